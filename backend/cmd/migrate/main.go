@@ -0,0 +1,68 @@
+// Command migrate applies, rolls back or lists the database migrations of pkg/migrations. It
+// reads the same DB_* settings as the server, which applies pending migrations itself unless
+// started with DB_MIGRATE=check or off.
+//
+//	go run ./cmd/migrate            # apply pending migrations
+//	go run ./cmd/migrate -status    # list migrations and when they were applied
+//	go run ./cmd/migrate -down 1    # roll back the latest migration
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"base-app/pkg/config"
+	"base-app/pkg/database"
+	"base-app/pkg/migrations"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	status := flag.Bool("status", false, "list migrations and when they were applied")
+	down := flag.Int("down", 0, "roll back this many of the latest applied migrations")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	db, err := database.OpenPostgres(cfg.Database.PrimaryDSN(), database.Options{}, logrus.StandardLogger())
+	if err != nil {
+		log.Fatal("DB connection failed: ", err)
+	}
+	defer db.Close()
+
+	runner, err := migrations.NewRunner(db, logrus.StandardLogger())
+	if err != nil {
+		log.Fatal("Invalid migrations: ", err)
+	}
+	ctx := context.Background()
+	switch {
+	case *status:
+		statuses, err := runner.Status(ctx)
+		if err != nil {
+			log.Fatal("Failed to read migrations: ", err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			log.Printf("%04d_%s: %s", s.Version, s.Name, applied)
+		}
+	case *down > 0:
+		versions, err := runner.Down(ctx, *down)
+		if err != nil {
+			log.Fatal("Rollback failed: ", err)
+		}
+		log.Printf("Rolled back %d migrations", len(versions))
+	default:
+		versions, err := runner.Up(ctx)
+		if err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		log.Printf("Applied %d migrations", len(versions))
+	}
+}
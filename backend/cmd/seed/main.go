@@ -0,0 +1,76 @@
+// Command seed fills a development database with demo roles, groups and users, built with
+// pkg/fixtures. It reads the same DB_* settings as the server. The migrations must have been
+// applied, by the server or cmd/migrate. Seeding again is harmless: existing rows are kept.
+//
+//	go run ./cmd/seed -admin-keycloak-id <sub of your Keycloak admin>
+//
+// Only local rows are created; log in as a seeded user through a Keycloak account whose ID
+// matches the user's keycloak_id.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"base-app/pkg/config"
+	"base-app/pkg/database"
+	"base-app/pkg/fixtures"
+	"base-app/pkg/perm"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	adminKeycloakID := flag.String("admin-keycloak-id", "kc-admin", "Keycloak user ID of the seeded admin")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	db, err := database.OpenPostgres(cfg.Database.PrimaryDSN(), database.Options{}, logrus.StandardLogger())
+	if err != nil {
+		log.Fatal("DB connection failed: ", err)
+	}
+	defer db.Close()
+
+	err = database.RunInTx(db, func(tx database.DBTX) error {
+		fx := fixtures.New(tx)
+		roles := []*fixtures.RoleBuilder{
+			fx.NewRole("admin").Description("Full access").WithPermissions(perm.All...),
+			fx.NewRole("user").Description("Regular user").WithPermissions(perm.ReadUser),
+			fx.NewRole("auditor").Description("Read-only access to security data").
+				WithPermissions(perm.ReadUser, perm.ReadRole, perm.ReadGroup, perm.ReadPermission, perm.ReadSecurityEvents, perm.ViewReports),
+		}
+		for _, role := range roles {
+			if _, err := role.Build(); err != nil {
+				return err
+			}
+		}
+		groups := []*fixtures.GroupBuilder{
+			fx.NewGroup("administrators").Description("Administrators").WithRoles("admin"),
+			fx.NewGroup("users").Description("All users").WithRoles("user"),
+			fx.NewGroup("auditors").Description("Security auditors").WithRoles("auditor"),
+		}
+		for _, group := range groups {
+			if _, err := group.Build(); err != nil {
+				return err
+			}
+		}
+		users := []*fixtures.UserBuilder{
+			fx.NewUser().Username("admin").KeycloakID(*adminKeycloakID).Name("Admin", "User").InGroup("administrators", "users"),
+			fx.NewUser().Username("alice").Name("Alice", "Example").InGroup("users"),
+			fx.NewUser().Username("bob").Name("Bob", "Example").InGroup("users", "auditors"),
+		}
+		for _, user := range users {
+			if _, err := user.Build(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Seeding failed: ", err)
+	}
+	log.Println("Seeded demo roles, groups and users")
+}
@@ -1,169 +1,911 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"base-app/modules/membership"
+	"base-app/modules/notification"
+	"base-app/modules/platform"
 	"base-app/modules/rbac"
+	"base-app/modules/security"
+	"base-app/modules/settings"
+	"base-app/modules/tenant"
+	"base-app/modules/usage"
 	"base-app/modules/user_management"
+	"base-app/pkg/apispec"
+	"base-app/pkg/audit"
+	"base-app/pkg/authevents"
+	"base-app/pkg/avatar"
+	"base-app/pkg/buildinfo"
+	"base-app/pkg/captcha"
+	"base-app/pkg/config"
+	"base-app/pkg/database"
+	"base-app/pkg/emailtemplates"
+	"base-app/pkg/errreport"
+	"base-app/pkg/fieldcrypt"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jobs"
+	"base-app/pkg/jsonschema"
+	"base-app/pkg/labels"
+	"base-app/pkg/logging"
+	"base-app/pkg/migrations"
+	"base-app/pkg/online"
+	"base-app/pkg/outbound"
+	"base-app/pkg/perm"
+	"base-app/pkg/profiling"
+	"base-app/pkg/quota"
+	"base-app/pkg/ratelimit"
+	"base-app/pkg/schemacheck"
+	"base-app/pkg/secrets"
+	"base-app/pkg/trash"
+	"base-app/pkg/uimanifest"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 )
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// loadKeycloakConfig reads keycloak.json and applies values from secret on top. The file is
+// optional when a secret manager supplies the settings.
+func loadKeycloakConfig(secret secrets.Secret) (user_management.KeycloakConfig, error) {
+	var kcConfig user_management.KeycloakConfig
+	file, err := os.Open("keycloak.json")
+	switch {
+	case err == nil:
+		defer file.Close()
+		if err := json.NewDecoder(file).Decode(&kcConfig); err != nil {
+			return kcConfig, err
+		}
+	case os.IsNotExist(err) && secret != nil:
+	default:
+		return kcConfig, err
 	}
-	return defaultValue
+
+	kcConfig.URL = secret.Get("url", kcConfig.URL)
+	kcConfig.Realm = secret.Get("realm", kcConfig.Realm)
+	kcConfig.ClientID = secret.Get("client_id", kcConfig.ClientID)
+	kcConfig.ClientSecret = secret.Get("client_secret", kcConfig.ClientSecret)
+	kcConfig.AdminUsername = secret.Get("admin_username", kcConfig.AdminUsername)
+	kcConfig.AdminPassword = secret.Get("admin_password", kcConfig.AdminPassword)
+	return kcConfig, nil
 }
 
-func loadKeycloakConfig() (user_management.KeycloakConfig, error) {
-	file, err := os.Open("keycloak.json")
-	if err != nil {
-		return user_management.KeycloakConfig{}, err
+// tokenRealms returns the realms whose tokens are accepted, or nil when only the primary realm
+// is configured and HMAC-signed tokens are accepted regardless of their issuer. With jwks the
+// RS256 tokens of each realm are verified with the public keys of its certs endpoint.
+func tokenRealms(kc user_management.KeycloakConfig, jwks bool, logger *logrus.Logger) []rbac.TokenRealm {
+	if len(kc.Realms) == 0 && !jwks {
+		return nil
+	}
+	realm := func(name, issuer, secret string) rbac.TokenRealm {
+		r := rbac.TokenRealm{Name: name, Issuer: issuer, Secret: secret}
+		if jwks {
+			r.JWKS = rbac.NewJWKS(rbac.CertsURL(issuer), outbound.Client(outbound.Keycloak), logger)
+		}
+		return r
 	}
-	defer file.Close()
+	realms := []rbac.TokenRealm{realm(kc.Realm, kc.Issuer(), "")}
+	for _, extra := range kc.Realms {
+		cfg, _ := kc.ForRealm(extra.Realm)
+		realms = append(realms, realm(extra.Realm, cfg.Issuer(), extra.JWTSecret))
+	}
+	return realms
+}
 
-	var config user_management.KeycloakConfig
-	err = json.NewDecoder(file).Decode(&config)
-	return config, err
+// encryptionKeys returns the column encryption keys from the secret when given, otherwise from
+// the environment. No keys means encryption at rest is disabled.
+func encryptionKeys(cfg config.EncryptionConfig, secret secrets.Secret) (string, map[string][]byte, error) {
+	primary, encoded := cfg.PrimaryKey, cfg.Keys
+	if secret != nil {
+		encoded = make(map[string]string, len(secret))
+		for id, key := range secret {
+			if id != "primary" {
+				encoded[id] = key
+			}
+		}
+		primary = secret.Get("primary", "")
+	}
+	if len(encoded) == 0 {
+		return "", nil, nil
+	}
+	keys, err := fieldcrypt.DecodeKeys(encoded)
+	return primary, keys, err
+}
+
+// rateLimitPolicy converts the runtime rate limit settings to a limiter policy
+func rateLimitPolicy(rt config.Runtime) ratelimit.Policy {
+	policy := ratelimit.Policy{
+		Default: ratelimit.Rule{Name: "default", Limit: rt.RateLimit, Window: rt.RateLimitWindow},
+		Rules:   make([]ratelimit.Rule, len(rt.RateLimitRules)),
+	}
+	for i, rule := range rt.RateLimitRules {
+		policy.Rules[i] = ratelimit.Rule(rule)
+	}
+	return policy
+}
+
+// uiCapabilities converts the configured UI capabilities for the manifest builder
+func uiCapabilities(rt config.Runtime) []uimanifest.Capability {
+	capabilities := make([]uimanifest.Capability, len(rt.UICapabilities))
+	for i, capability := range rt.UICapabilities {
+		capabilities[i] = uimanifest.Capability(capability)
+	}
+	return capabilities
 }
 
 func main() {
-	// DB connection from env
-	dbHost := getEnv("DB_HOST", "localhost")
-	dbPort := getEnv("DB_PORT", "5432")
-	dbUser := getEnv("DB_USER", "postgres")
-	dbPassword := getEnv("DB_PASSWORD", "postgres")
-	dbName := getEnv("DB_NAME", "baseapp")
-	dbSSLMode := getEnv("DB_SSLMODE", "disable")
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Invalid configuration:", err)
+	}
 
-	connStr := "host=" + dbHost + " port=" + dbPort + " user=" + dbUser + " password=" + dbPassword + " dbname=" + dbName + " sslmode=" + dbSSLMode
+	// Create loggers: JSON by default, level and per-module overrides from the environment
+	loggers, err := logging.New(cfg.Logging)
+	if err != nil {
+		log.Fatal("Invalid logging configuration:", err)
+	}
+	logger := loggers.Root()
 
-	db, err := sql.Open("postgres", connStr)
+	// Tunables (log levels, rate limits, CORS origins, feature flags) can be reloaded with SIGHUP
+	runtimeConfig, err := config.NewRuntimeStore(cfg.Runtime(), cfg.RuntimeConfigFile)
 	if err != nil {
-		log.Fatal("DB connection failed:", err)
-	}
-	defer db.Close()
-
-	if err := db.Ping(); err != nil {
-		log.Fatal("DB ping failed:", err)
-	}
-
-	// Create table if not exists
-	db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		id UUID PRIMARY KEY,
-		keycloak_id VARCHAR UNIQUE,
-		username VARCHAR UNIQUE,
-		email VARCHAR UNIQUE,
-		first_name VARCHAR,
-		last_name VARCHAR,
-		is_active BOOLEAN,
-		created_at TIMESTAMP,
-		updated_at TIMESTAMP
-	)`)
-
-	// Create RBAC tables
-	db.Exec(`CREATE TABLE IF NOT EXISTS roles (
-		id UUID PRIMARY KEY,
-		name VARCHAR UNIQUE NOT NULL,
-		description TEXT,
-		created_at TIMESTAMP NOT NULL
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS permissions (
-		id UUID PRIMARY KEY,
-		name VARCHAR UNIQUE NOT NULL,
-		resource VARCHAR NOT NULL,
-		action VARCHAR NOT NULL
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS role_permissions (
-		role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
-		permission_id UUID REFERENCES permissions(id) ON DELETE CASCADE,
-		PRIMARY KEY (role_id, permission_id)
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS role_groups (
-		id UUID PRIMARY KEY,
-		name VARCHAR UNIQUE NOT NULL,
-		description TEXT,
-		created_at TIMESTAMP NOT NULL
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS group_roles (
-		group_id UUID REFERENCES role_groups(id) ON DELETE CASCADE,
-		role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
-		PRIMARY KEY (group_id, role_id)
-	)`)
-
-	db.Exec(`CREATE TABLE IF NOT EXISTS user_group_memberships (
-		user_id UUID REFERENCES users(id) ON DELETE CASCADE,
-		group_id UUID REFERENCES role_groups(id) ON DELETE CASCADE,
-		assigned_at TIMESTAMP NOT NULL,
-		PRIMARY KEY (user_id, group_id)
-	)`)
-
-	// Create indexes for better performance
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_user_group_memberships_user_id ON user_group_memberships(user_id)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_group_roles_group_id ON group_roles(group_id)`)
-	db.Exec(`CREATE INDEX IF NOT EXISTS idx_role_permissions_role_id ON role_permissions(role_id)`)
-
-	// Insert default permissions
-	db.Exec(`INSERT INTO permissions (id, name, resource, action) VALUES
-		('550e8400-e29b-41d4-a716-446655440001', 'create_user', 'user', 'create'),
-		('550e8400-e29b-41d4-a716-446655440002', 'read_user', 'user', 'read'),
-		('550e8400-e29b-41d4-a716-446655440003', 'update_user', 'user', 'update'),
-		('550e8400-e29b-41d4-a716-446655440004', 'delete_user', 'user', 'delete'),
-		('550e8400-e29b-41d4-a716-446655440005', 'manage_roles', 'rbac', 'manage'),
-		('550e8400-e29b-41d4-a716-446655440006', 'view_reports', 'reports', 'read'),
-		('550e8400-e29b-41d4-a716-446655440007', 'manage_config', 'config', 'manage'),
-		('550e8400-e29b-41d4-a716-446655440008', 'create_role', 'role', 'create'),
-		('550e8400-e29b-41d4-a716-446655440009', 'read_role', 'role', 'read'),
-		('550e8400-e29b-41d4-a716-446655440010', 'update_role', 'role', 'update'),
-		('550e8400-e29b-41d4-a716-446655440011', 'delete_role', 'role', 'delete'),
-		('550e8400-e29b-41d4-a716-446655440012', 'create_group', 'group', 'create'),
-		('550e8400-e29b-41d4-a716-446655440013', 'read_group', 'group', 'read'),
-		('550e8400-e29b-41d4-a716-446655440014', 'update_group', 'group', 'update'),
-		('550e8400-e29b-41d4-a716-446655440015', 'delete_group', 'group', 'delete'),
-		('550e8400-e29b-41d4-a716-446655440016', 'manage_group_membership', 'group_membership', 'manage'),
-		('550e8400-e29b-41d4-a716-446655440017', 'manage_group_roles', 'group_roles', 'manage'),
-		('550e8400-e29b-41d4-a716-446655440018', 'read_permission', 'permission', 'read')
-		ON CONFLICT (id) DO NOTHING`)
-
-	// Load Keycloak config
-	keycloakConfig, err := loadKeycloakConfig()
+		logger.WithError(err).Fatal("Invalid runtime configuration")
+	}
+	if err := loggers.SetLevels(runtimeConfig.Current().LogLevel, runtimeConfig.Current().LogModuleLevels); err != nil {
+		logger.WithError(err).Fatal("Invalid runtime configuration")
+	}
+
+	// Calls to Keycloak, webhooks and other services go through the configured proxy and TLS
+	// settings, each within its timeout budget
+	if err := outbound.Configure(outbound.Options(cfg.Outbound)); err != nil {
+		logger.WithError(err).Fatal("Invalid outbound HTTP configuration")
+	}
+	// Every list endpoint pages within the same bounds, so no request can read a whole table
+	if err := httpapi.ConfigurePaging(httpapi.PageLimits{Default: cfg.Limits.DefaultPageSize, Max: cfg.Limits.MaxPageSize}); err != nil {
+		logger.WithError(err).Fatal("Invalid pagination configuration")
+	}
+
+	build := buildinfo.Get()
+	logger.WithFields(build.Fields()).Info("Starting Base-Application API")
+	logger.WithField("config", cfg.String()).Debug("Loaded configuration")
+
+	// Error reporting: Sentry when a DSN is configured; every Error-level log entry is reported
+	var reporter errreport.Reporter = errreport.Nop{}
+	if cfg.ErrorReporting.SentryDSN != "" {
+		sentryReporter, err := errreport.NewSentry(errreport.SentryOptions{
+			DSN:         cfg.ErrorReporting.SentryDSN,
+			Environment: cfg.ErrorReporting.Environment,
+			Release:     build.Version,
+		})
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid error reporting configuration")
+		}
+		reporter = sentryReporter
+		defer reporter.Flush(2 * time.Second)
+	}
+
+	// Credentials from a secret manager replace the plaintext env vars and keycloak.json values,
+	// and are re-fetched periodically so rotations apply without a restart
+	secretsProvider, err := secrets.New(context.Background(), cfg.Secrets)
 	if err != nil {
-		log.Fatal("Failed to load Keycloak config:", err)
+		logger.WithError(err).Fatal("Invalid secrets configuration")
 	}
+	var secretStore *secrets.Store
+	if secretsProvider != nil {
+		secretStore = secrets.NewStore(secretsProvider, loggers.For("secrets"))
+	}
+	loadSecret := func(name string) secrets.Secret {
+		if secretStore == nil || name == "" {
+			return nil
+		}
+		secret, err := secretStore.Load(context.Background(), name)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to load secret")
+		}
+		return secret
+	}
+	logger.AddHook(errreport.NewHook(reporter))
 
-	// Create logger
-	logger := logrus.New()
-	logger.SetLevel(logrus.InfoLevel)
+	// Demo runs bring their own throwaway database
+	if cfg.Database.Ephemeral != "" {
+		ephemeral, err := database.StartEphemeral(cfg.Database.Ephemeral, database.EphemeralOptions{Password: cfg.Database.Password})
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to start ephemeral Postgres")
+		}
+		logrus.RegisterExitHandler(func() { ephemeral.Stop() })
+		go func() {
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			<-signals
+			ephemeral.Stop()
+			os.Exit(0)
+		}()
+		if err := ephemeral.CreateDatabase(cfg.Database.Name); err != nil {
+			logger.WithError(err).Fatal("Failed to create database on ephemeral Postgres")
+		}
+		cfg.Database.Host, cfg.Database.Port, cfg.Database.User, cfg.Database.SSLMode = ephemeral.Host, ephemeral.Port, ephemeral.User, "disable"
+		cfg.Database.ReplicaDSNs = nil
+		logger.WithFields(logrus.Fields{"mode": cfg.Database.Ephemeral, "port": ephemeral.Port}).Warn("Using an ephemeral database; its data is lost on exit")
+	}
+
+	// DB connections: writes go to the primary, reads are spread over healthy replicas
+	dbOptions := database.Options{
+		SlowQueryThreshold:   cfg.Database.SlowQueryThreshold,
+		ConnStatementTimeout: cfg.Database.ConnStatementTimeout,
+	}
+	if loadSecret(cfg.Secrets.DatabaseSecret) != nil {
+		dbOptions.Credentials = func() (string, string) {
+			current := secretStore.Get(cfg.Secrets.DatabaseSecret)
+			return current.Get("username", cfg.Database.User), current.Get("password", cfg.Database.Password)
+		}
+	}
+	cluster, err := database.Open(cfg.Database.PrimaryDSN(), cfg.Database.ReplicaDSNs, dbOptions, loggers.For("database"))
+	if err != nil {
+		logger.WithError(err).Fatal("DB connection failed")
+	}
+	defer cluster.Close()
+
+	// The database may still be starting, e.g. when started alongside the API
+	db := cluster.Primary()
+	if err := cluster.WaitForPrimary(context.Background(), cfg.Database.ConnectTimeout); err != nil {
+		logger.WithError(err).Fatal("DB ping failed")
+	}
+
+	// Health checks notice lost and recovered databases, so a failover needs no restart
+	cluster.CheckReplicas(context.Background())
+	cluster.StartHealthChecks(context.Background(), cfg.Database.ReplicaHealthCheckInterval)
+
+	// The schema is created and upgraded by the versioned migrations of pkg/migrations. With
+	// DB_MIGRATE=check they are applied separately, with cmd/migrate.
+	migrator, err := migrations.NewRunner(db, loggers.For("database"))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid database migrations")
+	}
+	switch cfg.Database.Migrate {
+	case "up":
+		if _, err := migrator.Up(context.Background()); err != nil {
+			logger.WithError(err).Fatal("Database migration failed")
+		}
+	case "check":
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			logger.WithError(err).Fatal("Failed to read applied database migrations")
+		}
+		if len(pending) > 0 {
+			logger.WithField("pending", pending).Fatal("Database migrations are pending; apply them with cmd/migrate")
+		}
+	}
+
+	// Usernames and emails are unique regardless of letter case
+	if conflicts, err := user_management.EnsureCaseInsensitiveUniqueness(db); err != nil {
+		logger.WithError(err).Error("Failed to create case-insensitive user indexes")
+	} else {
+		for _, conflict := range conflicts {
+			logger.WithFields(logrus.Fields{
+				"column":   conflict.Column,
+				"value":    conflict.Value,
+				"user_ids": conflict.UserIDs,
+			}).Warn("Users differ only by letter case; resolve before case-insensitive uniqueness can be enforced")
+		}
+	}
+
+	// Tables edited by hand no longer match what the migrations create
+	if cfg.Database.SchemaDrift != "off" {
+		report, err := schemacheck.Check(db, schemacheck.Expected)
+		switch {
+		case err != nil:
+			logger.WithError(err).Error("Failed to check the database schema for drift")
+		case len(report) > 0 && cfg.Database.SchemaDrift == "fail":
+			logger.WithField("drift", report).Fatal("Database schema differs from the expected one:\n" + report.String())
+		case len(report) > 0:
+			logger.WithField("drift", report).Warn("Database schema differs from the expected one:\n" + report.String())
+		}
+	}
+
+	// Load Keycloak config; other identity providers do not need it, and without it logins are
+	// served locally unless a provider is chosen
+	identityProvider := cfg.Identity.Provider
+	keycloakConfig, err := loadKeycloakConfig(loadSecret(cfg.Secrets.KeycloakSecret))
+	switch {
+	case err == nil:
+		if identityProvider == "" {
+			identityProvider = "keycloak"
+		}
+	case os.IsNotExist(err) && identityProvider != "keycloak":
+		if identityProvider == "" {
+			identityProvider = "local"
+			logger.Warn("No Keycloak configured, serving logins locally")
+		}
+	default:
+		logger.WithError(err).Fatal("Failed to load Keycloak config")
+	}
+	// Phone numbers and custom attributes are encrypted at rest when keys are configured
+	var keyring *fieldcrypt.Keyring
+	primaryKey, keys, err := encryptionKeys(cfg.Encryption, loadSecret(cfg.Secrets.EncryptionSecret))
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid encryption keys")
+	}
+	if keys != nil {
+		if keyring, err = fieldcrypt.NewKeyring(primaryKey, keys); err != nil {
+			logger.WithError(err).Fatal("Invalid encryption keys")
+		}
+	}
+	reencrypt := func() {
+		encryptionLogger := loggers.For("encryption").WithField("primary_key", keyring.PrimaryKeyID())
+		n, err := user_management.ReencryptUsers(context.Background(), db, keyring, cfg.Encryption.ReencryptBatchSize)
+		if err != nil {
+			encryptionLogger.WithError(err).Error("Re-encryption of user data stopped")
+			return
+		}
+		if n > 0 {
+			encryptionLogger.WithField("rows", n).Info("Re-encrypted user data with the primary key")
+		}
+	}
 
 	// Create user repository and service
-	repo := user_management.NewUserRepository(db)
-	service := user_management.NewUserService(repo, keycloakConfig, logger)
+	var repo user_management.UserRepository
+	if keyring != nil {
+		repo = user_management.NewEncryptedUserRepository(db, cluster, keyring)
+		// Seal plaintext rows and rows under retired keys in the background
+		go reencrypt()
+	} else {
+		repo = user_management.NewUserRepositoryWithReader(db, cluster)
+	}
+	logger.WithField("keycloak", keycloakConfig.String()).Debug("Loaded Keycloak configuration")
+	service := user_management.NewUserService(repo, keycloakConfig, loggers.For("user_management"))
 
 	// Create RBAC repository and service
-	rbacRepo := rbac.NewRBACRepository(db)
-	rbacService := rbac.NewRBACService(rbacRepo, logger)
+	rbacRepo := rbac.NewRBACRepositoryWithReader(db, cluster)
+	rbacService := rbac.NewRBACService(rbacRepo, loggers.For("rbac"))
+
+	switch identityProvider {
+	case "oidc":
+		service.SetIdentityProvider(user_management.NewOIDCProvider(user_management.OIDCConfig{
+			IssuerURL:    cfg.Identity.OIDCIssuerURL,
+			ClientID:     cfg.Identity.OIDCClientID,
+			ClientSecret: cfg.Identity.OIDCClientSecret,
+		}, loggers.For("user_management")))
+	case "local":
+		// Local tokens live as long as denylist entries are kept, so revocations cover them
+		service.SetIdentityProvider(user_management.NewLocalProvider(db, rbacService.IssueToken, cfg.Denylist.TokenLifetime, loggers.For("user_management")))
+	}
+
+	// Modules declare their permissions in init; these belong to no module. Syncing upserts
+	// them all so the permissions table always matches the code.
+	rbac.RegisterPermissions(
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440006", Name: string(perm.ViewReports), Resource: "reports", Action: "read",
+			Category: "Reporting", Description: "View reports", RiskLevel: rbac.RiskLow},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440019", Name: string(perm.ManageSystem), Resource: "system", Action: "manage",
+			Category: "System", Description: "Profiling and other system operations", RiskLevel: rbac.RiskHigh},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440029", Name: string(perm.ReadAuditLog), Resource: "audit", Action: "read",
+			Category: "Monitoring", Description: "Review who created, changed and deleted users, roles and groups", RiskLevel: rbac.RiskLow},
+	)
+	if err := rbacService.SyncPermissions(); err != nil {
+		logger.WithError(err).Error("Failed to sync permissions")
+	}
+	// Checks of deprecated permissions are logged and also accept the permission replacing them
+	if err := rbacService.SyncDeprecations(); err != nil {
+		logger.WithError(err).Error("Failed to load permission deprecations")
+	}
+	rbacService.StartDeprecationSync(context.Background(), time.Minute)
+	// Registered users reach their own profile through the group every new user joins
+	if _, err := rbacService.Bootstrap(context.Background(), rbac.RegisteredUsersSpec()); err != nil {
+		logger.WithError(err).Error("Failed to set up the registered users group")
+	}
+	if cfg.RBACBootstrapFile != "" {
+		spec, err := rbac.LoadBootstrapSpec(cfg.RBACBootstrapFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid RBAC bootstrap file")
+		}
+		if _, err := rbacService.Bootstrap(context.Background(), spec); err != nil {
+			logger.WithError(err).Error("Failed to bootstrap RBAC")
+		}
+	}
+	if jwtSecret := loadSecret(cfg.Secrets.JWTSecret); jwtSecret != nil {
+		rbacService.SetJWTSecret(jwtSecret.Get("secret", ""))
+	}
+	// Keycloak signs its tokens with RS256; HMAC-signed tokens are only accepted from it when
+	// explicitly allowed for tests and development
+	jwks := cfg.Identity.JWKS && identityProvider == "keycloak"
+	if realms := tokenRealms(keycloakConfig, jwks, loggers.For("rbac")); realms != nil {
+		for _, realm := range realms {
+			if realm.JWKS == nil {
+				continue
+			}
+			if err := realm.JWKS.Refresh(context.Background()); err != nil {
+				logger.WithError(err).WithField("realm", realm.Name).Warn("Failed to load Keycloak signing keys, retrying on first use")
+			}
+		}
+		rbacService.SetTokenRealms(realms)
+	}
+	rbacService.SetAllowHMAC(cfg.Identity.AllowHMAC)
+
+	rateLimiter := ratelimit.New(rateLimitPolicy(runtimeConfig.Current()))
+	uiManifest := uimanifest.NewBuilder(uiCapabilities(runtimeConfig.Current()), func(name string) bool {
+		return runtimeConfig.Current().FeatureEnabled(name)
+	})
+	for _, capability := range runtimeConfig.Current().UICapabilities {
+		for _, name := range append(capability.AllOf, capability.AnyOf...) {
+			rbacService.ReferencePermissions("UI capability "+capability.Key, perm.Name(name))
+		}
+	}
+	// With the authz_decision_log feature on (e.g. through a SIGHUP reload), every authorization
+	// decision is logged under the "authz" module and kept for GET /api/rbac/decisions
+	rbacService.SetDecisionLogging(func() bool {
+		return runtimeConfig.Current().FeatureEnabled("authz_decision_log")
+	}, loggers.For("authz"))
+	runtimeConfig.Subscribe(func(rt config.Runtime) {
+		// Levels were validated before the swap, so this cannot fail
+		loggers.SetLevels(rt.LogLevel, rt.LogModuleLevels)
+		rateLimiter.SetPolicy(rateLimitPolicy(rt))
+		uiManifest.SetCapabilities(uiCapabilities(rt))
+	})
+	runtimeConfig.ReloadOnSignal(context.Background(), func(rt config.Runtime, err error) {
+		if err != nil {
+			logger.WithError(err).Error("Runtime configuration reload rejected, keeping current settings")
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"log_level":    rt.LogLevel,
+			"rate_limit":   rt.RateLimit,
+			"cors_origins": rt.CORSAllowedOrigins,
+			"features":     rt.Features,
+		}).Info("Runtime configuration reloaded")
+	})
+
+	if secretStore != nil {
+		secretStore.Watch(cfg.Secrets.KeycloakSecret, func(secret secrets.Secret) {
+			service.SetKeycloakCredentials(secret["client_secret"], secret["admin_username"], secret["admin_password"])
+		})
+		secretStore.Watch(cfg.Secrets.JWTSecret, func(secret secrets.Secret) {
+			rbacService.SetJWTSecret(secret.Get("secret", ""))
+		})
+		if keyring != nil {
+			secretStore.Watch(cfg.Secrets.EncryptionSecret, func(secret secrets.Secret) {
+				primaryKey, keys, err := encryptionKeys(cfg.Encryption, secret)
+				if err == nil {
+					err = keyring.SetKeys(primaryKey, keys)
+				}
+				if err != nil {
+					logger.WithError(err).Error("Rotated encryption keys rejected, keeping current keys")
+					return
+				}
+				go reencrypt()
+			})
+		}
+		secretStore.StartRefresh(context.Background(), cfg.Secrets.RefreshInterval)
+	}
+
+	// Alerts go to the configured webhook; anomaly detection watches failed logins and rejected tokens.
+	// Failed deliveries are kept as dead letters for inspection and replay.
+	var webhook notification.Notifier = notification.Nop{}
+	if cfg.Alerts.WebhookURL != "" {
+		webhook = notification.NewWebhook(cfg.Alerts.WebhookURL, cfg.Alerts.WebhookSecret)
+	}
+	deadLetters := notification.NewDeadLetters("alerts_webhook", webhook, notification.NewDeadLetterRepository(db), loggers.For("notification"))
+	var alerts notification.Notifier = deadLetters
+	anomalyDetector := security.NewAnomalyDetector(security.NewAnomalyRepository(db), alerts, security.Thresholds{
+		Window:   cfg.Anomaly.Window,
+		PerIP:    cfg.Anomaly.IPThreshold,
+		PerUser:  cfg.Anomaly.UserThreshold,
+		Cooldown: cfg.Anomaly.Cooldown,
+	}, loggers.For("security"))
+	rbacService.OnAuthFailure(anomalyDetector.Observe)
+	service.OnAuthFailure(anomalyDetector.Observe)
+
+	// Logins and registrations are also limited per username, and every rejected attempt is
+	// reported as a lockout so bursts show up as anomalies
+	accountLimiter := ratelimit.New(ratelimit.Policy{Default: ratelimit.Rule{
+		Name:   "account",
+		Limit:  cfg.BruteForce.AccountAttempts,
+		Window: cfg.BruteForce.AccountWindow,
+	}})
+	if cfg.BruteForce.AccountAttempts > 0 {
+		service.SetAccountLimiter(accountLimiter)
+	}
+	rateLimiter.OnReject(func(r *http.Request, decision ratelimit.Decision) {
+		if decision.Rule.Name == "login" || decision.Rule.Name == "register" {
+			anomalyDetector.Observe(r.Context(), authevents.Failure{
+				Kind: authevents.KindLockout,
+				Code: "RATE_LIMIT_EXCEEDED",
+				IP:   httpapi.ClientIP(r),
+				Path: r.URL.Path,
+			})
+		}
+	})
+
+	// Repeated failed logins from an IP or against an account require a CAPTCHA
+	if cfg.Captcha.Provider != "" {
+		verifier, err := captcha.New(cfg.Captcha.Provider, cfg.Captcha.Secret)
+		if err != nil {
+			logger.WithError(err).Fatal("Invalid CAPTCHA configuration")
+		}
+		service.SetLoginGuard(captcha.NewGuard(verifier, captcha.Thresholds{
+			Window:     cfg.Captcha.Window,
+			PerIP:      cfg.Captcha.IPThreshold,
+			PerAccount: cfg.Captcha.AccountThreshold,
+		}))
+	}
+
+	// Members and group managers are reminded before a time-limited membership expires; the
+	// webhook routes reminders to email and in-app delivery by notification type
+	expiryReminder := membership.NewReminder(membership.NewExpiryRepository(db), alerts,
+		time.Duration(cfg.Membership.NoticeDays)*24*time.Hour, loggers.For("membership"))
+	expiryReminder.Start(context.Background(), cfg.Membership.CheckInterval)
+
+	// Deactivating a user or removing them from a group ends their Keycloak sessions and
+	// rejects the tokens they already hold
+	rbacService.SetSessionRevoker(service)
+	rbacService.SetEventNotifier(alerts)
+	service.SetAccessRevoker(rbacService)
+	service.SetImpactAnalyzer(rbacService)
+
+	// New users join the groups administrators mapped to their email domain
+	service.SetGroupProvisioner(rbacService)
+
+	// New users then go through the configured welcome steps, in order
+	welcomeSteps, err := service.WelcomeSteps(cfg.Welcome.Steps, user_management.WelcomeOptions{
+		Preferences: cfg.Welcome.DefaultPreferences,
+		Notifier:    alerts,
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("Invalid welcome configuration")
+	}
+	service.SetWelcomeSteps(welcomeSteps...)
+
+	// Avatars fall back to Gravatar unless disabled for privacy, then to identicons
+	service.SetAvatars(avatar.New(avatar.Options{
+		Gravatar:    cfg.Avatar.Gravatar,
+		GravatarURL: cfg.Avatar.GravatarURL,
+		TTL:         cfg.Avatar.CacheTTL,
+	}))
+
+	// Support notes on user accounts, readable by holders of manage_user_notes
+	service.SetNoteRepository(user_management.NewNoteRepository(db, cluster))
+	// Views users save of the user and role lists
+	service.SetViewRepository(user_management.NewViewRepository(db, cluster))
+
+	// Logins from devices a user has not used before are announced through the alerts webhook
+	service.SetDeviceTracking(user_management.NewDeviceRepository(db, cluster), alerts)
+
+	// Subscribed administrators get daily or weekly RBAC change digests through the alerts
+	// webhook, addressed to their email
+	rbacService.SetDigestDelivery(alerts, func(ctx context.Context, userID string) (string, error) {
+		user, err := service.FindUserByKeycloakID(ctx, userID)
+		if err != nil {
+			return "", err
+		}
+		return user.Email, nil
+	})
+	emailTemplates := emailtemplates.NewService(emailtemplates.NewStore(db), loggers.For("emailtemplates"))
+	rbacService.SetDigestTemplates(emailTemplates)
+	rbacService.StartDigests(context.Background(), time.Hour)
+
+	// Passwordless login emails single-use codes; the tokens come from Keycloak token exchange or
+	// are signed here, per deployment
+	if cfg.Identity.MagicLink != "" {
+		var issuer user_management.MagicLinkIssuer
+		if cfg.Identity.MagicLink == "keycloak" {
+			if issuer, err = service.KeycloakMagicLinkIssuer(); err != nil {
+				logger.WithError(err).Fatal("MAGIC_LINK_LOGIN keycloak requires the Keycloak identity provider")
+			}
+		} else {
+			if jwks {
+				logger.Fatal("MAGIC_LINK_LOGIN local issues tokens Keycloak's keys cannot verify; use keycloak or disable JWT_JWKS")
+			}
+			issuer = user_management.NewLocalMagicLinkIssuer(rbacService.IssueToken, cfg.Denylist.TokenLifetime)
+		}
+		service.SetMagicLinks(user_management.NewMagicLinkRepository(db), user_management.MagicLinkOptions{
+			Issuer:    issuer,
+			Notifier:  alerts,
+			Templates: emailTemplates,
+			URL:       cfg.Identity.MagicLinkURL,
+			Lifetime:  cfg.Identity.MagicLinkLifetime,
+		})
+	}
+
+	// Callers exchange their Keycloak token for tokens of the configured downstream audiences
+	exchangePolicies := make([]user_management.ExchangePolicy, len(cfg.Identity.TokenExchange))
+	for i, policy := range cfg.Identity.TokenExchange {
+		exchangePolicies[i] = user_management.ExchangePolicy(policy)
+		rbacService.ReferencePermissions("token exchange to "+policy.Audience, perm.Name(policy.Permission))
+	}
+	service.SetTokenExchangePolicies(exchangePolicies)
+
+	// Reuse of a rotated refresh token ends its sessions and is raised as an anomaly
+	service.SetRefreshTokenTracking(user_management.NewRefreshTokenRepository(db))
+	service.StartRefreshTokenCleanup(context.Background(), time.Hour)
+
+	// Revoked tokens are shared between instances through the token_denylist table
+	rbacService.SetTokenLifetime(cfg.Denylist.TokenLifetime)
+	if err := rbacService.SyncDenylist(); err != nil {
+		logger.WithError(err).Error("Failed to load token denylist")
+	}
+	rbacService.StartDenylistSync(context.Background(), cfg.Denylist.RefreshInterval)
+
+	// Resolved permissions are cached per user; access changes made here invalidate them at once
+	if cfg.Permissions.TTL > 0 {
+		rbacService.SetPermissionCache(rbac.NewMemoryPermissionCache(cfg.Permissions.TTL, cfg.Permissions.MaxEntries))
+	}
+
+	// User objects only include contact details the caller may see
+	service.SetViewerResolver(rbacService.Viewer)
+
+	// Licensed quotas are checked when users, roles, groups and personal access tokens are created
+	quotas := quota.NewEnforcer()
+	quotas.Register(quota.Users, cfg.Quota.MaxUsers, quota.CountRows(db, `SELECT COUNT(*) FROM users WHERE is_active`))
+	quotas.Register(quota.Roles, cfg.Quota.MaxRoles, quota.CountRows(db, `SELECT COUNT(*) FROM roles`))
+	quotas.Register(quota.Groups, cfg.Quota.MaxGroups, quota.CountRows(db, `SELECT COUNT(*) FROM role_groups`))
+	quotas.Register(quota.APIKeys, cfg.Quota.MaxAPIKeys, quota.CountRows(db, `SELECT COUNT(*) FROM personal_access_tokens WHERE expires_at > NOW()`))
+	service.SetQuotaChecker(quotas)
+	rbacService.SetQuotaChecker(quotas)
+	rbacService.SetMaxListItems(cfg.Limits.MaxListItems)
+	rbacService.SetConfirmRoleDeletion(cfg.RBACConfirmRoleDeletion)
+
+	// Requests are counted per client and endpoint for GET /api/usage
+	usageRecorder := usage.NewRecorder(usage.NewUsageRepository(db), loggers.For("usage"))
+	usageRecorder.Start(context.Background(), cfg.Usage.FlushInterval)
+
+	// Long-running imports, exports and bulk assignments run as operations when clients send
+	// "Prefer: respond-async"
+	jobRunner := jobs.NewRunner(jobs.NewStore(db), loggers.For("jobs"))
+	jobRunner.Start(context.Background(), time.Minute)
+	service.SetJobRunner(jobRunner)
+	rbacService.SetJobRunner(jobRunner)
+	rbacService.StartAccessTracking(context.Background(), cfg.Usage.FlushInterval)
+
+	// Backfills of expand/contract schema changes update the users table in batches, so it is
+	// never locked as a whole; pending ones start with the server
+	backfills := online.NewBackfills(db, jobRunner, loggers.For("backfills"))
+	// Users created before multi-realm support live in the primary realm
+	backfills.Register(online.Backfill{
+		Name:        "users_realm",
+		Description: "Move users created before multi-realm support into the primary realm",
+		Table:       "users",
+		Set:         "realm = $1",
+		Where:       "realm = ''",
+		Args:        []interface{}{keycloakConfig.Realm},
+	})
+	backfills.StartPending(context.Background())
+
+	// Users, roles and groups can be labelled and their lists filtered with ?label=key:value
+	labelService := labels.NewService(labels.NewStore(db))
+	labelService.Register(labels.Kind{
+		Name: labels.KindUser, Path: "/api/users/{id}/labels", Read: perm.ReadUser, Update: perm.UpdateUser,
+		Exists: func(ctx context.Context, id string) (bool, error) {
+			user, err := service.GetProfile(ctx, id)
+			return user != nil, err
+		},
+	})
+	labelService.Register(labels.Kind{
+		Name: labels.KindRole, Path: "/api/rbac/roles/{id}/labels", Read: perm.ReadRole, Update: perm.UpdateRole,
+		Exists: func(_ context.Context, id string) (bool, error) {
+			role, err := rbacService.GetRole(id)
+			return role != nil, err
+		},
+	})
+	labelService.Register(labels.Kind{
+		Name: labels.KindGroup, Path: "/api/rbac/groups/{id}/labels", Read: perm.ReadGroup, Update: perm.UpdateGroup,
+		Exists: func(_ context.Context, id string) (bool, error) {
+			group, err := rbacService.GetRoleGroup(id)
+			return group != nil, err
+		},
+	})
+	service.SetLabels(labelService)
+	rbacService.SetLabels(labelService)
+
+	// Changes to users, roles and groups are recorded with their author in the audit log
+	auditLog := audit.NewLog(audit.NewStore(db), loggers.For("audit"))
+	service.SetAuditLog(auditLog)
+	rbacService.SetAuditLog(auditLog)
+
+	// Deleted users, roles and groups stay in the trash for 30 days
+	trashBin := trash.NewBin(trash.NewStore(db), loggers.For("trash"))
+	service.SetTrash(trashBin)
+	rbacService.SetTrash(trashBin)
+	trashBin.StartPurging(context.Background(), time.Hour)
+
+	// Create settings service; maintenance mode survives restarts because it is loaded from the DB
+	settingsService := settings.NewSettingsService(settings.NewSettingsRepository(db), loggers.For("settings"))
+	if err := settingsService.Refresh(); err != nil {
+		logger.WithError(err).Error("Failed to load settings")
+	}
+	settingsService.StartRefresh(context.Background(), cfg.SettingsRefreshInterval)
+
+	// Public registration can be closed, made invite-only or limited to email domains at runtime
+	service.SetRegistrationGate(settingsService)
+
+	// Tenants are provisioned with their own roles and groups; the invitation of a tenant's first
+	// administrator lets them register whatever the registration gate says
+	tenantTemplate := tenant.DefaultTemplate
+	if cfg.TenantBootstrapFile != "" {
+		if tenantTemplate, err = tenant.LoadTemplate(cfg.TenantBootstrapFile); err != nil {
+			logger.WithError(err).Fatal("Invalid tenant bootstrap file")
+		}
+	}
+	tenantService := tenant.NewService(tenant.NewTenantRepository(db), rbacService, tenantTemplate, loggers.For("tenant"))
+	tenantService.SetInviteDelivery(alerts, emailTemplates, cfg.TenantRegisterURL)
+	service.SetInvitations(tenantService)
+
+	// The hosting operator suspends tenants, sees their usage and acts in their admin context
+	// from the platform console; tokens of a suspended tenant are turned away
+	if err := tenantService.Refresh(); err != nil {
+		logger.WithError(err).Error("Failed to load suspended tenants")
+	}
+	tenantService.StartRefresh(context.Background(), cfg.SettingsRefreshInterval)
+	rbacService.SetTenantStatus(tenantService)
+	usageRecorder.SetTenantIdentifier(rbacService.Tenant)
+	platformConsole := platform.NewConsole(tenantService, rbacService, usageRecorder, loggers.For("platform"))
+
+	// Administrators choose the profile fields users must fill in after logging in
+	service.SetProfileRequirements(settingsService)
 
 	r := mux.NewRouter()
 
+	// Request IDs and access logs come first so every later entry can carry them
+	r.Use(logging.RequestMiddleware(loggers.For("http")))
+
+	// Each request has a deadline, which Keycloak and other outbound calls made for it inherit
+	r.Use(httpapi.Deadline(cfg.RequestTimeout))
+
+	// Database transactions begun for a request cap their statements at its budget and deadline
+	r.Use(httpapi.StatementTimeout(cfg.Database.StatementTimeout))
+
+	// Panics become 500s and are reported with the request's context
+	r.Use(errreport.Recover(reporter, loggers.For("http")))
+
+	// Usage is recorded before rate limiting so rejected requests show up too
+	r.Use(usageRecorder.Middleware(rbacService.ClientID))
+
+	// Requests over their route's or client tier's budget are turned away before any work is done
+	r.Use(rateLimiter.Middleware(rbacService.RateLimitClient))
+
+	// Large JSON responses are gzip/deflate encoded for clients that accept it
+	if cfg.Compression.Enabled {
+		r.Use(httpapi.Compress(httpapi.CompressionOptions{
+			MinSize:      cfg.Compression.MinSize,
+			Level:        cfg.Compression.Level,
+			RouteMinSize: cfg.Compression.RouteMinSize,
+		}))
+	}
+
+	// During maintenance only admins (and health checks) get through
+	r.Use(settings.MaintenanceMiddleware(settingsService, func(r *http.Request) bool {
+		return rbacService.RequestHasPermission(r, settings.AdminPermission)
+	}))
+
+	// Request bodies are checked against schemas derived from the request structs while the
+	// request_schema_validation feature flag is on
+	schemas := jsonschema.NewRegistry()
+	user_management.RegisterSchemas(schemas)
+	rbac.RegisterSchemas(schemas)
+	settings.RegisterSchemas(schemas)
+	r.Use(schemas.Middleware(func() bool {
+		return runtimeConfig.Current().FeatureEnabled("request_schema_validation")
+	}))
+
+	// Authenticate routes protected with rbacService.Protect; runs last so rejected requests are
+	// still logged, counted and rate limited
+	r.Use(rbacService.AuthMiddleware())
+
+	// Users missing a required profile field are sent to their profile while the policy is enforced
+	r.Use(user_management.ProfileCompletionMiddleware(service))
+
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := map[string]interface{}{
+			"status":      "ok",
+			"maintenance": settingsService.Maintenance().Enabled,
+			"version":     build.Version,
+			"git_sha":     build.GitSHA,
+		}
+		// Degraded still serves reads, so the instance stays ready; only an unreachable
+		// database takes it out of rotation
+		cluster.CheckPrimary(r.Context())
+		health := cluster.Health()
+		status["database"] = health
+		code := http.StatusOK
+		if health.Status != database.HealthOK {
+			status["status"] = health.Status
+		}
+		if health.Status == database.HealthUnavailable {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}).Methods("GET")
+
+	// Version, git SHA and build time of the running binary, public like /health
+	r.HandleFunc(buildinfo.Path, buildinfo.Handler()).Methods("GET")
+
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Base-Application API"))
 	})
 
-	user_management.SetupRoutes(r, service)
+	user_management.SetupRoutes(r, service, rbacService)
 	rbac.SetupRoutes(r, rbacService)
+	settings.SetupRoutes(r, settingsService, rbacService)
+	security.SetupRoutes(r, anomalyDetector, rbacService)
+	usage.SetupRoutes(r, usageRecorder, rbacService)
+	membership.SetupRoutes(r, expiryReminder, rbacService)
+	tenant.SetupRoutes(r, tenantService, rbacService)
+	platform.SetupRoutes(r, platformConsole, rbacService)
+	quota.Mount(r, quotas, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(usage.ReadPermission, handler)
+	})
+	ratelimit.Mount(r, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(security.ReadPermission, handler)
+	}, rateLimiter, accountLimiter)
+	// Any signed-in user may fetch their own manifest
+	notification.MountDeadLetters(r, deadLetters, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(perm.ManageSystem, handler)
+	})
+	// Any signed-in user may follow the operations they started
+	jobs.Mount(r, jobRunner, rbacService.Viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission("", handler)
+	})
+	labels.Mount(r, labelService, rbacService.RequirePermission)
+	online.Mount(r, backfills, rbacService.Viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(perm.ManageSystem, handler)
+	})
+	emailtemplates.Mount(r, emailTemplates, rbacService.Viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(perm.ManageConfig, handler)
+	})
+	audit.Mount(r, auditLog, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission(perm.ReadAuditLog, handler)
+	})
+	// Each trash item also requires the delete permission of its kind
+	trash.Mount(r, trashBin, rbacService.Viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission("", handler)
+	})
+	uimanifest.Mount(r, uiManifest, rbacService.Viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		return rbacService.RequirePermission("", handler)
+	})
+
+	// Profiling is off by default; when enabled it still requires manage_system
+	if cfg.PprofEnabled {
+		profiling.Mount(r, func(handler http.HandlerFunc) http.HandlerFunc {
+			return rbacService.RequirePermission(perm.ManageSystem, handler)
+		})
+		logger.Warn("pprof endpoints enabled at " + profiling.PathPrefix)
+	}
+
+	// Every route is mounted now: permissions checked but missing, or registered but never
+	// checked, are a typo or dead code that would otherwise surface as 403s
+	if cfg.PermissionCheck != "off" {
+		report, err := rbacService.CheckPermissionReferences()
+		switch {
+		case err != nil:
+			logger.WithError(err).Error("Failed to check permission references")
+		case !report.Empty() && cfg.PermissionCheck == "fail":
+			logger.WithField("permissions", report).Fatal("Routes and permissions disagree:\n" + report.String())
+		case !report.Empty():
+			logger.WithField("permissions", report).Warn("Routes and permissions disagree:\n" + report.String())
+		}
+	}
+
+	// The API surface of this build, as OpenAPI and TypeScript types for the frontend to pin
+	apiDoc, err := apispec.Build(r, schemas, func(route *mux.Route) (string, bool) {
+		permission, ok := rbacService.RoutePermission(route)
+		return string(permission), ok
+	}, apispec.Info{Title: "Base-Application", Version: build.Version})
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to describe the API")
+	}
+	clientArtifacts, err := apispec.Generate(apiDoc)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed to generate API client artifacts")
+	}
+	apispec.Mount(r, clientArtifacts)
 
-	port := getEnv("PORT", "8090")
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	logger.WithField("port", cfg.Port).Info("Server starting")
+	// CORS wraps the router so preflight requests are answered before route matching
+	handler := httpapi.CORS(func() []string { return runtimeConfig.Current().CORSAllowedOrigins })(r)
+	logger.WithError(http.ListenAndServe(":"+cfg.Port, handler)).Fatal("Server stopped")
 }
@@ -0,0 +1,175 @@
+// Package auth carries the authenticated caller through request contexts and provides the
+// middleware modules protect their routes with. Tokens are verified and permissions loaded by an
+// Authorizer, the RBAC service in this application; modules only depend on this package to
+// authenticate requests and read who is calling.
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+)
+
+// ContextKey is used to store the caller's identity in request contexts
+type ContextKey string
+
+// Context keys of the caller's identity; read them with the functions below
+const (
+	UserIDKey      ContextKey = "user_id"
+	UsernameKey    ContextKey = "username"
+	PermissionsKey ContextKey = "user_permissions"
+	RolesKey       ContextKey = "user_roles"
+	SessionKey     ContextKey = "session"
+	RealmKey       ContextKey = "realm"
+)
+
+// Session identifies the Keycloak login session and client a caller's token was issued for
+type Session struct {
+	ID       string
+	ClientID string
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	// UserID is the subject of the caller's token, their Keycloak ID
+	UserID   string
+	Username string
+	// Permissions and Roles are the keys of the caller's effective permissions and roles
+	Permissions []string
+	Roles       []string
+	Session     Session
+	// Realm is the configured Keycloak realm that issued the token
+	Realm string
+}
+
+// WithIdentity returns ctx carrying identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	ctx = context.WithValue(ctx, UserIDKey, identity.UserID)
+	ctx = context.WithValue(ctx, UsernameKey, identity.Username)
+	ctx = context.WithValue(ctx, PermissionsKey, identity.Permissions)
+	ctx = context.WithValue(ctx, RolesKey, identity.Roles)
+	ctx = context.WithValue(ctx, SessionKey, identity.Session)
+	return context.WithValue(ctx, RealmKey, identity.Realm)
+}
+
+// FromContext returns the authenticated caller in ctx; ok is false for anonymous requests
+func FromContext(ctx context.Context) (identity Identity, ok bool) {
+	identity.UserID = UserID(ctx)
+	identity.Username, _ = ctx.Value(UsernameKey).(string)
+	identity.Permissions = Permissions(ctx)
+	identity.Roles, _ = ctx.Value(RolesKey).([]string)
+	identity.Session = SessionFromContext(ctx)
+	identity.Realm = Realm(ctx)
+	return identity, identity.UserID != ""
+}
+
+// UserID returns the ID of the authenticated caller in ctx, or "" if none
+func UserID(ctx context.Context) string {
+	userID, _ := ctx.Value(UserIDKey).(string)
+	return userID
+}
+
+// Username returns the username of the authenticated caller in ctx, or "" if none
+func Username(ctx context.Context) string {
+	username, _ := ctx.Value(UsernameKey).(string)
+	return username
+}
+
+// Permissions returns the permission keys of the authenticated caller in ctx
+func Permissions(ctx context.Context) []string {
+	if permissions, ok := ctx.Value(PermissionsKey).([]string); ok {
+		return permissions
+	}
+	return []string{}
+}
+
+// HasPermission reports whether the authenticated caller in ctx holds permission
+func HasPermission(ctx context.Context, permission perm.Name) bool {
+	return contains(Permissions(ctx), string(permission))
+}
+
+// HasRole reports whether the authenticated caller in ctx has the role whose key is role
+func HasRole(ctx context.Context, role string) bool {
+	roles, _ := ctx.Value(RolesKey).([]string)
+	return contains(roles, role)
+}
+
+// SessionFromContext returns the Keycloak session of the authenticated caller; its ID is empty
+// for tokens not issued by an interactive login, such as service account tokens
+func SessionFromContext(ctx context.Context) Session {
+	session, _ := ctx.Value(SessionKey).(Session)
+	return session
+}
+
+// Realm returns the Keycloak realm of the caller's token, or "" for the default realm
+func Realm(ctx context.Context) string {
+	realm, _ := ctx.Value(RealmKey).(string)
+	return realm
+}
+
+// Authorizer verifies the bearer token of requests and loads the caller's permissions
+type Authorizer interface {
+	// Authorize authenticates r and checks permission (none when empty), writing the error
+	// response when either fails. On success it returns r carrying the caller's Identity.
+	Authorize(w http.ResponseWriter, r *http.Request, permission perm.Name) (*http.Request, bool)
+	// Forbid rejects the authenticated caller of r for lacking required, writing a 403
+	Forbid(w http.ResponseWriter, r *http.Request, required string)
+}
+
+// Authenticate requires a valid bearer token. Requests already authenticated by earlier
+// middleware are not checked again.
+func Authenticate(a Authorizer) mux.MiddlewareFunc {
+	return RequirePermission(a, "")
+}
+
+// RequirePermission requires a valid bearer token for a caller holding permission
+func RequirePermission(a Authorizer, permission perm.Name) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if UserID(r.Context()) != "" {
+				if permission == "" || HasPermission(r.Context(), permission) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			r, ok := a.Authorize(w, r, permission)
+			if !ok {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole requires a valid bearer token for a caller with the role whose key is role. Prefer
+// RequirePermission: roles are regrouped by administrators, permissions are not.
+func RequireRole(a Authorizer, role string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if UserID(r.Context()) == "" {
+				var ok bool
+				if r, ok = a.Authorize(w, r, ""); !ok {
+					return
+				}
+			}
+			if !HasRole(r.Context(), role) {
+				a.Forbid(w, r, "role "+role)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"base-app/pkg/perm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAuthorizer accepts the bearer token "valid" for a caller with the identity it holds
+type fakeAuthorizer struct {
+	identity  Identity
+	calls     int
+	forbidden []string
+}
+
+func (a *fakeAuthorizer) Authorize(w http.ResponseWriter, r *http.Request, permission perm.Name) (*http.Request, bool) {
+	a.calls++
+	if r.Header.Get("Authorization") != "Bearer valid" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return r, false
+	}
+	r = r.WithContext(WithIdentity(r.Context(), a.identity))
+	if permission != "" && !HasPermission(r.Context(), permission) {
+		w.WriteHeader(http.StatusForbidden)
+		return r, false
+	}
+	return r, true
+}
+
+func (a *fakeAuthorizer) Forbid(w http.ResponseWriter, r *http.Request, required string) {
+	a.forbidden = append(a.forbidden, required)
+	w.WriteHeader(http.StatusForbidden)
+}
+
+func serve(middleware func(http.Handler) http.Handler, token string) (int, Identity) {
+	var seen Identity
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = FromContext(r.Context())
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr.Code, seen
+}
+
+func TestMiddlewareInjectsIdentity(t *testing.T) {
+	a := &fakeAuthorizer{identity: Identity{
+		UserID: "kc-1", Username: "alice", Permissions: []string{"read_user"}, Roles: []string{"support"},
+		Session: Session{ID: "s1", ClientID: "web"},
+	}}
+
+	code, identity := serve(Authenticate(a), "valid")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, a.identity, identity)
+
+	code, _ = serve(Authenticate(a), "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = serve(RequirePermission(a, perm.ReadUser), "valid")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = serve(RequirePermission(a, perm.DeleteUser), "valid")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = serve(RequireRole(a, "support"), "valid")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = serve(RequireRole(a, "admin"), "valid")
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, []string{"role admin"}, a.forbidden)
+}
+
+func TestMiddlewareReusesEarlierAuthentication(t *testing.T) {
+	a := &fakeAuthorizer{identity: Identity{UserID: "kc-1", Permissions: []string{"read_user"}}}
+	handler := Authenticate(a)(RequirePermission(a, perm.ReadUser)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer valid")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, 1, a.calls)
+
+	_, ok := FromContext(context.Background())
+	assert.False(t, ok)
+}
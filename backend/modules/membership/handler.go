@@ -0,0 +1,208 @@
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ManagePermission is held by group managers; they are told about expiring memberships and may
+// extend or snooze them
+const ManagePermission = perm.ManageGroupMembership
+
+// NotificationType identifies expiry reminders sent through the notifier
+const NotificationType = "rbac.membership_expiring"
+
+// Channels the delivery side should use for expiry reminders
+var reminderChannels = []string{"email", "in_app"}
+
+// reminderBatchSize bounds the reminders sent per run; the rest follow on the next run
+const reminderBatchSize = 200
+
+// Reminder sends a notification to the member and the group managers when a time-limited
+// membership is about to expire. Each membership is reminded once; extending it re-arms the
+// reminder and snoozing it delays the reminder.
+type Reminder struct {
+	repo     ExpiryRepository
+	notifier notification.Notifier
+	logger   *logrus.Logger
+	// notice is how long before expiry the reminder is sent
+	notice time.Duration
+	now    func() time.Time
+}
+
+// NewReminder creates a new expiry reminder
+func NewReminder(repo ExpiryRepository, notifier notification.Notifier, notice time.Duration, logger *logrus.Logger) *Reminder {
+	return &Reminder{
+		repo:     repo,
+		notifier: notifier,
+		logger:   logger,
+		notice:   notice,
+		now:      time.Now,
+	}
+}
+
+// Run sends the reminders that are due and returns how many were sent. A reminder that fails
+// to send is retried on the next run.
+func (rem *Reminder) Run(ctx context.Context) (int, error) {
+	now := rem.now()
+	due, err := rem.repo.DueReminders(now, now.Add(rem.notice), reminderBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("list expiring memberships: %w", err)
+	}
+	if len(due) == 0 {
+		return 0, nil
+	}
+	managers, err := rem.repo.GroupManagers(string(ManagePermission))
+	if err != nil {
+		return 0, fmt.Errorf("list group managers: %w", err)
+	}
+
+	sent := 0
+	for _, m := range due {
+		logger := rem.logger.WithFields(logrus.Fields{"user_id": m.UserID, "group_id": m.GroupID})
+		if err := rem.notifier.Notify(ctx, reminderFor(m, managers, now)); err != nil {
+			logger.WithError(err).Error("Failed to send membership expiry reminder")
+			continue
+		}
+		if err := rem.repo.MarkReminded(m.UserID, m.GroupID, now); err != nil {
+			logger.WithError(err).Error("Failed to record membership expiry reminder")
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// reminderFor builds the notification for one expiring membership
+func reminderFor(m ExpiringMembership, managers []string, now time.Time) notification.Notification {
+	recipients := []string{m.UserID}
+	for _, id := range managers {
+		if id != m.UserID {
+			recipients = append(recipients, id)
+		}
+	}
+	days := int(m.ExpiresAt.Sub(now).Hours() / 24)
+	return notification.Notification{
+		Type:     NotificationType,
+		Severity: notification.SeverityInfo,
+		Subject:  fmt.Sprintf("Membership of %s in %s expires soon", m.Username, m.GroupName),
+		Message:  fmt.Sprintf("The membership of %s in group %s expires on %s (in %d days).", m.Username, m.GroupName, m.ExpiresAt.UTC().Format(time.RFC1123), days),
+		Data: map[string]interface{}{
+			"user_id":    m.UserID,
+			"username":   m.Username,
+			"group_id":   m.GroupID,
+			"group_name": m.GroupName,
+			"expires_at": m.ExpiresAt,
+			"recipients": recipients,
+			"channels":   reminderChannels,
+		},
+		OccurredAt: now,
+	}
+}
+
+// Start runs the reminder every interval until ctx is cancelled
+func (rem *Reminder) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := rem.Run(ctx); err != nil {
+					rem.logger.WithError(err).Error("Failed to send membership expiry reminders")
+				}
+			}
+		}
+	}()
+}
+
+// ExpiryRequest extends a membership to a new expiry or snoozes its reminder; exactly one field is set
+type ExpiryRequest struct {
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	SnoozeDays int        `json:"snooze_days,omitempty"`
+}
+
+// UpdateExpiry extends or snoozes the membership of userID in groupID and returns its new state
+func (rem *Reminder) UpdateExpiry(userID, groupID string, req ExpiryRequest) (*Expiry, error) {
+	if (req.ExpiresAt == nil) == (req.SnoozeDays == 0) {
+		return nil, &rbac.ValidationError{Field: "expires_at", Message: "set either expires_at or snooze_days"}
+	}
+	if req.SnoozeDays < 0 || req.SnoozeDays > 365 {
+		return nil, &rbac.ValidationError{Field: "snooze_days", Message: "must be between 1 and 365"}
+	}
+
+	current, err := rem.repo.Get(userID, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, apperrors.NotFound("MEMBERSHIP_NOT_FOUND", "user not in group")
+	}
+
+	now := rem.now()
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			return nil, &rbac.ValidationError{Field: "expires_at", Message: "must be in the future"}
+		}
+		err = rem.repo.Extend(userID, groupID, *req.ExpiresAt)
+	} else {
+		if current.ExpiresAt == nil {
+			return nil, apperrors.Conflict("MEMBERSHIP_NOT_TIME_LIMITED", "membership does not expire")
+		}
+		err = rem.repo.Snooze(userID, groupID, now.AddDate(0, 0, req.SnoozeDays))
+	}
+	if err != nil {
+		rem.logger.WithError(err).Error("Failed to update membership expiry")
+		return nil, err
+	}
+
+	rem.logger.WithFields(logrus.Fields{"user_id": userID, "group_id": groupID}).Info("Membership expiry updated")
+	return rem.repo.Get(userID, groupID)
+}
+
+// HTTP Handlers
+
+// UpdateExpiryHandler handles PUT /api/rbac/groups/{id}/users/{userId}/expiry
+func UpdateExpiryHandler(rem *Reminder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		var req ExpiryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		expiry, err := rem.UpdateExpiry(vars["userId"], vars["id"], req)
+		if err != nil {
+			if ve, ok := err.(*rbac.ValidationError); ok {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to update membership expiry")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(expiry)
+	}
+}
+
+// SetupRoutes configures the membership expiry routes
+func SetupRoutes(r *mux.Router, rem *Reminder, rbacService *rbac.RBACService) {
+	rbacService.Protect(r.HandleFunc("/api/rbac/groups/{id}/users/{userId}/expiry", UpdateExpiryHandler(rem)).Methods("PUT"), ManagePermission)
+}
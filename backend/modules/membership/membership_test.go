@@ -0,0 +1,150 @@
+package membership
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"base-app/modules/notification"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeExpiryRepo struct {
+	due      []ExpiringMembership
+	managers []string
+	reminded []string
+	expiries map[string]*Expiry
+}
+
+func (r *fakeExpiryRepo) DueReminders(now, before time.Time, limit int) ([]ExpiringMembership, error) {
+	return r.due, nil
+}
+
+func (r *fakeExpiryRepo) MarkReminded(userID, groupID string, at time.Time) error {
+	r.reminded = append(r.reminded, userID+"/"+groupID)
+	return nil
+}
+
+func (r *fakeExpiryRepo) GroupManagers(managePermission string) ([]string, error) {
+	return r.managers, nil
+}
+
+func (r *fakeExpiryRepo) Get(userID, groupID string) (*Expiry, error) {
+	return r.expiries[userID+"/"+groupID], nil
+}
+
+func (r *fakeExpiryRepo) Extend(userID, groupID string, expiresAt time.Time) error {
+	e := r.expiries[userID+"/"+groupID]
+	e.ExpiresAt, e.SnoozedUntil, e.RemindedAt = &expiresAt, nil, nil
+	return nil
+}
+
+func (r *fakeExpiryRepo) Snooze(userID, groupID string, until time.Time) error {
+	e := r.expiries[userID+"/"+groupID]
+	e.SnoozedUntil, e.RemindedAt = &until, nil
+	return nil
+}
+
+type recordingNotifier struct {
+	sent []notification.Notification
+	fail map[string]bool
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, msg notification.Notification) error {
+	if n.fail[msg.Data["user_id"].(string)] {
+		return errors.New("webhook unavailable")
+	}
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+var testNow = time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+func newTestReminder(repo *fakeExpiryRepo, notifier notification.Notifier) *Reminder {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rem := NewReminder(repo, notifier, 7*24*time.Hour, logger)
+	rem.now = func() time.Time { return testNow }
+	return rem
+}
+
+func TestRunNotifiesMemberAndManagers(t *testing.T) {
+	repo := &fakeExpiryRepo{
+		due: []ExpiringMembership{
+			{UserID: "u1", Username: "alice", GroupID: "g1", GroupName: "contractors", ExpiresAt: testNow.Add(72 * time.Hour)},
+			{UserID: "u2", Username: "bob", GroupID: "g1", GroupName: "contractors", ExpiresAt: testNow.Add(96 * time.Hour)},
+		},
+		managers: []string{"admin", "u1"},
+	}
+	notifier := &recordingNotifier{fail: map[string]bool{"u2": true}}
+
+	sent, err := newTestReminder(repo, notifier).Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	require.Len(t, notifier.sent, 1)
+	msg := notifier.sent[0]
+	assert.Equal(t, NotificationType, msg.Type)
+	assert.Contains(t, msg.Message, "in 3 days")
+	assert.Equal(t, []string{"u1", "admin"}, msg.Data["recipients"])
+	assert.Equal(t, []string{"u1/g1"}, repo.reminded, "failed reminders are retried on the next run")
+}
+
+func TestUpdateExpiryHandler(t *testing.T) {
+	expiresAt := testNow.Add(48 * time.Hour)
+	repo := &fakeExpiryRepo{expiries: map[string]*Expiry{
+		"u1/g1": {UserID: "u1", GroupID: "g1", ExpiresAt: &expiresAt, RemindedAt: &testNow},
+		"u2/g1": {UserID: "u2", GroupID: "g1"},
+	}}
+	r := mux.NewRouter()
+	r.HandleFunc("/api/rbac/groups/{id}/users/{userId}/expiry", UpdateExpiryHandler(newTestReminder(repo, &recordingNotifier{}))).Methods("PUT")
+
+	put := func(userID, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/rbac/groups/g1/users/"+userID+"/expiry", strings.NewReader(body)))
+		return w
+	}
+
+	w := put("u1", `{"snooze_days": 3}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, testNow.AddDate(0, 0, 3), *repo.expiries["u1/g1"].SnoozedUntil)
+	assert.Nil(t, repo.expiries["u1/g1"].RemindedAt)
+
+	w = put("u1", `{"expires_at": "2024-06-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"expires_at":"2024-06-01T00:00:00Z"`)
+	assert.Nil(t, repo.expiries["u1/g1"].SnoozedUntil)
+
+	assert.Equal(t, http.StatusConflict, put("u2", `{"snooze_days": 3}`).Code, "permanent memberships have no reminder to snooze")
+	assert.Equal(t, http.StatusNotFound, put("u3", `{"snooze_days": 3}`).Code)
+	for _, body := range []string{`{}`, `{"snooze_days": 3, "expires_at": "2024-06-01T00:00:00Z"}`, `{"expires_at": "2020-01-01T00:00:00Z"}`, `{"snooze_days": 400}`} {
+		assert.Equal(t, http.StatusBadRequest, put("u1", body).Code, body)
+	}
+}
+
+func TestExpiryRepositoryDueReminders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	before := testNow.Add(7 * 24 * time.Hour)
+	mock.ExpectQuery(`SELECT ugm.user_id, u.username, ugm.group_id, g.name, ugm.expires_at .* AND ugm.expiry_reminded_at IS NULL`).
+		WithArgs(testNow, before, 10).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "group_id", "name", "expires_at"}).
+			AddRow("u1", "alice", "g1", "contractors", testNow.Add(time.Hour)))
+
+	due, err := NewExpiryRepository(db).DueReminders(testNow, before, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []ExpiringMembership{{UserID: "u1", Username: "alice", GroupID: "g1", GroupName: "contractors", ExpiresAt: testNow.Add(time.Hour)}}, due)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
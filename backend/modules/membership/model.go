@@ -0,0 +1,135 @@
+package membership
+
+import (
+	"database/sql"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// ExpiringMembership is a time-limited group membership due for an expiry reminder
+type ExpiringMembership struct {
+	UserID    string    `json:"user_id" db:"user_id"`
+	Username  string    `json:"username" db:"username"`
+	GroupID   string    `json:"group_id" db:"group_id"`
+	GroupName string    `json:"group_name" db:"group_name"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// Expiry is the expiry state of one membership
+type Expiry struct {
+	UserID    string     `json:"user_id" db:"user_id"`
+	GroupID   string     `json:"group_id" db:"group_id"`
+	ExpiresAt *time.Time `json:"expires_at" db:"expires_at"`
+	// SnoozedUntil delays the expiry reminder
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty" db:"expiry_snoozed_until"`
+	RemindedAt   *time.Time `json:"reminded_at,omitempty" db:"expiry_reminded_at"`
+}
+
+// ExpiryRepository interface defines methods for membership expiry data access
+type ExpiryRepository interface {
+	// DueReminders returns unreminded, unsnoozed memberships expiring after now and no later than
+	// before, soonest first
+	DueReminders(now, before time.Time, limit int) ([]ExpiringMembership, error)
+	// MarkReminded records that the reminder for a membership was sent
+	MarkReminded(userID, groupID string, at time.Time) error
+	// GroupManagers returns the active members holding managePermission, who manage every group
+	GroupManagers(managePermission string) ([]string, error)
+	// Get returns a membership's expiry state, or nil when the user is not in the group
+	Get(userID, groupID string) (*Expiry, error)
+	// Extend sets a new expiry and re-arms the reminder
+	Extend(userID, groupID string, expiresAt time.Time) error
+	// Snooze delays the reminder until the given time
+	Snooze(userID, groupID string, until time.Time) error
+}
+
+// expiryRepository implements ExpiryRepository
+type expiryRepository struct {
+	db database.DBTX
+}
+
+// NewExpiryRepository creates a new expiry repository
+func NewExpiryRepository(db *sql.DB) ExpiryRepository {
+	return &expiryRepository{db: db}
+}
+
+func (r *expiryRepository) DueReminders(now, before time.Time, limit int) ([]ExpiringMembership, error) {
+	query := `SELECT ugm.user_id, u.username, ugm.group_id, g.name, ugm.expires_at
+	          FROM user_group_memberships ugm
+	          JOIN users u ON u.id = ugm.user_id
+	          JOIN role_groups g ON g.id = ugm.group_id
+	          WHERE ugm.expires_at > $1 AND ugm.expires_at <= $2
+	            AND ugm.expiry_reminded_at IS NULL
+	            AND (ugm.expiry_snoozed_until IS NULL OR ugm.expiry_snoozed_until <= $1)
+	          ORDER BY ugm.expires_at
+	          LIMIT $3`
+	return database.QueryAll(r.db, "list expiring memberships", scanExpiringMembership, query, now, before, limit)
+}
+
+func scanExpiringMembership(row database.Scanner) (ExpiringMembership, error) {
+	var m ExpiringMembership
+	err := row.Scan(&m.UserID, &m.Username, &m.GroupID, &m.GroupName, &m.ExpiresAt)
+	return m, err
+}
+
+func (r *expiryRepository) MarkReminded(userID, groupID string, at time.Time) error {
+	query := `UPDATE user_group_memberships SET expiry_reminded_at = $3 WHERE user_id = $1 AND group_id = $2`
+	_, err := r.db.Exec(query, userID, groupID, at)
+	return err
+}
+
+func (r *expiryRepository) GroupManagers(managePermission string) ([]string, error) {
+	query := `SELECT DISTINCT ugm.user_id
+	          FROM user_group_memberships ugm
+	          JOIN group_roles gr ON gr.group_id = ugm.group_id
+	          JOIN role_permissions rp ON rp.role_id = gr.role_id
+	          JOIN permissions p ON p.id = rp.permission_id
+	          WHERE p.key = $1 AND (ugm.expires_at IS NULL OR ugm.expires_at > NOW())
+	          ORDER BY ugm.user_id`
+	return database.QueryAll(r.db, "list group managers", func(row database.Scanner) (string, error) {
+		var userID string
+		err := row.Scan(&userID)
+		return userID, err
+	}, query, managePermission)
+}
+
+func (r *expiryRepository) Get(userID, groupID string) (*Expiry, error) {
+	query := `SELECT user_id, group_id, expires_at, expiry_snoozed_until, expiry_reminded_at
+	          FROM user_group_memberships WHERE user_id = $1 AND group_id = $2`
+	var e Expiry
+	var expiresAt, snoozedUntil, remindedAt sql.NullTime
+	err := r.db.QueryRow(query, userID, groupID).Scan(&e.UserID, &e.GroupID, &expiresAt, &snoozedUntil, &remindedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.ExpiresAt = nullTime(expiresAt)
+	e.SnoozedUntil = nullTime(snoozedUntil)
+	e.RemindedAt = nullTime(remindedAt)
+	return &e, nil
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (r *expiryRepository) Extend(userID, groupID string, expiresAt time.Time) error {
+	query := `UPDATE user_group_memberships
+	          SET expires_at = $3, expiry_reminded_at = NULL, expiry_snoozed_until = NULL
+	          WHERE user_id = $1 AND group_id = $2`
+	_, err := r.db.Exec(query, userID, groupID, expiresAt)
+	return err
+}
+
+func (r *expiryRepository) Snooze(userID, groupID string, until time.Time) error {
+	query := `UPDATE user_group_memberships
+	          SET expiry_snoozed_until = $3, expiry_reminded_at = NULL
+	          WHERE user_id = $1 AND group_id = $2`
+	_, err := r.db.Exec(query, userID, groupID, until)
+	return err
+}
@@ -0,0 +1,394 @@
+package notification
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of a dead letter
+const (
+	// DeadLetterPending is a delivery that failed and was not replayed successfully yet
+	DeadLetterPending = "pending"
+	// DeadLetterReplayed is a delivery that succeeded on replay
+	DeadLetterReplayed = "replayed"
+	// DeadLetterDiscarded is a delivery an operator gave up on
+	DeadLetterDiscarded = "discarded"
+)
+
+// previewLength bounds the message preview shown in dead letter lists
+const previewLength = 120
+
+// DeadLetterPath is where dead letters are served
+const DeadLetterPath = "/api/dead-letters"
+
+// DeliveryAttempt is one failed delivery of a dead letter
+type DeliveryAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// DeadLetter is a notification whose delivery failed, kept for inspection and replay
+type DeadLetter struct {
+	ID           string       `json:"id"`
+	Channel      string       `json:"channel"`
+	Type         string       `json:"type"`
+	Status       string       `json:"status"`
+	Notification Notification `json:"notification"`
+	// Attempts lists the failed deliveries, oldest first
+	Attempts   []DeliveryAttempt `json:"attempts"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	ReplayedAt *time.Time        `json:"replayed_at,omitempty"`
+}
+
+// DeadLetterSummary is a dead letter in lists, with a preview instead of the full payload
+type DeadLetterSummary struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Type      string    `json:"type"`
+	Status    string    `json:"status"`
+	Subject   string    `json:"subject"`
+	Preview   string    `json:"preview"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeadLetterRepository interface defines methods for dead letter data access
+type DeadLetterRepository interface {
+	// Add stores a new dead letter
+	Add(dl *DeadLetter) error
+	// List returns one page of dead letters with status, newest first, and their number
+	List(status string, limit, offset int) ([]DeadLetterSummary, int, error)
+	// Get returns the dead letter with id, or nil when there is none
+	Get(id string) (*DeadLetter, error)
+	// Update saves the status, attempts and replay time of a dead letter
+	Update(dl *DeadLetter) error
+}
+
+// deadLetterRepository implements DeadLetterRepository
+type deadLetterRepository struct {
+	db database.DBTX
+}
+
+// NewDeadLetterRepository creates a new dead letter repository
+func NewDeadLetterRepository(db *sql.DB) DeadLetterRepository {
+	return &deadLetterRepository{db: db}
+}
+
+func (r *deadLetterRepository) Add(dl *DeadLetter) error {
+	payload, err := json.Marshal(dl.Notification)
+	if err != nil {
+		return err
+	}
+	attempts, err := json.Marshal(dl.Attempts)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO dead_letters (id, channel, type, status, payload, attempts, created_at, updated_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err = r.db.Exec(query, dl.ID, dl.Channel, dl.Type, dl.Status, string(payload), string(attempts), dl.CreatedAt, dl.UpdatedAt)
+	return err
+}
+
+func (r *deadLetterRepository) List(status string, limit, offset int) ([]DeadLetterSummary, int, error) {
+	var total int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM dead_letters WHERE status = $1`, status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := `SELECT id, channel, type, status, payload, attempts, created_at, updated_at
+	          FROM dead_letters WHERE status = $1
+	          ORDER BY created_at DESC, id
+	          LIMIT $2 OFFSET $3`
+	summaries, err := database.QueryAll(r.db, "list dead letters", func(row database.Scanner) (DeadLetterSummary, error) {
+		dl, err := scanDeadLetter(row)
+		if err != nil {
+			return DeadLetterSummary{}, err
+		}
+		return dl.summary(), nil
+	}, query, status, limit, offset)
+	return summaries, total, err
+}
+
+func (r *deadLetterRepository) Get(id string) (*DeadLetter, error) {
+	query := `SELECT id, channel, type, status, payload, attempts, created_at, updated_at, replayed_at
+	          FROM dead_letters WHERE id = $1`
+	var dl DeadLetter
+	var payload, attempts []byte
+	var replayedAt sql.NullTime
+	err := r.db.QueryRow(query, id).Scan(&dl.ID, &dl.Channel, &dl.Type, &dl.Status, &payload, &attempts, &dl.CreatedAt, &dl.UpdatedAt, &replayedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := dl.decode(payload, attempts); err != nil {
+		return nil, err
+	}
+	if replayedAt.Valid {
+		dl.ReplayedAt = &replayedAt.Time
+	}
+	return &dl, nil
+}
+
+func (r *deadLetterRepository) Update(dl *DeadLetter) error {
+	attempts, err := json.Marshal(dl.Attempts)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE dead_letters SET status = $2, attempts = $3, updated_at = $4, replayed_at = $5 WHERE id = $1`
+	_, err = r.db.Exec(query, dl.ID, dl.Status, string(attempts), dl.UpdatedAt, dl.ReplayedAt)
+	return err
+}
+
+func scanDeadLetter(row database.Scanner) (*DeadLetter, error) {
+	var dl DeadLetter
+	var payload, attempts []byte
+	if err := row.Scan(&dl.ID, &dl.Channel, &dl.Type, &dl.Status, &payload, &attempts, &dl.CreatedAt, &dl.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := dl.decode(payload, attempts); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+func (dl *DeadLetter) decode(payload, attempts []byte) error {
+	if err := json.Unmarshal(payload, &dl.Notification); err != nil {
+		return err
+	}
+	return json.Unmarshal(attempts, &dl.Attempts)
+}
+
+func (dl *DeadLetter) summary() DeadLetterSummary {
+	s := DeadLetterSummary{
+		ID:        dl.ID,
+		Channel:   dl.Channel,
+		Type:      dl.Type,
+		Status:    dl.Status,
+		Subject:   dl.Notification.Subject,
+		Preview:   dl.Notification.Message,
+		Attempts:  len(dl.Attempts),
+		CreatedAt: dl.CreatedAt,
+		UpdatedAt: dl.UpdatedAt,
+	}
+	if runes := []rune(s.Preview); len(runes) > previewLength {
+		s.Preview = string(runes[:previewLength]) + "…"
+	}
+	if len(dl.Attempts) > 0 {
+		s.LastError = dl.Attempts[len(dl.Attempts)-1].Error
+	}
+	return s
+}
+
+// DeadLetters delivers notifications through a channel and keeps the ones that fail, so they
+// can be inspected and replayed instead of being lost
+type DeadLetters struct {
+	channel string
+	next    Notifier
+	repo    DeadLetterRepository
+	logger  *logrus.Logger
+	now     func() time.Time
+}
+
+// NewDeadLetters wraps next, the notifier of channel (e.g. "alerts_webhook")
+func NewDeadLetters(channel string, next Notifier, repo DeadLetterRepository, logger *logrus.Logger) *DeadLetters {
+	return &DeadLetters{channel: channel, next: next, repo: repo, logger: logger, now: time.Now}
+}
+
+// Notify delivers n and stores it as a dead letter when delivery fails. The delivery error is
+// still returned, so callers can log it as before.
+func (d *DeadLetters) Notify(ctx context.Context, n Notification) error {
+	if n.OccurredAt.IsZero() {
+		n.OccurredAt = d.now().UTC()
+	}
+	err := d.next.Notify(ctx, n)
+	if err == nil {
+		return nil
+	}
+
+	now := d.now()
+	dl := &DeadLetter{
+		ID:           uuid.New().String(),
+		Channel:      d.channel,
+		Type:         n.Type,
+		Status:       DeadLetterPending,
+		Notification: n,
+		Attempts:     []DeliveryAttempt{{At: now, Error: err.Error()}},
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	logger := d.logger.WithContext(ctx).WithFields(logrus.Fields{"channel": d.channel, "type": n.Type})
+	if addErr := d.repo.Add(dl); addErr != nil {
+		logger.WithError(addErr).Error("Failed to store dead letter; the notification is lost")
+	} else {
+		logger.WithError(err).WithField("dead_letter_id", dl.ID).Warn("Notification delivery failed; kept as a dead letter")
+	}
+	return err
+}
+
+// List returns one page of dead letters with status
+func (d *DeadLetters) List(status string, page httpapi.Page) ([]DeadLetterSummary, int, error) {
+	summaries, total, err := d.repo.List(status, page.Limit, page.Offset)
+	if err != nil {
+		d.logger.WithError(err).Error("Failed to list dead letters")
+		return nil, 0, err
+	}
+	return summaries, total, nil
+}
+
+// Get returns the dead letter with id, or a not found error
+func (d *DeadLetters) Get(id string) (*DeadLetter, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, apperrors.NotFound("DEAD_LETTER_NOT_FOUND", "dead letter not found")
+	}
+	dl, err := d.repo.Get(id)
+	if err != nil {
+		d.logger.WithError(err).Error("Failed to get dead letter")
+		return nil, err
+	}
+	if dl == nil {
+		return nil, apperrors.NotFound("DEAD_LETTER_NOT_FOUND", "dead letter not found")
+	}
+	return dl, nil
+}
+
+// Replay delivers a pending dead letter again. On success it is marked replayed; on failure
+// the error is added to its attempts and it stays pending.
+func (d *DeadLetters) Replay(ctx context.Context, id string) (*DeadLetter, error) {
+	dl, err := d.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if dl.Status != DeadLetterPending {
+		return nil, apperrors.Conflict("DEAD_LETTER_NOT_PENDING", "the dead letter is already "+dl.Status)
+	}
+
+	deliveryErr := d.next.Notify(ctx, dl.Notification)
+	now := d.now()
+	dl.UpdatedAt = now
+	if deliveryErr != nil {
+		dl.Attempts = append(dl.Attempts, DeliveryAttempt{At: now, Error: deliveryErr.Error()})
+	} else {
+		dl.Status, dl.ReplayedAt = DeadLetterReplayed, &now
+	}
+	if err := d.repo.Update(dl); err != nil {
+		d.logger.WithContext(ctx).WithError(err).WithField("dead_letter_id", id).Error("Failed to record dead letter replay")
+		return nil, err
+	}
+
+	logger := d.logger.WithContext(ctx).WithFields(logrus.Fields{"dead_letter_id": id, "channel": dl.Channel})
+	if deliveryErr != nil {
+		logger.WithError(deliveryErr).Warn("Dead letter replay failed")
+	} else {
+		logger.Info("Dead letter replayed")
+	}
+	return dl, nil
+}
+
+// Discard gives up on a pending dead letter
+func (d *DeadLetters) Discard(ctx context.Context, id string) error {
+	dl, err := d.Get(id)
+	if err != nil {
+		return err
+	}
+	if dl.Status != DeadLetterPending {
+		return apperrors.Conflict("DEAD_LETTER_NOT_PENDING", "the dead letter is already "+dl.Status)
+	}
+	dl.Status, dl.UpdatedAt = DeadLetterDiscarded, d.now()
+	if err := d.repo.Update(dl); err != nil {
+		d.logger.WithContext(ctx).WithError(err).WithField("dead_letter_id", id).Error("Failed to discard dead letter")
+		return err
+	}
+	d.logger.WithContext(ctx).WithField("dead_letter_id", id).Info("Dead letter discarded")
+	return nil
+}
+
+// ListDeadLettersHandler handles GET /api/dead-letters, filtered by ?status= (default pending)
+func ListDeadLettersHandler(d *DeadLetters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		switch status {
+		case "":
+			status = DeadLetterPending
+		case DeadLetterPending, DeadLetterReplayed, DeadLetterDiscarded:
+		default:
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid status parameter", "VALIDATION_ERROR", map[string]string{"status": "must be one of: pending, replayed, discarded"})
+			return
+		}
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		summaries, total, err := d.List(status, page)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list dead letters")
+			return
+		}
+		if summaries == nil {
+			summaries = []DeadLetterSummary{}
+		}
+		httpapi.WriteList(w, r, summaries, total, page)
+	}
+}
+
+// GetDeadLetterHandler handles GET /api/dead-letters/{id}, with the full payload and error history
+func GetDeadLetterHandler(d *DeadLetters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dl, err := d.Get(mux.Vars(r)["id"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get dead letter")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dl)
+	}
+}
+
+// ReplayDeadLetterHandler handles POST /api/dead-letters/{id}/replay. It answers the dead letter;
+// its status says whether the replay was delivered.
+func ReplayDeadLetterHandler(d *DeadLetters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dl, err := d.Replay(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to replay dead letter")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dl)
+	}
+}
+
+// DiscardDeadLetterHandler handles DELETE /api/dead-letters/{id}
+func DiscardDeadLetterHandler(d *DeadLetters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := d.Discard(r.Context(), mux.Vars(r)["id"]); err != nil {
+			httpapi.WriteError(w, err, "Failed to discard dead letter")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MountDeadLetters registers the dead letter endpoints under DeadLetterPath, wrapped by protect
+func MountDeadLetters(r *mux.Router, d *DeadLetters, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(DeadLetterPath, protect(ListDeadLettersHandler(d))).Methods("GET")
+	r.HandleFunc(DeadLetterPath+"/{id}", protect(GetDeadLetterHandler(d))).Methods("GET")
+	r.HandleFunc(DeadLetterPath+"/{id}", protect(DiscardDeadLetterHandler(d))).Methods("DELETE")
+	r.HandleFunc(DeadLetterPath+"/{id}/replay", protect(ReplayDeadLetterHandler(d))).Methods("POST")
+}
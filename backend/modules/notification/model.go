@@ -0,0 +1,34 @@
+package notification
+
+import (
+	"context"
+	"time"
+)
+
+// Severity levels
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Notification is an event delivered to operators or users through a Notifier
+type Notification struct {
+	// Type identifies the event, e.g. "security.anomaly"
+	Type       string                 `json:"type"`
+	Severity   string                 `json:"severity"`
+	Subject    string                 `json:"subject"`
+	Message    string                 `json:"message"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	OccurredAt time.Time              `json:"occurred_at"`
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Nop drops every notification; it is used when no channel is configured
+type Nop struct{}
+
+func (Nop) Notify(context.Context, Notification) error { return nil }
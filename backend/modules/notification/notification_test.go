@@ -0,0 +1,163 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookPostsSignedJSON(t *testing.T) {
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, Sign("s3cret", body), r.Header.Get(SignatureHeader))
+		require.NoError(t, json.Unmarshal(body, &received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	err := NewWebhook(server.URL, "s3cret").Notify(context.Background(), Notification{
+		Type:     "security.anomaly",
+		Severity: SeverityWarning,
+		Subject:  "Auth failure spike",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "security.anomaly", received.Type)
+	assert.False(t, received.OccurredAt.IsZero())
+}
+
+func TestWebhookFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	err := NewWebhook(server.URL, "").Notify(context.Background(), Notification{Type: "test"})
+	assert.Error(t, err)
+}
+
+// memoryDeadLetters keeps dead letters in memory
+type memoryDeadLetters struct {
+	letters map[string]DeadLetter
+}
+
+func (m *memoryDeadLetters) Add(dl *DeadLetter) error {
+	m.letters[dl.ID] = *dl
+	return nil
+}
+
+func (m *memoryDeadLetters) List(status string, limit, offset int) ([]DeadLetterSummary, int, error) {
+	var summaries []DeadLetterSummary
+	for _, dl := range m.letters {
+		if dl.Status == status {
+			summaries = append(summaries, dl.summary())
+		}
+	}
+	return summaries, len(summaries), nil
+}
+
+func (m *memoryDeadLetters) Get(id string) (*DeadLetter, error) {
+	dl, ok := m.letters[id]
+	if !ok {
+		return nil, nil
+	}
+	return &dl, nil
+}
+
+func (m *memoryDeadLetters) Update(dl *DeadLetter) error {
+	m.letters[dl.ID] = *dl
+	return nil
+}
+
+// flakyNotifier fails while err is set
+type flakyNotifier struct {
+	err       error
+	delivered []Notification
+}
+
+func (f *flakyNotifier) Notify(_ context.Context, n Notification) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.delivered = append(f.delivered, n)
+	return nil
+}
+
+func newTestDeadLetters(next Notifier) (*DeadLetters, *memoryDeadLetters) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	repo := &memoryDeadLetters{letters: make(map[string]DeadLetter)}
+	return NewDeadLetters("alerts_webhook", next, repo, logger), repo
+}
+
+func TestDeadLettersKeepFailedDeliveriesForReplay(t *testing.T) {
+	next := &flakyNotifier{err: errors.New("webhook returned 502 Bad Gateway")}
+	d, repo := newTestDeadLetters(next)
+
+	err := d.Notify(context.Background(), Notification{Type: "security.anomaly", Subject: "Spike", Message: strings.Repeat("x", 200)})
+	require.Error(t, err, "the delivery error is still returned")
+
+	summaries, _, err := repo.List(DeadLetterPending, 50, 0)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	id := summaries[0].ID
+	assert.Equal(t, "webhook returned 502 Bad Gateway", summaries[0].LastError)
+	assert.Len(t, []rune(summaries[0].Preview), previewLength+1, "the message is shortened to a preview")
+
+	dl, err := d.Replay(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterPending, dl.Status, "a failed replay leaves it pending")
+	assert.Len(t, dl.Attempts, 2)
+
+	next.err = nil
+	dl, err = d.Replay(context.Background(), id)
+	require.NoError(t, err)
+	assert.Equal(t, DeadLetterReplayed, dl.Status)
+	assert.NotNil(t, dl.ReplayedAt)
+	require.Len(t, next.delivered, 1)
+	assert.Equal(t, "Spike", next.delivered[0].Subject)
+
+	_, err = d.Replay(context.Background(), id)
+	assert.True(t, apperrors.IsConflict(err), "replayed letters are not delivered twice")
+}
+
+func TestDeadLettersHandlers(t *testing.T) {
+	d, _ := newTestDeadLetters(&flakyNotifier{err: errors.New("connection refused")})
+	d.Notify(context.Background(), Notification{Type: "rbac.access_revoked", Subject: "Access revoked"})
+
+	router := mux.NewRouter()
+	MountDeadLetters(router, d, func(h http.HandlerFunc) http.HandlerFunc { return h })
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	w := serve(http.MethodGet, DeadLetterPath)
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Data []DeadLetterSummary `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Data, 1)
+	id := list.Data[0].ID
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, DeadLetterPath+"/"+id).Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, DeadLetterPath+"/"+id+"/replay").Code)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, DeadLetterPath+"/"+id).Code)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPost, DeadLetterPath+"/"+id+"/replay").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, DeadLetterPath+"/nope").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, DeadLetterPath+"?status=lost").Code)
+}
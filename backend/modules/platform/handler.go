@@ -0,0 +1,217 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/modules/tenant"
+	"base-app/modules/usage"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	rbac.RegisterPermissions(
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440024", Name: string(perm.PlatformImpersonate), Resource: "platform", Action: "impersonate",
+			Category: "Platform", Description: "Act in the admin context of any tenant", RiskLevel: rbac.RiskHigh},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440025", Name: string(perm.PlatformReadUsage), Resource: "platform", Action: "read_usage",
+			Category: "Platform", Description: "View the API usage of every tenant", RiskLevel: rbac.RiskLow},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440026", Name: string(perm.PlatformSuspend), Resource: "platform", Action: "suspend",
+			Category: "Platform", Description: "Suspend and resume tenants", RiskLevel: rbac.RiskHigh},
+	)
+}
+
+// Impersonator issues tokens acting in a tenant's admin context
+type Impersonator interface {
+	Impersonate(ctx context.Context, tenant string, roles []string) (*rbac.Impersonation, error)
+}
+
+// UsageSummarizer summarizes the API usage of tenants
+type UsageSummarizer interface {
+	TenantSummaries(since time.Time, tenant string) ([]usage.TenantSummary, error)
+}
+
+// Console is the hosting operator's console across tenants: acting in a tenant's admin context,
+// per-tenant usage and suspending tenants. Its routes require the platform_admin_ permissions,
+// which tenant roles never grant.
+type Console struct {
+	tenants     *tenant.Service
+	impersonate Impersonator
+	usage       UsageSummarizer
+	logger      *logrus.Logger
+	now         func() time.Time
+}
+
+// NewConsole creates a new platform console
+func NewConsole(tenants *tenant.Service, impersonate Impersonator, usage UsageSummarizer, logger *logrus.Logger) *Console {
+	return &Console{
+		tenants:     tenants,
+		impersonate: impersonate,
+		usage:       usage,
+		logger:      logger,
+		now:         time.Now,
+	}
+}
+
+// TenantUsage is the usage of one tenant with its state
+type TenantUsage struct {
+	Tenant    *tenant.Tenant      `json:"tenant"`
+	Since     time.Time           `json:"since"`
+	Usage     usage.TenantSummary `json:"usage"`
+	Suspended bool                `json:"suspended"`
+}
+
+// Impersonate issues the caller a token acting in the admin context of the tenant slug
+func (c *Console) Impersonate(ctx context.Context, slug string) (*rbac.Impersonation, error) {
+	t, err := c.tenants.Get(slug)
+	if err != nil {
+		return nil, err
+	}
+	return c.impersonate.Impersonate(ctx, t.Slug, c.tenants.AdminRoles(t))
+}
+
+// Usage returns the usage of the tenant slug since the given time
+func (c *Console) Usage(slug string, since time.Time) (*TenantUsage, error) {
+	t, err := c.tenants.Get(slug)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := c.usage.TenantSummaries(since, t.Slug)
+	if err != nil {
+		return nil, err
+	}
+	result := &TenantUsage{Tenant: t, Since: since, Usage: usage.TenantSummary{Tenant: t.Slug}, Suspended: t.SuspendedAt != nil}
+	if len(summaries) > 0 {
+		result.Usage = summaries[0]
+	}
+	return result, nil
+}
+
+// HTTP Handlers
+
+// parseSince reads the since query parameter as a lookback duration, 24h by default, writing a
+// 400 when it is invalid
+func (c *Console) parseSince(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	lookback := 24 * time.Hour
+	if value := r.URL.Query().Get("since"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid since parameter", "VALIDATION_ERROR", map[string]string{"since": "must be a positive duration such as 24h"})
+			return time.Time{}, false
+		}
+		lookback = d
+	}
+	return c.now().Add(-lookback), true
+}
+
+// ListUsageHandler handles GET /api/platform/tenants/usage?since=24h
+func ListUsageHandler(c *Console) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, ok := c.parseSince(w, r)
+		if !ok {
+			return
+		}
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+		summaries, err := c.usage.TenantSummaries(since, "")
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get tenant usage")
+			return
+		}
+		if summaries == nil {
+			summaries = []usage.TenantSummary{}
+		}
+		httpapi.WriteList(w, r, httpapi.Paginate(summaries, page), len(summaries), page)
+	}
+}
+
+// UsageHandler handles GET /api/platform/tenants/{slug}/usage?since=24h
+func UsageHandler(c *Console) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, ok := c.parseSince(w, r)
+		if !ok {
+			return
+		}
+		result, err := c.Usage(mux.Vars(r)["slug"], since)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get tenant usage")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// ImpersonateHandler handles POST /api/platform/tenants/{slug}/impersonate
+func ImpersonateHandler(c *Console) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		impersonation, err := c.Impersonate(r.Context(), mux.Vars(r)["slug"])
+		if err != nil {
+			if ve, ok := err.(*rbac.ValidationError); ok {
+				httpapi.WriteErrorResponse(w, http.StatusConflict, ve.Error(), "TENANT_HAS_NO_ADMIN_ROLES", nil)
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to impersonate tenant admin")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(impersonation)
+	}
+}
+
+// SuspendHandler handles POST /api/platform/tenants/{slug}/suspend
+func SuspendHandler(c *Console) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req tenant.SuspendRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+		t, err := c.tenants.Suspend(r.Context(), mux.Vars(r)["slug"], req, rbac.UserIDFromContext(r.Context()))
+		if err != nil {
+			var fieldErrs validator.ValidationErrors
+			if errors.As(err, &fieldErrs) {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", map[string]string{"reason": "is required and at most 500 characters"})
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to suspend tenant")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// ResumeHandler handles POST /api/platform/tenants/{slug}/resume
+func ResumeHandler(c *Console) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := c.tenants.Resume(r.Context(), mux.Vars(r)["slug"], rbac.UserIDFromContext(r.Context()))
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to resume tenant")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// SetupRoutes configures the platform console routes
+func SetupRoutes(r *mux.Router, c *Console, rbacService *rbac.RBACService) {
+	platformRouter := r.PathPrefix("/api/platform/tenants").Subrouter()
+	rbacService.Protect(platformRouter.HandleFunc("/usage", ListUsageHandler(c)).Methods("GET"), perm.PlatformReadUsage)
+	rbacService.Protect(platformRouter.HandleFunc("/{slug}/usage", UsageHandler(c)).Methods("GET"), perm.PlatformReadUsage)
+	rbacService.Protect(platformRouter.HandleFunc("/{slug}/impersonate", ImpersonateHandler(c)).Methods("POST"), perm.PlatformImpersonate)
+	rbacService.Protect(platformRouter.HandleFunc("/{slug}/suspend", SuspendHandler(c)).Methods("POST"), perm.PlatformSuspend)
+	rbacService.Protect(platformRouter.HandleFunc("/{slug}/resume", ResumeHandler(c)).Methods("POST"), perm.PlatformSuspend)
+}
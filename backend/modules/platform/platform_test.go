@@ -0,0 +1,91 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/modules/tenant"
+	"base-app/modules/usage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingImpersonator struct {
+	tenant string
+	roles  []string
+}
+
+func (i *recordingImpersonator) Impersonate(ctx context.Context, tenant string, roles []string) (*rbac.Impersonation, error) {
+	i.tenant, i.roles = tenant, roles
+	return &rbac.Impersonation{AccessToken: "token", TokenType: "Bearer", Tenant: tenant, Roles: roles}, nil
+}
+
+type staticUsage []usage.TenantSummary
+
+func (u staticUsage) TenantSummaries(since time.Time, tenant string) ([]usage.TenantSummary, error) {
+	var summaries []usage.TenantSummary
+	for _, s := range u {
+		if tenant == "" || s.Tenant == tenant {
+			summaries = append(summaries, s)
+		}
+	}
+	return summaries, nil
+}
+
+func TestConsoleActsOnExistingTenants(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	tenants := tenant.NewService(tenant.NewTenantRepository(db), nil, tenant.DefaultTemplate, logger)
+	impersonator := &recordingImpersonator{}
+	console := NewConsole(tenants, impersonator, staticUsage{{Tenant: "acme", Requests: 12}, {Tenant: "globex", Requests: 3}}, logger)
+
+	columns := []string{"id", "slug", "name", "schema_name", "admin_email", "role_names", "group_names", "created_by", "created_at", "suspended_at", "suspend_reason"}
+	expectTenant := func(slug string) {
+		rows := sqlmock.NewRows(columns)
+		if slug == "acme" {
+			rows.AddRow("t1", "acme", "Acme", "", "admin@acme.test", pq.StringArray{"acme-admin"}, pq.StringArray{"acme-admins"}, "root", time.Now(), nil, "")
+		}
+		mock.ExpectQuery(`FROM tenants WHERE slug`).WithArgs(slug).WillReturnRows(rows)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/api/platform/tenants/{slug}/impersonate", ImpersonateHandler(console)).Methods("POST")
+	r.HandleFunc("/api/platform/tenants/{slug}/usage", UsageHandler(console)).Methods("GET")
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	expectTenant("missing")
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/api/platform/tenants/missing/impersonate").Code)
+
+	expectTenant("acme")
+	w := serve(http.MethodPost, "/api/platform/tenants/acme/impersonate")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"acme-admin"}, impersonator.roles, "the admin roles of the tenant template")
+
+	expectTenant("acme")
+	w = serve(http.MethodGet, "/api/platform/tenants/acme/usage?since=1h")
+	require.Equal(t, http.StatusOK, w.Code)
+	var result TenantUsage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, int64(12), result.Usage.Requests)
+	assert.False(t, result.Suspended)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/api/platform/tenants/acme/usage?since=soon").Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
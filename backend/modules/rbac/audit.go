@@ -0,0 +1,92 @@
+package rbac
+
+import (
+	"context"
+	"sort"
+
+	"base-app/pkg/audit"
+)
+
+// Resource types of RBAC changes in the audit log
+const (
+	AuditRole       = "role"
+	AuditGroup      = "group"
+	AuditPermission = "permission"
+	// AuditDeprecation changes are recorded against the deprecated permission
+	AuditDeprecation = "permission_deprecation"
+	// AuditMembership changes are recorded against the group, with the member in the payload
+	AuditMembership = "group_membership"
+	// AuditScope changes are recorded against the scoped role
+	AuditScope      = "role_scope"
+	AuditDomainRule = "domain_rule"
+	AuditTemplate   = "group_template"
+	// AuditToken changes are personal access tokens; their secrets are never recorded
+	AuditToken = "personal_token"
+)
+
+// SetAuditLog records every change to roles, groups, their assignments and permissions in log.
+// Set it before serving requests.
+func (s *RBACService) SetAuditLog(log *audit.Log) {
+	s.auditLog = log
+}
+
+// audit records a change when an audit log is set
+func (s *RBACService) audit(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) {
+	if s.auditLog != nil {
+		s.auditLog.Record(ctx, action, resourceType, resourceID, before, after)
+	}
+}
+
+// roleAccess is a role's permissions, recorded when they are replaced
+type roleAccess struct {
+	PermissionIDs []string `json:"permission_ids"`
+}
+
+// groupAccess is a group's roles, recorded when they are replaced
+type groupAccess struct {
+	RoleIDs []string `json:"role_ids"`
+}
+
+// auditedRoleAccess reads a role's permissions to record a change of them, or returns nil
+// without an audit log
+func (s *RBACService) auditedRoleAccess(roleID string) (*roleAccess, error) {
+	if s.auditLog == nil {
+		return nil, nil
+	}
+	permissions, err := s.repo.RolePermRepo.GetRolePermissions(roleID)
+	if err != nil {
+		return nil, err
+	}
+	access := &roleAccess{PermissionIDs: []string{}}
+	for _, p := range permissions {
+		access.PermissionIDs = append(access.PermissionIDs, p.ID)
+	}
+	sort.Strings(access.PermissionIDs)
+	return access, nil
+}
+
+// auditedGroupAccess reads a group's roles to record a change of them, or returns nil without
+// an audit log
+func (s *RBACService) auditedGroupAccess(groupID string) (*groupAccess, error) {
+	if s.auditLog == nil {
+		return nil, nil
+	}
+	roles, err := s.repo.GroupRoleRepo.GetGroupRoles(groupID)
+	if err != nil {
+		return nil, err
+	}
+	access := &groupAccess{RoleIDs: []string{}}
+	for _, role := range roles {
+		access.RoleIDs = append(access.RoleIDs, role.ID)
+	}
+	sort.Strings(access.RoleIDs)
+	return access, nil
+}
+
+// auditedScope reads a role's scope to record a change of it, or returns nil without an audit log
+func (s *RBACService) auditedScope(roleID string) (*RoleScope, error) {
+	if s.auditLog == nil {
+		return nil, nil
+	}
+	return s.repo.ScopeRepo.Get(roleID)
+}
@@ -0,0 +1,339 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/pkg/audit"
+	"base-app/pkg/quota"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of an item in a role batch
+const (
+	BatchCreated = "created"
+	BatchUpdated = "updated"
+	BatchInvalid = "invalid"
+	// BatchSkipped marks a valid item left unapplied because another item was invalid
+	BatchSkipped = "skipped"
+)
+
+// BatchRoleItem creates or updates one role in a batch. With an ID the role is renamed to Name;
+// without one, an existing role named Name is updated and otherwise a new role is created.
+// PermissionIDs replaces the role's permissions; when omitted, an updated role keeps its own.
+type BatchRoleItem struct {
+	ID            string   `json:"id,omitempty" validate:"omitempty,uuid"`
+	Name          string   `json:"name" validate:"required,min=2,max=50,role_name"`
+	Description   string   `json:"description"`
+	PermissionIDs []string `json:"permission_ids,omitempty" validate:"omitempty,uuid_list"`
+}
+
+// BatchRolesRequest represents the request to create or update several roles at once. A DryRun
+// batch is validated and reports its impact on users without being applied.
+type BatchRolesRequest struct {
+	Roles  []BatchRoleItem `json:"roles" validate:"required,min=1,max=100"`
+	DryRun bool            `json:"-"`
+}
+
+// BatchRoleResult is the outcome of one item, in request order
+type BatchRoleResult struct {
+	Index  int               `json:"index"`
+	ID     string            `json:"id,omitempty"`
+	Name   string            `json:"name"`
+	Status string            `json:"status"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// BatchRolesResult reports whether the batch was applied and the outcome of each item. A batch is
+// applied all or nothing, so one invalid item leaves every role unchanged. A valid dry run has
+// the outcomes the batch would have, without the IDs of roles it would create, and its Impact.
+type BatchRolesResult struct {
+	Applied bool              `json:"applied"`
+	DryRun  bool              `json:"dry_run,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Code    string            `json:"code,omitempty"`
+	Results []BatchRoleResult `json:"results"`
+	Impact  *Impact           `json:"impact,omitempty"`
+}
+
+// batchRolePlan is what applying one valid item does
+type batchRolePlan struct {
+	item     BatchRoleItem
+	existing *Role
+}
+
+// ApplyRoleBatch validates every item and, when all are valid, creates and updates the roles and
+// their permissions in a single transaction
+func (s *RBACService) ApplyRoleBatch(ctx context.Context, req BatchRolesRequest) (*BatchRolesResult, error) {
+	logger := s.logger.WithContext(ctx)
+	total := 0
+	for _, item := range req.Roles {
+		total += len(item.PermissionIDs)
+	}
+	if err := s.checkListSize("permission_ids", total); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(req); err != nil {
+		logger.WithError(err).Warn("Role batch validation failed")
+		return nil, err
+	}
+
+	result := &BatchRolesResult{Results: make([]BatchRoleResult, len(req.Roles))}
+	plans := make([]batchRolePlan, len(req.Roles))
+	itemErrors := make([]map[string]string, len(req.Roles))
+	names := make(map[string]int, len(req.Roles))
+	targets := make(map[string]int, len(req.Roles))
+	var permissionIDs []string
+
+	for i, item := range req.Roles {
+		errs := make(map[string]string)
+		itemErrors[i] = errs
+		plans[i].item = item
+
+		if err := validate.Struct(item); err != nil {
+			var fieldErrs validator.ValidationErrors
+			if !errors.As(err, &fieldErrs) {
+				return nil, err
+			}
+			for field, message := range validationErrorDetails(fieldErrs) {
+				errs[field] = message
+			}
+		}
+		if _, bad := errs["name"]; !bad {
+			if first, dup := names[item.Name]; dup {
+				errs["name"] = fmt.Sprintf("duplicates roles[%d]", first)
+			} else {
+				names[item.Name] = i
+			}
+		}
+		if len(errs) > 0 {
+			continue
+		}
+
+		existing, err := s.batchTarget(item, errs)
+		if err != nil {
+			logger.WithError(err).Error("Failed to look up batch role")
+			return nil, err
+		}
+		if existing != nil {
+			if first, dup := targets[existing.ID]; dup {
+				errs["id"] = fmt.Sprintf("updates the same role as roles[%d]", first)
+			} else {
+				targets[existing.ID] = i
+			}
+		}
+		plans[i].existing = existing
+		permissionIDs = append(permissionIDs, item.PermissionIDs...)
+	}
+
+	// Validate the permissions of all items with a single query
+	missing := make(map[string]bool)
+	if len(permissionIDs) > 0 {
+		notFound, err := s.repo.PermissionRepo.FindMissingIDs(permissionIDs)
+		if err != nil {
+			logger.WithError(err).Error("Failed to validate permission IDs")
+			return nil, err
+		}
+		for _, id := range notFound {
+			missing[id] = true
+		}
+	}
+
+	invalid, creations := 0, 0
+	for i, plan := range plans {
+		errs := itemErrors[i]
+		if len(errs) == 0 && len(missing) > 0 {
+			var notFound []string
+			for _, id := range plan.item.PermissionIDs {
+				if missing[id] {
+					notFound = append(notFound, id)
+				}
+			}
+			if len(notFound) > 0 {
+				errs["permission_ids"] = "permissions not found: " + strings.Join(notFound, ", ")
+			}
+		}
+		result.Results[i] = BatchRoleResult{Index: i, ID: plan.item.ID, Name: plan.item.Name}
+		if plan.existing != nil {
+			result.Results[i].ID = plan.existing.ID
+		}
+		if len(errs) > 0 {
+			result.Results[i].Status = BatchInvalid
+			result.Results[i].Errors = errs
+			invalid++
+		} else if plan.existing == nil {
+			creations++
+		}
+	}
+	if invalid > 0 {
+		for i := range result.Results {
+			if result.Results[i].Status == "" {
+				result.Results[i].Status = BatchSkipped
+			}
+		}
+		logger.WithField("invalid", invalid).Warn("Role batch rejected")
+		return result, nil
+	}
+
+	if err := s.checkQuotaN(ctx, quota.Roles, creations); err != nil {
+		return nil, err
+	}
+
+	// Roles are updated in place, so keep them as they were for the audit log
+	before := make([]*Role, len(plans))
+	for i, plan := range plans {
+		if plan.existing != nil {
+			role := *plan.existing
+			before[i] = &role
+		}
+	}
+	applied := make([]*Role, len(plans))
+	apply := func(repos *RBACRepository) error {
+		for i, plan := range plans {
+			role, status, err := applyBatchRole(repos, plan)
+			if err != nil {
+				return err
+			}
+			applied[i] = role
+			result.Results[i].ID = role.ID
+			result.Results[i].Status = status
+		}
+		return nil
+	}
+	if req.DryRun {
+		// Only updated roles whose permissions are replaced can take access away
+		var replaced []string
+		for _, plan := range plans {
+			if plan.existing != nil && plan.item.PermissionIDs != nil {
+				replaced = append(replaced, plan.existing.ID)
+			}
+		}
+		impact, err := s.whatIf(ctx, func(repos *RBACRepository) ([]string, error) {
+			return rolesMembers(repos, replaced)
+		}, apply)
+		if err != nil {
+			if dupErr := uniqueViolationError(err, roleUniqueConstraints); dupErr != err {
+				return nil, dupErr
+			}
+			logger.WithError(err).Error("Failed to dry run role batch")
+			return nil, err
+		}
+		for i := range result.Results {
+			if result.Results[i].Status == BatchCreated {
+				result.Results[i].ID = ""
+			}
+		}
+		result.DryRun, result.Impact = true, impact
+		return result, nil
+	}
+
+	err := s.repo.Tx.WithinTx(ctx, apply)
+	if err != nil {
+		if dupErr := uniqueViolationError(err, roleUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		logger.WithError(err).Error("Failed to apply role batch")
+		return nil, err
+	}
+
+	result.Applied = true
+	s.accessChanged(ctx)
+	for i, role := range applied {
+		if before[i] == nil {
+			s.audit(ctx, audit.ActionCreate, AuditRole, role.ID, nil, role)
+		} else {
+			s.audit(ctx, audit.ActionUpdate, AuditRole, role.ID, before[i], role)
+		}
+	}
+	logger.WithFields(logrus.Fields{"roles": len(plans), "created": creations}).Info("Role batch applied successfully")
+	return result, nil
+}
+
+// batchTarget returns the role an item updates, or nil when it creates one, recording conflicts in errs
+func (s *RBACService) batchTarget(item BatchRoleItem, errs map[string]string) (*Role, error) {
+	byName, err := s.repo.RoleRepo.GetByName(item.Name)
+	if err != nil {
+		return nil, err
+	}
+	if item.ID == "" {
+		return byName, nil
+	}
+
+	role, err := s.repo.RoleRepo.GetByID(item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		errs["id"] = "role not found"
+		return nil, nil
+	}
+	if byName != nil && byName.ID != role.ID {
+		errs["name"] = "already exists"
+	}
+	return role, nil
+}
+
+// applyBatchRole creates or updates the role of plan and replaces its permissions when given
+func applyBatchRole(repos *RBACRepository, plan batchRolePlan) (*Role, string, error) {
+	role, status := plan.existing, BatchUpdated
+	if role == nil {
+		role = &Role{ID: uuid.New().String(), Key: roleKey(plan.item.Name), CreatedAt: time.Now()}
+		status = BatchCreated
+	}
+	role.Name = plan.item.Name
+	role.Description = plan.item.Description
+
+	var err error
+	if status == BatchCreated {
+		err = repos.RoleRepo.Create(role)
+	} else {
+		err = repos.RoleRepo.Update(role)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if plan.item.PermissionIDs != nil {
+		if err := repos.RolePermRepo.ClearRolePermissions(role.ID); err != nil {
+			return nil, "", err
+		}
+		if err := repos.RolePermRepo.AssignPermissionsToRole(role.ID, plan.item.PermissionIDs); err != nil {
+			return nil, "", err
+		}
+	}
+	return role, status, nil
+}
+
+// BatchRolesHandler handles POST /api/rbac/roles/batch. With ?dry_run=true the batch is validated
+// and its impact reported without applying it.
+func BatchRolesHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BatchRolesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+		req.DryRun = IsDryRun(r)
+
+		result, err := service.ApplyRoleBatch(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to apply role batch")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !result.Applied && !result.DryRun {
+			result.Error, result.Code = "Validation failed", "VALIDATION_ERROR"
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
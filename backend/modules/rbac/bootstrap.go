@@ -0,0 +1,243 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"base-app/pkg/labels"
+	"base-app/pkg/perm"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// BootstrapRole is a role Bootstrap ensures exists and grants at least Permissions, by key. The
+// role is found by Key, so an administrator may rename it; Key defaults to the name in lower case
+// with spaces replaced by '_'.
+type BootstrapRole struct {
+	Key         string   `json:"key,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// BootstrapGroup is a role group Bootstrap ensures exists and holds at least Roles, by key
+type BootstrapGroup struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Roles       []string `json:"roles"`
+}
+
+// BootstrapSpec is the access setup an installation or new tenant starts from. Permissions are
+// extra permissions to declare on top of the ones modules register; roles and groups may refer
+// to both.
+type BootstrapSpec struct {
+	Permissions []Permission     `json:"permissions"`
+	Roles       []BootstrapRole  `json:"roles"`
+	Groups      []BootstrapGroup `json:"groups"`
+}
+
+// BootstrapResult names what Bootstrap had to create, roles by key and groups by name; both
+// lists are empty when the spec was already in place
+type BootstrapResult struct {
+	CreatedRoles  []string `json:"created_roles"`
+	CreatedGroups []string `json:"created_groups"`
+}
+
+// RegisteredUsersGroup is the role group every registered user joins
+const RegisteredUsersGroup = "Registered users"
+
+// RegisteredUsersSpec is the access every registered user starts with: the RegisteredUsersGroup
+// holding a role that reads and edits their own profile. Bootstrap it at startup, once the
+// modules' permissions are synced.
+func RegisteredUsersSpec() BootstrapSpec {
+	const role = "registered_user"
+	return BootstrapSpec{
+		Roles: []BootstrapRole{{
+			Key:         role,
+			Name:        "Registered user",
+			Description: "Read and edit your own profile",
+			Permissions: []string{string(perm.ReadUserOwn), string(perm.UpdateUserOwn)},
+		}},
+		Groups: []BootstrapGroup{{Name: RegisteredUsersGroup, Description: "Every registered user", Roles: []string{role}}},
+	}
+}
+
+// LoadBootstrapSpec reads a BootstrapSpec from a JSON file, rejecting unknown fields
+func LoadBootstrapSpec(path string) (BootstrapSpec, error) {
+	var spec BootstrapSpec
+	f, err := os.Open(path)
+	if err != nil {
+		return spec, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return spec, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return spec, nil
+}
+
+// Bootstrap ensures the permissions, roles and groups of spec exist, in a single transaction.
+// It is idempotent and only adds: existing roles and groups keep their descriptions and any
+// extra permissions or roles administrators gave them. Quotas do not apply.
+func (s *RBACService) Bootstrap(ctx context.Context, spec BootstrapSpec) (*BootstrapResult, error) {
+	logger := s.logger.WithContext(ctx)
+	permissions := make([]*Permission, len(spec.Permissions))
+	for i, p := range spec.Permissions {
+		p, err := normalizePermission(p)
+		if err != nil {
+			return nil, err
+		}
+		permissions[i] = &p
+	}
+	roles := make([]BootstrapRole, len(spec.Roles))
+	for i, role := range spec.Roles {
+		if err := validate.Struct(CreateRoleRequest{Key: role.Key, Name: role.Name, Description: role.Description}); err != nil {
+			return nil, fmt.Errorf("role %q: %w", role.Name, err)
+		}
+		if role.Key == "" {
+			role.Key = roleKey(role.Name)
+		}
+		roles[i] = role
+	}
+	for _, group := range spec.Groups {
+		if err := validate.Struct(CreateRoleGroupRequest{Name: group.Name, Description: group.Description}); err != nil {
+			return nil, fmt.Errorf("group %q: %w", group.Name, err)
+		}
+	}
+
+	result := &BootstrapResult{CreatedRoles: []string{}, CreatedGroups: []string{}}
+	err := s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if len(permissions) > 0 {
+			if err := repos.PermissionRepo.Upsert(permissions); err != nil {
+				return err
+			}
+		}
+		stored, err := repos.PermissionRepo.List()
+		if err != nil {
+			return err
+		}
+		permissionIDs := make(map[string]string, len(stored))
+		for _, p := range stored {
+			permissionIDs[p.Key] = p.ID
+		}
+
+		roleIDs := make(map[string]string, len(roles))
+		for _, want := range roles {
+			ids := make([]string, len(want.Permissions))
+			for i, name := range want.Permissions {
+				id, ok := permissionIDs[name]
+				if !ok {
+					return fmt.Errorf("role %q: unknown permission %q", want.Name, name)
+				}
+				ids[i] = id
+			}
+
+			role, err := repos.RoleRepo.GetByKey(want.Key)
+			if err != nil {
+				return err
+			}
+			if role == nil {
+				role = &Role{ID: uuid.New().String(), Key: want.Key, Name: want.Name, Description: want.Description, CreatedAt: time.Now()}
+				if err := repos.RoleRepo.Create(role); err != nil {
+					return fmt.Errorf("create role %q: %w", want.Key, err)
+				}
+				result.CreatedRoles = append(result.CreatedRoles, want.Key)
+			}
+			if err := repos.RolePermRepo.AssignPermissionsToRole(role.ID, ids); err != nil {
+				return err
+			}
+			roleIDs[want.Key] = role.ID
+		}
+
+		for _, want := range spec.Groups {
+			ids := make([]string, len(want.Roles))
+			for i, key := range want.Roles {
+				id, ok := roleIDs[key]
+				if !ok {
+					role, err := repos.RoleRepo.GetByKey(key)
+					if err != nil {
+						return err
+					}
+					if role == nil {
+						return fmt.Errorf("group %q: unknown role %q", want.Name, key)
+					}
+					id = role.ID
+				}
+				ids[i] = id
+			}
+
+			group, err := repos.GroupRepo.GetByName(want.Name)
+			if err != nil {
+				return err
+			}
+			if group == nil {
+				group = &RoleGroup{ID: uuid.New().String(), Name: want.Name, Description: want.Description, CreatedAt: time.Now()}
+				if err := repos.GroupRepo.Create(group); err != nil {
+					return fmt.Errorf("create group %q: %w", want.Name, err)
+				}
+				result.CreatedGroups = append(result.CreatedGroups, want.Name)
+			}
+			if err := repos.GroupRoleRepo.AssignRolesToGroup(group.ID, ids); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Error("RBAC bootstrap failed")
+		return nil, err
+	}
+	s.accessChanged(ctx)
+
+	logger.WithFields(logrus.Fields{
+		"created_roles":  result.CreatedRoles,
+		"created_groups": result.CreatedGroups,
+	}).Info("RBAC bootstrap applied")
+	return result, nil
+}
+
+// Unbootstrap deletes the roles and groups named in result for good, groups first; it undoes a
+// Bootstrap, e.g. when provisioning a tenant fails or the tenant is offboarded. Roles and groups
+// that no longer exist are skipped, so it can be retried.
+func (s *RBACService) Unbootstrap(ctx context.Context, result BootstrapResult) error {
+	logger := s.logger.WithContext(ctx)
+	for _, name := range result.CreatedGroups {
+		group, err := s.repo.GroupRepo.GetByName(name)
+		if err != nil {
+			return err
+		}
+		if group == nil {
+			continue
+		}
+		if err := s.deleteRoleGroup(ctx, group.ID); err != nil {
+			return fmt.Errorf("delete group %q: %w", name, err)
+		}
+		s.forgetLabels(labels.KindGroup, group.ID)
+	}
+	for _, key := range result.CreatedRoles {
+		role, err := s.repo.RoleRepo.GetByKey(key)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			continue
+		}
+		if _, err := s.deleteRole(ctx, role.ID, true); err != nil {
+			return fmt.Errorf("delete role %q: %w", key, err)
+		}
+		s.forgetLabels(labels.KindRole, role.ID)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"deleted_roles":  result.CreatedRoles,
+		"deleted_groups": result.CreatedGroups,
+	}).Info("RBAC bootstrap undone")
+	return nil
+}
@@ -0,0 +1,162 @@
+package rbac
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/sirupsen/logrus"
+)
+
+// decisionLogSize is how many authorization decisions are kept for the decisions endpoint
+const decisionLogSize = 1000
+
+// Decision is the outcome of one authorization check, recorded while decision logging is on to
+// answer "why am I getting 403"
+type Decision struct {
+	At       time.Time `json:"at"`
+	UserID   string    `json:"user_id,omitempty"`
+	Username string    `json:"username,omitempty"`
+	// Permission is the permission checked; empty when the route only needs a valid token
+	Permission string `json:"permission,omitempty"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Allowed    bool   `json:"allowed"`
+	// Code is the error code a denied request was answered with
+	Code string `json:"code,omitempty"`
+	// GrantedBy names the caller's roles granting Permission
+	GrantedBy []string `json:"granted_by,omitempty"`
+	// Scoped marks personal access tokens, which only carry their scopes
+	Scoped bool `json:"scoped,omitempty"`
+}
+
+// decisionLog keeps the latest decisions in a ring buffer
+type decisionLog struct {
+	enabled func() bool
+	logger  *logrus.Logger
+
+	mu      sync.Mutex
+	entries []Decision
+	next    int
+}
+
+// SetDecisionLogging records every authorization decision while enabled returns true, logging
+// it to logger and keeping the latest ones for GET /api/rbac/decisions. enabled is asked on
+// each check, so logging can be switched on at runtime. Set it before serving requests.
+func (s *RBACService) SetDecisionLogging(enabled func() bool, logger *logrus.Logger) {
+	s.decisions = &decisionLog{enabled: enabled, logger: logger}
+}
+
+// on reports whether decisions are being recorded
+func (l *decisionLog) on() bool {
+	return l != nil && l.enabled()
+}
+
+func (l *decisionLog) add(decision Decision) {
+	l.mu.Lock()
+	if len(l.entries) < decisionLogSize {
+		l.entries = append(l.entries, decision)
+	} else {
+		l.entries[l.next] = decision
+	}
+	l.next = (l.next + 1) % decisionLogSize
+	l.mu.Unlock()
+
+	l.logger.WithFields(logrus.Fields{
+		"user_id":    decision.UserID,
+		"permission": decision.Permission,
+		"path":       decision.Path,
+		"allowed":    decision.Allowed,
+		"code":       decision.Code,
+		"granted_by": decision.GrantedBy,
+	}).Info("Authorization decision")
+}
+
+// recordDecision notes the outcome of authenticate for r
+func (s *RBACService) recordDecision(r *http.Request, permission perm.Name, claims *JWTClaims, userPerms *UserPermissions, failure *authFailure) {
+	decision := Decision{
+		At:         time.Now().UTC(),
+		Permission: string(permission),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Allowed:    failure == nil,
+	}
+	if claims != nil {
+		decision.UserID, decision.Username, decision.Scoped = claims.UserID, claims.Username, claims.scopes != nil
+	}
+	if failure != nil {
+		decision.Code = failure.code
+	}
+	if userPerms != nil && permission != "" && failure == nil {
+		granting := make(map[string]bool)
+		for _, roleID := range userPerms.grants[string(permission)] {
+			granting[roleID] = true
+		}
+		for _, role := range userPerms.Roles {
+			if granting[role.ID] {
+				decision.GrantedBy = append(decision.GrantedBy, role.Name)
+			}
+		}
+	}
+	s.decisions.add(decision)
+}
+
+// DecisionFilter narrows the decisions listed; empty fields match everything
+type DecisionFilter struct {
+	UserID     string
+	Permission string
+	// Outcome is "allowed", "denied" or empty
+	Outcome string
+}
+
+func (f DecisionFilter) matches(decision Decision) bool {
+	switch {
+	case f.UserID != "" && decision.UserID != f.UserID:
+		return false
+	case f.Permission != "" && decision.Permission != f.Permission:
+		return false
+	case f.Outcome == "allowed" && !decision.Allowed, f.Outcome == "denied" && decision.Allowed:
+		return false
+	}
+	return true
+}
+
+// ListDecisions returns the recorded decisions matching filter, newest first
+func (s *RBACService) ListDecisions(filter DecisionFilter) []Decision {
+	decisions := []Decision{}
+	l := s.decisions
+	if l == nil {
+		return decisions
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 1; i <= len(l.entries); i++ {
+		decision := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if filter.matches(decision) {
+			decisions = append(decisions, decision)
+		}
+	}
+	return decisions
+}
+
+// GetDecisionsHandler handles GET /api/rbac/decisions?user_id=&permission=&outcome=allowed|denied
+func GetDecisionsHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+		query := r.URL.Query()
+		filter := DecisionFilter{UserID: query.Get("user_id"), Permission: query.Get("permission"), Outcome: query.Get("outcome")}
+		if filter.Outcome != "" && filter.Outcome != "allowed" && filter.Outcome != "denied" {
+			writeErrorResponse(w, http.StatusBadRequest, "outcome must be allowed or denied", "INVALID_OUTCOME", nil)
+			return
+		}
+
+		decisions := service.ListDecisions(filter)
+		httpapi.WriteList(w, r, httpapi.Paginate(decisions, page), len(decisions), page)
+	}
+}
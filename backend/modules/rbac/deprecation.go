@@ -0,0 +1,410 @@
+package rbac
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/database"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// PermissionDeprecation marks a permission as on its way out, usually because its key is being
+// changed to ReplacedBy. Until code stops checking the old key, the two keys are treated as one:
+// holding either satisfies a check of the other, so roles can be migrated to the successor
+// before or after the code is. Display names can be renamed without deprecating anything.
+type PermissionDeprecation struct {
+	PermissionID string `json:"permission_id"`
+	Permission   string `json:"permission"`
+	// Permission and ReplacedBy are keys; ReplacedByID and ReplacedBy identify the successor, if any
+	ReplacedByID string    `json:"replaced_by_id,omitempty"`
+	ReplacedBy   string    `json:"replaced_by,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	DeprecatedBy string    `json:"deprecated_by,omitempty"`
+	DeprecatedAt time.Time `json:"deprecated_at"`
+}
+
+// DeprecatePermissionRequest deprecates a permission, optionally in favour of the permission
+// with ID ReplacedBy
+type DeprecatePermissionRequest struct {
+	ReplacedBy string `json:"replaced_by,omitempty" validate:"omitempty,uuid"`
+	Reason     string `json:"reason,omitempty" validate:"max=500"`
+}
+
+// PermissionMigrationResult reports the roles moved from a deprecated permission to its successor
+type PermissionMigrationResult struct {
+	Permission string `json:"permission"`
+	ReplacedBy string `json:"replaced_by"`
+	// MigratedRoles is how many roles granted the deprecated permission
+	MigratedRoles int64 `json:"migrated_roles"`
+}
+
+// DeprecationRepository stores permission deprecations
+type DeprecationRepository interface {
+	List() ([]*PermissionDeprecation, error)
+	// Set deprecates a permission, replacing its previous deprecation
+	Set(d *PermissionDeprecation) error
+	Clear(permissionID string) error
+	// MigrateRoles grants to to every role granting from and revokes from, returning how many
+	// roles granted from
+	MigrateRoles(from, to string) (int64, error)
+}
+
+// deprecationRepository implements DeprecationRepository
+type deprecationRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+func (r *deprecationRepository) List() ([]*PermissionDeprecation, error) {
+	query := `SELECT d.permission_id, p.key, COALESCE(s.id::text, ''), COALESCE(s.key, ''), d.reason, d.deprecated_by, d.deprecated_at
+	          FROM permission_deprecations d
+	          JOIN permissions p ON p.id = d.permission_id
+	          LEFT JOIN permissions s ON s.id = d.replaced_by
+	          ORDER BY p.key`
+	deprecations := []*PermissionDeprecation{}
+	err := database.QueryEach(r.db, "list permission deprecations", func(row database.Scanner) error {
+		d := &PermissionDeprecation{}
+		if err := row.Scan(&d.PermissionID, &d.Permission, &d.ReplacedByID, &d.ReplacedBy, &d.Reason, &d.DeprecatedBy, &d.DeprecatedAt); err != nil {
+			return err
+		}
+		deprecations = append(deprecations, d)
+		return nil
+	}, query)
+	return deprecations, err
+}
+
+func (r *deprecationRepository) Set(d *PermissionDeprecation) error {
+	query := `INSERT INTO permission_deprecations (permission_id, replaced_by, reason, deprecated_by, deprecated_at)
+	          VALUES ($1, $2, $3, $4, $5)
+	          ON CONFLICT (permission_id) DO UPDATE SET replaced_by = EXCLUDED.replaced_by, reason = EXCLUDED.reason,
+	              deprecated_by = EXCLUDED.deprecated_by, deprecated_at = EXCLUDED.deprecated_at`
+	var replacedBy sql.NullString
+	if d.ReplacedByID != "" {
+		replacedBy = sql.NullString{String: d.ReplacedByID, Valid: true}
+	}
+	_, err := r.db.Exec(query, d.PermissionID, replacedBy, d.Reason, d.DeprecatedBy, d.DeprecatedAt)
+	return err
+}
+
+func (r *deprecationRepository) Clear(permissionID string) error {
+	_, err := r.db.Exec(`DELETE FROM permission_deprecations WHERE permission_id = $1`, permissionID)
+	return err
+}
+
+func (r *deprecationRepository) MigrateRoles(from, to string) (int64, error) {
+	insert := `INSERT INTO role_permissions (role_id, permission_id)
+	           SELECT role_id, $2 FROM role_permissions WHERE permission_id = $1
+	           ON CONFLICT DO NOTHING`
+	if _, err := r.db.Exec(insert, from, to); err != nil {
+		return 0, err
+	}
+	result, err := r.db.Exec(`DELETE FROM role_permissions WHERE permission_id = $1`, from)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// deprecationIndex holds the deprecated permission keys checked during authorization
+type deprecationIndex struct {
+	mu sync.RWMutex
+	// successor maps deprecated keys to the key replacing them, "" when there is none
+	successor map[string]string
+	// predecessors maps successor keys to the deprecated keys they replace
+	predecessors map[string][]string
+}
+
+func newDeprecationIndex() *deprecationIndex {
+	return &deprecationIndex{successor: map[string]string{}, predecessors: map[string][]string{}}
+}
+
+func (d *deprecationIndex) load(deprecations []*PermissionDeprecation) {
+	successor := make(map[string]string, len(deprecations))
+	predecessors := make(map[string][]string)
+	for _, dep := range deprecations {
+		successor[dep.Permission] = dep.ReplacedBy
+		if dep.ReplacedBy != "" {
+			predecessors[dep.ReplacedBy] = append(predecessors[dep.ReplacedBy], dep.Permission)
+		}
+	}
+	d.mu.Lock()
+	d.successor, d.predecessors = successor, predecessors
+	d.mu.Unlock()
+}
+
+// deprecated reports whether the key name is deprecated and the key replacing it
+func (d *deprecationIndex) deprecated(name string) (replacedBy string, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	replacedBy, ok = d.successor[name]
+	return replacedBy, ok
+}
+
+// predecessorsOf returns the deprecated keys the key name replaces
+func (d *deprecationIndex) predecessorsOf(name string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.predecessors[name]
+}
+
+// expand adds to the keys names the successors of the deprecated permissions among them and the
+// deprecated predecessors of the others, so checks of either key of a rename pass
+func (d *deprecationIndex) expand(names []string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if len(d.successor) == 0 {
+		return names
+	}
+	held := make(map[string]bool, len(names))
+	for _, name := range names {
+		held[name] = true
+	}
+	expanded := append([]string(nil), names...)
+	add := func(name string) {
+		if name != "" && !held[name] {
+			held[name] = true
+			expanded = append(expanded, name)
+		}
+	}
+	for _, name := range names {
+		add(d.successor[name])
+		for _, old := range d.predecessors[name] {
+			add(old)
+		}
+	}
+	return expanded
+}
+
+// warnDeprecatedCheck logs a check of a deprecated permission, so the code still checking it
+// can be found and moved to the successor
+func (s *RBACService) warnDeprecatedCheck(r *http.Request, permission string) {
+	replacedBy, ok := s.deprecations.deprecated(permission)
+	if !ok {
+		return
+	}
+	s.logger.WithContext(r.Context()).WithFields(logrus.Fields{
+		"permission":  permission,
+		"replaced_by": replacedBy,
+		"path":        r.URL.Path,
+	}).Warn("Deprecated permission checked")
+}
+
+// SyncDeprecations loads the permission deprecations checked during authorization. Changes made
+// through this service are loaded at once; StartDeprecationSync picks up those of other instances.
+func (s *RBACService) SyncDeprecations() error {
+	deprecations, err := s.repo.DeprecationRepo.List()
+	if err != nil {
+		return err
+	}
+	s.deprecations.load(deprecations)
+	return nil
+}
+
+// StartDeprecationSync runs SyncDeprecations every interval until ctx is cancelled
+func (s *RBACService) StartDeprecationSync(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.SyncDeprecations(); err != nil {
+					s.logger.WithError(err).Error("Failed to sync permission deprecations")
+				}
+			}
+		}
+	}()
+}
+
+// ListPermissionDeprecations returns the deprecated permissions sorted by name
+func (s *RBACService) ListPermissionDeprecations() ([]*PermissionDeprecation, error) {
+	deprecations, err := s.repo.DeprecationRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permission deprecations")
+		return nil, err
+	}
+	return deprecations, nil
+}
+
+// DeprecatePermission deprecates the permission with id, attributed to the user in ctx. A
+// successor must exist and not be deprecated itself, so renames never chain.
+func (s *RBACService) DeprecatePermission(ctx context.Context, id string, req DeprecatePermissionRequest) (*PermissionDeprecation, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	permission, err := s.repo.PermissionRepo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if permission == nil {
+		return nil, apperrors.NotFound("PERMISSION_NOT_FOUND", "permission not found")
+	}
+
+	deprecation := &PermissionDeprecation{
+		PermissionID: id,
+		Permission:   permission.Key,
+		Reason:       req.Reason,
+		DeprecatedBy: getUserIDFromContext(ctx),
+		DeprecatedAt: time.Now(),
+	}
+	if req.ReplacedBy != "" {
+		if req.ReplacedBy == id {
+			return nil, &ValidationError{Field: "replaced_by", Message: "a permission cannot replace itself"}
+		}
+		successor, err := s.repo.PermissionRepo.GetByID(req.ReplacedBy)
+		if err != nil {
+			return nil, err
+		}
+		if successor == nil {
+			return nil, &ValidationError{Field: "replaced_by", Message: "permission not found"}
+		}
+		if _, deprecated := s.deprecations.deprecated(successor.Key); deprecated {
+			return nil, &ValidationError{Field: "replaced_by", Message: successor.Key + " is deprecated itself"}
+		}
+		deprecation.ReplacedByID, deprecation.ReplacedBy = successor.ID, successor.Key
+	}
+	if replaced := s.deprecations.predecessorsOf(permission.Key); len(replaced) > 0 {
+		return nil, &ValidationError{Field: "permission", Message: permission.Key + " replaces deprecated " + replaced[0]}
+	}
+
+	if err := s.repo.DeprecationRepo.Set(deprecation); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to deprecate permission")
+		return nil, err
+	}
+	if err := s.SyncDeprecations(); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to sync permission deprecations")
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"permission":  permission.Key,
+		"replaced_by": deprecation.ReplacedBy,
+	}).Info("Permission deprecated")
+	s.audit(ctx, audit.ActionCreate, AuditDeprecation, id, nil, deprecation)
+	return deprecation, nil
+}
+
+// UndeprecatePermission withdraws the deprecation of the permission with id
+func (s *RBACService) UndeprecatePermission(ctx context.Context, id string) error {
+	if err := s.repo.DeprecationRepo.Clear(id); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to withdraw permission deprecation")
+		return err
+	}
+	if err := s.SyncDeprecations(); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to sync permission deprecations")
+	}
+
+	s.logger.WithContext(ctx).WithField("permission_id", id).Info("Permission deprecation withdrawn")
+	s.audit(ctx, audit.ActionDelete, AuditDeprecation, id, nil, nil)
+	return nil
+}
+
+// MigrateDeprecatedPermission moves every role granting the deprecated permission with id to
+// its successor, in one transaction. The deprecation stays, so checks of the old name keep
+// passing until the code checking it is changed.
+func (s *RBACService) MigrateDeprecatedPermission(ctx context.Context, id string) (*PermissionMigrationResult, error) {
+	var deprecation *PermissionDeprecation
+	deprecations, err := s.repo.DeprecationRepo.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range deprecations {
+		if d.PermissionID == id {
+			deprecation = d
+		}
+	}
+	if deprecation == nil {
+		return nil, apperrors.NotFound("PERMISSION_NOT_DEPRECATED", "permission is not deprecated")
+	}
+	if deprecation.ReplacedByID == "" {
+		return nil, &ValidationError{Field: "replaced_by", Message: deprecation.Permission + " has no successor to migrate to"}
+	}
+
+	result := &PermissionMigrationResult{Permission: deprecation.Permission, ReplacedBy: deprecation.ReplacedBy}
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		migrated, err := repos.DeprecationRepo.MigrateRoles(deprecation.PermissionID, deprecation.ReplacedByID)
+		result.MigratedRoles = migrated
+		return err
+	})
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to migrate deprecated permission")
+		return nil, err
+	}
+	s.accessChanged(ctx)
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"permission":     result.Permission,
+		"replaced_by":    result.ReplacedBy,
+		"migrated_roles": result.MigratedRoles,
+	}).Info("Roles migrated from deprecated permission")
+	s.audit(ctx, audit.ActionUpdate, AuditDeprecation, id, deprecation, result)
+	return result, nil
+}
+
+// ListPermissionDeprecationsHandler handles GET /api/rbac/permissions/deprecations
+func ListPermissionDeprecationsHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deprecations, err := service.ListPermissionDeprecations()
+		if err != nil {
+			writeServiceError(w, err, "Failed to list permission deprecations")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deprecations)
+	}
+}
+
+// PutPermissionDeprecationHandler handles PUT /api/rbac/permissions/{id}/deprecation
+func PutPermissionDeprecationHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeprecatePermissionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		deprecation, err := service.DeprecatePermission(r.Context(), mux.Vars(r)["id"], req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to deprecate permission")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deprecation)
+	}
+}
+
+// DeletePermissionDeprecationHandler handles DELETE /api/rbac/permissions/{id}/deprecation
+func DeletePermissionDeprecationHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.UndeprecatePermission(r.Context(), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to withdraw permission deprecation")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// MigratePermissionHandler handles POST /api/rbac/permissions/{id}/migrate
+func MigratePermissionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.MigrateDeprecatedPermission(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to migrate deprecated permission")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
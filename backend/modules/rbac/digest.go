@@ -0,0 +1,419 @@
+package rbac
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/database"
+	"base-app/pkg/emailtemplates"
+	"base-app/pkg/perm"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DigestEvent is the notification type of the RBAC change digests sent to subscribed administrators
+const DigestEvent = "rbac.change_digest"
+
+// Digest frequencies
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// digestPermission is required to subscribe to digests and to keep receiving them
+const digestPermission = perm.ReadRole
+
+// maxDigestItems bounds each list in a digest; the counts still cover every change
+const maxDigestItems = 100
+
+// DigestSubscription is an administrator's choice to receive RBAC change digests
+type DigestSubscription struct {
+	UserID    string `json:"user_id"`
+	Frequency string `json:"frequency"`
+	// LastSentAt is the end of the period the last digest covered; the next one starts there
+	LastSentAt *time.Time `json:"last_sent_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// PermissionGrant is a permission granted to a role
+type PermissionGrant struct {
+	RoleID         string    `json:"role_id"`
+	RoleName       string    `json:"role_name"`
+	PermissionName string    `json:"permission_name"`
+	GrantedAt      time.Time `json:"granted_at"`
+}
+
+// ChangeDigest summarises the RBAC changes of a period. Lists hold at most maxDigestItems of
+// the most recent changes; the counts cover all of them.
+type ChangeDigest struct {
+	From                  time.Time          `json:"from"`
+	To                    time.Time          `json:"to"`
+	NewRoles              []*Role            `json:"new_roles"`
+	NewRoleCount          int                `json:"new_role_count"`
+	MembershipChanges     []*MembershipEvent `json:"membership_changes"`
+	MembershipChangeCount int                `json:"membership_change_count"`
+	PermissionGrants      []*PermissionGrant `json:"permission_grants"`
+	PermissionGrantCount  int                `json:"permission_grant_count"`
+}
+
+// Empty reports whether nothing changed in the period
+func (d *ChangeDigest) Empty() bool {
+	return d.NewRoleCount == 0 && d.MembershipChangeCount == 0 && d.PermissionGrantCount == 0
+}
+
+// DigestRepository stores digest subscriptions and reads the changes digests report
+type DigestRepository interface {
+	GetSubscription(userID string) (*DigestSubscription, error)
+	// SaveSubscription creates or changes the subscription of sub.UserID
+	SaveSubscription(sub *DigestSubscription) error
+	DeleteSubscription(userID string) error
+	ListSubscriptions() ([]*DigestSubscription, error)
+	// MarkSent records that the digest of userID covered changes up to at
+	MarkSent(userID string, at time.Time) error
+	// Changes returns the changes made from from (inclusive) to to (exclusive)
+	Changes(from, to time.Time, limit int) (*ChangeDigest, error)
+}
+
+// digestRepository implements DigestRepository
+type digestRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+const digestSubscriptionSelect = `SELECT user_id, frequency, last_sent_at, created_at FROM rbac_digest_subscriptions`
+
+func scanDigestSubscription(row database.Scanner) (*DigestSubscription, error) {
+	sub := &DigestSubscription{}
+	err := row.Scan(&sub.UserID, &sub.Frequency, &sub.LastSentAt, &sub.CreatedAt)
+	return sub, err
+}
+
+func (r *digestRepository) GetSubscription(userID string) (*DigestSubscription, error) {
+	sub, err := scanDigestSubscription(r.db.QueryRow(digestSubscriptionSelect+` WHERE user_id = $1`, userID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+func (r *digestRepository) SaveSubscription(sub *DigestSubscription) error {
+	query := `INSERT INTO rbac_digest_subscriptions (user_id, frequency, created_at) VALUES ($1, $2, $3)
+	          ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency`
+	_, err := r.db.Exec(query, sub.UserID, sub.Frequency, sub.CreatedAt)
+	return err
+}
+
+func (r *digestRepository) DeleteSubscription(userID string) error {
+	_, err := r.db.Exec(`DELETE FROM rbac_digest_subscriptions WHERE user_id = $1`, userID)
+	return err
+}
+
+func (r *digestRepository) ListSubscriptions() ([]*DigestSubscription, error) {
+	return database.QueryAll(r.db, "list digest subscriptions", scanDigestSubscription, digestSubscriptionSelect+` ORDER BY created_at`)
+}
+
+func (r *digestRepository) MarkSent(userID string, at time.Time) error {
+	_, err := r.db.Exec(`UPDATE rbac_digest_subscriptions SET last_sent_at = $2 WHERE user_id = $1`, userID, at)
+	return err
+}
+
+func (r *digestRepository) Changes(from, to time.Time, limit int) (*ChangeDigest, error) {
+	digest := &ChangeDigest{From: from, To: to}
+
+	count := func(query string) (int, error) {
+		var n int
+		err := r.reader.QueryRow(query, from, to).Scan(&n)
+		return n, err
+	}
+	var err error
+	if digest.NewRoleCount, err = count(`SELECT COUNT(*) FROM roles WHERE created_at >= $1 AND created_at < $2`); err != nil {
+		return nil, err
+	}
+	if digest.MembershipChangeCount, err = count(`SELECT COUNT(*) FROM group_membership_history WHERE occurred_at >= $1 AND occurred_at < $2`); err != nil {
+		return nil, err
+	}
+	if digest.PermissionGrantCount, err = count(`SELECT COUNT(*) FROM role_permissions WHERE granted_at >= $1 AND granted_at < $2`); err != nil {
+		return nil, err
+	}
+
+	digest.NewRoles, err = database.QueryAll(r.reader, "list new roles", scanRole, `SELECT `+roleColumns+` FROM roles WHERE created_at >= $1 AND created_at < $2 ORDER BY created_at DESC LIMIT $3`, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	digest.MembershipChanges, err = database.QueryAll(r.reader, "list membership changes", scanMembershipEvent,
+		`SELECT `+membershipEventColumns+` FROM group_membership_history h LEFT JOIN role_groups g ON g.id = h.group_id
+		 WHERE h.occurred_at >= $1 AND h.occurred_at < $2 ORDER BY h.occurred_at DESC, h.id DESC LIMIT $3`, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	digest.PermissionGrants, err = database.QueryAll(r.reader, "list permission grants", func(row database.Scanner) (*PermissionGrant, error) {
+		grant := &PermissionGrant{}
+		err := row.Scan(&grant.RoleID, &grant.RoleName, &grant.PermissionName, &grant.GrantedAt)
+		return grant, err
+	}, `SELECT r.id, r.name, p.name, rp.granted_at FROM role_permissions rp
+	    JOIN roles r ON r.id = rp.role_id JOIN permissions p ON p.id = rp.permission_id
+	    WHERE rp.granted_at >= $1 AND rp.granted_at < $2 ORDER BY rp.granted_at DESC, r.name, p.name LIMIT $3`, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// DigestRecipient returns the email address digests for userID go to
+type DigestRecipient func(ctx context.Context, userID string) (string, error)
+
+// SetDigestDelivery sends change digests through notifier, addressed to the email recipient
+// returns for each subscriber. Without it digests are not sent. Set it before serving requests.
+func (s *RBACService) SetDigestDelivery(notifier notification.Notifier, recipient DigestRecipient) {
+	s.digests = notifier
+	s.digestRecipient = recipient
+}
+
+// SetDigestTemplates words digests with the digest email template instead of the built-in
+// text. Set it before serving requests.
+func (s *RBACService) SetDigestTemplates(templates *emailtemplates.Service) {
+	s.digestTemplates = templates
+}
+
+// DigestSubscriptionRequest represents the request to subscribe to change digests
+type DigestSubscriptionRequest struct {
+	Frequency string `json:"frequency" validate:"required,oneof=daily weekly"`
+}
+
+// digestPeriod is how much time one digest of frequency covers
+func digestPeriod(frequency string) time.Duration {
+	if frequency == DigestWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// GetDigestSubscription returns the caller's digest subscription
+func (s *RBACService) GetDigestSubscription(userID string) (*DigestSubscription, error) {
+	sub, err := s.repo.DigestRepo.GetSubscription(userID)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get digest subscription")
+		return nil, err
+	}
+	if sub == nil {
+		return nil, apperrors.NotFound("DIGEST_NOT_SUBSCRIBED", "Not subscribed to change digests")
+	}
+	return sub, nil
+}
+
+// SubscribeToDigest subscribes userID to change digests, or changes the frequency of their
+// subscription. The first digest covers the changes made from now on.
+func (s *RBACService) SubscribeToDigest(ctx context.Context, userID string, req DigestSubscriptionRequest) (*DigestSubscription, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	sub := &DigestSubscription{UserID: userID, Frequency: req.Frequency, CreatedAt: time.Now().UTC()}
+	if err := s.repo.DigestRepo.SaveSubscription(sub); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to save digest subscription")
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": userID, "frequency": req.Frequency}).Info("Subscribed to change digests")
+	return s.GetDigestSubscription(userID)
+}
+
+// UnsubscribeFromDigest ends the digest subscription of userID
+func (s *RBACService) UnsubscribeFromDigest(ctx context.Context, userID string) error {
+	if err := s.repo.DigestRepo.DeleteSubscription(userID); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to delete digest subscription")
+		return err
+	}
+	return nil
+}
+
+// SendDueDigests sends a digest to every subscriber whose period has passed. Subscribers who
+// lost the permission to read roles are skipped, and periods without changes send nothing.
+// A failure for one subscriber is logged and retried on the next run.
+func (s *RBACService) SendDueDigests(ctx context.Context) error {
+	if s.digests == nil {
+		return nil
+	}
+	subs, err := s.repo.DigestRepo.ListSubscriptions()
+	if err != nil {
+		return fmt.Errorf("list digest subscriptions: %w", err)
+	}
+	now := time.Now().UTC()
+	for _, sub := range subs {
+		from := sub.CreatedAt
+		if sub.LastSentAt != nil {
+			from = *sub.LastSentAt
+		}
+		if now.Sub(from) < digestPeriod(sub.Frequency) {
+			continue
+		}
+		if err := s.sendDigest(ctx, sub, from, now); err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("user_id", sub.UserID).Error("Failed to send change digest")
+		}
+	}
+	return nil
+}
+
+// sendDigest sends sub the changes from from to to and records them as sent
+func (s *RBACService) sendDigest(ctx context.Context, sub *DigestSubscription, from, to time.Time) error {
+	userPerms, err := s.GetUserPermissions(ctx, sub.UserID)
+	if err != nil {
+		return err
+	}
+	if !hasPermission(permissionNames(userPerms), string(digestPermission)) {
+		s.logger.WithContext(ctx).WithField("user_id", sub.UserID).Info("Skipping change digest of subscriber without access")
+		return s.repo.DigestRepo.MarkSent(sub.UserID, to)
+	}
+
+	digest, err := s.repo.DigestRepo.Changes(from, to, maxDigestItems)
+	if err != nil {
+		return err
+	}
+	if !digest.Empty() {
+		email, err := s.digestRecipient(ctx, sub.UserID)
+		if err != nil {
+			return err
+		}
+		msg := s.digestEmail(ctx, sub.Frequency, digest)
+		data := map[string]interface{}{
+			"user_id":   sub.UserID,
+			"email":     email,
+			"frequency": sub.Frequency,
+			"digest":    digest,
+		}
+		if msg.HTML != "" {
+			data["html"] = msg.HTML
+		}
+		err = s.digests.Notify(ctx, notification.Notification{
+			Type:       DigestEvent,
+			Severity:   notification.SeverityInfo,
+			Subject:    msg.Subject,
+			Message:    msg.Text,
+			Data:       data,
+			OccurredAt: to,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.repo.DigestRepo.MarkSent(sub.UserID, to)
+}
+
+// permissionNames lists the keys of the permissions in userPerms
+func permissionNames(userPerms *UserPermissions) []string {
+	names := make([]string, 0, len(userPerms.Permissions))
+	for _, p := range userPerms.Permissions {
+		names = append(names, p.Key)
+	}
+	return names
+}
+
+// digestEmail words digest with the digest template, falling back to the built-in text when the
+// template cannot be rendered so a broken template does not hold digests back
+func (s *RBACService) digestEmail(ctx context.Context, frequency string, digest *ChangeDigest) *emailtemplates.Message {
+	summary := digestMessage(digest)
+	if s.digestTemplates != nil {
+		msg, err := s.digestTemplates.Render(emailtemplates.Digest, emailtemplates.DefaultLocale, map[string]interface{}{
+			"Frequency": frequency,
+			"Summary":   summary,
+			"Digest":    digest,
+		})
+		if err == nil {
+			return msg
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to render digest template")
+	}
+	return &emailtemplates.Message{Subject: fmt.Sprintf("Access control changes (%s digest)", frequency), Text: summary}
+}
+
+// digestMessage is the plain-text summary of digest
+func digestMessage(digest *ChangeDigest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Changes between %s and %s: %d new roles, %d membership changes, %d permission grants.",
+		digest.From.Format(time.RFC3339), digest.To.Format(time.RFC3339),
+		digest.NewRoleCount, digest.MembershipChangeCount, digest.PermissionGrantCount)
+	for _, role := range digest.NewRoles {
+		fmt.Fprintf(&b, "\nNew role: %s", role.Name)
+	}
+	for _, event := range digest.MembershipChanges {
+		group := event.GroupName
+		if group == "" {
+			group = event.GroupID
+		}
+		fmt.Fprintf(&b, "\nUser %s %s group %s", event.UserID, map[string]string{MembershipAdded: "added to", MembershipRemoved: "removed from"}[event.Action], group)
+	}
+	for _, grant := range digest.PermissionGrants {
+		fmt.Fprintf(&b, "\nRole %s granted %s", grant.RoleName, grant.PermissionName)
+	}
+	return b.String()
+}
+
+// StartDigests sends due digests every interval until ctx is cancelled
+func (s *RBACService) StartDigests(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.SendDueDigests(ctx); err != nil {
+					s.logger.WithError(err).Error("Failed to send change digests")
+				}
+			}
+		}
+	}()
+}
+
+// HTTP Handlers
+
+// GetDigestSubscriptionHandler handles GET /api/rbac/digest-subscription
+func GetDigestSubscriptionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sub, err := service.GetDigestSubscription(getUserIDFromContext(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to get digest subscription")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sub)
+	}
+}
+
+// PutDigestSubscriptionHandler handles PUT /api/rbac/digest-subscription
+func PutDigestSubscriptionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DigestSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		sub, err := service.SubscribeToDigest(r.Context(), getUserIDFromContext(r.Context()), req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to subscribe to change digests")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sub)
+	}
+}
+
+// DeleteDigestSubscriptionHandler handles DELETE /api/rbac/digest-subscription
+func DeleteDigestSubscriptionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.UnsubscribeFromDigest(r.Context(), getUserIDFromContext(r.Context())); err != nil {
+			writeServiceError(w, err, "Failed to unsubscribe from change digests")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
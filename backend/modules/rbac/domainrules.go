@@ -0,0 +1,354 @@
+package rbac
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// DomainRuleActor prefixes the actor of memberships created by a domain rule in the membership
+// history, followed by the rule's ID
+const DomainRuleActor = "domain_rule:"
+
+// DomainGroupRule adds users whose email address is at Domain to a role group when they are
+// provisioned
+type DomainGroupRule struct {
+	ID      string `json:"id"`
+	Domain  string `json:"domain"`
+	GroupID string `json:"group_id"`
+	// GroupName is resolved when rules are listed
+	GroupName string    `json:"group_name,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DomainGroupRuleRequest represents the request to create a domain rule. Domain may be given
+// with a leading @.
+type DomainGroupRuleRequest struct {
+	Domain  string `json:"domain" validate:"required,max=254"`
+	GroupID string `json:"group_id" validate:"required,uuid"`
+}
+
+// DomainRuleRepository stores email domain to group rules
+type DomainRuleRepository interface {
+	Create(rule *DomainGroupRule) error
+	GetByID(id string) (*DomainGroupRule, error)
+	List() ([]*DomainGroupRule, error)
+	// ListForDomain returns the rules of domain, which must be lower case
+	ListForDomain(domain string) ([]*DomainGroupRule, error)
+	Delete(id string) error
+}
+
+// domainRuleRepository implements DomainRuleRepository
+type domainRuleRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+const domainRuleSelect = `SELECT d.id, d.domain, d.group_id, COALESCE(g.name, ''), d.created_by, d.created_at
+	          FROM domain_group_rules d
+	          LEFT JOIN role_groups g ON g.id = d.group_id`
+
+func scanDomainRule(row database.Scanner) (*DomainGroupRule, error) {
+	rule := &DomainGroupRule{}
+	err := row.Scan(&rule.ID, &rule.Domain, &rule.GroupID, &rule.GroupName, &rule.CreatedBy, &rule.CreatedAt)
+	return rule, err
+}
+
+func (r *domainRuleRepository) Create(rule *DomainGroupRule) error {
+	query := `INSERT INTO domain_group_rules (id, domain, group_id, created_by, created_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.Exec(query, rule.ID, rule.Domain, rule.GroupID, rule.CreatedBy, rule.CreatedAt)
+	return err
+}
+
+func (r *domainRuleRepository) GetByID(id string) (*DomainGroupRule, error) {
+	rule, err := scanDomainRule(r.db.QueryRow(domainRuleSelect+` WHERE d.id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return rule, err
+}
+
+func (r *domainRuleRepository) List() ([]*DomainGroupRule, error) {
+	return database.QueryAll(r.reader, "list domain rules", scanDomainRule, domainRuleSelect+` ORDER BY d.domain, g.name`)
+}
+
+func (r *domainRuleRepository) ListForDomain(domain string) ([]*DomainGroupRule, error) {
+	// Read from the primary: rules are applied right after an administrator may have added one
+	return database.QueryAll(r.db, "list domain rules", scanDomainRule, domainRuleSelect+` WHERE d.domain = $1`, domain)
+}
+
+func (r *domainRuleRepository) Delete(id string) error {
+	_, err := r.db.Exec(`DELETE FROM domain_group_rules WHERE id = $1`, id)
+	return err
+}
+
+// domainRuleUniqueConstraints maps unique constraints of domain_group_rules to the request field they guard
+var domainRuleUniqueConstraints = map[string]string{"domain_group_rules_domain_group_id_key": "group_id"}
+
+// normalizeDomain lower-cases domain and strips a leading @
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+}
+
+// emailDomain returns the lower-cased domain of an email address, or "" when it has none
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return normalizeDomain(email[at+1:])
+}
+
+// CreateDomainRule adds a rule placing future users of a domain in a group, attributed to the
+// user in ctx. Existing users are not affected.
+func (s *RBACService) CreateDomainRule(ctx context.Context, req DomainGroupRuleRequest) (*DomainGroupRule, error) {
+	logger := s.logger.WithContext(ctx)
+	req.Domain = normalizeDomain(req.Domain)
+	if err := validate.Struct(req); err != nil {
+		logger.WithError(err).Warn("Domain rule validation failed")
+		return nil, err
+	}
+	if err := validate.Var(req.Domain, "fqdn"); err != nil {
+		return nil, &ValidationError{Field: "domain", Message: "must be a domain name such as example.com"}
+	}
+
+	group, err := s.repo.GroupRepo.GetByID(req.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
+	}
+
+	rule := &DomainGroupRule{
+		ID:        uuid.New().String(),
+		Domain:    req.Domain,
+		GroupID:   group.ID,
+		GroupName: group.Name,
+		CreatedBy: getUserIDFromContext(ctx),
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.DomainRuleRepo.Create(rule); err != nil {
+		if dupErr := uniqueViolationError(err, domainRuleUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		logger.WithError(err).Error("Failed to create domain rule")
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"rule_id":  rule.ID,
+		"domain":   rule.Domain,
+		"group_id": rule.GroupID,
+	}).Info("Domain rule created successfully")
+	s.audit(ctx, audit.ActionCreate, AuditDomainRule, rule.ID, nil, rule)
+	return rule, nil
+}
+
+// ListDomainRules retrieves all domain rules
+func (s *RBACService) ListDomainRules() ([]*DomainGroupRule, error) {
+	rules, err := s.repo.DomainRuleRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list domain rules")
+		return nil, err
+	}
+	return rules, nil
+}
+
+// DeleteDomainRule deletes a domain rule; memberships it created are kept
+func (s *RBACService) DeleteDomainRule(ctx context.Context, id string) error {
+	rule, err := s.repo.DomainRuleRepo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if rule == nil {
+		return apperrors.NotFound("DOMAIN_RULE_NOT_FOUND", "domain rule not found")
+	}
+	if err := s.repo.DomainRuleRepo.Delete(id); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to delete domain rule")
+		return err
+	}
+
+	s.logger.WithContext(ctx).WithField("rule_id", id).Info("Domain rule deleted successfully")
+	s.audit(ctx, audit.ActionDelete, AuditDomainRule, id, rule, nil)
+	return nil
+}
+
+// ApplyDomainRules adds a newly provisioned user to the groups the rules of their email domain
+// name, skipping groups they already belong to, and returns the IDs of the groups joined. It is
+// called at registration and may be called by any other path that provisions users.
+func (s *RBACService) ApplyDomainRules(ctx context.Context, userID, email string) ([]string, error) {
+	domain := emailDomain(email)
+	if domain == "" {
+		return nil, nil
+	}
+	rules, err := s.repo.DomainRuleRepo.ListForDomain(domain)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	groupIDs := make([]string, len(rules))
+	actors := make([]string, len(rules))
+	for i, rule := range rules {
+		groupIDs[i] = rule.GroupID
+		actors[i] = DomainRuleActor + rule.ID
+	}
+	joined, err := s.joinGroups(ctx, userID, groupIDs, actors)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Error("Failed to apply domain rules")
+		return nil, err
+	}
+
+	if len(joined) > 0 {
+		s.logger.WithContext(ctx).WithFields(logrus.Fields{
+			"user_id": userID,
+			"domain":  domain,
+			"groups":  joined,
+		}).Info("User assigned to groups by domain rules")
+	}
+	return joined, nil
+}
+
+// JoinGroupsByName adds a user to the role groups named in names, skipping groups they already
+// belong to, attributed to the user in ctx. It returns the IDs of the groups joined and the names
+// no group has; used when importing users together with their memberships.
+func (s *RBACService) JoinGroupsByName(ctx context.Context, userID string, names []string) ([]string, []string, error) {
+	unknown := []string{}
+	groupIDs := []string{}
+	actors := []string{}
+	actor := getUserIDFromContext(ctx)
+	for _, name := range names {
+		group, err := s.repo.GroupRepo.GetByName(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if group == nil {
+			unknown = append(unknown, name)
+			continue
+		}
+		groupIDs = append(groupIDs, group.ID)
+		actors = append(actors, actor)
+	}
+
+	joined, err := s.joinGroups(ctx, userID, groupIDs, actors)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Error("Failed to assign user to groups")
+		return nil, nil, err
+	}
+	return joined, unknown, nil
+}
+
+// UserGroupNames returns the names of the groups a user belongs to
+func (s *RBACService) UserGroupNames(userID string) ([]string, error) {
+	groups, err := s.GetUserGroups(userID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(groups))
+	for i, group := range groups {
+		names[i] = group.Name
+	}
+	return names, nil
+}
+
+// joinGroups adds a user to each of groupIDs they are not a member of yet, in one transaction,
+// recording actors[i] as who added them to groupIDs[i]. It returns the IDs of the groups joined.
+func (s *RBACService) joinGroups(ctx context.Context, userID string, groupIDs, actors []string) ([]string, error) {
+	joined := []string{}
+	err := s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		now := time.Now()
+		for i, groupID := range groupIDs {
+			isMember, err := repos.MembershipRepo.IsUserInGroup(userID, groupID)
+			if err != nil {
+				return err
+			}
+			if isMember {
+				continue
+			}
+			if err := repos.MembershipRepo.Create(&UserGroupMembership{UserID: userID, GroupID: groupID, AssignedAt: now}); err != nil {
+				return err
+			}
+			err = repos.HistoryRepo.Record(&MembershipEvent{
+				GroupID:    groupID,
+				UserID:     userID,
+				Action:     MembershipAdded,
+				ActorID:    actors[i],
+				OccurredAt: now,
+			})
+			if err != nil {
+				return err
+			}
+			joined = append(joined, groupID)
+		}
+		return nil
+	})
+	if err == nil {
+		s.accessChanged(context.Background(), userID)
+	}
+	return joined, err
+}
+
+// HTTP Handlers
+
+// CreateDomainRuleHandler handles POST /api/rbac/domain-rules
+func CreateDomainRuleHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DomainGroupRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		rule, err := service.CreateDomainRule(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to create domain rule")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	}
+}
+
+// GetDomainRulesHandler handles GET /api/rbac/domain-rules
+func GetDomainRulesHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		rules, err := service.ListDomainRules()
+		if err != nil {
+			writeServiceError(w, err, "Failed to list domain rules")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(rules, page), len(rules), page)
+	}
+}
+
+// DeleteDomainRuleHandler handles DELETE /api/rbac/domain-rules/{id}
+func DeleteDomainRuleHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeleteDomainRule(r.Context(), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete domain rule")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,242 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// DefaultDormancyDays is the window of the dormancy report when none is requested
+const DefaultDormancyDays = 90
+
+// DormantRole is a role no authorization check has relied on within the report window
+type DormantRole struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// LastUsedAt is null when the role was never used since tracking started
+	LastUsedAt *time.Time `json:"last_used_at"`
+	GroupCount int        `json:"group_count"`
+}
+
+// UncheckedPermission is a permission granted by at least one role but not checked within the
+// report window
+type UncheckedPermission struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// LastCheckedAt is null when the permission was never checked since tracking started
+	LastCheckedAt *time.Time `json:"last_checked_at"`
+	RoleCount     int        `json:"role_count"`
+}
+
+// DormancyReport lists candidates for least-privilege cleanup. Usage is tracked from
+// successful authorization checks, so everything looks dormant until tracking has run for
+// the whole window.
+type DormancyReport struct {
+	Days                 int                    `json:"days"`
+	Since                time.Time              `json:"since"`
+	DormantRoles         []*DormantRole         `json:"dormant_roles"`
+	UncheckedPermissions []*UncheckedPermission `json:"unchecked_permissions"`
+}
+
+// AccessUsageRepository stores when permissions were last checked and roles last used
+type AccessUsageRepository interface {
+	// RecordUse saves the latest check time per permission name and use time per role ID
+	RecordUse(permissions, roles map[string]time.Time) error
+	// DormantRoles lists roles created before since and not used after it
+	DormantRoles(since time.Time) ([]*DormantRole, error)
+	// UncheckedPermissions lists granted permissions not checked after since
+	UncheckedPermissions(since time.Time) ([]*UncheckedPermission, error)
+}
+
+// accessUsageRepository implements AccessUsageRepository
+type accessUsageRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+func (r *accessUsageRepository) RecordUse(permissions, roles map[string]time.Time) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for name, at := range permissions {
+			query := `INSERT INTO permission_usage (name, last_checked_at) VALUES ($1, $2)
+			          ON CONFLICT (name) DO UPDATE SET last_checked_at = GREATEST(permission_usage.last_checked_at, EXCLUDED.last_checked_at)`
+			if _, err := tx.Exec(query, name, at); err != nil {
+				return err
+			}
+		}
+		for roleID, at := range roles {
+			query := `INSERT INTO role_usage (role_id, last_used_at) VALUES ($1, $2)
+			          ON CONFLICT (role_id) DO UPDATE SET last_used_at = GREATEST(role_usage.last_used_at, EXCLUDED.last_used_at)`
+			if _, err := tx.Exec(query, roleID, at); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *accessUsageRepository) DormantRoles(since time.Time) ([]*DormantRole, error) {
+	query := `SELECT r.id, r.name, u.last_used_at, COUNT(DISTINCT gr.group_id)
+	          FROM roles r
+	          LEFT JOIN role_usage u ON u.role_id = r.id
+	          LEFT JOIN group_roles gr ON gr.role_id = r.id
+	          WHERE r.created_at < $1 AND (u.last_used_at IS NULL OR u.last_used_at < $1)
+	          GROUP BY r.id, r.name, u.last_used_at
+	          ORDER BY u.last_used_at NULLS FIRST, r.name`
+	return database.QueryAll(r.reader, "list dormant roles", func(row database.Scanner) (*DormantRole, error) {
+		role := &DormantRole{}
+		err := row.Scan(&role.ID, &role.Name, &role.LastUsedAt, &role.GroupCount)
+		return role, err
+	}, query, since)
+}
+
+func (r *accessUsageRepository) UncheckedPermissions(since time.Time) ([]*UncheckedPermission, error) {
+	query := `SELECT p.id, p.name, u.last_checked_at, COUNT(DISTINCT rp.role_id)
+	          FROM permissions p
+	          JOIN role_permissions rp ON rp.permission_id = p.id
+	          LEFT JOIN permission_usage u ON u.name = p.key
+	          WHERE u.last_checked_at IS NULL OR u.last_checked_at < $1
+	          GROUP BY p.id, p.name, u.last_checked_at
+	          ORDER BY u.last_checked_at NULLS FIRST, p.name`
+	return database.QueryAll(r.reader, "list unchecked permissions", func(row database.Scanner) (*UncheckedPermission, error) {
+		permission := &UncheckedPermission{}
+		err := row.Scan(&permission.ID, &permission.Name, &permission.LastCheckedAt, &permission.RoleCount)
+		return permission, err
+	}, query, since)
+}
+
+// accessTracker collects the latest use of each permission and role in memory between flushes,
+// keeping the database out of the request path
+type accessTracker struct {
+	mu          sync.Mutex
+	permissions map[string]time.Time
+	roles       map[string]time.Time
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{permissions: make(map[string]time.Time), roles: make(map[string]time.Time)}
+}
+
+// observe records that permission was checked at and granted by roleIDs
+func (t *accessTracker) observe(permission string, roleIDs []string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keepLatest(t.permissions, permission, at)
+	for _, roleID := range roleIDs {
+		keepLatest(t.roles, roleID, at)
+	}
+}
+
+// take returns the pending uses and starts collecting anew
+func (t *accessTracker) take() (permissions, roles map[string]time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	permissions, roles = t.permissions, t.roles
+	t.permissions, t.roles = make(map[string]time.Time), make(map[string]time.Time)
+	return permissions, roles
+}
+
+// restore puts back uses that failed to save, so the next flush retries them
+func (t *accessTracker) restore(permissions, roles map[string]time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, at := range permissions {
+		keepLatest(t.permissions, name, at)
+	}
+	for roleID, at := range roles {
+		keepLatest(t.roles, roleID, at)
+	}
+}
+
+func keepLatest(times map[string]time.Time, key string, at time.Time) {
+	if current, ok := times[key]; !ok || at.After(current) {
+		times[key] = at
+	}
+}
+
+// FlushAccessUsage saves the permission and role uses observed since the last flush
+func (s *RBACService) FlushAccessUsage() error {
+	permissions, roles := s.access.take()
+	if len(permissions) == 0 && len(roles) == 0 {
+		return nil
+	}
+	if err := s.repo.AccessRepo.RecordUse(permissions, roles); err != nil {
+		s.access.restore(permissions, roles)
+		return err
+	}
+	return nil
+}
+
+// StartAccessTracking flushes observed permission and role uses every interval until ctx is cancelled
+func (s *RBACService) StartAccessTracking(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.FlushAccessUsage(); err != nil {
+					s.logger.WithError(err).Error("Failed to save permission usage")
+				}
+			}
+		}
+	}()
+}
+
+// DormancyReport lists the roles not used and the granted permissions not checked in the last days
+func (s *RBACService) DormancyReport(days int) (*DormancyReport, error) {
+	if days < 1 || days > 3650 {
+		return nil, &ValidationError{Field: "days", Message: "must be between 1 and 3650"}
+	}
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	roles, err := s.repo.AccessRepo.DormantRoles(since)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list dormant roles")
+		return nil, err
+	}
+	permissions, err := s.repo.AccessRepo.UncheckedPermissions(since)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list unchecked permissions")
+		return nil, err
+	}
+
+	report := &DormancyReport{Days: days, Since: since, DormantRoles: roles, UncheckedPermissions: permissions}
+	if report.DormantRoles == nil {
+		report.DormantRoles = []*DormantRole{}
+	}
+	if report.UncheckedPermissions == nil {
+		report.UncheckedPermissions = []*UncheckedPermission{}
+	}
+	return report, nil
+}
+
+// GetDormancyReportHandler handles GET /api/rbac/reports/dormancy?days=N
+func GetDormancyReportHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days := DefaultDormancyDays
+		if raw := r.URL.Query().Get("days"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				writeErrorResponse(w, http.StatusBadRequest, "days: must be a number", "VALIDATION_ERROR", map[string]string{"days": "must be a number"})
+				return
+			}
+			days = n
+		}
+
+		report, err := service.DormancyReport(days)
+		if err != nil {
+			writeServiceError(w, err, "Failed to build dormancy report")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,233 @@
+package rbac
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"base-app/pkg/apperrors"
+)
+
+// Impact is what a change does, or would do when DryRun, to the access of the users it affects
+type Impact struct {
+	DryRun bool `json:"dry_run"`
+	// MembershipsCleared are the group memberships the change removes
+	MembershipsCleared []MembershipChange `json:"memberships_cleared"`
+	// Users are the affected users who lose roles or permissions
+	Users []UserImpact `json:"users"`
+}
+
+// MembershipChange is a user's membership of a group
+type MembershipChange struct {
+	UserID    string `json:"user_id"`
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+}
+
+// UserImpact is the roles and permission keys a user loses
+type UserImpact struct {
+	UserID          string   `json:"user_id"`
+	LostRoles       []string `json:"lost_roles"`
+	LostPermissions []string `json:"lost_permissions"`
+}
+
+// errDryRun rolls back the transaction of a what-if once its impact is known
+var errDryRun = errors.New("dry run")
+
+// IsDryRun reports whether r asks with ?dry_run=true to see the impact of a change without making it
+func IsDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+// accessSnapshot is a user's groups and effective access at one point of a what-if
+type accessSnapshot struct {
+	groups      []*RoleGroup
+	permissions *UserPermissions
+}
+
+// whatIf makes change in a transaction that is always rolled back, and reports how it changes
+// the access of the users returned by affected, which runs in the transaction before the change
+func (s *RBACService) whatIf(ctx context.Context, affected func(repos *RBACRepository) ([]string, error), change func(repos *RBACRepository) error) (*Impact, error) {
+	impact := &Impact{DryRun: true, MembershipsCleared: []MembershipChange{}, Users: []UserImpact{}}
+	err := s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		userIDs, err := affected(repos)
+		if err != nil {
+			return err
+		}
+		userIDs = uniqueSorted(userIDs)
+		before := make([]accessSnapshot, len(userIDs))
+		for i, userID := range userIDs {
+			if before[i], err = snapshotAccess(repos, userID); err != nil {
+				return err
+			}
+		}
+		if err := change(repos); err != nil {
+			return err
+		}
+		for i, userID := range userIDs {
+			after, err := snapshotAccess(repos, userID)
+			if err != nil {
+				return err
+			}
+			impact.add(userID, before[i], after)
+		}
+		return errDryRun
+	})
+	if !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return impact, nil
+}
+
+// add records the difference between a user's access before and after a change
+func (impact *Impact) add(userID string, before, after accessSnapshot) {
+	remaining := make(map[string]bool)
+	for _, group := range after.groups {
+		remaining[group.ID] = true
+	}
+	for _, group := range before.groups {
+		if !remaining[group.ID] {
+			impact.MembershipsCleared = append(impact.MembershipsCleared, MembershipChange{UserID: userID, GroupID: group.ID, GroupName: group.Name})
+		}
+	}
+
+	user := UserImpact{UserID: userID, LostRoles: []string{}, LostPermissions: []string{}}
+	kept := make(map[string]bool)
+	for _, role := range after.permissions.Roles {
+		kept[role.Key] = true
+	}
+	for _, role := range before.permissions.Roles {
+		if !kept[role.Key] {
+			user.LostRoles = append(user.LostRoles, role.Key)
+		}
+	}
+	held := make(map[string]bool)
+	for _, p := range after.permissions.Permissions {
+		held[p.Key] = true
+	}
+	for _, p := range before.permissions.Permissions {
+		if !held[p.Key] {
+			user.LostPermissions = append(user.LostPermissions, p.Key)
+		}
+	}
+	if len(user.LostRoles) > 0 || len(user.LostPermissions) > 0 {
+		sort.Strings(user.LostRoles)
+		sort.Strings(user.LostPermissions)
+		impact.Users = append(impact.Users, user)
+	}
+}
+
+// snapshotAccess reads a user's groups and effective access
+func snapshotAccess(repos *RBACRepository, userID string) (accessSnapshot, error) {
+	groups, err := repos.MembershipRepo.GetUserGroups(userID)
+	if err != nil {
+		return accessSnapshot{}, err
+	}
+	permissions, err := repos.UserPermRepo.GetUserPermissions(userID)
+	if err != nil {
+		return accessSnapshot{}, err
+	}
+	return accessSnapshot{groups: groups, permissions: permissions}, nil
+}
+
+// uniqueSorted sorts ids and drops duplicates
+func uniqueSorted(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// groupsMembers returns the members of groups
+func groupsMembers(repos *RBACRepository, groupIDs []string) ([]string, error) {
+	var userIDs []string
+	for _, groupID := range groupIDs {
+		members, err := repos.MembershipRepo.GetGroupUsers(groupID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, members...)
+	}
+	return userIDs, nil
+}
+
+// rolesMembers returns the members of the groups holding roles
+func rolesMembers(repos *RBACRepository, roleIDs []string) ([]string, error) {
+	var groupIDs []string
+	for _, roleID := range roleIDs {
+		ids, err := repos.GroupRoleRepo.GetRoleGroupIDs(roleID)
+		if err != nil {
+			return nil, err
+		}
+		groupIDs = append(groupIDs, ids...)
+	}
+	return groupsMembers(repos, uniqueSorted(groupIDs))
+}
+
+// RoleDeletionImpact reports what deleting a role would do without deleting it
+func (s *RBACService) RoleDeletionImpact(ctx context.Context, id string) (*Impact, error) {
+	role, err := s.repo.RoleRepo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, apperrors.NotFound("ROLE_NOT_FOUND", "role not found")
+	}
+	return s.whatIf(ctx, func(repos *RBACRepository) ([]string, error) {
+		return rolesMembers(repos, []string{id})
+	}, func(repos *RBACRepository) error {
+		return s.deleteRoleIn(repos, id)
+	})
+}
+
+// RoleGroupDeletionImpact reports what deleting a role group would do without deleting it
+func (s *RBACService) RoleGroupDeletionImpact(ctx context.Context, id string) (*Impact, error) {
+	group, err := s.repo.GroupRepo.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
+	}
+	return s.whatIf(ctx, func(repos *RBACRepository) ([]string, error) {
+		return repos.MembershipRepo.GetGroupUsers(id)
+	}, func(repos *RBACRepository) error {
+		return s.deleteRoleGroupIn(ctx, repos, id)
+	})
+}
+
+// UserRemovalImpact reports what removing a user from every group would do. A deleted user loses
+// all their access; clearMemberships says whether their memberships go too, which they do not
+// while the user waits in the trash.
+func (s *RBACService) UserRemovalImpact(ctx context.Context, userID string, clearMemberships bool) (*Impact, error) {
+	impact, err := s.whatIf(ctx, func(repos *RBACRepository) ([]string, error) {
+		return []string{userID}, nil
+	}, func(repos *RBACRepository) error {
+		groups, err := repos.MembershipRepo.GetUserGroups(userID)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if err := repos.MembershipRepo.Delete(userID, group.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !clearMemberships {
+		impact.MembershipsCleared = []MembershipChange{}
+	}
+	return impact, nil
+}
@@ -3,12 +3,35 @@ package rbac
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"base-app/modules/auth"
+	"base-app/modules/notification"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/authevents"
+	"base-app/pkg/dberrors"
+	"base-app/pkg/emailtemplates"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jobs"
+	"base-app/pkg/jsonschema"
+	"base-app/pkg/labels"
+	"base-app/pkg/logging"
+	"base-app/pkg/perm"
+	"base-app/pkg/quota"
+	"base-app/pkg/ratelimit"
+	"base-app/pkg/trash"
+
+	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -16,23 +39,68 @@ import (
 )
 
 // ErrorResponse represents a standardized error response
-type ErrorResponse struct {
-	Error   string            `json:"error"`
-	Code    string            `json:"code"`
-	Details map[string]string `json:"details,omitempty"`
-}
+type ErrorResponse = httpapi.ErrorResponse
 
 // writeErrorResponse writes a standardized error response
 func writeErrorResponse(w http.ResponseWriter, statusCode int, message, code string, details map[string]string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Error:   message,
-		Code:    code,
-		Details: details,
+	httpapi.WriteErrorResponse(w, statusCode, message, code, details)
+}
+
+// writeValidationError writes a 400 response for validation failures and reports whether err was one
+func writeValidationError(w http.ResponseWriter, err error) bool {
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		writeErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", validationErrorDetails(fieldErrs))
+		return true
+	}
+	if ve, ok := err.(*ValidationError); ok {
+		writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+		return true
+	}
+	return false
+}
+
+// writeServiceError writes the response for an error returned by RBACService: validation
+// failures become 400s and everything else goes through the shared domain error mapper
+func writeServiceError(w http.ResponseWriter, err error, fallbackMessage string) {
+	if writeValidationError(w, err) {
+		return
+	}
+	httpapi.WriteError(w, err, fallbackMessage)
+}
+
+// roleResource and groupResource attach the links of a role or group to it for responses
+func roleResource(role *Role) httpapi.Linked {
+	return httpapi.WithLinks(role, httpapi.Links{
+		"self": "/api/rbac/roles/" + role.ID,
+	})
+}
+
+func groupResource(group *RoleGroup) httpapi.Linked {
+	self := "/api/rbac/groups/" + group.ID
+	return httpapi.WithLinks(group, httpapi.Links{
+		"self":  self,
+		"roles": self + "/roles",
+		"users": self + "/users",
 	})
 }
 
+func roleResources(roles []*Role) []httpapi.Linked {
+	resources := make([]httpapi.Linked, len(roles))
+	for i, role := range roles {
+		resources[i] = roleResource(role)
+	}
+	return resources
+}
+
+func groupResources(groups []*RoleGroup) []httpapi.Linked {
+	resources := make([]httpapi.Linked, len(groups))
+	for i, group := range groups {
+		resources[i] = groupResource(group)
+	}
+	return resources
+}
+
 // getEnv gets an environment variable with a default fallback value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -58,6 +126,14 @@ func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
 	}
 }
 
+// SetLimit changes the limit and window for subsequent requests
+func (rl *RateLimiter) SetLimit(limit int, window time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.limit = limit
+	rl.window = window
+}
+
 // Allow checks if a request from the given key is allowed
 func (rl *RateLimiter) Allow(key string) bool {
 	rl.mu.Lock()
@@ -88,12 +164,16 @@ func (rl *RateLimiter) Allow(key string) bool {
 
 // RateLimitMiddleware creates rate limiting middleware
 func RateLimitMiddleware(limit int, window time.Duration) mux.MiddlewareFunc {
-	limiter := NewRateLimiter(limit, window)
+	return NewRateLimiter(limit, window).Middleware()
+}
+
+// Middleware rejects requests from client IPs over the limit
+func (rl *RateLimiter) Middleware() mux.MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Use client IP as the rate limiting key
 			clientIP := getClientIP(r)
-			if !limiter.Allow(clientIP) {
+			if !rl.Allow(clientIP) {
 				writeErrorResponse(w, http.StatusTooManyRequests, "Rate limit exceeded", "RATE_LIMIT_EXCEEDED", map[string]string{
 					"retry_after": "60", // Suggest retry after 60 seconds
 				})
@@ -106,27 +186,7 @@ func RateLimitMiddleware(limit int, window time.Duration) mux.MiddlewareFunc {
 
 // getClientIP extracts the client IP address from the request
 func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxies/load balancers)
-	xForwardedFor := r.Header.Get("X-Forwarded-For")
-	if xForwardedFor != "" {
-		// Take the first IP if multiple are present
-		ips := strings.Split(xForwardedFor, ",")
-		return strings.TrimSpace(ips[0])
-	}
-
-	// Check X-Real-IP header
-	xRealIP := r.Header.Get("X-Real-IP")
-	if xRealIP != "" {
-		return xRealIP
-	}
-
-	// Fall back to RemoteAddr
-	ip := r.RemoteAddr
-	// Remove port if present
-	if strings.Contains(ip, ":") {
-		ip, _, _ = strings.Cut(ip, ":")
-	}
-	return ip
+	return httpapi.ClientIP(r)
 }
 
 // JWTClaims represents the JWT token claims from Keycloak
@@ -136,7 +196,17 @@ type JWTClaims struct {
 	Email    string   `json:"email"`                  // Keycloak email
 	Groups   []string `json:"groups"`                 // Keycloak groups
 	Roles    []string `json:"realm_access,omitempty"` // Keycloak realm roles (nested structure)
+	Tenant   string   `json:"tenant,omitempty"`       // Tenant the user belongs to, from a Keycloak attribute mapper
+	ClientID string   `json:"azp,omitempty"`          // Keycloak client the token was issued to
+	Session  string   `json:"sid,omitempty"`          // Keycloak session of the login that issued the token
+	// ActingAs holds the keys of the roles whose permissions the token carries instead of the
+	// user's own, for a platform operator acting in a tenant's admin context (see Impersonate)
+	ActingAs []string `json:"acting_as,omitempty"`
 	jwt.RegisteredClaims
+	// Realm is the configured Keycloak realm that issued the token, selected by its issuer
+	Realm string `json:"-"`
+	// scopes restrict a personal access token to these permissions; nil for Keycloak tokens
+	scopes []string
 }
 
 // RealmAccess represents the nested realm_access structure in Keycloak JWT
@@ -144,125 +214,435 @@ type RealmAccess struct {
 	Roles []string `json:"roles"`
 }
 
-// UserContextKey is used to store user information in request context
-type UserContextKey string
+// UserContextKey is used to store user information in request context; the keys are the auth
+// module's, which other modules read the caller's identity with
+type UserContextKey = auth.ContextKey
 
-const UserIDKey UserContextKey = "user_id"
-const UsernameKey UserContextKey = "username"
-const UserPermissionsKey UserContextKey = "user_permissions"
+const UserIDKey = auth.UserIDKey
+const UsernameKey = auth.UsernameKey
+const UserPermissionsKey = auth.PermissionsKey
+const SessionKey = auth.SessionKey
 
-// withAuth wraps a handler with authentication middleware requiring specific permission
-func withAuth(permission string, service *RBACService, handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Extract token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			writeErrorResponse(w, http.StatusUnauthorized, "Authorization header required", "AUTH_HEADER_MISSING", nil)
-			return
-		}
+// Session identifies the Keycloak login session and client a caller's token was issued for
+type Session = auth.Session
 
-		// Check Bearer token format
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			writeErrorResponse(w, http.StatusUnauthorized, "Invalid authorization format. Expected 'Bearer <token>'", "INVALID_AUTH_FORMAT", nil)
-			return
-		}
+// authFailure describes why a request could not be authenticated or authorized
+type authFailure struct {
+	status  int
+	message string
+	code    string
+	details map[string]string
+}
 
-		tokenString := parts[1]
-		if tokenString == "" {
-			writeErrorResponse(w, http.StatusUnauthorized, "Token is required", "TOKEN_MISSING", nil)
-			return
-		}
+// SetJWTSecret replaces the key used to verify tokens; safe to call while serving requests
+func (s *RBACService) SetJWTSecret(secret string) {
+	s.jwtSecret.Store(&secret)
+}
 
-		// Parse and validate JWT token
-		token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-			// Validate signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			// Use JWT secret from environment or default for development
-			// Use TEST_JWT_SECRET for testing, otherwise JWT_SECRET
-			jwtSecret := getEnv("TEST_JWT_SECRET", getEnv("JWT_SECRET", "your-secret-key-change-in-production"))
-			return []byte(jwtSecret), nil
-		})
+// signingSecret returns the configured JWT key, falling back to the environment
+func (s *RBACService) signingSecret() string {
+	if secret := s.jwtSecret.Load(); secret != nil && *secret != "" {
+		return *secret
+	}
+	// Use JWT secret from environment or default for development
+	// Use TEST_JWT_SECRET for testing, otherwise JWT_SECRET
+	return getEnv("TEST_JWT_SECRET", getEnv("JWT_SECRET", "your-secret-key-change-in-production"))
+}
 
-		if err != nil {
-			writeErrorResponse(w, http.StatusUnauthorized, "Invalid token", "INVALID_TOKEN", nil)
-			return
-		}
+// IssueToken signs claims with the JWT secret, for deployments that log users in themselves
+// instead of at Keycloak
+func (s *RBACService) IssueToken(claims JWTClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(s.signingSecret()))
+}
 
-		// Extract claims
-		claims, ok := token.Claims.(*JWTClaims)
-		if !ok || !token.Valid {
-			writeErrorResponse(w, http.StatusUnauthorized, "Invalid token claims", "INVALID_CLAIMS", nil)
-			return
+// parseToken validates the bearer token on r and returns its claims
+func (s *RBACService) parseToken(r *http.Request) (*JWTClaims, *authFailure) {
+	// Extract token from Authorization header
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, &authFailure{http.StatusUnauthorized, "Authorization header required", "AUTH_HEADER_MISSING", nil}
+	}
+
+	// Check Bearer token format
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, &authFailure{http.StatusUnauthorized, "Invalid authorization format. Expected 'Bearer <token>'", "INVALID_AUTH_FORMAT", nil}
+	}
+
+	tokenString := parts[1]
+	if tokenString == "" {
+		return nil, &authFailure{http.StatusUnauthorized, "Token is required", "TOKEN_MISSING", nil}
+	}
+	if strings.HasPrefix(tokenString, PersonalTokenPrefix) {
+		return s.parsePersonalToken(tokenString)
+	}
+
+	realm, ok := s.tokenRealm(tokenString)
+	if !ok {
+		return nil, unknownIssuer
+	}
+
+	// Parse and validate JWT token
+	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return s.verificationKey(r.Context(), realm, token)
+	})
+
+	if err != nil {
+		return nil, &authFailure{http.StatusUnauthorized, "Invalid token", "INVALID_TOKEN", nil}
+	}
+
+	// Extract claims
+	claims, ok := token.Claims.(*JWTClaims)
+	if !ok || !token.Valid {
+		return nil, &authFailure{http.StatusUnauthorized, "Invalid token claims", "INVALID_CLAIMS", nil}
+	}
+
+	// Check token expiration
+	if claims.ExpiresAt != nil && claims.ExpiresAt.Before(time.Now()) {
+		return nil, &authFailure{http.StatusUnauthorized, "Token has expired", "TOKEN_EXPIRED", nil}
+	}
+	if s.revoked.revokes(claims) {
+		return nil, &authFailure{http.StatusUnauthorized, "Session has been revoked", "SESSION_REVOKED", nil}
+	}
+	claims.Realm = realm.Name
+
+	return claims, nil
+}
+
+// authenticate validates the bearer token on r and loads the caller's permissions. When
+// permission is non-empty the caller must hold it.
+func (s *RBACService) authenticate(r *http.Request, permission perm.Name) (*JWTClaims, auth.Identity, *authFailure) {
+	claims, failure := s.parseToken(r)
+	if failure != nil {
+		if s.decisions.on() {
+			s.recordDecision(r, permission, nil, nil, failure)
 		}
+		return nil, auth.Identity{}, failure
+	}
+	userPerms, permissionNames, failure := s.authorizeClaims(r, claims, permission)
+	if s.decisions.on() {
+		s.recordDecision(r, permission, claims, userPerms, failure)
+	}
+	if failure != nil {
+		if failure.status != http.StatusForbidden {
+			return nil, auth.Identity{}, failure
+		}
+		// claims are returned alongside a 403 so observers can attribute it to the user
+		return claims, auth.Identity{}, failure
+	}
 
-		// Check token expiration
-		if claims.ExpiresAt != nil && claims.ExpiresAt.Before(time.Now()) {
-			writeErrorResponse(w, http.StatusUnauthorized, "Token has expired", "TOKEN_EXPIRED", nil)
-			return
+	identity := auth.Identity{
+		UserID:      claims.UserID,
+		Username:    claims.Username,
+		Permissions: permissionNames,
+		Session:     auth.Session{ID: claims.Session, ClientID: claims.ClientID},
+		Realm:       claims.Realm,
+	}
+	for _, role := range userPerms.Roles {
+		identity.Roles = append(identity.Roles, role.Key)
+	}
+	return claims, identity, nil
+}
+
+// authorizeClaims loads the permissions of the caller identified by claims and checks permission
+func (s *RBACService) authorizeClaims(r *http.Request, claims *JWTClaims, permission perm.Name) (*UserPermissions, []string, *authFailure) {
+	if failure := s.checkTenant(claims); failure != nil {
+		return nil, nil, failure
+	}
+
+	// Get user permissions from database based on groups, or from the roles an operator acts as
+	var userPerms *UserPermissions
+	var err error
+	if claims.ActingAs != nil {
+		userPerms, err = s.actingPermissions(claims)
+	} else {
+		userPerms, err = s.GetUserPermissions(r.Context(), claims.UserID)
+	}
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get user permissions from database")
+		status := http.StatusInternalServerError
+		if dberrors.IsUnavailable(err) {
+			status = http.StatusServiceUnavailable
 		}
+		return nil, nil, &authFailure{status, "Failed to load user permissions", "PERMISSION_LOAD_ERROR", nil}
+	}
 
-		// Get user permissions from database based on groups
-		userPerms, err := service.GetUserPermissions(r.Context(), claims.UserID)
-		if err != nil {
-			service.logger.WithError(err).Error("Failed to get user permissions from database")
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to load user permissions", "PERMISSION_LOAD_ERROR", nil)
+	// Checks compare permission keys, so renaming a permission does not break them
+	var permissionNames []string
+	for _, p := range userPerms.Permissions {
+		permissionNames = append(permissionNames, p.Key)
+	}
+	permissionNames = s.deprecations.expand(permissionNames)
+	permissionNames = scopePermissions(permissionNames, claims)
+	permissionNames = isolatePlatform(permissionNames, claims)
+
+	// Check if user has required permission
+	if permission != "" && !hasPermission(permissionNames, string(permission)) {
+		return userPerms, nil, &authFailure{http.StatusForbidden, "Insufficient permissions", "INSUFFICIENT_PERMISSIONS", map[string]string{"required": string(permission)}}
+	}
+	if permission != "" {
+		s.warnDeprecatedCheck(r, string(permission))
+		s.access.observe(string(permission), userPerms.grants[string(permission)], time.Now())
+	}
+
+	return userPerms, permissionNames, nil
+}
+
+// authorizedKey marks a request that passed authorize
+type authorizedKey struct{}
+
+// authorize authenticates r and checks permission, writing the error response and reporting
+// the failure when either fails. On success it returns r with the caller's identity and
+// permissions in its context and log fields.
+func (s *RBACService) authorize(w http.ResponseWriter, r *http.Request, permission perm.Name) (*http.Request, bool) {
+	claims, identity, failure := s.authenticate(r, permission)
+	if failure != nil {
+		s.reportAuthFailure(r, claims, failure)
+		writeErrorResponse(w, failure.status, failure.message, failure.code, failure.details)
+		return r, false
+	}
+
+	r = withIdentity(r, identity)
+	return r.WithContext(context.WithValue(r.Context(), authorizedKey{}, true)), true
+}
+
+// Authorize implements auth.Authorizer for the middleware of the auth module
+func (s *RBACService) Authorize(w http.ResponseWriter, r *http.Request, permission perm.Name) (*http.Request, bool) {
+	return s.authorize(w, r, permission)
+}
+
+// Forbid implements auth.Authorizer, reporting the rejection like the checks of this module
+func (s *RBACService) Forbid(w http.ResponseWriter, r *http.Request, required string) {
+	failure := &authFailure{http.StatusForbidden, "Insufficient permissions", "INSUFFICIENT_PERMISSIONS",
+		map[string]string{"required": required}}
+	s.reportAuthFailure(r, &JWTClaims{UserID: auth.UserID(r.Context()), Username: auth.Username(r.Context())}, failure)
+	writeErrorResponse(w, failure.status, failure.message, failure.code, failure.details)
+}
+
+// withIdentity adds the caller's identity to r's context and log fields
+func withIdentity(r *http.Request, identity auth.Identity) *http.Request {
+	logging.SetUserID(r.Context(), identity.UserID)
+	return r.WithContext(auth.WithIdentity(r.Context(), identity))
+}
+
+// withAuth wraps a handler with authentication middleware requiring specific permission
+func withAuth(permission perm.Name, service *RBACService, handler http.HandlerFunc) http.HandlerFunc {
+	return auth.RequirePermission(service, permission)(handler).ServeHTTP
+}
+
+// Protect records that route requires permission; AuthMiddleware enforces it. An empty
+// permission only requires a valid token. Any module can
+// protect its routes this way instead of wrapping handlers. The route fails closed with a 500
+// if it is served without AuthMiddleware, so a missing middleware cannot expose it.
+func (s *RBACService) Protect(route *mux.Route, permission perm.Name) *mux.Route {
+	s.routesMu.Lock()
+	s.routePermissions[route] = permission
+	s.routesMu.Unlock()
+
+	handler := route.GetHandler()
+	return route.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(authorizedKey{}) == nil {
+			s.logger.WithField("permission", permission).Error("Protected route served without the auth middleware")
+			writeErrorResponse(w, http.StatusInternalServerError, "Authorization is not configured", "AUTH_NOT_CONFIGURED", nil)
 			return
 		}
+		handler.ServeHTTP(w, r)
+	}))
+}
 
-		// Extract permission names for checking
-		var permissionNames []string
-		for _, perm := range userPerms.Permissions {
-			permissionNames = append(permissionNames, perm.Name)
-		}
+// RoutePermission returns the permission route was protected with
+func (s *RBACService) RoutePermission(route *mux.Route) (perm.Name, bool) {
+	if route == nil {
+		return "", false
+	}
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	permission, ok := s.routePermissions[route]
+	return permission, ok
+}
 
-		// Check if user has required permission
-		if permission != "" {
-			hasPermission := false
-			for _, perm := range permissionNames {
-				if perm == permission {
-					hasPermission = true
-					break
-				}
+// AuthMiddleware enforces the permissions recorded with Protect for the matched route; other
+// routes pass through untouched. Install it on the root router with Use, after middleware that
+// should also run for rejected requests.
+func (s *RBACService) AuthMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			permission, ok := s.RoutePermission(mux.CurrentRoute(r))
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
 			}
-			if !hasPermission {
-				writeErrorResponse(w, http.StatusForbidden, "Insufficient permissions", "INSUFFICIENT_PERMISSIONS", map[string]string{"required": permission})
+			r, ok = s.authorize(w, r, permission)
+			if !ok {
 				return
 			}
-		}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OnAuthFailure registers an observer for rejected requests (401 and 403). Register observers
+// before serving requests.
+func (s *RBACService) OnAuthFailure(observer authevents.Observer) {
+	s.authObservers = append(s.authObservers, observer)
+}
 
-		// Add user information to request context
-		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
-		ctx = context.WithValue(ctx, UsernameKey, claims.Username)
-		ctx = context.WithValue(ctx, UserPermissionsKey, permissionNames)
-		r = r.WithContext(ctx)
+// reportAuthFailure passes 401/403 failures to the registered observers; server-side failures
+// (e.g. the permission lookup failing) say nothing about the caller and are not reported
+func (s *RBACService) reportAuthFailure(r *http.Request, claims *JWTClaims, failure *authFailure) {
+	var kind string
+	switch failure.status {
+	case http.StatusUnauthorized:
+		kind = authevents.KindInvalidToken
+	case http.StatusForbidden:
+		kind = authevents.KindForbidden
+	default:
+		return
+	}
+	event := authevents.Failure{Kind: kind, Code: failure.code, IP: getClientIP(r), Path: r.URL.Path}
+	if claims != nil {
+		event.UserID = claims.UserID
+		event.Username = claims.Username
+	}
+	s.authObservers.Notify(r.Context(), event)
+}
 
-		handler(w, r)
+// OptionalAuth identifies the caller of public routes that behave differently when signed in.
+// A valid bearer token populates the request context like AuthMiddleware does; anonymous
+// requests and requests whose token is invalid or expired are served as anonymous rather than
+// rejected. Routes that require a permission still need Protect.
+func (s *RBACService) OptionalAuth() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" || getUserIDFromContext(r.Context()) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			_, identity, failure := s.authenticate(r, "")
+			if failure != nil {
+				s.logger.WithField("code", failure.code).Debug("Ignoring invalid token on public route")
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, withIdentity(r, identity))
+		})
 	}
 }
 
-// getUserIDFromContext extracts user ID from request context
-func getUserIDFromContext(ctx context.Context) string {
-	if userID, ok := ctx.Value(UserIDKey).(string); ok {
-		return userID
+// RequirePermission protects a handler outside this module with the given permission
+func (s *RBACService) RequirePermission(permission perm.Name, handler http.HandlerFunc) http.HandlerFunc {
+	s.ReferencePermissions("handler", permission)
+	return withAuth(permission, s, handler)
+}
+
+// RequestHasPermission reports whether r carries a valid token for a user holding permission,
+// without writing a response
+func (s *RBACService) RequestHasPermission(r *http.Request, permission perm.Name) bool {
+	_, _, failure := s.authenticate(r, permission)
+	return failure == nil
+}
+
+// Viewer identifies the caller of r for response field filtering. Requests that passed
+// withAuth or OptionalAuth reuse its result; on other routes a valid bearer token is honoured if present, and
+// any other request is treated as anonymous.
+func (s *RBACService) Viewer(r *http.Request) fieldfilter.Viewer {
+	if userID := getUserIDFromContext(r.Context()); userID != "" {
+		return fieldfilter.Viewer{UserID: userID, Permissions: getUserPermissionsFromContext(r.Context())}
+	}
+	if r.Header.Get("Authorization") == "" {
+		return fieldfilter.Viewer{}
+	}
+	_, identity, failure := s.authenticate(r, "")
+	if failure != nil {
+		return fieldfilter.Viewer{}
+	}
+	return fieldfilter.Viewer{UserID: identity.UserID, Permissions: identity.Permissions}
+}
+
+// Client tiers used to select rate limit rules
+const (
+	TierAnonymous = "anonymous"
+	TierUser      = "user"
+	// TierService is for Keycloak service accounts, i.e. API clients using client credentials
+	TierService = "service"
+	// TierAPIKey is for personal access tokens
+	TierAPIKey = "api_key"
+)
+
+// serviceAccountPrefix starts the username Keycloak gives a client's service account
+const serviceAccountPrefix = "service-account-"
+
+// RateLimitClient identifies the caller of r for rate limiting. Only the token is checked, not
+// the caller's permissions, so it stays cheap; requests without a valid token are anonymous.
+func (s *RBACService) RateLimitClient(r *http.Request) ratelimit.Client {
+	client := ratelimit.Client{IP: getClientIP(r), Tier: TierAnonymous}
+	if r.Header.Get("Authorization") == "" {
+		return client
+	}
+	claims, failure := s.parseToken(r)
+	if failure != nil {
+		return client
+	}
+	client.UserID = claims.UserID
+	client.Tenant = claims.Tenant
+	client.Tier = TierUser
+	if strings.HasPrefix(claims.Username, serviceAccountPrefix) {
+		client.Tier = TierService
+	}
+	if claims.ClientID == PersonalTokenClient {
+		client.Tier = TierAPIKey
+	}
+	return client
+}
+
+// ClientID returns the Keycloak client (integration) a request's token was issued to, or
+// "anonymous" for requests without a valid token
+func (s *RBACService) ClientID(r *http.Request) string {
+	if r.Header.Get("Authorization") != "" {
+		if claims, failure := s.parseToken(r); failure == nil && claims.ClientID != "" {
+			return claims.ClientID
+		}
+	}
+	return "anonymous"
+}
+
+// Tenant returns the tenant of the caller of r from their token, or "" when they have none or
+// the token is not valid
+func (s *RBACService) Tenant(r *http.Request) string {
+	if r.Header.Get("Authorization") != "" {
+		if claims, failure := s.parseToken(r); failure == nil {
+			return claims.Tenant
+		}
 	}
 	return ""
 }
 
+// UserIDFromContext returns the authenticated user ID set by withAuth or OptionalAuth, or "" if
+// none. Other modules use auth.UserID.
+func UserIDFromContext(ctx context.Context) string {
+	return auth.UserID(ctx)
+}
+
+// SessionFromContext returns the Keycloak session of the authenticated caller; its ID is empty
+// for tokens not issued by an interactive login, such as service account tokens
+func SessionFromContext(ctx context.Context) Session {
+	return auth.SessionFromContext(ctx)
+}
+
+// getUserIDFromContext extracts user ID from request context
+func getUserIDFromContext(ctx context.Context) string {
+	return auth.UserID(ctx)
+}
+
 // getUserPermissionsFromContext extracts user permissions from request context
 func getUserPermissionsFromContext(ctx context.Context) []string {
-	if permissions, ok := ctx.Value(UserPermissionsKey).([]string); ok {
-		return permissions
-	}
-	return []string{}
+	return auth.Permissions(ctx)
 }
 
 // hasPermission checks if the user has a specific permission
 func hasPermission(userPermissions []string, requiredPermission string) bool {
-	for _, perm := range userPermissions {
-		if perm == requiredPermission {
+	for _, name := range userPermissions {
+		if name == requiredPermission {
 			return true
 		}
 	}
@@ -273,21 +653,143 @@ func hasPermission(userPermissions []string, requiredPermission string) bool {
 type RBACService struct {
 	repo   *RBACRepository
 	logger *logrus.Logger
+	// authObservers are told about rejected requests
+	authObservers authevents.Observers
+	// jwtSecret, when set, overrides the JWT_SECRET environment variable (e.g. from a secret manager)
+	jwtSecret atomic.Pointer[string]
+	// realms, when set, are the Keycloak realms whose tokens are accepted, by issuer
+	realms map[string]TokenRealm
+	// allowHMAC accepts HMAC-signed tokens from realms verified with a JWKS
+	allowHMAC bool
+	// permCache, when set, keeps resolved user permissions between requests
+	permCache PermissionCache
+	// quotas, when set, limits how many roles and groups may be created
+	quotas quota.Checker
+	// maxListItems is the most IDs one assignment request may carry
+	maxListItems int
+	// jobs, when set, runs large assignments in the background for clients that prefer it
+	jobs *jobs.Runner
+
+	// routePermissions holds the permission of each route registered with Protect, and
+	// referenced the permissions checked elsewhere with where they are checked
+	routesMu         sync.RWMutex
+	routePermissions map[*mux.Route]perm.Name
+	referenced       map[perm.Name][]string
+	// access collects which permissions and roles authorization checks exercised
+	access *accessTracker
+
+	// revoked rejects denylisted tokens and tokens issued before a user's access was revoked
+	revoked *revocationList
+	// sessions, when set, ends revoked users' sessions at the identity provider
+	sessions SessionRevoker
+	// events is told when a user's access is revoked
+	events notification.Notifier
+	// tokenLifetime is how long denylist entries are kept
+	tokenLifetime time.Duration
+	// decisions, when set, records authorization decisions for troubleshooting
+	decisions *decisionLog
+	// digests, when set, delivers change digests to the addresses digestRecipient looks up
+	digests         notification.Notifier
+	digestRecipient DigestRecipient
+	// digestTemplates, when set, words the digests
+	digestTemplates *emailtemplates.Service
+	// labels, when set, filters role and group lists by label
+	labels *labels.Service
+	// trash, when set, keeps deleted roles and groups restorable
+	trash *trash.Bin
+	// auditLog, when set, records every change to roles, groups and permissions
+	auditLog *audit.Log
+	// confirmRoleDeletion refuses to delete roles that groups hold unless the deletion is forced
+	confirmRoleDeletion bool
+	// tenants, when set, rejects tokens of suspended tenants
+	tenants TenantStatus
+	// deprecations holds the deprecated permissions, whose checks also accept their successors
+	deprecations *deprecationIndex
 }
 
 // NewRBACService creates a new RBAC service
 func NewRBACService(repo *RBACRepository, logger *logrus.Logger) *RBACService {
 	return &RBACService{
-		repo:   repo,
-		logger: logger,
+		repo:             repo,
+		logger:           logger,
+		routePermissions: make(map[*mux.Route]perm.Name),
+		referenced:       make(map[perm.Name][]string),
+		access:           newAccessTracker(),
+		revoked:          newRevocationList(),
+		deprecations:     newDeprecationIndex(),
+		events:           notification.Nop{},
+		tokenLifetime:    DefaultTokenLifetime,
+		maxListItems:     DefaultMaxListItems,
+	}
+}
+
+// SetQuotaChecker enforces role and group quotas on creation. Set it before serving requests.
+func (s *RBACService) SetQuotaChecker(checker quota.Checker) {
+	s.quotas = checker
+}
+
+// DefaultMaxListItems is the most IDs one assignment request may carry unless SetMaxListItems says otherwise
+const DefaultMaxListItems = 500
+
+// SetMaxListItems bounds the ID lists of assignment requests. Set it before serving requests.
+func (s *RBACService) SetMaxListItems(n int) {
+	s.maxListItems = n
+}
+
+// SetJobRunner lets clients run assignments larger than the list limit as operations with
+// "Prefer: respond-async". Set it before serving requests.
+func (s *RBACService) SetJobRunner(runner *jobs.Runner) {
+	s.jobs = runner
+}
+
+// checkListSize rejects an ID list of n items in field when it is longer than the configured limit
+func (s *RBACService) checkListSize(field string, n int) error {
+	if n <= s.maxListItems {
+		return nil
 	}
+	s.logger.WithFields(logrus.Fields{"field": field, "items": n, "max_items": s.maxListItems}).Warn("Request list too large")
+	return apperrors.TooLarge("LIST_TOO_LARGE", fmt.Sprintf("%s has %d items; at most %d are accepted per request", field, n, s.maxListItems))
+}
+
+// checkQuota returns the quota error for creating one more resource, if any
+func (s *RBACService) checkQuota(ctx context.Context, resource string) error {
+	return s.checkQuotaN(ctx, resource, 1)
+}
+
+// checkQuotaN returns the quota error for creating n more resources, if any
+func (s *RBACService) checkQuotaN(ctx context.Context, resource string, n int) error {
+	if s.quotas == nil {
+		return nil
+	}
+	if err := s.quotas.CheckN(ctx, resource, n); err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("resource", resource).Warn("Quota check rejected creation")
+		return err
+	}
+	return nil
+}
+
+// roleUniqueConstraints, groupUniqueConstraints and permissionUniqueConstraints map unique
+// constraints to the request field they guard
+var (
+	roleUniqueConstraints       = map[string]string{"roles_name_key": "name", "roles_key_key": "key"}
+	groupUniqueConstraints      = map[string]string{"role_groups_name_key": "name"}
+	permissionUniqueConstraints = map[string]string{"permissions_name_key": "name"}
+)
+
+// uniqueViolationError turns a unique violation on one of constraints into the same ValidationError
+// the duplicate pre-check returns, so a concurrent insert that slips past the check is not a 500
+func uniqueViolationError(err error, constraints map[string]string) error {
+	if field, ok := dberrors.UniqueViolationField(err, constraints); ok {
+		return &ValidationError{Field: field, Message: "already exists"}
+	}
+	return err
 }
 
 // CreateRole creates a new role
 func (s *RBACService) CreateRole(ctx context.Context, req CreateRoleRequest) (*Role, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
-		s.logger.WithError(err).Warn("Role creation validation failed")
+		s.logger.WithContext(ctx).WithError(err).Warn("Role creation validation failed")
 		return nil, err
 	}
 
@@ -296,26 +798,33 @@ func (s *RBACService) CreateRole(ctx context.Context, req CreateRoleRequest) (*R
 		return nil, &ValidationError{Field: "name", Message: "already exists"}
 	}
 
+	if err := s.checkQuota(ctx, quota.Roles); err != nil {
+		return nil, err
+	}
+
 	role := &Role{
 		ID:          uuid.New().String(),
+		Key:         req.Key,
 		Name:        req.Name,
 		Description: req.Description,
 		CreatedAt:   time.Now(),
 	}
+	if role.Key == "" {
+		role.Key = roleKey(req.Name)
+	}
 
 	err := s.repo.RoleRepo.Create(role)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to create role")
+		if dupErr := uniqueViolationError(err, roleUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to create role")
 		return nil, err
 	}
 
-	// Log with user context if available
-	userID := getUserIDFromContext(ctx)
-	logger := s.logger.WithField("role_id", role.ID)
-	if userID != "" {
-		logger = logger.WithField("user_id", userID)
-	}
-	logger.Info("Role created successfully")
+	s.audit(ctx, audit.ActionCreate, AuditRole, role.ID, nil, role)
+	// Request and user IDs are attached from ctx
+	s.logger.WithContext(ctx).WithField("role_id", role.ID).Info("Role created successfully")
 	return role, nil
 }
 
@@ -339,8 +848,18 @@ func (s *RBACService) ListRoles() ([]*Role, error) {
 	return roles, nil
 }
 
+// ListRolesPage retrieves one page of roles and the total number of roles
+func (s *RBACService) ListRolesPage(page httpapi.Page) ([]*Role, int, error) {
+	roles, total, err := s.repo.RoleRepo.ListPage(page.Limit, page.Offset)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list roles")
+		return nil, 0, err
+	}
+	return roles, total, nil
+}
+
 // UpdateRole updates an existing role
-func (s *RBACService) UpdateRole(id string, req UpdateRoleRequest) (*Role, error) {
+func (s *RBACService) UpdateRole(ctx context.Context, id string, req UpdateRoleRequest) (*Role, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("Role update validation failed")
@@ -353,7 +872,7 @@ func (s *RBACService) UpdateRole(id string, req UpdateRoleRequest) (*Role, error
 		return nil, err
 	}
 	if role == nil {
-		return nil, &ValidationError{Field: "id", Message: "role not found"}
+		return nil, apperrors.NotFound("ROLE_NOT_FOUND", "role not found")
 	}
 
 	// Check if name conflicts with another role
@@ -361,73 +880,100 @@ func (s *RBACService) UpdateRole(id string, req UpdateRoleRequest) (*Role, error
 		return nil, &ValidationError{Field: "name", Message: "already exists"}
 	}
 
+	before := *role
 	role.Name = req.Name
 	role.Description = req.Description
 
 	err = s.repo.RoleRepo.Update(role)
 	if err != nil {
+		if dupErr := uniqueViolationError(err, roleUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
 		s.logger.WithError(err).Error("Failed to update role")
 		return nil, err
 	}
 
+	s.audit(ctx, audit.ActionUpdate, AuditRole, id, before, role)
 	s.logger.WithField("role_id", id).Info("Role updated successfully")
 	return role, nil
 }
 
-// DeleteRole deletes a role
-func (s *RBACService) DeleteRole(id string) error {
-	// Check if role exists
+// DeleteRole deletes a role for good; TrashRole keeps it restorable
+func (s *RBACService) DeleteRole(ctx context.Context, id string) error {
 	role, err := s.repo.RoleRepo.GetByID(id)
 	if err != nil {
 		return err
 	}
 	if role == nil {
-		return &ValidationError{Field: "id", Message: "role not found"}
+		return apperrors.NotFound("ROLE_NOT_FOUND", "role not found")
 	}
+	return s.removeRole(ctx, role, true)
+}
 
-	// Start transaction
-	tx, err := s.repo.RoleRepo.(*roleRepository).db.Begin()
+// removeRole deletes a role for good, recording who held it
+func (s *RBACService) removeRole(ctx context.Context, role *Role, force bool) error {
+	usage, err := s.deleteRole(ctx, role.ID, force)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to begin transaction")
+		s.auditRefusedDeletion(ctx, role, err)
 		return err
 	}
-	defer tx.Rollback()
 
-	// Clear role permissions within transaction
-	err = s.repo.RolePermRepo.(*rolePermissionRepository).ClearRolePermissionsWithTransaction(tx, id)
+	s.forgetLabels(labels.KindRole, role.ID)
+	s.audit(ctx, audit.ActionDelete, AuditRole, role.ID, roleDeletion{Role: role, Usage: usage}, nil)
+	s.logger.WithField("role_id", role.ID).Info("Role deleted successfully")
+	return nil
+}
+
+// deleteRole deletes a role with its permission and group assignments and returns who held it.
+// The role is locked and its usage read in the deleting transaction, so no group can gain it
+// unnoticed; when deletions must be confirmed, groups hold the role and force is not set it
+// refuses with a RoleInUseError.
+func (s *RBACService) deleteRole(ctx context.Context, id string, force bool) (*RoleUsage, error) {
+	var usage *RoleUsage
+	err := s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.RoleRepo.Lock(id); err != nil {
+			return err
+		}
+		var err error
+		if usage, err = repos.GroupRoleRepo.GetRoleUsage(id); err != nil {
+			return err
+		}
+		if s.confirmRoleDeletion && !force && len(usage.Groups) > 0 {
+			return &RoleInUseError{Usage: usage}
+		}
+		return s.deleteRoleIn(repos, id)
+	})
 	if err != nil {
+		return nil, err
+	}
+	s.accessChanged(context.Background())
+	return usage, nil
+}
+
+// deleteRoleIn deletes a role through repos, so a dry run can roll it back
+func (s *RBACService) deleteRoleIn(repos *RBACRepository, id string) error {
+	// Remove all permissions and group assignments before the role itself
+	if err := repos.RolePermRepo.ClearRolePermissions(id); err != nil {
 		s.logger.WithError(err).Error("Failed to clear role permissions in transaction")
 		return err
 	}
-
-	// Remove role from all groups within transaction
-	err = s.repo.GroupRoleRepo.(*groupRoleRepository).RemoveRoleFromAllGroupsWithTransaction(tx, id)
-	if err != nil {
+	if err := repos.GroupRoleRepo.RemoveRoleFromAllGroups(id); err != nil {
 		s.logger.WithError(err).Error("Failed to remove role from groups in transaction")
 		return err
 	}
-
-	// Delete the role within transaction
-	err = s.repo.RoleRepo.(*roleRepository).DeleteWithTransaction(tx, id)
-	if err != nil {
+	if err := repos.RoleRepo.Delete(id); err != nil {
 		s.logger.WithError(err).Error("Failed to delete role in transaction")
 		return err
 	}
-
-	// Commit transaction
-	err = tx.Commit()
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to commit transaction")
-		return err
-	}
-
-	s.logger.WithField("role_id", id).Info("Role deleted successfully")
 	return nil
 }
 
 // AssignPermissionsToRole assigns permissions to a role
-func (s *RBACService) AssignPermissionsToRole(roleID string, req AssignPermissionsToRoleRequest) error {
+func (s *RBACService) AssignPermissionsToRole(ctx context.Context, roleID string, req AssignPermissionsToRoleRequest) error {
 	// Validate input
+	if err := s.checkListSize("permission_ids", len(req.PermissionIDs)); err != nil {
+		return err
+	}
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("Permission assignment validation failed")
 		return err
@@ -439,25 +985,32 @@ func (s *RBACService) AssignPermissionsToRole(roleID string, req AssignPermissio
 		return err
 	}
 	if role == nil {
-		return &ValidationError{Field: "role_id", Message: "role not found"}
+		return apperrors.NotFound("ROLE_NOT_FOUND", "role not found")
 	}
 
-	// Validate all permissions exist
-	for _, permID := range req.PermissionIDs {
-		perm, err := s.repo.PermissionRepo.GetByID(permID)
-		if err != nil {
-			return err
-		}
-		if perm == nil {
-			return &ValidationError{Field: "permission_ids", Message: "permission not found: " + permID}
-		}
+	// Validate all permissions exist with a single query
+	missing, err := s.repo.PermissionRepo.FindMissingIDs(req.PermissionIDs)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to validate permission IDs")
+		return err
+	}
+	if len(missing) > 0 {
+		return &ValidationError{Field: "permission_ids", Message: "permissions not found: " + strings.Join(missing, ", ")}
 	}
 
+	before, err := s.auditedRoleAccess(roleID)
+	if err != nil {
+		return err
+	}
 	err = s.repo.RolePermRepo.AssignPermissionsToRole(roleID, req.PermissionIDs)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to assign permissions to role")
 		return err
 	}
+	s.accessChanged(ctx)
+	if before != nil {
+		s.audit(ctx, audit.ActionUpdate, AuditRole, roleID, before, &roleAccess{PermissionIDs: uniqueSorted(append(before.PermissionIDs, req.PermissionIDs...))})
+	}
 
 	s.logger.WithFields(logrus.Fields{
 		"role_id":     roleID,
@@ -477,7 +1030,7 @@ func (s *RBACService) GetRolePermissions(roleID string) ([]*Permission, error) {
 }
 
 // CreateRoleGroup creates a new role group
-func (s *RBACService) CreateRoleGroup(req CreateRoleGroupRequest) (*RoleGroup, error) {
+func (s *RBACService) CreateRoleGroup(ctx context.Context, req CreateRoleGroupRequest) (*RoleGroup, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("Role group creation validation failed")
@@ -489,6 +1042,10 @@ func (s *RBACService) CreateRoleGroup(req CreateRoleGroupRequest) (*RoleGroup, e
 		return nil, &ValidationError{Field: "name", Message: "already exists"}
 	}
 
+	if err := s.checkQuota(ctx, quota.Groups); err != nil {
+		return nil, err
+	}
+
 	group := &RoleGroup{
 		ID:          uuid.New().String(),
 		Name:        req.Name,
@@ -498,10 +1055,14 @@ func (s *RBACService) CreateRoleGroup(req CreateRoleGroupRequest) (*RoleGroup, e
 
 	err := s.repo.GroupRepo.Create(group)
 	if err != nil {
+		if dupErr := uniqueViolationError(err, groupUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
 		s.logger.WithError(err).Error("Failed to create role group")
 		return nil, err
 	}
 
+	s.audit(ctx, audit.ActionCreate, AuditGroup, group.ID, nil, group)
 	s.logger.WithField("group_id", group.ID).Info("Role group created successfully")
 	return group, nil
 }
@@ -526,8 +1087,18 @@ func (s *RBACService) ListRoleGroups() ([]*RoleGroup, error) {
 	return groups, nil
 }
 
+// ListRoleGroupsPage retrieves one page of role groups and the total number of role groups
+func (s *RBACService) ListRoleGroupsPage(page httpapi.Page) ([]*RoleGroup, int, error) {
+	groups, total, err := s.repo.GroupRepo.ListPage(page.Limit, page.Offset)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list role groups")
+		return nil, 0, err
+	}
+	return groups, total, nil
+}
+
 // UpdateRoleGroup updates an existing role group
-func (s *RBACService) UpdateRoleGroup(id string, req UpdateRoleGroupRequest) (*RoleGroup, error) {
+func (s *RBACService) UpdateRoleGroup(ctx context.Context, id string, req UpdateRoleGroupRequest) (*RoleGroup, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("Role group update validation failed")
@@ -540,7 +1111,7 @@ func (s *RBACService) UpdateRoleGroup(id string, req UpdateRoleGroupRequest) (*R
 		return nil, err
 	}
 	if group == nil {
-		return nil, &ValidationError{Field: "id", Message: "role group not found"}
+		return nil, apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
 	}
 
 	// Check if name conflicts with another group
@@ -548,77 +1119,88 @@ func (s *RBACService) UpdateRoleGroup(id string, req UpdateRoleGroupRequest) (*R
 		return nil, &ValidationError{Field: "name", Message: "already exists"}
 	}
 
+	before := *group
 	group.Name = req.Name
 	group.Description = req.Description
 
 	err = s.repo.GroupRepo.Update(group)
 	if err != nil {
+		if dupErr := uniqueViolationError(err, groupUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
 		s.logger.WithError(err).Error("Failed to update role group")
 		return nil, err
 	}
 
+	s.audit(ctx, audit.ActionUpdate, AuditGroup, id, before, group)
 	s.logger.WithField("group_id", id).Info("Role group updated successfully")
 	return group, nil
 }
 
-// DeleteRoleGroup deletes a role group
-func (s *RBACService) DeleteRoleGroup(id string) error {
-	// Check if group exists
+// DeleteRoleGroup deletes a role group for good; TrashRoleGroup keeps it restorable. The removal
+// of its members is recorded in the membership history, attributed to the user in ctx.
+func (s *RBACService) DeleteRoleGroup(ctx context.Context, id string) error {
 	group, err := s.repo.GroupRepo.GetByID(id)
 	if err != nil {
 		return err
 	}
 	if group == nil {
-		return &ValidationError{Field: "id", Message: "role group not found"}
+		return apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
 	}
-
-	// Start transaction
-	tx, err := s.repo.GroupRepo.(*roleGroupRepository).db.Begin()
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to begin transaction")
+	if err := s.deleteRoleGroup(ctx, id); err != nil {
 		return err
 	}
-	defer tx.Rollback()
 
-	// Clear group roles within transaction
-	err = s.repo.GroupRoleRepo.(*groupRoleRepository).ClearGroupRolesWithTransaction(tx, id)
-	if err != nil {
+	s.forgetLabels(labels.KindGroup, id)
+	s.audit(ctx, audit.ActionDelete, AuditGroup, id, group, nil)
+	s.logger.WithField("group_id", id).Info("Role group deleted successfully")
+	return nil
+}
+
+// deleteRoleGroup deletes a role group with its role assignments and memberships
+func (s *RBACService) deleteRoleGroup(ctx context.Context, id string) error {
+	err := s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		return s.deleteRoleGroupIn(ctx, repos, id)
+	})
+	if err == nil {
+		s.accessChanged(ctx)
+	}
+	return err
+}
+
+// deleteRoleGroupIn deletes a role group through repos, so a dry run can roll it back
+func (s *RBACService) deleteRoleGroupIn(ctx context.Context, repos *RBACRepository, id string) error {
+	// Detach roles and members before the group itself
+	if err := repos.GroupRoleRepo.ClearGroupRoles(id); err != nil {
 		s.logger.WithError(err).Error("Failed to clear group roles in transaction")
 		return err
 	}
-
-	// Remove all users from group within transaction
-	err = s.repo.MembershipRepo.(*userGroupMembershipRepository).ClearGroupMembershipsWithTransaction(tx, id)
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to clear group memberships in transaction")
+	if err := repos.HistoryRepo.RecordGroupRemoval(id, getUserIDFromContext(ctx), time.Now()); err != nil {
+		s.logger.WithError(err).Error("Failed to record group membership removals in transaction")
 		return err
 	}
-
-	// Delete the group within transaction
-	err = s.repo.GroupRepo.(*roleGroupRepository).DeleteWithTransaction(tx, id)
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to delete role group in transaction")
+	if err := repos.MembershipRepo.ClearGroupMemberships(id); err != nil {
+		s.logger.WithError(err).Error("Failed to clear group memberships in transaction")
 		return err
 	}
-
-	// Commit transaction
-	err = tx.Commit()
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to commit transaction")
+	if err := repos.GroupRepo.Delete(id); err != nil {
+		s.logger.WithError(err).Error("Failed to delete role group in transaction")
 		return err
 	}
-
-	s.logger.WithField("group_id", id).Info("Role group deleted successfully")
 	return nil
 }
 
-// AssignUserToGroup assigns a user to a role group
-func (s *RBACService) AssignUserToGroup(groupID string, req AssignUserToGroupRequest) error {
+// AssignUserToGroup assigns a user to a role group and records it in the membership history,
+// attributed to the user in ctx
+func (s *RBACService) AssignUserToGroup(ctx context.Context, groupID string, req AssignUserToGroupRequest) error {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("User assignment validation failed")
 		return err
 	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return &ValidationError{Field: "expires_at", Message: "must be in the future"}
+	}
 
 	// Check if group exists
 	group, err := s.repo.GroupRepo.GetByID(groupID)
@@ -626,7 +1208,7 @@ func (s *RBACService) AssignUserToGroup(groupID string, req AssignUserToGroupReq
 		return err
 	}
 	if group == nil {
-		return &ValidationError{Field: "group_id", Message: "group not found"}
+		return apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
 	}
 
 	// Check if user is already in group
@@ -635,20 +1217,35 @@ func (s *RBACService) AssignUserToGroup(groupID string, req AssignUserToGroupReq
 		return err
 	}
 	if isMember {
-		return &ValidationError{Field: "user_id", Message: "user already in group"}
+		return apperrors.Conflict("ALREADY_GROUP_MEMBER", "user already in group")
 	}
 
 	membership := &UserGroupMembership{
 		UserID:     req.UserID,
 		GroupID:    groupID,
 		AssignedAt: time.Now(),
+		ExpiresAt:  req.ExpiresAt,
 	}
 
-	err = s.repo.MembershipRepo.Create(membership)
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.MembershipRepo.Create(membership); err != nil {
+			return err
+		}
+		return repos.HistoryRepo.Record(&MembershipEvent{
+			GroupID:    groupID,
+			UserID:     req.UserID,
+			Action:     MembershipAdded,
+			ActorID:    getUserIDFromContext(ctx),
+			ExpiresAt:  req.ExpiresAt,
+			OccurredAt: membership.AssignedAt,
+		})
+	})
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to assign user to group")
 		return err
 	}
+	s.accessChanged(ctx, req.UserID)
+	s.audit(ctx, audit.ActionCreate, AuditMembership, groupID, nil, membership)
 
 	s.logger.WithFields(logrus.Fields{
 		"user_id":  req.UserID,
@@ -657,38 +1254,106 @@ func (s *RBACService) AssignUserToGroup(groupID string, req AssignUserToGroupReq
 	return nil
 }
 
-// RemoveUserFromGroup removes a user from a role group
-func (s *RBACService) RemoveUserFromGroup(groupID, userID string) error {
+// RemoveUserFromGroup removes a user from a role group and records it in the membership
+// history, attributed to the user in ctx
+func (s *RBACService) RemoveUserFromGroup(ctx context.Context, groupID, userID string) error {
 	// Check if membership exists
 	isMember, err := s.repo.MembershipRepo.IsUserInGroup(userID, groupID)
 	if err != nil {
 		return err
 	}
 	if !isMember {
-		return &ValidationError{Field: "user_id", Message: "user not in group"}
+		return apperrors.NotFound("MEMBERSHIP_NOT_FOUND", "user not in group")
 	}
 
-	err = s.repo.MembershipRepo.Delete(userID, groupID)
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.MembershipRepo.Delete(userID, groupID); err != nil {
+			return err
+		}
+		return repos.HistoryRepo.Record(&MembershipEvent{
+			GroupID:    groupID,
+			UserID:     userID,
+			Action:     MembershipRemoved,
+			ActorID:    getUserIDFromContext(ctx),
+			OccurredAt: time.Now(),
+		})
+	})
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to remove user from group")
 		return err
 	}
+	s.accessChanged(ctx, userID)
+	s.audit(ctx, audit.ActionDelete, AuditMembership, groupID, &UserGroupMembership{UserID: userID, GroupID: groupID}, nil)
+
+	s.logger.WithFields(logrus.Fields{
+		"user_id":  userID,
+		"group_id": groupID,
+	}).Info("User removed from group successfully")
+
+	// Tokens and identity provider sessions may still carry the group
+	if _, err := s.revokeUserAccess(ctx, userID, RevokedGroupRemoved, RevokedGroupRemoved, map[string]interface{}{"group_id": groupID}); err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Warn("Failed to end sessions of user removed from group")
+	}
+	return nil
+}
+
+// GetUserGroups retrieves all groups for a user
+func (s *RBACService) GetUserGroups(userID string) ([]*RoleGroup, error) {
+	groups, err := s.repo.MembershipRepo.GetUserGroups(userID)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get user groups")
+		return nil, err
+	}
+	return groups, nil
+}
+
+// MyAccess returns the groups, roles and permissions of userID. Unlike GetUserPermissions it
+// lists every group the user belongs to, including groups that grant no permissions.
+func (s *RBACService) MyAccess(ctx context.Context, userID, username string) (*MyAccess, error) {
+	groups, err := s.GetUserGroups(userID)
+	if err != nil {
+		return nil, err
+	}
+	userPerms, err := s.GetUserPermissions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(userPerms.Permissions))
+	for _, p := range userPerms.Permissions {
+		names = append(names, p.Key)
+	}
+	sort.Strings(names)
+	sort.Slice(userPerms.Roles, func(i, j int) bool { return userPerms.Roles[i].Name < userPerms.Roles[j].Name })
+
+	access := &MyAccess{UserID: userID, Username: username, Groups: groups, Roles: userPerms.Roles, Permissions: names}
+	if access.Groups == nil {
+		access.Groups = []*RoleGroup{}
+	}
+	if access.Roles == nil {
+		access.Roles = []Role{}
+	}
+	return access, nil
+}
 
-	s.logger.WithFields(logrus.Fields{
-		"user_id":  userID,
-		"group_id": groupID,
-	}).Info("User removed from group successfully")
-	return nil
+// GroupMembershipHistory returns one page of a group's membership events, newest first
+func (s *RBACService) GroupMembershipHistory(groupID string, page httpapi.Page) ([]*MembershipEvent, int, error) {
+	events, total, err := s.repo.HistoryRepo.ListByGroup(groupID, page.Limit, page.Offset)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list group membership history")
+		return nil, 0, err
+	}
+	return events, total, nil
 }
 
-// GetUserGroups retrieves all groups for a user
-func (s *RBACService) GetUserGroups(userID string) ([]*RoleGroup, error) {
-	groups, err := s.repo.MembershipRepo.GetUserGroups(userID)
+// UserMembershipHistory returns one page of a user's membership events, newest first
+func (s *RBACService) UserMembershipHistory(userID string, page httpapi.Page) ([]*MembershipEvent, int, error) {
+	events, total, err := s.repo.HistoryRepo.ListByUser(userID, page.Limit, page.Offset)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to get user groups")
-		return nil, err
+		s.logger.WithError(err).Error("Failed to list user membership history")
+		return nil, 0, err
 	}
-	return groups, nil
+	return events, total, nil
 }
 
 // GetGroupUsers retrieves all users in a group
@@ -701,9 +1366,21 @@ func (s *RBACService) GetGroupUsers(groupID string) ([]string, error) {
 	return userIDs, nil
 }
 
+// StreamGroupUsers calls fn for every user in a group while rows are read from the database
+func (s *RBACService) StreamGroupUsers(groupID string, fn func(userID string) error) error {
+	err := s.repo.MembershipRepo.StreamGroupUsers(groupID, fn)
+	if err != nil {
+		s.logger.WithError(err).WithField("group_id", groupID).Error("Failed to stream group users")
+	}
+	return err
+}
+
 // AssignRolesToGroup assigns roles to a group
-func (s *RBACService) AssignRolesToGroup(groupID string, req AssignRolesToGroupRequest) error {
+func (s *RBACService) AssignRolesToGroup(ctx context.Context, groupID string, req AssignRolesToGroupRequest) error {
 	// Validate input
+	if err := s.checkListSize("role_ids", len(req.RoleIDs)); err != nil {
+		return err
+	}
 	if err := validate.Struct(req); err != nil {
 		s.logger.WithError(err).Warn("Role assignment validation failed")
 		return err
@@ -715,25 +1392,32 @@ func (s *RBACService) AssignRolesToGroup(groupID string, req AssignRolesToGroupR
 		return err
 	}
 	if group == nil {
-		return &ValidationError{Field: "group_id", Message: "group not found"}
+		return apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
 	}
 
-	// Validate all roles exist
-	for _, roleID := range req.RoleIDs {
-		role, err := s.repo.RoleRepo.GetByID(roleID)
-		if err != nil {
-			return err
-		}
-		if role == nil {
-			return &ValidationError{Field: "role_ids", Message: "role not found: " + roleID}
-		}
+	// Validate all roles exist with a single query
+	missing, err := s.repo.RoleRepo.FindMissingIDs(req.RoleIDs)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to validate role IDs")
+		return err
+	}
+	if len(missing) > 0 {
+		return &ValidationError{Field: "role_ids", Message: "roles not found: " + strings.Join(missing, ", ")}
 	}
 
+	before, err := s.auditedGroupAccess(groupID)
+	if err != nil {
+		return err
+	}
 	err = s.repo.GroupRoleRepo.AssignRolesToGroup(groupID, req.RoleIDs)
 	if err != nil {
 		s.logger.WithError(err).Error("Failed to assign roles to group")
 		return err
 	}
+	s.accessChanged(ctx)
+	if before != nil {
+		s.audit(ctx, audit.ActionUpdate, AuditGroup, groupID, before, &groupAccess{RoleIDs: uniqueSorted(append(before.RoleIDs, req.RoleIDs...))})
+	}
 
 	s.logger.WithFields(logrus.Fields{
 		"group_id": groupID,
@@ -742,6 +1426,79 @@ func (s *RBACService) AssignRolesToGroup(groupID string, req AssignRolesToGroupR
 	return nil
 }
 
+// OperationAssignGroupRoles is the kind of the operation assigning roles to a group in the background
+const OperationAssignGroupRoles = "rbac.assign_group_roles"
+
+// maxAsyncListItems bounds the IDs of an assignment run as an operation
+const maxAsyncListItems = 100000
+
+// AssignmentResult is the result of an assignment run as an operation
+type AssignmentResult struct {
+	Assigned int `json:"assigned"`
+}
+
+// StartAssignRolesToGroup checks req and starts assigning its roles to a group as an operation,
+// in chunks of the list limit with one transaction each. A chunk naming a missing role fails
+// the operation; the chunks before it stay assigned.
+func (s *RBACService) StartAssignRolesToGroup(ctx context.Context, groupID string, req AssignRolesToGroupRequest) (*jobs.Operation, error) {
+	if len(req.RoleIDs) > maxAsyncListItems {
+		return nil, apperrors.TooLarge("LIST_TOO_LARGE", fmt.Sprintf("role_ids has %d items; at most %d are accepted per operation", len(req.RoleIDs), maxAsyncListItems))
+	}
+	if err := validate.Struct(req); err != nil {
+		s.logger.WithError(err).Warn("Role assignment validation failed")
+		return nil, err
+	}
+	group, err := s.repo.GroupRepo.GetByID(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
+	}
+
+	return s.jobs.Submit(ctx, OperationAssignGroupRoles, getUserIDFromContext(ctx), func(ctx context.Context) (interface{}, error) {
+		assigned, err := s.assignRolesToGroupInChunks(ctx, groupID, req.RoleIDs)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			err = apperrors.Invalid("VALIDATION_ERROR", validationErr.Error())
+		}
+		return &AssignmentResult{Assigned: assigned}, err
+	})
+}
+
+// assignRolesToGroupInChunks assigns roleIDs in chunks of the list limit and returns how many
+// were assigned
+func (s *RBACService) assignRolesToGroupInChunks(ctx context.Context, groupID string, roleIDs []string) (int, error) {
+	logger := s.logger.WithContext(ctx).WithField("group_id", groupID)
+	for start := 0; start < len(roleIDs); start += s.maxListItems {
+		chunk := roleIDs[start:min(start+s.maxListItems, len(roleIDs))]
+		missing, err := s.repo.RoleRepo.FindMissingIDs(chunk)
+		if err != nil {
+			logger.WithError(err).Error("Failed to validate role IDs")
+			return start, err
+		}
+		if len(missing) > 0 {
+			return start, &ValidationError{Field: "role_ids", Message: "roles not found: " + strings.Join(missing, ", ")}
+		}
+		before, err := s.auditedGroupAccess(groupID)
+		if err != nil {
+			return start, err
+		}
+		if err := s.repo.GroupRoleRepo.AssignRolesToGroup(groupID, chunk); err != nil {
+			logger.WithError(err).Error("Failed to assign roles to group")
+			return start, err
+		}
+		s.accessChanged(ctx)
+		if before != nil {
+			s.audit(ctx, audit.ActionUpdate, AuditGroup, groupID, before, &groupAccess{RoleIDs: uniqueSorted(append(before.RoleIDs, chunk...))})
+		}
+		jobs.ReportProgress(ctx, start+len(chunk), len(roleIDs))
+	}
+
+	logger.WithField("roles", len(roleIDs)).Info("Roles assigned to group successfully")
+	return len(roleIDs), nil
+}
+
 // GetGroupRoles retrieves roles for a group
 func (s *RBACService) GetGroupRoles(groupID string) ([]*Role, error) {
 	roles, err := s.repo.GroupRoleRepo.GetGroupRoles(groupID)
@@ -752,89 +1509,162 @@ func (s *RBACService) GetGroupRoles(groupID string) ([]*Role, error) {
 	return roles, nil
 }
 
-// GetUserPermissions retrieves all permissions for a user through their groups using a single optimized query
+// GetUserPermissions retrieves all permissions for a user through their groups. Cache misses
+// resolve on the primary, never a replica: the first lookup after accessChanged invalidated an
+// entry must see the change, or the stale result would be cached for the whole TTL.
 func (s *RBACService) GetUserPermissions(ctx context.Context, userID string) (*UserPermissions, error) {
-	// Use single optimized query with JOINs to get all user permissions
-	query := `
-		SELECT DISTINCT
-			p.id, p.name, p.resource, p.action,
-			r.id, r.name, r.description, r.created_at,
-			rg.id, rg.name, rg.description, rg.created_at
-		FROM permissions p
-		JOIN role_permissions rp ON p.id = rp.permission_id
-		JOIN group_roles gr ON rp.role_id = gr.role_id
-		JOIN user_group_memberships ugm ON gr.group_id = ugm.group_id
-		JOIN roles r ON rp.role_id = r.id
-		JOIN role_groups rg ON gr.group_id = rg.id
-		WHERE ugm.user_id = $1
-		ORDER BY rg.name, r.name, p.resource, p.action
-	`
-
-	rows, err := s.repo.RoleRepo.(*roleRepository).db.Query(query, userID)
+	var generation uint64
+	if s.permCache != nil {
+		var cached *UserPermissions
+		var ok bool
+		if cached, generation, ok = s.permCache.Get(ctx, userID); ok {
+			return cached, nil
+		}
+	}
+	userPerms, err := s.repo.UserPermRepo.GetUserPermissions(userID)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to get user permissions")
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to get user permissions")
 		return nil, err
 	}
-	defer rows.Close()
-
-	// Use maps to deduplicate results
-	permissionMap := make(map[string]*Permission)
-	roleMap := make(map[string]*Role)
-	groupMap := make(map[string]*RoleGroup)
+	if s.permCache != nil {
+		s.permCache.Set(ctx, userID, userPerms, generation)
+	}
+	return userPerms, nil
+}
 
-	for rows.Next() {
-		var perm Permission
-		var role Role
-		var group RoleGroup
+// ListPermissions retrieves all available permissions
+func (s *RBACService) ListPermissions() ([]*Permission, error) {
+	permissions, err := s.repo.PermissionRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permissions")
+		return nil, err
+	}
+	return permissions, nil
+}
 
-		err := rows.Scan(
-			&perm.ID, &perm.Name, &perm.Resource, &perm.Action,
-			&role.ID, &role.Name, &role.Description, &role.CreatedAt,
-			&group.ID, &group.Name, &group.Description, &group.CreatedAt,
-		)
-		if err != nil {
-			s.logger.WithError(err).Error("Failed to scan user permissions")
-			return nil, err
-		}
+// ListPermissionsPage retrieves one page of permissions and the total number of permissions
+func (s *RBACService) ListPermissionsPage(page httpapi.Page) ([]*Permission, int, error) {
+	permissions, total, err := s.repo.PermissionRepo.ListPage(page.Limit, page.Offset)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permissions")
+		return nil, 0, err
+	}
+	return permissions, total, nil
+}
 
-		// Store in maps to deduplicate
-		permissionMap[perm.ID] = &perm
-		roleMap[role.ID] = &role
-		groupMap[group.ID] = &group
+// PermissionCatalog returns every permission with the roles granting it, grouped by resource or
+// category (CatalogByResource or CatalogByCategory). Groups and their permissions are sorted by
+// key and name.
+func (s *RBACService) PermissionCatalog(groupBy string) ([]CatalogGroup, error) {
+	if groupBy != CatalogByResource && groupBy != CatalogByCategory {
+		return nil, &ValidationError{Field: "group_by", Message: "must be one of: resource, category"}
+	}
+	permissions, err := s.repo.PermissionRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permissions")
+		return nil, err
+	}
+	refs, err := s.repo.PermissionRepo.RoleReferences()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permission role references")
+		return nil, err
 	}
 
-	// Convert maps to slices
-	var permissions []Permission
-	for _, perm := range permissionMap {
-		permissions = append(permissions, *perm)
+	byKey := make(map[string]*CatalogGroup)
+	var keys []string
+	for _, permission := range permissions {
+		key := permission.Resource
+		if groupBy == CatalogByCategory {
+			key = permission.Category
+		}
+		group, ok := byKey[key]
+		if !ok {
+			group = &CatalogGroup{Key: key}
+			byKey[key] = group
+			keys = append(keys, key)
+		}
+		group.Permissions = append(group.Permissions, catalogEntry(permission, refs[permission.ID]))
 	}
 
-	var roles []Role
-	for _, role := range roleMap {
-		roles = append(roles, *role)
+	sort.Strings(keys)
+	catalog := make([]CatalogGroup, len(keys))
+	for i, key := range keys {
+		group := byKey[key]
+		sort.Slice(group.Permissions, func(a, b int) bool {
+			return group.Permissions[a].Name < group.Permissions[b].Name
+		})
+		catalog[i] = *group
 	}
+	return catalog, nil
+}
 
-	var groups []RoleGroup
-	for _, group := range groupMap {
-		groups = append(groups, *group)
+// PermissionMatrix returns the roles × permissions grid, limited to resource when it is set
+func (s *RBACService) PermissionMatrix(resource string) (*PermissionMatrix, error) {
+	matrix, err := s.repo.PermissionRepo.Matrix(resource)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to build permission matrix")
+		return nil, err
 	}
+	return matrix, nil
+}
 
-	return &UserPermissions{
-		UserID:      userID,
-		Permissions: permissions,
-		Roles:       roles,
-		Groups:      groups,
-	}, nil
+// GetPermission retrieves a permission and the roles granting it
+func (s *RBACService) GetPermission(id string) (*CatalogEntry, error) {
+	permission, err := s.repo.PermissionRepo.GetByID(id)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get permission")
+		return nil, err
+	}
+	if permission == nil {
+		return nil, apperrors.NotFound("PERMISSION_NOT_FOUND", "permission not found")
+	}
+	refs, err := s.repo.PermissionRepo.RoleReferences()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permission role references")
+		return nil, err
+	}
+	entry := catalogEntry(permission, refs[permission.ID])
+	return &entry, nil
 }
 
-// ListPermissions retrieves all available permissions
-func (s *RBACService) ListPermissions() ([]*Permission, error) {
-	permissions, err := s.repo.PermissionRepo.List()
+// RenamePermission changes the display name of a permission. Its key, and so every check of it,
+// stays the same.
+func (s *RBACService) RenamePermission(ctx context.Context, id string, req RenamePermissionRequest) (*Permission, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	permission, err := s.repo.PermissionRepo.GetByID(id)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to list permissions")
 		return nil, err
 	}
-	return permissions, nil
+	if permission == nil {
+		return nil, apperrors.NotFound("PERMISSION_NOT_FOUND", "permission not found")
+	}
+
+	if err := s.repo.PermissionRepo.Rename(id, req.Name); err != nil {
+		if dupErr := uniqueViolationError(err, permissionUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to rename permission")
+		return nil, err
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"permission": permission.Key,
+		"old_name":   permission.Name,
+		"new_name":   req.Name,
+	}).Info("Permission renamed")
+	before := *permission
+	permission.Name = req.Name
+	s.audit(ctx, audit.ActionUpdate, AuditPermission, id, before, permission)
+	return permission, nil
+}
+
+func catalogEntry(permission *Permission, roles []RoleRef) CatalogEntry {
+	if roles == nil {
+		roles = []RoleRef{}
+	}
+	return CatalogEntry{Permission: permission, Roles: roles}
 }
 
 // HTTP Handlers
@@ -855,21 +1685,18 @@ func CreateRoleHandler(service *RBACService) http.HandlerFunc {
 
 		role, err := service.CreateRole(r.Context(), req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
-				return
-			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to create role", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to create role")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(role)
+		json.NewEncoder(w).Encode(roleResource(role))
 	}
 }
 
-// GetRolesHandler handles GET /api/rbac/roles
+// GetRolesHandler handles GET /api/rbac/roles, optionally filtered with ?label=key:value and
+// ordered with ?sort=name
 func GetRolesHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -877,14 +1704,24 @@ func GetRolesHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		roles, err := service.ListRoles()
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		query, err := ParseListQuery(r.URL.Query())
 		if err != nil {
-			http.Error(w, "Failed to get roles", http.StatusInternalServerError)
+			writeServiceError(w, err, "Invalid list query")
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(roles)
+		roles, total, err := service.ListRolesQuery(query, page)
+		if err != nil {
+			writeServiceError(w, err, "Failed to get roles")
+			return
+		}
+
+		httpapi.WriteList(w, r, roleResources(roles), total, page)
 	}
 }
 
@@ -909,22 +1746,19 @@ func UpdateRoleHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		role, err := service.UpdateRole(roleID, req)
+		role, err := service.UpdateRole(r.Context(), roleID, req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Failed to update role", http.StatusInternalServerError)
+			writeServiceError(w, err, "Failed to update role")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(role)
+		json.NewEncoder(w).Encode(roleResource(role))
 	}
 }
 
-// DeleteRoleHandler handles DELETE /api/rbac/roles/{id}
+// DeleteRoleHandler handles DELETE /api/rbac/roles/{id}. With ?dry_run=true it reports the
+// impact of the deletion instead.
 func DeleteRoleHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
@@ -939,13 +1773,25 @@ func DeleteRoleHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		err := service.DeleteRole(roleID)
-		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+		if IsDryRun(r) {
+			impact, err := service.RoleDeletionImpact(r.Context(), roleID)
+			if err != nil {
+				writeServiceError(w, err, "Failed to delete role")
 				return
 			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete role", "INTERNAL_ERROR", nil)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(impact)
+			return
+		}
+
+		err := service.TrashRole(r.Context(), roleID, IsForced(r))
+		var inUse *RoleInUseError
+		if errors.As(err, &inUse) {
+			writeRoleInUse(w, inUse)
+			return
+		}
+		if err != nil {
+			writeServiceError(w, err, "Failed to delete role")
 			return
 		}
 
@@ -967,23 +1813,20 @@ func CreateRoleGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		group, err := service.CreateRoleGroup(req)
+		group, err := service.CreateRoleGroup(r.Context(), req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Failed to create role group", http.StatusInternalServerError)
+			writeServiceError(w, err, "Failed to create role group")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(group)
+		json.NewEncoder(w).Encode(groupResource(group))
 	}
 }
 
-// GetRoleGroupsHandler handles GET /api/rbac/groups
+// GetRoleGroupsHandler handles GET /api/rbac/groups, optionally filtered with ?label=key:value
+// and ordered with ?sort=name
 func GetRoleGroupsHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -991,14 +1834,24 @@ func GetRoleGroupsHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		groups, err := service.ListRoleGroups()
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		query, err := ParseListQuery(r.URL.Query())
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get role groups", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Invalid list query")
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(groups)
+		groups, total, err := service.ListRoleGroupsQuery(query, page)
+		if err != nil {
+			writeServiceError(w, err, "Failed to get role groups")
+			return
+		}
+
+		httpapi.WriteList(w, r, groupResources(groups), total, page)
 	}
 }
 
@@ -1019,7 +1872,7 @@ func GetRoleGroupHandler(service *RBACService) http.HandlerFunc {
 
 		group, err := service.GetRoleGroup(groupID)
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get role group", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to get role group")
 			return
 		}
 		if group == nil {
@@ -1028,7 +1881,7 @@ func GetRoleGroupHandler(service *RBACService) http.HandlerFunc {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(group)
+		json.NewEncoder(w).Encode(groupResource(group))
 	}
 }
 
@@ -1053,22 +1906,19 @@ func UpdateRoleGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		group, err := service.UpdateRoleGroup(groupID, req)
+		group, err := service.UpdateRoleGroup(r.Context(), groupID, req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
-				return
-			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to update role group", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to update role group")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(group)
+		json.NewEncoder(w).Encode(groupResource(group))
 	}
 }
 
-// DeleteRoleGroupHandler handles DELETE /api/rbac/groups/{id}
+// DeleteRoleGroupHandler handles DELETE /api/rbac/groups/{id}. With ?dry_run=true it reports
+// the impact of the deletion instead.
 func DeleteRoleGroupHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
@@ -1083,13 +1933,20 @@ func DeleteRoleGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		err := service.DeleteRoleGroup(groupID)
-		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+		if IsDryRun(r) {
+			impact, err := service.RoleGroupDeletionImpact(r.Context(), groupID)
+			if err != nil {
+				writeServiceError(w, err, "Failed to delete role group")
 				return
 			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to delete role group", "INTERNAL_ERROR", nil)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(impact)
+			return
+		}
+
+		err := service.TrashRoleGroup(r.Context(), groupID)
+		if err != nil {
+			writeServiceError(w, err, "Failed to delete role group")
 			return
 		}
 
@@ -1118,13 +1975,9 @@ func AssignUserToGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		err := service.AssignUserToGroup(groupID, req)
+		err := service.AssignUserToGroup(r.Context(), groupID, req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Failed to assign user to group", http.StatusInternalServerError)
+			writeServiceError(w, err, "Failed to assign user to group")
 			return
 		}
 
@@ -1149,13 +2002,9 @@ func RemoveUserFromGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		err := service.RemoveUserFromGroup(groupID, userID)
+		err := service.RemoveUserFromGroup(r.Context(), groupID, userID)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
-				return
-			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to remove user from group", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to remove user from group")
 			return
 		}
 
@@ -1163,6 +2012,34 @@ func RemoveUserFromGroupHandler(service *RBACService) http.HandlerFunc {
 	}
 }
 
+// membershipHistoryHandler serves one page of membership events listed by list for the path id
+func membershipHistoryHandler(list func(id string, page httpapi.Page) ([]*MembershipEvent, int, error), failure string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		events, total, err := list(mux.Vars(r)["id"], page)
+		if err != nil {
+			writeServiceError(w, err, failure)
+			return
+		}
+
+		httpapi.WriteList(w, r, events, total, page)
+	}
+}
+
+// GetGroupMembershipHistoryHandler handles GET /api/rbac/groups/{id}/membership-history
+func GetGroupMembershipHistoryHandler(service *RBACService) http.HandlerFunc {
+	return membershipHistoryHandler(service.GroupMembershipHistory, "Failed to get group membership history")
+}
+
+// GetUserMembershipHistoryHandler handles GET /api/rbac/users/{id}/membership-history
+func GetUserMembershipHistoryHandler(service *RBACService) http.HandlerFunc {
+	return membershipHistoryHandler(service.UserMembershipHistory, "Failed to get user membership history")
+}
+
 // GetGroupUsersHandler handles GET /api/rbac/groups/{id}/users
 func GetGroupUsersHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1178,18 +2055,24 @@ func GetGroupUsersHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		userIDs, err := service.GetGroupUsers(groupID)
+		// Stream members as they are scanned so very large groups don't have to fit in memory
+		stream := httpapi.NewArrayStream(w, "user_ids")
+		err := service.StreamGroupUsers(groupID, func(userID string) error {
+			return stream.Write(userID)
+		})
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get group users", "INTERNAL_ERROR", nil)
+			if !stream.Started() {
+				writeServiceError(w, err, "Failed to get group users")
+			}
+			// Leave a partially streamed array unterminated so clients can't mistake it for a complete list
 			return
 		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"user_ids": userIDs})
+		stream.Close()
 	}
 }
 
-// AssignRolesToGroupHandler handles POST /api/rbac/groups/{id}/roles
+// AssignRolesToGroupHandler handles POST /api/rbac/groups/{id}/roles. With "Prefer: respond-async"
+// it answers 202 and assigns the roles as an operation, which accepts lists past the list limit.
 func AssignRolesToGroupHandler(service *RBACService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
@@ -1210,13 +2093,19 @@ func AssignRolesToGroupHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		err := service.AssignRolesToGroup(groupID, req)
-		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				writeErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+		if jobs.WantsAsync(r) && service.jobs != nil {
+			op, err := service.StartAssignRolesToGroup(r.Context(), groupID, req)
+			if err != nil {
+				writeServiceError(w, err, "Failed to assign roles to group")
 				return
 			}
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to assign roles to group", "INTERNAL_ERROR", nil)
+			jobs.WriteAccepted(w, op)
+			return
+		}
+
+		err := service.AssignRolesToGroup(r.Context(), groupID, req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to assign roles to group")
 			return
 		}
 
@@ -1241,14 +2130,18 @@ func GetGroupRolesHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
 		roles, err := service.GetGroupRoles(groupID)
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get group roles", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to get group roles")
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(roles)
+		httpapi.WriteList(w, r, roleResources(httpapi.Paginate(roles, page)), len(roles), page)
 	}
 }
 
@@ -1267,14 +2160,18 @@ func GetUserGroupsHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
 		groups, err := service.GetUserGroups(userID)
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get user groups", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to get user groups")
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(groups)
+		httpapi.WriteList(w, r, groupResources(httpapi.Paginate(groups, page)), len(groups), page)
 	}
 }
 
@@ -1286,14 +2183,85 @@ func GetPermissionsHandler(service *RBACService) http.HandlerFunc {
 			return
 		}
 
-		permissions, err := service.ListPermissions()
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		permissions, total, err := service.ListPermissionsPage(page)
+		if err != nil {
+			writeServiceError(w, err, "Failed to get permissions")
+			return
+		}
+
+		httpapi.WriteList(w, r, permissions, total, page)
+	}
+}
+
+// GetPermissionMatrixHandler handles GET /api/rbac/matrix?resource=
+func GetPermissionMatrixHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		matrix, err := service.PermissionMatrix(r.URL.Query().Get("resource"))
+		if err != nil {
+			writeServiceError(w, err, "Failed to get permission matrix")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(matrix)
+	}
+}
+
+// GetPermissionCatalogHandler handles GET /api/rbac/permissions/catalog?group_by=resource|category
+func GetPermissionCatalogHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groupBy := r.URL.Query().Get("group_by")
+		if groupBy == "" {
+			groupBy = CatalogByResource
+		}
+
+		catalog, err := service.PermissionCatalog(groupBy)
+		if err != nil {
+			writeServiceError(w, err, "Failed to get permission catalog")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"group_by": groupBy, "groups": catalog})
+	}
+}
+
+// GetPermissionHandler handles GET /api/rbac/permissions/{id}
+func GetPermissionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry, err := service.GetPermission(mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to get permission")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// RenamePermissionHandler handles PUT /api/rbac/permissions/{id}
+func RenamePermissionHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RenamePermissionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		permission, err := service.RenamePermission(r.Context(), mux.Vars(r)["id"], req)
 		if err != nil {
-			http.Error(w, "Failed to get permissions", http.StatusInternalServerError)
+			writeServiceError(w, err, "Failed to rename permission")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(permissions)
+		json.NewEncoder(w).Encode(permission)
 	}
 }
 
@@ -1314,7 +2282,7 @@ func GetUserPermissionsHandler(service *RBACService) http.HandlerFunc {
 
 		userPerms, err := service.GetUserPermissions(r.Context(), userID)
 		if err != nil {
-			writeErrorResponse(w, http.StatusInternalServerError, "Failed to get user permissions", "INTERNAL_ERROR", nil)
+			writeServiceError(w, err, "Failed to get user permissions")
 			return
 		}
 
@@ -1323,40 +2291,129 @@ func GetUserPermissionsHandler(service *RBACService) http.HandlerFunc {
 	}
 }
 
-// SetupRoutes configures the RBAC routes with authentication and rate limiting middleware
+// RegisterSchemas registers the request bodies of the RBAC routes for schema validation
+func RegisterSchemas(reg *jsonschema.Registry) {
+	reg.Register("POST", "/api/rbac/roles", CreateRoleRequest{})
+	reg.Register("POST", "/api/rbac/roles/batch", BatchRolesRequest{})
+	reg.Register("PUT", "/api/rbac/roles/{id}", UpdateRoleRequest{})
+	reg.Register("PUT", "/api/rbac/roles/{id}/scope", RoleScopeRequest{})
+	reg.Register("PUT", "/api/rbac/permissions/{id}", RenamePermissionRequest{})
+	reg.Register("PUT", "/api/rbac/permissions/{id}/deprecation", DeprecatePermissionRequest{})
+	reg.Register("POST", "/api/rbac/groups", CreateRoleGroupRequest{})
+	reg.Register("PUT", "/api/rbac/groups/{id}", UpdateRoleGroupRequest{})
+	reg.Register("POST", "/api/rbac/group-templates", GroupTemplateRequest{})
+	reg.Register("PUT", "/api/rbac/group-templates/{id}", GroupTemplateRequest{})
+	reg.Register("POST", "/api/rbac/group-templates/{id}/instantiate", InstantiateGroupTemplateRequest{})
+	reg.Register("PUT", "/api/rbac/groups/{id}/assign-user", AssignUserToGroupRequest{})
+	reg.Register("POST", "/api/rbac/domain-rules", DomainGroupRuleRequest{})
+	reg.Register("POST", "/api/rbac/groups/{id}/roles", AssignRolesToGroupRequest{})
+	reg.Register("POST", "/api/rbac/users/{id}/revoke-tokens", RevokeUserTokensRequest{})
+	reg.Register("POST", "/api/rbac/tokens/revoke", RevokeTokenRequest{})
+	reg.Register("PUT", "/api/rbac/digest-subscription", DigestSubscriptionRequest{})
+}
+
+// MyAccessHandler handles GET /api/users/me/access. The caller is taken from the token, so no
+// permission beyond a valid token is needed.
+func MyAccessHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, _ := r.Context().Value(UsernameKey).(string)
+		access, err := service.MyAccess(r.Context(), getUserIDFromContext(r.Context()), username)
+		if err != nil {
+			writeServiceError(w, err, "Failed to get access")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(access)
+	}
+}
+
+// SetupRoutes configures the RBAC routes, each protected with its permission. Authentication
+// (AuthMiddleware) and rate limiting (see RateLimitClient) are applied to the whole router.
 func SetupRoutes(r *mux.Router, service *RBACService) {
-	// Create a subrouter for RBAC endpoints with rate limiting
 	rbacRouter := r.PathPrefix("/api/rbac").Subrouter()
 
-	// Apply rate limiting first (100 requests per minute per IP)
-	rbacRouter.Use(RateLimitMiddleware(100, time.Minute))
-
 	// Role routes with specific permissions
-	rbacRouter.HandleFunc("/roles", withAuth("create_role", service, CreateRoleHandler(service))).Methods("POST")
-	rbacRouter.HandleFunc("/roles", withAuth("read_role", service, GetRolesHandler(service))).Methods("GET")
-	rbacRouter.HandleFunc("/roles/{id}", withAuth("update_role", service, UpdateRoleHandler(service))).Methods("PUT")
-	rbacRouter.HandleFunc("/roles/{id}", withAuth("delete_role", service, DeleteRoleHandler(service))).Methods("DELETE")
+	service.Protect(rbacRouter.HandleFunc("/roles", CreateRoleHandler(service)).Methods("POST"), perm.CreateRole)
+	service.Protect(rbacRouter.HandleFunc("/roles", GetRolesHandler(service)).Methods("GET"), perm.ReadRole)
+	service.Protect(rbacRouter.HandleFunc("/roles/batch", BatchRolesHandler(service)).Methods("POST"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/roles/{id}", UpdateRoleHandler(service)).Methods("PUT"), perm.UpdateRole)
+	service.Protect(rbacRouter.HandleFunc("/roles/{id}", DeleteRoleHandler(service)).Methods("DELETE"), perm.DeleteRole)
+
+	// Resource scopes confine what a role grants, so changing them is role management
+	service.Protect(rbacRouter.HandleFunc("/roles/{id}/scope", GetRoleScopeHandler(service)).Methods("GET"), perm.ReadRole)
+	service.Protect(rbacRouter.HandleFunc("/roles/{id}/scope", PutRoleScopeHandler(service)).Methods("PUT"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/roles/{id}/scope", DeleteRoleScopeHandler(service)).Methods("DELETE"), perm.ManageRoles)
 
 	// Role group routes with specific permissions
-	rbacRouter.HandleFunc("/groups", withAuth("create_group", service, CreateRoleGroupHandler(service))).Methods("POST")
-	rbacRouter.HandleFunc("/groups", withAuth("read_group", service, GetRoleGroupsHandler(service))).Methods("GET")
-	rbacRouter.HandleFunc("/groups/{id}", withAuth("read_group", service, GetRoleGroupHandler(service))).Methods("GET")
-	rbacRouter.HandleFunc("/groups/{id}", withAuth("update_group", service, UpdateRoleGroupHandler(service))).Methods("PUT")
-	rbacRouter.HandleFunc("/groups/{id}", withAuth("delete_group", service, DeleteRoleGroupHandler(service))).Methods("DELETE")
+	service.Protect(rbacRouter.HandleFunc("/groups", CreateRoleGroupHandler(service)).Methods("POST"), perm.CreateGroup)
+	service.Protect(rbacRouter.HandleFunc("/groups", GetRoleGroupsHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}", GetRoleGroupHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}", UpdateRoleGroupHandler(service)).Methods("PUT"), perm.UpdateGroup)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}", DeleteRoleGroupHandler(service)).Methods("DELETE"), perm.DeleteGroup)
+
+	// Group templates; instantiating one only needs group creation rights, since administrators
+	// vetted the roles when they defined the template
+	service.Protect(rbacRouter.HandleFunc("/group-templates", CreateGroupTemplateHandler(service)).Methods("POST"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/group-templates", GetGroupTemplatesHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/group-templates/{id}", GetGroupTemplateHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/group-templates/{id}", UpdateGroupTemplateHandler(service)).Methods("PUT"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/group-templates/{id}", DeleteGroupTemplateHandler(service)).Methods("DELETE"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/group-templates/{id}/instantiate", InstantiateGroupTemplateHandler(service)).Methods("POST"), perm.CreateGroup)
 
 	// User-Group relationship routes
-	rbacRouter.HandleFunc("/groups/{id}/assign-user", withAuth("manage_group_membership", service, AssignUserToGroupHandler(service))).Methods("PUT")
-	rbacRouter.HandleFunc("/groups/{id}/users/{userId}", withAuth("manage_group_membership", service, RemoveUserFromGroupHandler(service))).Methods("DELETE")
-	rbacRouter.HandleFunc("/groups/{id}/users", withAuth("read_group", service, GetGroupUsersHandler(service))).Methods("GET")
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/assign-user", AssignUserToGroupHandler(service)).Methods("PUT"), perm.ManageGroupMembership)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/users/{userId}", RemoveUserFromGroupHandler(service)).Methods("DELETE"), perm.ManageGroupMembership)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/users", GetGroupUsersHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/membership-history", GetGroupMembershipHistoryHandler(service)).Methods("GET"), perm.ReadGroup)
+
+	// Email domain rules add new users to groups, so changing them is membership management
+	service.Protect(rbacRouter.HandleFunc("/domain-rules", CreateDomainRuleHandler(service)).Methods("POST"), perm.ManageGroupMembership)
+	service.Protect(rbacRouter.HandleFunc("/domain-rules", GetDomainRulesHandler(service)).Methods("GET"), perm.ReadGroup)
+	service.Protect(rbacRouter.HandleFunc("/domain-rules/{id}", DeleteDomainRuleHandler(service)).Methods("DELETE"), perm.ManageGroupMembership)
 
 	// Role-Group relationship routes
-	rbacRouter.HandleFunc("/groups/{id}/roles", withAuth("manage_group_roles", service, AssignRolesToGroupHandler(service))).Methods("POST")
-	rbacRouter.HandleFunc("/groups/{id}/roles", withAuth("read_group", service, GetGroupRolesHandler(service))).Methods("GET")
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/roles", AssignRolesToGroupHandler(service)).Methods("POST"), perm.ManageGroupRoles)
+	service.Protect(rbacRouter.HandleFunc("/groups/{id}/roles", GetGroupRolesHandler(service)).Methods("GET"), perm.ReadGroup)
+
+	// Token revocation, for incident response
+	service.Protect(rbacRouter.HandleFunc("/users/{id}/revoke-tokens", RevokeUserTokensHandler(service)).Methods("POST"), perm.RevokeTokens)
+	service.Protect(rbacRouter.HandleFunc("/tokens/revoke", RevokeTokenHandler(service)).Methods("POST"), perm.RevokeTokens)
+	service.Protect(rbacRouter.HandleFunc("/tokens/denylist", GetDenylistHandler(service)).Methods("GET"), perm.RevokeTokens)
 
 	// User routes
-	rbacRouter.HandleFunc("/users/{id}/groups", withAuth("read_user", service, GetUserGroupsHandler(service))).Methods("GET")
-	rbacRouter.HandleFunc("/users/{id}/permissions", withAuth("read_user", service, GetUserPermissionsHandler(service))).Methods("GET")
+	service.Protect(rbacRouter.HandleFunc("/users/{id}/groups", GetUserGroupsHandler(service)).Methods("GET"), perm.ReadUser)
+	service.Protect(rbacRouter.HandleFunc("/users/{id}/permissions", GetUserPermissionsHandler(service)).Methods("GET"), perm.ReadUser)
+	service.Protect(rbacRouter.HandleFunc("/users/{id}/membership-history", GetUserMembershipHistoryHandler(service)).Methods("GET"), perm.ReadUser)
+
+	// Authorization decisions recorded while decision logging is on
+	service.Protect(rbacRouter.HandleFunc("/decisions", GetDecisionsHandler(service)).Methods("GET"), perm.ManageSystem)
+
+	// Post-deploy verification: runs the authorization path end to end with temporary records
+	service.Protect(r.HandleFunc("/api/selftest", SelfTestHandler(service)).Methods("POST"), perm.ManageSystem)
+
+	// Change digests; subscribers must keep read_role to receive them
+	service.Protect(rbacRouter.HandleFunc("/digest-subscription", GetDigestSubscriptionHandler(service)).Methods("GET"), digestPermission)
+	service.Protect(rbacRouter.HandleFunc("/digest-subscription", PutDigestSubscriptionHandler(service)).Methods("PUT"), digestPermission)
+	service.Protect(rbacRouter.HandleFunc("/digest-subscription", DeleteDigestSubscriptionHandler(service)).Methods("DELETE"), "")
+
+	// Reports
+	service.Protect(rbacRouter.HandleFunc("/reports/dormancy", GetDormancyReportHandler(service)).Methods("GET"), perm.ViewReports)
 
 	// Permission routes
-	rbacRouter.HandleFunc("/permissions", withAuth("read_permission", service, GetPermissionsHandler(service))).Methods("GET")
+	service.Protect(rbacRouter.HandleFunc("/permissions", GetPermissionsHandler(service)).Methods("GET"), perm.ReadPermission)
+	service.Protect(rbacRouter.HandleFunc("/permissions/catalog", GetPermissionCatalogHandler(service)).Methods("GET"), perm.ReadPermission)
+	service.Protect(rbacRouter.HandleFunc("/permissions/deprecations", ListPermissionDeprecationsHandler(service)).Methods("GET"), perm.ReadPermission)
+	service.Protect(rbacRouter.HandleFunc("/permissions/{id}", GetPermissionHandler(service)).Methods("GET"), perm.ReadPermission)
+	service.Protect(rbacRouter.HandleFunc("/permissions/{id}", RenamePermissionHandler(service)).Methods("PUT"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/permissions/{id}/deprecation", PutPermissionDeprecationHandler(service)).Methods("PUT"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/permissions/{id}/deprecation", DeletePermissionDeprecationHandler(service)).Methods("DELETE"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/permissions/{id}/migrate", MigratePermissionHandler(service)).Methods("POST"), perm.ManageRoles)
+	service.Protect(rbacRouter.HandleFunc("/matrix", GetPermissionMatrixHandler(service)).Methods("GET"), perm.ReadRole)
+
+	// The caller's own access and tokens only need a valid token
+	service.Protect(r.HandleFunc("/api/users/me/access", MyAccessHandler(service)).Methods("GET"), "")
+	service.Protect(r.HandleFunc("/api/users/me/tokens", CreatePersonalTokenHandler(service)).Methods("POST"), "")
+	service.Protect(r.HandleFunc("/api/users/me/tokens", GetPersonalTokensHandler(service)).Methods("GET"), "")
+	service.Protect(r.HandleFunc("/api/users/me/tokens/{id}", DeletePersonalTokenHandler(service)).Methods("DELETE"), "")
 }
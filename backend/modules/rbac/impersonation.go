@@ -0,0 +1,180 @@
+package rbac
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/perm"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ImpersonationEvent is sent to the event notifier whenever an operator starts acting in a
+// tenant's admin context
+const ImpersonationEvent = "rbac.tenant_impersonated"
+
+// ImpersonationLifetime is how long a token acting in a tenant's admin context is valid
+const ImpersonationLifetime = 15 * time.Minute
+
+// TenantStatus tells whether a tenant is suspended
+type TenantStatus interface {
+	TenantSuspended(tenant string) bool
+}
+
+// SetTenantStatus rejects the tokens of suspended tenants with 403 TENANT_SUSPENDED. Operators
+// acting in a suspended tenant's admin context are still let in. Set it before serving requests.
+func (s *RBACService) SetTenantStatus(status TenantStatus) {
+	s.tenants = status
+}
+
+// checkTenant rejects claims of a suspended tenant
+func (s *RBACService) checkTenant(claims *JWTClaims) *authFailure {
+	if s.tenants == nil || claims.Tenant == "" || claims.ActingAs != nil {
+		return nil
+	}
+	if s.tenants.TenantSuspended(claims.Tenant) {
+		return &authFailure{http.StatusForbidden, "Tenant is suspended", "TENANT_SUSPENDED", map[string]string{"tenant": claims.Tenant}}
+	}
+	return nil
+}
+
+// isolatePlatform drops platform administration permissions from the permissions of a caller
+// in a tenant's context, so tenant roles can never grant them
+func isolatePlatform(permissionNames []string, claims *JWTClaims) []string {
+	if claims.Tenant == "" {
+		return permissionNames
+	}
+	isolated := permissionNames[:0:0]
+	for _, name := range permissionNames {
+		if !perm.Platform(name) {
+			isolated = append(isolated, name)
+		}
+	}
+	return isolated
+}
+
+// actingPermissions resolves the permissions of the roles claims act as. Roles deleted since
+// the token was issued grant nothing.
+func (s *RBACService) actingPermissions(claims *JWTClaims) (*UserPermissions, error) {
+	userPerms := &UserPermissions{UserID: claims.UserID, grants: make(map[string][]string)}
+	seen := make(map[string]bool)
+	for _, key := range claims.ActingAs {
+		role, err := s.repo.RoleRepo.GetByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			continue
+		}
+		permissions, err := s.repo.RolePermRepo.GetEffectiveRolePermissions(role.ID)
+		if err != nil {
+			return nil, err
+		}
+		userPerms.Roles = append(userPerms.Roles, *role)
+		for _, p := range permissions {
+			if !seen[p.Key] {
+				seen[p.Key] = true
+				userPerms.Permissions = append(userPerms.Permissions, *p)
+			}
+			userPerms.grants[p.Key] = append(userPerms.grants[p.Key], role.ID)
+		}
+	}
+	return userPerms, nil
+}
+
+// Impersonation is a short-lived token acting in a tenant's admin context
+type Impersonation struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Tenant      string `json:"tenant"`
+	// Roles are the keys of the roles acted as
+	Roles     []string  `json:"roles"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Impersonate issues the caller in ctx a token for tenant that carries the permissions of the
+// roles with the keys roles instead of their own, minus platform administration permissions. The token keeps the caller's
+// identity and session, so their actions stay attributed to them and revoking their access
+// revokes it too.
+func (s *RBACService) Impersonate(ctx context.Context, tenant string, roles []string) (*Impersonation, error) {
+	userID := getUserIDFromContext(ctx)
+	if userID == "" {
+		return nil, apperrors.Unauthorized("AUTH_REQUIRED", "Authentication required")
+	}
+	if tenant == "" || len(roles) == 0 {
+		return nil, &ValidationError{Field: "roles", Message: "the tenant has no admin roles"}
+	}
+	for _, key := range roles {
+		role, err := s.repo.RoleRepo.GetByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if role == nil {
+			return nil, apperrors.NotFound("ROLE_NOT_FOUND", fmt.Sprintf("Role %s not found", key))
+		}
+	}
+
+	// The token is signed for the realm the caller's own token came from, so it is accepted
+	// wherever theirs is
+	realmName := RealmFromContext(ctx)
+	var realm TokenRealm
+	for _, r := range s.realms {
+		if r.Name == realmName {
+			realm = r
+		}
+	}
+	// Impersonation tokens are HMAC-signed, which realms verified with a JWKS only accept when
+	// HMAC is explicitly allowed
+	if !s.hmacAccepted(realm) {
+		return nil, apperrors.Invalid("IMPERSONATION_UNAVAILABLE", "Impersonation is not available with the configured token verification")
+	}
+
+	now := time.Now()
+	username, _ := ctx.Value(UsernameKey).(string)
+	claims := JWTClaims{
+		UserID:   userID,
+		Username: username,
+		Tenant:   tenant,
+		Session:  SessionFromContext(ctx).ID,
+		ActingAs: roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    realm.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ImpersonationLifetime)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.tokenKey(realm))
+	if err != nil {
+		return nil, err
+	}
+
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": userID, "tenant": tenant, "roles": roles, "token_id": claims.ID})
+	err = s.events.Notify(ctx, notification.Notification{
+		Type:     ImpersonationEvent,
+		Severity: notification.SeverityWarning,
+		Subject:  "Tenant admin context entered",
+		Message:  fmt.Sprintf("User %s is acting as %v in tenant %s until %s.", userID, roles, tenant, claims.ExpiresAt.Time.UTC().Format(time.RFC3339)),
+		Data: map[string]interface{}{
+			"user_id":    userID,
+			"username":   username,
+			"tenant":     tenant,
+			"roles":      roles,
+			"token_id":   claims.ID,
+			"expires_at": claims.ExpiresAt.Time,
+		},
+		OccurredAt: now,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send impersonation event")
+	}
+	logger.Warn("Tenant admin context entered")
+
+	return &Impersonation{AccessToken: token, TokenType: "Bearer", Tenant: tenant, Roles: roles, ExpiresAt: claims.ExpiresAt.Time}, nil
+}
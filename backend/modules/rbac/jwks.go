@@ -0,0 +1,193 @@
+package rbac
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// JWKS refresh limits: the cached keys are refetched once they are JWKSMaxAge old, and a token
+// signed with an unknown key triggers a refetch at most every JWKSMinRefresh, so forged key IDs
+// cannot make every request call Keycloak
+const (
+	JWKSMaxAge     = time.Hour
+	JWKSMinRefresh = 30 * time.Second
+)
+
+var errUnknownKey = errors.New("unknown signing key")
+
+// JWKS fetches and caches the public keys a Keycloak realm signs its RS256 tokens with, from the
+// realm's certs endpoint. Keys are looked up by the kid header of the token; Keycloak rotating
+// its keys shows up as an unknown kid, which refetches the set.
+type JWKS struct {
+	url    string
+	client *http.Client
+	logger *logrus.Logger
+
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// attemptedAt is the last fetch, successful or not
+	attemptedAt time.Time
+	now         func() time.Time
+}
+
+// NewJWKS creates a key set fetched from url with client
+func NewJWKS(url string, client *http.Client, logger *logrus.Logger) *JWKS {
+	return &JWKS{url: url, client: client, logger: logger, now: time.Now}
+}
+
+// CertsURL returns the JWKS endpoint of the Keycloak realm with issuer
+func CertsURL(issuer string) string {
+	return issuer + "/protocol/openid-connect/certs"
+}
+
+// Key returns the public key with kid
+func (j *JWKS) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.RLock()
+	key, known := j.keys[kid]
+	stale := j.now().Sub(j.fetchedAt) > JWKSMaxAge
+	recent := j.now().Sub(j.attemptedAt) < JWKSMinRefresh
+	j.mu.RUnlock()
+	if known && !stale {
+		return key, nil
+	}
+	if recent {
+		if known {
+			return key, nil
+		}
+		return nil, errUnknownKey
+	}
+
+	if err := j.Refresh(ctx); err != nil {
+		// Keys still cached keep verifying while Keycloak is unreachable
+		if known {
+			j.logger.WithContext(ctx).WithError(err).Warn("Failed to refresh JWKS, using cached keys")
+			return key, nil
+		}
+		return nil, err
+	}
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// jsonWebKey is one key of a JWKS document
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Refresh fetches the key set, replacing the cached keys. Keys that are not RSA signing keys are
+// skipped.
+func (j *JWKS) Refresh(ctx context.Context) error {
+	j.mu.Lock()
+	j.attemptedAt = j.now()
+	j.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch JWKS: status %d", resp.StatusCode)
+	}
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(doc.Keys))
+	for _, jwk := range doc.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := rsaPublicKey(jwk)
+		if err != nil {
+			j.logger.WithContext(ctx).WithError(err).WithField("kid", jwk.Kid).Warn("Skipping unreadable JWKS key")
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("JWKS at %s has no RSA signing keys", j.url)
+	}
+
+	j.mu.Lock()
+	j.keys, j.fetchedAt = keys, j.now()
+	j.mu.Unlock()
+	return nil
+}
+
+// rsaPublicKey decodes the modulus and exponent of jwk
+func rsaPublicKey(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %w", err)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("exponent out of range")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// SetAllowHMAC accepts HMAC-signed tokens from realms verified with a JWKS, signed with the
+// realm's secret. Only enable it for tests and development: the API's own tokens, such as
+// impersonation tokens, are HMAC-signed too. Set it before serving requests.
+func (s *RBACService) SetAllowHMAC(allow bool) {
+	s.allowHMAC = allow
+}
+
+// verificationKey returns the key verifying token from realm: the realm's JWKS key for RS256
+// tokens, and its HMAC secret for HS256 tokens unless the realm is verified with a JWKS and HMAC
+// was not explicitly allowed
+func (s *RBACService) verificationKey(ctx context.Context, realm TokenRealm, token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		if realm.JWKS == nil {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		kid, _ := token.Header["kid"].(string)
+		return realm.JWKS.Key(ctx, kid)
+	case *jwt.SigningMethodHMAC:
+		if !s.hmacAccepted(realm) {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return s.tokenKey(realm), nil
+	default:
+		return nil, jwt.ErrSignatureInvalid
+	}
+}
+
+// hmacAccepted reports whether HMAC-signed tokens of realm are accepted
+func (s *RBACService) hmacAccepted(realm TokenRealm) bool {
+	return realm.JWKS == nil || s.allowHMAC
+}
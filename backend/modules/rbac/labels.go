@@ -0,0 +1,26 @@
+package rbac
+
+import (
+	"base-app/pkg/apperrors"
+	"base-app/pkg/labels"
+)
+
+// SetLabels lets role and group lists be filtered by label and forgets the labels of deleted
+// roles and groups. Set it before serving requests.
+func (s *RBACService) SetLabels(service *labels.Service) {
+	s.labels = service
+}
+
+// errLabelsUnavailable rejects label filters when no label service is configured
+var errLabelsUnavailable = apperrors.Invalid("LABELS_UNAVAILABLE", "Label filters are not available")
+
+// forgetLabels deletes the labels of a deleted role or group. Failures are logged: the entity
+// is already gone, and labels of unknown IDs match nothing that is listed.
+func (s *RBACService) forgetLabels(kind, id string) {
+	if s.labels == nil {
+		return
+	}
+	if err := s.labels.Forget(kind, id); err != nil {
+		s.logger.WithError(err).WithField(kind+"_id", id).Warn("Failed to forget labels")
+	}
+}
@@ -1,28 +1,95 @@
 package rbac
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jsonschema"
+
 	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 // Role represents a role in the system
 type Role struct {
-	ID          string    `json:"id" db:"id"`
-	Name        string    `json:"name" db:"name" validate:"required,min=2,max=50"`
+	ID string `json:"id" db:"id"`
+	// Key identifies the role to authorization checks; unlike Name it never changes
+	Key         string    `json:"key" db:"key"`
+	Name        string    `json:"name" db:"name" validate:"required,min=2,max=50,role_name"`
 	Description string    `json:"description" db:"description"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
 // Permission represents a permission that can be assigned to roles
 type Permission struct {
-	ID       string `json:"id" db:"id"`
+	ID string `json:"id" db:"id"`
+	// Key is what authorization checks compare, a perm.Name; it never changes. Name is shown
+	// to administrators and may be renamed; it defaults to the key.
+	Key      string `json:"key" db:"key"`
 	Name     string `json:"name" db:"name" validate:"required,min=2,max=100"`
 	Resource string `json:"resource" db:"resource" validate:"required"`
 	Action   string `json:"action" db:"action" validate:"required"`
+	// Category groups related permissions in the catalog, e.g. "Access control"
+	Category    string `json:"category" db:"category"`
+	Description string `json:"description" db:"description"`
+	// RiskLevel is RiskLow, RiskMedium or RiskHigh
+	RiskLevel string `json:"risk_level" db:"risk_level"`
+}
+
+// Permission risk levels; high-risk permissions grant destructive or system-wide access
+const (
+	RiskLow    = "low"
+	RiskMedium = "medium"
+	RiskHigh   = "high"
+)
+
+// RoleRef identifies a role that references a permission
+type RoleRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// CatalogEntry is a permission with the roles that grant it
+type CatalogEntry struct {
+	*Permission
+	Roles []RoleRef `json:"roles"`
+}
+
+// PermissionMatrix is the roles × permissions grid of the admin UI. Permissions are the
+// columns; each role row lists the IDs of the permissions it grants.
+type PermissionMatrix struct {
+	Resource    string        `json:"resource,omitempty"`
+	Permissions []*Permission `json:"permissions"`
+	Roles       []*MatrixRow  `json:"roles"`
 }
 
+// MatrixRow is one role of the permission matrix
+type MatrixRow struct {
+	RoleRef
+	PermissionIDs []string `json:"permission_ids"`
+}
+
+// CatalogGroup is the permissions sharing one resource or category
+type CatalogGroup struct {
+	Key         string         `json:"key"`
+	Permissions []CatalogEntry `json:"permissions"`
+}
+
+// Catalog groupings
+const (
+	CatalogByResource = "resource"
+	CatalogByCategory = "category"
+)
+
 // RoleGroup represents a group of roles for easier user assignment
 type RoleGroup struct {
 	ID          string    `json:"id" db:"id"`
@@ -36,6 +103,28 @@ type UserGroupMembership struct {
 	UserID     string    `json:"user_id" db:"user_id"`
 	GroupID    string    `json:"group_id" db:"group_id"`
 	AssignedAt time.Time `json:"assigned_at" db:"assigned_at"`
+	// ExpiresAt ends a time-limited membership; expired memberships grant nothing
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+}
+
+// Membership history actions
+const (
+	MembershipAdded   = "added"
+	MembershipRemoved = "removed"
+)
+
+// MembershipEvent records a user being added to or removed from a group
+type MembershipEvent struct {
+	ID      int64  `json:"id"`
+	GroupID string `json:"group_id"`
+	// GroupName is empty once the group has been deleted
+	GroupName string `json:"group_name,omitempty"`
+	UserID    string `json:"user_id"`
+	Action    string `json:"action"`
+	// ActorID is the user who made the change
+	ActorID    string     `json:"actor_id,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	OccurredAt time.Time  `json:"occurred_at"`
 }
 
 // RolePermission represents the many-to-many relationship between roles and permissions
@@ -52,16 +141,24 @@ type GroupRole struct {
 
 // CreateRoleRequest represents the request to create a new role
 type CreateRoleRequest struct {
-	Name        string `json:"name" validate:"required,min=2,max=50"`
+	// Key defaults to the name in lower case with spaces replaced by '_'
+	Key         string `json:"key,omitempty" validate:"omitempty,max=50,role_key"`
+	Name        string `json:"name" validate:"required,min=2,max=50,role_name"`
 	Description string `json:"description"`
 }
 
 // UpdateRoleRequest represents the request to update an existing role
 type UpdateRoleRequest struct {
-	Name        string `json:"name" validate:"required,min=2,max=50"`
+	Name        string `json:"name" validate:"required,min=2,max=50,role_name"`
 	Description string `json:"description"`
 }
 
+// RenamePermissionRequest represents the request to rename a permission. Only the display name
+// changes; checks keep using the key.
+type RenamePermissionRequest struct {
+	Name string `json:"name" validate:"required,min=2,max=100"`
+}
+
 // CreateRoleGroupRequest represents the request to create a new role group
 type CreateRoleGroupRequest struct {
 	Name        string `json:"name" validate:"required,min=2,max=50"`
@@ -76,17 +173,19 @@ type UpdateRoleGroupRequest struct {
 
 // AssignUserToGroupRequest represents the request to assign a user to a role group
 type AssignUserToGroupRequest struct {
-	UserID string `json:"user_id" validate:"required"`
+	UserID string `json:"user_id" validate:"required,uuid"`
+	// ExpiresAt makes the membership time-limited; it must be in the future
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // AssignPermissionsToRoleRequest represents the request to assign permissions to a role
 type AssignPermissionsToRoleRequest struct {
-	PermissionIDs []string `json:"permission_ids" validate:"required,min=1"`
+	PermissionIDs []string `json:"permission_ids" validate:"required,min=1,uuid_list"`
 }
 
 // AssignRolesToGroupRequest represents the request to assign roles to a group
 type AssignRolesToGroupRequest struct {
-	RoleIDs []string `json:"role_ids" validate:"required,min=1"`
+	RoleIDs []string `json:"role_ids" validate:"required,min=1,uuid_list"`
 }
 
 // UserPermissions represents the permissions a user has through their role groups
@@ -95,6 +194,18 @@ type UserPermissions struct {
 	Permissions []Permission `json:"permissions"`
 	Roles       []Role       `json:"roles"`
 	Groups      []RoleGroup  `json:"groups"`
+	// grants maps each permission key to the IDs of the user's roles granting it
+	grants map[string][]string
+}
+
+// MyAccess is the caller's own access, for building menus and hiding actions in frontends
+type MyAccess struct {
+	UserID   string       `json:"user_id"`
+	Username string       `json:"username"`
+	Groups   []*RoleGroup `json:"groups"`
+	Roles    []Role       `json:"roles"`
+	// Permissions holds the keys of the permissions the caller has, sorted, for clients to check
+	Permissions []string `json:"permissions"`
 }
 
 // ValidationError represents a validation error
@@ -109,8 +220,94 @@ func (e *ValidationError) Error() string {
 
 var validate *validator.Validate
 
+// roleNamePattern restricts role names to a leading letter followed by letters, digits, spaces, '_', '-' or '.'
+var roleNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.\- ]*$`)
+
+// roleKeyPattern restricts role keys to a leading lowercase letter followed by lowercase letters, digits, '_', '-' or '.'
+var roleKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_.\-]*$`)
+
 func init() {
 	validate = validator.New()
+
+	// Report fields by their JSON names so error details match the request payload
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	if err := validate.RegisterValidation("role_name", validateRoleName); err != nil {
+		panic(err)
+	}
+	if err := validate.RegisterValidation("role_key", validateRoleKey); err != nil {
+		panic(err)
+	}
+	if err := validate.RegisterValidation("uuid_list", validateUUIDList); err != nil {
+		panic(err)
+	}
+
+	// Mirror the custom rules in generated request schemas
+	jsonschema.RegisterTag("role_name", func(s *jsonschema.Schema, _ string) {
+		s.SetPattern(roleNamePattern.String())
+	})
+	jsonschema.RegisterTag("role_key", func(s *jsonschema.Schema, _ string) {
+		s.SetPattern(roleKeyPattern.String())
+	})
+	jsonschema.RegisterTag("uuid_list", func(s *jsonschema.Schema, _ string) {
+		if s.Items != nil {
+			s.Items.Format = "uuid"
+		}
+	})
+}
+
+// validateRoleName checks that a role name matches roleNamePattern
+func validateRoleName(fl validator.FieldLevel) bool {
+	return roleNamePattern.MatchString(fl.Field().String())
+}
+
+// validateRoleKey checks that a role key matches roleKeyPattern
+func validateRoleKey(fl validator.FieldLevel) bool {
+	return roleKeyPattern.MatchString(fl.Field().String())
+}
+
+// roleKey derives the key of a role created without one from its name
+func roleKey(name string) string {
+	return strings.Join(strings.Fields(strings.ToLower(name)), "_")
+}
+
+// validateUUIDList checks that every element of a string slice is a valid UUID
+func validateUUIDList(fl validator.FieldLevel) bool {
+	field := fl.Field()
+	if field.Kind() != reflect.Slice {
+		return false
+	}
+	for i := 0; i < field.Len(); i++ {
+		if _, err := uuid.Parse(field.Index(i).String()); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validationErrorDetails converts validator errors into per-field, human readable messages
+func validationErrorDetails(errs validator.ValidationErrors) map[string]string {
+	return httpapi.ValidationDetails(errs, validationMessage)
+}
+
+// validationMessage returns a friendly message for a single failed validation rule
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "uuid_list":
+		return "must contain only valid UUIDs"
+	case "role_name":
+		return "must start with a letter and contain only letters, digits, spaces, '_', '-' or '.'"
+	case "role_key":
+		return "must start with a lowercase letter and contain only lowercase letters, digits, '_', '-' or '.'"
+	default:
+		return httpapi.ValidationMessage(fe)
+	}
 }
 
 // RoleRepository interface defines methods for role data access
@@ -118,17 +315,35 @@ type RoleRepository interface {
 	Create(role *Role) error
 	GetByID(id string) (*Role, error)
 	GetByName(name string) (*Role, error)
+	// GetByKey returns the role with the stable key, which survives renames; nil when there is none
+	GetByKey(key string) (*Role, error)
+	FindMissingIDs(ids []string) ([]string, error)
 	List() ([]*Role, error)
+	ListPage(limit, offset int) ([]*Role, int, error)
 	Update(role *Role) error
 	Delete(id string) error
+	// Lock locks a role until the transaction ends, so no group can be assigned it meanwhile
+	Lock(id string) error
 }
 
 // PermissionRepository interface defines methods for permission data access
 type PermissionRepository interface {
 	Create(permission *Permission) error
 	GetByID(id string) (*Permission, error)
+	FindMissingIDs(ids []string) ([]string, error)
 	List() ([]*Permission, error)
+	ListPage(limit, offset int) ([]*Permission, int, error)
 	GetByRoleID(roleID string) ([]*Permission, error)
+	// RoleReferences maps permission IDs to the roles granting them, ordered by role name
+	RoleReferences() (map[string][]RoleRef, error)
+	// Upsert creates permissions or updates the definitions of existing ones, matched by key;
+	// the names of existing ones are kept
+	Upsert(permissions []*Permission) error
+	// Rename changes the name of a permission shown to administrators
+	Rename(id, name string) error
+	// Matrix returns the grid of every role against the permissions on resource, or all
+	// permissions when resource is empty
+	Matrix(resource string) (*PermissionMatrix, error)
 }
 
 // RoleGroupRepository interface defines methods for role group data access
@@ -137,6 +352,7 @@ type RoleGroupRepository interface {
 	GetByID(id string) (*RoleGroup, error)
 	GetByName(name string) (*RoleGroup, error)
 	List() ([]*RoleGroup, error)
+	ListPage(limit, offset int) ([]*RoleGroup, int, error)
 	Update(group *RoleGroup) error
 	Delete(id string) error
 }
@@ -147,7 +363,21 @@ type UserGroupMembershipRepository interface {
 	Delete(userID, groupID string) error
 	GetUserGroups(userID string) ([]*RoleGroup, error)
 	GetGroupUsers(groupID string) ([]string, error) // Returns user IDs
+	StreamGroupUsers(groupID string, fn func(userID string) error) error
 	IsUserInGroup(userID, groupID string) (bool, error)
+	ClearGroupMemberships(groupID string) error
+	// ListGroupMemberships returns the memberships of a group with their expiry
+	ListGroupMemberships(groupID string) ([]*UserGroupMembership, error)
+}
+
+// MembershipHistoryRepository records membership changes; events are kept after the group or
+// user is deleted
+type MembershipHistoryRepository interface {
+	Record(event *MembershipEvent) error
+	// RecordGroupRemoval records the removal of every current member of a group
+	RecordGroupRemoval(groupID, actorID string, at time.Time) error
+	ListByGroup(groupID string, limit, offset int) ([]*MembershipEvent, int, error)
+	ListByUser(userID string, limit, offset int) ([]*MembershipEvent, int, error)
 }
 
 // RolePermissionRepository interface defines methods for role-permission relationships
@@ -155,6 +385,9 @@ type RolePermissionRepository interface {
 	AssignPermissionsToRole(roleID string, permissionIDs []string) error
 	RemovePermissionsFromRole(roleID string, permissionIDs []string) error
 	GetRolePermissions(roleID string) ([]*Permission, error)
+	// GetEffectiveRolePermissions returns the permissions a role grants, which leaves out those
+	// outside its scope (see RoleScope)
+	GetEffectiveRolePermissions(roleID string) ([]*Permission, error)
 	ClearRolePermissions(roleID string) error
 }
 
@@ -164,50 +397,202 @@ type GroupRoleRepository interface {
 	RemoveRolesFromGroup(groupID string, roleIDs []string) error
 	GetGroupRoles(groupID string) ([]*Role, error)
 	ClearGroupRoles(groupID string) error
+	RemoveRoleFromAllGroups(roleID string) error
+	// GetRoleGroupIDs returns the IDs of the groups a role is assigned to
+	GetRoleGroupIDs(roleID string) ([]string, error)
+	// GetRoleUsage returns the groups a role is assigned to and how many users hold it through them
+	GetRoleUsage(roleID string) (*RoleUsage, error)
+}
+
+// UserPermissionRepository interface defines methods for resolving a user's effective permissions
+type UserPermissionRepository interface {
+	GetUserPermissions(userID string) (*UserPermissions, error)
+}
+
+// TxManager runs a unit of work whose repositories all share one database transaction
+type TxManager interface {
+	// WithinTx calls fn with transactional repositories whose statements run under ctx, committing
+	// if fn returns nil and rolling back otherwise
+	WithinTx(ctx context.Context, fn func(repos *RBACRepository) error) error
 }
 
 // RBACRepository combines all repository interfaces
 type RBACRepository struct {
-	RoleRepo       RoleRepository
-	PermissionRepo PermissionRepository
-	GroupRepo      RoleGroupRepository
-	MembershipRepo UserGroupMembershipRepository
-	RolePermRepo   RolePermissionRepository
-	GroupRoleRepo  GroupRoleRepository
+	RoleRepo        RoleRepository
+	PermissionRepo  PermissionRepository
+	GroupRepo       RoleGroupRepository
+	MembershipRepo  UserGroupMembershipRepository
+	RolePermRepo    RolePermissionRepository
+	GroupRoleRepo   GroupRoleRepository
+	UserPermRepo    UserPermissionRepository
+	HistoryRepo     MembershipHistoryRepository
+	AccessRepo      AccessUsageRepository
+	TemplateRepo    GroupTemplateRepository
+	DenylistRepo    DenylistRepository
+	DomainRuleRepo  DomainRuleRepository
+	TokenRepo       PersonalTokenRepository
+	DigestRepo      DigestRepository
+	ScopeRepo       RoleScopeRepository
+	DeprecationRepo DeprecationRepository
+	Tx              TxManager
 }
 
 // NewRBACRepository creates a new RBAC repository
 func NewRBACRepository(db *sql.DB) *RBACRepository {
+	return NewRBACRepositoryWithReader(db, db)
+}
+
+// NewRBACRepositoryWithReader creates a new RBAC repository that writes to db and sends list and
+// report queries to reader (typically a *database.Cluster routing to read replicas). Lookups that
+// services run before writing, and permission resolution, stay on db so they see the latest writes.
+func NewRBACRepositoryWithReader(db *sql.DB, reader database.Querier) *RBACRepository {
+	repos := newRBACRepository(db, reader)
+	repos.Tx = &sqlTxManager{db: db}
+	return repos
+}
+
+// newRBACRepository builds the repository set on top of db, which may be a transaction
+func newRBACRepository(db database.DBTX, reader database.Querier) *RBACRepository {
 	return &RBACRepository{
-		RoleRepo:       NewRoleRepository(db),
-		PermissionRepo: NewPermissionRepository(db),
-		GroupRepo:      NewRoleGroupRepository(db),
-		MembershipRepo: NewUserGroupMembershipRepository(db),
-		RolePermRepo:   NewRolePermissionRepository(db),
-		GroupRoleRepo:  NewGroupRoleRepository(db),
+		RoleRepo:        &roleRepository{db: db, reader: reader},
+		PermissionRepo:  &permissionRepository{db: db, reader: reader},
+		GroupRepo:       &roleGroupRepository{db: db, reader: reader},
+		MembershipRepo:  &userGroupMembershipRepository{db: db, reader: reader},
+		RolePermRepo:    &rolePermissionRepository{db: db, reader: reader},
+		GroupRoleRepo:   &groupRoleRepository{db: db, reader: reader},
+		UserPermRepo:    &userPermissionRepository{db: db},
+		HistoryRepo:     &membershipHistoryRepository{db: db, reader: reader},
+		AccessRepo:      &accessUsageRepository{db: db, reader: reader},
+		TemplateRepo:    &groupTemplateRepository{db: db, reader: reader},
+		DenylistRepo:    &denylistRepository{db: db, reader: reader},
+		DomainRuleRepo:  &domainRuleRepository{db: db, reader: reader},
+		TokenRepo:       &personalTokenRepository{db: db, reader: reader},
+		DigestRepo:      &digestRepository{db: db, reader: reader},
+		ScopeRepo:       &roleScopeRepository{db: db, reader: reader},
+		DeprecationRepo: &deprecationRepository{db: db, reader: reader},
+	}
+}
+
+// sqlTxManager implements TxManager on a *sql.DB
+type sqlTxManager struct {
+	db *sql.DB
+}
+
+func (m *sqlTxManager) WithinTx(ctx context.Context, fn func(repos *RBACRepository) error) error {
+	return database.RunInTxContext(ctx, m.db, func(tx database.DBTX) error {
+		// Reads go through the transaction too so they observe its own writes
+		repos := newRBACRepository(tx, tx)
+		repos.Tx = joinTxManager{repos: repos}
+		return fn(repos)
+	})
+}
+
+// joinTxManager is handed to code already inside a transaction; nested units of work join it,
+// running under the context the transaction was begun with
+type joinTxManager struct {
+	repos *RBACRepository
+}
+
+func (m joinTxManager) WithinTx(ctx context.Context, fn func(repos *RBACRepository) error) error {
+	return fn(m.repos)
+}
+
+// findMissingIDs runs a single "id = ANY($1)" lookup and returns the requested IDs that were not found,
+// preserving request order and dropping duplicates
+func findMissingIDs(db database.Querier, query string, ids []string) ([]string, error) {
+	found := make(map[string]bool, len(ids))
+	err := database.QueryEach(db, "find existing ids", func(row database.Scanner) error {
+		id, err := scanString(row)
+		if err != nil {
+			return err
+		}
+		found[strings.ToLower(id)] = true
+		return nil
+	}, query, pq.Array(ids))
+	if err != nil {
+		return nil, err
 	}
+
+	var missing []string
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		key := strings.ToLower(id)
+		if found[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		missing = append(missing, id)
+	}
+	return missing, nil
+}
+
+// listPage counts the rows of table and runs the page query, which takes the limit and offset
+// as $1 and $2
+func listPage[T any](db database.Querier, table string, scan func(row database.Scanner) (T, error), query string, limit, offset int) ([]T, int, error) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	items, err := database.QueryAll(db, "list "+table+" page", scan, query, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return items, total, nil
+}
+
+// scanRole, scanPermission, scanRoleGroup and scanString convert a single result row;
+// they are shared by the list queries below via database.QueryAll
+func scanRole(row database.Scanner) (*Role, error) {
+	role := &Role{}
+	err := row.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &role.Key)
+	return role, err
+}
+
+// roleColumns are the columns scanRole expects, in order
+const roleColumns = `id, name, description, created_at, key`
+
+// permissionColumns are the columns scanPermission expects, in order
+const permissionColumns = `id, name, resource, action, category, description, risk_level, key`
+
+func scanPermission(row database.Scanner) (*Permission, error) {
+	permission := &Permission{}
+	err := row.Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action,
+		&permission.Category, &permission.Description, &permission.RiskLevel, &permission.Key)
+	return permission, err
+}
+
+func scanRoleGroup(row database.Scanner) (*RoleGroup, error) {
+	group := &RoleGroup{}
+	err := row.Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt)
+	return group, err
+}
+
+func scanString(row database.Scanner) (string, error) {
+	var value string
+	err := row.Scan(&value)
+	return value, err
 }
 
 // roleRepository implements RoleRepository
 type roleRepository struct {
-	db *sql.DB
+	db     database.DBTX
+	reader database.Querier
 }
 
 func NewRoleRepository(db *sql.DB) RoleRepository {
-	return &roleRepository{db: db}
+	return &roleRepository{db: db, reader: db}
 }
 
 func (r *roleRepository) Create(role *Role) error {
-	query := `INSERT INTO roles (id, name, description, created_at)
-	          VALUES ($1, $2, $3, $4)`
-	_, err := r.db.Exec(query, role.ID, role.Name, role.Description, role.CreatedAt)
+	query := `INSERT INTO roles (` + roleColumns + `)
+	          VALUES ($1, $2, $3, $4, $5)`
+	_, err := r.db.Exec(query, role.ID, role.Name, role.Description, role.CreatedAt, role.Key)
 	return err
 }
 
 func (r *roleRepository) GetByID(id string) (*Role, error) {
-	role := &Role{}
-	query := `SELECT id, name, description, created_at FROM roles WHERE id = $1`
-	err := r.db.QueryRow(query, id).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE id = $1`
+	role, err := scanRole(r.db.QueryRow(query, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -215,33 +600,35 @@ func (r *roleRepository) GetByID(id string) (*Role, error) {
 }
 
 func (r *roleRepository) GetByName(name string) (*Role, error) {
-	role := &Role{}
-	query := `SELECT id, name, description, created_at FROM roles WHERE name = $1`
-	err := r.db.QueryRow(query, name).Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE name = $1`
+	role, err := scanRole(r.db.QueryRow(query, name))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	return role, err
 }
 
-func (r *roleRepository) List() ([]*Role, error) {
-	query := `SELECT id, name, description, created_at FROM roles ORDER BY name`
-	rows, err := r.db.Query(query)
-	if err != nil {
-		return nil, err
+func (r *roleRepository) GetByKey(key string) (*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles WHERE key = $1`
+	role, err := scanRole(r.db.QueryRow(query, key))
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	defer rows.Close()
+	return role, err
+}
 
-	var roles []*Role
-	for rows.Next() {
-		role := &Role{}
-		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		roles = append(roles, role)
-	}
-	return roles, nil
+func (r *roleRepository) FindMissingIDs(ids []string) ([]string, error) {
+	return findMissingIDs(r.db, `SELECT id FROM roles WHERE id = ANY($1::uuid[])`, ids)
+}
+
+func (r *roleRepository) List() ([]*Role, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles ORDER BY name`
+	return database.QueryAll(r.reader, "list roles", scanRole, query)
+}
+
+func (r *roleRepository) ListPage(limit, offset int) ([]*Role, int, error) {
+	query := `SELECT ` + roleColumns + ` FROM roles ORDER BY name LIMIT $1 OFFSET $2`
+	return listPage(r.reader, "roles", scanRole, query, limit, offset)
 }
 
 func (r *roleRepository) Update(role *Role) error {
@@ -256,88 +643,158 @@ func (r *roleRepository) Delete(id string) error {
 	return err
 }
 
-func (r *roleRepository) DeleteWithTransaction(tx *sql.Tx, id string) error {
-	query := `DELETE FROM roles WHERE id = $1`
-	_, err := tx.Exec(query, id)
+func (r *roleRepository) Lock(id string) error {
+	// Assigning a role to a group key-share locks the role through the foreign key, so it waits
+	query := `SELECT id FROM roles WHERE id = $1 FOR UPDATE`
+	_, err := r.db.Exec(query, id)
 	return err
 }
 
 // permissionRepository implements PermissionRepository
 type permissionRepository struct {
-	db *sql.DB
+	db     database.DBTX
+	reader database.Querier
 }
 
 func NewPermissionRepository(db *sql.DB) PermissionRepository {
-	return &permissionRepository{db: db}
+	return &permissionRepository{db: db, reader: db}
 }
 
 func (r *permissionRepository) Create(permission *Permission) error {
-	query := `INSERT INTO permissions (id, name, resource, action) VALUES ($1, $2, $3, $4)`
-	_, err := r.db.Exec(query, permission.ID, permission.Name, permission.Resource, permission.Action)
+	query := `INSERT INTO permissions (` + permissionColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := r.db.Exec(query, permission.ID, permission.Name, permission.Resource, permission.Action,
+		permission.Category, permission.Description, permission.RiskLevel, permission.Key)
 	return err
 }
 
 func (r *permissionRepository) GetByID(id string) (*Permission, error) {
-	permission := &Permission{}
-	query := `SELECT id, name, resource, action FROM permissions WHERE id = $1`
-	err := r.db.QueryRow(query, id).Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action)
+	query := `SELECT ` + permissionColumns + ` FROM permissions WHERE id = $1`
+	permission, err := scanPermission(r.db.QueryRow(query, id))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	return permission, err
 }
 
+func (r *permissionRepository) FindMissingIDs(ids []string) ([]string, error) {
+	return findMissingIDs(r.db, `SELECT id FROM permissions WHERE id = ANY($1::uuid[])`, ids)
+}
+
 func (r *permissionRepository) List() ([]*Permission, error) {
-	query := `SELECT id, name, resource, action FROM permissions ORDER BY resource, action`
-	rows, err := r.db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	query := `SELECT ` + permissionColumns + ` FROM permissions ORDER BY resource, action`
+	return database.QueryAll(r.reader, "list permissions", scanPermission, query)
+}
 
-	var permissions []*Permission
-	for rows.Next() {
-		permission := &Permission{}
-		err := rows.Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action)
-		if err != nil {
-			return nil, err
-		}
-		permissions = append(permissions, permission)
-	}
-	return permissions, nil
+func (r *permissionRepository) ListPage(limit, offset int) ([]*Permission, int, error) {
+	query := `SELECT ` + permissionColumns + ` FROM permissions ORDER BY resource, action LIMIT $1 OFFSET $2`
+	return listPage(r.reader, "permissions", scanPermission, query, limit, offset)
 }
 
 func (r *permissionRepository) GetByRoleID(roleID string) ([]*Permission, error) {
-	query := `SELECT p.id, p.name, p.resource, p.action
+	query := `SELECT p.id, p.name, p.resource, p.action, p.category, p.description, p.risk_level, p.key
 	          FROM permissions p
 	          JOIN role_permissions rp ON p.id = rp.permission_id
 	          WHERE rp.role_id = $1
 	          ORDER BY p.resource, p.action`
-	rows, err := r.db.Query(query, roleID)
+	return database.QueryAll(r.reader, "list permissions by role", scanPermission, query, roleID)
+}
+
+func (r *permissionRepository) Upsert(permissions []*Permission) error {
+	// The name is only set on insert, so renames by administrators survive
+	query := `INSERT INTO permissions (` + permissionColumns + `) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	          ON CONFLICT (key) DO UPDATE SET resource = EXCLUDED.resource, action = EXCLUDED.action,
+	              category = EXCLUDED.category, description = EXCLUDED.description, risk_level = EXCLUDED.risk_level`
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for _, p := range permissions {
+			if _, err := tx.Exec(query, p.ID, p.Name, p.Resource, p.Action, p.Category, p.Description, p.RiskLevel, p.Key); err != nil {
+				return fmt.Errorf("upsert permission %s: %w", p.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *permissionRepository) Rename(id, name string) error {
+	_, err := r.db.Exec(`UPDATE permissions SET name = $2 WHERE id = $1`, id, name)
+	return err
+}
+
+func (r *permissionRepository) RoleReferences() (map[string][]RoleRef, error) {
+	query := `SELECT rp.permission_id, r.id, r.name
+	          FROM role_permissions rp
+	          JOIN roles r ON r.id = rp.role_id
+	          ORDER BY r.name`
+	refs := make(map[string][]RoleRef)
+	err := database.QueryEach(r.reader, "list permission role references", func(row database.Scanner) error {
+		var permissionID string
+		var ref RoleRef
+		if err := row.Scan(&permissionID, &ref.ID, &ref.Name); err != nil {
+			return err
+		}
+		refs[permissionID] = append(refs[permissionID], ref)
+		return nil
+	}, query)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return refs, nil
+}
 
-	var permissions []*Permission
-	for rows.Next() {
-		permission := &Permission{}
-		err := rows.Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action)
-		if err != nil {
-			return nil, err
+func (r *permissionRepository) Matrix(resource string) (*PermissionMatrix, error) {
+	// One row per permission and role; the left joins keep permissions when there are no roles
+	query := `SELECT p.id, p.name, p.resource, p.action, p.category, p.description, p.risk_level, p.key,
+	                 r.id, r.name, rp.permission_id IS NOT NULL
+	          FROM permissions p
+	          LEFT JOIN roles r ON TRUE
+	          LEFT JOIN role_permissions rp ON rp.role_id = r.id AND rp.permission_id = p.id
+	          WHERE $1 = '' OR p.resource = $1
+	          ORDER BY p.resource, p.action, r.name`
+
+	matrix := &PermissionMatrix{Resource: resource, Permissions: []*Permission{}, Roles: []*MatrixRow{}}
+	seen := make(map[string]bool)
+	rows := make(map[string]*MatrixRow)
+	err := database.QueryEach(r.reader, "build permission matrix", func(row database.Scanner) error {
+		p := &Permission{}
+		var roleID, roleName sql.NullString
+		var granted bool
+		if err := row.Scan(&p.ID, &p.Name, &p.Resource, &p.Action, &p.Category, &p.Description, &p.RiskLevel, &p.Key,
+			&roleID, &roleName, &granted); err != nil {
+			return err
 		}
-		permissions = append(permissions, permission)
+		if !seen[p.ID] {
+			seen[p.ID] = true
+			matrix.Permissions = append(matrix.Permissions, p)
+		}
+		if !roleID.Valid {
+			return nil
+		}
+		mr, ok := rows[roleID.String]
+		if !ok {
+			mr = &MatrixRow{RoleRef: RoleRef{ID: roleID.String, Name: roleName.String}, PermissionIDs: []string{}}
+			rows[roleID.String] = mr
+			matrix.Roles = append(matrix.Roles, mr)
+		}
+		if granted {
+			mr.PermissionIDs = append(mr.PermissionIDs, p.ID)
+		}
+		return nil
+	}, query, resource)
+	if err != nil {
+		return nil, err
 	}
-	return permissions, nil
+
+	sort.Slice(matrix.Roles, func(i, j int) bool { return matrix.Roles[i].Name < matrix.Roles[j].Name })
+	return matrix, nil
 }
 
 // roleGroupRepository implements RoleGroupRepository
 type roleGroupRepository struct {
-	db *sql.DB
+	db     database.DBTX
+	reader database.Querier
 }
 
 func NewRoleGroupRepository(db *sql.DB) RoleGroupRepository {
-	return &roleGroupRepository{db: db}
+	return &roleGroupRepository{db: db, reader: db}
 }
 
 func (r *roleGroupRepository) Create(group *RoleGroup) error {
@@ -369,22 +826,12 @@ func (r *roleGroupRepository) GetByName(name string) (*RoleGroup, error) {
 
 func (r *roleGroupRepository) List() ([]*RoleGroup, error) {
 	query := `SELECT id, name, description, created_at FROM role_groups ORDER BY name`
-	rows, err := r.db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return database.QueryAll(r.reader, "list role groups", scanRoleGroup, query)
+}
 
-	var groups []*RoleGroup
-	for rows.Next() {
-		group := &RoleGroup{}
-		err := rows.Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		groups = append(groups, group)
-	}
-	return groups, nil
+func (r *roleGroupRepository) ListPage(limit, offset int) ([]*RoleGroup, int, error) {
+	query := `SELECT id, name, description, created_at FROM role_groups ORDER BY name LIMIT $1 OFFSET $2`
+	return listPage(r.reader, "role_groups", scanRoleGroup, query, limit, offset)
 }
 
 func (r *roleGroupRepository) Update(group *RoleGroup) error {
@@ -399,25 +846,23 @@ func (r *roleGroupRepository) Delete(id string) error {
 	return err
 }
 
-func (r *roleGroupRepository) DeleteWithTransaction(tx *sql.Tx, id string) error {
-	query := `DELETE FROM role_groups WHERE id = $1`
-	_, err := tx.Exec(query, id)
-	return err
-}
+// activeMembership restricts a query on user_group_memberships ugm to unexpired memberships
+const activeMembership = `(ugm.expires_at IS NULL OR ugm.expires_at > NOW())`
 
 // userGroupMembershipRepository implements UserGroupMembershipRepository
 type userGroupMembershipRepository struct {
-	db *sql.DB
+	db     database.DBTX
+	reader database.Querier
 }
 
 func NewUserGroupMembershipRepository(db *sql.DB) UserGroupMembershipRepository {
-	return &userGroupMembershipRepository{db: db}
+	return &userGroupMembershipRepository{db: db, reader: db}
 }
 
 func (r *userGroupMembershipRepository) Create(membership *UserGroupMembership) error {
-	query := `INSERT INTO user_group_memberships (user_id, group_id, assigned_at)
-	          VALUES ($1, $2, $3)`
-	_, err := r.db.Exec(query, membership.UserID, membership.GroupID, membership.AssignedAt)
+	query := `INSERT INTO user_group_memberships (user_id, group_id, assigned_at, expires_at)
+	          VALUES ($1, $2, $3, $4)`
+	_, err := r.db.Exec(query, membership.UserID, membership.GroupID, membership.AssignedAt, membership.ExpiresAt)
 	return err
 }
 
@@ -431,44 +876,36 @@ func (r *userGroupMembershipRepository) GetUserGroups(userID string) ([]*RoleGro
 	query := `SELECT g.id, g.name, g.description, g.created_at
 	          FROM role_groups g
 	          JOIN user_group_memberships ugm ON g.id = ugm.group_id
-	          WHERE ugm.user_id = $1
+	          WHERE ugm.user_id = $1 AND ` + activeMembership + `
 	          ORDER BY g.name`
-	rows, err := r.db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var groups []*RoleGroup
-	for rows.Next() {
-		group := &RoleGroup{}
-		err := rows.Scan(&group.ID, &group.Name, &group.Description, &group.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		groups = append(groups, group)
-	}
-	return groups, nil
+	return database.QueryAll(r.reader, "list user groups", scanRoleGroup, query, userID)
 }
 
 func (r *userGroupMembershipRepository) GetGroupUsers(groupID string) ([]string, error) {
 	query := `SELECT user_id FROM user_group_memberships WHERE group_id = $1`
-	rows, err := r.db.Query(query, groupID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return database.QueryAll(r.reader, "list group users", scanString, query, groupID)
+}
 
-	var userIDs []string
-	for rows.Next() {
-		var userID string
-		err := rows.Scan(&userID)
+func (r *userGroupMembershipRepository) ListGroupMemberships(groupID string) ([]*UserGroupMembership, error) {
+	// Read from the primary: the group is about to be deleted
+	query := `SELECT user_id, group_id, assigned_at, expires_at FROM user_group_memberships WHERE group_id = $1 ORDER BY assigned_at, user_id`
+	return database.QueryAll(r.db, "list group memberships", func(row database.Scanner) (*UserGroupMembership, error) {
+		membership := &UserGroupMembership{}
+		err := row.Scan(&membership.UserID, &membership.GroupID, &membership.AssignedAt, &membership.ExpiresAt)
+		return membership, err
+	}, query, groupID)
+}
+
+// StreamGroupUsers calls fn for each member of a group as rows are scanned, without buffering the result set
+func (r *userGroupMembershipRepository) StreamGroupUsers(groupID string, fn func(userID string) error) error {
+	query := `SELECT user_id FROM user_group_memberships WHERE group_id = $1 ORDER BY assigned_at, user_id`
+	return database.QueryEach(r.reader, "stream group users", func(row database.Scanner) error {
+		userID, err := scanString(row)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		userIDs = append(userIDs, userID)
-	}
-	return userIDs, nil
+		return fn(userID)
+	}, query, groupID)
 }
 
 func (r *userGroupMembershipRepository) IsUserInGroup(userID, groupID string) (bool, error) {
@@ -478,80 +915,120 @@ func (r *userGroupMembershipRepository) IsUserInGroup(userID, groupID string) (b
 	return count > 0, err
 }
 
-func (r *userGroupMembershipRepository) ClearGroupMembershipsWithTransaction(tx *sql.Tx, groupID string) error {
+func (r *userGroupMembershipRepository) ClearGroupMemberships(groupID string) error {
 	query := `DELETE FROM user_group_memberships WHERE group_id = $1`
-	_, err := tx.Exec(query, groupID)
+	_, err := r.db.Exec(query, groupID)
 	return err
 }
 
-// rolePermissionRepository implements RolePermissionRepository
-type rolePermissionRepository struct {
-	db *sql.DB
+// membershipHistoryRepository implements MembershipHistoryRepository
+type membershipHistoryRepository struct {
+	db     database.DBTX
+	reader database.Querier
 }
 
-func NewRolePermissionRepository(db *sql.DB) RolePermissionRepository {
-	return &rolePermissionRepository{db: db}
+func (r *membershipHistoryRepository) Record(event *MembershipEvent) error {
+	query := `INSERT INTO group_membership_history (group_id, user_id, action, actor_id, expires_at, occurred_at)
+	          VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	return r.db.QueryRow(query, event.GroupID, event.UserID, event.Action, event.ActorID, event.ExpiresAt, event.OccurredAt).Scan(&event.ID)
 }
 
-func (r *rolePermissionRepository) AssignPermissionsToRole(roleID string, permissionIDs []string) error {
-	tx, err := r.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
+func (r *membershipHistoryRepository) RecordGroupRemoval(groupID, actorID string, at time.Time) error {
+	query := `INSERT INTO group_membership_history (group_id, user_id, action, actor_id, expires_at, occurred_at)
+	          SELECT group_id, user_id, $2, $3, expires_at, $4 FROM user_group_memberships WHERE group_id = $1`
+	_, err := r.db.Exec(query, groupID, MembershipRemoved, actorID, at)
+	return err
+}
 
-	for _, permissionID := range permissionIDs {
-		query := `INSERT INTO role_permissions (role_id, permission_id)
-		          VALUES ($1, $2) ON CONFLICT DO NOTHING`
-		_, err = tx.Exec(query, roleID, permissionID)
-		if err != nil {
-			return err
-		}
-	}
+// membershipEventColumns are the columns scanMembershipEvent expects, in order; h is the
+// history table and g the (possibly deleted) group
+const membershipEventColumns = `h.id, h.group_id, COALESCE(g.name, ''), h.user_id, h.action, h.actor_id, h.expires_at, h.occurred_at`
 
-	return tx.Commit()
+func scanMembershipEvent(row database.Scanner) (*MembershipEvent, error) {
+	event := &MembershipEvent{}
+	err := row.Scan(&event.ID, &event.GroupID, &event.GroupName, &event.UserID, &event.Action, &event.ActorID, &event.ExpiresAt, &event.OccurredAt)
+	return event, err
 }
 
-func (r *rolePermissionRepository) RemovePermissionsFromRole(roleID string, permissionIDs []string) error {
-	tx, err := r.db.Begin()
+func (r *membershipHistoryRepository) ListByGroup(groupID string, limit, offset int) ([]*MembershipEvent, int, error) {
+	return r.list("group_id", groupID, limit, offset)
+}
+
+func (r *membershipHistoryRepository) ListByUser(userID string, limit, offset int) ([]*MembershipEvent, int, error) {
+	return r.list("user_id", userID, limit, offset)
+}
+
+// list returns one page of the events matching column, newest first
+func (r *membershipHistoryRepository) list(column, value string, limit, offset int) ([]*MembershipEvent, int, error) {
+	var total int
+	if err := r.reader.QueryRow(`SELECT COUNT(*) FROM group_membership_history WHERE `+column+` = $1`, value).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := `SELECT ` + membershipEventColumns + `
+	          FROM group_membership_history h
+	          LEFT JOIN role_groups g ON g.id = h.group_id
+	          WHERE h.` + column + ` = $1
+	          ORDER BY h.occurred_at DESC, h.id DESC
+	          LIMIT $2 OFFSET $3`
+	events, err := database.QueryAll(r.reader, "list membership history", scanMembershipEvent, query, value, limit, offset)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	defer tx.Rollback()
+	return events, total, nil
+}
 
-	for _, permissionID := range permissionIDs {
-		query := `DELETE FROM role_permissions WHERE role_id = $1 AND permission_id = $2`
-		_, err = tx.Exec(query, roleID, permissionID)
-		if err != nil {
-			return err
+// rolePermissionRepository implements RolePermissionRepository
+type rolePermissionRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+func NewRolePermissionRepository(db *sql.DB) RolePermissionRepository {
+	return &rolePermissionRepository{db: db, reader: db}
+}
+
+func (r *rolePermissionRepository) AssignPermissionsToRole(roleID string, permissionIDs []string) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for _, permissionID := range permissionIDs {
+			query := `INSERT INTO role_permissions (role_id, permission_id)
+			          VALUES ($1, $2) ON CONFLICT DO NOTHING`
+			if _, err := tx.Exec(query, roleID, permissionID); err != nil {
+				return err
+			}
 		}
-	}
+		return nil
+	})
+}
 
-	return tx.Commit()
+func (r *rolePermissionRepository) RemovePermissionsFromRole(roleID string, permissionIDs []string) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for _, permissionID := range permissionIDs {
+			query := `DELETE FROM role_permissions WHERE role_id = $1 AND permission_id = $2`
+			if _, err := tx.Exec(query, roleID, permissionID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (r *rolePermissionRepository) GetRolePermissions(roleID string) ([]*Permission, error) {
-	query := `SELECT p.id, p.name, p.resource, p.action
+	query := `SELECT p.id, p.name, p.resource, p.action, p.category, p.description, p.risk_level, p.key
 	          FROM permissions p
 	          JOIN role_permissions rp ON p.id = rp.permission_id
 	          WHERE rp.role_id = $1
 	          ORDER BY p.resource, p.action`
-	rows, err := r.db.Query(query, roleID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	return database.QueryAll(r.db, "list role permissions", scanPermission, query, roleID)
+}
 
-	var permissions []*Permission
-	for rows.Next() {
-		permission := &Permission{}
-		err := rows.Scan(&permission.ID, &permission.Name, &permission.Resource, &permission.Action)
-		if err != nil {
-			return nil, err
-		}
-		permissions = append(permissions, permission)
-	}
-	return permissions, nil
+func (r *rolePermissionRepository) GetEffectiveRolePermissions(roleID string) ([]*Permission, error) {
+	query := `SELECT p.id, p.name, p.resource, p.action, p.category, p.description, p.risk_level, p.key
+	          FROM permissions p
+	          JOIN role_permissions rp ON p.id = rp.permission_id
+	          LEFT JOIN role_scopes rs ON rs.role_id = rp.role_id
+	          WHERE rp.role_id = $1 AND ` + roleInScope + `
+	          ORDER BY p.resource, p.action`
+	return database.QueryAll(r.reader, "list effective role permissions", scanPermission, query, roleID)
 }
 
 func (r *rolePermissionRepository) ClearRolePermissions(roleID string) error {
@@ -560,80 +1037,84 @@ func (r *rolePermissionRepository) ClearRolePermissions(roleID string) error {
 	return err
 }
 
-func (r *rolePermissionRepository) ClearRolePermissionsWithTransaction(tx *sql.Tx, roleID string) error {
-	query := `DELETE FROM role_permissions WHERE role_id = $1`
-	_, err := tx.Exec(query, roleID)
-	return err
-}
-
 // groupRoleRepository implements GroupRoleRepository
 type groupRoleRepository struct {
-	db *sql.DB
+	db     database.DBTX
+	reader database.Querier
 }
 
 func NewGroupRoleRepository(db *sql.DB) GroupRoleRepository {
-	return &groupRoleRepository{db: db}
+	return &groupRoleRepository{db: db, reader: db}
 }
 
 func (r *groupRoleRepository) AssignRolesToGroup(groupID string, roleIDs []string) error {
-	tx, err := r.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	for _, roleID := range roleIDs {
-		query := `INSERT INTO group_roles (group_id, role_id)
-		          VALUES ($1, $2) ON CONFLICT DO NOTHING`
-		_, err = tx.Exec(query, groupID, roleID)
-		if err != nil {
-			return err
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for _, roleID := range roleIDs {
+			query := `INSERT INTO group_roles (group_id, role_id)
+			          VALUES ($1, $2) ON CONFLICT DO NOTHING`
+			if _, err := tx.Exec(query, groupID, roleID); err != nil {
+				return err
+			}
 		}
-	}
-
-	return tx.Commit()
+		return nil
+	})
 }
 
 func (r *groupRoleRepository) RemoveRolesFromGroup(groupID string, roleIDs []string) error {
-	tx, err := r.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
-	for _, roleID := range roleIDs {
-		query := `DELETE FROM group_roles WHERE group_id = $1 AND role_id = $2`
-		_, err = tx.Exec(query, groupID, roleID)
-		if err != nil {
-			return err
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for _, roleID := range roleIDs {
+			query := `DELETE FROM group_roles WHERE group_id = $1 AND role_id = $2`
+			if _, err := tx.Exec(query, groupID, roleID); err != nil {
+				return err
+			}
 		}
-	}
-
-	return tx.Commit()
+		return nil
+	})
 }
 
 func (r *groupRoleRepository) GetGroupRoles(groupID string) ([]*Role, error) {
-	query := `SELECT r.id, r.name, r.description, r.created_at
+	query := `SELECT r.id, r.name, r.description, r.created_at, r.key
 	          FROM roles r
 	          JOIN group_roles gr ON r.id = gr.role_id
 	          WHERE gr.group_id = $1
 	          ORDER BY r.name`
-	rows, err := r.db.Query(query, groupID)
+	return database.QueryAll(r.db, "list group roles", scanRole, query, groupID)
+}
+
+func (r *groupRoleRepository) GetRoleGroupIDs(roleID string) ([]string, error) {
+	// Read from the primary: the role is about to be deleted
+	query := `SELECT group_id FROM group_roles WHERE role_id = $1`
+	return database.QueryAll(r.db, "list role groups", scanString, query, roleID)
+}
+
+func (r *groupRoleRepository) GetRoleUsage(roleID string) (*RoleUsage, error) {
+	// Read from the primary: the role is about to be deleted. The empty grouping set adds a
+	// total row counting each user once however many of the groups they are in.
+	query := `SELECT GROUPING(rg.id) = 1, COALESCE(rg.id::text, ''), COALESCE(rg.name, ''), COUNT(DISTINCT ugm.user_id)
+	          FROM group_roles gr
+	          JOIN role_groups rg ON rg.id = gr.group_id
+	          LEFT JOIN user_group_memberships ugm ON ugm.group_id = gr.group_id AND ` + activeMembership + `
+	          WHERE gr.role_id = $1
+	          GROUP BY GROUPING SETS ((rg.id, rg.name), ())
+	          ORDER BY 1, rg.name`
+	usage := &RoleUsage{Groups: []GroupUsage{}}
+	err := database.QueryEach(r.db, "get role usage", func(row database.Scanner) error {
+		var total bool
+		var group GroupUsage
+		if err := row.Scan(&total, &group.GroupID, &group.GroupName, &group.UserCount); err != nil {
+			return err
+		}
+		if total {
+			usage.UserCount = group.UserCount
+		} else {
+			usage.Groups = append(usage.Groups, group)
+		}
+		return nil
+	}, query, roleID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var roles []*Role
-	for rows.Next() {
-		role := &Role{}
-		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		roles = append(roles, role)
-	}
-	return roles, nil
+	return usage, nil
 }
 
 func (r *groupRoleRepository) ClearGroupRoles(groupID string) error {
@@ -642,14 +1123,106 @@ func (r *groupRoleRepository) ClearGroupRoles(groupID string) error {
 	return err
 }
 
-func (r *groupRoleRepository) ClearGroupRolesWithTransaction(tx *sql.Tx, groupID string) error {
-	query := `DELETE FROM group_roles WHERE group_id = $1`
-	_, err := tx.Exec(query, groupID)
+func (r *groupRoleRepository) RemoveRoleFromAllGroups(roleID string) error {
+	query := `DELETE FROM group_roles WHERE role_id = $1`
+	_, err := r.db.Exec(query, roleID)
 	return err
 }
 
-func (r *groupRoleRepository) RemoveRoleFromAllGroupsWithTransaction(tx *sql.Tx, roleID string) error {
-	query := `DELETE FROM group_roles WHERE role_id = $1`
-	_, err := tx.Exec(query, roleID)
-	return err
+// userPermissionRepository implements UserPermissionRepository. Permissions are resolved on the
+// primary: a lagging replica would keep granting access that was just revoked.
+type userPermissionRepository struct {
+	db database.Querier
+}
+
+func NewUserPermissionRepository(db *sql.DB) UserPermissionRepository {
+	return &userPermissionRepository{db: db}
+}
+
+// GetUserPermissions resolves permissions, roles and groups for a user using a single optimized
+// query; scoped roles only grant their permissions on the resource they are scoped to
+func (r *userPermissionRepository) GetUserPermissions(userID string) (*UserPermissions, error) {
+	// Use single optimized query with JOINs to get all user permissions
+	query := `
+		SELECT DISTINCT
+			p.id, p.name, p.resource, p.action,
+			r.id, r.name, r.description, r.created_at,
+			rg.id, rg.name, rg.description, rg.created_at,
+			p.key, r.key
+		FROM permissions p
+		JOIN role_permissions rp ON p.id = rp.permission_id
+		JOIN group_roles gr ON rp.role_id = gr.role_id
+		JOIN user_group_memberships ugm ON gr.group_id = ugm.group_id
+		JOIN roles r ON rp.role_id = r.id
+		JOIN role_groups rg ON gr.group_id = rg.id
+		LEFT JOIN role_scopes rs ON rs.role_id = r.id
+		WHERE ugm.user_id = $1 AND ` + activeMembership + ` AND ` + roleInScope + `
+		ORDER BY rg.name, r.name, p.resource, p.action
+	`
+
+	// Use maps to deduplicate results
+	permissionMap := make(map[string]*Permission)
+	roleMap := make(map[string]*Role)
+	groupMap := make(map[string]*RoleGroup)
+	grantMap := make(map[string]map[string]bool)
+
+	err := database.QueryEach(r.db, "resolve user permissions", func(row database.Scanner) error {
+		var perm Permission
+		var role Role
+		var group RoleGroup
+
+		err := row.Scan(
+			&perm.ID, &perm.Name, &perm.Resource, &perm.Action,
+			&role.ID, &role.Name, &role.Description, &role.CreatedAt,
+			&group.ID, &group.Name, &group.Description, &group.CreatedAt,
+			&perm.Key, &role.Key,
+		)
+		if err != nil {
+			return err
+		}
+
+		// Store in maps to deduplicate
+		permissionMap[perm.ID] = &perm
+		roleMap[role.ID] = &role
+		groupMap[group.ID] = &group
+		if grantMap[perm.Key] == nil {
+			grantMap[perm.Key] = make(map[string]bool)
+		}
+		grantMap[perm.Key][role.ID] = true
+		return nil
+	}, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert maps to slices
+	var permissions []Permission
+	for _, perm := range permissionMap {
+		permissions = append(permissions, *perm)
+	}
+
+	var roles []Role
+	for _, role := range roleMap {
+		roles = append(roles, *role)
+	}
+
+	var groups []RoleGroup
+	for _, group := range groupMap {
+		groups = append(groups, *group)
+	}
+
+	grants := make(map[string][]string, len(grantMap))
+	for key, roleIDs := range grantMap {
+		for roleID := range roleIDs {
+			grants[key] = append(grants[key], roleID)
+		}
+	}
+
+	return &UserPermissions{
+		UserID:      userID,
+		Permissions: permissions,
+		Roles:       roles,
+		Groups:      groups,
+		grants:      grants,
+	}, nil
 }
@@ -0,0 +1,48 @@
+package rbac
+
+import (
+	"net/http"
+
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+)
+
+// Owner reports whether the user userID owns the resource r targets
+type Owner func(r *http.Request, userID string) (bool, error)
+
+// RequireOwnershipOr protects handler with permission or its own-resource variant (perm.Own):
+// callers holding permission act on any resource, callers holding only the variant act on the
+// resources owner says are theirs, and everyone else gets 403. Protect the route with an empty
+// permission so it still requires a valid token; outside a protected route the token is checked
+// here.
+func (s *RBACService) RequireOwnershipOr(permission perm.Name, owner Owner, handler http.HandlerFunc) http.HandlerFunc {
+	s.ReferencePermissions("ownership check", permission, perm.Own(permission))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if getUserIDFromContext(r.Context()) == "" {
+			var ok bool
+			if r, ok = s.authorize(w, r, ""); !ok {
+				return
+			}
+		}
+		permissionNames := getUserPermissionsFromContext(r.Context())
+		if hasPermission(permissionNames, string(permission)) {
+			handler(w, r)
+			return
+		}
+
+		userID := getUserIDFromContext(r.Context())
+		own := perm.Own(permission)
+		if hasPermission(permissionNames, string(own)) {
+			owns, err := owner(r, userID)
+			if err != nil {
+				httpapi.WriteError(w, err, "Failed to check ownership")
+				return
+			}
+			if owns {
+				handler(w, r)
+				return
+			}
+		}
+		s.Forbid(w, r, string(permission)+" or "+string(own))
+	}
+}
@@ -0,0 +1,122 @@
+package rbac
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultPermissionCacheSize is the most users whose permissions NewMemoryPermissionCache keeps
+const DefaultPermissionCacheSize = 10000
+
+// PermissionCache keeps resolved user permissions between requests, so authenticating a request
+// does not resolve them from the database every time. Entries live for the cache's TTL at most;
+// changes to memberships, group roles, role permissions and scopes invalidate them at once.
+//
+// Resolution and invalidation race: a lookup that started before an invalidation must not cache
+// its result. Get therefore returns the cache's generation, which every invalidation advances,
+// and Set drops entries resolved under an older generation. An implementation shared by several
+// instances (e.g. on Redis) makes invalidations on one instance take effect on all of them; with
+// the in-memory cache other instances catch up within the TTL.
+type PermissionCache interface {
+	// Get returns the cached permissions of userID, if any, and the current generation
+	Get(ctx context.Context, userID string) (*UserPermissions, uint64, bool)
+	// Set caches the permissions of userID resolved after Get returned generation
+	Set(ctx context.Context, userID string, perms *UserPermissions, generation uint64)
+	// Invalidate drops the permissions of the users
+	Invalidate(ctx context.Context, userIDs ...string)
+	// InvalidateAll drops every entry, for changes that affect an unknown set of users
+	InvalidateAll(ctx context.Context)
+}
+
+// SetPermissionCache caches resolved user permissions in cache. Set it before serving requests.
+func (s *RBACService) SetPermissionCache(cache PermissionCache) {
+	s.permCache = cache
+}
+
+// accessChanged invalidates the cached permissions of userIDs, or of everyone when none are
+// given. Call it after the change is committed.
+func (s *RBACService) accessChanged(ctx context.Context, userIDs ...string) {
+	if s.permCache == nil {
+		return
+	}
+	if len(userIDs) == 0 {
+		s.permCache.InvalidateAll(ctx)
+		return
+	}
+	s.permCache.Invalidate(ctx, userIDs...)
+}
+
+// memoryPermissionCache implements PermissionCache in process memory
+type memoryPermissionCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	mu         sync.Mutex
+	entries    map[string]cachedPermissions
+	generation uint64
+}
+
+type cachedPermissions struct {
+	perms     *UserPermissions
+	expiresAt time.Time
+}
+
+// NewMemoryPermissionCache returns a cache keeping the permissions of up to maxEntries users
+// (DefaultPermissionCacheSize when not positive) for ttl
+func NewMemoryPermissionCache(ttl time.Duration, maxEntries int) PermissionCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultPermissionCacheSize
+	}
+	return &memoryPermissionCache{ttl: ttl, maxEntries: maxEntries, now: time.Now, entries: make(map[string]cachedPermissions)}
+}
+
+func (c *memoryPermissionCache) Get(_ context.Context, userID string) (*UserPermissions, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[userID]
+	if ok && !c.now().Before(entry.expiresAt) {
+		delete(c.entries, userID)
+		ok = false
+	}
+	return entry.perms, c.generation, ok
+}
+
+func (c *memoryPermissionCache) Set(_ context.Context, userID string, perms *UserPermissions, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	now := c.now()
+	if _, ok := c.entries[userID]; !ok && len(c.entries) >= c.maxEntries {
+		// Make room by dropping expired entries, or everything when none has expired; a full
+		// cache only costs one resolution per user
+		for id, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, id)
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			c.entries = make(map[string]cachedPermissions)
+		}
+	}
+	c.entries[userID] = cachedPermissions{perms: perms, expiresAt: now.Add(c.ttl)}
+}
+
+func (c *memoryPermissionCache) Invalidate(_ context.Context, userIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, userID := range userIDs {
+		delete(c.entries, userID)
+	}
+}
+
+func (c *memoryPermissionCache) InvalidateAll(_ context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[string]cachedPermissions)
+}
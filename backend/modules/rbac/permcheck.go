@@ -0,0 +1,110 @@
+package rbac
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"base-app/pkg/perm"
+)
+
+// PermissionReferences compares the permissions routes and configuration check with those that
+// exist, so a misspelt or removed permission is found at startup rather than by a wave of 403s
+type PermissionReferences struct {
+	// Missing are checked somewhere but neither registered by a module nor in the permissions
+	// table; nobody can hold them, so whatever checks them is unreachable
+	Missing []MissingPermission `json:"missing"`
+	// Unreferenced are registered but checked nowhere, so granting them grants nothing.
+	// Deprecated permissions are left out: code is expected to stop checking them.
+	Unreferenced []string `json:"unreferenced"`
+}
+
+// MissingPermission is a permission checked by Sources that does not exist
+type MissingPermission struct {
+	Permission string   `json:"permission"`
+	Sources    []string `json:"sources"`
+}
+
+// Empty reports whether routes, configuration and permissions agree
+func (r *PermissionReferences) Empty() bool {
+	return len(r.Missing) == 0 && len(r.Unreferenced) == 0
+}
+
+// String lists the mismatches, one per line
+func (r *PermissionReferences) String() string {
+	var lines []string
+	for _, m := range r.Missing {
+		lines = append(lines, fmt.Sprintf("- %s: checked by %s but does not exist", m.Permission, strings.Join(m.Sources, ", ")))
+	}
+	for _, name := range r.Unreferenced {
+		lines = append(lines, fmt.Sprintf("- %s: registered but checked nowhere", name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ReferencePermissions records that source checks permissions without Protect or
+// RequirePermission, e.g. inside a handler or through configuration, so CheckPermissionReferences
+// counts them as used. Call it while setting up, before the check runs.
+func (s *RBACService) ReferencePermissions(source string, permissions ...perm.Name) {
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+	for _, permission := range permissions {
+		if permission != "" {
+			s.referenced[permission] = append(s.referenced[permission], source)
+		}
+	}
+}
+
+// CheckPermissionReferences compares the permissions of the routes registered with Protect and
+// those recorded with ReferencePermissions against the registered and stored permissions. Run it
+// once every module has mounted its routes.
+func (s *RBACService) CheckPermissionReferences() (*PermissionReferences, error) {
+	stored, err := s.repo.PermissionRepo.List()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[string]bool)
+	for _, p := range stored {
+		exists[p.Key] = true
+	}
+	registered := RegisteredPermissions()
+	for _, p := range registered {
+		exists[p.Key] = true
+	}
+
+	sources := make(map[string][]string)
+	s.routesMu.RLock()
+	for route, permission := range s.routePermissions {
+		if permission == "" {
+			continue
+		}
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		sources[string(permission)] = append(sources[string(permission)], strings.TrimSpace(strings.Join(methods, ",")+" "+path))
+	}
+	for permission, from := range s.referenced {
+		sources[string(permission)] = append(sources[string(permission)], from...)
+	}
+	s.routesMu.RUnlock()
+
+	report := &PermissionReferences{Missing: []MissingPermission{}, Unreferenced: []string{}}
+	for name, from := range sources {
+		if !exists[name] {
+			sort.Strings(from)
+			report.Missing = append(report.Missing, MissingPermission{Permission: name, Sources: slices.Compact(from)})
+		}
+	}
+	sort.Slice(report.Missing, func(i, j int) bool { return report.Missing[i].Permission < report.Missing[j].Permission })
+	for _, p := range registered {
+		if _, checked := sources[p.Key]; checked {
+			continue
+		}
+		if _, deprecated := s.deprecations.deprecated(p.Key); deprecated {
+			continue
+		}
+		report.Unreferenced = append(report.Unreferenced, p.Key)
+	}
+	sort.Strings(report.Unreferenced)
+	return report, nil
+}
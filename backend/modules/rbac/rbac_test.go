@@ -2,19 +2,44 @@ package rbac
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"base-app/modules/auth"
+	"base-app/modules/notification"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/authevents"
+	"base-app/pkg/database"
+	"base-app/pkg/fixtures"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jsonschema"
+	"base-app/pkg/perm"
+	"base-app/pkg/quota"
+	"base-app/pkg/ratelimit"
+	"base-app/pkg/testsupport"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -38,45 +63,8 @@ func (suite *IntegrationTestSuite) SetupSuite() {
 	suite.logger = logrus.New()
 	suite.logger.SetLevel(logrus.ErrorLevel) // Reduce log noise during tests
 
-	// Get database configuration
-	dbHost := getEnv("TEST_DB_HOST", "localhost")
-	dbPort := getEnv("TEST_DB_PORT", "5433")
-	dbUser := getEnv("TEST_DB_USER", "postgres")
-	dbPassword := getEnv("TEST_DB_PASSWORD", "postgres")
-	dbName := getEnv("TEST_DB_NAME", "rbac_test")
-	dbSSLMode := getEnv("TEST_DB_SSLMODE", "disable")
-
-	// First connect to postgres database to create the test database
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-		dbHost, dbPort, dbUser, dbPassword, dbSSLMode)
-
-	adminDB, err := sql.Open("postgres", connStr)
-	if err != nil {
-		suite.T().Fatalf("Failed to connect to postgres database: %v", err)
-	}
-	defer adminDB.Close()
-
-	// Drop test database if it exists, then create fresh
-	_, err = adminDB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
-	if err != nil {
-		// Ignore error if database doesn't exist
-		suite.logger.Warnf("Failed to drop test database (may not exist): %v", err)
-	}
-
-	// Create test database
-	_, err = adminDB.Exec(fmt.Sprintf("CREATE DATABASE %s", dbName))
-	suite.Require().NoError(err, "Failed to create test database")
-
-	// Now connect to the test database
-	testConnStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		dbHost, dbPort, dbUser, dbPassword, dbName, dbSSLMode)
-
-	suite.db, err = sql.Open("postgres", testConnStr)
-	suite.Require().NoError(err, "Failed to connect to test database")
-
-	// Ping to ensure connection
-	err = suite.db.Ping()
-	suite.Require().NoError(err, "Failed to ping test database")
+	// A fresh database on the server TEST_DB_MODE selects (see pkg/testsupport), dropped when the suite ends
+	suite.db = testsupport.NewTestDatabase(suite.T())
 
 	// Set connection pool settings for tests
 	suite.db.SetMaxOpenConns(10)
@@ -102,27 +90,6 @@ func (suite *IntegrationTestSuite) SetupSuite() {
 func (suite *IntegrationTestSuite) TearDownSuite() {
 	if suite.db != nil {
 		suite.db.Close()
-
-		// Clean up test database
-		dbHost := getEnv("TEST_DB_HOST", "localhost")
-		dbPort := getEnv("TEST_DB_PORT", "5432")
-		dbUser := getEnv("TEST_DB_USER", "postgres")
-		dbPassword := getEnv("TEST_DB_PASSWORD", "postgres")
-		dbName := getEnv("TEST_DB_NAME", "rbac_test")
-		dbSSLMode := getEnv("TEST_DB_SSLMODE", "disable")
-
-		// Connect to postgres database to drop the test database
-		connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=postgres sslmode=%s",
-			dbHost, dbPort, dbUser, dbPassword, dbSSLMode)
-
-		adminDB, err := sql.Open("postgres", connStr)
-		if err == nil {
-			defer adminDB.Close()
-			// Terminate active connections to the test database
-			adminDB.Exec(fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s'", dbName))
-			// Drop the test database
-			adminDB.Exec(fmt.Sprintf("DROP DATABASE IF EXISTS %s", dbName))
-		}
 	}
 }
 
@@ -149,13 +116,31 @@ func (suite *IntegrationTestSuite) setupTestDatabase() {
 			id UUID PRIMARY KEY,
 			name VARCHAR UNIQUE NOT NULL,
 			description TEXT,
-			created_at TIMESTAMP NOT NULL
+			created_at TIMESTAMP NOT NULL,
+			key VARCHAR UNIQUE NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS role_scopes (
+			role_id UUID PRIMARY KEY REFERENCES roles(id) ON DELETE CASCADE,
+			resource VARCHAR NOT NULL,
+			updated_by VARCHAR NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL
 		)`,
 		`CREATE TABLE IF NOT EXISTS permissions (
 			id UUID PRIMARY KEY,
 			name VARCHAR UNIQUE NOT NULL,
 			resource VARCHAR NOT NULL,
-			action VARCHAR NOT NULL
+			action VARCHAR NOT NULL,
+			category VARCHAR NOT NULL DEFAULT 'General',
+			description TEXT NOT NULL DEFAULT '',
+			risk_level VARCHAR NOT NULL DEFAULT 'low',
+			key VARCHAR UNIQUE NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS permission_deprecations (
+			permission_id UUID PRIMARY KEY REFERENCES permissions(id) ON DELETE CASCADE,
+			replaced_by UUID REFERENCES permissions(id) ON DELETE SET NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			deprecated_by VARCHAR NOT NULL DEFAULT '',
+			deprecated_at TIMESTAMP NOT NULL
 		)`,
 		`CREATE TABLE IF NOT EXISTS role_permissions (
 			role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
@@ -177,8 +162,61 @@ func (suite *IntegrationTestSuite) setupTestDatabase() {
 			user_id UUID NOT NULL,
 			group_id UUID REFERENCES role_groups(id) ON DELETE CASCADE,
 			assigned_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP,
+			expiry_reminded_at TIMESTAMP,
+			expiry_snoozed_until TIMESTAMP,
 			PRIMARY KEY (user_id, group_id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS group_membership_history (
+			id BIGSERIAL PRIMARY KEY,
+			group_id UUID NOT NULL,
+			user_id UUID NOT NULL,
+			action VARCHAR NOT NULL,
+			actor_id VARCHAR NOT NULL DEFAULT '',
+			expires_at TIMESTAMP,
+			occurred_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_templates (
+			id UUID PRIMARY KEY,
+			name VARCHAR UNIQUE NOT NULL,
+			name_pattern VARCHAR NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_template_roles (
+			template_id UUID REFERENCES group_templates(id) ON DELETE CASCADE,
+			role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+			PRIMARY KEY (template_id, role_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS domain_group_rules (
+			id UUID PRIMARY KEY,
+			domain VARCHAR NOT NULL,
+			group_id UUID NOT NULL REFERENCES role_groups(id) ON DELETE CASCADE,
+			created_by VARCHAR NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (domain, group_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS personal_access_tokens (
+			id UUID PRIMARY KEY,
+			user_id VARCHAR NOT NULL,
+			username VARCHAR NOT NULL DEFAULT '',
+			name VARCHAR NOT NULL,
+			prefix VARCHAR NOT NULL,
+			token_hash VARCHAR UNIQUE NOT NULL,
+			permissions TEXT[] NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS token_denylist (
+			kind VARCHAR NOT NULL,
+			value VARCHAR NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			revoked_by VARCHAR NOT NULL DEFAULT '',
+			revoked_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (kind, value)
+		)`,
 		`CREATE TABLE IF NOT EXISTS users (
 			id UUID PRIMARY KEY,
 			keycloak_id VARCHAR UNIQUE,
@@ -213,6 +251,12 @@ func (suite *IntegrationTestSuite) setupTestDatabase() {
 func (suite *IntegrationTestSuite) cleanupTestData() {
 	// Use DELETE FROM to completely clean tables, ignoring foreign key constraints
 	tables := []string{
+		"group_membership_history",
+		"group_template_roles",
+		"group_templates",
+		"domain_group_rules",
+		"personal_access_tokens",
+		"token_denylist",
 		"user_group_memberships",
 		"group_roles",
 		"role_permissions",
@@ -231,162 +275,59 @@ func (suite *IntegrationTestSuite) cleanupTestData() {
 }
 
 func (suite *IntegrationTestSuite) seedTestPermissions() {
-	permissions := []struct {
-		id       string
-		name     string
-		resource string
-		action   string
-	}{
-		{"550e8400-e29b-41d4-a716-446655440001", "create_user", "user", "create"},
-		{"550e8400-e29b-41d4-a716-446655440002", "read_user", "user", "read"},
-		{"550e8400-e29b-41d4-a716-446655440003", "update_user", "user", "update"},
-		{"550e8400-e29b-41d4-a716-446655440004", "delete_user", "user", "delete"},
-		{"550e8400-e29b-41d4-a716-446655440008", "create_role", "role", "create"},
-		{"550e8400-e29b-41d4-a716-446655440009", "read_role", "role", "read"},
-		{"550e8400-e29b-41d4-a716-446655440010", "update_role", "role", "update"},
-		{"550e8400-e29b-41d4-a716-446655440011", "delete_role", "role", "delete"},
-		{"550e8400-e29b-41d4-a716-446655440012", "create_group", "group", "create"},
-		{"550e8400-e29b-41d4-a716-446655440013", "read_group", "group", "read"},
-		{"550e8400-e29b-41d4-a716-446655440014", "update_group", "group", "update"},
-		{"550e8400-e29b-41d4-a716-446655440015", "delete_group", "group", "delete"},
-		{"550e8400-e29b-41d4-a716-446655440016", "manage_group_membership", "group_membership", "manage"},
-		{"550e8400-e29b-41d4-a716-446655440017", "manage_group_roles", "group_roles", "manage"},
-		{"550e8400-e29b-41d4-a716-446655440018", "read_permission", "permission", "read"},
-	}
-
-	for _, perm := range permissions {
-		_, err := suite.db.Exec(
-			`INSERT INTO permissions (id, name, resource, action) VALUES ($1, $2, $3, $4) ON CONFLICT (id) DO NOTHING`,
-			perm.id, perm.name, perm.resource, perm.action,
-		)
+	fx := fixtures.New(suite.db)
+	for _, name := range []perm.Name{
+		perm.CreateUser, perm.ReadUser, perm.UpdateUser, perm.DeleteUser,
+		perm.CreateRole, perm.ReadRole, perm.UpdateRole, perm.DeleteRole,
+		perm.CreateGroup, perm.ReadGroup, perm.UpdateGroup, perm.DeleteGroup,
+		perm.ManageGroupMembership, perm.ManageGroupRoles, perm.ReadPermission,
+	} {
+		_, err := fx.Permission(name)
 		suite.Require().NoError(err, "Failed to seed permission")
 	}
 }
 
 func (suite *IntegrationTestSuite) createTestData() {
-	// Create test users
-	testUsers := []struct {
-		id         string
-		keycloakId string
-		username   string
-		email      string
-		firstName  string
-		lastName   string
-	}{
-		{uuid.New().String(), "kc-user-1", "testuser1", "test1@example.com", "Test", "User1"},
-		{uuid.New().String(), "kc-user-2", "testuser2", "test2@example.com", "Test", "User2"},
-		{uuid.New().String(), "kc-admin", "admin", "admin@example.com", "Admin", "User"},
-	}
-
-	for _, user := range testUsers {
-		_, err := suite.db.Exec(
-			`INSERT INTO users (id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at)
-			 VALUES ($1, $2, $3, $4, $5, $6, true, NOW(), NOW())`,
-			user.id, user.keycloakId, user.username, user.email, user.firstName, user.lastName,
-		)
-		suite.Require().NoError(err, "Failed to create test user")
-		suite.testUsers[user.id] = user.username
-	}
-
-	// Create test roles
-	testRoles := []struct {
-		id          string
-		name        string
-		description string
-	}{
-		{uuid.New().String(), "admin", "Administrator role"},
-		{uuid.New().String(), "user", "Regular user role"},
-		{uuid.New().String(), "moderator", "Moderator role"},
-	}
-
-	var adminRoleID, userRoleID, moderatorRoleID string
-	for _, role := range testRoles {
-		_, err := suite.db.Exec(
-			`INSERT INTO roles (id, name, description, created_at) VALUES ($1, $2, $3, NOW())`,
-			role.id, role.name, role.description,
-		)
+	fx := fixtures.New(suite.db)
+
+	// Roles with their permissions
+	roles := []*fixtures.RoleBuilder{
+		fx.NewRole("admin").Description("Administrator role").WithPermissions(
+			perm.CreateUser, perm.ReadUser, perm.UpdateUser, perm.DeleteUser,
+			perm.CreateRole, perm.ReadRole, perm.UpdateRole, perm.DeleteRole,
+			perm.CreateGroup, perm.ReadGroup, perm.UpdateGroup, perm.DeleteGroup,
+			perm.ManageGroupMembership, perm.ManageGroupRoles, perm.ReadPermission),
+		fx.NewRole("user").Description("Regular user role").WithPermissions(perm.ReadUser),
+		fx.NewRole("moderator").Description("Moderator role").WithPermissions(perm.ReadUser, perm.UpdateUser, perm.ReadGroup),
+	}
+	for _, builder := range roles {
+		role, err := builder.Build()
 		suite.Require().NoError(err, "Failed to create test role")
-		suite.testRoles[role.id] = role.name
-		if role.name == "admin" {
-			adminRoleID = role.id
-		} else if role.name == "user" {
-			userRoleID = role.id
-		} else if role.name == "moderator" {
-			moderatorRoleID = role.id
-		}
+		suite.testRoles[role.ID] = role.Name
 	}
 
-	// Create test groups
-	testGroups := []struct {
-		id          string
-		name        string
-		description string
-	}{
-		{uuid.New().String(), "administrators", "Administrator group"},
-		{uuid.New().String(), "users", "Regular users group"},
+	// Groups with their roles
+	groups := []*fixtures.GroupBuilder{
+		fx.NewGroup("administrators").Description("Administrator group").WithRoles("admin"),
+		fx.NewGroup("users").Description("Regular users group").WithRoles("user"),
 	}
-
-	for _, group := range testGroups {
-		_, err := suite.db.Exec(
-			`INSERT INTO role_groups (id, name, description, created_at) VALUES ($1, $2, $3, NOW())`,
-			group.id, group.name, group.description,
-		)
+	for _, builder := range groups {
+		group, err := builder.Build()
 		suite.Require().NoError(err, "Failed to create test group")
-		suite.testGroups[group.id] = group.name
+		suite.testGroups[group.ID] = group.Name
 	}
 
-	// Assign roles to groups (simplified - direct inserts instead of using service methods)
-	var adminGroupID, userGroupID string
-	err := suite.db.QueryRow(`SELECT id FROM role_groups WHERE name = $1`, "administrators").Scan(&adminGroupID)
-	suite.Require().NoError(err, "Failed to get administrators group ID")
-
-	err = suite.db.QueryRow(`SELECT id FROM role_groups WHERE name = $1`, "users").Scan(&userGroupID)
-	suite.Require().NoError(err, "Failed to get users group ID")
-
-	_, err = suite.db.Exec(`INSERT INTO group_roles (group_id, role_id) VALUES ($1, $2)`, adminGroupID, adminRoleID)
-	suite.Require().NoError(err, "Failed to assign admin role to administrators group")
-
-	_, err = suite.db.Exec(`INSERT INTO group_roles (group_id, role_id) VALUES ($1, $2)`, userGroupID, userRoleID)
-	suite.Require().NoError(err, "Failed to assign user role to users group")
-
-	// Assign permissions to roles (simplified - direct inserts)
-	permAssignments := []struct {
-		roleID string
-		perm   string
-	}{
-		{adminRoleID, "create_user"}, {adminRoleID, "read_user"}, {adminRoleID, "update_user"}, {adminRoleID, "delete_user"},
-		{adminRoleID, "create_role"}, {adminRoleID, "read_role"}, {adminRoleID, "update_role"}, {adminRoleID, "delete_role"},
-		{adminRoleID, "create_group"}, {adminRoleID, "read_group"}, {adminRoleID, "update_group"}, {adminRoleID, "delete_group"},
-		{adminRoleID, "manage_group_membership"}, {adminRoleID, "manage_group_roles"}, {adminRoleID, "read_permission"},
-		{userRoleID, "read_user"},
-		{moderatorRoleID, "read_user"}, {moderatorRoleID, "update_user"}, {moderatorRoleID, "read_group"},
+	// Users in their groups
+	users := []*fixtures.UserBuilder{
+		fx.NewUser().Username("testuser1").KeycloakID("kc-user-1").Email("test1@example.com").Name("Test", "User1").InGroup("users"),
+		fx.NewUser().Username("testuser2").KeycloakID("kc-user-2").Email("test2@example.com").Name("Test", "User2").InGroup("users"),
+		fx.NewUser().Username("admin").KeycloakID("kc-admin").Email("admin@example.com").Name("Admin", "User").InGroup("administrators"),
 	}
-
-	for _, assignment := range permAssignments {
-		permID := suite.getPermissionIDByName(assignment.perm)
-		_, err := suite.db.Exec(`INSERT INTO role_permissions (role_id, permission_id) VALUES ($1, $2)`, assignment.roleID, permID)
-		suite.Require().NoError(err, "Failed to assign permission to role")
+	for _, builder := range users {
+		user, err := builder.Build()
+		suite.Require().NoError(err, "Failed to create test user")
+		suite.testUsers[user.ID] = user.Username
 	}
-
-	// Assign users to groups (simplified - direct inserts)
-	var adminUserID, testUser1ID, testUser2ID string
-	err = suite.db.QueryRow(`SELECT id FROM users WHERE username = $1`, "admin").Scan(&adminUserID)
-	suite.Require().NoError(err, "Failed to get admin user ID")
-
-	err = suite.db.QueryRow(`SELECT id FROM users WHERE username = $1`, "testuser1").Scan(&testUser1ID)
-	suite.Require().NoError(err, "Failed to get testuser1 ID")
-
-	err = suite.db.QueryRow(`SELECT id FROM users WHERE username = $1`, "testuser2").Scan(&testUser2ID)
-	suite.Require().NoError(err, "Failed to get testuser2 ID")
-
-	_, err = suite.db.Exec(`INSERT INTO user_group_memberships (user_id, group_id, assigned_at) VALUES ($1, $2, NOW())`, adminUserID, adminGroupID)
-	suite.Require().NoError(err, "Failed to assign admin to administrators group")
-
-	_, err = suite.db.Exec(`INSERT INTO user_group_memberships (user_id, group_id, assigned_at) VALUES ($1, $2, NOW())`, testUser1ID, userGroupID)
-	suite.Require().NoError(err, "Failed to assign testuser1 to users group")
-
-	_, err = suite.db.Exec(`INSERT INTO user_group_memberships (user_id, group_id, assigned_at) VALUES ($1, $2, NOW())`, testUser2ID, userGroupID)
-	suite.Require().NoError(err, "Failed to assign testuser2 to users group")
 }
 
 func (suite *IntegrationTestSuite) getUserIDByUsername(username string) string {
@@ -456,6 +397,8 @@ func (suite *IntegrationTestSuite) createAuthenticatedRequest(method, url, userI
 	return req
 }
 
+func TestMain(m *testing.M) { testsupport.Main(m) }
+
 func TestIntegrationSuite(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping integration tests in short mode")
@@ -528,7 +471,7 @@ func (suite *IntegrationTestSuite) TestCreateRoleGroup() {
 		Description: "Test group for integration testing",
 	}
 
-	group, err := suite.service.CreateRoleGroup(req)
+	group, err := suite.service.CreateRoleGroup(context.Background(), req)
 
 	assert.NoError(suite.T(), err)
 	assert.NotNil(suite.T(), group)
@@ -547,12 +490,13 @@ func (suite *IntegrationTestSuite) TestAssignUserToGroup() {
 		UserID: userID,
 	}
 
-	err := suite.service.AssignUserToGroup(groupID, req)
+	err := suite.service.AssignUserToGroup(context.Background(), groupID, req)
 
 	// This might fail if user is already in group, which is fine for integration test
 	if err != nil {
-		assert.IsType(suite.T(), &ValidationError{}, err)
-		assert.Contains(suite.T(), err.Error(), "already in group")
+		assert.True(suite.T(), apperrors.IsConflict(err), "unexpected error: %v", err)
+		appErr, _ := apperrors.As(err)
+		assert.Equal(suite.T(), "ALREADY_GROUP_MEMBER", appErr.Code)
 	} else {
 		assert.NoError(suite.T(), err)
 	}
@@ -572,7 +516,7 @@ func (suite *IntegrationTestSuite) TestGetUserPermissions() {
 	// Create a test role
 	testRoleID := uuid.New().String()
 	_, err = suite.db.Exec(
-		`INSERT INTO roles (id, name, description, created_at) VALUES ($1, $2, $3, NOW())`,
+		`INSERT INTO roles (id, key, name, description, created_at) VALUES ($1, $2, $2, $3, NOW())`,
 		testRoleID, "test_permissions_role", "Test role for permissions",
 	)
 	suite.Require().NoError(err)
@@ -735,7 +679,7 @@ func (suite *IntegrationTestSuite) TestWithAuth_SuccessfulPermissionCheck() {
 	// Create a test role
 	testRoleID := uuid.New().String()
 	_, err = suite.db.Exec(
-		`INSERT INTO roles (id, name, description, created_at) VALUES ($1, $2, $3, NOW())`,
+		`INSERT INTO roles (id, key, name, description, created_at) VALUES ($1, $2, $2, $3, NOW())`,
 		testRoleID, "test_auth_role", "Test role for auth",
 	)
 	suite.Require().NoError(err)
@@ -877,13 +821,13 @@ func (suite *IntegrationTestSuite) TestRoleCRUDOperations() {
 		Name:        roleName + "_updated",
 		Description: "Updated CRUD test role",
 	}
-	updatedRole, err := suite.service.UpdateRole(role.ID, updateReq)
+	updatedRole, err := suite.service.UpdateRole(context.Background(), role.ID, updateReq)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), roleName+"_updated", updatedRole.Name)
 	assert.Equal(suite.T(), "Updated CRUD test role", updatedRole.Description)
 
 	// Delete
-	err = suite.service.DeleteRole(role.ID)
+	err = suite.service.DeleteRole(context.Background(), role.ID)
 	assert.NoError(suite.T(), err)
 
 	// Verify deletion
@@ -900,7 +844,7 @@ func (suite *IntegrationTestSuite) TestRoleGroupCRUDOperations() {
 		Name:        groupName,
 		Description: "CRUD test group",
 	}
-	group, err := suite.service.CreateRoleGroup(createReq)
+	group, err := suite.service.CreateRoleGroup(context.Background(), createReq)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), groupName, group.Name)
 
@@ -914,13 +858,13 @@ func (suite *IntegrationTestSuite) TestRoleGroupCRUDOperations() {
 		Name:        groupName + "_updated",
 		Description: "Updated CRUD test group",
 	}
-	updatedGroup, err := suite.service.UpdateRoleGroup(group.ID, updateReq)
+	updatedGroup, err := suite.service.UpdateRoleGroup(context.Background(), group.ID, updateReq)
 	assert.NoError(suite.T(), err)
 	assert.Equal(suite.T(), groupName+"_updated", updatedGroup.Name)
 	assert.Equal(suite.T(), "Updated CRUD test group", updatedGroup.Description)
 
 	// Delete
-	err = suite.service.DeleteRoleGroup(group.ID)
+	err = suite.service.DeleteRoleGroup(context.Background(), group.ID)
 	assert.NoError(suite.T(), err)
 
 	// Verify deletion
@@ -950,7 +894,7 @@ func (suite *IntegrationTestSuite) TestUserGroupMembership() {
 
 	// Assign user to group
 	req := AssignUserToGroupRequest{UserID: testUserID}
-	err = suite.service.AssignUserToGroup(testGroupID, req)
+	err = suite.service.AssignUserToGroup(context.Background(), testGroupID, req)
 	assert.NoError(suite.T(), err)
 
 	// Check user groups
@@ -965,9 +909,19 @@ func (suite *IntegrationTestSuite) TestUserGroupMembership() {
 	assert.Contains(suite.T(), userIDs, testUserID)
 
 	// Remove user from group
-	err = suite.service.RemoveUserFromGroup(testGroupID, testUserID)
+	err = suite.service.RemoveUserFromGroup(context.Background(), testGroupID, testUserID)
 	assert.NoError(suite.T(), err)
 
+	// Both changes are in the history, newest first
+	history, total, err := suite.service.UserMembershipHistory(testUserID, httpapi.Page{Limit: 10})
+	assert.NoError(suite.T(), err)
+	assert.Equal(suite.T(), 2, total)
+	if assert.Len(suite.T(), history, 2) {
+		assert.Equal(suite.T(), MembershipRemoved, history[0].Action)
+		assert.Equal(suite.T(), MembershipAdded, history[1].Action)
+		assert.Equal(suite.T(), "test_membership_group", history[1].GroupName)
+	}
+
 	// Verify removal
 	groups, err = suite.service.GetUserGroups(testUserID)
 	assert.NoError(suite.T(), err)
@@ -978,8 +932,8 @@ func (suite *IntegrationTestSuite) TestRolePermissionAssignment() {
 	// Create a test role
 	testRoleID := uuid.New().String()
 	_, err := suite.db.Exec(
-		`INSERT INTO roles (id, name, description, created_at)
-		 VALUES ($1, $2, $3, NOW())`,
+		`INSERT INTO roles (id, key, name, description, created_at)
+		 VALUES ($1, $2, $2, $3, NOW())`,
 		testRoleID, "test_permission_role", "Test role for permissions",
 	)
 	suite.Require().NoError(err)
@@ -991,7 +945,7 @@ func (suite *IntegrationTestSuite) TestRolePermissionAssignment() {
 			suite.getPermissionIDByName("create_role"),
 		},
 	}
-	err = suite.service.AssignPermissionsToRole(testRoleID, req)
+	err = suite.service.AssignPermissionsToRole(context.Background(), testRoleID, req)
 	assert.NoError(suite.T(), err)
 
 	// Check role permissions
@@ -1007,19 +961,47 @@ func (suite *IntegrationTestSuite) TestRolePermissionAssignment() {
 	assert.Contains(suite.T(), permissionNames, "create_role")
 }
 
+func (suite *IntegrationTestSuite) TestAssignPermissionsToRole_ReportsAllMissingIDs() {
+	roleID := suite.getRoleIDByName("user")
+	missing1 := uuid.New().String()
+	missing2 := uuid.New().String()
+
+	req := AssignPermissionsToRoleRequest{
+		PermissionIDs: []string{suite.getPermissionIDByName("read_role"), missing1, missing2},
+	}
+	err := suite.service.AssignPermissionsToRole(context.Background(), roleID, req)
+
+	assert.Error(suite.T(), err)
+	assert.IsType(suite.T(), &ValidationError{}, err)
+	assert.Contains(suite.T(), err.Error(), missing1)
+	assert.Contains(suite.T(), err.Error(), missing2)
+}
+
+func (suite *IntegrationTestSuite) TestSelfTest() {
+	report := suite.service.SelfTest(context.Background(), suite.getUserIDByUsername("admin"))
+
+	suite.Require().True(report.OK, "steps: %+v", report.Steps)
+	assert.Len(suite.T(), report.Steps, 10)
+
+	var leftovers int
+	err := suite.db.QueryRow(`SELECT COUNT(*) FROM roles WHERE name LIKE 'selftest-%'`).Scan(&leftovers)
+	suite.Require().NoError(err)
+	assert.Zero(suite.T(), leftovers)
+}
+
 func (suite *IntegrationTestSuite) TestGroupRoleAssignment() {
 	// Create test roles for this test
 	testRole1ID := uuid.New().String()
 	testRole2ID := uuid.New().String()
 	_, err := suite.db.Exec(
-		`INSERT INTO roles (id, name, description, created_at)
-		 VALUES ($1, $2, $3, NOW())`,
+		`INSERT INTO roles (id, key, name, description, created_at)
+		 VALUES ($1, $2, $2, $3, NOW())`,
 		testRole1ID, "test_role_1", "Test role 1",
 	)
 	suite.Require().NoError(err)
 	_, err = suite.db.Exec(
-		`INSERT INTO roles (id, name, description, created_at)
-		 VALUES ($1, $2, $3, NOW())`,
+		`INSERT INTO roles (id, key, name, description, created_at)
+		 VALUES ($1, $2, $2, $3, NOW())`,
 		testRole2ID, "test_role_2", "Test role 2",
 	)
 	suite.Require().NoError(err)
@@ -1037,7 +1019,7 @@ func (suite *IntegrationTestSuite) TestGroupRoleAssignment() {
 	req := AssignRolesToGroupRequest{
 		RoleIDs: []string{testRole1ID, testRole2ID},
 	}
-	err = suite.service.AssignRolesToGroup(testGroupID, req)
+	err = suite.service.AssignRolesToGroup(context.Background(), testGroupID, req)
 	assert.NoError(suite.T(), err)
 
 	// Check group roles
@@ -1052,3 +1034,1932 @@ func (suite *IntegrationTestSuite) TestGroupRoleAssignment() {
 	assert.Contains(suite.T(), roleNames, "test_role_1")
 	assert.Contains(suite.T(), roleNames, "test_role_2")
 }
+
+func TestValidationErrorDetails(t *testing.T) {
+	err := validate.Struct(CreateRoleRequest{Name: "1-invalid"})
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	assert.True(t, ok)
+
+	details := validationErrorDetails(fieldErrs)
+	assert.Contains(t, details["name"], "must start with a letter")
+
+	err = validate.Struct(AssignPermissionsToRoleRequest{PermissionIDs: []string{uuid.New().String(), "not-a-uuid"}})
+	fieldErrs, ok = err.(validator.ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, "must contain only valid UUIDs", validationErrorDetails(fieldErrs)["permission_ids"])
+
+	err = validate.Struct(AssignRolesToGroupRequest{})
+	fieldErrs, ok = err.(validator.ValidationErrors)
+	assert.True(t, ok)
+	assert.Equal(t, "is required", validationErrorDetails(fieldErrs)["role_ids"])
+
+	assert.NoError(t, validate.Struct(CreateRoleRequest{Name: "Report Viewer"}))
+}
+
+func TestWriteValidationError(t *testing.T) {
+	w := httptest.NewRecorder()
+	handled := writeValidationError(w, validate.Struct(AssignUserToGroupRequest{UserID: "user-1"}))
+
+	assert.True(t, handled)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "VALIDATION_ERROR")
+	assert.Contains(t, w.Body.String(), "must be a valid UUID")
+
+	w = httptest.NewRecorder()
+	assert.False(t, writeValidationError(w, fmt.Errorf("database unavailable")))
+}
+
+func TestFindMissingIDs(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	present := uuid.New().String()
+	missing := uuid.New().String()
+	mock.ExpectQuery(`SELECT id FROM roles WHERE id = ANY`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(present))
+
+	result, err := NewRoleRepository(db).FindMissingIDs([]string{present, missing, missing})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{missing}, result)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateRole_ConcurrentDuplicateIsValidationError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The pre-check sees no role, but a concurrent insert wins the race
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(`INSERT INTO roles`).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "roles_name_key"})
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	_, err = service.CreateRole(context.Background(), CreateRoleRequest{Name: "editor"})
+
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "name", validationErr.Field)
+	assert.Equal(t, "already exists", validationErr.Message)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSelfTest_SkipsScenarioAfterFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(`INSERT INTO roles`).
+		WillReturnError(errors.New("connection refused"))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	report := service.SelfTest(context.Background(), "user-1")
+
+	assert.False(t, report.OK)
+	require.Len(t, report.Steps, 6, "nothing was created, so there is nothing to clean up")
+	assert.Equal(t, StepCreateRole, report.Steps[0].Name)
+	assert.False(t, report.Steps[0].OK)
+	assert.Contains(t, report.Steps[0].Error, "connection refused")
+	for _, step := range report.Steps[1:] {
+		assert.True(t, step.Skipped, step.Name)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateRoleHandler_QuotaExceeded(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).
+		WillReturnError(sql.ErrNoRows)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	quotas := quota.NewEnforcer()
+	quotas.Register(quota.Roles, 2, func(context.Context) (int, error) { return 2, nil })
+	service.SetQuotaChecker(quotas)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/rbac/roles", strings.NewReader(`{"name":"editor"}`))
+	w := httptest.NewRecorder()
+	CreateRoleHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	var resp ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "QUOTA_EXCEEDED", resp.Code)
+	assert.NoError(t, mock.ExpectationsWereMet(), "no role may be inserted")
+}
+
+func TestAssignRolesToGroupHandler_ListTooLarge(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{}, logger)
+	service.SetMaxListItems(2)
+
+	body, _ := json.Marshal(AssignRolesToGroupRequest{RoleIDs: []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}})
+	req := httptest.NewRequest(http.MethodPost, "/api/rbac/groups/"+uuid.New().String()+"/roles", strings.NewReader(string(body)))
+	req = mux.SetURLVars(req, map[string]string{"id": uuid.New().String()})
+	w := httptest.NewRecorder()
+	AssignRolesToGroupHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	var resp ErrorResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "LIST_TOO_LARGE", resp.Code)
+	assert.Equal(t, "role_ids has 3 items; at most 2 are accepted per request", resp.Error)
+}
+
+func TestAssignRolesToGroupInChunks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	roleIDs := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	mock.ExpectQuery(`SELECT id FROM roles WHERE id = ANY`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(roleIDs[0]).AddRow(roleIDs[1]))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO group_roles`).WithArgs("group-1", roleIDs[0]).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO group_roles`).WithArgs("group-1", roleIDs[1]).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT id FROM roles WHERE id = ANY`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	service.SetMaxListItems(2)
+
+	assigned, err := service.assignRolesToGroupInChunks(context.Background(), "group-1", roleIDs)
+
+	assert.Equal(t, 2, assigned, "the first chunk stays assigned")
+	var validationErr *ValidationError
+	require.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "roles not found: "+roleIDs[2], validationErr.Message)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAssignUserToGroup_ExpiryMustBeInFuture(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{}, logger)
+
+	past := time.Now().Add(-time.Hour)
+	err := service.AssignUserToGroup(context.Background(), uuid.New().String(), AssignUserToGroupRequest{UserID: uuid.New().String(), ExpiresAt: &past})
+
+	var validationErr *ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Equal(t, "expires_at", validationErr.Field)
+}
+
+func TestRemoveUserFromGroupHandler_NotMemberIsNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_group_memberships`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/rbac/groups/g1/users/u1", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": "g1", "userId": "u1"})
+	w := httptest.NewRecorder()
+	RemoveUserFromGroupHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "MEMBERSHIP_NOT_FOUND")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteRole_RunsInSingleTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID := uuid.New().String()
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+			AddRow(roleID, "editor", "", time.Now(), "editor"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT id FROM roles WHERE id = \$1 FOR UPDATE`).WithArgs(roleID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`GROUP BY GROUPING SETS`).WithArgs(roleID).
+		WillReturnRows(sqlmock.NewRows([]string{"total", "id", "name", "count"}).AddRow(true, "", "", 0))
+	mock.ExpectExec(`DELETE FROM role_permissions WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM group_roles WHERE role_id`).WillReturnError(fmt.Errorf("connection reset"))
+	mock.ExpectRollback()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	err = service.DeleteRole(context.Background(), roleID)
+
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteRole_TransactionRunsUnderTheRequestsStatementBudget(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID := uuid.New().String()
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+			AddRow(roleID, "editor", "", time.Now(), "editor"))
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET LOCAL statement_timeout = 3000`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`SELECT id FROM roles WHERE id = \$1 FOR UPDATE`).WithArgs(roleID).
+		WillReturnError(errors.New("canceling statement due to statement timeout"))
+	mock.ExpectRollback()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	err = service.DeleteRole(database.WithStatementTimeout(context.Background(), 3*time.Second), roleID)
+
+	assert.Error(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteRoleDryRunReportsLostAccessAndRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID := uuid.New().String()
+	createdAt := time.Now()
+	permissionColumns := []string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}
+	userGroups := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "description", "created_at"}).AddRow("g1", "editors", "", createdAt)
+	}
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+			AddRow(roleID, "editor", "", createdAt, "editor"))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT group_id FROM group_roles WHERE role_id`).WithArgs(roleID).
+		WillReturnRows(sqlmock.NewRows([]string{"group_id"}).AddRow("g1"))
+	mock.ExpectQuery(`SELECT user_id FROM user_group_memberships WHERE group_id`).WithArgs("g1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow("user-1"))
+	mock.ExpectQuery(`SELECT g.id, g.name, g.description, g.created_at`).WithArgs("user-1").WillReturnRows(userGroups())
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows(permissionColumns).
+		AddRow("p1", "Read roles", "role", "read", roleID, "editor", "", createdAt, "g1", "editors", "", createdAt, "read_role", "editor"))
+	mock.ExpectExec(`DELETE FROM role_permissions WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM group_roles WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM roles WHERE id`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT g.id, g.name, g.description, g.created_at`).WithArgs("user-1").WillReturnRows(userGroups())
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows(permissionColumns))
+	mock.ExpectRollback()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	req := httptest.NewRequest(http.MethodDelete, "/api/rbac/roles/"+roleID+"?dry_run=true", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": roleID})
+	w := httptest.NewRecorder()
+	DeleteRoleHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var impact Impact
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &impact))
+	assert.True(t, impact.DryRun)
+	assert.Empty(t, impact.MembershipsCleared)
+	assert.Equal(t, []UserImpact{{UserID: "user-1", LostRoles: []string{"editor"}, LostPermissions: []string{"read_role"}}}, impact.Users)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// auditEntries is an audit store keeping entries in memory
+type auditEntries struct {
+	entries []*audit.Entry
+}
+
+func (s *auditEntries) Create(entry *audit.Entry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *auditEntries) List(audit.Filter, int, int) ([]*audit.Entry, int, error) {
+	return s.entries, len(s.entries), nil
+}
+
+func TestDeleteRoleInUseIsRefusedUnlessForced(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID := uuid.New().String()
+	expectUsage := func() {
+		mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+				AddRow(roleID, "editor", "", time.Now(), "editor"))
+		// The role is locked and its usage read in one aggregate query, inside the deleting transaction
+		mock.ExpectBegin()
+		mock.ExpectExec(`SELECT id FROM roles WHERE id = \$1 FOR UPDATE`).WithArgs(roleID).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`GROUP BY GROUPING SETS`).WithArgs(roleID).
+			WillReturnRows(sqlmock.NewRows([]string{"total", "id", "name", "count"}).
+				AddRow(false, "g1", "editors", 2).
+				AddRow(false, "g2", "writers", 1).
+				AddRow(true, "", "", 2))
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	service.SetConfirmRoleDeletion(true)
+	entries := &auditEntries{}
+	service.SetAuditLog(audit.NewLog(entries, logger))
+	deleteRole := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/rbac/roles/"+roleID+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": roleID})
+		w := httptest.NewRecorder()
+		DeleteRoleHandler(service)(w, req)
+		return w
+	}
+
+	expectUsage()
+	mock.ExpectRollback()
+	w := deleteRole("")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var refused struct {
+		Code string `json:"code"`
+		RoleUsage
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &refused))
+	assert.Equal(t, "ROLE_IN_USE", refused.Code)
+	assert.Equal(t, []GroupUsage{{GroupID: "g1", GroupName: "editors", UserCount: 2}, {GroupID: "g2", GroupName: "writers", UserCount: 1}}, refused.Groups)
+	assert.Equal(t, 2, refused.UserCount, "users in several groups count once")
+	if assert.Len(t, entries.entries, 1, "the refusal is audited") {
+		assert.Equal(t, audit.ActionDeleteRefused, entries.entries[0].Action)
+		assert.Equal(t, roleID, entries.entries[0].ResourceID)
+		assert.Contains(t, string(entries.entries[0].Before), `"group_name":"editors"`)
+	}
+
+	expectUsage()
+	mock.ExpectExec(`DELETE FROM role_permissions WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM group_roles WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM roles WHERE id`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	w = deleteRole("?force=true")
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+	if assert.Len(t, entries.entries, 2) {
+		assert.Equal(t, audit.ActionDelete, entries.entries[1].Action)
+		assert.Contains(t, string(entries.entries[1].Before), `"user_count":2`)
+	}
+}
+
+func TestRepositoryReadsBeforeWritesAndResolutionUsePrimary(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer primary.Close()
+	replica, replicaMock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer replica.Close()
+	repos := NewRBACRepositoryWithReader(primary, replica)
+
+	primaryMock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}))
+	primaryMock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_group_memberships`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	primaryMock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	replicaMock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles ORDER BY name`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}))
+
+	_, err = repos.RoleRepo.GetByID("role-1")
+	assert.NoError(t, err)
+	_, err = repos.MembershipRepo.IsUserInGroup("user-1", "group-1")
+	assert.NoError(t, err)
+	_, err = repos.UserPermRepo.GetUserPermissions("user-1")
+	assert.NoError(t, err)
+	_, err = repos.RoleRepo.List()
+	assert.NoError(t, err)
+
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestRoleList_SurfacesIterationError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles ORDER BY name`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+			AddRow(uuid.New().String(), "admin", "", time.Now(), "admin").
+			AddRow(uuid.New().String(), "editor", "", time.Now(), "editor").
+			RowError(1, fmt.Errorf("connection reset by peer")))
+
+	roles, err := NewRoleRepository(db).List()
+
+	assert.Nil(t, roles)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "list roles")
+}
+
+func TestGetRolesHandlerPaginates(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID := uuid.New().String()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM roles`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles ORDER BY name LIMIT \$1 OFFSET \$2`).
+		WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).
+			AddRow(roleID, "editor", "", time.Now(), "editor"))
+
+	service := NewRBACService(NewRBACRepository(db), logrus.New())
+	req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles?limit=1&offset=1", nil)
+	w := httptest.NewRecorder()
+	GetRolesHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Data []struct {
+			ID    string            `json:"id"`
+			Links map[string]string `json:"links"`
+		} `json:"data"`
+		Meta  map[string]int    `json:"meta"`
+		Links map[string]string `json:"links"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Data, 1) {
+		assert.Equal(t, "/api/rbac/roles/"+roleID, resp.Data[0].Links["self"])
+	}
+	assert.Equal(t, map[string]int{"total": 3, "limit": 1, "offset": 1}, resp.Meta)
+	assert.Equal(t, "/api/rbac/roles?limit=1&offset=2", resp.Links["next"])
+	assert.Equal(t, "/api/rbac/roles?limit=1&offset=0", resp.Links["prev"])
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	w = httptest.NewRecorder()
+	GetRolesHandler(service)(w, httptest.NewRequest(http.MethodGet, "/api/rbac/roles?limit=1000", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGetPermissionCatalogHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	columns := []string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery(`SELECT id, name, resource, action, category, description, risk_level, key FROM permissions ORDER BY resource, action`).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow("p1", "read_role", "role", "read", "Access control", "View roles", RiskLow, "read_role").
+				AddRow("p2", "delete_user", "user", "delete", "User management", "Delete users", RiskHigh, "delete_user").
+				AddRow("p3", "create_role", "role", "create", "Access control", "Create roles", RiskMedium, "create_role"))
+		mock.ExpectQuery(`SELECT rp.permission_id, r.id, r.name FROM role_permissions rp JOIN roles r`).
+			WillReturnRows(sqlmock.NewRows([]string{"permission_id", "id", "name"}).
+				AddRow("p1", "r1", "auditor").
+				AddRow("p1", "r2", "editor"))
+	}
+
+	service := NewRBACService(NewRBACRepository(db), logrus.New())
+	get := func(query string) ([]CatalogGroup, int) {
+		w := httptest.NewRecorder()
+		GetPermissionCatalogHandler(service)(w, httptest.NewRequest(http.MethodGet, "/api/rbac/permissions/catalog"+query, nil))
+		var resp struct {
+			Groups []CatalogGroup `json:"groups"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Groups, w.Code
+	}
+
+	groups, status := get("")
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "role", groups[0].Key)
+		assert.Equal(t, "create_role", groups[0].Permissions[0].Name)
+		assert.Empty(t, groups[0].Permissions[0].Roles)
+		assert.Equal(t, []RoleRef{{ID: "r1", Name: "auditor"}, {ID: "r2", Name: "editor"}}, groups[0].Permissions[1].Roles)
+		assert.Equal(t, RiskHigh, groups[1].Permissions[0].RiskLevel)
+	}
+
+	groups, status = get("?group_by=category")
+	assert.Equal(t, http.StatusOK, status)
+	if assert.Len(t, groups, 2) {
+		assert.Equal(t, "Access control", groups[0].Key)
+		assert.Equal(t, "User management", groups[1].Key)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, status = get("?group_by=action")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRegisterPermissions(t *testing.T) {
+	RegisterPermissions(Permission{Name: "test_export_reports", Resource: "test_reports", Action: "export"})
+
+	var registered *Permission
+	for _, p := range RegisteredPermissions() {
+		if p.Name == "test_export_reports" {
+			p := p
+			registered = &p
+		}
+	}
+	if assert.NotNil(t, registered) {
+		assert.Equal(t, uuid.NewSHA1(permissionNamespace, []byte("test_export_reports")).String(), registered.ID)
+		assert.Equal(t, "General", registered.Category)
+		assert.Equal(t, RiskLow, registered.RiskLevel)
+	}
+
+	// Registering the same definition again is harmless; changing it is a programming error
+	assert.NotPanics(t, func() {
+		RegisterPermissions(Permission{Name: "test_export_reports", Resource: "test_reports", Action: "export"})
+	})
+	assert.Panics(t, func() {
+		RegisterPermissions(Permission{Name: "test_export_reports", Resource: "test_reports", Action: "download"})
+	})
+	assert.Panics(t, func() { RegisterPermissions(Permission{Name: "test_no_resource", Action: "read"}) })
+	assert.Panics(t, func() {
+		RegisterPermissions(Permission{Name: "test_risky", Resource: "test", Action: "read", RiskLevel: "extreme"})
+	})
+}
+
+func TestSyncPermissionsUpsertsRegistry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	registered := RegisteredPermissions()
+	mock.ExpectBegin()
+	for _, p := range registered {
+		mock.ExpectExec(`INSERT INTO permissions .* ON CONFLICT \(key\) DO UPDATE`).
+			WithArgs(p.ID, p.Name, p.Resource, p.Action, p.Category, p.Description, p.RiskLevel, p.Key).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+	mock.ExpectQuery(`SELECT id, name, resource, action, category, description, risk_level, key FROM permissions`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}).
+			AddRow(uuid.New().String(), "legacy_permission", "legacy", "read", "General", "", RiskLow, "legacy_permission"))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	assert.NoError(t, service.SyncPermissions())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetJWTSecretOverridesEnvironment(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "env-secret")
+	service := NewRBACService(&RBACRepository{}, logrus.New())
+	assert.Equal(t, "env-secret", service.signingSecret())
+
+	service.SetJWTSecret("rotated-secret")
+	assert.Equal(t, "rotated-secret", service.signingSecret())
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	limiter := NewRateLimiter(1, time.Minute)
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"))
+
+	limiter.SetLimit(3, time.Minute)
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.True(t, limiter.Allow("10.0.0.1"))
+	assert.False(t, limiter.Allow("10.0.0.1"))
+}
+
+func TestRateLimitClient(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "rate-limit-secret")
+	service := NewRBACService(&RBACRepository{}, logrus.New())
+
+	sign := func(username string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			UserID:           "user-1",
+			Username:         username,
+			Tenant:           "acme",
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+		})
+		signed, err := token.SignedString([]byte("rate-limit-secret"))
+		assert.NoError(t, err)
+		return signed
+	}
+	clientFor := func(authorization string) ratelimit.Client {
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return service.RateLimitClient(req)
+	}
+
+	assert.Equal(t, ratelimit.Client{IP: "203.0.113.9", Tier: TierAnonymous}, clientFor(""))
+	assert.Equal(t, ratelimit.Client{IP: "203.0.113.9", Tier: TierAnonymous}, clientFor("Bearer not-a-jwt"))
+	assert.Equal(t, ratelimit.Client{IP: "203.0.113.9", UserID: "user-1", Tenant: "acme", Tier: TierUser}, clientFor("Bearer "+sign("alice")))
+	assert.Equal(t, TierService, clientFor("Bearer "+sign("service-account-reporting")).Tier)
+}
+
+func TestWithAuthReportsFailures(t *testing.T) {
+	service := NewRBACService(&RBACRepository{}, logrus.New())
+	var failures []authevents.Failure
+	service.OnAuthFailure(func(_ context.Context, failure authevents.Failure) {
+		failures = append(failures, failure)
+	})
+
+	handler := withAuth("read_role", service, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	w := httptest.NewRecorder()
+	handler(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	if !assert.Len(t, failures, 1) {
+		return
+	}
+	assert.Equal(t, authevents.KindInvalidToken, failures[0].Kind)
+	assert.Equal(t, "INVALID_TOKEN", failures[0].Code)
+	assert.Equal(t, "203.0.113.7", failures[0].IP)
+}
+
+func TestAuthMiddlewareEnforcesRoutePermissions(t *testing.T) {
+	service := NewRBACService(&RBACRepository{}, logrus.New())
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	r := mux.NewRouter()
+	protected := service.Protect(r.HandleFunc("/protected", ok).Methods("GET"), perm.ReadRole)
+	public := r.HandleFunc("/public", ok).Methods("GET")
+	r.Use(service.AuthMiddleware())
+
+	permission, found := service.RoutePermission(protected)
+	assert.True(t, found)
+	assert.Equal(t, perm.ReadRole, permission)
+	_, found = service.RoutePermission(public)
+	assert.False(t, found)
+
+	serve := func(router *mux.Router, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	assert.Equal(t, http.StatusUnauthorized, serve(r, "/protected").Code)
+	assert.Equal(t, http.StatusOK, serve(r, "/public").Code)
+
+	// Without the middleware a protected route fails closed
+	bare := mux.NewRouter()
+	service.Protect(bare.HandleFunc("/protected", ok).Methods("GET"), perm.ReadRole)
+	w := serve(bare, "/protected")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), "AUTH_NOT_CONFIGURED")
+}
+
+func TestOptionalAuthServesAnonymousRequests(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "optional-auth-secret")
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	handler := service.OptionalAuth()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(UserIDFromContext(r.Context())))
+	}))
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/settings/maintenance", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		UserID:           "user-1",
+		Username:         "alice",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	signed, err := token.SignedString([]byte("optional-auth-secret"))
+	assert.NoError(t, err)
+
+	for _, authorization := range []string{"", "Bearer not-a-jwt"} {
+		w := serve(authorization)
+		assert.Equal(t, http.StatusOK, w.Code, authorization)
+		assert.Empty(t, w.Body.String(), authorization)
+	}
+	w := serve("Bearer " + signed)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user-1", w.Body.String())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRegisterSchemasMirrorsCustomRules(t *testing.T) {
+	reg := jsonschema.NewRegistry()
+	RegisterSchemas(reg)
+
+	roleSchema, ok := reg.Lookup("POST", "/api/rbac/roles")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Empty(t, roleSchema.ValidateJSON([]byte(`{"name":"editor"}`)))
+	assert.Equal(t, map[string]string{"name": "has an invalid format"}, jsonschema.Details(roleSchema.ValidateJSON([]byte(`{"name":"9lives"}`))))
+
+	rolesSchema, ok := reg.Lookup("POST", "/api/rbac/groups/{id}/roles")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, map[string]string{"role_ids[0]": "must be a valid UUID"}, jsonschema.Details(rolesSchema.ValidateJSON([]byte(`{"role_ids":["nope"]}`))))
+}
+
+func TestMyAccessHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT g.id, g.name, g.description, g.created_at`).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}).
+			AddRow("g1", "editors", "", createdAt).
+			AddRow("g2", "newsletter", "", createdAt))
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}).
+		AddRow("p2", "update_role", "role", "update", "r1", "editor", "", createdAt, "g1", "editors", "", createdAt, "update_role", "editor").
+		AddRow("p1", "read_role", "role", "read", "r1", "editor", "", createdAt, "g1", "editors", "", createdAt, "read_role", "editor"))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me/access", nil)
+	ctx := context.WithValue(req.Context(), UserIDKey, "user-1")
+	ctx = context.WithValue(ctx, UsernameKey, "alice")
+	w := httptest.NewRecorder()
+	MyAccessHandler(service)(w, req.WithContext(ctx))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var access MyAccess
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &access))
+	assert.Equal(t, "alice", access.Username)
+	assert.Len(t, access.Groups, 2, "groups granting no permissions are listed too")
+	assert.Len(t, access.Roles, 1)
+	assert.Equal(t, []string{"read_role", "update_role"}, access.Permissions)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAssignUserToGroupRecordsHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	groupID, userID := uuid.New().String(), uuid.New().String()
+	mock.ExpectQuery(`SELECT id, name, description, created_at FROM role_groups WHERE id`).WithArgs(groupID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}).AddRow(groupID, "contractors", "", time.Now()))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_group_memberships`).WithArgs(userID, groupID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO user_group_memberships`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO group_membership_history`).
+		WithArgs(groupID, userID, MembershipAdded, "admin-1", nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	ctx := context.WithValue(context.Background(), UserIDKey, "admin-1")
+	assert.NoError(t, service.AssignUserToGroup(ctx, groupID, AssignUserToGroupRequest{UserID: userID}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAccessTrackingRecordsAuthorizedChecks(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "access-tracking-secret")
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}).AddRow("p1", "read_role", "role", "read", "r1", "viewer", "", createdAt, "g1", "staff", "", createdAt, "read_role", "viewer"))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		UserID:           "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	signed, err := token.SignedString([]byte("access-tracking-secret"))
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	w := httptest.NewRecorder()
+	withAuth(perm.ReadRole, service, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// A failed flush keeps the uses for the next one
+	mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+	assert.Error(t, service.FlushAccessUsage())
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO permission_usage`).WithArgs("read_role", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO role_usage`).WithArgs("r1", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, service.FlushAccessUsage())
+	assert.NoError(t, service.FlushAccessUsage(), "nothing left to save")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDecisionLoggingExplainsDenials(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "decision-log-secret")
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+			"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+			"key", "key",
+		}).AddRow("p1", "read_role", "role", "read", "r1", "viewer", "", createdAt, "g1", "staff", "", createdAt, "read_role", "viewer"))
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	enabled := false
+	service.SetDecisionLogging(func() bool { return enabled }, logger)
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		UserID:           "user-1",
+		Username:         "alice",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	signed, err := token.SignedString([]byte("decision-log-secret"))
+	assert.NoError(t, err)
+	check := func(permission perm.Name, authorization string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+		req.Header.Set("Authorization", authorization)
+		withAuth(permission, service, func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), req)
+	}
+
+	check(perm.ReadRole, "Bearer "+signed)
+	assert.Empty(t, service.ListDecisions(DecisionFilter{}), "nothing is recorded while logging is off")
+
+	enabled = true
+	check(perm.ReadRole, "Bearer "+signed)
+	check(perm.DeleteRole, "Bearer "+signed)
+	check(perm.ReadRole, "Bearer not-a-token")
+
+	decisions := service.ListDecisions(DecisionFilter{UserID: "user-1"})
+	if assert.Len(t, decisions, 2) {
+		assert.False(t, decisions[0].Allowed, "newest first")
+		assert.Equal(t, "INSUFFICIENT_PERMISSIONS", decisions[0].Code)
+		assert.Equal(t, "delete_role", decisions[0].Permission)
+		assert.True(t, decisions[1].Allowed)
+		assert.Equal(t, []string{"viewer"}, decisions[1].GrantedBy)
+	}
+	assert.Len(t, service.ListDecisions(DecisionFilter{Outcome: "denied"}), 2, "invalid tokens are recorded too")
+
+	w := httptest.NewRecorder()
+	GetDecisionsHandler(service)(w, httptest.NewRequest(http.MethodGet, "/api/rbac/decisions?outcome=maybe", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetDormancyReportHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	lastUsed := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`FROM roles r\s+LEFT JOIN role_usage`).WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "last_used_at", "count"}).
+			AddRow("r1", "legacy_admin", nil, 2).
+			AddRow("r2", "auditor", lastUsed, 1))
+	mock.ExpectQuery(`FROM permissions p\s+JOIN role_permissions`).WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "last_checked_at", "count"}).AddRow("p1", "delete_group", nil, 1))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	handler := GetDormancyReportHandler(NewRBACService(NewRBACRepository(db), logger))
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/api/rbac/reports/dormancy?days=30", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report DormancyReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 30, report.Days)
+	if assert.Len(t, report.DormantRoles, 2) {
+		assert.Nil(t, report.DormantRoles[0].LastUsedAt)
+		assert.Equal(t, 2, report.DormantRoles[0].GroupCount)
+	}
+	if assert.Len(t, report.UncheckedPermissions, 1) {
+		assert.Equal(t, "delete_group", report.UncheckedPermissions[0].Name)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	for _, days := range []string{"0", "many"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/api/rbac/reports/dormancy?days="+days, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, days)
+	}
+}
+
+func TestGetPermissionMatrixHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	columns := []string{"id", "name", "resource", "action", "category", "description", "risk_level", "key", "id", "name", "granted"}
+	mock.ExpectQuery(`FROM permissions p\s+LEFT JOIN roles r ON TRUE`).WithArgs("role").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("p1", "create_role", "role", "create", "Access control", "", RiskMedium, "create_role", "r2", "editor", true).
+			AddRow("p1", "create_role", "role", "create", "Access control", "", RiskMedium, "create_role", "r1", "admin", true).
+			AddRow("p2", "read_role", "role", "read", "Access control", "", RiskLow, "read_role", "r2", "editor", false).
+			AddRow("p2", "read_role", "role", "read", "Access control", "", RiskLow, "read_role", "r1", "admin", true))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	w := httptest.NewRecorder()
+	GetPermissionMatrixHandler(service)(w, httptest.NewRequest(http.MethodGet, "/api/rbac/matrix?resource=role", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var matrix PermissionMatrix
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &matrix))
+	assert.Equal(t, "role", matrix.Resource)
+	if assert.Len(t, matrix.Permissions, 2) {
+		assert.Equal(t, "create_role", matrix.Permissions[0].Name)
+	}
+	assert.Equal(t, []*MatrixRow{
+		{RoleRef: RoleRef{ID: "r1", Name: "admin"}, PermissionIDs: []string{"p1", "p2"}},
+		{RoleRef: RoleRef{ID: "r2", Name: "editor"}, PermissionIDs: []string{"p1"}},
+	}, matrix.Roles)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBatchRolesHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	editorID, permissionID := uuid.New().String(), uuid.New().String()
+	noRole := sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"})
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).WithArgs("auditor").WillReturnRows(noRole)
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).WithArgs("editor").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).AddRow(editorID, "editor", "", time.Now(), "editor"))
+	mock.ExpectQuery(`SELECT id FROM permissions WHERE id = ANY`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(permissionID))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO roles`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM role_permissions WHERE role_id`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO role_permissions`).WithArgs(sqlmock.AnyArg(), permissionID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE roles SET name`).WithArgs(editorID, "editor", "Edits content").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	body := `{"roles": [
+		{"name": "auditor", "permission_ids": ["` + permissionID + `"]},
+		{"name": "editor", "description": "Edits content"}
+	]}`
+	w := httptest.NewRecorder()
+	BatchRolesHandler(service)(w, httptest.NewRequest("POST", "/api/rbac/roles/batch", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp BatchRolesResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Applied)
+	assert.Equal(t, BatchCreated, resp.Results[0].Status)
+	assert.NotEmpty(t, resp.Results[0].ID)
+	assert.Equal(t, BatchUpdated, resp.Results[1].Status)
+	assert.Equal(t, editorID, resp.Results[1].ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// One invalid item rejects the whole batch before anything is written
+	body = `{"roles": [{"name": "viewer"}, {"name": "viewer"}, {"name": "x"}]}`
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE name`).WithArgs("viewer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}))
+	w = httptest.NewRecorder()
+	BatchRolesHandler(service)(w, httptest.NewRequest("POST", "/api/rbac/roles/batch", strings.NewReader(body)))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	resp = BatchRolesResult{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.False(t, resp.Applied)
+	assert.Equal(t, "VALIDATION_ERROR", resp.Code)
+	assert.Equal(t, BatchSkipped, resp.Results[0].Status)
+	assert.Equal(t, BatchInvalid, resp.Results[1].Status)
+	assert.Equal(t, "duplicates roles[0]", resp.Results[1].Errors["name"])
+	assert.Equal(t, BatchInvalid, resp.Results[2].Status)
+	assert.Contains(t, resp.Results[2].Errors, "name")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInstantiateGroupTemplateHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	templateID, roleA, roleB := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	mock.ExpectQuery(`FROM group_templates t .* WHERE t.id = \$1 GROUP BY`).WithArgs(templateID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "name_pattern", "description", "created_at", "role_ids"}).
+			AddRow(templateID, "project", "project-{name}", "Members of project {name}", time.Now(), "{"+roleA+","+roleB+"}"))
+	mock.ExpectQuery(`SELECT id, name, description, created_at FROM role_groups WHERE name`).WithArgs("project-apollo").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO role_groups`).
+		WithArgs(sqlmock.AnyArg(), "project-apollo", "Members of project apollo", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO group_roles`).WithArgs(sqlmock.AnyArg(), roleA).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO group_roles`).WithArgs(sqlmock.AnyArg(), roleB).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	req := httptest.NewRequest("POST", "/api/rbac/group-templates/"+templateID+"/instantiate", strings.NewReader(`{"name": "apollo"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": templateID})
+	w := httptest.NewRecorder()
+	InstantiateGroupTemplateHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var group RoleGroup
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &group))
+	assert.Equal(t, "project-apollo", group.Name)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// An unknown template is a 404
+	mock.ExpectQuery(`FROM group_templates t`).WithArgs("missing").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "name_pattern", "description", "created_at", "role_ids"}))
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/", strings.NewReader(`{"name": "apollo"}`)), map[string]string{"id": "missing"})
+	w = httptest.NewRecorder()
+	InstantiateGroupTemplateHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "GROUP_TEMPLATE_NOT_FOUND")
+}
+
+func TestBootstrapOnlyCreatesWhatIsMissing(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	roleID, permissionID := uuid.New().String(), uuid.New().String()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM permissions ORDER BY resource, action`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}).
+			AddRow(permissionID, "read_role", "role", "read", "Access control", "", RiskLow, "read_role"))
+	// An administrator renamed the role since; it is still found by its key
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE key`).WithArgs("viewer").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).AddRow(roleID, "Read-only viewers", "", time.Now(), "viewer"))
+	mock.ExpectExec(`INSERT INTO role_permissions`).WithArgs(roleID, permissionID).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT id, name, description, created_at FROM role_groups WHERE name`).WithArgs("staff").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at"}))
+	mock.ExpectExec(`INSERT INTO role_groups`).WithArgs(sqlmock.AnyArg(), "staff", "Everyone", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO group_roles`).WithArgs(sqlmock.AnyArg(), roleID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	result, err := service.Bootstrap(context.Background(), BootstrapSpec{
+		Roles:  []BootstrapRole{{Name: "viewer", Permissions: []string{"read_role"}}},
+		Groups: []BootstrapGroup{{Name: "staff", Description: "Everyone", Roles: []string{"viewer"}}},
+	})
+
+	assert.NoError(t, err)
+	assert.Empty(t, result.CreatedRoles)
+	assert.Equal(t, []string{"staff"}, result.CreatedGroups)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = service.Bootstrap(context.Background(), BootstrapSpec{Roles: []BootstrapRole{{Name: "x"}}})
+	assert.Error(t, err, "invalid names are rejected before touching the database")
+}
+
+type sessionRevokerFunc func(ctx context.Context, userID string) error
+
+func (f sessionRevokerFunc) RevokeSessions(ctx context.Context, userID string) error {
+	return f(ctx, userID)
+}
+
+type recordingNotifier struct {
+	sent []notification.Notification
+}
+
+func (n *recordingNotifier) Notify(_ context.Context, sent notification.Notification) error {
+	n.sent = append(n.sent, sent)
+	return nil
+}
+
+func TestRevokeUserAccessRejectsEarlierTokens(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{}, logger)
+	service.SetJWTSecret("revocation-secret")
+
+	var loggedOut []string
+	service.SetSessionRevoker(sessionRevokerFunc(func(_ context.Context, userID string) error {
+		loggedOut = append(loggedOut, userID)
+		return nil
+	}))
+	events := &recordingNotifier{}
+	service.SetEventNotifier(events)
+
+	parse := func(issuedAt time.Time) *authFailure {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			UserID: "user-1",
+			RegisteredClaims: jwt.RegisteredClaims{
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+		signed, err := token.SignedString([]byte("revocation-secret"))
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		_, failure := service.parseToken(req)
+		return failure
+	}
+
+	issued := time.Now().Add(-time.Minute)
+	assert.Nil(t, parse(issued))
+
+	assert.NoError(t, service.RevokeUserAccess(context.Background(), "user-1", RevokedDeactivated))
+
+	failure := parse(issued)
+	if assert.NotNil(t, failure) {
+		assert.Equal(t, "SESSION_REVOKED", failure.code)
+	}
+	assert.Nil(t, parse(time.Now().Add(2*time.Second)), "tokens issued after the revocation are accepted")
+	assert.Equal(t, []string{"user-1"}, loggedOut)
+	if assert.Len(t, events.sent, 1) {
+		assert.Equal(t, AccessRevokedEvent, events.sent[0].Type)
+		assert.Equal(t, RevokedDeactivated, events.sent[0].Data["reason"])
+	}
+}
+
+func TestRevokeTokenHandlerDeniesTokenOnEveryInstance(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	other := NewRBACService(NewRBACRepository(db), logger)
+	other.SetJWTSecret("denylist-secret")
+
+	mock.ExpectExec(`INSERT INTO token_denylist`).
+		WithArgs(DenyToken, "token-1", "leaked in logs", "admin-1", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest("POST", "/api/rbac/tokens/revoke", strings.NewReader(`{"jti": "token-1", "reason": "leaked in logs"}`))
+	req = req.WithContext(context.WithValue(req.Context(), UserIDKey, "admin-1"))
+	w := httptest.NewRecorder()
+	RevokeTokenHandler(service)(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var entry DenylistEntry
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &entry))
+	assert.Equal(t, DenyToken, entry.Kind)
+	assert.Equal(t, "token-1", entry.Value)
+	assert.WithinDuration(t, entry.RevokedAt.Add(DefaultTokenLifetime), entry.ExpiresAt, time.Second)
+
+	// Another instance learns about the revocation when it syncs
+	mock.ExpectExec(`DELETE FROM token_denylist WHERE expires_at <= \$1`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`FROM token_denylist WHERE expires_at > \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "value", "reason", "revoked_by", "revoked_at", "expires_at"}).
+			AddRow(entry.Kind, entry.Value, entry.Reason, entry.RevokedBy, entry.RevokedAt, entry.ExpiresAt))
+	assert.NoError(t, other.SyncDenylist())
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	parse := func(tokenID string) *authFailure {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			UserID: "user-1",
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        tokenID,
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+		signed, err := token.SignedString([]byte("denylist-secret"))
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		_, failure := other.parseToken(req)
+		return failure
+	}
+	if failure := parse("token-1"); assert.NotNil(t, failure) {
+		assert.Equal(t, "SESSION_REVOKED", failure.code)
+	}
+	assert.Nil(t, parse("token-2"), "other tokens of the user are still accepted")
+
+	w = httptest.NewRecorder()
+	GetDenylistHandler(other)(w, httptest.NewRequest("GET", "/api/rbac/tokens/denylist", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"token-1"`)
+}
+
+func TestApplyDomainRulesJoinsMissingGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	userID, groupA, groupB := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	mock.ExpectQuery(`FROM domain_group_rules d .* WHERE d.domain = \$1`).WithArgs("acme.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "domain", "group_id", "group_name", "created_by", "created_at"}).
+			AddRow("rule-a", "acme.com", groupA, "staff", "", time.Now()).
+			AddRow("rule-b", "acme.com", groupB, "engineering", "", time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_group_memberships`).WithArgs(userID, groupA).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM user_group_memberships`).WithArgs(userID, groupB).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(`INSERT INTO user_group_memberships`).WithArgs(userID, groupB, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO group_membership_history`).
+		WithArgs(groupB, userID, MembershipAdded, DomainRuleActor+"rule-b", nil, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	joined, err := service.ApplyDomainRules(context.Background(), userID, "Alice@ACME.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{groupB}, joined, "groups the user already belongs to are skipped")
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	joined, err = service.ApplyDomainRules(context.Background(), userID, "not-an-email")
+	assert.NoError(t, err)
+	assert.Empty(t, joined)
+
+	_, err = service.CreateDomainRule(context.Background(), DomainGroupRuleRequest{Domain: "@not a domain", GroupID: groupA})
+	var validationErr *ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+}
+
+type memoryTokenRepo struct {
+	tokens map[string]*PersonalToken
+	hashes map[string]string
+}
+
+func (r *memoryTokenRepo) Create(token *PersonalToken, hash string) error {
+	r.tokens[token.ID] = token
+	r.hashes[hash] = token.ID
+	return nil
+}
+
+func (r *memoryTokenRepo) GetByHash(hash string) (*PersonalToken, error) {
+	return r.tokens[r.hashes[hash]], nil
+}
+
+func (r *memoryTokenRepo) ListForUser(userID string) ([]*PersonalToken, error) {
+	var tokens []*PersonalToken
+	for _, token := range r.tokens {
+		if token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (r *memoryTokenRepo) Delete(userID, id string) (bool, error) {
+	token, ok := r.tokens[id]
+	if !ok || token.UserID != userID {
+		return false, nil
+	}
+	delete(r.tokens, id)
+	return true, nil
+}
+
+func (r *memoryTokenRepo) DeleteForUser(userID string) error {
+	for id, token := range r.tokens {
+		if token.UserID == userID {
+			delete(r.tokens, id)
+		}
+	}
+	return nil
+}
+
+func (r *memoryTokenRepo) Touch(id string, at time.Time) error {
+	r.tokens[id].LastUsedAt = &at
+	return nil
+}
+
+type staticPermissions []string
+
+func (p staticPermissions) GetUserPermissions(userID string) (*UserPermissions, error) {
+	perms := &UserPermissions{UserID: userID}
+	for _, name := range p {
+		perms.Permissions = append(perms.Permissions, Permission{Key: name, Name: name})
+	}
+	return perms, nil
+}
+
+func TestPersonalTokensAreScopedToTheirPermissions(t *testing.T) {
+	tokens := &memoryTokenRepo{tokens: map[string]*PersonalToken{}, hashes: map[string]string{}}
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{TokenRepo: tokens, UserPermRepo: staticPermissions{"read_role", "update_role"}}, logger)
+
+	ctx := context.WithValue(context.Background(), UserIDKey, "user-1")
+	ctx = context.WithValue(ctx, UsernameKey, "alice")
+	ctx = context.WithValue(ctx, UserPermissionsKey, []string{"read_role", "update_role"})
+	_, err := service.CreatePersonalToken(ctx, CreatePersonalTokenRequest{Name: "ci", Permissions: []string{"delete_role"}})
+	assert.Equal(t, apperrors.KindForbidden, apperrors.KindOf(err), "permissions the owner lacks cannot be granted")
+
+	created, err := service.CreatePersonalToken(ctx, CreatePersonalTokenRequest{Name: "ci", Permissions: []string{"read_role"}})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(created.Token, PersonalTokenPrefix+created.Prefix[len(PersonalTokenPrefix):]))
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, DefaultPersonalTokenDays), created.ExpiresAt, time.Minute)
+
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	service.Protect(r.HandleFunc("/roles", ok).Methods("GET"), perm.ReadRole)
+	service.Protect(r.HandleFunc("/roles", ok).Methods("PUT"), perm.UpdateRole)
+	r.Use(service.AuthMiddleware())
+	serve := func(method, token string) int {
+		req := httptest.NewRequest(method, "/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, created.Token))
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPut, created.Token), "the owner's other permissions are not granted")
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, created.Token+"x"))
+	assert.NotNil(t, tokens.tokens[created.ID].LastUsedAt)
+
+	req := httptest.NewRequest(http.MethodGet, "/roles", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	assert.Equal(t, TierAPIKey, service.RateLimitClient(req).Tier)
+
+	assert.Equal(t, apperrors.KindNotFound, apperrors.KindOf(service.DeletePersonalToken(context.WithValue(context.Background(), UserIDKey, "user-2"), created.ID)),
+		"only the owner can delete a token")
+	assert.NoError(t, service.RevokeUserAccess(ctx, "user-1", RevokedDeactivated))
+	assert.Empty(t, tokens.tokens, "deactivation deletes personal access tokens")
+	assert.Equal(t, http.StatusUnauthorized, serve(http.MethodGet, created.Token))
+}
+
+func TestParseTokenSelectsRealmByIssuer(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{}, logger)
+	service.SetJWTSecret("employees-secret")
+	service.SetTokenRealms([]TokenRealm{
+		{Name: "employees", Issuer: "https://sso.example.com/realms/employees"},
+		{Name: "customers", Issuer: "https://sso.example.com/realms/customers", Secret: "customers-secret"},
+	})
+
+	parse := func(issuer, secret string) (*JWTClaims, *authFailure) {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+			UserID: "user-1",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    issuer,
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+		signed, err := token.SignedString([]byte(secret))
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		return service.parseToken(req)
+	}
+
+	claims, failure := parse("https://sso.example.com/realms/employees", "employees-secret")
+	if assert.Nil(t, failure) {
+		assert.Equal(t, "employees", claims.Realm)
+	}
+	claims, failure = parse("https://sso.example.com/realms/customers", "customers-secret")
+	if assert.Nil(t, failure) {
+		assert.Equal(t, "customers", claims.Realm)
+	}
+
+	_, failure = parse("https://sso.example.com/realms/customers", "employees-secret")
+	if assert.NotNil(t, failure, "a realm's tokens are verified with its own secret") {
+		assert.Equal(t, "INVALID_TOKEN", failure.code)
+	}
+	_, failure = parse("https://evil.example.com/realms/employees", "employees-secret")
+	if assert.NotNil(t, failure) {
+		assert.Equal(t, "UNKNOWN_ISSUER", failure.code)
+	}
+}
+
+type memoryDigestRepo struct {
+	subs    map[string]*DigestSubscription
+	changes *ChangeDigest
+}
+
+func (m *memoryDigestRepo) GetSubscription(userID string) (*DigestSubscription, error) {
+	return m.subs[userID], nil
+}
+
+func (m *memoryDigestRepo) SaveSubscription(sub *DigestSubscription) error {
+	if existing, ok := m.subs[sub.UserID]; ok {
+		existing.Frequency = sub.Frequency
+		return nil
+	}
+	m.subs[sub.UserID] = sub
+	return nil
+}
+
+func (m *memoryDigestRepo) DeleteSubscription(userID string) error {
+	delete(m.subs, userID)
+	return nil
+}
+
+func (m *memoryDigestRepo) ListSubscriptions() ([]*DigestSubscription, error) {
+	var subs []*DigestSubscription
+	for _, sub := range m.subs {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (m *memoryDigestRepo) MarkSent(userID string, at time.Time) error {
+	m.subs[userID].LastSentAt = &at
+	return nil
+}
+
+func (m *memoryDigestRepo) Changes(from, to time.Time, limit int) (*ChangeDigest, error) {
+	digest := *m.changes
+	digest.From, digest.To = from, to
+	return &digest, nil
+}
+
+func TestSendDueDigestsToSubscribedAdmins(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	digests := &memoryDigestRepo{subs: map[string]*DigestSubscription{}, changes: &ChangeDigest{
+		NewRoles:             []*Role{{ID: "r1", Name: "auditor"}},
+		NewRoleCount:         1,
+		PermissionGrants:     []*PermissionGrant{{RoleID: "r1", RoleName: "auditor", PermissionName: "read_user"}},
+		PermissionGrantCount: 1,
+	}}
+	service := NewRBACService(&RBACRepository{UserPermRepo: staticPermissions{string(perm.ReadRole)}, DigestRepo: digests}, logger)
+	notifier := &recordingNotifier{}
+	service.SetDigestDelivery(notifier, func(_ context.Context, userID string) (string, error) { return userID + "@example.com", nil })
+	ctx := context.Background()
+
+	_, err := service.SubscribeToDigest(ctx, "admin-1", DigestSubscriptionRequest{Frequency: "hourly"})
+	assert.Error(t, err, "only daily and weekly digests exist")
+	sub, err := service.SubscribeToDigest(ctx, "admin-1", DigestSubscriptionRequest{Frequency: DigestDaily})
+	require.NoError(t, err)
+	assert.Equal(t, DigestDaily, sub.Frequency)
+	weekly, err := service.SubscribeToDigest(ctx, "admin-2", DigestSubscriptionRequest{Frequency: DigestWeekly})
+	require.NoError(t, err)
+
+	// Nothing is due within the first day
+	require.NoError(t, service.SendDueDigests(ctx))
+	assert.Empty(t, notifier.sent)
+
+	sub.CreatedAt = sub.CreatedAt.Add(-25 * time.Hour)
+	weekly.CreatedAt = weekly.CreatedAt.Add(-25 * time.Hour)
+	require.NoError(t, service.SendDueDigests(ctx))
+	require.Len(t, notifier.sent, 1, "the weekly subscriber waits a week")
+	sent := notifier.sent[0]
+	assert.Equal(t, DigestEvent, sent.Type)
+	assert.Equal(t, "admin-1@example.com", sent.Data["email"])
+	assert.Contains(t, sent.Message, "1 new roles, 0 membership changes, 1 permission grants")
+	assert.Contains(t, sent.Message, "Role auditor granted read_user")
+	require.NotNil(t, sub.LastSentAt)
+
+	// The next digest starts where the last one ended
+	require.NoError(t, service.SendDueDigests(ctx))
+	assert.Len(t, notifier.sent, 1)
+
+	// Subscribers who lost access get nothing
+	service.repo.UserPermRepo = staticPermissions{}
+	sub.LastSentAt = nil
+	require.NoError(t, service.SendDueDigests(ctx))
+	assert.Len(t, notifier.sent, 1)
+
+	require.NoError(t, service.UnsubscribeFromDigest(ctx, "admin-1"))
+	_, err = service.GetDigestSubscription("admin-1")
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+type suspendedTenants map[string]bool
+
+func (s suspendedTenants) TenantSuspended(tenant string) bool { return s[tenant] }
+
+func TestImpersonationActsInTenantAdminContext(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "impersonation-secret")
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	service.SetTenantStatus(suspendedTenants{"acme": true})
+
+	// The role was renamed after the tenant was provisioned; it is acted as by its key
+	roleRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).AddRow("role-1", "Acme administrators", "", time.Now(), "acme-admin")
+	}
+	expectActingPermissions := func() {
+		mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE key`).WithArgs("acme-admin").WillReturnRows(roleRows())
+		mock.ExpectQuery(`FROM permissions p`).WithArgs("role-1").WillReturnRows(sqlmock.NewRows([]string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}).
+			AddRow("p1", "read_user", "users", "read", "Users", "", RiskLow, "read_user").
+			AddRow("p2", "platform_admin_suspend_tenants", "platform", "suspend", "Platform", "", RiskHigh, "platform_admin_suspend_tenants"))
+	}
+
+	ctx := context.WithValue(context.Background(), UserIDKey, "operator")
+	ctx = context.WithValue(ctx, UsernameKey, "ops")
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE key`).WithArgs("acme-admin").WillReturnRows(roleRows())
+	impersonation, err := service.Impersonate(ctx, "acme", []string{"acme-admin"})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(ImpersonationLifetime), impersonation.ExpiresAt, time.Minute)
+
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(UserIDFromContext(r.Context()))) }
+	service.Protect(r.HandleFunc("/users", ok).Methods("GET"), perm.ReadUser)
+	service.Protect(r.HandleFunc("/platform", ok).Methods("GET"), perm.PlatformSuspend)
+	r.Use(service.AuthMiddleware())
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	expectActingPermissions()
+	w := serve("/users", impersonation.AccessToken)
+	assert.Equal(t, http.StatusOK, w.Code, "the operator acts in a suspended tenant")
+	assert.Equal(t, "operator", w.Body.String(), "actions stay attributed to the operator")
+	expectActingPermissions()
+	assert.Equal(t, http.StatusForbidden, serve("/platform", impersonation.AccessToken).Code, "tenant roles never grant platform permissions")
+
+	member, err := service.IssueToken(JWTClaims{UserID: "user-1", Tenant: "acme", RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}})
+	require.NoError(t, err)
+	w = serve("/users", member)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "TENANT_SUSPENDED")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRequireOwnershipOrLetsOwnersThrough(t *testing.T) {
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	owner := func(r *http.Request, userID string) (bool, error) {
+		return r.URL.Query().Get("user_id") == userID, nil
+	}
+	handler := service.RequireOwnershipOr(perm.UpdateUser, owner, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	serve := func(userID string, permissions []string, target string) *httptest.ResponseRecorder {
+		ctx := context.WithValue(context.Background(), UserIDKey, userID)
+		ctx = context.WithValue(ctx, UserPermissionsKey, permissions)
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPut, "/profile?user_id="+target, nil).WithContext(ctx))
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve("admin", []string{"update_user"}, "user-1").Code)
+	assert.Equal(t, http.StatusNoContent, serve("user-1", []string{"update_user_own"}, "user-1").Code)
+	w := serve("user-1", []string{"update_user_own"}, "user-2")
+	assert.Equal(t, http.StatusForbidden, w.Code, "the own variant only reaches the caller's resources")
+	assert.Contains(t, w.Body.String(), "INSUFFICIENT_PERMISSIONS")
+	assert.Equal(t, http.StatusForbidden, serve("user-1", []string{"read_user_own"}, "user-1").Code)
+
+	// Without an identity in the context the token is checked
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPut, "/profile?user_id=user-1", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestJWKSVerifiesRS256TokensAcrossKeyRotation(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "jwks-secret")
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	published := map[string]*rsa.PrivateKey{"old": oldKey}
+	fetches := 0
+	certs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		keys := []map[string]string{{"kid": "enc", "kty": "RSA", "use": "enc", "n": "AQAB", "e": "AQAB"}}
+		for kid, key := range published {
+			keys = append(keys, map[string]string{
+				"kid": kid, "kty": "RSA", "use": "sig",
+				"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer certs.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(&RBACRepository{}, logger)
+	issuer := "https://sso.example.com/realms/main"
+	jwks := NewJWKS(certs.URL, certs.Client(), logger)
+	now := time.Now()
+	jwks.now = func() time.Time { return now }
+	service.SetTokenRealms([]TokenRealm{{Name: "main", Issuer: issuer, JWKS: jwks}})
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, JWTClaims{UserID: "user-1", RegisteredClaims: jwt.RegisteredClaims{
+			Issuer: issuer, ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		require.NoError(t, err)
+		return signed
+	}
+	parse := func(token string) *authFailure {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, failure := service.parseToken(r)
+		return failure
+	}
+
+	assert.Nil(t, parse(sign(jwt.SigningMethodRS256, "old", oldKey)))
+	assert.Equal(t, 1, fetches)
+
+	// Keycloak rotates its key: the unknown kid refetches the set, but not more often than
+	// JWKSMinRefresh
+	published["new"] = newKey
+	rotated := sign(jwt.SigningMethodRS256, "new", newKey)
+	assert.NotNil(t, parse(rotated))
+	assert.Equal(t, 1, fetches, "fetched moments ago")
+	now = now.Add(JWKSMinRefresh + time.Second)
+	assert.Nil(t, parse(rotated))
+	assert.Equal(t, 2, fetches)
+
+	assert.NotNil(t, parse(sign(jwt.SigningMethodRS256, "new", oldKey)), "wrong key for the kid")
+	hmacToken := sign(jwt.SigningMethodHS256, "", []byte("jwks-secret"))
+	assert.NotNil(t, parse(hmacToken), "HMAC is not accepted from a JWKS realm by default")
+	service.SetAllowHMAC(true)
+	assert.Nil(t, parse(hmacToken))
+}
+
+func TestRoleScopeConfinesGrantedPermissions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	permissionColumns := []string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}
+	ctx := context.WithValue(context.Background(), UserIDKey, "admin-1")
+
+	// Scoping to a resource no permission is on is rejected
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).WithArgs("role-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).AddRow("role-1", "reports-admin", "", createdAt, "reports-admin"))
+	mock.ExpectQuery(`FROM permissions ORDER BY resource, action`).
+		WillReturnRows(sqlmock.NewRows(permissionColumns).AddRow("p1", "view_reports", "reports", "read", "Reports", "", "low", "view_reports"))
+	_, err = service.SetRoleScope(ctx, "role-1", RoleScopeRequest{Resource: "invoices"})
+	var ve *ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "resource", ve.Field)
+
+	// The role's permissions on other resources are reported as ignored
+	mock.ExpectQuery(`SELECT id, name, description, created_at, key FROM roles WHERE id`).WithArgs("role-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "description", "created_at", "key"}).AddRow("role-1", "reports-admin", "", createdAt, "reports-admin"))
+	mock.ExpectQuery(`FROM permissions ORDER BY resource, action`).
+		WillReturnRows(sqlmock.NewRows(permissionColumns).AddRow("p1", "view_reports", "reports", "read", "Reports", "", "low", "view_reports"))
+	mock.ExpectExec(`INSERT INTO role_scopes`).WithArgs("role-1", "reports", "admin-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM permissions p\s+JOIN role_permissions rp ON p.id = rp.permission_id\s+WHERE rp.role_id`).WithArgs("role-1").
+		WillReturnRows(sqlmock.NewRows(permissionColumns).
+			AddRow("p1", "view_reports", "reports", "read", "Reports", "", "low", "view_reports").
+			AddRow("p2", "delete_user", "user", "delete", "Users", "", "high", "delete_user"))
+	scope, err := service.SetRoleScope(ctx, "role-1", RoleScopeRequest{Resource: "reports"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"delete_user"}, scope.IgnoredPermissions)
+
+	// Resolution leaves out permissions outside the scopes of the roles granting them
+	mock.ExpectQuery(`LEFT JOIN role_scopes rs ON rs.role_id = r.id\s+WHERE ugm.user_id = \$1 AND .* AND \(rs.resource IS NULL OR rs.resource = p.resource\)`).
+		WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}))
+	_, err = service.GetUserPermissions(context.Background(), "user-1")
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPermissionCacheServesUntilInvalidated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	// Misses resolve on the primary, so a lagging replica cannot refill the cache with access
+	// that was just revoked
+	replica, replicaMock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer replica.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepositoryWithReader(db, replica), logger)
+	cache := NewMemoryPermissionCache(time.Minute, 10)
+	service.SetPermissionCache(cache)
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolved := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{
+			"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+			"key", "key",
+		}).AddRow("p1", "view_reports", "reports", "read", "role-1", "reports-viewer", "", createdAt, "group-1", "analysts", "", createdAt, "view_reports", "reports-viewer")
+	}
+
+	// The second lookup is served from the cache
+	mock.ExpectQuery(`FROM permissions p`).WithArgs("user-1").WillReturnRows(resolved())
+	for i := 0; i < 2; i++ {
+		perms, err := service.GetUserPermissions(context.Background(), "user-1")
+		require.NoError(t, err)
+		require.Len(t, perms.Permissions, 1)
+	}
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// A change to the user's access resolves their permissions again
+	service.accessChanged(context.Background(), "user-1")
+	mock.ExpectQuery(`FROM permissions p`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}))
+	perms, err := service.GetUserPermissions(context.Background(), "user-1")
+	require.NoError(t, err)
+	assert.Empty(t, perms.Permissions)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// A lookup that started before an invalidation does not cache its stale result
+	_, generation, _ := cache.Get(context.Background(), "user-2")
+	service.accessChanged(context.Background())
+	cache.Set(context.Background(), "user-2", &UserPermissions{UserID: "user-2"}, generation)
+	_, _, ok := cache.Get(context.Background(), "user-2")
+	assert.False(t, ok)
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+}
+
+func TestPermissionDeprecationAliasesAndMigratesSuccessor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	deprecatedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	deprecationColumns := []string{"permission_id", "name", "replaced_by_id", "replaced_by", "reason", "deprecated_by", "deprecated_at"}
+	listed := func() *sqlmock.Rows {
+		return sqlmock.NewRows(deprecationColumns).AddRow("p-old", "view_report", "p-new", "view_reports", "renamed", "admin-1", deprecatedAt)
+	}
+
+	mock.ExpectQuery(`FROM permission_deprecations d`).WillReturnRows(listed())
+	require.NoError(t, service.SyncDeprecations())
+
+	// Either name of the rename satisfies checks of the other
+	assert.ElementsMatch(t, []string{"view_report", "view_reports"}, service.deprecations.expand([]string{"view_report"}))
+	assert.ElementsMatch(t, []string{"view_reports", "view_report"}, service.deprecations.expand([]string{"view_reports"}))
+	assert.Equal(t, []string{"manage_system"}, service.deprecations.expand([]string{"manage_system"}))
+
+	// The successor cannot be deprecated in turn
+	mock.ExpectQuery(`FROM permissions WHERE id`).WithArgs("p-new").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}).
+			AddRow("p-new", "view_reports", "reports", "read", "Reporting", "", "low", "view_reports"))
+	_, err = service.DeprecatePermission(context.Background(), "p-new", DeprecatePermissionRequest{})
+	var ve *ValidationError
+	require.ErrorAs(t, err, &ve)
+
+	// Migration moves the roles to the successor in one transaction
+	mock.ExpectQuery(`FROM permission_deprecations d`).WillReturnRows(listed())
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO role_permissions \(role_id, permission_id\)\s+SELECT role_id, \$2 FROM role_permissions WHERE permission_id = \$1`).
+		WithArgs("p-old", "p-new").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM role_permissions WHERE permission_id = \$1`).WithArgs("p-old").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+	result, err := service.MigrateDeprecatedPermission(context.Background(), "p-old")
+	require.NoError(t, err)
+	assert.Equal(t, &PermissionMigrationResult{Permission: "view_report", ReplacedBy: "view_reports", MigratedRoles: 3}, result)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRenamedPermissionsAndRolesAreCheckedByKey(t *testing.T) {
+	t.Setenv("TEST_JWT_SECRET", "stable-key-secret")
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+	permissionColumns := []string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}
+
+	// Renaming changes the display name only
+	mock.ExpectQuery(`FROM permissions WHERE id`).WithArgs("p1").
+		WillReturnRows(sqlmock.NewRows(permissionColumns).AddRow("p1", "read_role", "role", "read", "Access control", "", RiskLow, "read_role"))
+	mock.ExpectExec(`UPDATE permissions SET name = \$2 WHERE id = \$1`).WithArgs("p1", "View roles").WillReturnResult(sqlmock.NewResult(0, 1))
+	renamed, err := service.RenamePermission(context.Background(), "p1", RenamePermissionRequest{Name: "View roles"})
+	require.NoError(t, err)
+	assert.Equal(t, "View roles", renamed.Name)
+	assert.Equal(t, "read_role", renamed.Key)
+
+	// Display names stay unique
+	mock.ExpectQuery(`FROM permissions WHERE id`).WithArgs("p2").
+		WillReturnRows(sqlmock.NewRows(permissionColumns).AddRow("p2", "update_role", "role", "update", "Access control", "", RiskMedium, "update_role"))
+	mock.ExpectExec(`UPDATE permissions SET name`).WithArgs("p2", "View roles").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "permissions_name_key"})
+	_, err = service.RenamePermission(context.Background(), "p2", RenamePermissionRequest{Name: "View roles"})
+	var ve *ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "name", ve.Field)
+
+	// Checks compare keys, whatever the permission and role are called now
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT DISTINCT`).WithArgs("user-1").WillReturnRows(sqlmock.NewRows([]string{
+		"id", "name", "resource", "action", "id", "name", "description", "created_at", "id", "name", "description", "created_at",
+		"key", "key",
+	}).AddRow("p1", "View roles", "role", "read", "r1", "Report viewers", "", createdAt, "g1", "staff", "", createdAt, "read_role", "viewer"))
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, JWTClaims{
+		UserID:           "user-1",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	signed, err := token.SignedString([]byte("stable-key-secret"))
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	w := httptest.NewRecorder()
+	var hasRole bool
+	withAuth(perm.ReadRole, service, func(w http.ResponseWriter, r *http.Request) {
+		hasRole = auth.HasRole(r.Context(), "viewer")
+	})(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, hasRole)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCheckPermissionReferencesReportsMissingAndUnchecked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewRBACService(NewRBACRepository(db), logger)
+
+	r := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	service.Protect(r.HandleFunc("/roles", ok).Methods("GET"), perm.ReadRole)
+	service.Protect(r.HandleFunc("/reports", ok).Methods("GET"), "export_reprots")
+	service.Protect(r.HandleFunc("/legacy", ok).Methods("GET"), "legacy_permission")
+	service.Protect(r.HandleFunc("/me", ok).Methods("GET"), "")
+	service.RequirePermission(perm.ReadGroup, ok)
+	service.ReferencePermissions("UI capability menu.reports", "export_reprots")
+
+	mock.ExpectQuery(`FROM permissions ORDER BY resource, action`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "resource", "action", "category", "description", "risk_level", "key"}).
+			AddRow("p1", "legacy_permission", "legacy", "read", "General", "", RiskLow, "legacy_permission"))
+	report, err := service.CheckPermissionReferences()
+	require.NoError(t, err)
+	assert.Equal(t, []MissingPermission{{Permission: "export_reprots", Sources: []string{"GET /reports", "UI capability menu.reports"}}}, report.Missing)
+	assert.Contains(t, report.Unreferenced, string(perm.RevokeTokens))
+	assert.NotContains(t, report.Unreferenced, string(perm.ReadRole))
+	assert.NotContains(t, report.Unreferenced, string(perm.ReadGroup))
+	assert.Contains(t, report.String(), "export_reprots: checked by GET /reports, UI capability menu.reports but does not exist")
+	require.NoError(t, mock.ExpectationsWereMet())
+}
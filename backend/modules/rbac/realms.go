@@ -0,0 +1,68 @@
+package rbac
+
+import (
+	"context"
+	"net/http"
+
+	"base-app/modules/auth"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RealmKey stores the Keycloak realm of the caller's token in the request context
+const RealmKey = auth.RealmKey
+
+// TokenRealm is a Keycloak realm whose tokens are accepted
+type TokenRealm struct {
+	// Name is the realm name, e.g. "employees"
+	Name string
+	// Issuer is the iss claim of the realm's tokens, e.g. "https://sso.example.com/realms/employees"
+	Issuer string
+	// Secret verifies the realm's HMAC-signed tokens; empty uses the service JWT secret
+	Secret string
+	// JWKS, when set, verifies the realm's RS256 tokens with Keycloak's public keys; its
+	// HMAC-signed tokens are then only accepted with SetAllowHMAC
+	JWKS *JWKS
+}
+
+// SetTokenRealms accepts tokens from these realms only, picking the realm by the token's issuer.
+// Without realms any token signed with the service JWT secret is accepted and no realm is
+// recorded. Set it before serving requests.
+func (s *RBACService) SetTokenRealms(realms []TokenRealm) {
+	s.realms = make(map[string]TokenRealm, len(realms))
+	for _, realm := range realms {
+		s.realms[realm.Issuer] = realm
+	}
+}
+
+// tokenRealm returns the configured realm that issued tokenString. ok is false when realms are
+// configured and none has the token's issuer.
+func (s *RBACService) tokenRealm(tokenString string) (realm TokenRealm, ok bool) {
+	if len(s.realms) == 0 {
+		return TokenRealm{}, true
+	}
+	// The issuer only selects the key; the signature is verified with it afterwards
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &claims); err != nil {
+		return TokenRealm{}, false
+	}
+	realm, ok = s.realms[claims.Issuer]
+	return realm, ok
+}
+
+// tokenKey returns the key verifying tokens of realm
+func (s *RBACService) tokenKey(realm TokenRealm) []byte {
+	if realm.Secret != "" {
+		return []byte(realm.Secret)
+	}
+	return []byte(s.signingSecret())
+}
+
+// unknownIssuer is the failure for tokens from a realm that is not configured
+var unknownIssuer = &authFailure{http.StatusUnauthorized, "Token issuer is not accepted", "UNKNOWN_ISSUER", nil}
+
+// RealmFromContext returns the Keycloak realm of the authenticated caller's token, or "" when
+// realms are not configured or the caller used a personal access token
+func RealmFromContext(ctx context.Context) string {
+	return auth.Realm(ctx)
+}
@@ -0,0 +1,157 @@
+package rbac
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"base-app/pkg/perm"
+
+	"github.com/google/uuid"
+)
+
+// permissionNamespace derives stable IDs for permissions registered without one, so the same
+// permission gets the same ID in every environment
+var permissionNamespace = uuid.MustParse("550e8400-e29b-41d4-a716-446655440000")
+
+// permissionRegistry holds the permissions declared by modules, by key
+var permissionRegistry = struct {
+	mu    sync.Mutex
+	byKey map[string]Permission
+}{byKey: make(map[string]Permission)}
+
+// RegisterPermissions declares permissions a module checks. Modules call it from init so every
+// permission is known before SyncPermissions runs at startup. Key defaults to Name, Category to
+// "General" and RiskLevel to RiskLow. It panics on an invalid permission or when a key is
+// registered twice with different definitions, since both are programming errors.
+func RegisterPermissions(permissions ...Permission) {
+	permissionRegistry.mu.Lock()
+	defer permissionRegistry.mu.Unlock()
+
+	for _, p := range permissions {
+		p, err := normalizePermission(p)
+		if err != nil {
+			panic("rbac: " + err.Error())
+		}
+		if existing, ok := permissionRegistry.byKey[p.Key]; ok && existing != p {
+			panic(fmt.Sprintf("rbac: permission %q registered twice with different definitions", p.Key))
+		}
+		permissionRegistry.byKey[p.Key] = p
+	}
+}
+
+// normalizePermission checks p and fills in its defaults: the name as key, a stable ID derived
+// from the key, the "General" category and RiskLow
+func normalizePermission(p Permission) (Permission, error) {
+	if p.Key == "" {
+		p.Key = p.Name
+	}
+	if p.Name == "" {
+		p.Name = p.Key
+	}
+	if p.Key == "" || p.Resource == "" || p.Action == "" {
+		return p, fmt.Errorf("permission %q needs a key, resource and action", p.Key)
+	}
+	if p.ID == "" {
+		p.ID = uuid.NewSHA1(permissionNamespace, []byte(p.Key)).String()
+	}
+	if p.Category == "" {
+		p.Category = "General"
+	}
+	switch p.RiskLevel {
+	case "":
+		p.RiskLevel = RiskLow
+	case RiskLow, RiskMedium, RiskHigh:
+	default:
+		return p, fmt.Errorf("permission %q has invalid risk level %q", p.Key, p.RiskLevel)
+	}
+	return p, nil
+}
+
+// RegisteredPermissions returns the declared permissions sorted by resource and action
+func RegisteredPermissions() []Permission {
+	permissionRegistry.mu.Lock()
+	defer permissionRegistry.mu.Unlock()
+
+	permissions := make([]Permission, 0, len(permissionRegistry.byKey))
+	for _, p := range permissionRegistry.byKey {
+		permissions = append(permissions, p)
+	}
+	sort.Slice(permissions, func(i, j int) bool {
+		if permissions[i].Resource != permissions[j].Resource {
+			return permissions[i].Resource < permissions[j].Resource
+		}
+		return permissions[i].Action < permissions[j].Action
+	})
+	return permissions
+}
+
+// SyncPermissions upserts the registered permissions into the permissions table. Permissions in
+// the table that no module declares any more are logged rather than deleted, because roles may
+// still grant them.
+func (s *RBACService) SyncPermissions() error {
+	registered := RegisteredPermissions()
+	permissions := make([]*Permission, len(registered))
+	for i := range registered {
+		permissions[i] = &registered[i]
+	}
+	if err := s.repo.PermissionRepo.Upsert(permissions); err != nil {
+		s.logger.WithError(err).Error("Failed to sync permissions")
+		return err
+	}
+
+	stored, err := s.repo.PermissionRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list permissions")
+		return err
+	}
+	declared := make(map[string]bool, len(registered))
+	for _, p := range registered {
+		declared[p.Key] = true
+	}
+	for _, p := range stored {
+		if !declared[p.Key] {
+			s.logger.WithField("permission", p.Key).Warn("Permission is not declared by any module")
+		}
+	}
+	for _, name := range perm.All {
+		if !declared[string(name)] {
+			s.logger.WithField("permission", name).Error("Permission constant is not declared by any module; routes requiring it deny everyone")
+		}
+	}
+
+	s.logger.WithField("count", len(registered)).Info("Permissions synced")
+	return nil
+}
+
+// RBAC's own permissions
+func init() {
+	RegisterPermissions(
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440005", Name: string(perm.ManageRoles), Resource: "rbac", Action: "manage",
+			Category: "Access control", Description: "Administer all RBAC configuration", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440008", Name: string(perm.CreateRole), Resource: "role", Action: "create",
+			Category: "Access control", Description: "Create roles", RiskLevel: RiskMedium},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440009", Name: string(perm.ReadRole), Resource: "role", Action: "read",
+			Category: "Access control", Description: "View roles and their permissions", RiskLevel: RiskLow},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440010", Name: string(perm.UpdateRole), Resource: "role", Action: "update",
+			Category: "Access control", Description: "Rename roles and change their permissions", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440011", Name: string(perm.DeleteRole), Resource: "role", Action: "delete",
+			Category: "Access control", Description: "Delete roles", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440012", Name: string(perm.CreateGroup), Resource: "group", Action: "create",
+			Category: "Access control", Description: "Create role groups", RiskLevel: RiskMedium},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440013", Name: string(perm.ReadGroup), Resource: "group", Action: "read",
+			Category: "Access control", Description: "View role groups, their roles and members", RiskLevel: RiskLow},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440014", Name: string(perm.UpdateGroup), Resource: "group", Action: "update",
+			Category: "Access control", Description: "Rename role groups", RiskLevel: RiskMedium},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440015", Name: string(perm.DeleteGroup), Resource: "group", Action: "delete",
+			Category: "Access control", Description: "Delete role groups", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440016", Name: string(perm.ManageGroupMembership), Resource: "group_membership", Action: "manage",
+			Category: "Access control", Description: "Add and remove group members and manage membership expiry", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440017", Name: string(perm.ManageGroupRoles), Resource: "group_roles", Action: "manage",
+			Category: "Access control", Description: "Assign roles to role groups", RiskLevel: RiskHigh},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440018", Name: string(perm.ReadPermission), Resource: "permission", Action: "read",
+			Category: "Access control", Description: "Browse the permission catalog", RiskLevel: RiskLow},
+		Permission{ID: "550e8400-e29b-41d4-a716-446655440022", Name: string(perm.RevokeTokens), Resource: "token", Action: "revoke",
+			Category: "Access control", Description: "Revoke the access tokens of users during incident response", RiskLevel: RiskHigh},
+	)
+}
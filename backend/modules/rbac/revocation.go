@@ -0,0 +1,392 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// AccessRevokedEvent is the notification type sent when a user's access is revoked
+const AccessRevokedEvent = "rbac.user_access_revoked"
+
+// Reasons for revoking a user's access
+const (
+	RevokedDeactivated  = "deactivated"
+	RevokedGroupRemoved = "group_removed"
+	RevokedByAdmin      = "revoked_by_admin"
+	RevokedDeleted      = "deleted"
+)
+
+// DefaultTokenLifetime is how long denylist entries are kept unless SetTokenLifetime says otherwise
+const DefaultTokenLifetime = time.Hour
+
+// Kinds of denylist entry
+const (
+	// DenySubject rejects every token of a user issued up to the revocation
+	DenySubject = "subject"
+	// DenyToken rejects one token by its ID (the jti claim)
+	DenyToken = "jti"
+)
+
+// DenylistEntry rejects tokens until ExpiresAt, by which time every token it covers has expired
+type DenylistEntry struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	RevokedBy string    `json:"revoked_by"`
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// DenylistRepository persists denylist entries so every instance enforces them and they survive restarts
+type DenylistRepository interface {
+	// Add saves entry, keeping the later revocation and expiry when one exists for the same token or user
+	Add(entry *DenylistEntry) error
+	// Active lists the entries that have not expired at now
+	Active(now time.Time) ([]*DenylistEntry, error)
+	// Purge deletes the entries expired at now
+	Purge(now time.Time) error
+}
+
+// denylistRepository implements DenylistRepository
+type denylistRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+func (r *denylistRepository) Add(entry *DenylistEntry) error {
+	query := `INSERT INTO token_denylist (kind, value, reason, revoked_by, revoked_at, expires_at)
+	          VALUES ($1, $2, $3, $4, $5, $6)
+	          ON CONFLICT (kind, value) DO UPDATE SET reason = EXCLUDED.reason, revoked_by = EXCLUDED.revoked_by,
+	              revoked_at = GREATEST(token_denylist.revoked_at, EXCLUDED.revoked_at),
+	              expires_at = GREATEST(token_denylist.expires_at, EXCLUDED.expires_at)`
+	_, err := r.db.Exec(query, entry.Kind, entry.Value, entry.Reason, entry.RevokedBy, entry.RevokedAt, entry.ExpiresAt)
+	return err
+}
+
+func (r *denylistRepository) Active(now time.Time) ([]*DenylistEntry, error) {
+	query := `SELECT kind, value, reason, revoked_by, revoked_at, expires_at FROM token_denylist
+	          WHERE expires_at > $1 ORDER BY revoked_at DESC`
+	return database.QueryAll(r.db, "list token denylist", func(row database.Scanner) (*DenylistEntry, error) {
+		entry := &DenylistEntry{}
+		err := row.Scan(&entry.Kind, &entry.Value, &entry.Reason, &entry.RevokedBy, &entry.RevokedAt, &entry.ExpiresAt)
+		return entry, err
+	}, query, now)
+}
+
+func (r *denylistRepository) Purge(now time.Time) error {
+	_, err := r.db.Exec(`DELETE FROM token_denylist WHERE expires_at <= $1`, now)
+	return err
+}
+
+// SessionRevoker ends every session of a user at the identity provider, so refresh tokens stop working
+type SessionRevoker interface {
+	RevokeSessions(ctx context.Context, userID string) error
+}
+
+// SetSessionRevoker ends identity provider sessions when access is revoked. Set it before serving requests.
+func (s *RBACService) SetSessionRevoker(revoker SessionRevoker) {
+	s.sessions = revoker
+}
+
+// SetEventNotifier receives an AccessRevokedEvent whenever access is revoked. Set it before serving requests.
+func (s *RBACService) SetEventNotifier(notifier notification.Notifier) {
+	s.events = notifier
+}
+
+// SetTokenLifetime sets how long denylist entries are kept; it must cover the longest access
+// token lifetime. Set it before serving requests.
+func (s *RBACService) SetTokenLifetime(lifetime time.Duration) {
+	s.tokenLifetime = lifetime
+}
+
+// revocationList is the in-memory copy of the denylist checked on every request
+type revocationList struct {
+	mu      sync.RWMutex
+	entries map[string]*DenylistEntry
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{entries: make(map[string]*DenylistEntry)}
+}
+
+func denylistKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// add enforces entry, keeping the later revocation when the token or user is already denied
+func (l *revocationList) add(entry *DenylistEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := denylistKey(entry.Kind, entry.Value)
+	if current, ok := l.entries[key]; ok && current.RevokedAt.After(entry.RevokedAt) {
+		return
+	}
+	l.entries[key] = entry
+}
+
+// merge adds entries loaded from the database and forgets expired ones
+func (l *revocationList) merge(entries []*DenylistEntry, now time.Time) {
+	for _, entry := range entries {
+		l.add(entry)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, entry := range l.entries {
+		if !entry.ExpiresAt.After(now) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+// list returns the entries, most recent first
+func (l *revocationList) list() []*DenylistEntry {
+	l.mu.RLock()
+	entries := make([]*DenylistEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	l.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RevokedAt.After(entries[j].RevokedAt) })
+	return entries
+}
+
+// revokes reports whether the token of claims is denied, by its ID or because it was issued
+// before its user's access was revoked
+func (l *revocationList) revokes(claims *JWTClaims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if claims.ID != "" {
+		if _, ok := l.entries[denylistKey(DenyToken, claims.ID)]; ok {
+			return true
+		}
+	}
+	subject, ok := l.entries[denylistKey(DenySubject, claims.UserID)]
+	if !ok {
+		return false
+	}
+	// Token issue times have second precision
+	return claims.IssuedAt == nil || !claims.IssuedAt.After(subject.RevokedAt.Truncate(time.Second))
+}
+
+// deny enforces entry on this instance at once and saves it for the others
+func (s *RBACService) deny(ctx context.Context, kind, value, reason string) (*DenylistEntry, error) {
+	now := time.Now().UTC()
+	entry := &DenylistEntry{
+		Kind:      kind,
+		Value:     value,
+		Reason:    reason,
+		RevokedBy: getUserIDFromContext(ctx),
+		RevokedAt: now,
+		ExpiresAt: now.Add(s.tokenLifetime),
+	}
+	s.revoked.add(entry)
+	if s.repo.DenylistRepo == nil {
+		return entry, nil
+	}
+	if err := s.repo.DenylistRepo.Add(entry); err != nil {
+		return entry, fmt.Errorf("save token denylist entry: %w", err)
+	}
+	return entry, nil
+}
+
+// SyncDenylist deletes expired entries and loads the ones other instances added
+func (s *RBACService) SyncDenylist() error {
+	now := time.Now().UTC()
+	if err := s.repo.DenylistRepo.Purge(now); err != nil {
+		return err
+	}
+	entries, err := s.repo.DenylistRepo.Active(now)
+	if err != nil {
+		return err
+	}
+	s.revoked.merge(entries, now)
+	return nil
+}
+
+// StartDenylistSync runs SyncDenylist every interval until ctx is cancelled
+func (s *RBACService) StartDenylistSync(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.SyncDenylist(); err != nil {
+					s.logger.WithError(err).Error("Failed to sync token denylist")
+				}
+			}
+		}
+	}()
+}
+
+// RevokeUserAccess makes a change to a user's access take effect now rather than when their
+// token expires: tokens issued so far are denied, their identity provider sessions are ended
+// and an AccessRevokedEvent is sent. Unless only a group was removed, their personal access
+// tokens are deleted too. The denied tokens cannot use cached permissions, so none are purged.
+// The returned error reports a failed logout; the tokens are denied regardless.
+func (s *RBACService) RevokeUserAccess(ctx context.Context, userID, reason string) error {
+	_, err := s.revokeUserAccess(ctx, userID, reason, reason, nil)
+	return err
+}
+
+// RevokeUserTokens denies every token a user holds and ends their sessions, for incident
+// response; note, when given, is recorded as the reason. Failures to save the entry or end the
+// sessions are logged rather than returned, since the tokens are denied on this instance regardless.
+func (s *RBACService) RevokeUserTokens(ctx context.Context, userID, note string) *DenylistEntry {
+	if note == "" {
+		note = RevokedByAdmin
+	}
+	entry, err := s.revokeUserAccess(ctx, userID, RevokedByAdmin, note, nil)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Warn("Failed to end sessions of user whose tokens were revoked")
+	}
+	return entry
+}
+
+func (s *RBACService) revokeUserAccess(ctx context.Context, userID, reason, note string, data map[string]interface{}) (*DenylistEntry, error) {
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": userID, "reason": reason})
+	entry, err := s.deny(ctx, DenySubject, userID, note)
+	if err != nil {
+		// Still enforced by this instance until it restarts
+		logger.WithError(err).Error("Failed to save token revocation")
+	}
+
+	// Personal access tokens outlive the denylist entry, so deactivated users and incident
+	// response lose them for good; a group removal already narrows them to what is left
+	if reason != RevokedGroupRemoved && s.repo.TokenRepo != nil {
+		if err := s.repo.TokenRepo.DeleteForUser(userID); err != nil {
+			logger.WithError(err).Error("Failed to delete personal access tokens")
+		}
+	}
+
+	var logoutErr error
+	if s.sessions != nil {
+		if err := s.sessions.RevokeSessions(ctx, userID); err != nil {
+			logoutErr = fmt.Errorf("end sessions of %s: %w", userID, err)
+		}
+	}
+
+	event := map[string]interface{}{"user_id": userID, "reason": reason, "actor_id": entry.RevokedBy}
+	if note != reason {
+		event["note"] = note
+	}
+	for k, v := range data {
+		event[k] = v
+	}
+	err = s.events.Notify(ctx, notification.Notification{
+		Type:       AccessRevokedEvent,
+		Severity:   notification.SeverityInfo,
+		Subject:    "User access revoked",
+		Message:    fmt.Sprintf("Access of user %s was revoked (%s).", userID, reason),
+		Data:       event,
+		OccurredAt: entry.RevokedAt,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send access revocation event")
+	}
+
+	logger.Info("User access revoked")
+	return entry, logoutErr
+}
+
+// RevokeToken denies a single token by its ID
+func (s *RBACService) RevokeToken(ctx context.Context, tokenID, note string) (*DenylistEntry, error) {
+	if note == "" {
+		note = RevokedByAdmin
+	}
+	entry, err := s.deny(ctx, DenyToken, tokenID, note)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to save token revocation")
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithField("jti", tokenID).Info("Token revoked")
+	return entry, nil
+}
+
+// ListDenylist returns the tokens and users currently denied, most recent first
+func (s *RBACService) ListDenylist() []*DenylistEntry {
+	return s.revoked.list()
+}
+
+// HTTP Handlers
+
+// RevokeUserTokensRequest represents the request to revoke every token of a user
+type RevokeUserTokensRequest struct {
+	Reason string `json:"reason" validate:"max=500"`
+}
+
+// RevokeTokenRequest represents the request to revoke a single token
+type RevokeTokenRequest struct {
+	JTI    string `json:"jti" validate:"required,max=255"`
+	Reason string `json:"reason" validate:"max=500"`
+}
+
+// RevokeUserTokensHandler handles POST /api/rbac/users/{id}/revoke-tokens
+func RevokeUserTokensHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RevokeUserTokensRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+		if err := validate.Struct(req); err != nil {
+			writeServiceError(w, err, "Failed to revoke tokens")
+			return
+		}
+
+		entry := service.RevokeUserTokens(r.Context(), mux.Vars(r)["id"], req.Reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// RevokeTokenHandler handles POST /api/rbac/tokens/revoke
+func RevokeTokenHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RevokeTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+		if err := validate.Struct(req); err != nil {
+			writeServiceError(w, err, "Failed to revoke token")
+			return
+		}
+
+		entry, err := service.RevokeToken(r.Context(), req.JTI, req.Reason)
+		if err != nil {
+			writeServiceError(w, err, "Failed to revoke token")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	}
+}
+
+// GetDenylistHandler handles GET /api/rbac/tokens/denylist
+func GetDenylistHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+		entries := service.ListDenylist()
+		httpapi.WriteList(w, r, httpapi.Paginate(entries, page), len(entries), page)
+	}
+}
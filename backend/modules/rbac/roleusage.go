@@ -0,0 +1,78 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"base-app/pkg/audit"
+)
+
+// RoleUsage is who holds a role: the groups it is assigned to and their members
+type RoleUsage struct {
+	Groups []GroupUsage `json:"groups"`
+	// UserCount is the number of distinct users holding the role through its groups
+	UserCount int `json:"user_count"`
+}
+
+// GroupUsage is a group holding a role and its number of members
+type GroupUsage struct {
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	UserCount int    `json:"user_count"`
+}
+
+// RoleInUseError refuses to delete a role that groups still hold unless the deletion is forced
+type RoleInUseError struct {
+	Usage *RoleUsage
+}
+
+func (e *RoleInUseError) Error() string {
+	return fmt.Sprintf("role is assigned to %d groups with %d users", len(e.Usage.Groups), e.Usage.UserCount)
+}
+
+// roleDeletion is what the audit log records of a deleted role: the role and who held it
+type roleDeletion struct {
+	Role  interface{} `json:"role"`
+	Usage *RoleUsage  `json:"usage"`
+}
+
+// SetConfirmRoleDeletion makes DELETE /api/rbac/roles/{id} refuse to delete roles that groups
+// still hold unless ?force=true is given. Set it before serving requests.
+func (s *RBACService) SetConfirmRoleDeletion(enabled bool) {
+	s.confirmRoleDeletion = enabled
+}
+
+// IsForced reports whether r confirms with ?force=true a change that would otherwise be refused
+func IsForced(r *http.Request) bool {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	return force
+}
+
+// auditRefusedDeletion records a role deletion refused with a RoleInUseError, with who held the
+// role; the role is unchanged so it is both the before and the after of the entry
+func (s *RBACService) auditRefusedDeletion(ctx context.Context, role *Role, err error) {
+	var inUse *RoleInUseError
+	if errors.As(err, &inUse) {
+		refused := roleDeletion{Role: role, Usage: inUse.Usage}
+		s.audit(ctx, audit.ActionDeleteRefused, AuditRole, role.ID, refused, refused)
+	}
+}
+
+// writeRoleInUse writes the 409 response of a refused role deletion, listing who holds the role
+func writeRoleInUse(w http.ResponseWriter, inUse *RoleInUseError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+		*RoleUsage
+	}{
+		Error:     "Role is assigned to groups; delete it with force=true to remove it from them",
+		Code:      "ROLE_IN_USE",
+		RoleUsage: inUse.Usage,
+	})
+}
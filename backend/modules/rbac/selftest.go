@@ -0,0 +1,198 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"base-app/pkg/perm"
+
+	"github.com/google/uuid"
+)
+
+// selfTestPermission is the permission the self-test grants its temporary role; a harmless
+// read permission, since the caller briefly holds it through the temporary group
+const selfTestPermission = perm.ReadPermission
+
+// Self-test steps, in the order they run
+const (
+	StepCreateRole      = "create_role"
+	StepGrantPermission = "grant_permission"
+	StepCreateGroup     = "create_group"
+	StepAssignRole      = "assign_role"
+	StepAddMember       = "add_member"
+	StepCheckAuthorized = "check_authorization"
+	StepRemoveMember    = "remove_member"
+	StepDeleteGroup     = "delete_group"
+	StepDeleteRole      = "delete_role"
+	StepCheckCleanedUp  = "check_cleaned_up"
+)
+
+// selfTestNamePrefix starts the names of the temporary role and group
+const selfTestNamePrefix = "selftest-"
+
+// selfTestStepTimeout bounds each step, so a hung database fails the run instead of the request
+const selfTestStepTimeout = 10 * time.Second
+
+// SelfTestStep is the outcome of one step
+type SelfTestStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	// Skipped marks steps not run because an earlier one failed
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// SelfTestReport is the result of a self-test run
+type SelfTestReport struct {
+	OK         bool           `json:"ok"`
+	StartedAt  time.Time      `json:"started_at"`
+	DurationMS int64          `json:"duration_ms"`
+	Steps      []SelfTestStep `json:"steps"`
+}
+
+// selfTest runs steps, skipping the rest of the scenario after a failure; cleanup steps run
+// whenever what they clean up was created
+type selfTest struct {
+	report SelfTestReport
+	failed bool
+}
+
+// step runs fn as the step called name, unless an earlier step failed and always is false
+func (t *selfTest) step(ctx context.Context, name string, always bool, fn func(ctx context.Context) error) {
+	if t.failed && !always {
+		t.report.Steps = append(t.report.Steps, SelfTestStep{Name: name, Skipped: true})
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, selfTestStepTimeout)
+	defer cancel()
+	started := time.Now()
+	err := fn(ctx)
+	result := SelfTestStep{Name: name, OK: err == nil, DurationMS: time.Since(started).Milliseconds()}
+	if err != nil {
+		result.Error = err.Error()
+		t.failed = true
+	}
+	t.report.Steps = append(t.report.Steps, result)
+}
+
+// SelfTest exercises the authorization path end to end against the live database: it creates
+// a temporary role granting a permission, puts it in a temporary group, adds the caller to the
+// group, checks the caller's permissions come out of it, and removes everything again. Removing
+// the temporary membership does not revoke the caller's sessions.
+func (s *RBACService) SelfTest(ctx context.Context, userID string) *SelfTestReport {
+	t := &selfTest{report: SelfTestReport{StartedAt: time.Now()}}
+	suffix := uuid.New().String()[:8]
+	var role *Role
+	var group *RoleGroup
+	member := false
+
+	t.step(ctx, StepCreateRole, false, func(ctx context.Context) (err error) {
+		role, err = s.CreateRole(ctx, CreateRoleRequest{Name: selfTestNamePrefix + suffix, Description: "Temporary role of a self-test run"})
+		return err
+	})
+	t.step(ctx, StepGrantPermission, false, func(ctx context.Context) error {
+		permissions, err := s.ListPermissions()
+		if err != nil {
+			return err
+		}
+		for _, p := range permissions {
+			if p.Key == string(selfTestPermission) {
+				return s.AssignPermissionsToRole(ctx, role.ID, AssignPermissionsToRoleRequest{PermissionIDs: []string{p.ID}})
+			}
+		}
+		return fmt.Errorf("permission %s is not in the catalog", selfTestPermission)
+	})
+	t.step(ctx, StepCreateGroup, false, func(ctx context.Context) (err error) {
+		group, err = s.CreateRoleGroup(ctx, CreateRoleGroupRequest{Name: selfTestNamePrefix + suffix, Description: "Temporary group of a self-test run"})
+		return err
+	})
+	t.step(ctx, StepAssignRole, false, func(ctx context.Context) error {
+		return s.AssignRolesToGroup(ctx, group.ID, AssignRolesToGroupRequest{RoleIDs: []string{role.ID}})
+	})
+	t.step(ctx, StepAddMember, false, func(ctx context.Context) error {
+		if err := s.AssignUserToGroup(ctx, group.ID, AssignUserToGroupRequest{UserID: userID}); err != nil {
+			return err
+		}
+		member = true
+		return nil
+	})
+	t.step(ctx, StepCheckAuthorized, false, func(ctx context.Context) error {
+		userPerms, err := s.GetUserPermissions(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for _, roleID := range userPerms.grants[string(selfTestPermission)] {
+			if roleID == role.ID {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not granted through the temporary role", selfTestPermission)
+	})
+
+	// Clean up whatever was created, even after a failure
+	if member {
+		t.step(ctx, StepRemoveMember, true, func(ctx context.Context) error {
+			return s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+				if err := repos.MembershipRepo.Delete(userID, group.ID); err != nil {
+					return err
+				}
+				return repos.HistoryRepo.Record(&MembershipEvent{
+					GroupID:    group.ID,
+					UserID:     userID,
+					Action:     MembershipRemoved,
+					ActorID:    userID,
+					OccurredAt: time.Now(),
+				})
+			})
+		})
+	}
+	if group != nil {
+		t.step(ctx, StepDeleteGroup, true, func(ctx context.Context) error {
+			return s.DeleteRoleGroup(ctx, group.ID)
+		})
+	}
+	if role != nil {
+		t.step(ctx, StepDeleteRole, true, func(ctx context.Context) error {
+			return s.DeleteRole(ctx, role.ID)
+		})
+		t.step(ctx, StepCheckCleanedUp, true, func(ctx context.Context) error {
+			leftover, err := s.repo.RoleRepo.GetByID(role.ID)
+			if err != nil {
+				return err
+			}
+			if leftover != nil {
+				return fmt.Errorf("temporary role %s is still there", role.Name)
+			}
+			return nil
+		})
+	}
+
+	t.report.OK = !t.failed
+	t.report.DurationMS = time.Since(t.report.StartedAt).Milliseconds()
+	entry := s.logger.WithContext(ctx).WithField("duration_ms", t.report.DurationMS)
+	if t.report.OK {
+		entry.Info("Self-test passed")
+	} else {
+		entry.WithField("steps", t.report.Steps).Error("Self-test failed")
+	}
+	return &t.report
+}
+
+// SelfTestHandler runs a self-test as the caller and answers the report: 200 when it passed,
+// 503 when a step failed, for post-deploy checks
+func SelfTestHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := service.SelfTest(r.Context(), getUserIDFromContext(r.Context()))
+		status := http.StatusOK
+		if !report.OK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,440 @@
+package rbac
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/quota"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// TemplateNamePlaceholder is replaced in a template's name pattern and description by the name
+// given when instantiating it
+const TemplateNamePlaceholder = "{name}"
+
+// GroupTemplate is a reusable access bundle; instantiating it creates a role group holding its roles
+type GroupTemplate struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	NamePattern string    `json:"name_pattern"`
+	Description string    `json:"description"`
+	RoleIDs     []string  `json:"role_ids"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// GroupTemplateRequest represents the request to create or replace a group template
+type GroupTemplateRequest struct {
+	Name        string   `json:"name" validate:"required,min=2,max=50"`
+	NamePattern string   `json:"name_pattern" validate:"required,max=100,contains={name}"`
+	Description string   `json:"description"`
+	RoleIDs     []string `json:"role_ids" validate:"required,min=1,uuid_list"`
+}
+
+// InstantiateGroupTemplateRequest represents the request to create a group from a template
+type InstantiateGroupTemplateRequest struct {
+	Name string `json:"name" validate:"required,max=50"`
+}
+
+// GroupTemplateRepository stores group templates and their roles
+type GroupTemplateRepository interface {
+	Create(template *GroupTemplate) error
+	GetByID(id string) (*GroupTemplate, error)
+	GetByName(name string) (*GroupTemplate, error)
+	List() ([]*GroupTemplate, error)
+	// Update replaces the template's fields and roles
+	Update(template *GroupTemplate) error
+	Delete(id string) error
+}
+
+// groupTemplateRepository implements GroupTemplateRepository
+type groupTemplateRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+// groupTemplateSelect loads templates with their role IDs; append a WHERE clause before groupTemplateGroupBy
+const (
+	groupTemplateSelect = `SELECT t.id, t.name, t.name_pattern, t.description, t.created_at,
+	          COALESCE(array_agg(tr.role_id::text ORDER BY tr.role_id) FILTER (WHERE tr.role_id IS NOT NULL), '{}')
+	          FROM group_templates t
+	          LEFT JOIN group_template_roles tr ON tr.template_id = t.id`
+	groupTemplateGroupBy = ` GROUP BY t.id, t.name, t.name_pattern, t.description, t.created_at`
+)
+
+func scanGroupTemplate(row database.Scanner) (*GroupTemplate, error) {
+	template := &GroupTemplate{}
+	var roleIDs pq.StringArray
+	err := row.Scan(&template.ID, &template.Name, &template.NamePattern, &template.Description, &template.CreatedAt, &roleIDs)
+	template.RoleIDs = []string(roleIDs)
+	return template, err
+}
+
+func (r *groupTemplateRepository) Create(template *GroupTemplate) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		query := `INSERT INTO group_templates (id, name, name_pattern, description, created_at) VALUES ($1, $2, $3, $4, $5)`
+		if _, err := tx.Exec(query, template.ID, template.Name, template.NamePattern, template.Description, template.CreatedAt); err != nil {
+			return err
+		}
+		return insertTemplateRoles(tx, template)
+	})
+}
+
+func (r *groupTemplateRepository) get(where string, arg interface{}) (*GroupTemplate, error) {
+	template, err := scanGroupTemplate(r.db.QueryRow(groupTemplateSelect+` WHERE `+where+groupTemplateGroupBy, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return template, err
+}
+
+func (r *groupTemplateRepository) GetByID(id string) (*GroupTemplate, error) {
+	return r.get(`t.id = $1`, id)
+}
+
+func (r *groupTemplateRepository) GetByName(name string) (*GroupTemplate, error) {
+	return r.get(`t.name = $1`, name)
+}
+
+func (r *groupTemplateRepository) List() ([]*GroupTemplate, error) {
+	return database.QueryAll(r.reader, "list group templates", scanGroupTemplate, groupTemplateSelect+groupTemplateGroupBy+` ORDER BY t.name`)
+}
+
+func (r *groupTemplateRepository) Update(template *GroupTemplate) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		query := `UPDATE group_templates SET name = $2, name_pattern = $3, description = $4 WHERE id = $1`
+		if _, err := tx.Exec(query, template.ID, template.Name, template.NamePattern, template.Description); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM group_template_roles WHERE template_id = $1`, template.ID); err != nil {
+			return err
+		}
+		return insertTemplateRoles(tx, template)
+	})
+}
+
+func (r *groupTemplateRepository) Delete(id string) error {
+	_, err := r.db.Exec(`DELETE FROM group_templates WHERE id = $1`, id)
+	return err
+}
+
+func insertTemplateRoles(tx database.DBTX, template *GroupTemplate) error {
+	for _, roleID := range template.RoleIDs {
+		query := `INSERT INTO group_template_roles (template_id, role_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		if _, err := tx.Exec(query, template.ID, roleID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupTemplateUniqueConstraints maps unique constraints of group_templates to the request field they guard
+var groupTemplateUniqueConstraints = map[string]string{"group_templates_name_key": "name"}
+
+// validateGroupTemplate checks req and that its name and roles are free and exist; id is the
+// template being replaced, empty on creation
+func (s *RBACService) validateGroupTemplate(id string, req GroupTemplateRequest) error {
+	if err := s.checkListSize("role_ids", len(req.RoleIDs)); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		s.logger.WithError(err).Warn("Group template validation failed")
+		return err
+	}
+	if existing, _ := s.repo.TemplateRepo.GetByName(req.Name); existing != nil && existing.ID != id {
+		return &ValidationError{Field: "name", Message: "already exists"}
+	}
+
+	missing, err := s.repo.RoleRepo.FindMissingIDs(req.RoleIDs)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to validate role IDs")
+		return err
+	}
+	if len(missing) > 0 {
+		return &ValidationError{Field: "role_ids", Message: "roles not found: " + strings.Join(missing, ", ")}
+	}
+	return nil
+}
+
+// CreateGroupTemplate creates a new group template
+func (s *RBACService) CreateGroupTemplate(ctx context.Context, req GroupTemplateRequest) (*GroupTemplate, error) {
+	if err := s.validateGroupTemplate("", req); err != nil {
+		return nil, err
+	}
+
+	template := &GroupTemplate{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		NamePattern: req.NamePattern,
+		Description: req.Description,
+		RoleIDs:     req.RoleIDs,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.repo.TemplateRepo.Create(template); err != nil {
+		if dupErr := uniqueViolationError(err, groupTemplateUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		s.logger.WithError(err).Error("Failed to create group template")
+		return nil, err
+	}
+
+	s.audit(ctx, audit.ActionCreate, AuditTemplate, template.ID, nil, template)
+	s.logger.WithField("template_id", template.ID).Info("Group template created successfully")
+	return template, nil
+}
+
+// GetGroupTemplate retrieves a group template by ID
+func (s *RBACService) GetGroupTemplate(id string) (*GroupTemplate, error) {
+	template, err := s.repo.TemplateRepo.GetByID(id)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to get group template")
+		return nil, err
+	}
+	if template == nil {
+		return nil, apperrors.NotFound("GROUP_TEMPLATE_NOT_FOUND", "group template not found")
+	}
+	return template, nil
+}
+
+// ListGroupTemplates retrieves all group templates
+func (s *RBACService) ListGroupTemplates() ([]*GroupTemplate, error) {
+	templates, err := s.repo.TemplateRepo.List()
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list group templates")
+		return nil, err
+	}
+	return templates, nil
+}
+
+// UpdateGroupTemplate replaces a group template. Groups created from it earlier keep their roles.
+func (s *RBACService) UpdateGroupTemplate(ctx context.Context, id string, req GroupTemplateRequest) (*GroupTemplate, error) {
+	template, err := s.GetGroupTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.validateGroupTemplate(id, req); err != nil {
+		return nil, err
+	}
+
+	before := *template
+	template.Name = req.Name
+	template.NamePattern = req.NamePattern
+	template.Description = req.Description
+	template.RoleIDs = req.RoleIDs
+	if err := s.repo.TemplateRepo.Update(template); err != nil {
+		if dupErr := uniqueViolationError(err, groupTemplateUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		s.logger.WithError(err).Error("Failed to update group template")
+		return nil, err
+	}
+
+	s.audit(ctx, audit.ActionUpdate, AuditTemplate, id, before, template)
+	s.logger.WithField("template_id", id).Info("Group template updated successfully")
+	return template, nil
+}
+
+// DeleteGroupTemplate deletes a group template; groups created from it are kept
+func (s *RBACService) DeleteGroupTemplate(ctx context.Context, id string) error {
+	template, err := s.GetGroupTemplate(id)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.TemplateRepo.Delete(id); err != nil {
+		s.logger.WithError(err).Error("Failed to delete group template")
+		return err
+	}
+
+	s.audit(ctx, audit.ActionDelete, AuditTemplate, id, template, nil)
+	s.logger.WithField("template_id", id).Info("Group template deleted successfully")
+	return nil
+}
+
+// InstantiateGroupTemplate creates a role group from a template, naming it after the template's
+// pattern, and assigns the template's roles to it in the same transaction
+func (s *RBACService) InstantiateGroupTemplate(ctx context.Context, id string, req InstantiateGroupTemplateRequest) (*RoleGroup, error) {
+	logger := s.logger.WithContext(ctx)
+	if err := validate.Struct(req); err != nil {
+		logger.WithError(err).Warn("Group template instantiation validation failed")
+		return nil, err
+	}
+	template, err := s.GetGroupTemplate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	group := CreateRoleGroupRequest{
+		Name:        strings.ReplaceAll(template.NamePattern, TemplateNamePlaceholder, req.Name),
+		Description: strings.ReplaceAll(template.Description, TemplateNamePlaceholder, req.Name),
+	}
+	if err := validate.Struct(group); err != nil {
+		var fieldErrs validator.ValidationErrors
+		if errors.As(err, &fieldErrs) {
+			return nil, &ValidationError{Field: "name", Message: "group name " + group.Name + " " + validationErrorDetails(fieldErrs)["name"]}
+		}
+		return nil, err
+	}
+	if existing, _ := s.repo.GroupRepo.GetByName(group.Name); existing != nil {
+		return nil, &ValidationError{Field: "name", Message: "group " + group.Name + " already exists"}
+	}
+
+	if err := s.checkQuota(ctx, quota.Groups); err != nil {
+		return nil, err
+	}
+
+	created := &RoleGroup{
+		ID:          uuid.New().String(),
+		Name:        group.Name,
+		Description: group.Description,
+		CreatedAt:   time.Now(),
+	}
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.GroupRepo.Create(created); err != nil {
+			return err
+		}
+		return repos.GroupRoleRepo.AssignRolesToGroup(created.ID, template.RoleIDs)
+	})
+	if err != nil {
+		if dupErr := uniqueViolationError(err, groupUniqueConstraints); dupErr != err {
+			return nil, dupErr
+		}
+		logger.WithError(err).Error("Failed to instantiate group template")
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"template_id": id,
+		"group_id":    created.ID,
+		"roles":       template.RoleIDs,
+	}).Info("Role group created from template successfully")
+	s.audit(ctx, audit.ActionCreate, AuditGroup, created.ID, nil, created)
+	return created, nil
+}
+
+// HTTP Handlers
+
+// groupTemplateBody decodes a GroupTemplateRequest, writing a 400 when the body is malformed
+func groupTemplateBody(w http.ResponseWriter, r *http.Request) (GroupTemplateRequest, bool) {
+	var req GroupTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+		return req, false
+	}
+	return req, true
+}
+
+// CreateGroupTemplateHandler handles POST /api/rbac/group-templates
+func CreateGroupTemplateHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := groupTemplateBody(w, r)
+		if !ok {
+			return
+		}
+
+		template, err := service.CreateGroupTemplate(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to create group template")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(template)
+	}
+}
+
+// GetGroupTemplatesHandler handles GET /api/rbac/group-templates
+func GetGroupTemplatesHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		templates, err := service.ListGroupTemplates()
+		if err != nil {
+			writeServiceError(w, err, "Failed to list group templates")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(templates, page), len(templates), page)
+	}
+}
+
+// GetGroupTemplateHandler handles GET /api/rbac/group-templates/{id}
+func GetGroupTemplateHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		template, err := service.GetGroupTemplate(mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to get group template")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(template)
+	}
+}
+
+// UpdateGroupTemplateHandler handles PUT /api/rbac/group-templates/{id}
+func UpdateGroupTemplateHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, ok := groupTemplateBody(w, r)
+		if !ok {
+			return
+		}
+
+		template, err := service.UpdateGroupTemplate(r.Context(), mux.Vars(r)["id"], req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to update group template")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(template)
+	}
+}
+
+// DeleteGroupTemplateHandler handles DELETE /api/rbac/group-templates/{id}
+func DeleteGroupTemplateHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeleteGroupTemplate(r.Context(), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete group template")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// InstantiateGroupTemplateHandler handles POST /api/rbac/group-templates/{id}/instantiate
+func InstantiateGroupTemplateHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req InstantiateGroupTemplateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		group, err := service.InstantiateGroupTemplate(r.Context(), mux.Vars(r)["id"], req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to create group from template")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(groupResource(group))
+	}
+}
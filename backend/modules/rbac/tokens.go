@@ -0,0 +1,347 @@
+package rbac
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/database"
+	"base-app/pkg/dberrors"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/quota"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Personal access tokens let users script against the API as themselves. Each token is scoped to
+// a subset of its owner's permissions and is sent as a bearer token like a Keycloak token; the
+// caller gets the permissions the token and its owner both hold, so losing a role also narrows
+// the tokens. Only a hash of each token is stored.
+
+// PersonalTokenPrefix starts every personal access token, telling them apart from JWTs
+const PersonalTokenPrefix = "pat_"
+
+// PersonalTokenClient is the client ID reported for requests made with a personal access token
+const PersonalTokenClient = "personal_access_token"
+
+// Token expiry bounds, in days
+const (
+	DefaultPersonalTokenDays = 90
+	MaxPersonalTokenDays     = 365
+)
+
+// lastUsedPrecision is how stale a token's last use may get before it is written again, so busy
+// scripts do not write on every request
+const lastUsedPrecision = time.Minute
+
+// PersonalToken is a personal access token without its secret
+type PersonalToken struct {
+	ID       string `json:"id"`
+	UserID   string `json:"user_id"`
+	Username string `json:"-"`
+	Name     string `json:"name"`
+	// Prefix is the start of the token, to recognise it by
+	Prefix      string     `json:"prefix"`
+	Permissions []string   `json:"permissions"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CreatedPersonalToken is a new token with its secret, which is only ever returned here
+type CreatedPersonalToken struct {
+	*PersonalToken
+	Token string `json:"token"`
+}
+
+// CreatePersonalTokenRequest represents the request to create a personal access token.
+// ExpiresInDays defaults to DefaultPersonalTokenDays.
+type CreatePersonalTokenRequest struct {
+	Name          string   `json:"name" validate:"required,min=1,max=100"`
+	Permissions   []string `json:"permissions" validate:"required,min=1,max=100,dive,required,max=100"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"min=0,max=365"`
+}
+
+// PersonalTokenRepository stores personal access tokens by the hash of their secret
+type PersonalTokenRepository interface {
+	Create(token *PersonalToken, hash string) error
+	// GetByHash returns the token whose secret hashes to hash, or nil
+	GetByHash(hash string) (*PersonalToken, error)
+	ListForUser(userID string) ([]*PersonalToken, error)
+	// Delete deletes a token of userID and reports whether it existed
+	Delete(userID, id string) (bool, error)
+	DeleteForUser(userID string) error
+	Touch(id string, at time.Time) error
+}
+
+// personalTokenRepository implements PersonalTokenRepository
+type personalTokenRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+const personalTokenSelect = `SELECT id, user_id, username, name, prefix, permissions, expires_at, last_used_at, created_at
+	          FROM personal_access_tokens`
+
+func scanPersonalToken(row database.Scanner) (*PersonalToken, error) {
+	token := &PersonalToken{}
+	var lastUsedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.UserID, &token.Username, &token.Name, &token.Prefix,
+		pq.Array(&token.Permissions), &token.ExpiresAt, &lastUsedAt, &token.CreatedAt)
+	if lastUsedAt.Valid {
+		token.LastUsedAt = &lastUsedAt.Time
+	}
+	return token, err
+}
+
+func (r *personalTokenRepository) Create(token *PersonalToken, hash string) error {
+	query := `INSERT INTO personal_access_tokens (id, user_id, username, name, prefix, token_hash, permissions, expires_at, created_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := r.db.Exec(query, token.ID, token.UserID, token.Username, token.Name, token.Prefix, hash,
+		pq.Array(token.Permissions), token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+func (r *personalTokenRepository) GetByHash(hash string) (*PersonalToken, error) {
+	// Read from the primary: a token is typically used right after it was created
+	token, err := scanPersonalToken(r.db.QueryRow(personalTokenSelect+` WHERE token_hash = $1`, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return token, err
+}
+
+func (r *personalTokenRepository) ListForUser(userID string) ([]*PersonalToken, error) {
+	return database.QueryAll(r.reader, "list personal access tokens", scanPersonalToken,
+		personalTokenSelect+` WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+}
+
+func (r *personalTokenRepository) Delete(userID, id string) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (r *personalTokenRepository) DeleteForUser(userID string) error {
+	_, err := r.db.Exec(`DELETE FROM personal_access_tokens WHERE user_id = $1`, userID)
+	return err
+}
+
+func (r *personalTokenRepository) Touch(id string, at time.Time) error {
+	_, err := r.db.Exec(`UPDATE personal_access_tokens SET last_used_at = $2 WHERE id = $1`, id, at)
+	return err
+}
+
+// hashPersonalToken returns the stored form of a token secret
+func hashPersonalToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// parsePersonalToken authenticates a personal access token. The claims carry the token's ID as
+// jti and its creation as issue time, so the denylist applies to it like to any other token.
+func (s *RBACService) parsePersonalToken(secret string) (*JWTClaims, *authFailure) {
+	token, err := s.repo.TokenRepo.GetByHash(hashPersonalToken(secret))
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to look up personal access token")
+		status := http.StatusInternalServerError
+		if dberrors.IsUnavailable(err) {
+			status = http.StatusServiceUnavailable
+		}
+		return nil, &authFailure{status, "Failed to verify token", "TOKEN_LOOKUP_ERROR", nil}
+	}
+	if token == nil {
+		return nil, &authFailure{http.StatusUnauthorized, "Invalid token", "INVALID_TOKEN", nil}
+	}
+	now := time.Now()
+	if !token.ExpiresAt.After(now) {
+		return nil, &authFailure{http.StatusUnauthorized, "Token has expired", "TOKEN_EXPIRED", nil}
+	}
+
+	claims := &JWTClaims{
+		UserID:   token.UserID,
+		Username: token.Username,
+		ClientID: PersonalTokenClient,
+		scopes:   token.Permissions,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        token.ID,
+			IssuedAt:  jwt.NewNumericDate(token.CreatedAt),
+			ExpiresAt: jwt.NewNumericDate(token.ExpiresAt),
+		},
+	}
+	if s.revoked.revokes(claims) {
+		return nil, &authFailure{http.StatusUnauthorized, "Session has been revoked", "SESSION_REVOKED", nil}
+	}
+
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) >= lastUsedPrecision {
+		if err := s.repo.TokenRepo.Touch(token.ID, now); err != nil {
+			s.logger.WithError(err).WithField("token_id", token.ID).Warn("Failed to record personal access token use")
+		}
+	}
+	return claims, nil
+}
+
+// scopePermissions keeps the permissions a personal access token was granted; tokens from
+// Keycloak carry no scopes and keep every permission
+func scopePermissions(permissionNames []string, claims *JWTClaims) []string {
+	if claims.scopes == nil {
+		return permissionNames
+	}
+	var scoped []string
+	for _, name := range permissionNames {
+		if hasPermission(claims.scopes, name) {
+			scoped = append(scoped, name)
+		}
+	}
+	return scoped
+}
+
+// CreatePersonalToken mints a token for the caller in ctx. The caller must hold every permission
+// requested, so a token never grants more than its owner has.
+func (s *RBACService) CreatePersonalToken(ctx context.Context, req CreatePersonalTokenRequest) (*CreatedPersonalToken, error) {
+	logger := s.logger.WithContext(ctx)
+	if err := validate.Struct(req); err != nil {
+		logger.WithError(err).Warn("Personal access token validation failed")
+		return nil, err
+	}
+	held := getUserPermissionsFromContext(ctx)
+	for _, name := range req.Permissions {
+		if !hasPermission(held, name) {
+			return nil, apperrors.Forbidden("PERMISSION_NOT_HELD", fmt.Sprintf("You do not hold permission %s", name))
+		}
+	}
+	if err := s.checkQuota(ctx, quota.APIKeys); err != nil {
+		return nil, err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	secret := PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(random)
+	days := req.ExpiresInDays
+	if days == 0 {
+		days = DefaultPersonalTokenDays
+	}
+	username, _ := ctx.Value(UsernameKey).(string)
+	now := time.Now()
+	token := &PersonalToken{
+		ID:          uuid.New().String(),
+		UserID:      getUserIDFromContext(ctx),
+		Username:    username,
+		Name:        req.Name,
+		Prefix:      secret[:len(PersonalTokenPrefix)+6],
+		Permissions: req.Permissions,
+		ExpiresAt:   now.AddDate(0, 0, days),
+		CreatedAt:   now,
+	}
+	if err := s.repo.TokenRepo.Create(token, hashPersonalToken(secret)); err != nil {
+		logger.WithError(err).Error("Failed to create personal access token")
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"token_id":    token.ID,
+		"user_id":     token.UserID,
+		"permissions": token.Permissions,
+		"expires_at":  token.ExpiresAt,
+	}).Info("Personal access token created")
+	s.audit(ctx, audit.ActionCreate, AuditToken, token.ID, nil, token)
+	return &CreatedPersonalToken{PersonalToken: token, Token: secret}, nil
+}
+
+// ListPersonalTokens lists a user's tokens, newest first
+func (s *RBACService) ListPersonalTokens(userID string) ([]*PersonalToken, error) {
+	tokens, err := s.repo.TokenRepo.ListForUser(userID)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to list personal access tokens")
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// DeletePersonalToken revokes one of the caller's tokens
+func (s *RBACService) DeletePersonalToken(ctx context.Context, id string) error {
+	userID := getUserIDFromContext(ctx)
+	found, err := s.repo.TokenRepo.Delete(userID, id)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to delete personal access token")
+		return err
+	}
+	if !found {
+		return apperrors.NotFound("TOKEN_NOT_FOUND", "personal access token not found")
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"token_id": id, "user_id": userID}).Info("Personal access token deleted")
+	s.audit(ctx, audit.ActionDelete, AuditToken, id, &PersonalToken{ID: id, UserID: userID}, nil)
+	return nil
+}
+
+// HTTP Handlers
+
+// CreatePersonalTokenHandler handles POST /api/users/me/tokens
+func CreatePersonalTokenHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreatePersonalTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		token, err := service.CreatePersonalToken(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to create token")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(token)
+	}
+}
+
+// GetPersonalTokensHandler handles GET /api/users/me/tokens
+func GetPersonalTokensHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		tokens, err := service.ListPersonalTokens(getUserIDFromContext(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to list tokens")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(tokens, page), len(tokens), page)
+	}
+}
+
+// DeletePersonalTokenHandler handles DELETE /api/users/me/tokens/{id}
+func DeletePersonalTokenHandler(service *RBACService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeletePersonalToken(r.Context(), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete token")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
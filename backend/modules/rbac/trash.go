@@ -0,0 +1,301 @@
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/labels"
+	"base-app/pkg/perm"
+	"base-app/pkg/quota"
+	"base-app/pkg/trash"
+)
+
+// Kinds of RBAC entities in the trash
+const (
+	TrashKindRole  = "role"
+	TrashKindGroup = "group"
+)
+
+// roleSnapshot is what a trashed role is restored from
+type roleSnapshot struct {
+	Role          *Role    `json:"role"`
+	PermissionIDs []string `json:"permission_ids"`
+	GroupIDs      []string `json:"group_ids"`
+	// Scope is the resource the role was scoped to, if any
+	Scope string `json:"scope,omitempty"`
+}
+
+// groupSnapshot is what a trashed role group is restored from
+type groupSnapshot struct {
+	Group   *RoleGroup             `json:"group"`
+	RoleIDs []string               `json:"role_ids"`
+	Members []*UserGroupMembership `json:"members"`
+}
+
+// SetTrash keeps deleted roles and groups in bin, restorable with their permissions, role
+// assignments and members until they are purged. Set it before serving requests.
+func (s *RBACService) SetTrash(bin *trash.Bin) {
+	s.trash = bin
+	bin.Register(trash.Kind{
+		Name: TrashKindRole, Permission: perm.DeleteRole, Restore: s.restoreRole,
+		Purge: func(_ context.Context, item *trash.Item) error {
+			s.forgetLabels(labels.KindRole, item.EntityID)
+			return nil
+		},
+	})
+	bin.Register(trash.Kind{
+		Name: TrashKindGroup, Permission: perm.DeleteGroup, Restore: s.restoreRoleGroup,
+		Purge: func(_ context.Context, item *trash.Item) error {
+			s.forgetLabels(labels.KindGroup, item.EntityID)
+			return nil
+		},
+	})
+}
+
+// TrashRole deletes a role, keeping it in the trash when one is configured. Unless force is set,
+// it refuses with a RoleInUseError to delete a role that groups hold when deletions must be
+// confirmed, recording the refusal in the audit log.
+func (s *RBACService) TrashRole(ctx context.Context, id string, force bool) error {
+	role, err := s.repo.RoleRepo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if role == nil {
+		return apperrors.NotFound("ROLE_NOT_FOUND", "role not found")
+	}
+	if s.trash == nil {
+		return s.removeRole(ctx, role, force)
+	}
+
+	snapshot := roleSnapshot{Role: role}
+	permissions, err := s.repo.RolePermRepo.GetRolePermissions(id)
+	if err != nil {
+		return err
+	}
+	for _, p := range permissions {
+		snapshot.PermissionIDs = append(snapshot.PermissionIDs, p.ID)
+	}
+	if snapshot.GroupIDs, err = s.repo.GroupRoleRepo.GetRoleGroupIDs(id); err != nil {
+		return err
+	}
+	scope, err := s.repo.ScopeRepo.Get(id)
+	if err != nil {
+		return err
+	}
+	if scope != nil {
+		snapshot.Scope = scope.Resource
+	}
+
+	item, err := s.trash.Put(ctx, TrashKindRole, id, role.Name, getUserIDFromContext(ctx), snapshot)
+	if err != nil {
+		return err
+	}
+	usage, err := s.deleteRole(ctx, id, force)
+	if err != nil {
+		s.trash.Discard(ctx, item)
+		s.auditRefusedDeletion(ctx, role, err)
+		return err
+	}
+	s.audit(ctx, audit.ActionDelete, AuditRole, id, roleDeletion{Role: snapshot, Usage: usage}, nil)
+
+	s.logger.WithContext(ctx).WithField("role_id", id).Info("Role moved to the trash")
+	return nil
+}
+
+// TrashRoleGroup deletes a role group, keeping it in the trash when one is configured
+func (s *RBACService) TrashRoleGroup(ctx context.Context, id string) error {
+	if s.trash == nil {
+		return s.DeleteRoleGroup(ctx, id)
+	}
+	group, err := s.repo.GroupRepo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return apperrors.NotFound("GROUP_NOT_FOUND", "role group not found")
+	}
+
+	snapshot := groupSnapshot{Group: group}
+	roles, err := s.repo.GroupRoleRepo.GetGroupRoles(id)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		snapshot.RoleIDs = append(snapshot.RoleIDs, role.ID)
+	}
+	if snapshot.Members, err = s.repo.MembershipRepo.ListGroupMemberships(id); err != nil {
+		return err
+	}
+
+	item, err := s.trash.Put(ctx, TrashKindGroup, id, group.Name, getUserIDFromContext(ctx), snapshot)
+	if err != nil {
+		return err
+	}
+	if err := s.deleteRoleGroup(ctx, id); err != nil {
+		s.trash.Discard(ctx, item)
+		return err
+	}
+	s.audit(ctx, audit.ActionDelete, AuditGroup, id, snapshot, nil)
+
+	s.logger.WithContext(ctx).WithField("group_id", id).Info("Role group moved to the trash")
+	return nil
+}
+
+// restoreRole recreates a trashed role with the permissions and group assignments that still exist
+func (s *RBACService) restoreRole(ctx context.Context, item *trash.Item) error {
+	var snapshot roleSnapshot
+	if err := json.Unmarshal(item.Data, &snapshot); err != nil || snapshot.Role == nil {
+		return apperrors.Internal("TRASH_ITEM_CORRUPT", "The trashed role cannot be read", err)
+	}
+	role := snapshot.Role
+	if role.Key == "" {
+		// Trashed before roles had keys
+		role.Key = roleKey(role.Name)
+	}
+	if existing, err := s.repo.RoleRepo.GetByName(role.Name); err != nil {
+		return err
+	} else if existing != nil {
+		return apperrors.Conflict("ROLE_NAME_TAKEN", "Another role is now named "+role.Name)
+	}
+	if err := s.checkQuota(ctx, quota.Roles); err != nil {
+		return err
+	}
+
+	permissionIDs, err := s.existing(snapshot.PermissionIDs, s.repo.PermissionRepo.FindMissingIDs)
+	if err != nil {
+		return err
+	}
+	var groupIDs []string
+	for _, groupID := range snapshot.GroupIDs {
+		group, err := s.repo.GroupRepo.GetByID(groupID)
+		if err != nil {
+			return err
+		}
+		if group != nil {
+			groupIDs = append(groupIDs, groupID)
+		}
+	}
+
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.RoleRepo.Create(role); err != nil {
+			if dupErr := uniqueViolationError(err, roleUniqueConstraints); dupErr != err {
+				return dupErr
+			}
+			return err
+		}
+		// The scope is restored before the permissions so they never grant beyond it
+		if snapshot.Scope != "" {
+			scope := &RoleScope{RoleID: role.ID, Resource: snapshot.Scope, UpdatedBy: getUserIDFromContext(ctx), UpdatedAt: time.Now()}
+			if err := repos.ScopeRepo.Set(scope); err != nil {
+				return err
+			}
+		}
+		if len(permissionIDs) > 0 {
+			if err := repos.RolePermRepo.AssignPermissionsToRole(role.ID, permissionIDs); err != nil {
+				return err
+			}
+		}
+		for _, groupID := range groupIDs {
+			if err := repos.GroupRoleRepo.AssignRolesToGroup(groupID, []string{role.ID}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.accessChanged(ctx)
+	s.audit(ctx, audit.ActionRestore, AuditRole, role.ID, nil, roleSnapshot{Role: role, PermissionIDs: permissionIDs, GroupIDs: groupIDs, Scope: snapshot.Scope})
+	return nil
+}
+
+// restoreRoleGroup recreates a trashed role group with the roles that still exist and the members
+// whose membership has not expired since; restored members are recorded in the membership
+// history, attributed to the user in ctx
+func (s *RBACService) restoreRoleGroup(ctx context.Context, item *trash.Item) error {
+	var snapshot groupSnapshot
+	if err := json.Unmarshal(item.Data, &snapshot); err != nil || snapshot.Group == nil {
+		return apperrors.Internal("TRASH_ITEM_CORRUPT", "The trashed group cannot be read", err)
+	}
+	group := snapshot.Group
+	if existing, err := s.repo.GroupRepo.GetByName(group.Name); err != nil {
+		return err
+	} else if existing != nil {
+		return apperrors.Conflict("GROUP_NAME_TAKEN", "Another group is now named "+group.Name)
+	}
+	if err := s.checkQuota(ctx, quota.Groups); err != nil {
+		return err
+	}
+
+	roleIDs, err := s.existing(snapshot.RoleIDs, s.repo.RoleRepo.FindMissingIDs)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = s.repo.Tx.WithinTx(ctx, func(repos *RBACRepository) error {
+		if err := repos.GroupRepo.Create(group); err != nil {
+			if dupErr := uniqueViolationError(err, groupUniqueConstraints); dupErr != err {
+				return dupErr
+			}
+			return err
+		}
+		if len(roleIDs) > 0 {
+			if err := repos.GroupRoleRepo.AssignRolesToGroup(group.ID, roleIDs); err != nil {
+				return err
+			}
+		}
+		for _, member := range snapshot.Members {
+			if member.ExpiresAt != nil && !member.ExpiresAt.After(now) {
+				continue
+			}
+			if err := repos.MembershipRepo.Create(member); err != nil {
+				return err
+			}
+			err := repos.HistoryRepo.Record(&MembershipEvent{
+				GroupID:    group.ID,
+				UserID:     member.UserID,
+				Action:     MembershipAdded,
+				ActorID:    getUserIDFromContext(ctx),
+				ExpiresAt:  member.ExpiresAt,
+				OccurredAt: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.accessChanged(ctx)
+	s.audit(ctx, audit.ActionRestore, AuditGroup, group.ID, nil, group)
+	return nil
+}
+
+// existing returns the IDs that findMissing does not report
+func (s *RBACService) existing(ids []string, findMissing func(ids []string) ([]string, error)) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	missing, err := findMissing(ids)
+	if err != nil {
+		return nil, err
+	}
+	gone := make(map[string]bool, len(missing))
+	for _, id := range missing {
+		gone[id] = true
+	}
+	var kept []string
+	for _, id := range ids {
+		if !gone[id] {
+			kept = append(kept, id)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,271 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/authevents"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ReadPermission is required to review detected anomalies
+const ReadPermission = perm.ReadSecurityEvents
+
+func init() {
+	rbac.RegisterPermissions(rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440020", Name: string(ReadPermission), Resource: "security", Action: "read",
+		Category: "Monitoring", Description: "Review detected authentication anomalies", RiskLevel: rbac.RiskLow})
+}
+
+// NotificationType identifies anomaly alerts sent through the notifier
+const NotificationType = "security.auth_anomaly"
+
+// maxTrackedSubjects bounds memory use; beyond it stale subjects are swept on every record
+const maxTrackedSubjects = 10000
+
+// Thresholds configure when failures count as an anomaly
+type Thresholds struct {
+	// Window is the sliding window failures are counted in
+	Window time.Duration
+	// PerIP and PerUser are the failure counts within Window that raise an anomaly (0 disables)
+	PerIP   int
+	PerUser int
+	// Cooldown suppresses repeat alerts for the same subject
+	Cooldown time.Duration
+}
+
+// subjectKey identifies a tracked IP or user
+type subjectKey struct {
+	subjectType string
+	subject     string
+}
+
+// subjectState is the sliding window of failures for one subject
+type subjectState struct {
+	failures  []authevents.Failure
+	lastAlert time.Time
+}
+
+// AnomalyDetector aggregates authentication failures per IP and per user in a sliding window
+// and raises an anomaly, persisted and sent to the notifier, when a threshold is exceeded
+type AnomalyDetector struct {
+	repo       AnomalyRepository
+	notifier   notification.Notifier
+	logger     *logrus.Logger
+	thresholds Thresholds
+	now        func() time.Time
+
+	mu       sync.Mutex
+	subjects map[subjectKey]*subjectState
+}
+
+// NewAnomalyDetector creates a new anomaly detector
+func NewAnomalyDetector(repo AnomalyRepository, notifier notification.Notifier, thresholds Thresholds, logger *logrus.Logger) *AnomalyDetector {
+	return &AnomalyDetector{
+		repo:       repo,
+		notifier:   notifier,
+		logger:     logger,
+		thresholds: thresholds,
+		now:        time.Now,
+		subjects:   make(map[subjectKey]*subjectState),
+	}
+}
+
+// Observe records failure; it matches authevents.Observer so it can be registered with the
+// modules that authenticate requests
+func (d *AnomalyDetector) Observe(ctx context.Context, failure authevents.Failure) {
+	if failure.At.IsZero() {
+		failure.At = d.now()
+	}
+	// Reuse of a rotated refresh token needs no threshold: one is enough to suspect theft
+	if failure.Kind == authevents.KindRefreshTokenReuse && failure.UserID != "" {
+		d.raise(ctx, &Anomaly{
+			ID:          uuid.New().String(),
+			SubjectType: SubjectUser,
+			Subject:     failure.UserID,
+			Failures:    1,
+			Kinds:       map[string]int{failure.Kind: 1},
+			WindowStart: failure.At,
+			DetectedAt:  failure.At,
+		})
+		return
+	}
+
+	var detected []*Anomaly
+	d.mu.Lock()
+	if failure.IP != "" {
+		if anomaly := d.record(subjectKey{SubjectIP, failure.IP}, failure, d.thresholds.PerIP); anomaly != nil {
+			detected = append(detected, anomaly)
+		}
+	}
+	if failure.UserID != "" {
+		if anomaly := d.record(subjectKey{SubjectUser, failure.UserID}, failure, d.thresholds.PerUser); anomaly != nil {
+			detected = append(detected, anomaly)
+		}
+	}
+	if len(d.subjects) > maxTrackedSubjects {
+		d.sweep(failure.At)
+	}
+	d.mu.Unlock()
+
+	for _, anomaly := range detected {
+		d.raise(ctx, anomaly)
+	}
+}
+
+// record adds failure to key's window and returns an anomaly when it crosses threshold outside
+// the cooldown; callers hold d.mu
+func (d *AnomalyDetector) record(key subjectKey, failure authevents.Failure, threshold int) *Anomaly {
+	if threshold <= 0 {
+		return nil
+	}
+	state, ok := d.subjects[key]
+	if !ok {
+		state = &subjectState{}
+		d.subjects[key] = state
+	}
+
+	windowStart := failure.At.Add(-d.thresholds.Window)
+	kept := state.failures[:0]
+	for _, f := range state.failures {
+		if f.At.After(windowStart) {
+			kept = append(kept, f)
+		}
+	}
+	state.failures = append(kept, failure)
+
+	if len(state.failures) < threshold || failure.At.Sub(state.lastAlert) < d.thresholds.Cooldown {
+		return nil
+	}
+	state.lastAlert = failure.At
+
+	kinds := make(map[string]int)
+	for _, f := range state.failures {
+		kinds[f.Kind]++
+	}
+	return &Anomaly{
+		ID:          uuid.New().String(),
+		SubjectType: key.subjectType,
+		Subject:     key.subject,
+		Failures:    len(state.failures),
+		Kinds:       kinds,
+		WindowStart: state.failures[0].At,
+		DetectedAt:  failure.At,
+	}
+}
+
+// sweep drops subjects with no failures in the window and no alert in the cooldown; callers hold d.mu
+func (d *AnomalyDetector) sweep(now time.Time) {
+	for key, state := range d.subjects {
+		last := state.failures[len(state.failures)-1].At
+		if now.Sub(last) > d.thresholds.Window && now.Sub(state.lastAlert) > d.thresholds.Cooldown {
+			delete(d.subjects, key)
+		}
+	}
+}
+
+// raise persists and announces an anomaly. Notification happens in the background so a slow
+// webhook never delays the request that tipped the threshold.
+func (d *AnomalyDetector) raise(ctx context.Context, anomaly *Anomaly) {
+	entry := d.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"anomaly_id":   anomaly.ID,
+		"subject_type": anomaly.SubjectType,
+		"subject":      anomaly.Subject,
+		"failures":     anomaly.Failures,
+	})
+	entry.Warn("Authentication failure anomaly detected")
+
+	subject := fmt.Sprintf("Authentication failure spike for %s %s", anomaly.SubjectType, anomaly.Subject)
+	message := fmt.Sprintf("%d authentication failures between %s and %s",
+		anomaly.Failures, anomaly.WindowStart.UTC().Format(time.RFC3339), anomaly.DetectedAt.UTC().Format(time.RFC3339))
+	if anomaly.Kinds[authevents.KindRefreshTokenReuse] > 0 {
+		subject = fmt.Sprintf("Refresh token reuse for %s %s", anomaly.SubjectType, anomaly.Subject)
+		message = fmt.Sprintf("A rotated refresh token was presented again at %s; its sessions were ended",
+			anomaly.DetectedAt.UTC().Format(time.RFC3339))
+	}
+
+	if err := d.repo.Create(anomaly); err != nil {
+		entry.WithError(err).Error("Failed to save anomaly")
+	}
+
+	n := notification.Notification{
+		Type:     NotificationType,
+		Severity: notification.SeverityWarning,
+		Subject:  subject,
+		Message:  message,
+		Data: map[string]interface{}{
+			"anomaly_id":   anomaly.ID,
+			"subject_type": anomaly.SubjectType,
+			"subject":      anomaly.Subject,
+			"failures":     anomaly.Failures,
+			"kinds":        anomaly.Kinds,
+		},
+		OccurredAt: anomaly.DetectedAt,
+	}
+	go func() {
+		notifyCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := d.notifier.Notify(notifyCtx, n); err != nil {
+			entry.WithError(err).Warn("Failed to send anomaly notification")
+		}
+	}()
+}
+
+// Recent returns anomalies detected since the given time, newest first
+func (d *AnomalyDetector) Recent(since time.Time, limit int) ([]Anomaly, error) {
+	anomalies, err := d.repo.ListSince(since, limit)
+	if err != nil {
+		d.logger.WithError(err).Error("Failed to list anomalies")
+		return nil, err
+	}
+	return anomalies, nil
+}
+
+// HTTP Handlers
+
+// ListAnomaliesHandler handles GET /api/security/anomalies?since=24h&limit=50, newest first. The
+// limit defaults to and is bounded by the configured page limits.
+func ListAnomaliesHandler(detector *AnomalyDetector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lookback := 24 * time.Hour
+		if value := r.URL.Query().Get("since"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid since parameter", "VALIDATION_ERROR", map[string]string{"since": "must be a positive duration such as 24h"})
+				return
+			}
+			lookback = d
+		}
+		limit, ok := httpapi.ParseLimit(w, r)
+		if !ok {
+			return
+		}
+
+		anomalies, err := detector.Recent(time.Now().Add(-lookback), limit)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list anomalies")
+			return
+		}
+		if anomalies == nil {
+			anomalies = []Anomaly{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(anomalies)
+	}
+}
+
+// SetupRoutes configures the security routes
+func SetupRoutes(r *mux.Router, detector *AnomalyDetector, rbacService *rbac.RBACService) {
+	rbacService.Protect(r.HandleFunc("/api/security/anomalies", ListAnomaliesHandler(detector)).Methods("GET"), ReadPermission)
+}
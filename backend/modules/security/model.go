@@ -0,0 +1,75 @@
+package security
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// Subject types an anomaly can be attributed to
+const (
+	SubjectIP   = "ip"
+	SubjectUser = "user"
+)
+
+// Anomaly is a burst of authentication failures from one IP or against one user that exceeded
+// the configured threshold within the detection window
+type Anomaly struct {
+	ID          string         `json:"id" db:"id"`
+	SubjectType string         `json:"subject_type" db:"subject_type"`
+	Subject     string         `json:"subject" db:"subject"`
+	Failures    int            `json:"failures" db:"failures"`
+	Kinds       map[string]int `json:"kinds" db:"kinds"`
+	WindowStart time.Time      `json:"window_start" db:"window_start"`
+	DetectedAt  time.Time      `json:"detected_at" db:"detected_at"`
+}
+
+// AnomalyRepository interface defines methods for anomaly data access
+type AnomalyRepository interface {
+	Create(anomaly *Anomaly) error
+	ListSince(since time.Time, limit int) ([]Anomaly, error)
+}
+
+// anomalyRepository implements AnomalyRepository
+type anomalyRepository struct {
+	db database.DBTX
+}
+
+// NewAnomalyRepository creates a new anomaly repository
+func NewAnomalyRepository(db *sql.DB) AnomalyRepository {
+	return &anomalyRepository{db: db}
+}
+
+func (r *anomalyRepository) Create(anomaly *Anomaly) error {
+	kinds, err := json.Marshal(anomaly.Kinds)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO security_anomalies (id, subject_type, subject, failures, kinds, window_start, detected_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = r.db.Exec(query, anomaly.ID, anomaly.SubjectType, anomaly.Subject, anomaly.Failures, kinds, anomaly.WindowStart, anomaly.DetectedAt)
+	return err
+}
+
+func (r *anomalyRepository) ListSince(since time.Time, limit int) ([]Anomaly, error) {
+	query := `SELECT id, subject_type, subject, failures, kinds, window_start, detected_at
+	          FROM security_anomalies WHERE detected_at >= $1 ORDER BY detected_at DESC LIMIT $2`
+	return database.QueryAll(r.db, "list anomalies", scanAnomaly, query, since, limit)
+}
+
+func scanAnomaly(row database.Scanner) (Anomaly, error) {
+	var anomaly Anomaly
+	var kinds []byte
+	err := row.Scan(&anomaly.ID, &anomaly.SubjectType, &anomaly.Subject, &anomaly.Failures, &kinds, &anomaly.WindowStart, &anomaly.DetectedAt)
+	if err != nil {
+		return anomaly, err
+	}
+	if len(kinds) > 0 {
+		if err := json.Unmarshal(kinds, &anomaly.Kinds); err != nil {
+			return anomaly, err
+		}
+	}
+	return anomaly, nil
+}
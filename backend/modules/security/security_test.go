@@ -0,0 +1,148 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/pkg/authevents"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAnomalyRepo struct {
+	mu        sync.Mutex
+	anomalies []Anomaly
+}
+
+func (r *fakeAnomalyRepo) Create(anomaly *Anomaly) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.anomalies = append(r.anomalies, *anomaly)
+	return nil
+}
+
+func (r *fakeAnomalyRepo) ListSince(since time.Time, limit int) ([]Anomaly, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []Anomaly
+	for i := len(r.anomalies) - 1; i >= 0 && len(result) < limit; i-- {
+		if !r.anomalies[i].DetectedAt.Before(since) {
+			result = append(result, r.anomalies[i])
+		}
+	}
+	return result, nil
+}
+
+type fakeNotifier struct {
+	sent chan notification.Notification
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, msg notification.Notification) error {
+	n.sent <- msg
+	return nil
+}
+
+func newTestDetector(thresholds Thresholds) (*AnomalyDetector, *fakeAnomalyRepo, *fakeNotifier, *time.Time) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	repo := &fakeAnomalyRepo{}
+	notifier := &fakeNotifier{sent: make(chan notification.Notification, 10)}
+	detector := NewAnomalyDetector(repo, notifier, thresholds, logger)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	detector.now = func() time.Time { return now }
+	return detector, repo, notifier, &now
+}
+
+func TestDetectorRaisesAnomalyPerIP(t *testing.T) {
+	detector, repo, notifier, now := newTestDetector(Thresholds{Window: time.Minute, PerIP: 3, Cooldown: 10 * time.Minute})
+
+	fail := func(kind string) {
+		detector.Observe(context.Background(), authevents.Failure{Kind: kind, IP: "10.0.0.1"})
+		*now = now.Add(10 * time.Second)
+	}
+
+	fail(authevents.KindInvalidToken)
+	fail(authevents.KindLoginFailed)
+	assert.Empty(t, repo.anomalies)
+
+	fail(authevents.KindLoginFailed)
+	require.Len(t, repo.anomalies, 1)
+	anomaly := repo.anomalies[0]
+	assert.Equal(t, SubjectIP, anomaly.SubjectType)
+	assert.Equal(t, "10.0.0.1", anomaly.Subject)
+	assert.Equal(t, 3, anomaly.Failures)
+	assert.Equal(t, map[string]int{authevents.KindInvalidToken: 1, authevents.KindLoginFailed: 2}, anomaly.Kinds)
+
+	select {
+	case sent := <-notifier.sent:
+		assert.Equal(t, NotificationType, sent.Type)
+		assert.Equal(t, anomaly.ID, sent.Data["anomaly_id"])
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+	}
+
+	// Further failures within the cooldown do not alert again
+	fail(authevents.KindLoginFailed)
+	assert.Len(t, repo.anomalies, 1)
+}
+
+func TestDetectorSlidingWindow(t *testing.T) {
+	detector, repo, _, now := newTestDetector(Thresholds{Window: time.Minute, PerUser: 2})
+
+	detector.Observe(context.Background(), authevents.Failure{Kind: authevents.KindForbidden, UserID: "user-1"})
+	*now = now.Add(2 * time.Minute)
+	detector.Observe(context.Background(), authevents.Failure{Kind: authevents.KindForbidden, UserID: "user-1"})
+	assert.Empty(t, repo.anomalies, "failures outside the window do not count")
+
+	*now = now.Add(30 * time.Second)
+	detector.Observe(context.Background(), authevents.Failure{Kind: authevents.KindForbidden, UserID: "user-1"})
+	require.Len(t, repo.anomalies, 1)
+	assert.Equal(t, SubjectUser, repo.anomalies[0].SubjectType)
+}
+
+func TestDetectorRaisesRefreshTokenReuseAtOnce(t *testing.T) {
+	detector, repo, notifier, _ := newTestDetector(Thresholds{Window: time.Minute, PerUser: 5})
+
+	detector.Observe(context.Background(), authevents.Failure{Kind: authevents.KindRefreshTokenReuse, UserID: "user-1", IP: "10.0.0.1"})
+	require.Len(t, repo.anomalies, 1)
+	assert.Equal(t, SubjectUser, repo.anomalies[0].SubjectType)
+	assert.Equal(t, "user-1", repo.anomalies[0].Subject)
+	assert.Equal(t, map[string]int{authevents.KindRefreshTokenReuse: 1}, repo.anomalies[0].Kinds)
+
+	select {
+	case sent := <-notifier.sent:
+		assert.Contains(t, sent.Subject, "Refresh token reuse")
+	case <-time.After(time.Second):
+		t.Fatal("expected a notification")
+	}
+}
+
+func TestListAnomaliesHandler(t *testing.T) {
+	detector, repo, _, _ := newTestDetector(Thresholds{Window: time.Minute})
+	repo.anomalies = []Anomaly{
+		{ID: "old", DetectedAt: time.Now().Add(-48 * time.Hour)},
+		{ID: "recent", DetectedAt: time.Now().Add(-time.Hour)},
+	}
+
+	w := httptest.NewRecorder()
+	ListAnomaliesHandler(detector)(w, httptest.NewRequest(http.MethodGet, "/api/security/anomalies", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var anomalies []Anomaly
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &anomalies))
+	require.Len(t, anomalies, 1)
+	assert.Equal(t, "recent", anomalies[0].ID)
+
+	w = httptest.NewRecorder()
+	ListAnomaliesHandler(detector)(w, httptest.NewRequest(http.MethodGet, "/api/security/anomalies?since=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
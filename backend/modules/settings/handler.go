@@ -0,0 +1,259 @@
+package settings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jsonschema"
+	"base-app/pkg/perm"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminPermission is required to change settings and to use the API during maintenance
+const AdminPermission = perm.ManageConfig
+
+func init() {
+	rbac.RegisterPermissions(rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440007", Name: string(AdminPermission), Resource: "config", Action: "manage",
+		Category: "System", Description: "Change application configuration", RiskLevel: rbac.RiskHigh})
+}
+
+// defaultRetryAfter is sent with 503 responses when maintenance mode sets no explicit value
+const defaultRetryAfter = 300
+
+var validate = validator.New()
+
+// maintenanceExemptPaths stay reachable during maintenance for everyone
+var maintenanceExemptPaths = []string{"/health", "/api/version", "/api/settings/maintenance"}
+
+// SettingsService provides business logic for persisted settings
+type SettingsService struct {
+	repo   SettingsRepository
+	logger *logrus.Logger
+
+	mu           sync.RWMutex
+	maintenance  MaintenanceState
+	registration RegistrationState
+	profile      ProfilePolicy
+}
+
+// NewSettingsService creates a new settings service
+func NewSettingsService(repo SettingsRepository, logger *logrus.Logger) *SettingsService {
+	return &SettingsService{
+		repo:   repo,
+		logger: logger,
+	}
+}
+
+// Refresh reloads cached settings from the database so toggles made by other instances apply here
+func (s *SettingsService) Refresh() error {
+	setting, err := s.repo.Get(MaintenanceKey)
+	if err != nil {
+		return err
+	}
+
+	var state MaintenanceState
+	if setting != nil {
+		if err := json.Unmarshal([]byte(setting.Value), &state); err != nil {
+			return err
+		}
+	}
+	registration, err := s.loadRegistration()
+	if err != nil {
+		return err
+	}
+	profile, err := s.loadProfilePolicy()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	changed := s.maintenance.Enabled != state.Enabled
+	s.maintenance = state
+	modeChanged := s.registration.Mode != registration.Mode
+	s.registration = registration
+	s.profile = profile
+	s.mu.Unlock()
+
+	if changed {
+		s.logger.WithField("enabled", state.Enabled).Info("Maintenance mode state loaded")
+	}
+	if modeChanged {
+		s.logger.WithField("mode", registration.Mode).Info("Registration mode loaded")
+	}
+	return nil
+}
+
+// StartRefresh reloads settings every interval until ctx is cancelled
+func (s *SettingsService) StartRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Refresh(); err != nil {
+					s.logger.WithError(err).Warn("Failed to refresh settings")
+				}
+			}
+		}
+	}()
+}
+
+// Maintenance returns the current maintenance mode state
+func (s *SettingsService) Maintenance() MaintenanceState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maintenance
+}
+
+// SetMaintenance persists a new maintenance mode state
+func (s *SettingsService) SetMaintenance(userID string, req SetMaintenanceRequest) (MaintenanceState, error) {
+	if err := validate.Struct(req); err != nil {
+		s.logger.WithError(err).Warn("Maintenance mode validation failed")
+		return MaintenanceState{}, err
+	}
+
+	state := MaintenanceState{
+		Enabled:    req.Enabled,
+		Message:    req.Message,
+		RetryAfter: req.RetryAfter,
+		UpdatedBy:  userID,
+		UpdatedAt:  time.Now(),
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return MaintenanceState{}, err
+	}
+
+	err = s.repo.Set(&Setting{
+		Key:       MaintenanceKey,
+		Value:     string(value),
+		UpdatedBy: userID,
+		UpdatedAt: state.UpdatedAt,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to save maintenance mode")
+		return MaintenanceState{}, err
+	}
+
+	s.mu.Lock()
+	s.maintenance = state
+	s.mu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"enabled": state.Enabled,
+		"user_id": userID,
+	}).Warn("Maintenance mode changed")
+	return state, nil
+}
+
+// MaintenanceMiddleware rejects requests with 503 while maintenance mode is on. Health checks,
+// the maintenance endpoint itself and requests for which isAdmin returns true pass through.
+func MaintenanceMiddleware(service *SettingsService, isAdmin func(r *http.Request) bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state := service.Maintenance()
+			if !state.Enabled || isMaintenanceExempt(r.URL.Path) || isAdmin(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			retryAfter := state.RetryAfter
+			if retryAfter <= 0 {
+				retryAfter = defaultRetryAfter
+			}
+			message := state.Message
+			if message == "" {
+				message = "Service is under maintenance"
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			httpapi.WriteErrorResponse(w, http.StatusServiceUnavailable, message, "MAINTENANCE_MODE", nil)
+		})
+	}
+}
+
+// isMaintenanceExempt reports whether path stays available during maintenance
+func isMaintenanceExempt(path string) bool {
+	for _, exempt := range maintenanceExemptPaths {
+		if path == exempt || strings.HasPrefix(path, exempt+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP Handlers
+
+// GetMaintenanceHandler handles GET /api/settings/maintenance. The route is public; who last
+// changed maintenance mode is only shown to signed-in callers.
+func GetMaintenanceHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := service.Maintenance()
+		if rbac.UserIDFromContext(r.Context()) == "" {
+			state.UpdatedBy = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// SetMaintenanceHandler handles PUT /api/settings/maintenance
+func SetMaintenanceHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SetMaintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		state, err := service.SetMaintenance(rbac.UserIDFromContext(r.Context()), req)
+		if err != nil {
+			var fieldErrs validator.ValidationErrors
+			if errors.As(err, &fieldErrs) {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", nil)
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to update maintenance mode")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// RegisterSchemas registers the request bodies of the settings routes for schema validation
+func RegisterSchemas(reg *jsonschema.Registry) {
+	reg.Register("PUT", "/api/settings/maintenance", SetMaintenanceRequest{})
+	reg.Register("PUT", "/api/settings/registration", SetRegistrationRequest{})
+	reg.Register("PUT", "/api/settings/profile-policy", SetProfilePolicyRequest{})
+}
+
+// SetupRoutes registers settings routes; reads are public and changes require AdminPermission
+func SetupRoutes(r *mux.Router, service *SettingsService, rbacService *rbac.RBACService) {
+	settingsRouter := r.PathPrefix("/api/settings").Subrouter()
+	settingsRouter.Use(rbacService.OptionalAuth())
+
+	settingsRouter.HandleFunc("/maintenance", GetMaintenanceHandler(service)).Methods("GET")
+	rbacService.Protect(settingsRouter.HandleFunc("/maintenance", SetMaintenanceHandler(service)).Methods("PUT"), AdminPermission)
+	settingsRouter.HandleFunc("/registration", GetRegistrationHandler(service)).Methods("GET")
+	rbacService.Protect(settingsRouter.HandleFunc("/registration", SetRegistrationHandler(service)).Methods("PUT"), AdminPermission)
+	settingsRouter.HandleFunc("/profile-policy", GetProfilePolicyHandler(service)).Methods("GET")
+	rbacService.Protect(settingsRouter.HandleFunc("/profile-policy", SetProfilePolicyHandler(service)).Methods("PUT"), AdminPermission)
+}
@@ -0,0 +1,73 @@
+package settings
+
+import (
+	"database/sql"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// Setting is a persisted key/value application setting. Value holds JSON.
+type Setting struct {
+	Key       string    `json:"key" db:"key"`
+	Value     string    `json:"value" db:"value"`
+	UpdatedBy string    `json:"updated_by,omitempty" db:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// MaintenanceKey is the settings key holding the maintenance mode state
+const MaintenanceKey = "maintenance_mode"
+
+// MaintenanceState describes whether the API is in maintenance mode
+type MaintenanceState struct {
+	Enabled    bool      `json:"enabled"`
+	Message    string    `json:"message,omitempty"`
+	RetryAfter int       `json:"retry_after_seconds"`
+	UpdatedBy  string    `json:"updated_by,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at,omitempty"`
+}
+
+// SetMaintenanceRequest represents the request to toggle maintenance mode
+type SetMaintenanceRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message" validate:"max=500"`
+	RetryAfter int    `json:"retry_after_seconds" validate:"min=0,max=86400"`
+}
+
+// SettingsRepository interface defines methods for settings data access
+type SettingsRepository interface {
+	Get(key string) (*Setting, error)
+	Set(setting *Setting) error
+}
+
+// settingsRepository implements SettingsRepository
+type settingsRepository struct {
+	db database.DBTX
+}
+
+// NewSettingsRepository creates a new settings repository. Settings are always read from the
+// primary so a toggle is visible immediately after it is written.
+func NewSettingsRepository(db *sql.DB) SettingsRepository {
+	return &settingsRepository{db: db}
+}
+
+func (r *settingsRepository) Get(key string) (*Setting, error) {
+	setting := &Setting{}
+	var updatedBy sql.NullString
+	query := `SELECT key, value, updated_by, updated_at FROM settings WHERE key = $1`
+	err := r.db.QueryRow(query, key).Scan(&setting.Key, &setting.Value, &updatedBy, &setting.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	setting.UpdatedBy = updatedBy.String
+	return setting, err
+}
+
+func (r *settingsRepository) Set(setting *Setting) error {
+	query := `INSERT INTO settings (key, value, updated_by, updated_at)
+	          VALUES ($1, $2, NULLIF($3, ''), $4)
+	          ON CONFLICT (key) DO UPDATE
+	          SET value = EXCLUDED.value, updated_by = EXCLUDED.updated_by, updated_at = EXCLUDED.updated_at`
+	_, err := r.db.Exec(query, setting.Key, setting.Value, setting.UpdatedBy, setting.UpdatedAt)
+	return err
+}
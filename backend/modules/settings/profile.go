@@ -0,0 +1,168 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/httpapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProfilePolicyKey is the settings key holding the profile fields users must fill in
+const ProfilePolicyKey = "profile_policy"
+
+// ProfilePolicy lists the profile fields every user must fill in after logging in. Fields are
+// "first_name", "last_name", "phone" or "attributes.<key>" for a custom attribute. With Enforce
+// on, users whose profile is incomplete can only reach their profile until they complete it.
+type ProfilePolicy struct {
+	RequiredFields []string  `json:"required_fields"`
+	Enforce        bool      `json:"enforce"`
+	UpdatedBy      string    `json:"updated_by,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+}
+
+// SetProfilePolicyRequest represents the request to change the required profile fields
+type SetProfilePolicyRequest struct {
+	RequiredFields []string `json:"required_fields" validate:"max=50,dive,required,max=80"`
+	Enforce        bool     `json:"enforce"`
+}
+
+// profileFields are the built-in fields a policy may require
+var profileFields = map[string]bool{"first_name": true, "last_name": true, "phone": true}
+
+// attributePrefix marks a required custom attribute
+const attributePrefix = "attributes."
+
+// isProfileField reports whether a policy may require field
+func isProfileField(field string) bool {
+	if key, ok := strings.CutPrefix(field, attributePrefix); ok {
+		return key != "" && len(key) <= 64
+	}
+	return profileFields[field]
+}
+
+// loadProfilePolicy reads the persisted profile policy; unset requires nothing
+func (s *SettingsService) loadProfilePolicy() (ProfilePolicy, error) {
+	var policy ProfilePolicy
+	setting, err := s.repo.Get(ProfilePolicyKey)
+	if err != nil || setting == nil {
+		return policy, err
+	}
+	if err := json.Unmarshal([]byte(setting.Value), &policy); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+// ProfilePolicy returns the current profile policy
+func (s *SettingsService) ProfilePolicy() ProfilePolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policy := s.profile
+	if policy.RequiredFields == nil {
+		policy.RequiredFields = []string{}
+	}
+	return policy
+}
+
+// ProfileRequirements returns the required profile fields and whether they are enforced
+func (s *SettingsService) ProfileRequirements() ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.profile.RequiredFields, s.profile.Enforce
+}
+
+// SetProfilePolicy persists a new profile policy
+func (s *SettingsService) SetProfilePolicy(userID string, req SetProfilePolicyRequest) (ProfilePolicy, error) {
+	if err := validate.Struct(req); err != nil {
+		s.logger.WithError(err).Warn("Profile policy validation failed")
+		return ProfilePolicy{}, err
+	}
+
+	fields := []string{}
+	seen := make(map[string]bool, len(req.RequiredFields))
+	for _, field := range req.RequiredFields {
+		if !isProfileField(field) {
+			return ProfilePolicy{}, apperrors.Invalid("INVALID_PROFILE_FIELD",
+				"Unknown profile field "+field+": use first_name, last_name, phone or attributes.<key>")
+		}
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+	policy := ProfilePolicy{
+		RequiredFields: fields,
+		Enforce:        req.Enforce,
+		UpdatedBy:      userID,
+		UpdatedAt:      time.Now(),
+	}
+	value, err := json.Marshal(policy)
+	if err != nil {
+		return ProfilePolicy{}, err
+	}
+
+	err = s.repo.Set(&Setting{
+		Key:       ProfilePolicyKey,
+		Value:     string(value),
+		UpdatedBy: userID,
+		UpdatedAt: policy.UpdatedAt,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to save profile policy")
+		return ProfilePolicy{}, err
+	}
+
+	s.mu.Lock()
+	s.profile = policy
+	s.mu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"required_fields": policy.RequiredFields,
+		"enforce":         policy.Enforce,
+		"user_id":         userID,
+	}).Warn("Profile policy changed")
+	return policy, nil
+}
+
+// GetProfilePolicyHandler handles GET /api/settings/profile-policy. The route is public so
+// sign-up forms can ask for the required fields up front; who last changed the policy is only
+// shown to signed-in callers.
+func GetProfilePolicyHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		policy := service.ProfilePolicy()
+		if rbac.UserIDFromContext(r.Context()) == "" {
+			policy.UpdatedBy = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
+
+// SetProfilePolicyHandler handles PUT /api/settings/profile-policy
+func SetProfilePolicyHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SetProfilePolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		policy, err := service.SetProfilePolicy(rbac.UserIDFromContext(r.Context()), req)
+		if err != nil {
+			if httpapi.WriteValidationError(w, err) {
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to update profile policy")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
@@ -0,0 +1,213 @@
+package settings
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/httpapi"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RegistrationKey is the settings key holding who may sign up
+const RegistrationKey = "registration"
+
+// Registration modes
+const (
+	// RegistrationOpen lets anyone sign up
+	RegistrationOpen = "open"
+	// RegistrationInviteOnly requires one of the configured invite codes
+	RegistrationInviteOnly = "invite_only"
+	// RegistrationClosed turns public sign-up off
+	RegistrationClosed = "closed"
+)
+
+// RegistrationState describes who may use public registration. AllowedDomains, when set,
+// restricts sign-up to email addresses of those domains in every mode.
+type RegistrationState struct {
+	Mode           string   `json:"mode"`
+	AllowedDomains []string `json:"allowed_domains"`
+	// InviteCodes are persisted but never returned; responses carry InviteCodeCount instead
+	InviteCodes     []string  `json:"invite_codes,omitempty"`
+	InviteCodeCount int       `json:"invite_code_count"`
+	UpdatedBy       string    `json:"updated_by,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at,omitempty"`
+}
+
+// SetRegistrationRequest represents the request to change registration settings. Omitting
+// invite_codes keeps the current codes; an empty list removes them.
+type SetRegistrationRequest struct {
+	Mode           string    `json:"mode" validate:"required,oneof=open invite_only closed"`
+	AllowedDomains []string  `json:"allowed_domains" validate:"max=100,dive,fqdn"`
+	InviteCodes    *[]string `json:"invite_codes" validate:"omitempty,max=100,dive,min=8,max=128"`
+}
+
+var (
+	errRegistrationDisabled = apperrors.Forbidden("REGISTRATION_DISABLED", "Registration is disabled")
+	errDomainNotAllowed     = apperrors.Forbidden("EMAIL_DOMAIN_NOT_ALLOWED", "Registration is not open to this email domain")
+	errInviteCodeRequired   = apperrors.Forbidden("INVITE_CODE_REQUIRED", "An invite code is required to register")
+	errInvalidInviteCode    = apperrors.Forbidden("INVALID_INVITE_CODE", "Invite code is invalid")
+)
+
+// loadRegistration reads the persisted registration settings; unset means open registration
+func (s *SettingsService) loadRegistration() (RegistrationState, error) {
+	state := RegistrationState{Mode: RegistrationOpen}
+	setting, err := s.repo.Get(RegistrationKey)
+	if err != nil || setting == nil {
+		return state, err
+	}
+	if err := json.Unmarshal([]byte(setting.Value), &state); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
+// Registration returns the current registration settings without the invite codes
+func (s *SettingsService) Registration() RegistrationState {
+	s.mu.RLock()
+	state := s.registration
+	s.mu.RUnlock()
+	if state.Mode == "" {
+		state.Mode = RegistrationOpen
+	}
+	state.InviteCodeCount = len(state.InviteCodes)
+	state.InviteCodes = nil
+	return state
+}
+
+// CheckRegistration returns the error to reject a sign-up of email with inviteCode with, or nil
+// when the current settings allow it
+func (s *SettingsService) CheckRegistration(email, inviteCode string) error {
+	s.mu.RLock()
+	state := s.registration
+	s.mu.RUnlock()
+
+	if state.Mode == RegistrationClosed {
+		return errRegistrationDisabled
+	}
+	if len(state.AllowedDomains) > 0 {
+		domain := ""
+		if at := strings.LastIndex(email, "@"); at >= 0 {
+			domain = strings.ToLower(email[at+1:])
+		}
+		allowed := false
+		for _, d := range state.AllowedDomains {
+			if d == domain {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errDomainNotAllowed
+		}
+	}
+	if state.Mode == RegistrationInviteOnly {
+		if inviteCode == "" {
+			return errInviteCodeRequired
+		}
+		for _, code := range state.InviteCodes {
+			if subtle.ConstantTimeCompare([]byte(code), []byte(inviteCode)) == 1 {
+				return nil
+			}
+		}
+		return errInvalidInviteCode
+	}
+	return nil
+}
+
+// SetRegistration persists new registration settings
+func (s *SettingsService) SetRegistration(userID string, req SetRegistrationRequest) (RegistrationState, error) {
+	if err := validate.Struct(req); err != nil {
+		s.logger.WithError(err).Warn("Registration settings validation failed")
+		return RegistrationState{}, err
+	}
+
+	s.mu.RLock()
+	codes := s.registration.InviteCodes
+	s.mu.RUnlock()
+	if req.InviteCodes != nil {
+		codes = *req.InviteCodes
+	}
+	if req.Mode == RegistrationInviteOnly && len(codes) == 0 {
+		return RegistrationState{}, apperrors.Invalid("INVITE_CODES_REQUIRED", "Invite-only registration needs at least one invite code")
+	}
+
+	domains := make([]string, len(req.AllowedDomains))
+	for i, d := range req.AllowedDomains {
+		domains[i] = strings.ToLower(d)
+	}
+	state := RegistrationState{
+		Mode:           req.Mode,
+		AllowedDomains: domains,
+		InviteCodes:    codes,
+		UpdatedBy:      userID,
+		UpdatedAt:      time.Now(),
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return RegistrationState{}, err
+	}
+
+	err = s.repo.Set(&Setting{
+		Key:       RegistrationKey,
+		Value:     string(value),
+		UpdatedBy: userID,
+		UpdatedAt: state.UpdatedAt,
+	})
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to save registration settings")
+		return RegistrationState{}, err
+	}
+
+	s.mu.Lock()
+	s.registration = state
+	s.mu.Unlock()
+
+	s.logger.WithFields(logrus.Fields{
+		"mode":            state.Mode,
+		"allowed_domains": state.AllowedDomains,
+		"user_id":         userID,
+	}).Warn("Registration settings changed")
+	return s.Registration(), nil
+}
+
+// GetRegistrationHandler handles GET /api/settings/registration. The route is public so sign-up
+// forms can adapt; who last changed the settings is only shown to signed-in callers.
+func GetRegistrationHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := service.Registration()
+		if rbac.UserIDFromContext(r.Context()) == "" {
+			state.UpdatedBy = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}
+}
+
+// SetRegistrationHandler handles PUT /api/settings/registration
+func SetRegistrationHandler(service *SettingsService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SetRegistrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		state, err := service.SetRegistration(rbac.UserIDFromContext(r.Context()), req)
+		if err != nil {
+			if httpapi.WriteValidationError(w, err) {
+				return
+			}
+			httpapi.WriteError(w, err, "Failed to update registration settings")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	}
+}
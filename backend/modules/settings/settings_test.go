@@ -0,0 +1,197 @@
+package settings
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestService(t *testing.T) (*SettingsService, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	return NewSettingsService(NewSettingsRepository(db), logger), mock, func() { db.Close() }
+}
+
+func TestRefreshLoadsPersistedMaintenanceState(t *testing.T) {
+	service, mock, closeDB := newTestService(t)
+	defer closeDB()
+
+	mock.ExpectQuery(`SELECT key, value, updated_by, updated_at FROM settings WHERE key`).
+		WithArgs(MaintenanceKey).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value", "updated_by", "updated_at"}).
+			AddRow(MaintenanceKey, `{"enabled":true,"message":"Upgrading","retry_after_seconds":120}`, "admin-1", time.Now()))
+	mock.ExpectQuery(`SELECT key, value, updated_by, updated_at FROM settings WHERE key`).
+		WithArgs(RegistrationKey).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value", "updated_by", "updated_at"}))
+	mock.ExpectQuery(`SELECT key, value, updated_by, updated_at FROM settings WHERE key`).
+		WithArgs(ProfilePolicyKey).
+		WillReturnRows(sqlmock.NewRows([]string{"key", "value", "updated_by", "updated_at"}).
+			AddRow(ProfilePolicyKey, `{"required_fields":["phone"],"enforce":true}`, "admin-1", time.Now()))
+
+	assert.NoError(t, service.Refresh())
+
+	state := service.Maintenance()
+	assert.True(t, state.Enabled)
+	assert.Equal(t, "Upgrading", state.Message)
+	assert.Equal(t, 120, state.RetryAfter)
+	fields, enforce := service.ProfileRequirements()
+	assert.Equal(t, []string{"phone"}, fields)
+	assert.True(t, enforce)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetMaintenancePersists(t *testing.T) {
+	service, mock, closeDB := newTestService(t)
+	defer closeDB()
+
+	mock.ExpectExec(`INSERT INTO settings`).
+		WithArgs(MaintenanceKey, sqlmock.AnyArg(), "admin-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	state, err := service.SetMaintenance("admin-1", SetMaintenanceRequest{Enabled: true, RetryAfter: 60})
+
+	assert.NoError(t, err)
+	assert.True(t, state.Enabled)
+	assert.True(t, service.Maintenance().Enabled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = service.SetMaintenance("admin-1", SetMaintenanceRequest{Enabled: true, RetryAfter: -1})
+	assert.Error(t, err)
+}
+
+func TestMaintenanceMiddleware(t *testing.T) {
+	service, _, closeDB := newTestService(t)
+	defer closeDB()
+	service.maintenance = MaintenanceState{Enabled: true, RetryAfter: 90}
+
+	isAdmin := func(r *http.Request) bool { return r.Header.Get("X-Test-Admin") == "yes" }
+	handler := MaintenanceMiddleware(service, isAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		name   string
+		path   string
+		admin  bool
+		status int
+	}{
+		{"regular traffic", "/api/rbac/roles", false, http.StatusServiceUnavailable},
+		{"admin traffic", "/api/rbac/roles", true, http.StatusOK},
+		{"health check", "/health", false, http.StatusOK},
+		{"maintenance status", "/api/settings/maintenance", false, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.admin {
+				req.Header.Set("X-Test-Admin", "yes")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.status, w.Code)
+			if tc.status == http.StatusServiceUnavailable {
+				assert.Equal(t, "90", w.Header().Get("Retry-After"))
+				assert.Contains(t, w.Body.String(), "MAINTENANCE_MODE")
+			}
+		})
+	}
+
+	service.maintenance = MaintenanceState{}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/rbac/roles", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRegistrationSettings(t *testing.T) {
+	service, mock, closeDB := newTestService(t)
+	defer closeDB()
+
+	assert.NoError(t, service.CheckRegistration("alice@example.com", ""), "registration is open by default")
+
+	_, err := service.SetRegistration("admin-1", SetRegistrationRequest{Mode: RegistrationInviteOnly})
+	assert.Equal(t, "INVITE_CODES_REQUIRED", errorCode(err))
+
+	mock.ExpectExec(`INSERT INTO settings`).
+		WithArgs(RegistrationKey, sqlmock.AnyArg(), "admin-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	codes := []string{"welcome-2024"}
+	state, err := service.SetRegistration("admin-1", SetRegistrationRequest{
+		Mode:           RegistrationInviteOnly,
+		AllowedDomains: []string{"Example.com"},
+		InviteCodes:    &codes,
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, state.InviteCodes, "invite codes are never returned")
+	assert.Equal(t, 1, state.InviteCodeCount)
+
+	cases := []struct {
+		email, code, want string
+	}{
+		{"alice@example.com", "welcome-2024", ""},
+		{"alice@example.com", "", "INVITE_CODE_REQUIRED"},
+		{"alice@example.com", "guessed-code", "INVALID_INVITE_CODE"},
+		{"alice@other.com", "welcome-2024", "EMAIL_DOMAIN_NOT_ALLOWED"},
+		{"alice@sub.example.com", "welcome-2024", "EMAIL_DOMAIN_NOT_ALLOWED"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, errorCode(service.CheckRegistration(tc.email, tc.code)), tc.email+" "+tc.code)
+	}
+
+	mock.ExpectExec(`INSERT INTO settings`).
+		WithArgs(RegistrationKey, sqlmock.AnyArg(), "admin-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	state, err = service.SetRegistration("admin-1", SetRegistrationRequest{Mode: RegistrationClosed})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, state.InviteCodeCount, "omitting invite_codes keeps the current ones")
+	assert.Equal(t, "REGISTRATION_DISABLED", errorCode(service.CheckRegistration("alice@example.com", "welcome-2024")))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestProfilePolicy(t *testing.T) {
+	service, mock, closeDB := newTestService(t)
+	defer closeDB()
+
+	assert.Equal(t, []string{}, service.ProfilePolicy().RequiredFields, "nothing is required by default")
+
+	_, err := service.SetProfilePolicy("admin-1", SetProfilePolicyRequest{RequiredFields: []string{"password"}})
+	assert.Equal(t, "INVALID_PROFILE_FIELD", errorCode(err))
+	_, err = service.SetProfilePolicy("admin-1", SetProfilePolicyRequest{RequiredFields: []string{"attributes."}})
+	assert.Equal(t, "INVALID_PROFILE_FIELD", errorCode(err))
+
+	mock.ExpectExec(`INSERT INTO settings`).
+		WithArgs(ProfilePolicyKey, sqlmock.AnyArg(), "admin-1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	policy, err := service.SetProfilePolicy("admin-1", SetProfilePolicyRequest{
+		RequiredFields: []string{"phone", "attributes.department", "phone"},
+		Enforce:        true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"phone", "attributes.department"}, policy.RequiredFields, "duplicates are dropped")
+
+	fields, enforce := service.ProfileRequirements()
+	assert.Equal(t, []string{"phone", "attributes.department"}, fields)
+	assert.True(t, enforce)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// errorCode returns the code of an apperrors error, or "" for nil
+func errorCode(err error) string {
+	if appErr, ok := apperrors.As(err); ok {
+		return appErr.Code
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -0,0 +1,470 @@
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/emailtemplates"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ManagePermission is required to provision and offboard tenants
+const ManagePermission = perm.ManageTenants
+
+func init() {
+	rbac.RegisterPermissions(rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440023", Name: string(ManagePermission), Resource: "tenants", Action: "manage",
+		Category: "System", Description: "Provision and offboard tenants", RiskLevel: rbac.RiskHigh})
+}
+
+// InviteEvent identifies the invitation sent to the first administrator of a tenant
+const InviteEvent = "tenant.admin_invited"
+
+// InvitationLifetime is how long the invitation of a tenant's first administrator is valid
+const InvitationLifetime = 7 * 24 * time.Hour
+
+// Placeholder is replaced by the tenant slug in the names and descriptions of a Template
+const Placeholder = "{tenant}"
+
+var validate = validator.New()
+
+// slugPattern restricts slugs to lower-case letters, digits and '-', so they can name roles,
+// groups and a schema
+var slugPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{1,39}$`)
+
+// Template is the access setup every tenant starts from, with Placeholder in role and group
+// names. The first administrator's invitation puts them in AdminGroups.
+type Template struct {
+	rbac.BootstrapSpec
+	AdminGroups []string `json:"admin_groups"`
+}
+
+// DefaultTemplate gives each tenant an administrator role over users and group membership and
+// a group holding it
+var DefaultTemplate = Template{
+	BootstrapSpec: rbac.BootstrapSpec{
+		Roles: []rbac.BootstrapRole{{
+			Key:         Placeholder + "-admin",
+			Name:        Placeholder + "-admin",
+			Description: "Administers the users of tenant " + Placeholder,
+			Permissions: []string{
+				string(perm.CreateUser), string(perm.ReadUser), string(perm.UpdateUser), string(perm.DeleteUser),
+				string(perm.ReadGroup), string(perm.ManageGroupMembership),
+			},
+		}},
+		Groups: []rbac.BootstrapGroup{{
+			Name:        Placeholder + "-admins",
+			Description: "Administrators of tenant " + Placeholder,
+			Roles:       []string{Placeholder + "-admin"},
+		}},
+	},
+	AdminGroups: []string{Placeholder + "-admins"},
+}
+
+// LoadTemplate reads a Template from a JSON file, rejecting unknown fields
+func LoadTemplate(path string) (Template, error) {
+	var template Template
+	f, err := os.Open(path)
+	if err != nil {
+		return template, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&template); err != nil {
+		return template, fmt.Errorf("parse %s: %w", path, err)
+	}
+	// Platform administration stays with the hosting operator
+	for _, role := range template.Roles {
+		for _, name := range role.Permissions {
+			if perm.Platform(name) {
+				return template, fmt.Errorf("%s: role %q grants platform permission %q", path, role.Name, name)
+			}
+		}
+	}
+	return template, nil
+}
+
+// For returns the bootstrap spec and admin groups of the tenant slug
+func (t Template) For(slug string) (rbac.BootstrapSpec, []string) {
+	fill := func(s string) string { return strings.ReplaceAll(s, Placeholder, slug) }
+	fillAll := func(names []string) []string {
+		filled := make([]string, len(names))
+		for i, name := range names {
+			filled[i] = fill(name)
+		}
+		return filled
+	}
+
+	spec := rbac.BootstrapSpec{Permissions: t.Permissions}
+	for _, role := range t.Roles {
+		spec.Roles = append(spec.Roles, rbac.BootstrapRole{Key: fill(role.Key), Name: fill(role.Name), Description: fill(role.Description), Permissions: role.Permissions})
+	}
+	for _, group := range t.Groups {
+		spec.Groups = append(spec.Groups, rbac.BootstrapGroup{Name: fill(group.Name), Description: fill(group.Description), Roles: fillAll(group.Roles)})
+	}
+	return spec, fillAll(t.AdminGroups)
+}
+
+// AccessBootstrapper creates and removes the roles and groups of tenants
+type AccessBootstrapper interface {
+	Bootstrap(ctx context.Context, spec rbac.BootstrapSpec) (*rbac.BootstrapResult, error)
+	Unbootstrap(ctx context.Context, result rbac.BootstrapResult) error
+}
+
+// ProvisionRequest represents the request to provision a tenant
+type ProvisionRequest struct {
+	Slug       string `json:"slug" validate:"required"`
+	Name       string `json:"name" validate:"required,min=1,max=100"`
+	AdminEmail string `json:"admin_email" validate:"required,email,max=255"`
+	// CreateSchema gives the tenant its own database schema, named after the slug
+	CreateSchema bool `json:"create_schema"`
+}
+
+// Provisioned is a new tenant with the invitation of its first administrator. InviteCode is
+// only ever returned here.
+type Provisioned struct {
+	Tenant     *Tenant     `json:"tenant"`
+	Invitation *Invitation `json:"invitation"`
+	InviteCode string      `json:"invite_code"`
+}
+
+// Service provisions and offboards tenants
+type Service struct {
+	repo     TenantRepository
+	access   AccessBootstrapper
+	template Template
+	logger   *logrus.Logger
+	now      func() time.Time
+
+	// invites, when set, delivers the invitation of a tenant's first administrator
+	invites     notification.Notifier
+	templates   *emailtemplates.Service
+	registerURL string
+
+	// suspended holds the slugs of suspended tenants, checked on every request
+	mu        sync.RWMutex
+	suspended map[string]bool
+}
+
+// NewService creates a new tenant service giving each tenant the access setup of template
+func NewService(repo TenantRepository, access AccessBootstrapper, template Template, logger *logrus.Logger) *Service {
+	return &Service{
+		repo:      repo,
+		access:    access,
+		template:  template,
+		logger:    logger,
+		now:       time.Now,
+		suspended: make(map[string]bool),
+	}
+}
+
+// SetInviteDelivery sends the invitation of each new tenant's first administrator through
+// notifier, worded with the invite email template and pointing at registerURL. Without it the
+// invite code is only returned to the caller. Set it before serving requests.
+func (s *Service) SetInviteDelivery(notifier notification.Notifier, templates *emailtemplates.Service, registerURL string) {
+	s.invites = notifier
+	s.templates = templates
+	s.registerURL = registerURL
+}
+
+// SchemaName is the database schema of the tenant slug
+func SchemaName(slug string) string {
+	return "tenant_" + strings.ReplaceAll(slug, "-", "_")
+}
+
+// hashCode returns the stored form of an invite code
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Provision creates a tenant with its roles and groups, the invitation of its first
+// administrator and, when asked, its schema. When any step fails the ones before it are undone.
+func (s *Service) Provision(ctx context.Context, req ProvisionRequest, createdBy string) (*Provisioned, error) {
+	logger := s.logger.WithContext(ctx).WithField("tenant", req.Slug)
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	if !slugPattern.MatchString(req.Slug) {
+		return nil, &rbac.ValidationError{Field: "slug", Message: "must be 2 to 40 lower-case letters, digits or '-', starting with a letter"}
+	}
+	existing, err := s.repo.GetBySlug(req.Slug)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, apperrors.Conflict("TENANT_EXISTS", "a tenant with this slug already exists")
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	code := base64.RawURLEncoding.EncodeToString(random)
+
+	spec, adminGroups := s.template.For(req.Slug)
+	created, err := s.access.Bootstrap(ctx, spec)
+	if err != nil {
+		logger.WithError(err).Error("Failed to bootstrap tenant access")
+		return nil, fmt.Errorf("bootstrap tenant access: %w", err)
+	}
+
+	now := s.now()
+	tenant := &Tenant{
+		ID:         uuid.New().String(),
+		Slug:       req.Slug,
+		Name:       req.Name,
+		AdminEmail: req.AdminEmail,
+		Roles:      created.CreatedRoles,
+		Groups:     created.CreatedGroups,
+		CreatedBy:  createdBy,
+		CreatedAt:  now,
+	}
+	if req.CreateSchema {
+		tenant.Schema = SchemaName(req.Slug)
+	}
+	invitation := &Invitation{
+		ID:        uuid.New().String(),
+		TenantID:  tenant.ID,
+		Email:     req.AdminEmail,
+		CodeHash:  hashCode(code),
+		Groups:    adminGroups,
+		ExpiresAt: now.Add(InvitationLifetime),
+		CreatedAt: now,
+	}
+	if err := s.repo.Create(tenant, invitation); err != nil {
+		logger.WithError(err).Error("Failed to create tenant")
+		if undoErr := s.access.Unbootstrap(ctx, *created); undoErr != nil {
+			logger.WithError(undoErr).Error("Failed to remove the access setup of a tenant that was not created")
+		}
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{"tenant_id": tenant.ID, "created_by": createdBy}).Info("Tenant provisioned")
+	s.sendInvite(ctx, tenant, invitation, code)
+	return &Provisioned{Tenant: tenant, Invitation: invitation, InviteCode: code}, nil
+}
+
+// sendInvite delivers the invitation of the tenant's first administrator. Failures are logged:
+// the caller got the code and can pass it on.
+func (s *Service) sendInvite(ctx context.Context, tenant *Tenant, invitation *Invitation, code string) {
+	if s.invites == nil {
+		return
+	}
+	logger := s.logger.WithContext(ctx).WithField("tenant", tenant.Slug)
+	msg := &emailtemplates.Message{
+		Subject: fmt.Sprintf("You are invited to administer %s", tenant.Name),
+		Text:    fmt.Sprintf("Register at %s with the invite code %s to administer %s.", s.registerURL, code, tenant.Name),
+	}
+	if s.templates != nil {
+		rendered, err := s.templates.Render(emailtemplates.Invite, emailtemplates.DefaultLocale, map[string]interface{}{
+			"InviterName": tenant.Name,
+			"RegisterURL": s.registerURL,
+			"InviteCode":  code,
+		})
+		if err == nil {
+			msg = rendered
+		} else {
+			logger.WithError(err).Error("Failed to render invite template")
+		}
+	}
+	data := map[string]interface{}{
+		"tenant":     tenant.Slug,
+		"email":      invitation.Email,
+		"expires_at": invitation.ExpiresAt,
+	}
+	if msg.HTML != "" {
+		data["html"] = msg.HTML
+	}
+	err := s.invites.Notify(ctx, notification.Notification{
+		Type:       InviteEvent,
+		Severity:   notification.SeverityInfo,
+		Subject:    msg.Subject,
+		Message:    msg.Text,
+		Data:       data,
+		OccurredAt: invitation.CreatedAt,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to send tenant admin invitation")
+	}
+}
+
+// Get returns the tenant slug
+func (s *Service) Get(slug string) (*Tenant, error) {
+	tenant, err := s.repo.GetBySlug(slug)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, apperrors.NotFound("TENANT_NOT_FOUND", "tenant not found")
+	}
+	return tenant, nil
+}
+
+// List returns every tenant
+func (s *Service) List() ([]Tenant, error) {
+	return s.repo.List()
+}
+
+// Teardown offboards the tenant slug: its roles and groups are deleted first, then the tenant
+// with its invitations and schema. A teardown that failed part way can be retried.
+func (s *Service) Teardown(ctx context.Context, slug, deletedBy string) error {
+	tenant, err := s.Get(slug)
+	if err != nil {
+		return err
+	}
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{"tenant": slug, "tenant_id": tenant.ID})
+	if err := s.access.Unbootstrap(ctx, rbac.BootstrapResult{CreatedRoles: tenant.Roles, CreatedGroups: tenant.Groups}); err != nil {
+		logger.WithError(err).Error("Failed to remove tenant access")
+		return fmt.Errorf("remove tenant access: %w", err)
+	}
+	if err := s.repo.Delete(tenant); err != nil {
+		logger.WithError(err).Error("Failed to delete tenant")
+		return err
+	}
+	s.setSuspended(slug, false)
+	logger.WithField("deleted_by", deletedBy).Info("Tenant offboarded")
+	return nil
+}
+
+// CheckInvitation reports whether code is a pending invitation of email
+func (s *Service) CheckInvitation(email, code string) (bool, error) {
+	invitation, err := s.repo.PendingInvitation(email, hashCode(code), s.now())
+	if err != nil {
+		return false, err
+	}
+	return invitation != nil, nil
+}
+
+// RedeemInvitation accepts the invitation of email with code for userID and returns the groups
+// it grants
+func (s *Service) RedeemInvitation(ctx context.Context, email, code, userID string) ([]string, error) {
+	now := s.now()
+	invitation, err := s.repo.PendingInvitation(email, hashCode(code), now)
+	if err != nil {
+		return nil, err
+	}
+	if invitation == nil {
+		return nil, apperrors.NotFound("INVITATION_NOT_FOUND", "invitation not found or expired")
+	}
+	accepted, err := s.repo.AcceptInvitation(invitation.ID, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !accepted {
+		return nil, apperrors.Conflict("INVITATION_ACCEPTED", "invitation was accepted already")
+	}
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"tenant_id": invitation.TenantID, "user_id": userID}).Info("Tenant invitation accepted")
+	return invitation.Groups, nil
+}
+
+// HTTP Handlers
+
+// writeServiceError writes validation failures as 400s and everything else through the shared
+// domain error mapper
+func writeServiceError(w http.ResponseWriter, err error, fallbackMessage string) {
+	var fieldErrs validator.ValidationErrors
+	if errors.As(err, &fieldErrs) {
+		httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", nil)
+		return
+	}
+	if ve, ok := err.(*rbac.ValidationError); ok {
+		httpapi.WriteErrorResponse(w, http.StatusBadRequest, ve.Error(), "VALIDATION_ERROR", map[string]string{ve.Field: ve.Message})
+		return
+	}
+	httpapi.WriteError(w, err, fallbackMessage)
+}
+
+// ProvisionHandler handles POST /api/tenants
+func ProvisionHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ProvisionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		provisioned, err := service.Provision(r.Context(), req, rbac.UserIDFromContext(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to provision tenant")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(provisioned)
+	}
+}
+
+// ListHandler handles GET /api/tenants
+func ListHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+		tenants, err := service.List()
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list tenants")
+			return
+		}
+		if tenants == nil {
+			tenants = []Tenant{}
+		}
+		httpapi.WriteList(w, r, httpapi.Paginate(tenants, page), len(tenants), page)
+	}
+}
+
+// GetHandler handles GET /api/tenants/{slug}
+func GetHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := service.Get(mux.Vars(r)["slug"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get tenant")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenant)
+	}
+}
+
+// TeardownHandler handles DELETE /api/tenants/{slug}
+func TeardownHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.Teardown(r.Context(), mux.Vars(r)["slug"], rbac.UserIDFromContext(r.Context())); err != nil {
+			httpapi.WriteError(w, err, "Failed to offboard tenant")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SetupRoutes configures the tenant routes
+func SetupRoutes(r *mux.Router, service *Service, rbacService *rbac.RBACService) {
+	rbacService.Protect(r.HandleFunc("/api/tenants", ListHandler(service)).Methods("GET"), ManagePermission)
+	rbacService.Protect(r.HandleFunc("/api/tenants", ProvisionHandler(service)).Methods("POST"), ManagePermission)
+	rbacService.Protect(r.HandleFunc("/api/tenants/{slug}", GetHandler(service)).Methods("GET"), ManagePermission)
+	rbacService.Protect(r.HandleFunc("/api/tenants/{slug}", TeardownHandler(service)).Methods("DELETE"), ManagePermission)
+}
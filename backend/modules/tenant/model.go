@@ -0,0 +1,178 @@
+package tenant
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"base-app/pkg/database"
+
+	"github.com/lib/pq"
+)
+
+// Tenant is an organisation provisioned on the installation. Its roles and groups are the ones
+// the bootstrap created for it, by name, and are deleted with it.
+type Tenant struct {
+	ID         string `json:"id" db:"id"`
+	Slug       string `json:"slug" db:"slug"`
+	Name       string `json:"name" db:"name"`
+	Schema     string `json:"schema,omitempty" db:"schema_name"`
+	AdminEmail string `json:"admin_email" db:"admin_email"`
+	// Roles are the keys of the roles created for the tenant
+	Roles     []string  `json:"roles" db:"role_names"`
+	Groups    []string  `json:"groups" db:"group_names"`
+	CreatedBy string    `json:"created_by" db:"created_by"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	// SuspendedAt is set while the tenant is suspended; its callers are then turned away
+	SuspendedAt   *time.Time `json:"suspended_at,omitempty" db:"suspended_at"`
+	SuspendReason string     `json:"suspend_reason,omitempty" db:"suspend_reason"`
+}
+
+// Invitation is a personal invitation to register, issued to the first administrator of a
+// tenant. Only the SHA-256 hash of its code is stored.
+type Invitation struct {
+	ID         string     `json:"id" db:"id"`
+	TenantID   string     `json:"tenant_id" db:"tenant_id"`
+	Email      string     `json:"email" db:"email"`
+	CodeHash   string     `json:"-" db:"code_hash"`
+	Groups     []string   `json:"groups" db:"group_names"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedBy string     `json:"accepted_by,omitempty" db:"accepted_by"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty" db:"accepted_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+}
+
+// TenantRepository interface defines methods for tenant data access
+type TenantRepository interface {
+	// Create stores tenant with its invitation and, when tenant.Schema is set, creates the schema,
+	// all in one transaction
+	Create(tenant *Tenant, invitation *Invitation) error
+	// GetBySlug returns the tenant, or nil when there is none
+	GetBySlug(slug string) (*Tenant, error)
+	// List returns every tenant by slug
+	List() ([]Tenant, error)
+	// Delete removes the tenant with its invitations and drops its schema, in one transaction
+	Delete(tenant *Tenant) error
+	// SetSuspended suspends the tenant since at, or resumes it when at is nil
+	SetSuspended(id string, at *time.Time, reason string) error
+	// ListSuspended returns the slugs of the suspended tenants
+	ListSuspended() ([]string, error)
+	// PendingInvitation returns the unaccepted, unexpired invitation of email with codeHash, or nil
+	PendingInvitation(email, codeHash string, now time.Time) (*Invitation, error)
+	// AcceptInvitation marks the invitation accepted by userID; it reports false when it was
+	// accepted already
+	AcceptInvitation(id, userID string, at time.Time) (bool, error)
+}
+
+// tenantRepository implements TenantRepository
+type tenantRepository struct {
+	db database.DBTX
+}
+
+// NewTenantRepository creates a new tenant repository
+func NewTenantRepository(db *sql.DB) TenantRepository {
+	return &tenantRepository{db: db}
+}
+
+func (r *tenantRepository) Create(tenant *Tenant, invitation *Invitation) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		query := `INSERT INTO tenants (id, slug, name, schema_name, admin_email, role_names, group_names, created_by, created_at)
+		          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		if _, err := tx.Exec(query, tenant.ID, tenant.Slug, tenant.Name, tenant.Schema, tenant.AdminEmail,
+			pq.Array(tenant.Roles), pq.Array(tenant.Groups), tenant.CreatedBy, tenant.CreatedAt); err != nil {
+			return err
+		}
+		query = `INSERT INTO tenant_invitations (id, tenant_id, email, code_hash, group_names, expires_at, created_at)
+		         VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		if _, err := tx.Exec(query, invitation.ID, invitation.TenantID, invitation.Email, invitation.CodeHash,
+			pq.Array(invitation.Groups), invitation.ExpiresAt, invitation.CreatedAt); err != nil {
+			return err
+		}
+		if tenant.Schema != "" {
+			if _, err := tx.Exec(`CREATE SCHEMA ` + pq.QuoteIdentifier(tenant.Schema)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const tenantSelect = `SELECT id, slug, name, schema_name, admin_email, role_names, group_names, created_by, created_at,
+	suspended_at, suspend_reason FROM tenants`
+
+func scanTenant(row database.Scanner) (Tenant, error) {
+	var t Tenant
+	var suspendedAt sql.NullTime
+	err := row.Scan(&t.ID, &t.Slug, &t.Name, &t.Schema, &t.AdminEmail, pq.Array(&t.Roles), pq.Array(&t.Groups), &t.CreatedBy, &t.CreatedAt,
+		&suspendedAt, &t.SuspendReason)
+	if suspendedAt.Valid {
+		t.SuspendedAt = &suspendedAt.Time
+	}
+	return t, err
+}
+
+func (r *tenantRepository) GetBySlug(slug string) (*Tenant, error) {
+	t, err := scanTenant(r.db.QueryRow(tenantSelect+` WHERE slug = $1`, slug))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *tenantRepository) List() ([]Tenant, error) {
+	return database.QueryAll(r.db, "list tenants", scanTenant, tenantSelect+` ORDER BY slug`)
+}
+
+func (r *tenantRepository) Delete(tenant *Tenant) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		if tenant.Schema != "" {
+			if _, err := tx.Exec(`DROP SCHEMA IF EXISTS ` + pq.QuoteIdentifier(tenant.Schema) + ` CASCADE`); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM tenants WHERE id = $1`, tenant.ID)
+		return err
+	})
+}
+
+func (r *tenantRepository) SetSuspended(id string, at *time.Time, reason string) error {
+	_, err := r.db.Exec(`UPDATE tenants SET suspended_at = $2, suspend_reason = $3 WHERE id = $1`, id, at, reason)
+	return err
+}
+
+func (r *tenantRepository) ListSuspended() ([]string, error) {
+	return database.QueryAll(r.db, "list suspended tenants", func(row database.Scanner) (string, error) {
+		var slug string
+		err := row.Scan(&slug)
+		return slug, err
+	}, `SELECT slug FROM tenants WHERE suspended_at IS NOT NULL ORDER BY slug`)
+}
+
+func (r *tenantRepository) PendingInvitation(email, codeHash string, now time.Time) (*Invitation, error) {
+	query := `SELECT id, tenant_id, email, code_hash, group_names, expires_at, created_at
+	          FROM tenant_invitations
+	          WHERE lower(email) = $1 AND code_hash = $2 AND accepted_at IS NULL AND expires_at > $3`
+	var inv Invitation
+	err := r.db.QueryRow(query, strings.ToLower(email), codeHash, now).Scan(
+		&inv.ID, &inv.TenantID, &inv.Email, &inv.CodeHash, pq.Array(&inv.Groups), &inv.ExpiresAt, &inv.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (r *tenantRepository) AcceptInvitation(id, userID string, at time.Time) (bool, error) {
+	query := `UPDATE tenant_invitations SET accepted_by = $2, accepted_at = $3 WHERE id = $1 AND accepted_at IS NULL`
+	result, err := r.db.Exec(query, id, userID, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
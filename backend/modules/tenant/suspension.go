@@ -0,0 +1,135 @@
+package tenant
+
+import (
+	"context"
+	"time"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SuspendRequest represents the request to suspend a tenant
+type SuspendRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+// Refresh reloads which tenants are suspended
+func (s *Service) Refresh() error {
+	slugs, err := s.repo.ListSuspended()
+	if err != nil {
+		return err
+	}
+	suspended := make(map[string]bool, len(slugs))
+	for _, slug := range slugs {
+		suspended[slug] = true
+	}
+	s.mu.Lock()
+	s.suspended = suspended
+	s.mu.Unlock()
+	return nil
+}
+
+// StartRefresh reloads which tenants are suspended every interval until ctx is cancelled, so
+// suspensions made on other instances take effect here too
+func (s *Service) StartRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.Refresh(); err != nil {
+					s.logger.WithError(err).Warn("Failed to refresh suspended tenants")
+				}
+			}
+		}
+	}()
+}
+
+// TenantSuspended reports whether the tenant slug is suspended
+func (s *Service) TenantSuspended(slug string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.suspended[slug]
+}
+
+func (s *Service) setSuspended(slug string, suspended bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if suspended {
+		s.suspended[slug] = true
+	} else {
+		delete(s.suspended, slug)
+	}
+}
+
+// Suspend turns away the callers of the tenant slug until it is resumed. Its data, roles and
+// groups are kept.
+func (s *Service) Suspend(ctx context.Context, slug string, req SuspendRequest, suspendedBy string) (*Tenant, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	tenant, err := s.Get(slug)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.SuspendedAt != nil {
+		return nil, apperrors.Conflict("TENANT_SUSPENDED", "the tenant is already suspended")
+	}
+	now := s.now()
+	if err := s.repo.SetSuspended(tenant.ID, &now, req.Reason); err != nil {
+		return nil, err
+	}
+	s.setSuspended(slug, true)
+	tenant.SuspendedAt, tenant.SuspendReason = &now, req.Reason
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"tenant": slug, "suspended_by": suspendedBy, "reason": req.Reason}).Warn("Tenant suspended")
+	return tenant, nil
+}
+
+// Resume lets the callers of the suspended tenant slug back in
+func (s *Service) Resume(ctx context.Context, slug, resumedBy string) (*Tenant, error) {
+	tenant, err := s.Get(slug)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.SuspendedAt == nil {
+		return nil, apperrors.Conflict("TENANT_NOT_SUSPENDED", "the tenant is not suspended")
+	}
+	if err := s.repo.SetSuspended(tenant.ID, nil, ""); err != nil {
+		return nil, err
+	}
+	s.setSuspended(slug, false)
+	tenant.SuspendedAt, tenant.SuspendReason = nil, ""
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"tenant": slug, "resumed_by": resumedBy}).Info("Tenant resumed")
+	return tenant, nil
+}
+
+// AdminRoles returns the keys of the roles the first administrator of tenant gets through the
+// admin groups of the template, which are the roles of the tenant's admin context
+func (s *Service) AdminRoles(tenant *Tenant) []string {
+	spec, adminGroups := s.template.For(tenant.Slug)
+	var roles []string
+	seen := make(map[string]bool)
+	for _, group := range spec.Groups {
+		for _, name := range adminGroups {
+			if group.Name != name {
+				continue
+			}
+			for _, role := range group.Roles {
+				if !seen[role] {
+					seen[role] = true
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	return roles
+}
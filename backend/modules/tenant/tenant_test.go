@@ -0,0 +1,265 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTenantRepo struct {
+	tenants     map[string]*Tenant
+	invitations []*Invitation
+	failCreate  error
+	deleted     []string
+}
+
+func newFakeTenantRepo() *fakeTenantRepo {
+	return &fakeTenantRepo{tenants: make(map[string]*Tenant)}
+}
+
+func (r *fakeTenantRepo) Create(tenant *Tenant, invitation *Invitation) error {
+	if r.failCreate != nil {
+		return r.failCreate
+	}
+	r.tenants[tenant.Slug] = tenant
+	r.invitations = append(r.invitations, invitation)
+	return nil
+}
+
+func (r *fakeTenantRepo) GetBySlug(slug string) (*Tenant, error) {
+	return r.tenants[slug], nil
+}
+
+func (r *fakeTenantRepo) List() ([]Tenant, error) {
+	var list []Tenant
+	for _, t := range r.tenants {
+		list = append(list, *t)
+	}
+	return list, nil
+}
+
+func (r *fakeTenantRepo) Delete(tenant *Tenant) error {
+	delete(r.tenants, tenant.Slug)
+	r.deleted = append(r.deleted, tenant.Slug)
+	return nil
+}
+
+func (r *fakeTenantRepo) SetSuspended(id string, at *time.Time, reason string) error {
+	for _, t := range r.tenants {
+		if t.ID == id {
+			t.SuspendedAt, t.SuspendReason = at, reason
+		}
+	}
+	return nil
+}
+
+func (r *fakeTenantRepo) ListSuspended() ([]string, error) {
+	var slugs []string
+	for slug, t := range r.tenants {
+		if t.SuspendedAt != nil {
+			slugs = append(slugs, slug)
+		}
+	}
+	return slugs, nil
+}
+
+func (r *fakeTenantRepo) PendingInvitation(email, codeHash string, now time.Time) (*Invitation, error) {
+	for _, inv := range r.invitations {
+		if inv.Email == email && inv.CodeHash == codeHash && inv.AcceptedAt == nil && inv.ExpiresAt.After(now) {
+			return inv, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *fakeTenantRepo) AcceptInvitation(id, userID string, at time.Time) (bool, error) {
+	for _, inv := range r.invitations {
+		if inv.ID == id && inv.AcceptedAt == nil {
+			inv.AcceptedBy, inv.AcceptedAt = userID, &at
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type fakeAccess struct {
+	bootstrapped []rbac.BootstrapSpec
+	removed      []rbac.BootstrapResult
+}
+
+func (a *fakeAccess) Bootstrap(ctx context.Context, spec rbac.BootstrapSpec) (*rbac.BootstrapResult, error) {
+	a.bootstrapped = append(a.bootstrapped, spec)
+	result := &rbac.BootstrapResult{}
+	for _, role := range spec.Roles {
+		result.CreatedRoles = append(result.CreatedRoles, role.Name)
+	}
+	for _, group := range spec.Groups {
+		result.CreatedGroups = append(result.CreatedGroups, group.Name)
+	}
+	return result, nil
+}
+
+func (a *fakeAccess) Unbootstrap(ctx context.Context, result rbac.BootstrapResult) error {
+	a.removed = append(a.removed, result)
+	return nil
+}
+
+type recordingNotifier struct {
+	sent []notification.Notification
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, note notification.Notification) error {
+	n.sent = append(n.sent, note)
+	return nil
+}
+
+func newTestService() (*Service, *fakeTenantRepo, *fakeAccess) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	repo, access := newFakeTenantRepo(), &fakeAccess{}
+	return NewService(repo, access, DefaultTemplate, logger), repo, access
+}
+
+func TestProvisionBootstrapsAndInvitesAdmin(t *testing.T) {
+	service, repo, access := newTestService()
+	notifier := &recordingNotifier{}
+	service.SetInviteDelivery(notifier, nil, "https://example.com/register")
+
+	provisioned, err := service.Provision(context.Background(), ProvisionRequest{
+		Slug: "acme-corp", Name: "Acme", AdminEmail: "admin@acme.test", CreateSchema: true,
+	}, "root")
+	require.NoError(t, err)
+
+	require.Len(t, access.bootstrapped, 1)
+	assert.Equal(t, "acme-corp-admin", access.bootstrapped[0].Roles[0].Name)
+	assert.Equal(t, []string{"acme-corp-admin"}, access.bootstrapped[0].Groups[0].Roles)
+	assert.Equal(t, "tenant_acme_corp", provisioned.Tenant.Schema)
+	assert.Equal(t, []string{"acme-corp-admins"}, provisioned.Tenant.Groups)
+	assert.Equal(t, []string{"acme-corp-admins"}, provisioned.Invitation.Groups)
+	assert.NotEqual(t, provisioned.InviteCode, provisioned.Invitation.CodeHash, "only the hash is stored")
+
+	require.Len(t, notifier.sent, 1)
+	assert.Contains(t, notifier.sent[0].Message, provisioned.InviteCode)
+
+	_, err = service.Provision(context.Background(), ProvisionRequest{Slug: "acme-corp", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	_, err = service.Provision(context.Background(), ProvisionRequest{Slug: "Acme_Corp", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	var ve *rbac.ValidationError
+	require.ErrorAs(t, err, &ve)
+	assert.Equal(t, "slug", ve.Field)
+	assert.Len(t, repo.tenants, 1)
+}
+
+func TestProvisionUndoesBootstrapWhenCreateFails(t *testing.T) {
+	service, repo, access := newTestService()
+	repo.failCreate = errors.New("schema exists")
+
+	_, err := service.Provision(context.Background(), ProvisionRequest{Slug: "acme", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	require.Error(t, err)
+	require.Len(t, access.removed, 1)
+	assert.Equal(t, []string{"acme-admin"}, access.removed[0].CreatedRoles)
+	assert.Equal(t, []string{"acme-admins"}, access.removed[0].CreatedGroups)
+}
+
+func TestInvitationIsRedeemedOnce(t *testing.T) {
+	service, _, _ := newTestService()
+	provisioned, err := service.Provision(context.Background(), ProvisionRequest{Slug: "acme", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	require.NoError(t, err)
+
+	invited, err := service.CheckInvitation("admin@acme.test", "wrong")
+	require.NoError(t, err)
+	assert.False(t, invited)
+	invited, err = service.CheckInvitation("admin@acme.test", provisioned.InviteCode)
+	require.NoError(t, err)
+	assert.True(t, invited)
+
+	groups, err := service.RedeemInvitation(context.Background(), "admin@acme.test", provisioned.InviteCode, "user-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme-admins"}, groups)
+
+	_, err = service.RedeemInvitation(context.Background(), "admin@acme.test", provisioned.InviteCode, "user-2")
+	assert.Equal(t, apperrors.KindNotFound, apperrors.KindOf(err))
+}
+
+func TestTeardownRemovesAccessBeforeTenant(t *testing.T) {
+	service, repo, access := newTestService()
+	_, err := service.Provision(context.Background(), ProvisionRequest{Slug: "acme", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	require.NoError(t, err)
+
+	require.NoError(t, service.Teardown(context.Background(), "acme", "root"))
+	require.Len(t, access.removed, 1)
+	assert.Equal(t, []string{"acme-admins"}, access.removed[0].CreatedGroups)
+	assert.Equal(t, []string{"acme"}, repo.deleted)
+
+	err = service.Teardown(context.Background(), "acme", "root")
+	assert.Equal(t, apperrors.KindNotFound, apperrors.KindOf(err))
+}
+
+func TestSuspendAndResume(t *testing.T) {
+	service, repo, _ := newTestService()
+	_, err := service.Provision(context.Background(), ProvisionRequest{Slug: "acme", Name: "Acme", AdminEmail: "admin@acme.test"}, "root")
+	require.NoError(t, err)
+
+	_, err = service.Suspend(context.Background(), "acme", SuspendRequest{}, "operator")
+	require.Error(t, err, "a reason is required")
+	suspended, err := service.Suspend(context.Background(), "acme", SuspendRequest{Reason: "unpaid invoices"}, "operator")
+	require.NoError(t, err)
+	assert.NotNil(t, suspended.SuspendedAt)
+	assert.True(t, service.TenantSuspended("acme"))
+	_, err = service.Suspend(context.Background(), "acme", SuspendRequest{Reason: "again"}, "operator")
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+
+	// Another instance learns of the suspension on refresh
+	other := NewService(repo, &fakeAccess{}, DefaultTemplate, service.logger)
+	require.NoError(t, other.Refresh())
+	assert.True(t, other.TenantSuspended("acme"))
+
+	_, err = service.Resume(context.Background(), "acme", "operator")
+	require.NoError(t, err)
+	assert.False(t, service.TenantSuspended("acme"))
+	assert.Equal(t, []string{"acme-admin"}, service.AdminRoles(repo.tenants["acme"]))
+}
+
+func TestLoadTemplateRejectsPlatformPermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenant.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"roles": [{"name": "{tenant}-admin", "permissions": ["read_user", "platform_admin_suspend_tenants"]}]}`), 0o600))
+	_, err := LoadTemplate(path)
+	assert.ErrorContains(t, err, "platform permission")
+}
+
+func TestRepositoryCreatesTenantSchemaInTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	repo := NewTenantRepository(db)
+	tenant := &Tenant{ID: "t1", Slug: "acme", Schema: "tenant_acme", Roles: []string{}, Groups: []string{}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO tenants").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO tenant_invitations").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`CREATE SCHEMA "tenant_acme"`)).WillReturnError(errors.New("schema exists"))
+	mock.ExpectRollback()
+	require.Error(t, repo.Create(tenant, &Invitation{ID: "i1", TenantID: "t1"}))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DROP SCHEMA IF EXISTS "tenant_acme" CASCADE`)).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM tenants").WithArgs("t1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	require.NoError(t, repo.Delete(tenant))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
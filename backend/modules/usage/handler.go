@@ -0,0 +1,249 @@
+package usage
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ReadPermission is required to view API usage
+const ReadPermission = perm.ReadUsage
+
+func init() {
+	rbac.RegisterPermissions(rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440021", Name: string(ReadPermission), Resource: "usage", Action: "read",
+		Category: "Monitoring", Description: "View API usage and quota consumption", RiskLevel: rbac.RiskLow})
+}
+
+// Recorder counts requests per client and endpoint in memory and periodically adds the
+// counts to the hourly rollup table, so recording never waits on the database
+type Recorder struct {
+	repo   UsageRepository
+	logger *logrus.Logger
+	now    func() time.Time
+
+	// tenant, when set, identifies the tenant of each request
+	tenant func(*http.Request) string
+
+	mu      sync.Mutex
+	pending map[Key]Counters
+}
+
+// NewRecorder creates a new usage recorder
+func NewRecorder(repo UsageRepository, logger *logrus.Logger) *Recorder {
+	return &Recorder{
+		repo:    repo,
+		logger:  logger,
+		now:     time.Now,
+		pending: make(map[Key]Counters),
+	}
+}
+
+// SetTenantIdentifier also rolls up the requests of each tenant identify returns one for. Set it
+// before serving requests.
+func (rec *Recorder) SetTenantIdentifier(identify func(*http.Request) string) {
+	rec.tenant = identify
+}
+
+// Record counts one request
+func (rec *Recorder) Record(clientID, method, route string, status int, duration time.Duration) {
+	rec.RecordTenant(clientID, "", method, route, status, duration)
+}
+
+// RecordTenant counts one request of a tenant's caller
+func (rec *Recorder) RecordTenant(clientID, tenant, method, route string, status int, duration time.Duration) {
+	c := Counters{Requests: 1, DurationMs: duration.Milliseconds()}
+	switch {
+	case status >= 500:
+		c.ServerErrors = 1
+	case status >= 400:
+		c.ClientErrors = 1
+	}
+	key := Key{PeriodStart: rec.now().UTC().Truncate(time.Hour), ClientID: clientID, Method: method, Route: route, Tenant: tenant}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	counters := rec.pending[key]
+	counters.add(c)
+	rec.pending[key] = counters
+}
+
+// Flush writes the pending counts. On failure they are kept and retried on the next flush.
+func (rec *Recorder) Flush() error {
+	rec.mu.Lock()
+	rows := rec.pending
+	rec.pending = make(map[Key]Counters)
+	rec.mu.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := rec.repo.Add(rows); err != nil {
+		rec.mu.Lock()
+		for key, c := range rows {
+			counters := rec.pending[key]
+			counters.add(c)
+			rec.pending[key] = counters
+		}
+		rec.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Start flushes every interval until ctx is cancelled
+func (rec *Recorder) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rec.Flush(); err != nil {
+					rec.logger.WithError(err).Error("Failed to save API usage")
+				}
+			}
+		}
+	}()
+}
+
+// Summaries returns one page of usage summaries matching filter
+func (rec *Recorder) Summaries(filter Filter, page httpapi.Page) ([]Summary, int, error) {
+	summaries, total, err := rec.repo.Summarize(filter, page.Limit, page.Offset)
+	if err != nil {
+		rec.logger.WithError(err).Error("Failed to summarize API usage")
+		return nil, 0, err
+	}
+	return summaries, total, nil
+}
+
+// TenantSummaries returns the usage of each tenant since the given time, or of tenant alone
+// when it is not empty
+func (rec *Recorder) TenantSummaries(since time.Time, tenant string) ([]TenantSummary, error) {
+	summaries, err := rec.repo.SummarizeTenants(since, tenant)
+	if err != nil {
+		rec.logger.WithError(err).Error("Failed to summarize tenant usage")
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// statusRecorder captures the response status for Middleware
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware records every routed request against the client identify returns for it. It is
+// added with Use so requests are counted by route template rather than raw path.
+func (rec *Recorder) Middleware(identify func(*http.Request) string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := r.URL.Path
+			if current := mux.CurrentRoute(r); current != nil {
+				if template, err := current.GetPathTemplate(); err == nil {
+					route = template
+				}
+			}
+			clientID, tenant := identify(r), ""
+			if rec.tenant != nil {
+				tenant = rec.tenant(r)
+			}
+
+			start := time.Now()
+			sw := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				status := sw.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				if p := recover(); p != nil {
+					rec.RecordTenant(clientID, tenant, r.Method, route, http.StatusInternalServerError, time.Since(start))
+					panic(p)
+				}
+				rec.RecordTenant(clientID, tenant, r.Method, route, status, time.Since(start))
+			}()
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// HTTP Handlers
+
+// ListUsageHandler handles GET /api/usage?since=24h&client_id=...&group_by=client
+func ListUsageHandler(rec *Recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := Filter{ClientID: query.Get("client_id"), GroupBy: GroupByEndpoint}
+
+		lookback := 24 * time.Hour
+		if value := query.Get("since"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid since parameter", "VALIDATION_ERROR", map[string]string{"since": "must be a positive duration such as 24h"})
+				return
+			}
+			lookback = d
+		}
+		filter.Since = rec.now().Add(-lookback)
+
+		switch value := query.Get("group_by"); value {
+		case "", GroupByEndpoint:
+		case GroupByClient:
+			filter.GroupBy = GroupByClient
+		default:
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid group_by parameter", "VALIDATION_ERROR", map[string]string{"group_by": "must be one of: endpoint, client"})
+			return
+		}
+
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		summaries, total, err := rec.Summaries(filter, page)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get API usage")
+			return
+		}
+		if summaries == nil {
+			summaries = []Summary{}
+		}
+		httpapi.WriteList(w, r, summaries, total, page)
+	}
+}
+
+// SetupRoutes configures the usage routes
+func SetupRoutes(r *mux.Router, rec *Recorder, rbacService *rbac.RBACService) {
+	rbacService.Protect(r.HandleFunc("/api/usage", ListUsageHandler(rec)).Methods("GET"), ReadPermission)
+}
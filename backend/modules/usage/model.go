@@ -0,0 +1,197 @@
+package usage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// AnonymousClient is recorded for requests without a valid token
+const AnonymousClient = "anonymous"
+
+// Key identifies one rollup row: a client's calls to one endpoint within one hour
+type Key struct {
+	PeriodStart time.Time
+	ClientID    string
+	Method      string
+	Route       string
+	// Tenant is the caller's tenant, empty when they have none. Calls of a tenant are also
+	// rolled up per tenant and hour.
+	Tenant string
+}
+
+// Counters are the totals accumulated for a key
+type Counters struct {
+	Requests     int64
+	ClientErrors int64
+	ServerErrors int64
+	// DurationMs is the summed handling time in milliseconds
+	DurationMs int64
+}
+
+func (c *Counters) add(other Counters) {
+	c.Requests += other.Requests
+	c.ClientErrors += other.ClientErrors
+	c.ServerErrors += other.ServerErrors
+	c.DurationMs += other.DurationMs
+}
+
+// Summary is the usage of one client, or one client's endpoint, over the requested period
+type Summary struct {
+	ClientID      string  `json:"client_id"`
+	Method        string  `json:"method,omitempty"`
+	Route         string  `json:"route,omitempty"`
+	Requests      int64   `json:"requests"`
+	ClientErrors  int64   `json:"client_errors"`
+	ServerErrors  int64   `json:"server_errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+}
+
+// TenantSummary is the usage of one tenant over the requested period
+type TenantSummary struct {
+	Tenant        string  `json:"tenant"`
+	Requests      int64   `json:"requests"`
+	ClientErrors  int64   `json:"client_errors"`
+	ServerErrors  int64   `json:"server_errors"`
+	ErrorRate     float64 `json:"error_rate"`
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+}
+
+// Grouping levels for summaries
+const (
+	GroupByEndpoint = "endpoint"
+	GroupByClient   = "client"
+)
+
+// Filter selects the usage to summarize
+type Filter struct {
+	Since    time.Time
+	ClientID string
+	// GroupBy is GroupByEndpoint (the default) or GroupByClient
+	GroupBy string
+}
+
+// UsageRepository interface defines methods for usage data access
+type UsageRepository interface {
+	// Add adds counters to the rollup rows, creating them as needed
+	Add(rows map[Key]Counters) error
+	// Summarize returns one page of summaries, busiest first, and the number of summaries
+	Summarize(filter Filter, limit, offset int) ([]Summary, int, error)
+	// SummarizeTenants returns the usage of each tenant since the given time, busiest first; only
+	// tenant when it is not empty
+	SummarizeTenants(since time.Time, tenant string) ([]TenantSummary, error)
+}
+
+// usageRepository implements UsageRepository
+type usageRepository struct {
+	db database.DBTX
+}
+
+// NewUsageRepository creates a new usage repository
+func NewUsageRepository(db *sql.DB) UsageRepository {
+	return &usageRepository{db: db}
+}
+
+func (r *usageRepository) Add(rows map[Key]Counters) error {
+	query := `INSERT INTO api_usage (period_start, client_id, method, route, requests, client_errors, server_errors, duration_ms)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	          ON CONFLICT (period_start, client_id, method, route) DO UPDATE SET
+	              requests = api_usage.requests + EXCLUDED.requests,
+	              client_errors = api_usage.client_errors + EXCLUDED.client_errors,
+	              server_errors = api_usage.server_errors + EXCLUDED.server_errors,
+	              duration_ms = api_usage.duration_ms + EXCLUDED.duration_ms`
+	tenantQuery := `INSERT INTO tenant_usage (period_start, tenant, requests, client_errors, server_errors, duration_ms)
+	          VALUES ($1, $2, $3, $4, $5, $6)
+	          ON CONFLICT (period_start, tenant) DO UPDATE SET
+	              requests = tenant_usage.requests + EXCLUDED.requests,
+	              client_errors = tenant_usage.client_errors + EXCLUDED.client_errors,
+	              server_errors = tenant_usage.server_errors + EXCLUDED.server_errors,
+	              duration_ms = tenant_usage.duration_ms + EXCLUDED.duration_ms`
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		for key, c := range rows {
+			if _, err := tx.Exec(query, key.PeriodStart, key.ClientID, key.Method, key.Route,
+				c.Requests, c.ClientErrors, c.ServerErrors, c.DurationMs); err != nil {
+				return fmt.Errorf("add usage: %w", err)
+			}
+			if key.Tenant == "" {
+				continue
+			}
+			if _, err := tx.Exec(tenantQuery, key.PeriodStart, key.Tenant,
+				c.Requests, c.ClientErrors, c.ServerErrors, c.DurationMs); err != nil {
+				return fmt.Errorf("add tenant usage: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (r *usageRepository) SummarizeTenants(since time.Time, tenant string) ([]TenantSummary, error) {
+	query := `SELECT tenant, SUM(requests), SUM(client_errors), SUM(server_errors), SUM(duration_ms)
+	          FROM tenant_usage WHERE period_start >= $1 AND ($2 = '' OR tenant = $2)
+	          GROUP BY tenant ORDER BY SUM(requests) DESC, tenant`
+	return database.QueryAll(r.db, "summarize tenant usage", scanTenantSummary, query, since, tenant)
+}
+
+func scanTenantSummary(row database.Scanner) (TenantSummary, error) {
+	var s TenantSummary
+	var durationMs int64
+	if err := row.Scan(&s.Tenant, &s.Requests, &s.ClientErrors, &s.ServerErrors, &durationMs); err != nil {
+		return s, err
+	}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.ClientErrors+s.ServerErrors) / float64(s.Requests)
+		s.AvgDurationMs = float64(durationMs) / float64(s.Requests)
+	}
+	return s, nil
+}
+
+func (r *usageRepository) Summarize(filter Filter, limit, offset int) ([]Summary, int, error) {
+	groupColumns := "client_id, method, route"
+	if filter.GroupBy == GroupByClient {
+		groupColumns = "client_id, '' AS method, '' AS route"
+	}
+	conditions := []string{"period_start >= $1"}
+	args := []interface{}{filter.Since}
+	if filter.ClientID != "" {
+		args = append(args, filter.ClientID)
+		conditions = append(conditions, fmt.Sprintf("client_id = $%d", len(args)))
+	}
+	where := strings.Join(conditions, " AND ")
+	groupBy := "client_id, method, route"
+	if filter.GroupBy == GroupByClient {
+		groupBy = "client_id"
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM (SELECT 1 FROM api_usage WHERE ` + where + ` GROUP BY ` + groupBy + `) AS summaries`
+	if err := r.db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`SELECT %s, SUM(requests), SUM(client_errors), SUM(server_errors), SUM(duration_ms)
+	          FROM api_usage WHERE %s GROUP BY %s
+	          ORDER BY SUM(requests) DESC, %s LIMIT $%d OFFSET $%d`,
+		groupColumns, where, groupBy, groupBy, len(args)+1, len(args)+2)
+	summaries, err := database.QueryAll(r.db, "summarize usage", scanSummary, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return summaries, total, nil
+}
+
+func scanSummary(row database.Scanner) (Summary, error) {
+	var s Summary
+	var durationMs int64
+	if err := row.Scan(&s.ClientID, &s.Method, &s.Route, &s.Requests, &s.ClientErrors, &s.ServerErrors, &durationMs); err != nil {
+		return s, err
+	}
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.ClientErrors+s.ServerErrors) / float64(s.Requests)
+		s.AvgDurationMs = float64(durationMs) / float64(s.Requests)
+	}
+	return s, nil
+}
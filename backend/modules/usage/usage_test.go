@@ -0,0 +1,201 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeUsageRepo struct {
+	rows   map[Key]Counters
+	err    error
+	filter Filter
+}
+
+func (r *fakeUsageRepo) Add(rows map[Key]Counters) error {
+	if r.err != nil {
+		return r.err
+	}
+	for key, c := range rows {
+		counters := r.rows[key]
+		counters.add(c)
+		r.rows[key] = counters
+	}
+	return nil
+}
+
+func (r *fakeUsageRepo) Summarize(filter Filter, limit, offset int) ([]Summary, int, error) {
+	r.filter = filter
+	return []Summary{{ClientID: "reporting", Requests: 10}}, 1, nil
+}
+
+func (r *fakeUsageRepo) SummarizeTenants(since time.Time, tenant string) ([]TenantSummary, error) {
+	totals := make(map[string]int64)
+	for key, c := range r.rows {
+		if key.Tenant != "" && (tenant == "" || key.Tenant == tenant) {
+			totals[key.Tenant] += c.Requests
+		}
+	}
+	var summaries []TenantSummary
+	for name, requests := range totals {
+		summaries = append(summaries, TenantSummary{Tenant: name, Requests: requests})
+	}
+	return summaries, nil
+}
+
+func newTestRecorder() (*Recorder, *fakeUsageRepo) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	repo := &fakeUsageRepo{rows: make(map[Key]Counters)}
+	rec := NewRecorder(repo, logger)
+	now := time.Date(2024, 1, 1, 12, 34, 0, 0, time.UTC)
+	rec.now = func() time.Time { return now }
+	return rec, repo
+}
+
+func TestMiddlewareRecordsPerClientAndRoute(t *testing.T) {
+	rec, repo := newTestRecorder()
+
+	r := mux.NewRouter()
+	r.Use(rec.Middleware(func(r *http.Request) string { return r.Header.Get("X-Client") }))
+	r.HandleFunc("/api/rbac/groups/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	for _, id := range []string{"a", "b", "missing"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/rbac/groups/"+id, nil)
+		req.Header.Set("X-Client", "reporting")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	require.NoError(t, rec.Flush())
+	key := Key{
+		PeriodStart: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		ClientID:    "reporting",
+		Method:      http.MethodGet,
+		Route:       "/api/rbac/groups/{id}",
+	}
+	require.Len(t, repo.rows, 1)
+	assert.Equal(t, int64(3), repo.rows[key].Requests)
+	assert.Equal(t, int64(1), repo.rows[key].ClientErrors)
+	assert.Zero(t, repo.rows[key].ServerErrors)
+}
+
+func TestFlushKeepsCountsOnFailure(t *testing.T) {
+	rec, repo := newTestRecorder()
+	rec.Record("reporting", http.MethodGet, "/api/usage", http.StatusOK, time.Millisecond)
+
+	repo.err = errors.New("database is down")
+	assert.Error(t, rec.Flush())
+	rec.Record("reporting", http.MethodGet, "/api/usage", http.StatusInternalServerError, time.Millisecond)
+
+	repo.err = nil
+	require.NoError(t, rec.Flush())
+	for _, c := range repo.rows {
+		assert.Equal(t, int64(2), c.Requests)
+		assert.Equal(t, int64(1), c.ServerErrors)
+	}
+	assert.Empty(t, rec.pending)
+}
+
+func TestListUsageHandler(t *testing.T) {
+	rec, repo := newTestRecorder()
+
+	w := httptest.NewRecorder()
+	ListUsageHandler(rec)(w, httptest.NewRequest(http.MethodGet, "/api/usage?since=1h&client_id=reporting&group_by=client", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, Filter{Since: rec.now().Add(-time.Hour), ClientID: "reporting", GroupBy: GroupByClient}, repo.filter)
+
+	var resp struct {
+		Data []Summary      `json:"data"`
+		Meta map[string]int `json:"meta"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "reporting", resp.Data[0].ClientID)
+	assert.Equal(t, 1, resp.Meta["total"])
+
+	for _, query := range []string{"?since=yesterday", "?group_by=day", "?limit=0"} {
+		w := httptest.NewRecorder()
+		ListUsageHandler(rec)(w, httptest.NewRequest(http.MethodGet, "/api/usage"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestUsageRepositorySummarize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM \(SELECT 1 FROM api_usage WHERE period_start >= \$1 AND client_id = \$2 GROUP BY client_id, method, route\)`).
+		WithArgs(since, "reporting").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT client_id, method, route, SUM\(requests\)`).
+		WithArgs(since, "reporting", 50, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"client_id", "method", "route", "requests", "client_errors", "server_errors", "duration_ms"}).
+			AddRow("reporting", "GET", "/api/rbac/roles", 8, 1, 1, 40))
+
+	summaries, total, err := NewUsageRepository(db).Summarize(Filter{Since: since, ClientID: "reporting"}, 50, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []Summary{{
+		ClientID:      "reporting",
+		Method:        "GET",
+		Route:         "/api/rbac/roles",
+		Requests:      8,
+		ClientErrors:  1,
+		ServerErrors:  1,
+		ErrorRate:     0.25,
+		AvgDurationMs: 5,
+	}}, summaries)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMiddlewareRollsUpTenants(t *testing.T) {
+	rec, repo := newTestRecorder()
+	rec.SetTenantIdentifier(func(r *http.Request) string { return r.Header.Get("X-Tenant") })
+	r := mux.NewRouter()
+	r.Use(rec.Middleware(func(r *http.Request) string { return "portal" }))
+	r.HandleFunc("/api/users", func(w http.ResponseWriter, r *http.Request) {})
+	for _, tenant := range []string{"acme", "acme", "globex", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+		req.Header.Set("X-Tenant", tenant)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	require.NoError(t, rec.Flush())
+	assert.Len(t, repo.rows, 3, "one row per tenant, rolled up into one api_usage row")
+
+	summaries, err := rec.TenantSummaries(time.Time{}, "acme")
+	require.NoError(t, err)
+	assert.Equal(t, []TenantSummary{{Tenant: "acme", Requests: 2}}, summaries)
+}
+
+func TestUsageRepositoryAddsTenantRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	hour := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO api_usage`).WithArgs(hour, "portal", "GET", "/api/users", 3, 1, 0, 30).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO tenant_usage`).WithArgs(hour, "acme", 3, 1, 0, 30).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	rows := map[Key]Counters{
+		{PeriodStart: hour, ClientID: "portal", Method: "GET", Route: "/api/users", Tenant: "acme"}: {Requests: 3, ClientErrors: 1, DurationMs: 30},
+	}
+	require.NoError(t, NewUsageRepository(db).Add(rows))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
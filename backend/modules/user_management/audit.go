@@ -0,0 +1,25 @@
+package user_management
+
+import (
+	"context"
+
+	"base-app/pkg/audit"
+)
+
+// Resource types of user changes in the audit log
+const (
+	AuditUser     = "user"
+	AuditUserNote = "user_note"
+)
+
+// SetAuditLog records every change to users in log. Set it before serving requests.
+func (s *UserService) SetAuditLog(log *audit.Log) {
+	s.auditLog = log
+}
+
+// audit records a change when an audit log is set
+func (s *UserService) audit(ctx context.Context, action, resourceType, resourceID string, before, after interface{}) {
+	if s.auditLog != nil {
+		s.auditLog.Record(ctx, action, resourceType, resourceID, before, after)
+	}
+}
@@ -0,0 +1,57 @@
+package user_management
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/avatar"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// SetAvatars serves user avatars from avatars, which decides whether Gravatar is consulted.
+// Without it only identicons are served. Set it before serving requests.
+func (s *UserService) SetAvatars(avatars *avatar.Service) {
+	s.avatars = avatars
+}
+
+// GetAvatarHandler handles GET /api/users/{id}/avatar?size=N. Users cannot upload pictures yet,
+// so this is their Gravatar or identicon. The route is public so the URL works in img tags; it
+// reveals no more than the picture, since Gravatar is fetched server-side.
+func GetAvatarHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		size := avatar.DefaultSize
+		if raw := r.URL.Query().Get("size"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				writeServiceError(w, apperrors.Invalid("INVALID_SIZE", "size must be a number of pixels"), "")
+				return
+			}
+			size = n
+		}
+
+		if _, err := uuid.Parse(id); err != nil {
+			writeServiceError(w, apperrors.NotFound("USER_NOT_FOUND", "User not found"), "")
+			return
+		}
+		user, err := service.repo.GetByID(id)
+		if err != nil {
+			writeServiceError(w, err, "Failed to load avatar")
+			return
+		}
+		if user == nil {
+			writeServiceError(w, apperrors.NotFound("USER_NOT_FOUND", "User not found"), "")
+			return
+		}
+
+		if service.avatars == nil {
+			avatar.Write(w, r, avatar.Identicon(user.ID, size), 24*time.Hour)
+			return
+		}
+		avatar.Write(w, r, service.avatars.Get(r.Context(), user.ID, user.Email, size), service.avatars.TTL())
+	}
+}
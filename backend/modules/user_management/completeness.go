@@ -0,0 +1,156 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"base-app/modules/auth"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// ProfileRequirements supplies the profile fields users must fill in
+type ProfileRequirements interface {
+	// ProfileRequirements returns the required fields ("first_name", "last_name", "phone" or
+	// "attributes.<key>") and whether incomplete profiles are blocked from the rest of the API
+	ProfileRequirements() (fields []string, enforce bool)
+}
+
+// ProfileCompleteness reports which required profile fields a user has yet to fill in
+type ProfileCompleteness struct {
+	Complete bool     `json:"complete"`
+	Required []string `json:"required_fields"`
+	Missing  []string `json:"missing_fields"`
+	// Enforced says whether other endpoints answer 428 until the profile is complete
+	Enforced bool `json:"enforced"`
+}
+
+// profileCompletionExemptPaths stay reachable with an incomplete profile, so users can see what
+// is missing and fill it in
+var profileCompletionExemptPaths = []string{
+	"/health", "/api/version", "/api/users/profile", "/api/users/me", "/api/settings", "/api/ui/manifest",
+}
+
+// SetProfileRequirements checks user profiles against requirements. Set it before serving
+// requests.
+func (s *UserService) SetProfileRequirements(requirements ProfileRequirements) {
+	s.profileRequirements = requirements
+}
+
+// profileValue returns the value of a required profile field of user
+func profileValue(user *User, field string) string {
+	if key, ok := strings.CutPrefix(field, "attributes."); ok {
+		return user.Attributes[key]
+	}
+	switch field {
+	case "first_name":
+		return user.FirstName
+	case "last_name":
+		return user.LastName
+	case "phone":
+		return user.Phone
+	}
+	return ""
+}
+
+// completeness checks user against the required fields
+func completeness(user *User, fields []string, enforce bool) *ProfileCompleteness {
+	result := &ProfileCompleteness{Required: []string{}, Missing: []string{}, Enforced: enforce}
+	for _, field := range fields {
+		result.Required = append(result.Required, field)
+		if strings.TrimSpace(profileValue(user, field)) == "" {
+			result.Missing = append(result.Missing, field)
+		}
+	}
+	result.Complete = len(result.Missing) == 0
+	return result
+}
+
+// ProfileCompleteness checks the profile of the user with the given Keycloak ID against the
+// required fields
+func (s *UserService) ProfileCompleteness(ctx context.Context, keycloakID string) (*ProfileCompleteness, error) {
+	var fields []string
+	var enforce bool
+	if s.profileRequirements != nil {
+		fields, enforce = s.profileRequirements.ProfileRequirements()
+	}
+	if len(fields) == 0 {
+		return completeness(nil, nil, enforce), nil
+	}
+	user, err := s.findUser(ctx, "keycloak_id", keycloakID, s.repo.GetByKeycloakID)
+	if err != nil {
+		return nil, err
+	}
+	return completeness(user, fields, enforce), nil
+}
+
+// isProfileCompletionExempt reports whether path stays available with an incomplete profile
+func isProfileCompletionExempt(path string) bool {
+	for _, exempt := range profileCompletionExemptPaths {
+		if path == exempt || strings.HasPrefix(path, exempt+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileCompletionMiddleware answers 428 PROFILE_INCOMPLETE to signed-in users whose profile
+// lacks a required field while the policy is enforced, except on the profile routes themselves.
+// Install it after rbacService.AuthMiddleware so the caller is known; anonymous requests and
+// users without a local record pass through.
+func ProfileCompletionMiddleware(service *UserService) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if service.profileRequirements == nil || isProfileCompletionExempt(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			userID := auth.UserID(r.Context())
+			if userID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if fields, enforce := service.profileRequirements.ProfileRequirements(); !enforce || len(fields) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := service.ProfileCompleteness(r.Context(), userID)
+			if apperrors.KindOf(err) == apperrors.KindNotFound {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err != nil {
+				writeServiceError(w, err, "Failed to check profile")
+				return
+			}
+			if result.Complete {
+				next.ServeHTTP(w, r)
+				return
+			}
+			httpapi.WriteErrorResponse(w, http.StatusPreconditionRequired, "Complete your profile to continue", "PROFILE_INCOMPLETE", map[string]string{
+				"missing_fields": strings.Join(result.Missing, ","),
+			})
+		})
+	}
+}
+
+// HTTP Handlers
+
+// GetProfileCompletenessHandler handles GET /api/users/me/profile/completeness
+func GetProfileCompletenessHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.ProfileCompleteness(r.Context(), auth.UserID(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to check profile")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
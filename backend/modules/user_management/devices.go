@@ -0,0 +1,311 @@
+package user_management
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/modules/auth"
+	"base-app/modules/notification"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// NewDeviceEvent is the notification type sent when a user logs in from a device not seen before
+const NewDeviceEvent = "user.new_device_login"
+
+// Device is a browser or app a user logged in from. Devices are told apart by the user agent
+// and the fingerprint the client sends on login; neither is proof of identity, so devices are
+// for the user's overview and alerts, not for authentication.
+type Device struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// Name is derived from the user agent, e.g. "Firefox on Windows"
+	Name      string `json:"name"`
+	UserAgent string `json:"user_agent"`
+	LastIP    string `json:"last_ip"`
+	// SessionID is the Keycloak session of the latest login, ended when the device is revoked
+	SessionID   string    `json:"-"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	// Current marks the device of the caller's own session
+	Current bool `json:"current"`
+}
+
+// LoginDevice describes where a login came from
+type LoginDevice struct {
+	UserAgent   string
+	Fingerprint string
+	IP          string
+}
+
+// key identifies the device among a user's devices
+func (d LoginDevice) key() string {
+	sum := sha256.Sum256([]byte(d.Fingerprint + "\n" + d.UserAgent))
+	return hex.EncodeToString(sum[:])
+}
+
+// DeviceRepository stores the devices users logged in from
+type DeviceRepository interface {
+	// GetByKey returns the device of userID with the given key, or nil
+	GetByKey(userID, key string) (*Device, error)
+	Create(device *Device, key string) error
+	// Seen records another login from a known device
+	Seen(device *Device) error
+	ListForUser(userID string) ([]*Device, error)
+	GetByID(userID, id string) (*Device, error)
+	Delete(userID, id string) error
+	// CountForUser returns how many devices userID has
+	CountForUser(userID string) (int, error)
+}
+
+type deviceRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+// NewDeviceRepository creates a device repository that writes to db and reads from reader
+func NewDeviceRepository(db *sql.DB, reader database.Querier) DeviceRepository {
+	return &deviceRepository{db: db, reader: reader}
+}
+
+const deviceSelect = `SELECT id, user_id, name, user_agent, last_ip, session_id, first_seen_at, last_seen_at FROM user_devices`
+
+func scanDevice(row database.Scanner) (*Device, error) {
+	device := &Device{}
+	err := row.Scan(&device.ID, &device.UserID, &device.Name, &device.UserAgent, &device.LastIP,
+		&device.SessionID, &device.FirstSeenAt, &device.LastSeenAt)
+	return device, err
+}
+
+func (r *deviceRepository) getOne(q database.Querier, where string, args ...interface{}) (*Device, error) {
+	device, err := scanDevice(q.QueryRow(deviceSelect+` WHERE `+where, args...))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return device, err
+}
+
+func (r *deviceRepository) GetByKey(userID, key string) (*Device, error) {
+	// Read from the primary, which saw the previous login
+	return r.getOne(r.db, `user_id = $1 AND device_key = $2`, userID, key)
+}
+
+func (r *deviceRepository) Create(device *Device, key string) error {
+	query := `INSERT INTO user_devices (id, user_id, device_key, name, user_agent, last_ip, session_id, first_seen_at, last_seen_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	_, err := r.db.Exec(query, device.ID, device.UserID, key, device.Name, device.UserAgent, device.LastIP,
+		device.SessionID, device.FirstSeenAt, device.LastSeenAt)
+	return err
+}
+
+func (r *deviceRepository) Seen(device *Device) error {
+	query := `UPDATE user_devices SET last_ip = $2, session_id = $3, last_seen_at = $4 WHERE id = $1`
+	_, err := r.db.Exec(query, device.ID, device.LastIP, device.SessionID, device.LastSeenAt)
+	return err
+}
+
+func (r *deviceRepository) ListForUser(userID string) ([]*Device, error) {
+	return database.QueryAll(r.reader, "list devices", scanDevice, deviceSelect+` WHERE user_id = $1 ORDER BY last_seen_at DESC`, userID)
+}
+
+func (r *deviceRepository) GetByID(userID, id string) (*Device, error) {
+	return r.getOne(r.db, `user_id = $1 AND id = $2`, userID, id)
+}
+
+func (r *deviceRepository) Delete(userID, id string) error {
+	_, err := r.db.Exec(`DELETE FROM user_devices WHERE user_id = $1 AND id = $2`, userID, id)
+	return err
+}
+
+func (r *deviceRepository) CountForUser(userID string) (int, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM user_devices WHERE user_id = $1`, userID).Scan(&n)
+	return n, err
+}
+
+// SetDeviceTracking records the devices users log in from in devices and sends a NewDeviceEvent
+// to alerts when a login comes from a device not seen before. Set it before serving requests.
+func (s *UserService) SetDeviceTracking(devices DeviceRepository, alerts notification.Notifier) {
+	s.devices = devices
+	s.deviceAlerts = alerts
+}
+
+// deviceName summarises a user agent as "<browser> on <platform>"
+func deviceName(userAgent string) string {
+	browser, platform := "Unknown browser", "unknown device"
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+		{"curl/", "curl"}, {"okhttp", "Android app"}, {"CFNetwork", "iOS app"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	for _, p := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, p.token) {
+			platform = p.name
+			break
+		}
+	}
+	return browser + " on " + platform
+}
+
+// recordDevice remembers the device of a successful login and alerts when it is new. A user's
+// first device is not announced, since every account starts with one. Failures are logged: the
+// login has already succeeded.
+func (s *UserService) recordDevice(ctx context.Context, user *User, sessionID string, login LoginDevice) {
+	if s.devices == nil || user == nil || user.KeycloakID == "" {
+		return
+	}
+	logger := s.logger.WithContext(ctx).WithField("user_id", user.KeycloakID)
+	key := login.key()
+	now := time.Now()
+
+	device, err := s.devices.GetByKey(user.KeycloakID, key)
+	if err != nil {
+		logger.WithError(err).Error("Failed to look up login device")
+		return
+	}
+	if device != nil {
+		device.LastIP, device.SessionID, device.LastSeenAt = login.IP, sessionID, now
+		if err := s.devices.Seen(device); err != nil {
+			logger.WithError(err).Error("Failed to record login device")
+		}
+		return
+	}
+
+	known, err := s.devices.CountForUser(user.KeycloakID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to count login devices")
+		return
+	}
+	device = &Device{
+		ID:          uuid.New().String(),
+		UserID:      user.KeycloakID,
+		Name:        deviceName(login.UserAgent),
+		UserAgent:   login.UserAgent,
+		LastIP:      login.IP,
+		SessionID:   sessionID,
+		FirstSeenAt: now,
+		LastSeenAt:  now,
+	}
+	if err := s.devices.Create(device, key); err != nil {
+		logger.WithError(err).Error("Failed to record login device")
+		return
+	}
+	logger.WithFields(logrus.Fields{"device_id": device.ID, "device": device.Name}).Info("Login from new device")
+	if known == 0 || s.deviceAlerts == nil {
+		return
+	}
+
+	err = s.deviceAlerts.Notify(ctx, notification.Notification{
+		Type:     NewDeviceEvent,
+		Severity: notification.SeverityInfo,
+		Subject:  "New sign-in to your account",
+		Message:  fmt.Sprintf("%s signed in from a new device: %s (%s).", user.Username, device.Name, device.LastIP),
+		Data: map[string]interface{}{
+			"user_id":   user.KeycloakID,
+			"username":  user.Username,
+			"email":     user.Email,
+			"device_id": device.ID,
+			"device":    device.Name,
+			"ip":        device.LastIP,
+		},
+		OccurredAt: now,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send new device alert")
+	}
+}
+
+// ListDevices lists the devices of the user with the given Keycloak ID, most recently used
+// first, marking the one of session as current
+func (s *UserService) ListDevices(ctx context.Context, userID, session string) ([]*Device, error) {
+	if s.devices == nil {
+		return []*Device{}, nil
+	}
+	devices, err := s.devices.ListForUser(userID)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to list devices")
+		return nil, err
+	}
+	for _, device := range devices {
+		device.Current = session != "" && device.SessionID == session
+	}
+	return devices, nil
+}
+
+// RevokeDevice forgets a device and ends its Keycloak session, so its refresh token stops
+// working; its current access token lasts until it expires. The next login from the device
+// counts as a new device.
+func (s *UserService) RevokeDevice(ctx context.Context, userID, id string) error {
+	if s.devices == nil {
+		return apperrors.NotFound("DEVICE_NOT_FOUND", "Device not found")
+	}
+	device, err := s.devices.GetByID(userID, id)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return apperrors.NotFound("DEVICE_NOT_FOUND", "Device not found")
+	}
+
+	if device.SessionID != "" {
+		if err := s.identity.LogoutSession(ctx, auth.Realm(ctx), device.SessionID); err != nil {
+			return err
+		}
+	}
+	if err := s.devices.Delete(userID, id); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to delete device")
+		return err
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": userID, "device_id": id}).Info("Device revoked")
+	return nil
+}
+
+// HTTP Handlers
+
+// GetDevicesHandler handles GET /api/users/me/devices
+func GetDevicesHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		devices, err := service.ListDevices(r.Context(), auth.UserID(r.Context()), auth.SessionFromContext(r.Context()).ID)
+		if err != nil {
+			writeServiceError(w, err, "Failed to list devices")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(devices, page), len(devices), page)
+	}
+}
+
+// RevokeDeviceHandler handles DELETE /api/users/me/devices/{id}
+func RevokeDeviceHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.RevokeDevice(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to revoke device")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
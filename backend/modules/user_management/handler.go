@@ -3,15 +3,60 @@ package user_management
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"base-app/modules/auth"
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/authevents"
+	"base-app/pkg/avatar"
+	"base-app/pkg/captcha"
+	"base-app/pkg/dberrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jobs"
+	"base-app/pkg/jsonschema"
+	"base-app/pkg/labels"
+	"base-app/pkg/outbound"
+	"base-app/pkg/perm"
+	"base-app/pkg/quota"
+	"base-app/pkg/ratelimit"
+	"base-app/pkg/redact"
+	"base-app/pkg/trash"
+
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
+// User management permissions; read_user also gates the contact fields of User (see the perm tags)
+func init() {
+	rbac.RegisterPermissions(
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440001", Name: string(perm.CreateUser), Resource: "user", Action: "create",
+			Category: "User management", Description: "Register new user accounts", RiskLevel: rbac.RiskMedium},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440002", Name: string(perm.ReadUser), Resource: "user", Action: "read",
+			Category: "User management", Description: "View user accounts and profiles", RiskLevel: rbac.RiskLow},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440003", Name: string(perm.UpdateUser), Resource: "user", Action: "update",
+			Category: "User management", Description: "Edit user accounts and profiles", RiskLevel: rbac.RiskMedium},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440004", Name: string(perm.DeleteUser), Resource: "user", Action: "delete",
+			Category: "User management", Description: "Delete user accounts", RiskLevel: rbac.RiskHigh},
+		rbac.Permission{Name: string(perm.ManageUserNotes), Resource: "user_note", Action: "manage",
+			Category: "User management", Description: "Read and write support notes on user accounts", RiskLevel: rbac.RiskMedium},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440027", Name: string(perm.ReadUserOwn), Resource: "user", Action: "read_own",
+			Category: "User management", Description: "View your own profile", RiskLevel: rbac.RiskLow},
+		rbac.Permission{ID: "550e8400-e29b-41d4-a716-446655440028", Name: string(perm.UpdateUserOwn), Resource: "user", Action: "update_own",
+			Category: "User management", Description: "Edit your own profile", RiskLevel: rbac.RiskLow},
+	)
+}
+
 type KeycloakConfig struct {
 	URL           string `json:"url"`
 	Realm         string `json:"realm"`
@@ -19,66 +64,376 @@ type KeycloakConfig struct {
 	ClientSecret  string `json:"client_secret"`
 	AdminUsername string `json:"admin_username"`
 	AdminPassword string `json:"admin_password"`
+	// LinkProviders are the aliases of the Keycloak identity providers users may link to their
+	// account; DefaultLinkProviders when empty
+	LinkProviders []string `json:"link_providers,omitempty"`
+	// LinkRedirectURL is the frontend page Keycloak returns users to after linking; linking is
+	// disabled without it
+	LinkRedirectURL string `json:"link_redirect_url,omitempty"`
+	// PasskeyRedirectURL is the frontend page Keycloak returns users to after registering a
+	// passkey or security key; registration through the API is disabled without it
+	PasskeyRedirectURL string `json:"passkey_redirect_url,omitempty"`
+	// Realms are further realms served besides Realm, e.g. customers next to employees
+	Realms []RealmConfig `json:"realms,omitempty"`
+}
+
+// RealmConfig is the client of one additional Keycloak realm
+type RealmConfig struct {
+	Realm        string `json:"realm"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// AdminUsername and AdminPassword default to the primary realm's admin account
+	AdminUsername string `json:"admin_username,omitempty"`
+	AdminPassword string `json:"admin_password,omitempty"`
+	// JWTSecret verifies the realm's tokens; empty uses JWT_SECRET
+	JWTSecret string `json:"jwt_secret,omitempty"`
+}
+
+// String renders the config for logs with the client secret and admin password masked
+func (c KeycloakConfig) String() string {
+	type plain KeycloakConfig
+	masked := plain(c)
+	masked.ClientSecret = redact.Secret(c.ClientSecret)
+	masked.AdminPassword = redact.Secret(c.AdminPassword)
+	masked.Realms = make([]RealmConfig, len(c.Realms))
+	for i, realm := range c.Realms {
+		realm.ClientSecret = redact.Secret(realm.ClientSecret)
+		realm.AdminPassword = redact.Secret(realm.AdminPassword)
+		realm.JWTSecret = redact.Secret(realm.JWTSecret)
+		masked.Realms[i] = realm
+	}
+	return fmt.Sprintf("%+v", masked)
+}
+
+// ForRealm returns the config for talking to realm: c itself for the primary realm or "", and c
+// with the realm's client and admin account for an additional realm. ok is false for a realm
+// that is not configured.
+func (c KeycloakConfig) ForRealm(realm string) (cfg KeycloakConfig, ok bool) {
+	if realm == "" || realm == c.Realm {
+		return c, true
+	}
+	for _, extra := range c.Realms {
+		if extra.Realm != realm {
+			continue
+		}
+		cfg = c
+		cfg.Realm, cfg.ClientID, cfg.ClientSecret = extra.Realm, extra.ClientID, extra.ClientSecret
+		if extra.AdminUsername != "" {
+			cfg.AdminUsername, cfg.AdminPassword = extra.AdminUsername, extra.AdminPassword
+		}
+		return cfg, true
+	}
+	return KeycloakConfig{}, false
+}
+
+// Issuer returns the iss claim of tokens issued by the primary realm
+func (c KeycloakConfig) Issuer() string {
+	return strings.TrimSuffix(c.URL, "/") + "/realms/" + c.Realm
 }
 
 type UserService struct {
 	repo     UserRepository
 	keycloak *gocloak.GoCloak
-	config   KeycloakConfig
 	logger   *logrus.Logger
+
+	// identity keeps accounts and logs users in; Keycloak unless SetIdentityProvider says otherwise
+	identity IdentityProvider
+
+	// authObservers are told about failed logins
+	authObservers authevents.Observers
+
+	// viewer identifies the caller for response field filtering; nil disables filtering
+	viewer func(r *http.Request) fieldfilter.Viewer
+
+	// quotas, when set, limits how many users may register
+	quotas quota.Checker
+
+	// access, when set, is told to cut off deactivated users immediately
+	access AccessRevoker
+
+	// registration, when set, decides who may sign up
+	registration RegistrationGate
+
+	// invitations, when set, lets invited people register with their personal invite code
+	invitations Invitations
+
+	// groups, when set, manages the group memberships of registered, imported and exported users
+	groups GroupProvisioner
+
+	// devices, when set, records the devices users log in from; deviceAlerts hears of new ones
+	devices      DeviceRepository
+	deviceAlerts notification.Notifier
+
+	// avatars, when set, serves Gravatars and caches avatars
+	avatars *avatar.Service
+
+	// refreshTokens, when set, remembers issued refresh tokens to detect reuse of rotated ones
+	refreshTokens RefreshTokenRepository
+
+	// notes holds administrators' support notes on users
+	notes NoteRepository
+
+	// views, when set, keeps the views users save of the admin lists
+	views ViewRepository
+
+	// welcome runs after each registration
+	welcome []WelcomeStep
+
+	// profileRequirements, when set, lists the profile fields users must fill in
+	profileRequirements ProfileRequirements
+
+	// magicLinks, when set, enables passwordless login with the codes it keeps
+	magicLinks    MagicLinkRepository
+	magicLinkOpts MagicLinkOptions
+
+	// exchangePolicies lists the downstream audiences callers may exchange their token for
+	exchangePolicies map[string]ExchangePolicy
+
+	// loginGuard, when set, requires a challenge after repeated failed logins
+	loginGuard *captcha.Guard
+
+	// accountLimiter, when set, limits login and registration attempts per username
+	accountLimiter *ratelimit.Limiter
+
+	// jobs, when set, runs imports and exports in the background for clients that prefer it
+	jobs *jobs.Runner
+
+	// labels, when set, lets exports be limited to labelled users
+	labels *labels.Service
+
+	// trash, when set, keeps deleted users restorable until they are purged
+	trash *trash.Bin
+
+	// impacts, when set, reports what deleting a user would do for dry runs
+	impacts ImpactAnalyzer
+
+	// auditLog, when set, records every change to users
+	auditLog *audit.Log
+
+	// configMu guards config, whose credentials may be rotated at runtime
+	configMu sync.RWMutex
+	config   KeycloakConfig
 }
 
 func NewUserService(repo UserRepository, config KeycloakConfig, logger *logrus.Logger) *UserService {
-	return &UserService{
+	keycloak := gocloak.NewClient(config.URL)
+	keycloak.RestyClient().SetTransport(outbound.Transport(outbound.Keycloak))
+	s := &UserService{
 		repo:     repo,
-		keycloak: gocloak.NewClient(config.URL),
+		keycloak: keycloak,
 		config:   config,
 		logger:   logger,
 	}
+	s.identity = &keycloakProvider{client: s.keycloak, config: s.realmConfig, logger: logger}
+	s.welcome, _ = s.WelcomeSteps(DefaultWelcomeSteps, WelcomeOptions{})
+	return s
+}
+
+// OnAuthFailure registers an observer for failed logins. Register observers before serving requests.
+func (s *UserService) OnAuthFailure(observer authevents.Observer) {
+	s.authObservers = append(s.authObservers, observer)
+}
+
+// SetViewerResolver enables permission-aware filtering of the user objects returned by the
+// profile endpoints; resolve identifies the caller of a request. Set it before serving requests.
+func (s *UserService) SetViewerResolver(resolve func(r *http.Request) fieldfilter.Viewer) {
+	s.viewer = resolve
+}
+
+// filterFor removes the fields of v the caller of r may not see
+func (s *UserService) filterFor(r *http.Request, v interface{}) interface{} {
+	if s.viewer == nil {
+		return v
+	}
+	return fieldfilter.Filter(v, s.viewer(r))
+}
+
+// SetQuotaChecker enforces the user quota on registration. Set it before serving requests.
+func (s *UserService) SetQuotaChecker(checker quota.Checker) {
+	s.quotas = checker
+}
+
+// AccessRevoker ends a user's current access: their tokens, sessions and cached permissions
+type AccessRevoker interface {
+	RevokeUserAccess(ctx context.Context, userID, reason string) error
+}
+
+// SetAccessRevoker revokes the access of users when they are deactivated. Set it before serving requests.
+func (s *UserService) SetAccessRevoker(revoker AccessRevoker) {
+	s.access = revoker
+}
+
+// RegistrationGate decides whether public registration is open to an email address
+type RegistrationGate interface {
+	// CheckRegistration returns the error to reject the sign-up with, or nil to allow it
+	CheckRegistration(email, inviteCode string) error
+}
+
+// SetRegistrationGate applies gate to every registration, e.g. to close sign-up or require an
+// invite code. Set it before serving requests.
+func (s *UserService) SetRegistrationGate(gate RegistrationGate) {
+	s.registration = gate
+}
+
+// GroupProvisioner manages the role group memberships of provisioned users
+type GroupProvisioner interface {
+	// ApplyDomainRules adds a new user to the groups their email domain is mapped to
+	ApplyDomainRules(ctx context.Context, userID, email string) ([]string, error)
+	// JoinGroupsByName adds a user to the named groups, returning the IDs joined and the unknown names
+	JoinGroupsByName(ctx context.Context, userID string, names []string) ([]string, []string, error)
+	// UserGroupNames lists the names of a user's groups
+	UserGroupNames(userID string) ([]string, error)
+}
+
+// SetGroupProvisioner assigns registered users to groups by their email domain and carries
+// group memberships through user import and export. Set it before serving requests.
+func (s *UserService) SetGroupProvisioner(groups GroupProvisioner) {
+	s.groups = groups
+}
+
+// SetLoginGuard requires a solved challenge at login once failures from an IP or against an
+// account reach the guard's thresholds. Set it before serving requests.
+func (s *UserService) SetLoginGuard(guard *captcha.Guard) {
+	s.loginGuard = guard
+}
+
+// SetJobRunner lets clients start user imports and exports as operations with
+// "Prefer: respond-async". Set it before serving requests.
+func (s *UserService) SetJobRunner(runner *jobs.Runner) {
+	s.jobs = runner
+}
+
+// SetLabels lets user exports be filtered by label. Set it before serving requests.
+func (s *UserService) SetLabels(service *labels.Service) {
+	s.labels = service
+}
+
+// Rate limit budgets counted per username by the account limiter
+const (
+	LoginAccountBudget    = "login_account"
+	RegisterAccountBudget = "register_account"
+)
+
+// SetAccountLimiter limits login and registration attempts per username with the default rule
+// of limiter, complementing the per-IP budgets of the global rate limiter. Set it before
+// serving requests.
+func (s *UserService) SetAccountLimiter(limiter *ratelimit.Limiter) {
+	s.accountLimiter = limiter
+}
+
+// allowAccount takes an attempt from the budget of username, writing a 429 and reporting a
+// lockout when it is used up
+func (s *UserService) allowAccount(w http.ResponseWriter, r *http.Request, budget, username string) bool {
+	if s.accountLimiter == nil || username == "" {
+		return true
+	}
+	rule := s.accountLimiter.Match(r.Method, "", "")
+	rule.Name = budget
+	decision := s.accountLimiter.AllowKey(rule, strings.ToLower(username))
+	if decision.Allowed {
+		return true
+	}
+
+	s.authObservers.Notify(r.Context(), authevents.Failure{
+		Kind:     authevents.KindLockout,
+		Code:     "RATE_LIMIT_EXCEEDED",
+		Username: username,
+		IP:       httpapi.ClientIP(r),
+		Path:     r.URL.Path,
+	})
+	ratelimit.WriteRejection(w, decision)
+	return false
+}
+
+// SetKeycloakCredentials replaces the client secret and admin credentials, e.g. after a rotation
+// in the secret manager. Empty values leave the current one in place.
+func (s *UserService) SetKeycloakCredentials(clientSecret, adminUsername, adminPassword string) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+	if clientSecret != "" {
+		s.config.ClientSecret = clientSecret
+	}
+	if adminUsername != "" {
+		s.config.AdminUsername = adminUsername
+	}
+	if adminPassword != "" {
+		s.config.AdminPassword = adminPassword
+	}
+}
+
+// keycloakConfig returns a consistent snapshot of the Keycloak configuration
+func (s *UserService) keycloakConfig() KeycloakConfig {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config
+}
+
+// realmConfig returns the Keycloak config for realm, the primary realm when it is ""
+func (s *UserService) realmConfig(realm string) (KeycloakConfig, error) {
+	cfg, ok := s.keycloakConfig().ForRealm(realm)
+	if !ok {
+		return KeycloakConfig{}, apperrors.Invalid("UNKNOWN_REALM", fmt.Sprintf("Realm %q is not configured", realm))
+	}
+	return cfg, nil
+}
+
+// userUniqueConstraints maps unique constraints and indexes on users to the request field they guard
+var userUniqueConstraints = map[string]string{
+	"users_username_key":       "username",
+	"users_email_key":          "email",
+	"idx_users_username_lower": "username",
+	"idx_users_email_lower":    "email",
 }
 
 func (s *UserService) RegisterUser(ctx context.Context, req RegisterRequest) (*User, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
-		s.logger.WithError(err).Warn("Validation failed")
+		s.logger.WithContext(ctx).WithError(err).Warn("Validation failed")
 		return nil, err
 	}
 
-	// Check if username or email exists locally
-	if existing, _ := s.repo.GetByUsername(req.Username); existing != nil {
-		return nil, &ValidationError{Field: "username", Message: "already exists"}
-	}
-	if existing, _ := s.repo.GetByEmail(req.Email); existing != nil {
-		return nil, &ValidationError{Field: "email", Message: "already exists"}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = NormalizeEmail(req.Email)
+	cfg, err := s.realmConfig(req.Realm)
+	if err != nil {
+		return nil, err
 	}
 
-	// Register in Keycloak
-	token, err := s.keycloak.LoginAdmin(ctx, s.config.AdminUsername, s.config.AdminPassword, s.config.Realm)
+	// A personal invitation lets its invitee register however registration is gated
+	invited, err := s.checkInvitation(req.Email, req.InviteCode)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to login to Keycloak")
 		return nil, err
 	}
 
-	user := gocloak.User{
-		Username:      &req.Username,
-		Email:         &req.Email,
-		FirstName:     &req.FirstName,
-		LastName:      &req.LastName,
-		EmailVerified: gocloak.BoolP(true),
-		Enabled:       gocloak.BoolP(true),
+	// Closed or invite-only registration is enforced before anything is looked up, so rejected
+	// sign-ups cannot probe for existing accounts
+	if s.registration != nil && !invited {
+		if err := s.registration.CheckRegistration(req.Email, req.InviteCode); err != nil {
+			s.logger.WithContext(ctx).WithError(err).Warn("Registration rejected")
+			return nil, err
+		}
 	}
 
-	keycloakID, err := s.keycloak.CreateUser(ctx, token.AccessToken, s.config.Realm, user)
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to create user in Keycloak")
-		return nil, err
+	// Check if username or email exists locally (case-insensitive)
+	if existing, _ := s.repo.GetByUsername(req.Username); existing != nil {
+		return nil, takenError("username")
+	}
+	if existing, _ := s.repo.GetByEmail(req.Email); existing != nil {
+		return nil, takenError("email")
+	}
+
+	// Check the seat quota before creating anything in Keycloak
+	if s.quotas != nil {
+		if err := s.quotas.Check(ctx, quota.Users); err != nil {
+			s.logger.WithContext(ctx).WithError(err).Warn("User quota rejected registration")
+			return nil, err
+		}
 	}
 
-	// Set password in Keycloak
-	err = s.keycloak.SetPassword(ctx, token.AccessToken, keycloakID, s.config.Realm, req.Password, false)
+	// Register at the identity provider
+	account := Account{Username: req.Username, Email: req.Email, FirstName: req.FirstName, LastName: req.LastName}
+	keycloakID, err := s.identity.CreateUser(ctx, cfg.Realm, account, req.Password)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to set password in Keycloak")
-		// Optionally delete the user from Keycloak
 		return nil, err
 	}
 
@@ -93,107 +448,212 @@ func (s *UserService) RegisterUser(ctx context.Context, req RegisterRequest) (*U
 		IsActive:   true,
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
+		Realm:      cfg.Realm,
+	}
+	if hasher, ok := s.identity.(passwordHasher); ok {
+		if localUser.PasswordHash, err = hasher.HashPassword(req.Password); err != nil {
+			s.logger.WithContext(ctx).WithError(err).Error("Failed to hash password")
+			return nil, err
+		}
 	}
 
 	err = s.repo.Create(localUser)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to create user locally")
+		if field, ok := dberrors.UniqueViolationField(err, userUniqueConstraints); ok {
+			// Lost a race with a concurrent registration; roll back the account we just created
+			if delErr := s.identity.DeleteUser(ctx, cfg.Realm, keycloakID); delErr != nil {
+				s.logger.WithContext(ctx).WithError(delErr).WithField("keycloak_id", keycloakID).Error("Failed to delete orphaned Keycloak user")
+			}
+			return nil, takenError(field)
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to create user locally")
 		// Optionally delete from Keycloak
 		return nil, err
 	}
 
-	s.logger.WithField("user_id", localUser.ID).Info("User registered successfully")
+	s.logger.WithContext(ctx).WithField("user_id", localUser.ID).Info("User registered successfully")
+	s.audit(ctx, audit.ActionCreate, AuditUser, localUser.ID, nil, localUser)
+	if invited {
+		s.redeemInvitation(ctx, localUser, req.InviteCode)
+	}
+	s.runWelcome(ctx, localUser)
 	return localUser, nil
 }
 
 type LoginRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
+	// CaptchaResponse is the solved challenge, needed after repeated failed logins
+	CaptchaResponse string `json:"captcha_response,omitempty"`
+	// DeviceFingerprint is an optional stable identifier of the client, telling apart devices
+	// with the same user agent
+	DeviceFingerprint string `json:"device_fingerprint,omitempty" validate:"max=256"`
+	// Realm is the Keycloak realm of the account; the primary realm when empty
+	Realm string `json:"realm,omitempty" validate:"max=255"`
 }
 
 type LoginResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
 	User         *User  `json:"user"`
+	// sessionID is the Keycloak session the login started
+	sessionID string
 }
 
 func (s *UserService) LoginUser(ctx context.Context, req LoginRequest) (*LoginResponse, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
-		s.logger.WithError(err).Warn("Login validation failed")
+		s.logger.WithContext(ctx).WithError(err).Warn("Login validation failed")
 		return nil, err
 	}
 
-	// Authenticate with Keycloak
-	token, err := s.keycloak.Login(ctx, s.config.ClientID, s.config.ClientSecret, s.config.Realm, req.Username, req.Password)
+	// Authenticate at the identity provider
+	cfg, err := s.realmConfig(req.Realm)
 	if err != nil {
-		s.logger.WithError(err).Warn("Login failed")
-		return nil, &ValidationError{Field: "credentials", Message: "invalid"}
+		return nil, err
+	}
+	token, err := s.identity.Login(ctx, cfg.Realm, req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, errInvalidCredentials) {
+			s.logger.WithContext(ctx).Warn("Login failed")
+		}
+		return nil, err
 	}
 
 	// Get user info from local DB
 	user, err := s.repo.GetByUsername(req.Username)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to get user from DB")
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to get user from DB")
 		return nil, err
 	}
+	if user == nil && token.Account != nil {
+		if user, err = s.provisionUser(ctx, cfg.Realm, token); err != nil {
+			return nil, err
+		}
+	}
+	// Providers that manage accounts elsewhere cannot be told about deactivations
+	if user != nil && !user.IsActive {
+		s.logger.WithContext(ctx).WithField("user_id", user.ID).Warn("Login of deactivated user rejected")
+		return nil, errInvalidCredentials
+	}
+
+	userID := token.Subject
+	if user != nil {
+		userID = user.KeycloakID
+	}
+	s.trackRefreshToken(ctx, "", userID, cfg.Realm, token)
 
 	return &LoginResponse{
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		User:         user,
+		sessionID:    token.SessionID,
 	}, nil
 }
 
+// provisionUser creates the local record of a user the identity provider knows but this
+// service has not seen, at their first login
+func (s *UserService) provisionUser(ctx context.Context, realm string, token *Tokens) (*User, error) {
+	now := time.Now()
+	user := &User{
+		ID:         uuid.New().String(),
+		KeycloakID: token.Subject,
+		Username:   token.Account.Username,
+		Email:      NormalizeEmail(token.Account.Email),
+		FirstName:  token.Account.FirstName,
+		LastName:   token.Account.LastName,
+		IsActive:   true,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Realm:      realm,
+	}
+	if err := s.repo.Create(user); err != nil {
+		if field, ok := dberrors.UniqueViolationField(err, userUniqueConstraints); ok {
+			return nil, takenError(field)
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to create user locally")
+		return nil, err
+	}
+	s.logger.WithContext(ctx).WithField("user_id", user.ID).Info("User provisioned at first login")
+	s.runWelcome(ctx, user)
+	return user, nil
+}
+
 type ProfileUpdateRequest struct {
 	FirstName string `json:"first_name" validate:"required"`
 	LastName  string `json:"last_name" validate:"required"`
 	Email     string `json:"email" validate:"required,email"`
+	// Phone is optional, in E.164 format (e.g. +14155552671)
+	Phone string `json:"phone" validate:"omitempty,e164"`
+	// Attributes replace the user's custom attributes when present
+	Attributes map[string]string `json:"attributes" validate:"omitempty,max=50,dive,keys,min=1,max=64,endkeys,max=1024"`
 }
 
 func (s *UserService) GetProfile(ctx context.Context, userID string) (*User, error) {
 	user, err := s.repo.GetByID(userID)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to get profile")
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to get profile")
+		return nil, err
+	}
+	return user, nil
+}
+
+// FindUserByUsername looks up a user for administrators; usernames match case-insensitively
+func (s *UserService) FindUserByUsername(ctx context.Context, username string) (*User, error) {
+	return s.findUser(ctx, "username", username, s.repo.GetByUsername)
+}
+
+// FindUserByEmail looks up a user for administrators; emails match case-insensitively
+func (s *UserService) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findUser(ctx, "email", email, s.repo.GetByEmail)
+}
+
+// FindUserByKeycloakID looks up a user for administrators by their Keycloak user ID
+func (s *UserService) FindUserByKeycloakID(ctx context.Context, keycloakID string) (*User, error) {
+	return s.findUser(ctx, "keycloak_id", keycloakID, s.repo.GetByKeycloakID)
+}
+
+// findUser runs lookup and turns a missing user into a NotFound error
+func (s *UserService) findUser(ctx context.Context, by, value string, lookup func(string) (*User, error)) (*User, error) {
+	user, err := lookup(value)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("by", by).Error("Failed to look up user")
 		return nil, err
 	}
+	if user == nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
 	return user, nil
 }
 
 func (s *UserService) UpdateProfile(ctx context.Context, userID string, req ProfileUpdateRequest) (*User, error) {
 	// Validate input
 	if err := validate.Struct(req); err != nil {
-		s.logger.WithError(err).Warn("Profile update validation failed")
+		s.logger.WithContext(ctx).WithError(err).Warn("Profile update validation failed")
 		return nil, err
 	}
 
+	req.Email = NormalizeEmail(req.Email)
+
 	// Get current user
 	user, err := s.repo.GetByID(userID)
 	if err != nil {
 		return nil, err
 	}
+	if user == nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
 
 	// Check if email is taken by another user
 	if existing, _ := s.repo.GetByEmail(req.Email); existing != nil && existing.ID != userID {
-		return nil, &ValidationError{Field: "email", Message: "already exists"}
-	}
-
-	// Update in Keycloak
-	keycloakUser := gocloak.User{
-		FirstName: &req.FirstName,
-		LastName:  &req.LastName,
-		Email:     &req.Email,
+		return nil, takenError("email")
 	}
 
-	token, err := s.keycloak.LoginAdmin(ctx, s.config.AdminUsername, s.config.AdminPassword, s.config.Realm)
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to login to Keycloak for update")
-		return nil, err
-	}
+	before := *user
 
-	err = s.keycloak.UpdateUser(ctx, token.AccessToken, s.config.Realm, keycloakUser)
-	if err != nil {
-		s.logger.WithError(err).Error("Failed to update user in Keycloak")
+	// Update at the identity provider
+	account := Account{Username: user.Username, Email: req.Email, FirstName: req.FirstName, LastName: req.LastName}
+	if err := s.identity.UpdateUser(ctx, user.Realm, user.KeycloakID, account); err != nil {
 		return nil, err
 	}
 
@@ -201,47 +661,175 @@ func (s *UserService) UpdateProfile(ctx context.Context, userID string, req Prof
 	user.FirstName = req.FirstName
 	user.LastName = req.LastName
 	user.Email = req.Email
+	user.Phone = req.Phone
+	if req.Attributes != nil {
+		user.Attributes = req.Attributes
+	}
 	user.UpdatedAt = time.Now()
 
 	err = s.repo.Update(user)
 	if err != nil {
-		s.logger.WithError(err).Error("Failed to update user locally")
+		if field, ok := dberrors.UniqueViolationField(err, userUniqueConstraints); ok {
+			return nil, takenError(field)
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to update user locally")
 		return nil, err
 	}
 
-	s.logger.WithField("user_id", userID).Info("Profile updated successfully")
+	s.logger.WithContext(ctx).WithField("user_id", userID).Info("Profile updated successfully")
+	s.audit(ctx, audit.ActionUpdate, AuditUser, userID, &before, user)
 	return user, nil
 }
 
-type ValidationError struct {
-	Field   string
-	Message string
+// RevokeSessions logs the user with the given Keycloak ID out of every Keycloak session in
+// their realm
+func (s *UserService) RevokeSessions(ctx context.Context, keycloakID string) error {
+	var realm string
+	if user, err := s.repo.GetByKeycloakID(keycloakID); err == nil && user != nil {
+		realm = user.Realm
+	}
+	return s.identity.LogoutAllSessions(ctx, realm, keycloakID)
+}
+
+// DeactivateUser disables a user locally and in Keycloak and revokes their current access, so
+// they are locked out at once instead of when their token expires
+func (s *UserService) DeactivateUser(ctx context.Context, userID string) (*User, error) {
+	user, err := s.setActive(ctx, userID, false)
+	if err != nil || s.access == nil {
+		return user, err
+	}
+	if err := s.access.RevokeUserAccess(ctx, user.KeycloakID, rbac.RevokedDeactivated); err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Warn("Failed to end sessions of deactivated user")
+	}
+	return user, nil
+}
+
+// ActivateUser re-enables a deactivated user; active users count against the user quota
+func (s *UserService) ActivateUser(ctx context.Context, userID string) (*User, error) {
+	return s.setActive(ctx, userID, true)
+}
+
+// setActive enables or disables a user in Keycloak and then locally; it does nothing when the
+// user already has that state
+func (s *UserService) setActive(ctx context.Context, userID string, active bool) (*User, error) {
+	logger := s.logger.WithContext(ctx).WithField("user_id", userID)
+	user, err := s.repo.GetByID(userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get user")
+		return nil, err
+	}
+	if user == nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	if user.IsActive == active {
+		return user, nil
+	}
+	if active && s.quotas != nil {
+		if err := s.quotas.Check(ctx, quota.Users); err != nil {
+			logger.WithError(err).Warn("User quota rejected activation")
+			return nil, err
+		}
+	}
+
+	if err := s.identity.SetEnabled(ctx, user.Realm, user.KeycloakID, active); err != nil {
+		return nil, err
+	}
+
+	before := *user
+	user.IsActive = active
+	user.UpdatedAt = time.Now()
+	if err := s.repo.Update(user); err != nil {
+		logger.WithError(err).Error("Failed to update user locally")
+		return nil, err
+	}
+
+	logger.WithField("active", active).Info("User activation changed")
+	s.audit(ctx, audit.ActionUpdate, AuditUser, userID, &before, user)
+	return user, nil
+}
+
+// errInvalidCredentials is returned when Keycloak rejects a username and password
+var errInvalidCredentials = apperrors.Unauthorized("INVALID_CREDENTIALS", "Invalid username or password")
+
+// takenError is the conflict returned when a username or email already belongs to a user
+func takenError(field string) error {
+	if field == "email" {
+		return apperrors.Conflict("EMAIL_TAKEN", "Email already exists")
+	}
+	return apperrors.Conflict("USERNAME_TAKEN", "Username already exists")
+}
+
+// writeServiceError writes the response for an error returned by UserService: validation
+// failures become 400s and everything else goes through the shared domain error mapper
+func writeServiceError(w http.ResponseWriter, err error, fallbackMessage string) {
+	if httpapi.WriteValidationError(w, err) {
+		return
+	}
+	httpapi.WriteError(w, err, fallbackMessage)
+}
+
+// writeMethodNotAllowed rejects a request made with the wrong HTTP method
+func writeMethodNotAllowed(w http.ResponseWriter) {
+	httpapi.WriteErrorResponse(w, http.StatusMethodNotAllowed, "Method not allowed", "METHOD_NOT_ALLOWED", nil)
+}
+
+// writeInvalidBody rejects a request whose body is not valid JSON
+func writeInvalidBody(w http.ResponseWriter) {
+	httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
 }
 
-func (e *ValidationError) Error() string {
-	return e.Field + ": " + e.Message
+// profileUserID returns the user a profile request is for: the user_id query parameter, or the
+// authenticated caller when it is omitted. It writes the error response when there is neither.
+func (s *UserService) profileUserID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if userID := r.URL.Query().Get("user_id"); userID != "" {
+		return userID, true
+	}
+	caller := auth.UserID(r.Context())
+	if caller == "" {
+		httpapi.WriteErrorResponse(w, http.StatusBadRequest, "User ID required", "VALIDATION_ERROR", map[string]string{"user_id": "is required"})
+		return "", false
+	}
+	user, err := s.FindUserByKeycloakID(r.Context(), caller)
+	if err != nil {
+		writeServiceError(w, err, "Failed to get profile")
+		return "", false
+	}
+	return user.ID, true
+}
+
+// ownsProfile reports whether the profile named by the user_id parameter is the one of userID,
+// the caller's Keycloak ID; without the parameter the request is for the caller's own profile
+func (s *UserService) ownsProfile(r *http.Request, userID string) (bool, error) {
+	id := r.URL.Query().Get("user_id")
+	if id == "" {
+		return true, nil
+	}
+	user, err := s.repo.GetByID(id)
+	if err != nil || user == nil {
+		return false, err
+	}
+	return user.KeycloakID == userID || user.ID == userID, nil
 }
 
 func RegisterHandler(service *UserService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
 		var req RegisterRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			writeInvalidBody(w)
+			return
+		}
+		if !service.allowAccount(w, r, RegisterAccountBudget, strings.TrimSpace(req.Username)) {
 			return
 		}
 
 		user, err := service.RegisterUser(r.Context(), req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Registration failed", http.StatusInternalServerError)
+			writeServiceError(w, err, "Registration failed")
 			return
 		}
 
@@ -253,98 +841,263 @@ func RegisterHandler(service *UserService) http.HandlerFunc {
 func LoginHandler(service *UserService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
 		var req LoginRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			writeInvalidBody(w)
+			return
+		}
+
+		username, ip := strings.TrimSpace(req.Username), httpapi.ClientIP(r)
+		if !service.allowAccount(w, r, LoginAccountBudget, username) {
+			return
+		}
+		if service.loginGuard != nil && !service.checkLoginChallenge(w, r, ip, username, req.CaptchaResponse) {
 			return
 		}
 
 		response, err := service.LoginUser(r.Context(), req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusUnauthorized)
-				return
+			if errors.Is(err, errInvalidCredentials) {
+				service.authObservers.Notify(r.Context(), authevents.Failure{
+					Kind:     authevents.KindLoginFailed,
+					Code:     errInvalidCredentials.Code,
+					Username: username,
+					IP:       ip,
+					Path:     r.URL.Path,
+				})
+				if service.loginGuard != nil {
+					service.loginGuard.Failed(ip, username)
+					if service.loginGuard.Required(ip, username) {
+						w.Header().Set(CaptchaRequiredHeader, "true")
+					}
+				}
 			}
-			http.Error(w, "Login failed", http.StatusInternalServerError)
+			writeServiceError(w, err, "Login failed")
 			return
 		}
+		if service.loginGuard != nil {
+			service.loginGuard.Succeeded(username)
+		}
+		service.recordDevice(r.Context(), response.User, response.sessionID, LoginDevice{
+			UserAgent:   r.UserAgent(),
+			Fingerprint: req.DeviceFingerprint,
+			IP:          ip,
+		})
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
 }
 
+// CaptchaRequiredHeader is set on failed logins once the next attempt needs a solved challenge
+const CaptchaRequiredHeader = "X-Captcha-Required"
+
+// checkLoginChallenge verifies the challenge of a login attempt when one is required, writing
+// the error response and reporting false when the attempt may not proceed
+func (s *UserService) checkLoginChallenge(w http.ResponseWriter, r *http.Request, ip, username, response string) bool {
+	err := s.loginGuard.Check(r.Context(), ip, username, response)
+	if err == nil {
+		return true
+	}
+
+	var code, message string
+	switch {
+	case errors.Is(err, captcha.ErrRequired):
+		code, message = "CAPTCHA_REQUIRED", "Solve the challenge to log in"
+	case errors.Is(err, captcha.ErrInvalid):
+		code, message = "CAPTCHA_INVALID", "Challenge verification failed"
+	default:
+		s.logger.WithContext(r.Context()).WithError(err).Error("Captcha verification unavailable")
+		httpapi.WriteErrorResponse(w, http.StatusServiceUnavailable, "Challenge verification unavailable", "CAPTCHA_UNAVAILABLE", nil)
+		return false
+	}
+	s.authObservers.Notify(r.Context(), authevents.Failure{
+		Kind:     authevents.KindLockout,
+		Code:     code,
+		Username: username,
+		IP:       ip,
+		Path:     r.URL.Path,
+	})
+	w.Header().Set(CaptchaRequiredHeader, "true")
+	httpapi.WriteErrorResponse(w, http.StatusUnauthorized, message, code, nil)
+	return false
+}
+
 func GetProfileHandler(service *UserService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
-		// Assume user ID from context or token, for simplicity, from query param
-		userID := r.URL.Query().Get("user_id")
-		if userID == "" {
-			http.Error(w, "User ID required", http.StatusBadRequest)
+		userID, ok := service.profileUserID(w, r)
+		if !ok {
 			return
 		}
 
 		user, err := service.GetProfile(r.Context(), userID)
 		if err != nil {
-			http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+			writeServiceError(w, err, "Failed to get profile")
 			return
 		}
 		if user == nil {
-			http.Error(w, "User not found", http.StatusNotFound)
+			httpapi.WriteErrorResponse(w, http.StatusNotFound, "User not found", "USER_NOT_FOUND", nil)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(user)
+		json.NewEncoder(w).Encode(service.filterFor(r, user))
 	}
 }
 
 func UpdateProfileHandler(service *UserService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPut {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeMethodNotAllowed(w)
 			return
 		}
 
-		// Assume user ID from context
-		userID := r.URL.Query().Get("user_id")
-		if userID == "" {
-			http.Error(w, "User ID required", http.StatusBadRequest)
+		userID, ok := service.profileUserID(w, r)
+		if !ok {
 			return
 		}
 
 		var req ProfileUpdateRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request", http.StatusBadRequest)
+			writeInvalidBody(w)
 			return
 		}
 
 		user, err := service.UpdateProfile(r.Context(), userID, req)
 		if err != nil {
-			if ve, ok := err.(*ValidationError); ok {
-				http.Error(w, ve.Error(), http.StatusBadRequest)
-				return
-			}
-			http.Error(w, "Update failed", http.StatusInternalServerError)
+			writeServiceError(w, err, "Update failed")
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(user)
+		json.NewEncoder(w).Encode(service.filterFor(r, user))
 	}
 }
 
-func SetupRoutes(r *mux.Router, service *UserService) {
+// lookupHandler serves a user found by the path variable key
+func lookupHandler(service *UserService, key string, find func(context.Context, string) (*User, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := find(r.Context(), mux.Vars(r)[key])
+		if err != nil {
+			writeServiceError(w, err, "Failed to look up user")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.filterFor(r, user))
+	}
+}
+
+// GetUserByUsernameHandler handles GET /api/users/by-username/{name}
+func GetUserByUsernameHandler(service *UserService) http.HandlerFunc {
+	return lookupHandler(service, "name", service.FindUserByUsername)
+}
+
+// GetUserByEmailHandler handles GET /api/users/by-email/{email}
+func GetUserByEmailHandler(service *UserService) http.HandlerFunc {
+	return lookupHandler(service, "email", service.FindUserByEmail)
+}
+
+// GetUserByKeycloakIDHandler handles GET /api/users/by-keycloak-id/{id}
+func GetUserByKeycloakIDHandler(service *UserService) http.HandlerFunc {
+	return lookupHandler(service, "id", service.FindUserByKeycloakID)
+}
+
+// activationHandler serves the user after changing whether they are active
+func activationHandler(service *UserService, set func(context.Context, string) (*User, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := set(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to update user")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.filterFor(r, user))
+	}
+}
+
+// DeactivateUserHandler handles POST /api/users/{id}/deactivate
+func DeactivateUserHandler(service *UserService) http.HandlerFunc {
+	return activationHandler(service, service.DeactivateUser)
+}
+
+// ActivateUserHandler handles POST /api/users/{id}/activate
+func ActivateUserHandler(service *UserService) http.HandlerFunc {
+	return activationHandler(service, service.ActivateUser)
+}
+
+// RegisterSchemas registers the request bodies of the user routes for schema validation
+func RegisterSchemas(reg *jsonschema.Registry) {
+	reg.Register("POST", "/api/users/register", RegisterRequest{})
+	reg.Register("POST", "/api/users/login", LoginRequest{})
+	reg.Register("POST", MagicLinkPath, MagicLinkRequest{})
+	reg.Register("POST", MagicLinkVerifyPath, MagicLinkVerifyRequest{})
+	reg.Register("POST", TokenExchangePath, TokenExchangeRequest{})
+	reg.Register("PUT", "/api/users/profile", ProfileUpdateRequest{})
+	reg.Register("POST", "/api/users/{id}/notes", CreateUserNoteRequest{})
+	reg.Register("POST", "/api/users/me/views", SaveViewRequest{})
+	reg.Register("PUT", "/api/users/me/views/{id}", SaveViewRequest{})
+}
+
+// SetupRoutes configures the user routes; the admin lookups require read_user, (de)activation
+// requires update_user, profiles require read_user/update_user or their _own variants for the
+// caller's own profile, deletion requires delete_user and support notes require manage_user_notes
+func SetupRoutes(r *mux.Router, service *UserService, rbacService *rbac.RBACService) {
 	r.HandleFunc("/api/users/register", RegisterHandler(service)).Methods("POST")
 	r.HandleFunc("/api/users/login", LoginHandler(service)).Methods("POST")
-	r.HandleFunc("/api/users/profile", GetProfileHandler(service)).Methods("GET")
-	r.HandleFunc("/api/users/profile", UpdateProfileHandler(service)).Methods("PUT")
+	r.HandleFunc(MagicLinkPath, RequestMagicLinkHandler(service)).Methods("POST")
+	r.HandleFunc(MagicLinkVerifyPath, VerifyMagicLinkHandler(service)).Methods("POST")
+	r.HandleFunc(RefreshPath, RefreshHandler(service)).Methods("POST")
+	rbacService.Protect(r.HandleFunc(TokenExchangePath, TokenExchangeHandler(service)).Methods("POST"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/profile", rbacService.RequireOwnershipOr(perm.ReadUser, service.ownsProfile, GetProfileHandler(service))).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/profile", rbacService.RequireOwnershipOr(perm.UpdateUser, service.ownsProfile, UpdateProfileHandler(service))).Methods("PUT"), "")
+	r.HandleFunc("/api/users/{id}/avatar", GetAvatarHandler(service)).Methods("GET")
+
+	rbacService.Protect(r.HandleFunc("/api/users/by-username/{name}", GetUserByUsernameHandler(service)).Methods("GET"), perm.ReadUser)
+	rbacService.Protect(r.HandleFunc("/api/users/by-email/{email}", GetUserByEmailHandler(service)).Methods("GET"), perm.ReadUser)
+	rbacService.Protect(r.HandleFunc("/api/users/by-keycloak-id/{id}", GetUserByKeycloakIDHandler(service)).Methods("GET"), perm.ReadUser)
+	rbacService.Protect(r.HandleFunc("/api/users/{id}/deactivate", DeactivateUserHandler(service)).Methods("POST"), perm.UpdateUser)
+	rbacService.Protect(r.HandleFunc("/api/users/{id}/activate", ActivateUserHandler(service)).Methods("POST"), perm.UpdateUser)
+	rbacService.Protect(r.HandleFunc("/api/users/{id}", DeleteUserHandler(service)).Methods("DELETE"), perm.DeleteUser)
+	rbacService.Protect(r.HandleFunc("/api/users/{id}/notes", GetUserNotesHandler(service)).Methods("GET"), perm.ManageUserNotes)
+	rbacService.Protect(r.HandleFunc("/api/users/{id}/notes", CreateUserNoteHandler(service)).Methods("POST"), perm.ManageUserNotes)
+
+	// Social identity providers the caller links to their own account
+	rbacService.Protect(r.HandleFunc("/api/users/me/identities", GetLinkedIdentitiesHandler(service)).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/identities/{provider}/link", StartIdentityLinkHandler(service)).Methods("POST"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/identities/{provider}/confirm", ConfirmIdentityLinkHandler(service)).Methods("POST"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/identities/{provider}", UnlinkIdentityHandler(service)).Methods("DELETE"), "")
+
+	// WebAuthn credentials (passkeys and security keys) of the caller
+	rbacService.Protect(r.HandleFunc("/api/users/me/passkeys", GetPasskeysHandler(service)).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/passkeys/register", StartPasskeyRegistrationHandler(service)).Methods("POST"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/passkeys/{id}", DeletePasskeyHandler(service)).Methods("DELETE"), "")
+
+	// Which required profile fields the caller has yet to fill in
+	rbacService.Protect(r.HandleFunc("/api/users/me/profile/completeness", GetProfileCompletenessHandler(service)).Methods("GET"), "")
+
+	// Devices the caller logged in from
+	rbacService.Protect(r.HandleFunc("/api/users/me/devices", GetDevicesHandler(service)).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/devices/{id}", RevokeDeviceHandler(service)).Methods("DELETE"), "")
+
+	// Named filter and sort configurations the caller saved for the admin lists
+	rbacService.Protect(r.HandleFunc("/api/users/me/views", GetViewsHandler(service)).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/views", SaveViewHandler(service)).Methods("POST"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/views/{id}", GetViewHandler(service)).Methods("GET"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/views/{id}", SaveViewHandler(service)).Methods("PUT"), "")
+	rbacService.Protect(r.HandleFunc("/api/users/me/views/{id}", DeleteViewHandler(service)).Methods("DELETE"), "")
+
+	// Migration between realms and environments in Keycloak's realm export format
+	rbacService.Protect(r.HandleFunc("/api/users/import", ImportUsersHandler(service)).Methods("POST"), perm.CreateUser)
+	rbacService.Protect(r.HandleFunc("/api/users/export", ExportUsersHandler(service)).Methods("GET"), perm.ReadUser)
 }
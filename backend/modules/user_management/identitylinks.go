@@ -0,0 +1,260 @@
+package user_management
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"base-app/modules/auth"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Users link social identity providers configured in Keycloak (Google, GitHub, ...) with
+// Keycloak's client-initiated account linking: the browser is sent to the broker link URL of the
+// provider, Keycloak links the identity after the user signs in there and returns to
+// LinkRedirectURL, and the frontend then confirms the link here.
+
+// DefaultLinkProviders are the providers users may link when none are configured
+var DefaultLinkProviders = []string{"google", "github"}
+
+// LinkedIdentity is an account at an identity provider linked to a user
+type LinkedIdentity struct {
+	Provider string `json:"provider"`
+	// ProviderUserID and ProviderUsername identify the user at the provider
+	ProviderUserID   string `json:"provider_user_id"`
+	ProviderUsername string `json:"provider_username,omitempty"`
+}
+
+// LinkStart is where to send the browser to link a provider
+type LinkStart struct {
+	Provider string `json:"provider"`
+	URL      string `json:"url"`
+}
+
+var errIdentityNotLinked = apperrors.NotFound("IDENTITY_NOT_LINKED", "No account of this identity provider is linked")
+
+// linkProvider returns the alias of provider when users may link it
+func (s *UserService) linkProvider(cfg KeycloakConfig, provider string) (string, error) {
+	providers := cfg.LinkProviders
+	if len(providers) == 0 {
+		providers = DefaultLinkProviders
+	}
+	for _, p := range providers {
+		if strings.EqualFold(p, provider) {
+			return p, nil
+		}
+	}
+	return "", apperrors.NotFound("IDENTITY_PROVIDER_NOT_FOUND", "Identity provider not available for linking")
+}
+
+// StartIdentityLink returns the Keycloak URL that links provider to the account of the caller
+// logged in with session. The hash binds the request to the session, so the URL only works in
+// the browser of that login.
+func (s *UserService) StartIdentityLink(ctx context.Context, userID string, session rbac.Session, provider string) (*LinkStart, error) {
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider, err = s.linkProvider(cfg, provider)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LinkRedirectURL == "" {
+		return nil, apperrors.Internal("LINKING_NOT_CONFIGURED", "Account linking is not configured", nil)
+	}
+	if session.ID == "" || session.ClientID == "" {
+		return nil, apperrors.Invalid("SESSION_REQUIRED", "Linking requires a token from an interactive login")
+	}
+
+	nonce := uuid.New().String()
+	sum := sha256.Sum256([]byte(nonce + session.ID + session.ClientID + provider))
+	query := url.Values{
+		"client_id":    {session.ClientID},
+		"redirect_uri": {cfg.LinkRedirectURL},
+		"nonce":        {nonce},
+		"hash":         {base64.RawURLEncoding.EncodeToString(sum[:])},
+	}
+	link := strings.TrimRight(cfg.URL, "/") + "/realms/" + url.PathEscape(cfg.Realm) +
+		"/broker/" + url.PathEscape(provider) + "/link?" + query.Encode()
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":  userID,
+		"provider": provider,
+	}).Info("Identity provider linking started")
+	return &LinkStart{Provider: provider, URL: link}, nil
+}
+
+// LinkedIdentities lists the identity provider accounts linked to the user with the given
+// Keycloak ID
+func (s *UserService) LinkedIdentities(ctx context.Context, userID string) ([]LinkedIdentity, error) {
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.keycloak.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "admin login", err)
+	}
+	return s.linkedIdentities(ctx, token.AccessToken, cfg.Realm, userID)
+}
+
+func (s *UserService) linkedIdentities(ctx context.Context, token, realm, userID string) ([]LinkedIdentity, error) {
+	federated, err := s.keycloak.GetUserFederatedIdentities(ctx, token, realm, userID)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "list federated identities", err)
+	}
+	identities := make([]LinkedIdentity, len(federated))
+	for i, identity := range federated {
+		identities[i] = LinkedIdentity{
+			Provider:         gocloak.PString(identity.IdentityProvider),
+			ProviderUserID:   gocloak.PString(identity.UserID),
+			ProviderUsername: gocloak.PString(identity.UserName),
+		}
+	}
+	return identities, nil
+}
+
+// findIdentity returns the identity of provider among identities, or nil
+func findIdentity(identities []LinkedIdentity, provider string) *LinkedIdentity {
+	for i := range identities {
+		if strings.EqualFold(identities[i].Provider, provider) {
+			return &identities[i]
+		}
+	}
+	return nil
+}
+
+// ConfirmIdentityLink checks that Keycloak linked provider after the user came back from the
+// link URL and returns the linked identity. It is stateless, so any instance can confirm.
+func (s *UserService) ConfirmIdentityLink(ctx context.Context, userID, provider string) (*LinkedIdentity, error) {
+	provider, err := s.linkProvider(s.keycloakConfig(), provider)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := s.LinkedIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	identity := findIdentity(identities, provider)
+	if identity == nil {
+		return nil, apperrors.Conflict("LINK_NOT_COMPLETED", "The identity provider account was not linked")
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":  userID,
+		"provider": provider,
+	}).Info("Identity provider linked")
+	return identity, nil
+}
+
+// UnlinkIdentity removes the link to provider. The last identity of a user without a password
+// is kept, since they could no longer log in.
+func (s *UserService) UnlinkIdentity(ctx context.Context, userID, provider string) error {
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return err
+	}
+	token, err := s.keycloak.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return s.keycloakError(ctx, "admin login", err)
+	}
+	identities, err := s.linkedIdentities(ctx, token.AccessToken, cfg.Realm, userID)
+	if err != nil {
+		return err
+	}
+	identity := findIdentity(identities, provider)
+	if identity == nil {
+		return errIdentityNotLinked
+	}
+
+	if len(identities) == 1 {
+		credentials, err := s.keycloak.GetCredentials(ctx, token.AccessToken, cfg.Realm, userID)
+		if err != nil {
+			return s.keycloakError(ctx, "list credentials", err)
+		}
+		hasPassword := false
+		for _, credential := range credentials {
+			if gocloak.PString(credential.Type) == "password" {
+				hasPassword = true
+			}
+		}
+		if !hasPassword {
+			return apperrors.Conflict("LAST_LOGIN_METHOD", "Set a password before unlinking your only identity provider")
+		}
+	}
+
+	if err := s.keycloak.DeleteUserFederatedIdentity(ctx, token.AccessToken, cfg.Realm, userID, identity.Provider); err != nil {
+		return s.keycloakError(ctx, "delete federated identity", err)
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":  userID,
+		"provider": identity.Provider,
+	}).Info("Identity provider unlinked")
+	return nil
+}
+
+// HTTP Handlers
+
+// StartIdentityLinkHandler handles POST /api/users/me/identities/{provider}/link
+func StartIdentityLinkHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, err := service.StartIdentityLink(r.Context(), auth.UserID(r.Context()), auth.SessionFromContext(r.Context()), mux.Vars(r)["provider"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to start linking")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(start)
+	}
+}
+
+// ConfirmIdentityLinkHandler handles POST /api/users/me/identities/{provider}/confirm
+func ConfirmIdentityLinkHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := service.ConfirmIdentityLink(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["provider"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to confirm linking")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(identity)
+	}
+}
+
+// GetLinkedIdentitiesHandler handles GET /api/users/me/identities
+func GetLinkedIdentitiesHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identities, err := service.LinkedIdentities(r.Context(), auth.UserID(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to list linked identities")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"identities": identities})
+	}
+}
+
+// UnlinkIdentityHandler handles DELETE /api/users/me/identities/{provider}
+func UnlinkIdentityHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.UnlinkIdentity(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["provider"]); err != nil {
+			writeServiceError(w, err, "Failed to unlink identity")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,83 @@
+package user_management
+
+import (
+	"context"
+
+	"base-app/modules/auth"
+	"base-app/pkg/apperrors"
+)
+
+// IdentityProvider keeps the accounts users log in with and their sessions. Keycloak is the
+// default; deployments that cannot run it use another provider, such as any OpenID Connect
+// server. The realm selects a Keycloak realm and is "" for the primary one; other providers
+// ignore it.
+//
+// Providers return domain errors: errInvalidCredentials for a rejected login, takenError for
+// a username or email in use and apperrors.Unavailable when the provider cannot be reached.
+type IdentityProvider interface {
+	// CreateUser creates an enabled account with password and returns its ID at the provider
+	CreateUser(ctx context.Context, realm string, account Account, password string) (string, error)
+	// UpdateUser replaces the name and email of the account with id
+	UpdateUser(ctx context.Context, realm, id string, account Account) error
+	// SetEnabled enables or disables the account with id
+	SetEnabled(ctx context.Context, realm, id string, enabled bool) error
+	// DeleteUser deletes the account with id
+	DeleteUser(ctx context.Context, realm, id string) error
+	// Login checks a username and password and returns the tokens of the new session
+	Login(ctx context.Context, realm, username, password string) (*Tokens, error)
+	// Refresh exchanges a refresh token for new tokens, returning errInvalidRefreshToken when
+	// the provider rejects it
+	Refresh(ctx context.Context, realm, refreshToken string) (*Tokens, error)
+	// LogoutSession ends one session; LogoutAllSessions ends every session of the account with id
+	LogoutSession(ctx context.Context, realm, sessionID string) error
+	LogoutAllSessions(ctx context.Context, realm, id string) error
+}
+
+// Account is the profile an identity provider keeps for a user
+type Account struct {
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// Tokens are issued by an identity provider at login
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+	// SessionID identifies the session at the provider; empty when it has none
+	SessionID string
+	// Subject and Account describe the user as the provider knows them. Providers that manage
+	// accounts elsewhere set them, so a local record can be created at the first login.
+	Subject string
+	Account *Account
+}
+
+// passwordHasher is implemented by identity providers that keep password hashes with the local
+// user record; RegisterUser stores the hash when it creates the record
+type passwordHasher interface {
+	HashPassword(password string) (string, error)
+}
+
+// SetIdentityProvider replaces Keycloak as the provider of accounts and logins. Features only
+// Keycloak offers, such as identity linking, passkeys and realm imports, are unavailable with
+// other providers. Set it before serving requests.
+func (s *UserService) SetIdentityProvider(provider IdentityProvider) {
+	s.identity = provider
+}
+
+// requireKeycloak rejects a Keycloak-only feature when another identity provider is configured
+func (s *UserService) requireKeycloak() error {
+	if _, ok := s.identity.(*keycloakProvider); !ok {
+		return apperrors.Invalid("KEYCLOAK_REQUIRED", "This feature is not available with the configured identity provider")
+	}
+	return nil
+}
+
+// callerKeycloakConfig returns the config of the caller's realm for a Keycloak-only feature
+func (s *UserService) callerKeycloakConfig(ctx context.Context) (KeycloakConfig, error) {
+	if err := s.requireKeycloak(); err != nil {
+		return KeycloakConfig{}, err
+	}
+	return s.realmConfig(auth.Realm(ctx))
+}
@@ -0,0 +1,55 @@
+package user_management
+
+import "context"
+
+// Invitations are personal invite codes issued to one email address, such as the invitation of
+// the first administrator of a new tenant
+type Invitations interface {
+	// CheckInvitation reports whether code is a pending invitation of email
+	CheckInvitation(email, code string) (bool, error)
+	// RedeemInvitation accepts the invitation of email with code for userID and returns the names
+	// of the groups it grants
+	RedeemInvitation(ctx context.Context, email, code, userID string) ([]string, error)
+}
+
+// SetInvitations lets people register with a personal invitation, even while registration is
+// closed or invite-only, and puts them in the groups it grants. Set it before serving requests.
+func (s *UserService) SetInvitations(invitations Invitations) {
+	s.invitations = invitations
+}
+
+// checkInvitation reports whether code is a pending invitation of email
+func (s *UserService) checkInvitation(email, code string) (bool, error) {
+	if s.invitations == nil || code == "" {
+		return false, nil
+	}
+	invited, err := s.invitations.CheckInvitation(email, code)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to check invitation")
+		return false, err
+	}
+	return invited, nil
+}
+
+// redeemInvitation accepts the invitation user registered with and adds them to its groups. The
+// user is registered either way; failures are logged for an administrator to follow up.
+func (s *UserService) redeemInvitation(ctx context.Context, user *User, code string) {
+	logger := s.logger.WithContext(ctx).WithField("user_id", user.ID)
+	groups, err := s.invitations.RedeemInvitation(ctx, user.Email, code, user.ID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to redeem invitation")
+		return
+	}
+	if len(groups) == 0 || s.groups == nil {
+		return
+	}
+	_, unknown, err := s.groups.JoinGroupsByName(ctx, user.KeycloakID, groups)
+	if err != nil {
+		logger.WithError(err).Error("Failed to add invited user to groups")
+		return
+	}
+	if len(unknown) > 0 {
+		logger.WithField("groups", unknown).Warn("Invitation grants groups that no longer exist")
+	}
+	logger.WithField("groups", groups).Info("Invitation redeemed")
+}
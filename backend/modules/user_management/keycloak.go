@@ -0,0 +1,225 @@
+package user_management
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/sirupsen/logrus"
+)
+
+// Failed Keycloak calls are mapped to domain errors here, at the service boundary. Responses
+// only carry a stable code and a generic message; the upstream status and body are logged.
+// Unreachable, throttled or failing servers are retryable (KEYCLOAK_UNAVAILABLE, 503 with
+// Retry-After); every other failure is permanent.
+
+// keycloakStatus returns the HTTP status Keycloak answered a failed call with, or 0 when it
+// could not be reached
+func keycloakStatus(err error) int {
+	var apiErr *gocloak.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+// keycloakError logs a failed Keycloak call op with its upstream detail and returns the
+// sanitized error to hand to callers
+func (s *UserService) keycloakError(ctx context.Context, op string, err error) error {
+	return logKeycloakError(ctx, s.logger, op, err)
+}
+
+func logKeycloakError(ctx context.Context, logger *logrus.Logger, op string, err error) error {
+	mapped := mapKeycloakError(op, err)
+	kind := apperrors.KindOf(mapped)
+	entry := logger.WithContext(ctx).WithError(err).WithFields(logrus.Fields{
+		"keycloak_op":     op,
+		"keycloak_status": keycloakStatus(err),
+		"retryable":       kind == apperrors.KindUnavailable,
+	})
+	if kind == apperrors.KindUnavailable || kind == apperrors.KindInternal {
+		entry.Error("Keycloak request failed")
+	} else {
+		entry.Warn("Keycloak rejected request")
+	}
+	return mapped
+}
+
+// mapKeycloakError categorizes a failed Keycloak call. The returned error never contains the
+// upstream response, so it is safe to log and to return anywhere.
+func mapKeycloakError(op string, err error) error {
+	status := keycloakStatus(err)
+	message := ""
+	var apiErr *gocloak.APIError
+	if errors.As(err, &apiErr) {
+		message = strings.ToLower(apiErr.Message)
+	}
+	cause := fmt.Errorf("keycloak %s failed with status %d", op, status)
+
+	switch {
+	case status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError:
+		return apperrors.Unavailable("KEYCLOAK_UNAVAILABLE", "Identity provider unavailable, try again later", cause)
+	case status == http.StatusConflict:
+		if strings.Contains(message, "email") {
+			return takenError("email")
+		}
+		return takenError("username")
+	case status == http.StatusNotFound:
+		return apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	case status == http.StatusBadRequest && op == "set password":
+		// Keycloak answers 400 when the password violates the realm policy
+		return apperrors.Invalid("PASSWORD_REJECTED", "Password does not meet the password policy")
+	default:
+		// Includes 401/403 on admin calls, i.e. misconfigured service credentials
+		return apperrors.Internal("KEYCLOAK_REQUEST_FAILED", "Identity provider rejected the request", cause)
+	}
+}
+
+// keycloakProvider is the Keycloak IdentityProvider. Admin calls log in with the admin account
+// of the realm each time, so rotated credentials take effect at once.
+type keycloakProvider struct {
+	client *gocloak.GoCloak
+	// config returns the configuration of a realm
+	config func(realm string) (KeycloakConfig, error)
+	logger *logrus.Logger
+}
+
+// admin returns the configuration of realm and an admin access token for it
+func (p *keycloakProvider) admin(ctx context.Context, realm string) (KeycloakConfig, string, error) {
+	cfg, err := p.config(realm)
+	if err != nil {
+		return cfg, "", err
+	}
+	token, err := p.client.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return cfg, "", logKeycloakError(ctx, p.logger, "admin login", err)
+	}
+	return cfg, token.AccessToken, nil
+}
+
+func (p *keycloakProvider) CreateUser(ctx context.Context, realm string, account Account, password string) (string, error) {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return "", err
+	}
+	user := gocloak.User{
+		Username:      &account.Username,
+		Email:         &account.Email,
+		FirstName:     &account.FirstName,
+		LastName:      &account.LastName,
+		EmailVerified: gocloak.BoolP(true),
+		Enabled:       gocloak.BoolP(true),
+	}
+	id, err := p.client.CreateUser(ctx, token, cfg.Realm, user)
+	if err != nil {
+		return "", logKeycloakError(ctx, p.logger, "create user", err)
+	}
+
+	if err := p.client.SetPassword(ctx, token, id, cfg.Realm, password, false); err != nil {
+		// Roll back the Keycloak user so the username is free for the next attempt
+		if delErr := p.client.DeleteUser(ctx, token, cfg.Realm, id); delErr != nil {
+			p.logger.WithContext(ctx).WithError(delErr).WithField("keycloak_id", id).Error("Failed to delete orphaned Keycloak user")
+		}
+		return "", logKeycloakError(ctx, p.logger, "set password", err)
+	}
+	return id, nil
+}
+
+func (p *keycloakProvider) UpdateUser(ctx context.Context, realm, id string, account Account) error {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return err
+	}
+	user := gocloak.User{
+		ID:        &id,
+		FirstName: &account.FirstName,
+		LastName:  &account.LastName,
+		Email:     &account.Email,
+	}
+	if err := p.client.UpdateUser(ctx, token, cfg.Realm, user); err != nil {
+		return logKeycloakError(ctx, p.logger, "update user", err)
+	}
+	return nil
+}
+
+func (p *keycloakProvider) SetEnabled(ctx context.Context, realm, id string, enabled bool) error {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return err
+	}
+	if err := p.client.UpdateUser(ctx, token, cfg.Realm, gocloak.User{ID: &id, Enabled: gocloak.BoolP(enabled)}); err != nil {
+		return logKeycloakError(ctx, p.logger, "update user", err)
+	}
+	return nil
+}
+
+func (p *keycloakProvider) DeleteUser(ctx context.Context, realm, id string) error {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return err
+	}
+	if err := p.client.DeleteUser(ctx, token, cfg.Realm, id); err != nil {
+		return logKeycloakError(ctx, p.logger, "delete user", err)
+	}
+	return nil
+}
+
+func (p *keycloakProvider) Login(ctx context.Context, realm, username, password string) (*Tokens, error) {
+	cfg, err := p.config(realm)
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.client.Login(ctx, cfg.ClientID, cfg.ClientSecret, cfg.Realm, username, password)
+	if err != nil {
+		// Keycloak answers 401 for wrong passwords and 400 for disabled accounts
+		if status := keycloakStatus(err); status != http.StatusUnauthorized && status != http.StatusBadRequest {
+			return nil, logKeycloakError(ctx, p.logger, "login", err)
+		}
+		return nil, errInvalidCredentials
+	}
+	return &Tokens{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken, SessionID: token.SessionState}, nil
+}
+
+func (p *keycloakProvider) Refresh(ctx context.Context, realm, refreshToken string) (*Tokens, error) {
+	cfg, err := p.config(realm)
+	if err != nil {
+		return nil, err
+	}
+	token, err := p.client.RefreshToken(ctx, refreshToken, cfg.ClientID, cfg.ClientSecret, cfg.Realm)
+	if err != nil {
+		// Keycloak answers 400 for expired, revoked and already rotated refresh tokens
+		if status := keycloakStatus(err); status != http.StatusUnauthorized && status != http.StatusBadRequest {
+			return nil, logKeycloakError(ctx, p.logger, "refresh token", err)
+		}
+		return nil, errInvalidRefreshToken
+	}
+	return &Tokens{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken, SessionID: token.SessionState}, nil
+}
+
+func (p *keycloakProvider) LogoutSession(ctx context.Context, realm, sessionID string) error {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return err
+	}
+	// The session may already have ended
+	if err := p.client.LogoutUserSession(ctx, token, cfg.Realm, sessionID); err != nil && keycloakStatus(err) != http.StatusNotFound {
+		return logKeycloakError(ctx, p.logger, "logout session", err)
+	}
+	return nil
+}
+
+func (p *keycloakProvider) LogoutAllSessions(ctx context.Context, realm, id string) error {
+	cfg, token, err := p.admin(ctx, realm)
+	if err != nil {
+		return err
+	}
+	if err := p.client.LogoutAllSessions(ctx, token, cfg.Realm, id); err != nil {
+		return logKeycloakError(ctx, p.logger, "logout sessions", err)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package user_management
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"base-app/modules/rbac"
+	"base-app/pkg/password"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// LocalIssuer is the iss claim of tokens issued by the local identity provider
+const LocalIssuer = "base-app"
+
+// localProvider serves logins from the users table, for air-gapped deployments without
+// Keycloak. Passwords are kept as argon2id hashes in users.password_hash and logins are answered
+// with access tokens the API signs itself, so the login and registration API stays the same.
+// Sessions are the tokens: they end when they expire or are revoked through RBAC.
+type localProvider struct {
+	db *sql.DB
+	// issue signs the claims of an access token
+	issue    func(claims rbac.JWTClaims) (string, error)
+	lifetime time.Duration
+	logger   *logrus.Logger
+
+	// dummyHash is verified against when a username is unknown, so the response time does not
+	// tell whether an account exists
+	dummyOnce sync.Once
+	dummyHash string
+}
+
+// NewLocalProvider creates an identity provider keeping passwords in db and issuing access tokens
+// valid for lifetime with issue
+func NewLocalProvider(db *sql.DB, issue func(claims rbac.JWTClaims) (string, error), lifetime time.Duration, logger *logrus.Logger) IdentityProvider {
+	return &localProvider{db: db, issue: issue, lifetime: lifetime, logger: logger}
+}
+
+// CreateUser returns the ID of a new account; its password is stored with the local record,
+// see HashPassword
+func (p *localProvider) CreateUser(context.Context, string, Account, string) (string, error) {
+	return uuid.New().String(), nil
+}
+
+// HashPassword returns the hash to store with the local record of a new account
+func (p *localProvider) HashPassword(plain string) (string, error) {
+	return password.Hash(plain)
+}
+
+func (p *localProvider) Login(ctx context.Context, _, username, plain string) (*Tokens, error) {
+	var id, name, email string
+	var hash sql.NullString
+	var active bool
+	err := p.db.QueryRowContext(ctx, `SELECT keycloak_id, username, email, password_hash, is_active FROM users WHERE lower(username) = lower($1)`, username).
+		Scan(&id, &name, &email, &hash, &active)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		p.logger.WithContext(ctx).WithError(err).Error("Failed to get credentials")
+		return nil, err
+	}
+	if err != nil || !hash.Valid {
+		// Unknown users and users without a local password take as long as a wrong password
+		p.dummyOnce.Do(func() { p.dummyHash, _ = password.Hash(uuid.New().String()) })
+		password.Verify(plain, p.dummyHash)
+		return nil, errInvalidCredentials
+	}
+	ok, err := password.Verify(plain, hash.String)
+	if err != nil {
+		p.logger.WithContext(ctx).WithError(err).WithField("keycloak_id", id).Error("Stored password hash is unreadable")
+	}
+	if !ok || !active {
+		return nil, errInvalidCredentials
+	}
+
+	tokens, err := localTokens(p.issue, p.lifetime, id, name, email)
+	if err != nil {
+		p.logger.WithContext(ctx).WithError(err).Error("Failed to issue token")
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// localTokens signs an access token valid for lifetime for the user with Keycloak ID id, in a
+// new session
+func localTokens(issue func(claims rbac.JWTClaims) (string, error), lifetime time.Duration, id, username, email string) (*Tokens, error) {
+	now := time.Now()
+	sessionID := uuid.New().String()
+	token, err := issue(rbac.JWTClaims{
+		UserID:   id,
+		Username: username,
+		Email:    email,
+		Session:  sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    LocalIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tokens{AccessToken: token, SessionID: sessionID}, nil
+}
+
+// Refresh rejects every token: local logins issue no refresh tokens
+func (p *localProvider) Refresh(context.Context, string, string) (*Tokens, error) {
+	return nil, errInvalidRefreshToken
+}
+
+// UpdateUser does nothing: the profile is the local record
+func (p *localProvider) UpdateUser(context.Context, string, string, Account) error {
+	return nil
+}
+
+// SetEnabled does nothing: Login checks the local record's is_active
+func (p *localProvider) SetEnabled(context.Context, string, string, bool) error {
+	return nil
+}
+
+// DeleteUser does nothing: the password hash goes with the local record
+func (p *localProvider) DeleteUser(context.Context, string, string) error {
+	return nil
+}
+
+// LogoutSession does nothing: tokens are revoked through RBAC
+func (p *localProvider) LogoutSession(context.Context, string, string) error {
+	return nil
+}
+
+// LogoutAllSessions does nothing, like LogoutSession
+func (p *localProvider) LogoutAllSessions(context.Context, string, string) error {
+	return nil
+}
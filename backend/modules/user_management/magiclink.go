@@ -0,0 +1,403 @@
+package user_management
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/authevents"
+	"base-app/pkg/database"
+	"base-app/pkg/emailtemplates"
+	"base-app/pkg/httpapi"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/google/uuid"
+)
+
+// Passwordless login: a user asks for a magic link by email and receives a single-use code, on
+// its own and in a link to the frontend. Verifying the code signs them in like a password login.
+// Depending on the deployment the tokens come from Keycloak token exchange or are signed by the
+// API itself (see MagicLinkIssuer).
+
+// Magic link routes
+const (
+	MagicLinkPath       = "/api/users/login/magic-link"
+	MagicLinkVerifyPath = "/api/users/login/magic-link/verify"
+)
+
+// MagicLinkEvent is sent to the magic link notifier with each code
+const MagicLinkEvent = "user.magic_link"
+
+// MagicLinkAccountBudget is counted per email address by the account limiter
+const MagicLinkAccountBudget = "magic_link_account"
+
+// DefaultMagicLinkLifetime is how long a code is valid unless configured otherwise
+const DefaultMagicLinkLifetime = 15 * time.Minute
+
+var errInvalidMagicLink = apperrors.Unauthorized("INVALID_MAGIC_LINK", "Invalid or expired login code")
+
+// MagicLink is a login code sent to a user. Only the SHA-256 hash of the code is stored.
+type MagicLink struct {
+	ID string
+	// UserID is the local ID of the user the code signs in
+	UserID    string
+	CodeHash  string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// MagicLinkRepository keeps the codes sent to users
+type MagicLinkRepository interface {
+	// Create stores link, replacing the unused codes of its user and dropping expired ones
+	Create(link *MagicLink) error
+	// Consume marks the unused, unexpired code with codeHash used at the given time and returns
+	// it, or nil when there is none
+	Consume(codeHash string, at time.Time) (*MagicLink, error)
+}
+
+type magicLinkRepository struct {
+	db database.DBTX
+}
+
+// NewMagicLinkRepository creates a magic link repository. Reads go to the primary, since a code
+// is usually presented moments after it was sent.
+func NewMagicLinkRepository(db *sql.DB) MagicLinkRepository {
+	return &magicLinkRepository{db: db}
+}
+
+func (r *magicLinkRepository) Create(link *MagicLink) error {
+	return database.RunInTx(r.db, func(tx database.DBTX) error {
+		if _, err := tx.Exec(`DELETE FROM magic_link_codes WHERE (user_id = $1 AND used_at IS NULL) OR expires_at < $2`, link.UserID, link.CreatedAt); err != nil {
+			return err
+		}
+		query := `INSERT INTO magic_link_codes (id, user_id, code_hash, expires_at, created_at) VALUES ($1, $2, $3, $4, $5)`
+		_, err := tx.Exec(query, link.ID, link.UserID, link.CodeHash, link.ExpiresAt, link.CreatedAt)
+		return err
+	})
+}
+
+func (r *magicLinkRepository) Consume(codeHash string, at time.Time) (*MagicLink, error) {
+	link := &MagicLink{}
+	query := `UPDATE magic_link_codes SET used_at = $2
+	          WHERE code_hash = $1 AND used_at IS NULL AND expires_at > $2
+	          RETURNING id, user_id, code_hash, expires_at, used_at, created_at`
+	err := r.db.QueryRow(query, codeHash, at).Scan(&link.ID, &link.UserID, &link.CodeHash, &link.ExpiresAt, &link.UsedAt, &link.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// MagicLinkIssuer signs in the user of a verified code
+type MagicLinkIssuer interface {
+	IssueTokens(ctx context.Context, user *User) (*Tokens, error)
+}
+
+// KeycloakMagicLinkIssuer returns the issuer exchanging the API client's own token for tokens of
+// the user (Keycloak token exchange with requested_subject). The client needs the token-exchange
+// and impersonation permissions in each realm.
+func (s *UserService) KeycloakMagicLinkIssuer() (MagicLinkIssuer, error) {
+	if err := s.requireKeycloak(); err != nil {
+		return nil, err
+	}
+	return s.identity.(*keycloakProvider), nil
+}
+
+func (p *keycloakProvider) IssueTokens(ctx context.Context, user *User) (*Tokens, error) {
+	cfg, err := p.config(user.Realm)
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.client.LoginClient(ctx, cfg.ClientID, cfg.ClientSecret, cfg.Realm)
+	if err != nil {
+		return nil, logKeycloakError(ctx, p.logger, "client login", err)
+	}
+	token, err := p.client.GetToken(ctx, cfg.Realm, gocloak.TokenOptions{
+		ClientID:           &cfg.ClientID,
+		ClientSecret:       &cfg.ClientSecret,
+		GrantType:          gocloak.StringP("urn:ietf:params:oauth:grant-type:token-exchange"),
+		SubjectToken:       &client.AccessToken,
+		RequestedSubject:   &user.KeycloakID,
+		RequestedTokenType: gocloak.StringP("urn:ietf:params:oauth:token-type:refresh_token"),
+	})
+	if err != nil {
+		return nil, logKeycloakError(ctx, p.logger, "token exchange", err)
+	}
+	return &Tokens{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken, SessionID: token.SessionState}, nil
+}
+
+// localMagicLinkIssuer signs access tokens itself, like the local identity provider
+type localMagicLinkIssuer struct {
+	issue    func(claims rbac.JWTClaims) (string, error)
+	lifetime time.Duration
+}
+
+// NewLocalMagicLinkIssuer returns the issuer signing access tokens valid for lifetime with issue,
+// for deployments whose identity provider cannot exchange tokens
+func NewLocalMagicLinkIssuer(issue func(claims rbac.JWTClaims) (string, error), lifetime time.Duration) MagicLinkIssuer {
+	return &localMagicLinkIssuer{issue: issue, lifetime: lifetime}
+}
+
+func (i *localMagicLinkIssuer) IssueTokens(_ context.Context, user *User) (*Tokens, error) {
+	return localTokens(i.issue, i.lifetime, user.KeycloakID, user.Username, user.Email)
+}
+
+// MagicLinkOptions configures passwordless login
+type MagicLinkOptions struct {
+	Issuer MagicLinkIssuer
+	// Notifier delivers the codes by email
+	Notifier notification.Notifier
+	// Templates, when set, render the emails from the magic_link template
+	Templates *emailtemplates.Service
+	// URL is the frontend page the link opens, with the code in its code parameter; emails
+	// carry only the code without it
+	URL string
+	// Lifetime is how long a code is valid; DefaultMagicLinkLifetime when 0
+	Lifetime time.Duration
+}
+
+// SetMagicLinks enables passwordless login with the codes kept in repo. Set it before serving
+// requests.
+func (s *UserService) SetMagicLinks(repo MagicLinkRepository, opts MagicLinkOptions) {
+	if opts.Notifier == nil {
+		opts.Notifier = notification.Nop{}
+	}
+	if opts.Lifetime <= 0 {
+		opts.Lifetime = DefaultMagicLinkLifetime
+	}
+	s.magicLinks = repo
+	s.magicLinkOpts = opts
+}
+
+// MagicLinkRequest asks for a login code by email
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+// MagicLinkVerifyRequest presents a login code
+type MagicLinkVerifyRequest struct {
+	Code string `json:"code" validate:"required,max=128"`
+	// DeviceFingerprint is an optional stable identifier of the client, see LoginRequest
+	DeviceFingerprint string `json:"device_fingerprint,omitempty" validate:"max=256"`
+}
+
+// requireMagicLinks rejects passwordless login when it is not enabled
+func (s *UserService) requireMagicLinks() error {
+	if s.magicLinks == nil {
+		return apperrors.NotFound("MAGIC_LINK_DISABLED", "Passwordless login is not enabled")
+	}
+	return nil
+}
+
+// RequestMagicLink emails a login code to the active user with the email address. Unknown and
+// deactivated addresses are ignored silently, so the answer does not tell whether an account exists.
+func (s *UserService) RequestMagicLink(ctx context.Context, req MagicLinkRequest) error {
+	if err := s.requireMagicLinks(); err != nil {
+		return err
+	}
+	if err := validate.Struct(req); err != nil {
+		return err
+	}
+	user, err := s.repo.GetByEmail(NormalizeEmail(req.Email))
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to get user for magic link")
+		return err
+	}
+	if user == nil || !user.IsActive {
+		s.logger.WithContext(ctx).Debug("Magic link requested for unknown or inactive address")
+		return nil
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	code := base64.RawURLEncoding.EncodeToString(random)
+	now := time.Now()
+	link := &MagicLink{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		CodeHash:  hashMagicLinkCode(code),
+		ExpiresAt: now.Add(s.magicLinkOpts.Lifetime),
+		CreatedAt: now,
+	}
+	if err := s.magicLinks.Create(link); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to store magic link")
+		return err
+	}
+	s.sendMagicLink(ctx, user, link, code)
+	return nil
+}
+
+// sendMagicLink emails code to user. Failures are logged: the answer must not differ from the
+// one for unknown addresses.
+func (s *UserService) sendMagicLink(ctx context.Context, user *User, link *MagicLink, code string) {
+	opts := s.magicLinkOpts
+	logger := s.logger.WithContext(ctx).WithField("user_id", user.ID)
+	loginURL := ""
+	if opts.URL != "" {
+		separator := "?"
+		if strings.Contains(opts.URL, "?") {
+			separator = "&"
+		}
+		loginURL = opts.URL + separator + "code=" + url.QueryEscape(code)
+	}
+	expiresIn := opts.Lifetime.Round(time.Minute).String()
+	text := fmt.Sprintf("Log in with the code %s. It can be used once and expires in %s.", code, expiresIn)
+	if loginURL != "" {
+		text = fmt.Sprintf("Log in at %s or with the code %s. It can be used once and expires in %s.", loginURL, code, expiresIn)
+	}
+	msg := &emailtemplates.Message{Subject: "Your login link", Text: text}
+	if opts.Templates != nil {
+		rendered, err := opts.Templates.Render(emailtemplates.MagicLink, emailtemplates.DefaultLocale, map[string]interface{}{
+			"Name":      user.FirstName,
+			"LoginURL":  loginURL,
+			"Code":      code,
+			"ExpiresIn": expiresIn,
+		})
+		if err == nil {
+			msg = rendered
+		} else {
+			logger.WithError(err).Error("Failed to render magic link template")
+		}
+	}
+	data := map[string]interface{}{
+		"user_id":    user.ID,
+		"email":      user.Email,
+		"expires_at": link.ExpiresAt,
+	}
+	if msg.HTML != "" {
+		data["html"] = msg.HTML
+	}
+	err := opts.Notifier.Notify(ctx, notification.Notification{
+		Type:       MagicLinkEvent,
+		Severity:   notification.SeverityInfo,
+		Subject:    msg.Subject,
+		Message:    msg.Text,
+		Data:       data,
+		OccurredAt: link.CreatedAt,
+	})
+	if err != nil {
+		logger.WithError(err).Error("Failed to send magic link")
+	}
+}
+
+// VerifyMagicLink signs in the user a code was sent to, using it up
+func (s *UserService) VerifyMagicLink(ctx context.Context, req MagicLinkVerifyRequest) (*LoginResponse, error) {
+	if err := s.requireMagicLinks(); err != nil {
+		return nil, err
+	}
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	link, err := s.magicLinks.Consume(hashMagicLinkCode(strings.TrimSpace(req.Code)), time.Now())
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to consume magic link")
+		return nil, err
+	}
+	if link == nil {
+		return nil, errInvalidMagicLink
+	}
+	user, err := s.repo.GetByID(link.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || !user.IsActive {
+		s.logger.WithContext(ctx).WithField("user_id", link.UserID).Warn("Magic link of missing or deactivated user rejected")
+		return nil, errInvalidMagicLink
+	}
+
+	tokens, err := s.magicLinkOpts.Issuer.IssueTokens(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	s.trackRefreshToken(ctx, "", user.KeycloakID, user.Realm, tokens)
+	s.logger.WithContext(ctx).WithField("user_id", user.ID).Info("Logged in with magic link")
+	return &LoginResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		User:         user,
+		sessionID:    tokens.SessionID,
+	}, nil
+}
+
+// hashMagicLinkCode returns the hex SHA-256 a code is stored by
+func hashMagicLinkCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestMagicLinkHandler handles POST /api/users/login/magic-link; it answers 202 whether or
+// not the address belongs to an account
+func RequestMagicLinkHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MagicLinkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+		if !service.allowAccount(w, r, MagicLinkAccountBudget, strings.TrimSpace(req.Email)) {
+			return
+		}
+		if err := service.RequestMagicLink(r.Context(), req); err != nil {
+			writeServiceError(w, err, "Failed to send login link")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "If the address belongs to an account, a login link is on its way"})
+	}
+}
+
+// VerifyMagicLinkHandler handles POST /api/users/login/magic-link/verify
+func VerifyMagicLinkHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req MagicLinkVerifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+
+		ip := httpapi.ClientIP(r)
+		response, err := service.VerifyMagicLink(r.Context(), req)
+		if err != nil {
+			if errors.Is(err, errInvalidMagicLink) {
+				service.authObservers.Notify(r.Context(), authevents.Failure{
+					Kind: authevents.KindLoginFailed,
+					Code: errInvalidMagicLink.Code,
+					IP:   ip,
+					Path: r.URL.Path,
+				})
+			}
+			writeServiceError(w, err, "Login failed")
+			return
+		}
+		service.recordDevice(r.Context(), response.User, response.sessionID, LoginDevice{
+			UserAgent:   r.UserAgent(),
+			Fingerprint: req.DeviceFingerprint,
+			IP:          ip,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -1,22 +1,45 @@
 package user_management
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
+	"base-app/pkg/database"
+	"base-app/pkg/fieldcrypt"
+
 	"github.com/go-playground/validator/v10"
+	"github.com/lib/pq"
 )
 
+// User is a local user record. Fields tagged with perm are only returned to callers holding
+// read_user, or to the user themselves where marked "self".
 type User struct {
 	ID         string    `json:"id" db:"id"`
-	KeycloakID string    `json:"keycloak_id" db:"keycloak_id"`
+	KeycloakID string    `json:"keycloak_id" db:"keycloak_id" perm:"read_user"`
 	Username   string    `json:"username" db:"username" validate:"required,min=3,max=50"`
-	Email      string    `json:"email" db:"email" validate:"required,email"`
+	Email      string    `json:"email" db:"email" validate:"required,email" perm:"read_user,self"`
 	FirstName  string    `json:"first_name" db:"first_name" validate:"required"`
 	LastName   string    `json:"last_name" db:"last_name" validate:"required"`
 	IsActive   bool      `json:"is_active" db:"is_active"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+	// Phone and Attributes are PII and encrypted at rest when a keyring is configured
+	Phone      string            `json:"phone,omitempty" db:"phone" perm:"read_user,self"`
+	Attributes map[string]string `json:"attributes,omitempty" db:"attributes" perm:"read_user,self"`
+	// Realm is the Keycloak realm the user's account lives in
+	Realm string `json:"realm,omitempty" db:"realm"`
+	// PasswordHash is written on creation when the identity provider keeps passwords locally;
+	// it is never read back into a User
+	PasswordHash string `json:"-" db:"password_hash"`
+}
+
+// OwnerID makes a user's own record visible to them in filtered responses
+func (u User) OwnerID() string {
+	return u.ID
 }
 
 type RegisterRequest struct {
@@ -25,6 +48,10 @@ type RegisterRequest struct {
 	FirstName string `json:"first_name" validate:"required"`
 	LastName  string `json:"last_name" validate:"required"`
 	Password  string `json:"password" validate:"required,min=8"`
+	// InviteCode is required while registration is invite-only
+	InviteCode string `json:"invite_code,omitempty" validate:"max=128"`
+	// Realm is the Keycloak realm to create the account in; the primary realm when empty
+	Realm string `json:"realm,omitempty" validate:"max=255"`
 }
 
 var validate *validator.Validate
@@ -38,60 +65,299 @@ type UserRepository interface {
 	GetByID(id string) (*User, error)
 	GetByUsername(username string) (*User, error)
 	GetByEmail(email string) (*User, error)
+	GetByKeycloakID(keycloakID string) (*User, error)
 	Update(user *User) error
+	// Delete removes a user; their group memberships and notes go with them
+	Delete(id string) error
+	// List returns every user, ordered by username
+	List() ([]*User, error)
+	// Each calls fn with every user as it is read, ordered by username, stopping at fn's first error
+	Each(fn func(user *User) error) error
 }
 
 type userRepository struct {
-	db *sql.DB
+	db      *sql.DB
+	reader  database.Querier
+	keyring *fieldcrypt.Keyring
 }
 
 func NewUserRepository(db *sql.DB) UserRepository {
-	return &userRepository{db: db}
+	return &userRepository{db: db, reader: db}
+}
+
+// NewUserRepositoryWithReader creates a user repository that writes to db and sends
+// list queries to reader (typically a *database.Cluster routing to read replicas); single-user
+// lookups stay on db
+func NewUserRepositoryWithReader(db *sql.DB, reader database.Querier) UserRepository {
+	return &userRepository{db: db, reader: reader}
 }
 
+// NewEncryptedUserRepository creates a user repository that encrypts the phone and attributes
+// columns with keyring on write and decrypts them on read. Plaintext values written before
+// encryption was enabled are still read as-is until ReencryptUsers seals them.
+func NewEncryptedUserRepository(db *sql.DB, reader database.Querier, keyring *fieldcrypt.Keyring) UserRepository {
+	return &userRepository{db: db, reader: reader, keyring: keyring}
+}
+
+const userColumns = `id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at, phone, attributes, realm`
+
 func (r *userRepository) Create(user *User) error {
-	query := `INSERT INTO users (id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at)
-	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := r.db.Exec(query, user.ID, user.KeycloakID, user.Username, user.Email, user.FirstName, user.LastName, user.IsActive, user.CreatedAt, user.UpdatedAt)
+	phone, attributes, err := sealPII(r.keyring, user)
+	if err != nil {
+		return err
+	}
+	var passwordHash interface{}
+	if user.PasswordHash != "" {
+		passwordHash = user.PasswordHash
+	}
+	query := `INSERT INTO users (` + userColumns + `, password_hash)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	_, err = r.db.Exec(query, user.ID, user.KeycloakID, user.Username, user.Email, user.FirstName, user.LastName, user.IsActive, user.CreatedAt, user.UpdatedAt, phone, attributes, user.Realm, passwordHash)
 	return err
 }
 
 func (r *userRepository) GetByID(id string) (*User, error) {
-	user := &User{}
-	query := `SELECT id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at
-	          FROM users WHERE id = $1`
-	err := r.db.QueryRow(query, id).Scan(&user.ID, &user.KeycloakID, &user.Username, &user.Email, &user.FirstName, &user.LastName, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	return user, err
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+	return r.getOne(query, id)
 }
 
 func (r *userRepository) GetByUsername(username string) (*User, error) {
-	user := &User{}
-	query := `SELECT id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at
-	          FROM users WHERE username = $1`
-	err := r.db.QueryRow(query, username).Scan(&user.ID, &user.KeycloakID, &user.Username, &user.Email, &user.FirstName, &user.LastName, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(username) = lower($1)`
+	return r.getOne(query, username)
+}
+
+func (r *userRepository) GetByEmail(email string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE lower(email) = lower($1)`
+	return r.getOne(query, email)
+}
+
+func (r *userRepository) GetByKeycloakID(keycloakID string) (*User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE keycloak_id = $1`
+	return r.getOne(query, keycloakID)
+}
+
+func (r *userRepository) List() ([]*User, error) {
+	return database.QueryAll(r.reader, "list users", r.scan, `SELECT `+userColumns+` FROM users ORDER BY username`)
+}
+
+func (r *userRepository) Each(fn func(user *User) error) error {
+	return database.QueryEach(r.reader, "stream users", func(row database.Scanner) error {
+		user, err := r.scan(row)
+		if err != nil {
+			return err
+		}
+		return fn(user)
+	}, `SELECT `+userColumns+` FROM users ORDER BY username`)
+}
+
+// getOne reads one user from the primary: services look users up to update them or to check
+// that a username or email is free, which a lagging replica would get wrong
+func (r *userRepository) getOne(query string, arg interface{}) (*User, error) {
+	user, err := r.scan(r.db.QueryRow(query, arg))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	return user, err
 }
 
-func (r *userRepository) GetByEmail(email string) (*User, error) {
+// scan reads a row of userColumns, decrypting the PII columns
+func (r *userRepository) scan(row database.Scanner) (*User, error) {
 	user := &User{}
-	query := `SELECT id, keycloak_id, username, email, first_name, last_name, is_active, created_at, updated_at
-	          FROM users WHERE email = $1`
-	err := r.db.QueryRow(query, email).Scan(&user.ID, &user.KeycloakID, &user.Username, &user.Email, &user.FirstName, &user.LastName, &user.IsActive, &user.CreatedAt, &user.UpdatedAt)
-	if err == sql.ErrNoRows {
-		return nil, nil
+	var phone, attributes sql.NullString
+	err := row.Scan(&user.ID, &user.KeycloakID, &user.Username, &user.Email, &user.FirstName, &user.LastName, &user.IsActive, &user.CreatedAt, &user.UpdatedAt, &phone, &attributes, &user.Realm)
+	if err != nil {
+		return user, err
 	}
-	return user, err
+	if err := openPII(r.keyring, user, phone.String, attributes.String); err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 func (r *userRepository) Update(user *User) error {
-	query := `UPDATE users SET keycloak_id = $2, username = $3, email = $4, first_name = $5, last_name = $6, is_active = $7, updated_at = $8
+	phone, attributes, err := sealPII(r.keyring, user)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET keycloak_id = $2, username = $3, email = $4, first_name = $5, last_name = $6, is_active = $7, updated_at = $8, phone = $9, attributes = $10
 	          WHERE id = $1`
-	_, err := r.db.Exec(query, user.ID, user.KeycloakID, user.Username, user.Email, user.FirstName, user.LastName, user.IsActive, user.UpdatedAt)
+	_, err = r.db.Exec(query, user.ID, user.KeycloakID, user.Username, user.Email, user.FirstName, user.LastName, user.IsActive, user.UpdatedAt, phone, attributes)
+	return err
+}
+
+func (r *userRepository) Delete(id string) error {
+	_, err := r.db.Exec(`DELETE FROM users WHERE id = $1`, id)
 	return err
 }
+
+// piiAAD binds an encrypted value to its column and row, so ciphertext moved between rows or
+// columns fails to decrypt
+func piiAAD(column, userID string) []byte {
+	return []byte("users." + column + ":" + userID)
+}
+
+// sealPII returns the stored form of the user's phone and attributes: encrypted when keyring is
+// set, NULL when empty
+func sealPII(keyring *fieldcrypt.Keyring, user *User) (phone, attributes sql.NullString, err error) {
+	if user.Phone != "" {
+		phone.String, phone.Valid = user.Phone, true
+	}
+	if len(user.Attributes) > 0 {
+		data, err := json.Marshal(user.Attributes)
+		if err != nil {
+			return phone, attributes, err
+		}
+		attributes.String, attributes.Valid = string(data), true
+	}
+	if keyring == nil {
+		return phone, attributes, nil
+	}
+	if phone.Valid {
+		if phone.String, err = keyring.Encrypt([]byte(phone.String), piiAAD("phone", user.ID)); err != nil {
+			return phone, attributes, err
+		}
+	}
+	if attributes.Valid {
+		if attributes.String, err = keyring.Encrypt([]byte(attributes.String), piiAAD("attributes", user.ID)); err != nil {
+			return phone, attributes, err
+		}
+	}
+	return phone, attributes, nil
+}
+
+// openPII fills the user's phone and attributes from their stored form
+func openPII(keyring *fieldcrypt.Keyring, user *User, phone, attributes string) error {
+	var err error
+	if user.Phone, err = openValue(keyring, phone, piiAAD("phone", user.ID)); err != nil {
+		return fmt.Errorf("decrypt phone of user %s: %w", user.ID, err)
+	}
+	data, err := openValue(keyring, attributes, piiAAD("attributes", user.ID))
+	if err != nil {
+		return fmt.Errorf("decrypt attributes of user %s: %w", user.ID, err)
+	}
+	user.Attributes = nil
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &user.Attributes); err != nil {
+			return fmt.Errorf("decode attributes of user %s: %w", user.ID, err)
+		}
+	}
+	return nil
+}
+
+// openValue decrypts an encrypted value and passes plaintext through unchanged
+func openValue(keyring *fieldcrypt.Keyring, value string, aad []byte) (string, error) {
+	if !fieldcrypt.IsEncrypted(value) {
+		return value, nil
+	}
+	if keyring == nil {
+		return "", fmt.Errorf("value is encrypted with key %q but no keyring is configured", fieldcrypt.KeyID(value))
+	}
+	plaintext, err := keyring.Decrypt(value, aad)
+	return string(plaintext), err
+}
+
+// ReencryptUsers seals every phone and attributes value that is still plaintext or encrypted
+// with a key other than keyring's primary key. It works in batches of batchSize rows and
+// returns the number of rows rewritten. Rows changed concurrently are skipped and picked up
+// by the next run, so it is safe to run while the application serves requests.
+func ReencryptUsers(ctx context.Context, db *sql.DB, keyring *fieldcrypt.Keyring, batchSize int) (int, error) {
+	primaryPrefix := fieldcrypt.KeyPrefix(keyring.PrimaryKeyID()) + "%"
+	query := `SELECT id, phone, attributes FROM users
+	          WHERE id > $1
+	            AND ((phone IS NOT NULL AND phone NOT LIKE $2) OR (attributes IS NOT NULL AND attributes NOT LIKE $2))
+	          ORDER BY id LIMIT $3`
+	type storedPII struct {
+		id                string
+		phone, attributes sql.NullString
+	}
+
+	rewritten := 0
+	after := "00000000-0000-0000-0000-000000000000"
+	for {
+		if err := ctx.Err(); err != nil {
+			return rewritten, err
+		}
+		rows, err := database.QueryAll(db, "list users to re-encrypt", func(row database.Scanner) (storedPII, error) {
+			var stored storedPII
+			err := row.Scan(&stored.id, &stored.phone, &stored.attributes)
+			return stored, err
+		}, query, after, primaryPrefix, batchSize)
+		if err != nil {
+			return rewritten, err
+		}
+
+		for _, stored := range rows {
+			user := &User{ID: stored.id}
+			if err := openPII(keyring, user, stored.phone.String, stored.attributes.String); err != nil {
+				return rewritten, err
+			}
+			phone, attributes, err := sealPII(keyring, user)
+			if err != nil {
+				return rewritten, err
+			}
+			// Only overwrite what was read, so a concurrent profile update is never lost
+			result, err := db.ExecContext(ctx, `UPDATE users SET phone = $2, attributes = $3
+			          WHERE id = $1 AND phone IS NOT DISTINCT FROM $4 AND attributes IS NOT DISTINCT FROM $5`,
+				stored.id, phone, attributes, stored.phone, stored.attributes)
+			if err != nil {
+				return rewritten, fmt.Errorf("re-encrypt user %s: %w", stored.id, err)
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				rewritten++
+			}
+		}
+
+		if len(rows) < batchSize {
+			return rewritten, nil
+		}
+		after = rows[len(rows)-1].id
+	}
+}
+
+// CaseConflict describes users whose username or email only differ by letter case
+type CaseConflict struct {
+	Column  string   `json:"column"`
+	Value   string   `json:"value"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// NormalizeEmail trims and lower-cases an email address for storage and comparison
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// EnsureCaseInsensitiveUniqueness adds lower() unique indexes on users.username and users.email.
+// Existing rows that collide case-insensitively would make index creation fail, so they are
+// detected first and returned; no index is created for a column while conflicts remain.
+func EnsureCaseInsensitiveUniqueness(db *sql.DB) ([]CaseConflict, error) {
+	var conflicts []CaseConflict
+	for _, column := range []string{"username", "email"} {
+		columnConflicts, err := findCaseConflicts(db, column)
+		if err != nil {
+			return nil, err
+		}
+		if len(columnConflicts) > 0 {
+			conflicts = append(conflicts, columnConflicts...)
+			continue
+		}
+
+		index := fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_%s_lower ON users (lower(%s))`, column, column)
+		if _, err := db.Exec(index); err != nil {
+			return nil, fmt.Errorf("create case-insensitive index on users.%s: %w", column, err)
+		}
+	}
+	return conflicts, nil
+}
+
+// findCaseConflicts lists values of column that appear more than once once lower-cased
+func findCaseConflicts(db *sql.DB, column string) ([]CaseConflict, error) {
+	query := fmt.Sprintf(`SELECT lower(%s), array_agg(id::text ORDER BY created_at)
+	          FROM users WHERE %s IS NOT NULL
+	          GROUP BY lower(%s) HAVING COUNT(*) > 1`, column, column, column)
+	op := fmt.Sprintf("detect case conflicts on users.%s", column)
+	return database.QueryAll(db, op, func(row database.Scanner) (CaseConflict, error) {
+		conflict := CaseConflict{Column: column}
+		err := row.Scan(&conflict.Value, pq.Array(&conflict.UserIDs))
+		return conflict, err
+	}, query)
+}
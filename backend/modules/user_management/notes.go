@@ -0,0 +1,181 @@
+package user_management
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"base-app/modules/auth"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// UserNote is a support note administrators keep on a user account. Notes are only served by
+// the manage_user_notes routes and never to the user they are about.
+type UserNote struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	// AuthorID is the Keycloak ID of the administrator who wrote the note
+	AuthorID   string    `json:"author_id"`
+	AuthorName string    `json:"author_name"`
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateUserNoteRequest represents the request to add a note to a user
+type CreateUserNoteRequest struct {
+	Body string `json:"body" validate:"required,max=5000"`
+}
+
+// NoteRepository stores support notes on users
+type NoteRepository interface {
+	Create(note *UserNote) error
+	// ListForUser returns the notes on a user, newest first
+	ListForUser(userID string) ([]*UserNote, error)
+}
+
+type noteRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+// NewNoteRepository creates a note repository that writes to db and reads from reader
+func NewNoteRepository(db *sql.DB, reader database.Querier) NoteRepository {
+	return &noteRepository{db: db, reader: reader}
+}
+
+func (r *noteRepository) Create(note *UserNote) error {
+	query := `INSERT INTO user_notes (id, user_id, author_id, author_name, body, created_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.Exec(query, note.ID, note.UserID, note.AuthorID, note.AuthorName, note.Body, note.CreatedAt)
+	return err
+}
+
+func (r *noteRepository) ListForUser(userID string) ([]*UserNote, error) {
+	query := `SELECT id, user_id, author_id, author_name, body, created_at FROM user_notes
+	          WHERE user_id = $1 ORDER BY created_at DESC`
+	return database.QueryAll(r.reader, "list user notes", func(row database.Scanner) (*UserNote, error) {
+		note := &UserNote{}
+		err := row.Scan(&note.ID, &note.UserID, &note.AuthorID, &note.AuthorName, &note.Body, &note.CreatedAt)
+		return note, err
+	}, query, userID)
+}
+
+// SetNoteRepository enables support notes on users. Set it before serving requests.
+func (s *UserService) SetNoteRepository(notes NoteRepository) {
+	s.notes = notes
+}
+
+// noteSubject returns the user notes are read or written on. Administrators cannot use notes
+// on their own account, so a user never sees what support wrote about them.
+func (s *UserService) noteSubject(ctx context.Context, userID string) (*User, error) {
+	if s.notes == nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	user, err := s.findUser(ctx, "id", userID, s.repo.GetByID)
+	if err != nil {
+		return nil, err
+	}
+	if caller := auth.UserID(ctx); caller == user.KeycloakID || caller == user.ID {
+		return nil, apperrors.Forbidden("OWN_ACCOUNT_NOTES", "Notes on your own account are not available to you")
+	}
+	return user, nil
+}
+
+// CreateUserNote adds a note to a user, written by the caller in ctx
+func (s *UserService) CreateUserNote(ctx context.Context, userID string, req CreateUserNoteRequest) (*UserNote, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	user, err := s.noteSubject(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	authorName := auth.Username(ctx)
+	note := &UserNote{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		AuthorID:   auth.UserID(ctx),
+		AuthorName: authorName,
+		Body:       req.Body,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.notes.Create(note); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to create user note")
+		return nil, err
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":   user.ID,
+		"note_id":   note.ID,
+		"author_id": note.AuthorID,
+	}).Info("User note added")
+	s.audit(ctx, audit.ActionCreate, AuditUserNote, note.ID, nil, note)
+	return note, nil
+}
+
+// ListUserNotes lists the notes on a user, newest first
+func (s *UserService) ListUserNotes(ctx context.Context, userID string) ([]*UserNote, error) {
+	user, err := s.noteSubject(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := s.notes.ListForUser(user.ID)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to list user notes")
+		return nil, err
+	}
+	return notes, nil
+}
+
+// HTTP Handlers
+
+// CreateUserNoteHandler handles POST /api/users/{id}/notes
+func CreateUserNoteHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateUserNoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+
+		note, err := service.CreateUserNote(r.Context(), mux.Vars(r)["id"], req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to add note")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(note)
+	}
+}
+
+// GetUserNotesHandler handles GET /api/users/{id}/notes
+func GetUserNotesHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		notes, err := service.ListUserNotes(r.Context(), mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to list notes")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(notes, page), len(notes), page)
+	}
+}
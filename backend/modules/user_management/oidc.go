@@ -0,0 +1,230 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/outbound"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OIDCConfig configures a generic OpenID Connect identity provider
+type OIDCConfig struct {
+	// IssuerURL is where the provider serves /.well-known/openid-configuration
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+}
+
+// oidcProvider logs users in at any OpenID Connect provider with the resource owner password
+// grant. Accounts are managed at the provider: registration is not available here, profile
+// changes and deactivations are kept locally, and users get a local record at their first
+// login. The API must be able to verify the provider's access tokens.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+	logger *logrus.Logger
+
+	// endpoints are discovered at the first login and kept
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+// oidcEndpoints are the parts of the provider metadata the provider uses
+type oidcEndpoints struct {
+	Token    string `json:"token_endpoint"`
+	UserInfo string `json:"userinfo_endpoint"`
+}
+
+// NewOIDCProvider creates an identity provider for the OpenID Connect server at config.IssuerURL
+func NewOIDCProvider(config OIDCConfig, logger *logrus.Logger) IdentityProvider {
+	return &oidcProvider{config: config, client: outbound.Client(outbound.OIDC), logger: logger}
+}
+
+// oidcUnavailable is the message of failures worth retrying
+const oidcUnavailable = "Identity provider unavailable, try again later"
+
+// discover returns the provider's endpoints, fetching its metadata the first time
+func (p *oidcProvider) discover(ctx context.Context) (*oidcEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	metadataURL := strings.TrimSuffix(p.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints oidcEndpoints
+	if err := p.do(ctx, "discovery", req, &endpoints); err != nil {
+		return nil, err
+	}
+	if endpoints.Token == "" {
+		return nil, apperrors.Internal("IDP_MISCONFIGURED", "Identity provider does not support logins", fmt.Errorf("oidc: no token_endpoint at %s", metadataURL))
+	}
+	p.endpoints = &endpoints
+	return p.endpoints, nil
+}
+
+// do sends req and decodes the JSON answer into v, mapping failures to domain errors
+func (p *oidcProvider) do(ctx context.Context, op string, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.logger.WithContext(ctx).WithError(err).WithField("oidc_op", op).Error("OIDC request failed")
+		return apperrors.Unavailable("IDP_UNAVAILABLE", oidcUnavailable, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	cause := fmt.Errorf("oidc %s failed with status %d", op, resp.StatusCode)
+	entry := p.logger.WithContext(ctx).WithFields(logrus.Fields{"oidc_op": op, "oidc_status": resp.StatusCode})
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		entry.Error("OIDC request failed")
+		return apperrors.Unavailable("IDP_UNAVAILABLE", oidcUnavailable, cause)
+	case (op == "login" || op == "refresh") && (resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized):
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(body, &oauthErr)
+		if oauthErr.Error == "invalid_grant" && op == "refresh" {
+			return errInvalidRefreshToken
+		}
+		if oauthErr.Error == "invalid_grant" {
+			return errInvalidCredentials
+		}
+		entry.WithField("oauth_error", oauthErr.Error).Error("OIDC provider rejected request")
+		return apperrors.Internal("IDP_REQUEST_FAILED", "Identity provider rejected the request", cause)
+	case resp.StatusCode != http.StatusOK:
+		entry.Error("OIDC provider rejected request")
+		return apperrors.Internal("IDP_REQUEST_FAILED", "Identity provider rejected the request", cause)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		entry.WithError(err).Error("Invalid OIDC response")
+		return apperrors.Internal("IDP_REQUEST_FAILED", "Identity provider rejected the request", err)
+	}
+	return nil
+}
+
+func (p *oidcProvider) Login(ctx context.Context, _, username, password string) (*Tokens, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+		"client_id":  {p.config.ClientID},
+		"scope":      {"openid profile email"},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	tokens, err := p.token(ctx, "login", endpoints, form)
+	if err != nil {
+		return nil, err
+	}
+
+	if endpoints.UserInfo == "" {
+		return tokens, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoints.UserInfo, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	var info struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+		GivenName         string `json:"given_name"`
+		FamilyName        string `json:"family_name"`
+	}
+	if err := p.do(ctx, "userinfo", req, &info); err != nil {
+		return nil, err
+	}
+	tokens.Subject = info.Subject
+	tokens.Account = &Account{Username: info.PreferredUsername, Email: info.Email, FirstName: info.GivenName, LastName: info.FamilyName}
+	if tokens.Account.Username == "" {
+		tokens.Account.Username = username
+	}
+	return tokens, nil
+}
+
+// Refresh uses the refresh token grant. The provider does not repeat the user's profile, which
+// the local record already has.
+func (p *oidcProvider) Refresh(ctx context.Context, _, refreshToken string) (*Tokens, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {p.config.ClientID},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	return p.token(ctx, "refresh", endpoints, form)
+}
+
+// token posts form to the token endpoint
+func (p *oidcProvider) token(ctx context.Context, op string, endpoints *oidcEndpoints, form url.Values) (*Tokens, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoints.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		SessionState string `json:"session_state"`
+	}
+	if err := p.do(ctx, op, req, &token); err != nil {
+		return nil, err
+	}
+	return &Tokens{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken, SessionID: token.SessionState}, nil
+}
+
+func (p *oidcProvider) CreateUser(context.Context, string, Account, string) (string, error) {
+	return "", apperrors.Forbidden("REGISTRATION_DISABLED", "Accounts are created at the identity provider")
+}
+
+// UpdateUser keeps profile changes local; the provider's copy is managed there
+func (p *oidcProvider) UpdateUser(context.Context, string, string, Account) error {
+	return nil
+}
+
+// SetEnabled keeps deactivations local; logins of deactivated users are rejected here
+func (p *oidcProvider) SetEnabled(context.Context, string, string, bool) error {
+	return nil
+}
+
+// DeleteUser does nothing, since CreateUser never creates accounts
+func (p *oidcProvider) DeleteUser(context.Context, string, string) error {
+	return nil
+}
+
+// LogoutSession does nothing: OpenID Connect has no API to end another client's sessions, so
+// they last until their tokens expire or are revoked here
+func (p *oidcProvider) LogoutSession(context.Context, string, string) error {
+	return nil
+}
+
+// LogoutAllSessions does nothing, like LogoutSession
+func (p *oidcProvider) LogoutAllSessions(context.Context, string, string) error {
+	return nil
+}
@@ -0,0 +1,235 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"base-app/modules/auth"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Passkeys are WebAuthn credentials held by Keycloak. Registration needs the browser to talk to
+// Keycloak directly, so it is started with an application-initiated action: the browser is sent
+// to Keycloak's authorization endpoint with kc_action set, registers the authenticator there and
+// returns to PasskeyRedirectURL. Listing and deleting go through the admin API, so users never
+// need the Keycloak account console.
+
+// Keycloak credential types of WebAuthn authenticators
+const (
+	// CredentialPasskey signs in without a password
+	CredentialPasskey = "webauthn-passwordless"
+	// CredentialSecurityKey is a second factor after the password
+	CredentialSecurityKey = "webauthn"
+)
+
+// passkeyActions maps the registration kinds callers ask for to Keycloak required actions
+var passkeyActions = map[string]string{
+	"passkey":      "webauthn-register-passwordless",
+	"security_key": "webauthn-register",
+}
+
+// Passkey is a WebAuthn credential of a user
+type Passkey struct {
+	ID string `json:"id"`
+	// Type is CredentialPasskey or CredentialSecurityKey
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PasskeyRegistration is where to send the browser to register an authenticator
+type PasskeyRegistration struct {
+	Kind string `json:"kind"`
+	URL  string `json:"url"`
+}
+
+var errPasskeyNotFound = apperrors.NotFound("PASSKEY_NOT_FOUND", "Passkey not found")
+
+// isPasskey reports whether a Keycloak credential type is a WebAuthn authenticator
+func isPasskey(credentialType string) bool {
+	return credentialType == CredentialPasskey || credentialType == CredentialSecurityKey
+}
+
+// credentials lists the Keycloak credentials of the user with the given Keycloak ID
+func (s *UserService) credentials(ctx context.Context, token, realm, userID string) ([]*gocloak.CredentialRepresentation, error) {
+	credentials, err := s.keycloak.GetCredentials(ctx, token, realm, userID)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "list credentials", err)
+	}
+	return credentials, nil
+}
+
+// Passkeys lists the WebAuthn credentials of the user with the given Keycloak ID
+func (s *UserService) Passkeys(ctx context.Context, userID string) ([]Passkey, error) {
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := s.keycloak.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "admin login", err)
+	}
+	credentials, err := s.credentials(ctx, token.AccessToken, cfg.Realm, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys := []Passkey{}
+	for _, credential := range credentials {
+		if !isPasskey(gocloak.PString(credential.Type)) {
+			continue
+		}
+		passkey := Passkey{
+			ID:    gocloak.PString(credential.ID),
+			Type:  gocloak.PString(credential.Type),
+			Label: gocloak.PString(credential.UserLabel),
+		}
+		if credential.CreatedDate != nil {
+			passkey.CreatedAt = time.UnixMilli(*credential.CreatedDate).UTC()
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, nil
+}
+
+// StartPasskeyRegistration returns the Keycloak URL that registers an authenticator of kind
+// ("passkey" or "security_key") for the caller logged in with session
+func (s *UserService) StartPasskeyRegistration(ctx context.Context, userID string, session rbac.Session, kind string) (*PasskeyRegistration, error) {
+	if kind == "" {
+		kind = "passkey"
+	}
+	action, ok := passkeyActions[kind]
+	if !ok {
+		return nil, apperrors.Invalid("INVALID_PASSKEY_KIND", "kind must be passkey or security_key")
+	}
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PasskeyRedirectURL == "" {
+		return nil, apperrors.Internal("PASSKEYS_NOT_CONFIGURED", "Passkey registration is not configured", nil)
+	}
+	if session.ClientID == "" {
+		return nil, apperrors.Invalid("SESSION_REQUIRED", "Registering a passkey requires a token from an interactive login")
+	}
+
+	query := url.Values{
+		"client_id":     {session.ClientID},
+		"redirect_uri":  {cfg.PasskeyRedirectURL},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+		"kc_action":     {action},
+	}
+	registration := strings.TrimRight(cfg.URL, "/") + "/realms/" + url.PathEscape(cfg.Realm) +
+		"/protocol/openid-connect/auth?" + query.Encode()
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id": userID,
+		"kind":    kind,
+	}).Info("Passkey registration started")
+	return &PasskeyRegistration{Kind: kind, URL: registration}, nil
+}
+
+// DeletePasskey removes a WebAuthn credential of the user. Other credentials cannot be deleted
+// this way, and a user's last way to sign in is kept.
+func (s *UserService) DeletePasskey(ctx context.Context, userID, credentialID string) error {
+	cfg, err := s.callerKeycloakConfig(ctx)
+	if err != nil {
+		return err
+	}
+	token, err := s.keycloak.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return s.keycloakError(ctx, "admin login", err)
+	}
+	credentials, err := s.credentials(ctx, token.AccessToken, cfg.Realm, userID)
+	if err != nil {
+		return err
+	}
+
+	var target *gocloak.CredentialRepresentation
+	signIns := 0
+	for _, credential := range credentials {
+		credentialType := gocloak.PString(credential.Type)
+		if gocloak.PString(credential.ID) == credentialID && isPasskey(credentialType) {
+			target = credential
+			continue
+		}
+		if credentialType == "password" || credentialType == CredentialPasskey {
+			signIns++
+		}
+	}
+	if target == nil {
+		return errPasskeyNotFound
+	}
+
+	if gocloak.PString(target.Type) == CredentialPasskey && signIns == 0 {
+		identities, err := s.linkedIdentities(ctx, token.AccessToken, cfg.Realm, userID)
+		if err != nil {
+			return err
+		}
+		if len(identities) == 0 {
+			return apperrors.Conflict("LAST_LOGIN_METHOD", "Set a password before deleting your only passkey")
+		}
+	}
+
+	if err := s.keycloak.DeleteCredentials(ctx, token.AccessToken, cfg.Realm, userID, credentialID); err != nil {
+		return s.keycloakError(ctx, "delete credential", err)
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":       userID,
+		"credential_id": credentialID,
+	}).Info("Passkey deleted")
+	return nil
+}
+
+// HTTP Handlers
+
+// GetPasskeysHandler handles GET /api/users/me/passkeys
+func GetPasskeysHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passkeys, err := service.Passkeys(r.Context(), auth.UserID(r.Context()))
+		if err != nil {
+			writeServiceError(w, err, "Failed to list passkeys")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"passkeys": passkeys})
+	}
+}
+
+// StartPasskeyRegistrationHandler handles POST /api/users/me/passkeys/register?kind=passkey|security_key
+func StartPasskeyRegistrationHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		registration, err := service.StartPasskeyRegistration(r.Context(), auth.UserID(r.Context()),
+			auth.SessionFromContext(r.Context()), r.URL.Query().Get("kind"))
+		if err != nil {
+			writeServiceError(w, err, "Failed to start passkey registration")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registration)
+	}
+}
+
+// DeletePasskeyHandler handles DELETE /api/users/me/passkeys/{id}
+func DeletePasskeyHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeletePasskey(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete passkey")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,493 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"base-app/modules/auth"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/dberrors"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jobs"
+	"base-app/pkg/labels"
+	"base-app/pkg/quota"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Users are imported from and exported to the users part of Keycloak's realm export format, so
+// they can be moved between realms and environments with kc.sh export/import on either side.
+
+// PhoneAttribute is the Keycloak user attribute holding the local phone number
+const PhoneAttribute = "phoneNumber"
+
+// Kinds of the operations started by imports and exports with "Prefer: respond-async"
+const (
+	OperationImportUsers = "users.import"
+	OperationExportUsers = "users.export"
+)
+
+// MaxImportUsers bounds the users one import request may carry
+const MaxImportUsers = 500
+
+// maxImportBodyBytes bounds the size of an import request body
+const maxImportBodyBytes = 10 << 20
+
+// RealmUsersFile is a Keycloak realm export, either a full realm file or one of the
+// <realm>-users-N.json files kc.sh export writes. Only the realm name and users are read.
+type RealmUsersFile struct {
+	Realm string         `json:"realm,omitempty"`
+	Users []gocloak.User `json:"users"`
+}
+
+// Statuses of a user in an import
+const (
+	ImportCreated = "created"
+	// ImportExisting marks a user whose username or email already belongs to a local user
+	ImportExisting = "exists"
+	// ImportSkipped marks a service account user; those belong to their client
+	ImportSkipped = "skipped"
+	ImportFailed  = "failed"
+)
+
+// ImportUserResult is the outcome of one user of an import, in file order
+type ImportUserResult struct {
+	Index    int    `json:"index"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+	UserID   string `json:"user_id,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// UnknownGroups are groups of the user no local role group is named after
+	UnknownGroups []string `json:"unknown_groups,omitempty"`
+}
+
+// ImportUsersResult summarizes an import. Users are imported one by one, so a failed user does
+// not undo the others.
+type ImportUsersResult struct {
+	Created  int                `json:"created"`
+	Existing int                `json:"existing"`
+	Skipped  int                `json:"skipped"`
+	Failed   int                `json:"failed"`
+	Results  []ImportUserResult `json:"results"`
+}
+
+// ImportUsers creates the users of a Keycloak realm export in Keycloak and locally. Hashed
+// password credentials and attributes are carried over as they are; the user's groups are mapped
+// to the local role groups of the same name (the last segment of the group path). Users whose
+// username or email is already taken are left alone.
+func (s *UserService) ImportUsers(ctx context.Context, file RealmUsersFile) (*ImportUsersResult, error) {
+	if err := s.requireKeycloak(); err != nil {
+		return nil, err
+	}
+	if len(file.Users) == 0 {
+		return nil, apperrors.Invalid("EMPTY_IMPORT", "The file contains no users")
+	}
+	if len(file.Users) > MaxImportUsers {
+		return nil, apperrors.Invalid("IMPORT_TOO_LARGE", fmt.Sprintf("At most %d users can be imported at once", MaxImportUsers))
+	}
+
+	cfg := s.keycloakConfig()
+	token, err := s.keycloak.LoginAdmin(ctx, cfg.AdminUsername, cfg.AdminPassword, cfg.Realm)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "admin login", err)
+	}
+
+	result := &ImportUsersResult{Results: make([]ImportUserResult, len(file.Users))}
+	for i, exported := range file.Users {
+		item := s.importUser(ctx, token.AccessToken, cfg.Realm, exported)
+		item.Index = i
+		switch item.Status {
+		case ImportCreated:
+			result.Created++
+		case ImportExisting:
+			result.Existing++
+		case ImportSkipped:
+			result.Skipped++
+		default:
+			result.Failed++
+		}
+		result.Results[i] = item
+		jobs.ReportProgress(ctx, i+1, len(file.Users))
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"source_realm": file.Realm,
+		"created":      result.Created,
+		"existing":     result.Existing,
+		"skipped":      result.Skipped,
+		"failed":       result.Failed,
+	}).Info("Users imported")
+	return result, nil
+}
+
+// importUser imports one exported user with the admin token
+func (s *UserService) importUser(ctx context.Context, token, realm string, exported gocloak.User) ImportUserResult {
+	result := ImportUserResult{Username: gocloak.PString(exported.Username)}
+	if exported.ServiceAccountClientID != nil {
+		result.Status = ImportSkipped
+		return result
+	}
+
+	user, err := localUserFromKeycloak(exported)
+	if err != nil {
+		return importFailure(result, err)
+	}
+	user.Realm = realm
+	result.Username = user.Username
+	if existing, _ := s.repo.GetByUsername(user.Username); existing != nil {
+		result.Status, result.UserID = ImportExisting, existing.ID
+		return result
+	}
+	if existing, _ := s.repo.GetByEmail(user.Email); existing != nil {
+		result.Status, result.UserID = ImportExisting, existing.ID
+		return result
+	}
+	if s.quotas != nil {
+		if err := s.quotas.Check(ctx, quota.Users); err != nil {
+			return importFailure(result, err)
+		}
+	}
+
+	keycloakID, err := s.keycloak.CreateUser(ctx, token, realm, keycloakImportUser(exported, user))
+	if err != nil {
+		return importFailure(result, s.keycloakError(ctx, "import user", err))
+	}
+	user.KeycloakID = keycloakID
+	if err := s.repo.Create(user); err != nil {
+		if delErr := s.keycloak.DeleteUser(ctx, token, realm, keycloakID); delErr != nil {
+			s.logger.WithContext(ctx).WithError(delErr).WithField("keycloak_id", keycloakID).Error("Failed to delete orphaned Keycloak user")
+		}
+		if field, ok := dberrors.UniqueViolationField(err, userUniqueConstraints); ok {
+			return importFailure(result, takenError(field))
+		}
+		s.logger.WithContext(ctx).WithError(err).WithField("username", user.Username).Error("Failed to create imported user locally")
+		return importFailure(result, err)
+	}
+	result.Status, result.UserID = ImportCreated, user.ID
+	s.audit(ctx, audit.ActionCreate, AuditUser, user.ID, nil, user)
+
+	// Memberships are best effort, like at registration; unknown groups are reported
+	if s.groups != nil {
+		if names := groupNames(exported.Groups); len(names) > 0 {
+			_, unknown, err := s.groups.JoinGroupsByName(ctx, keycloakID, names)
+			if err != nil {
+				s.logger.WithContext(ctx).WithError(err).WithField("user_id", user.ID).Warn("Failed to assign imported user to groups")
+			}
+			result.UnknownGroups = unknown
+		}
+		if _, err := s.groups.ApplyDomainRules(ctx, keycloakID, user.Email); err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("user_id", user.ID).Warn("Failed to assign groups by email domain")
+		}
+	}
+	return result
+}
+
+// importFailure marks result failed with the code and message of err. Unexpected errors get a
+// generic message; they are logged where they occur.
+func importFailure(result ImportUserResult, err error) ImportUserResult {
+	result.Status = ImportFailed
+	var fieldErrs validator.ValidationErrors
+	if appErr, ok := apperrors.As(err); ok {
+		result.Code, result.Error = appErr.Code, appErr.Message
+	} else if errors.As(err, &fieldErrs) {
+		details := httpapi.ValidationDetails(fieldErrs, httpapi.ValidationMessage)
+		fields := make([]string, 0, len(details))
+		for field, message := range details {
+			fields = append(fields, field+": "+message)
+		}
+		sort.Strings(fields)
+		result.Code, result.Error = "VALIDATION_ERROR", strings.Join(fields, "; ")
+	} else {
+		result.Code, result.Error = "IMPORT_FAILED", "Failed to import user"
+	}
+	return result
+}
+
+// localUserFromKeycloak builds the local record of an exported user and validates it like a
+// registration. Multi-valued attributes keep their first value.
+func localUserFromKeycloak(exported gocloak.User) (*User, error) {
+	now := time.Now()
+	user := &User{
+		ID:        uuid.New().String(),
+		Username:  strings.TrimSpace(gocloak.PString(exported.Username)),
+		Email:     NormalizeEmail(gocloak.PString(exported.Email)),
+		FirstName: gocloak.PString(exported.FirstName),
+		LastName:  gocloak.PString(exported.LastName),
+		IsActive:  gocloak.PBool(exported.Enabled),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if exported.CreatedTimestamp != nil {
+		user.CreatedAt = time.UnixMilli(*exported.CreatedTimestamp)
+	}
+	if exported.Attributes != nil {
+		for name, values := range *exported.Attributes {
+			if len(values) == 0 {
+				continue
+			}
+			if name == PhoneAttribute {
+				user.Phone = values[0]
+				continue
+			}
+			if user.Attributes == nil {
+				user.Attributes = make(map[string]string)
+			}
+			user.Attributes[name] = values[0]
+		}
+	}
+
+	if err := validate.Struct(user); err != nil {
+		return nil, err
+	}
+	profile := ProfileUpdateRequest{FirstName: user.FirstName, LastName: user.LastName, Email: user.Email, Phone: user.Phone, Attributes: user.Attributes}
+	if err := validate.Struct(profile); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// keycloakImportUser is the representation to create an exported user with in this realm. IDs,
+// links and role mappings belong to the source realm and are dropped; groups are mapped locally.
+func keycloakImportUser(exported gocloak.User, user *User) gocloak.User {
+	rep := gocloak.User{
+		Username:        &user.Username,
+		Email:           &user.Email,
+		EmailVerified:   exported.EmailVerified,
+		FirstName:       &user.FirstName,
+		LastName:        &user.LastName,
+		Enabled:         gocloak.BoolP(user.IsActive),
+		Totp:            exported.Totp,
+		Attributes:      exported.Attributes,
+		RequiredActions: exported.RequiredActions,
+	}
+	if exported.Credentials != nil {
+		credentials := make([]gocloak.CredentialRepresentation, len(*exported.Credentials))
+		for i, credential := range *exported.Credentials {
+			credential.ID = nil
+			credentials[i] = credential
+		}
+		rep.Credentials = &credentials
+	}
+	return rep
+}
+
+// groupNames returns the local group names of Keycloak group paths such as /staff/engineering
+func groupNames(paths *[]string) []string {
+	if paths == nil {
+		return nil
+	}
+	names := make([]string, 0, len(*paths))
+	for _, path := range *paths {
+		if name := path[strings.LastIndex(path, "/")+1:]; name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ExportUsers returns every local user in Keycloak's realm export format, with their role groups
+// as group paths. Credentials stay in Keycloak and are not exported, so imported copies need a
+// password reset unless the realm itself is exported too. With selectors, only the users whose
+// labels match every selector are exported.
+func (s *UserService) ExportUsers(ctx context.Context, selectors ...labels.Selector) (*RealmUsersFile, error) {
+	users, err := s.repo.List()
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to list users for export")
+		return nil, err
+	}
+	matching, err := s.exportMatching(ctx, selectors)
+	if err != nil {
+		return nil, err
+	}
+	if matching != nil {
+		users = labels.Filter(users, func(user *User) string { return user.ID }, matching)
+	}
+
+	file := &RealmUsersFile{Realm: s.keycloakConfig().Realm, Users: make([]gocloak.User, len(users))}
+	for i, user := range users {
+		if file.Users[i], err = s.exportUser(ctx, user); err != nil {
+			return nil, err
+		}
+		jobs.ReportProgress(ctx, i+1, len(users))
+	}
+
+	s.logger.WithContext(ctx).WithField("users", len(users)).Info("Users exported")
+	return file, nil
+}
+
+// StreamExportUsers exports the users like ExportUsers, calling fn with each one as it is read so
+// the realm file never has to be held in memory, and returns the number exported
+func (s *UserService) StreamExportUsers(ctx context.Context, fn func(user gocloak.User) error, selectors ...labels.Selector) (int, error) {
+	matching, err := s.exportMatching(ctx, selectors)
+	if err != nil {
+		return 0, err
+	}
+	exported := 0
+	err = s.repo.Each(func(user *User) error {
+		if matching != nil && !matching[user.ID] {
+			return nil
+		}
+		rep, err := s.exportUser(ctx, user)
+		if err != nil {
+			return err
+		}
+		exported++
+		return fn(rep)
+	})
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to stream users for export")
+		return exported, err
+	}
+
+	s.logger.WithContext(ctx).WithField("users", exported).Info("Users exported")
+	return exported, nil
+}
+
+// exportMatching returns the IDs of the users matching selectors, or nil when there are none
+func (s *UserService) exportMatching(ctx context.Context, selectors []labels.Selector) (map[string]bool, error) {
+	if len(selectors) == 0 {
+		return nil, nil
+	}
+	if s.labels == nil {
+		return nil, apperrors.Invalid("LABELS_UNAVAILABLE", "Label filters are not available")
+	}
+	matching, err := s.labels.Matching(labels.KindUser, selectors)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to match user labels for export")
+		return nil, err
+	}
+	return matching, nil
+}
+
+// exportUser is user in Keycloak's format with their role groups as group paths
+func (s *UserService) exportUser(ctx context.Context, user *User) (gocloak.User, error) {
+	rep := keycloakExportUser(user)
+	if s.groups != nil && user.KeycloakID != "" {
+		names, err := s.groups.UserGroupNames(user.KeycloakID)
+		if err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithField("user_id", user.ID).Error("Failed to list groups for export")
+			return rep, err
+		}
+		paths := make([]string, len(names))
+		for j, name := range names {
+			paths[j] = "/" + name
+		}
+		rep.Groups = &paths
+	}
+	return rep, nil
+}
+
+// keycloakExportUser is the Keycloak representation of a local user
+func keycloakExportUser(user *User) gocloak.User {
+	rep := gocloak.User{
+		CreatedTimestamp: gocloak.Int64P(user.CreatedAt.UnixMilli()),
+		Username:         gocloak.StringP(user.Username),
+		Email:            gocloak.StringP(user.Email),
+		FirstName:        gocloak.StringP(user.FirstName),
+		LastName:         gocloak.StringP(user.LastName),
+		Enabled:          gocloak.BoolP(user.IsActive),
+	}
+	if user.KeycloakID != "" {
+		rep.ID = gocloak.StringP(user.KeycloakID)
+	}
+	attributes := make(map[string][]string, len(user.Attributes)+1)
+	for name, value := range user.Attributes {
+		attributes[name] = []string{value}
+	}
+	if user.Phone != "" {
+		attributes[PhoneAttribute] = []string{user.Phone}
+	}
+	if len(attributes) > 0 {
+		rep.Attributes = &attributes
+	}
+	return rep
+}
+
+// ImportUsersHandler handles POST /api/users/import with a Keycloak realm export as the body.
+// With "Prefer: respond-async" it answers 202 and imports the users as an operation.
+func ImportUsersHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var file RealmUsersFile
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBodyBytes)).Decode(&file); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+
+		if jobs.WantsAsync(r) && service.jobs != nil {
+			op, err := service.jobs.Submit(r.Context(), OperationImportUsers, auth.UserID(r.Context()), func(ctx context.Context) (interface{}, error) {
+				return service.ImportUsers(ctx, file)
+			})
+			if err != nil {
+				writeServiceError(w, err, "Import failed")
+				return
+			}
+			jobs.WriteAccepted(w, op)
+			return
+		}
+
+		result, err := service.ImportUsers(r.Context(), file)
+		if err != nil {
+			writeServiceError(w, err, "Import failed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// ExportUsersHandler handles GET /api/users/export, streaming the users as <realm>-users-0.json
+// like kc.sh export names its files. ?label=key:value exports only the matching users. With
+// "Prefer: respond-async" it answers 202 and the file becomes the operation's result.
+func ExportUsersHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selectors, err := labels.ParseSelectors(r)
+		if err != nil {
+			writeServiceError(w, err, "Invalid label filter")
+			return
+		}
+
+		if jobs.WantsAsync(r) && service.jobs != nil {
+			op, err := service.jobs.Submit(r.Context(), OperationExportUsers, auth.UserID(r.Context()), func(ctx context.Context) (interface{}, error) {
+				return service.ExportUsers(ctx, selectors...)
+			})
+			if err != nil {
+				writeServiceError(w, err, "Export failed")
+				return
+			}
+			jobs.WriteAccepted(w, op)
+			return
+		}
+
+		// Stream the users as they are read so a large realm never has to fit in memory
+		realm := service.keycloakConfig().Realm
+		stream := httpapi.NewArrayStream(w, "users")
+		if realm != "" {
+			stream.WithField("realm", realm)
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-users-0.json"`, realm))
+		_, err = service.StreamExportUsers(r.Context(), func(user gocloak.User) error {
+			return stream.Write(user)
+		}, selectors...)
+		if err != nil {
+			if !stream.Started() {
+				w.Header().Del("Content-Disposition")
+				writeServiceError(w, err, "Export failed")
+			}
+			// Leave a partially streamed file unterminated so it can't be mistaken for a complete one
+			return
+		}
+		stream.Close()
+	}
+}
@@ -0,0 +1,303 @@
+package user_management
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/authevents"
+	"base-app/pkg/database"
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RefreshPath is where clients exchange a refresh token for new tokens
+const RefreshPath = "/api/users/refresh"
+
+// RefreshTokenRetention is how long issued refresh tokens are remembered. It must cover the
+// longest refresh token lifetime, or reuse of an older token goes unnoticed.
+const RefreshTokenRetention = 30 * 24 * time.Hour
+
+var (
+	errInvalidRefreshToken = apperrors.Unauthorized("INVALID_REFRESH_TOKEN", "Invalid or expired refresh token")
+	errRefreshTokenReused  = apperrors.Unauthorized("REFRESH_TOKEN_REUSED", "Refresh token was already used; log in again")
+)
+
+// RefreshToken is a refresh token issued to a client. Every login starts a family; each refresh
+// rotates the presented token and adds its successor to the family. A rotated token presented
+// again means two parties hold the family, so it is revoked as a whole.
+type RefreshToken struct {
+	// Hash is the SHA-256 of the token; tokens themselves are not stored
+	Hash     string
+	FamilyID string
+	// UserID is the Keycloak ID of the user, when known
+	UserID    string
+	Realm     string
+	SessionID string
+	IssuedAt  time.Time
+	RotatedAt *time.Time
+	RevokedAt *time.Time
+}
+
+// RefreshTokenRepository remembers issued refresh tokens by their hash
+type RefreshTokenRepository interface {
+	Create(token *RefreshToken) error
+	// GetByHash returns the token with hash, or nil
+	GetByHash(hash string) (*RefreshToken, error)
+	// Rotate marks the token with hash as used and reports false when it already was, or was revoked
+	Rotate(hash string, at time.Time) (bool, error)
+	// RevokeFamily revokes every token of a family and returns the sessions they belong to
+	RevokeFamily(familyID string, at time.Time) ([]string, error)
+	// DeleteIssuedBefore forgets tokens issued before the given time
+	DeleteIssuedBefore(before time.Time) (int64, error)
+}
+
+type refreshTokenRepository struct {
+	db database.DBTX
+}
+
+// NewRefreshTokenRepository creates a refresh token repository. Reads go to the primary, since
+// a token is usually presented moments after it was issued.
+func NewRefreshTokenRepository(db *sql.DB) RefreshTokenRepository {
+	return &refreshTokenRepository{db: db}
+}
+
+func (r *refreshTokenRepository) Create(token *RefreshToken) error {
+	query := `INSERT INTO refresh_tokens (token_hash, family_id, user_id, realm, session_id, issued_at) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := r.db.Exec(query, token.Hash, token.FamilyID, token.UserID, token.Realm, token.SessionID, token.IssuedAt)
+	return err
+}
+
+func (r *refreshTokenRepository) GetByHash(hash string) (*RefreshToken, error) {
+	token := &RefreshToken{}
+	err := r.db.QueryRow(`SELECT token_hash, family_id, user_id, realm, session_id, issued_at, rotated_at, revoked_at FROM refresh_tokens WHERE token_hash = $1`, hash).
+		Scan(&token.Hash, &token.FamilyID, &token.UserID, &token.Realm, &token.SessionID, &token.IssuedAt, &token.RotatedAt, &token.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return token, err
+}
+
+func (r *refreshTokenRepository) Rotate(hash string, at time.Time) (bool, error) {
+	result, err := r.db.Exec(`UPDATE refresh_tokens SET rotated_at = $2 WHERE token_hash = $1 AND rotated_at IS NULL AND revoked_at IS NULL`, hash, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (r *refreshTokenRepository) RevokeFamily(familyID string, at time.Time) ([]string, error) {
+	return database.QueryAll(r.db, "revoke refresh token family", func(row database.Scanner) (string, error) {
+		var sessionID string
+		err := row.Scan(&sessionID)
+		return sessionID, err
+	}, `UPDATE refresh_tokens SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL RETURNING session_id`, familyID, at)
+}
+
+func (r *refreshTokenRepository) DeleteIssuedBefore(before time.Time) (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM refresh_tokens WHERE issued_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetRefreshTokenTracking remembers the refresh tokens issued at login and refresh in tokens, so
+// that reuse of a rotated token revokes its family. Set it before serving requests.
+func (s *UserService) SetRefreshTokenTracking(tokens RefreshTokenRepository) {
+	s.refreshTokens = tokens
+}
+
+// hashRefreshToken returns the hex SHA-256 a refresh token is remembered by
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// trackRefreshToken remembers a newly issued refresh token as a member of familyID, or of a new
+// family when familyID is empty. Failures are logged: the tokens have already been issued.
+func (s *UserService) trackRefreshToken(ctx context.Context, familyID, userID, realm string, tokens *Tokens) {
+	if s.refreshTokens == nil || tokens.RefreshToken == "" {
+		return
+	}
+	if familyID == "" {
+		familyID = uuid.New().String()
+	}
+	err := s.refreshTokens.Create(&RefreshToken{
+		Hash:      hashRefreshToken(tokens.RefreshToken),
+		FamilyID:  familyID,
+		UserID:    userID,
+		Realm:     realm,
+		SessionID: tokens.SessionID,
+		IssuedAt:  time.Now(),
+	})
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("user_id", userID).Error("Failed to record refresh token")
+	}
+}
+
+// RefreshRequest represents the request to exchange a refresh token for new tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required,max=8192"`
+	// Realm is the Keycloak realm the token was issued by; the primary realm when empty
+	Realm string `json:"realm,omitempty" validate:"max=255"`
+}
+
+// RefreshResponse carries the tokens that replace the presented refresh token
+type RefreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshSession exchanges a refresh token for new tokens at the identity provider. A token
+// that was already rotated revokes its whole family: the sessions it belongs to are ended, so
+// neither the thief nor the user can refresh again, and a KindRefreshTokenReuse event reports
+// the incident. Access tokens already issued last until they expire. ip is the caller's address
+// for the event.
+func (s *UserService) RefreshSession(ctx context.Context, req RefreshRequest, ip string) (*RefreshResponse, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+
+	var known *RefreshToken
+	hash := hashRefreshToken(req.RefreshToken)
+	if s.refreshTokens != nil {
+		var err error
+		if known, err = s.refreshTokens.GetByHash(hash); err != nil {
+			s.logger.WithContext(ctx).WithError(err).Error("Failed to look up refresh token")
+			return nil, err
+		}
+	}
+	realm := req.Realm
+	if known != nil {
+		if known.RevokedAt != nil {
+			return nil, errInvalidRefreshToken
+		}
+		if known.RotatedAt != nil {
+			return nil, s.refreshTokenReused(ctx, known, ip)
+		}
+		realm = known.Realm
+	}
+
+	cfg, err := s.realmConfig(realm)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := s.identity.Refresh(ctx, cfg.Realm, req.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued before tracking started begin a family now
+	if known == nil {
+		s.trackRefreshToken(ctx, "", tokens.Subject, cfg.Realm, tokens)
+		return &RefreshResponse{AccessToken: tokens.AccessToken, RefreshToken: tokens.RefreshToken}, nil
+	}
+	rotated, err := s.refreshTokens.Rotate(hash, time.Now())
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to rotate refresh token")
+		return nil, err
+	}
+	if !rotated {
+		// Another request rotated the token while this one was at the provider
+		return nil, s.refreshTokenReused(ctx, known, ip)
+	}
+	s.trackRefreshToken(ctx, known.FamilyID, known.UserID, cfg.Realm, tokens)
+	return &RefreshResponse{AccessToken: tokens.AccessToken, RefreshToken: tokens.RefreshToken}, nil
+}
+
+// refreshTokenReused revokes the family of a reused refresh token, ends its sessions and reports
+// the incident; it returns the error to answer the request with
+func (s *UserService) refreshTokenReused(ctx context.Context, token *RefreshToken, ip string) error {
+	logger := s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": token.UserID, "family_id": token.FamilyID})
+	logger.Warn("Rotated refresh token reused, revoking its family")
+
+	sessions, err := s.refreshTokens.RevokeFamily(token.FamilyID, time.Now())
+	if err != nil {
+		logger.WithError(err).Error("Failed to revoke refresh token family")
+	}
+	ended := make(map[string]bool)
+	for _, sessionID := range append(sessions, token.SessionID) {
+		if sessionID == "" || ended[sessionID] {
+			continue
+		}
+		ended[sessionID] = true
+		if err := s.identity.LogoutSession(ctx, token.Realm, sessionID); err != nil {
+			logger.WithError(err).WithField("session_id", sessionID).Error("Failed to end session of reused refresh token")
+		}
+	}
+
+	s.authObservers.Notify(ctx, authevents.Failure{
+		Kind:   authevents.KindRefreshTokenReuse,
+		Code:   errRefreshTokenReused.Code,
+		UserID: token.UserID,
+		IP:     ip,
+		Path:   RefreshPath,
+	})
+	return errRefreshTokenReused
+}
+
+// CleanupRefreshTokens forgets refresh tokens older than RefreshTokenRetention
+func (s *UserService) CleanupRefreshTokens(ctx context.Context) error {
+	if s.refreshTokens == nil {
+		return nil
+	}
+	n, err := s.refreshTokens.DeleteIssuedBefore(time.Now().Add(-RefreshTokenRetention))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		s.logger.WithContext(ctx).WithField("tokens", n).Info("Forgot expired refresh tokens")
+	}
+	return nil
+}
+
+// StartRefreshTokenCleanup runs CleanupRefreshTokens every interval until ctx is cancelled
+func (s *UserService) StartRefreshTokenCleanup(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.CleanupRefreshTokens(ctx); err != nil {
+					s.logger.WithError(err).Error("Failed to clean up refresh tokens")
+				}
+			}
+		}
+	}()
+}
+
+// HTTP Handlers
+
+// RefreshHandler handles POST /api/users/refresh
+func RefreshHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+		req.RefreshToken = strings.TrimSpace(req.RefreshToken)
+
+		response, err := service.RefreshSession(r.Context(), req, httpapi.ClientIP(r))
+		if err != nil {
+			writeServiceError(w, err, "Token refresh failed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
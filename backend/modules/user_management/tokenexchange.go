@@ -0,0 +1,146 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"base-app/modules/auth"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/perm"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/sirupsen/logrus"
+)
+
+// TokenExchangePath is where callers exchange their token for one to call a downstream API with
+const TokenExchangePath = "/api/auth/token-exchange"
+
+// ExchangePolicy lets callers obtain tokens for one downstream audience
+type ExchangePolicy struct {
+	// Audience is the Keycloak client ID of the downstream API
+	Audience string
+	// Permission, when set, must be held by the caller
+	Permission string
+	// Scopes are the most a token may carry; requests may ask for fewer. Without scopes the
+	// token carries the audience client's default scopes only.
+	Scopes []string
+}
+
+// SetTokenExchangePolicies lets callers exchange their Keycloak token for tokens of the listed
+// audiences, on their behalf. Other audiences are refused. Set it before serving requests.
+func (s *UserService) SetTokenExchangePolicies(policies []ExchangePolicy) {
+	s.exchangePolicies = make(map[string]ExchangePolicy, len(policies))
+	for _, policy := range policies {
+		s.exchangePolicies[policy.Audience] = policy
+	}
+}
+
+// TokenExchangeRequest asks for a token for audience with the space-separated scope
+type TokenExchangeRequest struct {
+	Audience string `json:"audience" validate:"required,max=255"`
+	Scope    string `json:"scope,omitempty" validate:"max=1024"`
+}
+
+// ExchangedToken is a token for calling a downstream API on the caller's behalf
+type ExchangedToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Audience    string `json:"audience"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// ExchangeToken exchanges subjectToken, the Keycloak access token of the caller in ctx, for a
+// token of req.Audience narrowed to the requested scopes, as the audience's policy allows
+func (s *UserService) ExchangeToken(ctx context.Context, subjectToken string, req TokenExchangeRequest) (*ExchangedToken, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	policy, ok := s.exchangePolicies[req.Audience]
+	if !ok {
+		return nil, apperrors.Forbidden("AUDIENCE_NOT_ALLOWED", fmt.Sprintf("Tokens for %q cannot be requested", req.Audience))
+	}
+	if policy.Permission != "" && !auth.HasPermission(ctx, perm.Name(policy.Permission)) {
+		return nil, apperrors.Forbidden("AUDIENCE_NOT_ALLOWED", fmt.Sprintf("Tokens for %q need the %s permission", req.Audience, policy.Permission))
+	}
+	scopes := strings.Fields(req.Scope)
+	for _, scope := range scopes {
+		if !containsString(policy.Scopes, scope) {
+			return nil, apperrors.Invalid("SCOPE_NOT_ALLOWED", fmt.Sprintf("Scope %q is not allowed for %s", scope, req.Audience))
+		}
+	}
+	if strings.HasPrefix(subjectToken, rbac.PersonalTokenPrefix) {
+		return nil, apperrors.Invalid("SUBJECT_TOKEN_UNSUPPORTED", "Personal access tokens cannot be exchanged")
+	}
+	if err := s.requireKeycloak(); err != nil {
+		return nil, err
+	}
+	cfg, err := s.realmConfig(auth.Realm(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	options := gocloak.TokenOptions{
+		ClientID:           &cfg.ClientID,
+		ClientSecret:       &cfg.ClientSecret,
+		GrantType:          gocloak.StringP("urn:ietf:params:oauth:grant-type:token-exchange"),
+		SubjectToken:       &subjectToken,
+		Audience:           &req.Audience,
+		RequestedTokenType: gocloak.StringP("urn:ietf:params:oauth:token-type:access_token"),
+	}
+	if len(scopes) > 0 {
+		options.Scope = gocloak.StringP(strings.Join(scopes, " "))
+	}
+	token, err := s.keycloak.GetToken(ctx, cfg.Realm, options)
+	if err != nil {
+		return nil, s.keycloakError(ctx, "token exchange", err)
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{
+		"user_id":  auth.UserID(ctx),
+		"audience": req.Audience,
+		"scope":    token.Scope,
+	}).Info("Token exchanged for downstream audience")
+	return &ExchangedToken{
+		AccessToken: token.AccessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   token.ExpiresIn,
+		Audience:    req.Audience,
+		Scope:       token.Scope,
+	}, nil
+}
+
+// containsString reports whether list holds value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenExchangeHandler handles POST /api/auth/token-exchange
+func TokenExchangeHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TokenExchangeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+		subjectToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token, err := service.ExchangeToken(r.Context(), subjectToken, req)
+		if err != nil {
+			writeServiceError(w, err, "Token exchange failed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(token)
+	}
+}
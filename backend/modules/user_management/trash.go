@@ -0,0 +1,182 @@
+package user_management
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"base-app/modules/auth"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/audit"
+	"base-app/pkg/labels"
+	"base-app/pkg/perm"
+	"base-app/pkg/trash"
+
+	"github.com/gorilla/mux"
+)
+
+// TrashKindUser is the kind of deleted users in the trash
+const TrashKindUser = "user"
+
+// userSnapshot is what a trashed user is restored from. The account itself stays in place,
+// disabled, until the item is purged, so passwords, notes and memberships survive a restore.
+type userSnapshot struct {
+	WasActive bool `json:"was_active"`
+}
+
+// SetTrash lets deleted users be restored from bin until they are purged. Set it before serving
+// requests.
+func (s *UserService) SetTrash(bin *trash.Bin) {
+	s.trash = bin
+	bin.Register(trash.Kind{Name: TrashKindUser, Permission: perm.DeleteUser, Restore: s.restoreUser, Purge: s.purgeUser})
+}
+
+// ImpactAnalyzer reports what removing a user would do to their group memberships and access
+type ImpactAnalyzer interface {
+	UserRemovalImpact(ctx context.Context, userID string, clearMemberships bool) (*rbac.Impact, error)
+}
+
+// SetImpactAnalyzer lets DELETE /api/users/{id}?dry_run=true report what the deletion would do.
+// Set it before serving requests.
+func (s *UserService) SetImpactAnalyzer(analyzer ImpactAnalyzer) {
+	s.impacts = analyzer
+}
+
+// DeletionImpact reports what deleting a user would do without deleting them. Memberships are
+// cleared only when the user is deleted for good rather than moved to the trash.
+func (s *UserService) DeletionImpact(ctx context.Context, userID string) (*rbac.Impact, error) {
+	user, err := s.repo.GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	if s.impacts == nil {
+		return nil, apperrors.Internal("DRY_RUN_NOT_CONFIGURED", "Dry runs of user deletion are not configured", nil)
+	}
+	return s.impacts.UserRemovalImpact(ctx, user.ID, s.trash == nil)
+}
+
+// DeleteUser disables a user and revokes their access at once, then moves them to the trash.
+// Without a trash the user is deleted for good.
+func (s *UserService) DeleteUser(ctx context.Context, userID string) error {
+	logger := s.logger.WithContext(ctx).WithField("user_id", userID)
+	user, err := s.repo.GetByID(userID)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get user")
+		return err
+	}
+	if user == nil {
+		return apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	if s.trash == nil {
+		return s.deleteUser(ctx, user)
+	}
+
+	item, err := s.trash.Put(ctx, TrashKindUser, user.ID, user.Username, auth.UserID(ctx), userSnapshot{WasActive: user.IsActive})
+	if err != nil {
+		return err
+	}
+	if _, err := s.setActive(ctx, user.ID, false); err != nil {
+		s.trash.Discard(ctx, item)
+		return err
+	}
+	if s.access != nil {
+		if err := s.access.RevokeUserAccess(ctx, user.KeycloakID, rbac.RevokedDeleted); err != nil {
+			logger.WithError(err).Warn("Failed to end sessions of deleted user")
+		}
+	}
+
+	logger.Info("User moved to the trash")
+	s.audit(ctx, audit.ActionDelete, AuditUser, user.ID, user, nil)
+	return nil
+}
+
+// restoreUser re-enables a trashed user that was active when deleted
+func (s *UserService) restoreUser(ctx context.Context, item *trash.Item) error {
+	var snapshot userSnapshot
+	if err := json.Unmarshal(item.Data, &snapshot); err != nil {
+		return apperrors.Internal("TRASH_ITEM_CORRUPT", "The trashed user cannot be read", err)
+	}
+	user, err := s.repo.GetByID(item.EntityID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return apperrors.NotFound("USER_NOT_FOUND", "User not found")
+	}
+	if snapshot.WasActive {
+		if user, err = s.ActivateUser(ctx, item.EntityID); err != nil {
+			return err
+		}
+	}
+	s.audit(ctx, audit.ActionRestore, AuditUser, user.ID, nil, user)
+	return nil
+}
+
+// purgeUser deletes a trashed user for good
+func (s *UserService) purgeUser(ctx context.Context, item *trash.Item) error {
+	user, err := s.repo.GetByID(item.EntityID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		s.forgetLabels(item.EntityID)
+		return nil
+	}
+	return s.deleteUser(ctx, user)
+}
+
+// deleteUser deletes a user's account at the identity provider and then their local record
+func (s *UserService) deleteUser(ctx context.Context, user *User) error {
+	logger := s.logger.WithContext(ctx).WithField("user_id", user.ID)
+	if err := s.identity.DeleteUser(ctx, user.Realm, user.KeycloakID); err != nil {
+		logger.WithError(err).Error("Failed to delete user account")
+		return err
+	}
+	if err := s.repo.Delete(user.ID); err != nil {
+		logger.WithError(err).Error("Failed to delete user locally")
+		return err
+	}
+	s.forgetLabels(user.ID)
+
+	logger.Info("User deleted")
+	s.audit(ctx, audit.ActionDelete, AuditUser, user.ID, user, nil)
+	return nil
+}
+
+// forgetLabels deletes the labels of a deleted user. Failures are logged: the user is already
+// gone, and labels of unknown IDs match nothing that is exported.
+func (s *UserService) forgetLabels(userID string) {
+	if s.labels == nil {
+		return
+	}
+	if err := s.labels.Forget(labels.KindUser, userID); err != nil {
+		s.logger.WithError(err).WithField("user_id", userID).Warn("Failed to forget labels")
+	}
+}
+
+// DeleteUserHandler handles DELETE /api/users/{id}. With ?dry_run=true it reports the impact of
+// the deletion instead.
+func DeleteUserHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rbac.IsDryRun(r) {
+			impact, err := service.DeletionImpact(r.Context(), mux.Vars(r)["id"])
+			if err != nil {
+				writeServiceError(w, err, "Failed to delete user")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(impact)
+			return
+		}
+		if err := service.DeleteUser(r.Context(), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete user")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
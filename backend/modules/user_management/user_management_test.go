@@ -3,26 +3,40 @@ package user_management
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/authevents"
+	"base-app/pkg/fieldcrypt"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+	"base-app/pkg/ratelimit"
+	"base-app/pkg/testsupport"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 )
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
-
 func loadTestKeycloakConfig(t *testing.T) KeycloakConfig {
 	file, err := os.Open("../../keycloak.json")
 	if err != nil {
@@ -38,27 +52,15 @@ func loadTestKeycloakConfig(t *testing.T) KeycloakConfig {
 	return config
 }
 
-func setupTestDB(t *testing.T) *sql.DB {
-	// For testing, use an in-memory or test DB. For simplicity, assume PostgreSQL test instance.
-	// In real, use testcontainers or sqlite.
-	dbHost := getEnv("DB_HOST", "localhost")
-	dbPort := getEnv("DB_PORT", "5432")
-	dbUser := getEnv("DB_USER", "postgres")
-	dbPassword := getEnv("DB_PASSWORD", "postgres")
-	dbName := getEnv("DB_NAME", "baseapp")
-	dbSSLMode := getEnv("DB_SSLMODE", "disable")
+func TestMain(m *testing.M) { testsupport.Main(m) }
 
-	connStr := "host=" + dbHost + " port=" + dbPort + " user=" + dbUser + " password=" + dbPassword + " dbname=" + dbName + " sslmode=" + dbSSLMode
+func setupTestDB(t *testing.T) *sql.DB {
+	// A fresh database on the server TEST_DB_MODE selects; see pkg/testsupport
+	testsupport.SkipWithoutPostgres(t)
+	db := testsupport.NewTestDatabase(t)
 
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		t.Skip("Test DB not available")
-	}
-	if err := db.Ping(); err != nil {
-		t.Skip("Test DB not available")
-	}
 	// Create table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
 		id UUID PRIMARY KEY,
 		keycloak_id VARCHAR UNIQUE,
 		username VARCHAR UNIQUE,
@@ -72,6 +74,10 @@ func setupTestDB(t *testing.T) *sql.DB {
 	if err != nil {
 		t.Fatal(err)
 	}
+	_, err = db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT, ADD COLUMN IF NOT EXISTS attributes TEXT`)
+	if err != nil {
+		t.Fatal(err)
+	}
 	return db
 }
 
@@ -120,7 +126,7 @@ func TestRegisterHandler(t *testing.T) {
 	service := NewUserService(repo, config, logger)
 
 	r := mux.NewRouter()
-	SetupRoutes(r, service)
+	SetupRoutes(r, service, rbac.NewRBACService(&rbac.RBACRepository{}, logger))
 
 	reqBody := RegisterRequest{
 		Username:  "handleruser",
@@ -301,3 +307,1729 @@ func TestUpdateProfile(t *testing.T) {
 		t.Skip("Update failed due to Keycloak")
 	}
 }
+
+func TestEnsureCaseInsensitiveUniqueness(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	// username has a conflict, so only the email index is created
+	mock.ExpectQuery(`SELECT lower\(username\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"lower", "ids"}).AddRow("alice", "{id-1,id-2}"))
+	mock.ExpectQuery(`SELECT lower\(email\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"lower", "ids"}))
+	mock.ExpectExec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_lower ON users \(lower\(email\)\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	conflicts, err := EnsureCaseInsensitiveUniqueness(db)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("Expected 1 conflict, got %d", len(conflicts))
+	}
+	if conflicts[0].Column != "username" || conflicts[0].Value != "alice" || len(conflicts[0].UserIDs) != 2 {
+		t.Errorf("Unexpected conflict: %+v", conflicts[0])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	if got := NormalizeEmail("  Foo@Example.COM "); got != "foo@example.com" {
+		t.Errorf("Expected foo@example.com, got %q", got)
+	}
+}
+
+func TestKeycloakConfigStringMasksSecrets(t *testing.T) {
+	cfg := KeycloakConfig{Realm: "base", ClientID: "api", ClientSecret: "client-s3cret", AdminUsername: "admin", AdminPassword: "admin-s3cret"}
+
+	dump := cfg.String()
+	if strings.Contains(dump, "s3cret") {
+		t.Errorf("Expected secrets to be masked, got %s", dump)
+	}
+	if !strings.Contains(dump, "ClientID:api") {
+		t.Errorf("Expected non-secret fields to be kept, got %s", dump)
+	}
+}
+
+func TestKeycloakConfigForRealm(t *testing.T) {
+	cfg := KeycloakConfig{URL: "https://sso.example.com", Realm: "employees", ClientID: "api", ClientSecret: "s1", AdminUsername: "admin", AdminPassword: "p1",
+		Realms: []RealmConfig{{Realm: "customers", ClientID: "shop", ClientSecret: "s2"}}}
+
+	primary, ok := cfg.ForRealm("")
+	if !ok || primary.Realm != "employees" || primary.ClientID != "api" {
+		t.Errorf("Expected the primary realm for an empty name, got %+v", primary)
+	}
+	customers, ok := cfg.ForRealm("customers")
+	if !ok || customers.Realm != "customers" || customers.ClientID != "shop" || customers.ClientSecret != "s2" {
+		t.Errorf("Expected the customers client, got %+v", customers)
+	}
+	if customers.AdminUsername != "admin" || customers.URL != cfg.URL {
+		t.Errorf("Expected the admin account and URL to be shared, got %+v", customers)
+	}
+	if customers.Issuer() != "https://sso.example.com/realms/customers" {
+		t.Errorf("Unexpected issuer %s", customers.Issuer())
+	}
+	if _, ok := cfg.ForRealm("partners"); ok {
+		t.Error("Expected an unconfigured realm to be rejected")
+	}
+	if dump := cfg.String(); strings.Contains(dump, "s2") {
+		t.Errorf("Expected realm secrets to be masked, got %s", dump)
+	}
+}
+
+// captureArg matches any value and records it, so a test can read back what was written
+type captureArg struct {
+	value *string
+}
+
+func (c captureArg) Match(v driver.Value) bool {
+	if s, ok := v.(string); ok {
+		*c.value = s
+	}
+	return true
+}
+
+func TestEncryptedUserRepository(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	keyring, err := fieldcrypt.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{7}, fieldcrypt.KeySize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := NewEncryptedUserRepository(db, db, keyring)
+	user := &User{ID: "user-1", Username: "alice", Phone: "+14155552671", Attributes: map[string]string{"department": "finance"}}
+
+	var storedPhone, storedAttributes string
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(user.ID, sqlmock.AnyArg(), user.Username, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), captureArg{&storedPhone}, captureArg{&storedAttributes}, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := repo.Create(user); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !fieldcrypt.IsEncrypted(storedPhone) || strings.Contains(storedAttributes, "finance") {
+		t.Fatalf("Expected PII to be stored encrypted, got %q and %q", storedPhone, storedAttributes)
+	}
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`SELECT (.+) FROM users WHERE id = \$1`).WithArgs(user.ID).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(user.ID, "", "alice", "", "", "", true, time.Now(), time.Now(), storedPhone, storedAttributes, ""))
+	loaded, err := repo.GetByID(user.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if loaded.Phone != user.Phone || loaded.Attributes["department"] != "finance" {
+		t.Errorf("Expected decrypted PII, got %q and %v", loaded.Phone, loaded.Attributes)
+	}
+
+	// Ciphertext copied onto another row does not decrypt
+	mock.ExpectQuery(`SELECT (.+) FROM users WHERE id = \$1`).WithArgs("user-2").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-2", "", "mallory", "", "", "", true, time.Now(), time.Now(), storedPhone, nil, ""))
+	if _, err := repo.GetByID("user-2"); err == nil {
+		t.Error("Expected an error for ciphertext from another row")
+	}
+
+	// Rows written before encryption was enabled are read as plaintext
+	mock.ExpectQuery(`SELECT (.+) FROM users WHERE id = \$1`).WithArgs("user-3").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-3", "", "bob", "", "", "", true, time.Now(), time.Now(), "+441632960961", nil, ""))
+	legacy, err := repo.GetByID("user-3")
+	if err != nil || legacy.Phone != "+441632960961" {
+		t.Errorf("Expected plaintext phone to be read as-is, got %v, %v", legacy, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestReencryptUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	keys := map[string][]byte{"old": bytes.Repeat([]byte{1}, fieldcrypt.KeySize)}
+	keyring, err := fieldcrypt.NewKeyring("old", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPhone, err := keyring.Encrypt([]byte("+14155552671"), piiAAD("phone", "user-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys["new"] = bytes.Repeat([]byte{2}, fieldcrypt.KeySize)
+	if err := keyring.SetKeys("new", keys); err != nil {
+		t.Fatal(err)
+	}
+
+	var newPhone string
+	mock.ExpectQuery(`SELECT id, phone, attributes FROM users`).
+		WithArgs("00000000-0000-0000-0000-000000000000", "enc:v1:new:%", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "phone", "attributes"}).
+			AddRow("user-1", oldPhone, nil).
+			AddRow("user-2", "+441632960961", nil))
+	mock.ExpectExec(`UPDATE users SET phone = \$2, attributes = \$3`).
+		WithArgs("user-1", captureArg{&newPhone}, nil, oldPhone, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// user-2 changed since it was read, so nothing is overwritten
+	mock.ExpectExec(`UPDATE users SET phone = \$2, attributes = \$3`).
+		WithArgs("user-2", sqlmock.AnyArg(), nil, "+441632960961", nil).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	n, err := ReencryptUsers(context.Background(), db, keyring, 10)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 row re-encrypted, got %d", n)
+	}
+	if fieldcrypt.KeyID(newPhone) != "new" {
+		t.Errorf("Expected phone to be sealed with the new key, got %q", newPhone)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestGetProfileHandlerFiltersFields(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	var viewer fieldfilter.Viewer
+	service.SetViewerResolver(func(r *http.Request) fieldfilter.Viewer { return viewer })
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	get := func() map[string]interface{} {
+		mock.ExpectQuery(`SELECT (.+) FROM users WHERE id = \$1`).WithArgs("user-1").
+			WillReturnRows(sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), "+14155552671", nil, ""))
+		rr := httptest.NewRecorder()
+		GetProfileHandler(service)(rr, httptest.NewRequest("GET", "/api/users/profile?user_id=user-1", nil))
+		var body map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to decode response %q: %v", rr.Body.String(), err)
+		}
+		return body
+	}
+
+	anonymous := get()
+	if _, ok := anonymous["email"]; ok {
+		t.Errorf("Expected email to be hidden from anonymous callers, got %v", anonymous)
+	}
+	if _, ok := anonymous["keycloak_id"]; ok {
+		t.Errorf("Expected keycloak_id to be hidden from anonymous callers, got %v", anonymous)
+	}
+	if anonymous["username"] != "alice" {
+		t.Errorf("Expected public fields to be kept, got %v", anonymous)
+	}
+
+	viewer = fieldfilter.Viewer{UserID: "user-1"}
+	self := get()
+	if self["email"] != "alice@example.com" || self["phone"] != "+14155552671" {
+		t.Errorf("Expected users to see their own contact details, got %v", self)
+	}
+	if _, ok := self["keycloak_id"]; ok {
+		t.Errorf("Expected keycloak_id to require read_user, got %v", self)
+	}
+
+	viewer = fieldfilter.Viewer{UserID: "admin", Permissions: []string{"read_user"}}
+	if admin := get(); admin["keycloak_id"] != "kc-1" || admin["email"] != "alice@example.com" {
+		t.Errorf("Expected read_user to see every field, got %v", admin)
+	}
+}
+
+func TestUserLookupHandlers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	r := mux.NewRouter()
+	r.HandleFunc("/api/users/by-username/{name}", GetUserByUsernameHandler(service)).Methods("GET")
+	r.HandleFunc("/api/users/by-email/{email}", GetUserByEmailHandler(service)).Methods("GET")
+	r.HandleFunc("/api/users/by-keycloak-id/{id}", GetUserByKeycloakIDHandler(service)).Methods("GET")
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	row := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, "")
+	}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\) = lower\(\$1\)`).WithArgs("Alice").WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE lower\(email\) = lower\(\$1\)`).WithArgs("alice@example.com").WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs("kc-1").WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs("kc-2").WillReturnRows(sqlmock.NewRows(columns))
+
+	for _, path := range []string{"/api/users/by-username/Alice", "/api/users/by-email/alice@example.com", "/api/users/by-keycloak-id/kc-1"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"id":"user-1"`) {
+			t.Errorf("%s: expected user-1, got %d %s", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("GET", "/api/users/by-keycloak-id/kc-2", nil))
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "USER_NOT_FOUND") {
+		t.Errorf("Expected 404 USER_NOT_FOUND, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+type recordingRevoker struct {
+	revoked []string
+}
+
+func (r *recordingRevoker) RevokeUserAccess(_ context.Context, userID, reason string) error {
+	r.revoked = append(r.revoked, userID+":"+reason)
+	return nil
+}
+
+func TestDeactivateUserDisablesAndRevokesAccess(t *testing.T) {
+	var keycloakCalls []string
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keycloakCalls = append(keycloakCalls, r.Method+" "+r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/token") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer keycloak.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs("user-1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, ""))
+	mock.ExpectExec(`UPDATE users SET`).WithArgs("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", false, sqlmock.AnyArg(), nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{URL: keycloak.URL, Realm: "base"}, logger)
+	revoker := &recordingRevoker{}
+	service.SetAccessRevoker(revoker)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/users/{id}/deactivate", DeactivateUserHandler(service)).Methods("POST")
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest("POST", "/api/users/user-1/deactivate", nil))
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"is_active":false`) {
+		t.Errorf("Expected the deactivated user, got %d %s", rr.Code, rr.Body.String())
+	}
+	if len(keycloakCalls) != 2 || keycloakCalls[1] != "PUT /admin/realms/base/users/kc-1" {
+		t.Errorf("Expected the Keycloak user to be disabled, got %v", keycloakCalls)
+	}
+	if len(revoker.revoked) != 1 || revoker.revoked[0] != "kc-1:"+rbac.RevokedDeactivated {
+		t.Errorf("Expected access of kc-1 to be revoked, got %v", revoker.revoked)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestLoginHandlerLimitsAttemptsPerUsername(t *testing.T) {
+	var keycloakLogins int
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keycloakLogins++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer keycloak.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{URL: keycloak.URL, Realm: "base", ClientID: "app"}, logger)
+	limiter := ratelimit.New(ratelimit.Policy{Default: ratelimit.Rule{Name: "account", Limit: 2, Window: time.Minute}})
+	service.SetAccountLimiter(limiter)
+	var lockouts []string
+	service.OnAuthFailure(func(_ context.Context, failure authevents.Failure) {
+		if failure.Kind == authevents.KindLockout {
+			lockouts = append(lockouts, failure.Username)
+		}
+	})
+
+	login := func(username string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		body := `{"username": "` + username + `", "password": "guess"}`
+		LoginHandler(service)(rr, httptest.NewRequest("POST", "/api/users/login", strings.NewReader(body)))
+		return rr
+	}
+
+	for _, username := range []string{"alice", "ALICE"} {
+		if rr := login(username); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a wrong password, got %d", rr.Code)
+		}
+	}
+	rr := login("alice")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After once the username's budget is used, got %d", rr.Code)
+	}
+	if keycloakLogins != 2 {
+		t.Errorf("Expected the rejected attempt not to reach Keycloak, got %d logins", keycloakLogins)
+	}
+	if len(lockouts) != 1 || lockouts[0] != "alice" {
+		t.Errorf("Expected one lockout for alice, got %v", lockouts)
+	}
+	if rr := login("bob"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected other usernames to keep their budget, got %d", rr.Code)
+	}
+}
+
+func TestHandlersWriteStructuredErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	keycloakUp := true
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !keycloakUp {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer keycloak.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{URL: keycloak.URL, Realm: "base", ClientID: "app"}, logger)
+
+	send := func(handler http.HandlerFunc, method, target, body string) (int, httpapi.ErrorResponse) {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var resp httpapi.ErrorResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Errorf("Expected a JSON error body, got %q", rr.Body.String())
+		}
+		return rr.Code, resp
+	}
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, ""))
+	register := `{"username": "alice", "email": "other@example.com", "first_name": "A", "last_name": "B", "password": "password123"}`
+
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    string
+		status  int
+		code    string
+	}{
+		{"taken username", RegisterHandler(service), "POST", "/api/users/register", register, http.StatusConflict, "USERNAME_TAKEN"},
+		{"invalid fields", RegisterHandler(service), "POST", "/api/users/register", `{"username": "al"}`, http.StatusBadRequest, "VALIDATION_ERROR"},
+		{"malformed body", LoginHandler(service), "POST", "/api/users/login", `{`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"wrong password", LoginHandler(service), "POST", "/api/users/login", `{"username": "alice", "password": "guess"}`, http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+		{"wrong method", GetProfileHandler(service), "POST", "/api/users/profile", ``, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+		{"missing user id", GetProfileHandler(service), "GET", "/api/users/profile", ``, http.StatusBadRequest, "VALIDATION_ERROR"},
+	}
+	for _, tc := range cases {
+		if status, resp := send(tc.handler, tc.method, tc.target, tc.body); status != tc.status || resp.Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tc.name, tc.status, tc.code, status, resp.Code)
+		}
+	}
+
+	keycloakUp = false
+	status, resp := send(LoginHandler(service), "POST", "/api/users/login", `{"username": "alice", "password": "guess"}`)
+	if status != http.StatusServiceUnavailable || resp.Code != "KEYCLOAK_UNAVAILABLE" {
+		t.Errorf("Expected 503 KEYCLOAK_UNAVAILABLE while Keycloak is down, got %d %s", status, resp.Code)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestRegisterHandlerSanitizesKeycloakErrors(t *testing.T) {
+	var failure string
+	var deleted []string
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/token"):
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+		case r.Method == "POST" && r.URL.Path == "/admin/realms/base/users":
+			switch failure {
+			case "conflict":
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"errorMessage": "User exists with same email"}`))
+			case "outage":
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error": "org.keycloak.models.ModelException: connection refused to db-internal:5432"}`))
+			default:
+				w.Header().Set("Location", "/admin/realms/base/users/kc-new")
+				w.WriteHeader(http.StatusCreated)
+			}
+		case r.Method == "PUT" && strings.HasSuffix(r.URL.Path, "/reset-password"):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalidPasswordMinLengthMessage", "error_description": "org.keycloak.policy.LengthPasswordPolicyProvider"}`))
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer keycloak.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{URL: keycloak.URL, Realm: "base"}, logger)
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	body := `{"username": "alice", "email": "alice@example.com", "first_name": "A", "last_name": "B", "password": "password123"}`
+
+	cases := []struct {
+		failure string
+		status  int
+		code    string
+	}{
+		{"password", http.StatusBadRequest, "PASSWORD_REJECTED"},
+		{"conflict", http.StatusConflict, "EMAIL_TAKEN"},
+		{"outage", http.StatusServiceUnavailable, "KEYCLOAK_UNAVAILABLE"},
+	}
+	for _, tc := range cases {
+		failure = tc.failure
+		mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WillReturnRows(sqlmock.NewRows(columns))
+		mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(sqlmock.NewRows(columns))
+
+		rr := httptest.NewRecorder()
+		RegisterHandler(service)(rr, httptest.NewRequest("POST", "/api/users/register", strings.NewReader(body)))
+		var resp httpapi.ErrorResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != tc.status || resp.Code != tc.code {
+			t.Errorf("%s: expected %d %s, got %d %s", tc.failure, tc.status, tc.code, rr.Code, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "org.keycloak") || strings.Contains(rr.Body.String(), "db-internal") {
+			t.Errorf("%s: expected upstream details to stay out of the response, got %s", tc.failure, rr.Body.String())
+		}
+	}
+	if len(deleted) != 1 || deleted[0] != "/admin/realms/base/users/kc-new" {
+		t.Errorf("Expected the user with the rejected password to be rolled back, got %v", deleted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+type recordingGroups struct {
+	joined map[string][]string
+}
+
+func (g *recordingGroups) ApplyDomainRules(_ context.Context, userID, email string) ([]string, error) {
+	return nil, nil
+}
+
+func (g *recordingGroups) JoinGroupsByName(_ context.Context, userID string, names []string) ([]string, []string, error) {
+	var unknown []string
+	for _, name := range names {
+		if name == "staff" || name == rbac.RegisteredUsersGroup {
+			g.joined[userID] = append(g.joined[userID], name)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	return nil, unknown, nil
+}
+
+func (g *recordingGroups) UserGroupNames(userID string) ([]string, error) {
+	return g.joined[userID], nil
+}
+
+func TestImportAndExportUsersInKeycloakFormat(t *testing.T) {
+	var created []map[string]interface{}
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/token") {
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+			return
+		}
+		var rep map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&rep)
+		created = append(created, rep)
+		w.Header().Set("Location", "/admin/realms/base/users/kc-new")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer keycloak.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{URL: keycloak.URL, Realm: "base"}, logger)
+	groups := &recordingGroups{joined: map[string][]string{}}
+	service.SetGroupProvisioner(groups)
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WithArgs("alice@example.com").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), "kc-new", "alice", "alice@example.com", "Alice", "A", true, sqlmock.AnyArg(), sqlmock.AnyArg(), "+14155552671", `{"department":"sales"}`, "base", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("user-2", "kc-2", "bob", "bob@example.com", "Bob", "B", true, time.Now(), time.Now(), nil, nil, ""))
+
+	export := `{"realm": "old", "users": [
+		{"id": "old-id", "username": "alice", "email": "Alice@Example.com", "firstName": "Alice", "lastName": "A", "enabled": true,
+		 "createdTimestamp": 1700000000000, "attributes": {"phoneNumber": ["+14155552671"], "department": ["sales"]},
+		 "credentials": [{"id": "cred-1", "type": "password", "secretData": "{\"value\":\"hash\",\"salt\":\"salt\"}", "credentialData": "{\"hashIterations\":27500,\"algorithm\":\"pbkdf2-sha256\"}"}],
+		 "groups": ["/staff", "/org/missing"], "realmRoles": ["default-roles-old"]},
+		{"username": "bob", "email": "bob@example.com", "firstName": "Bob", "lastName": "B", "enabled": true},
+		{"username": "service-account-app", "serviceAccountClientId": "app", "enabled": true},
+		{"username": "x", "email": "not-an-email", "enabled": true}
+	]}`
+	rr := httptest.NewRecorder()
+	ImportUsersHandler(service)(rr, httptest.NewRequest("POST", "/api/users/import", strings.NewReader(export)))
+
+	var result ImportUsersResult
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected an import result, got %d %s", rr.Code, rr.Body.String())
+	}
+	if result.Created != 1 || result.Existing != 1 || result.Skipped != 1 || result.Failed != 1 {
+		t.Errorf("Expected one user of each status, got %+v", result)
+	}
+	if alice := result.Results[0]; len(alice.UnknownGroups) != 1 || alice.UnknownGroups[0] != "missing" {
+		t.Errorf("Expected the missing group to be reported, got %+v", alice)
+	}
+	if invalid := result.Results[3]; invalid.Code != "VALIDATION_ERROR" {
+		t.Errorf("Expected the invalid user to fail validation, got %+v", invalid)
+	}
+	if len(created) != 1 {
+		t.Fatalf("Expected one user created in Keycloak, got %d", len(created))
+	}
+	credentials, _ := created[0]["credentials"].([]interface{})
+	if _, hasID := created[0]["id"]; hasID || created[0]["groups"] != nil || created[0]["realmRoles"] != nil || len(credentials) != 1 {
+		t.Errorf("Expected the hashed credential without source realm IDs, groups or roles, got %v", created[0])
+	} else if credential := credentials[0].(map[string]interface{}); credential["secretData"] == nil || credential["id"] != nil {
+		t.Errorf("Expected the hashed credential to be carried over, got %v", credential)
+	}
+	if len(groups.joined["kc-new"]) != 1 {
+		t.Errorf("Expected alice to join staff, got %v", groups.joined)
+	}
+
+	mock.ExpectQuery(`FROM users ORDER BY username`).WillReturnRows(sqlmock.NewRows(columns).
+		AddRow("user-1", "kc-new", "alice", "alice@example.com", "Alice", "A", true, time.UnixMilli(1700000000000), time.Now(), "+14155552671", `{"department":"sales"}`, ""))
+	rr = httptest.NewRecorder()
+	ExportUsersHandler(service)(rr, httptest.NewRequest("GET", "/api/users/export", nil))
+
+	var exported RealmUsersFile
+	if err := json.Unmarshal(rr.Body.Bytes(), &exported); err != nil || len(exported.Users) != 1 {
+		t.Fatalf("Expected one exported user, got %d %s", rr.Code, rr.Body.String())
+	}
+	if exported.Realm != "base" {
+		t.Errorf("Expected the realm ahead of the streamed users, got %q", exported.Realm)
+	}
+	if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="base-users-0.json"` {
+		t.Errorf("Expected a Keycloak style file name, got %q", got)
+	}
+	alice := exported.Users[0]
+	if *alice.ID != "kc-new" || *alice.CreatedTimestamp != 1700000000000 || (*alice.Attributes)[PhoneAttribute][0] != "+14155552671" || (*alice.Groups)[0] != "/staff" {
+		t.Errorf("Expected alice in Keycloak format, got %s", rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestIdentityLinking(t *testing.T) {
+	identities := `[{"identityProvider": "github", "userId": "1234", "userName": "alice-gh"}]`
+	credentials := `[]`
+	var deleted []string
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/token"):
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/users/kc-1/federated-identity"):
+			w.Write([]byte(identities))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/users/kc-1/credentials"):
+			w.Write([]byte(credentials))
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer keycloak.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{URL: keycloak.URL, Realm: "base", LinkRedirectURL: "https://app.example.com/profile"}, logger)
+	ctx := context.Background()
+	session := rbac.Session{ID: "session-1", ClientID: "frontend"}
+
+	start, err := service.StartIdentityLink(ctx, "kc-1", session, "Google")
+	if err != nil {
+		t.Fatalf("Expected a link URL, got %v", err)
+	}
+	link, _ := url.Parse(start.URL)
+	query := link.Query()
+	sum := sha256.Sum256([]byte(query.Get("nonce") + "session-1" + "frontend" + "google"))
+	if link.Path != "/realms/base/broker/google/link" || query.Get("client_id") != "frontend" ||
+		query.Get("redirect_uri") != "https://app.example.com/profile" || query.Get("hash") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Expected a Keycloak client-initiated link URL, got %s", start.URL)
+	}
+	if _, err := service.StartIdentityLink(ctx, "kc-1", rbac.Session{}, "google"); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected tokens without a session to be rejected, got %v", err)
+	}
+	if _, err := service.StartIdentityLink(ctx, "kc-1", session, "facebook"); apperrors.KindOf(err) != apperrors.KindNotFound {
+		t.Errorf("Expected providers outside the configured list to be rejected, got %v", err)
+	}
+
+	if _, err := service.ConfirmIdentityLink(ctx, "kc-1", "google"); apperrors.KindOf(err) != apperrors.KindConflict {
+		t.Errorf("Expected an unlinked provider not to confirm, got %v", err)
+	}
+	identity, err := service.ConfirmIdentityLink(ctx, "kc-1", "github")
+	if err != nil || identity.ProviderUsername != "alice-gh" {
+		t.Errorf("Expected the linked GitHub identity, got %+v %v", identity, err)
+	}
+
+	if err := service.UnlinkIdentity(ctx, "kc-1", "github"); apperrors.KindOf(err) != apperrors.KindConflict {
+		t.Errorf("Expected the only login method of a user without password to be kept, got %v", err)
+	}
+	credentials = `[{"type": "password"}]`
+	if err := service.UnlinkIdentity(ctx, "kc-1", "github"); err != nil {
+		t.Errorf("Expected unlinking to succeed, got %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/admin/realms/base/users/kc-1/federated-identity/github" {
+		t.Errorf("Expected the GitHub link to be deleted, got %v", deleted)
+	}
+}
+
+type memoryDevices struct {
+	devices map[string]*Device
+	keys    map[string]string
+}
+
+func (m *memoryDevices) GetByKey(userID, key string) (*Device, error) {
+	return m.devices[m.keys[userID+"/"+key]], nil
+}
+
+func (m *memoryDevices) Create(device *Device, key string) error {
+	m.devices[device.ID] = device
+	m.keys[device.UserID+"/"+key] = device.ID
+	return nil
+}
+
+func (m *memoryDevices) Seen(device *Device) error { return nil }
+
+func (m *memoryDevices) ListForUser(userID string) ([]*Device, error) {
+	var devices []*Device
+	for _, device := range m.devices {
+		if device.UserID == userID {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func (m *memoryDevices) GetByID(userID, id string) (*Device, error) {
+	if device, ok := m.devices[id]; ok && device.UserID == userID {
+		return device, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryDevices) Delete(userID, id string) error {
+	delete(m.devices, id)
+	return nil
+}
+
+func (m *memoryDevices) CountForUser(userID string) (int, error) {
+	devices, _ := m.ListForUser(userID)
+	return len(devices), nil
+}
+
+type recordingNotifier []notification.Notification
+
+func (r *recordingNotifier) Notify(_ context.Context, n notification.Notification) error {
+	*r = append(*r, n)
+	return nil
+}
+
+func TestDevicesAreRecordedAndNewOnesAnnounced(t *testing.T) {
+	var keycloakCalls []string
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keycloakCalls = append(keycloakCalls, r.Method+" "+r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/token") {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer keycloak.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{URL: keycloak.URL, Realm: "base"}, logger)
+	devices := &memoryDevices{devices: map[string]*Device{}, keys: map[string]string{}}
+	alerts := &recordingNotifier{}
+	service.SetDeviceTracking(devices, alerts)
+
+	ctx := context.Background()
+	user := &User{KeycloakID: "kc-1", Username: "alice", Email: "alice@example.com"}
+	laptop := LoginDevice{UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0", IP: "10.0.0.1"}
+	service.recordDevice(ctx, user, "sess-1", laptop)
+	service.recordDevice(ctx, user, "sess-2", laptop)
+	if len(devices.devices) != 1 || len(*alerts) != 0 {
+		t.Errorf("Expected the first device to be recorded once without an alert, got %d devices and %d alerts", len(devices.devices), len(*alerts))
+	}
+
+	phone := LoginDevice{UserAgent: laptop.UserAgent, Fingerprint: "phone-1", IP: "10.0.0.2"}
+	service.recordDevice(ctx, user, "sess-3", phone)
+	if len(*alerts) != 1 || (*alerts)[0].Type != NewDeviceEvent || (*alerts)[0].Data["device"] != "Firefox on Windows" {
+		t.Errorf("Expected a new device alert, got %+v", *alerts)
+	}
+
+	listed, err := service.ListDevices(ctx, "kc-1", "sess-3")
+	if err != nil || len(listed) != 2 {
+		t.Fatalf("Expected two devices, got %v %v", listed, err)
+	}
+	var current *Device
+	for _, device := range listed {
+		if device.Current {
+			current = device
+		}
+	}
+	if current == nil || current.LastIP != "10.0.0.2" {
+		t.Errorf("Expected the phone to be the current device, got %+v", current)
+	}
+
+	if err := service.RevokeDevice(ctx, "kc-2", current.ID); apperrors.KindOf(err) != apperrors.KindNotFound {
+		t.Errorf("Expected devices of other users not to be found, got %v", err)
+	}
+	if err := service.RevokeDevice(ctx, "kc-1", current.ID); err != nil {
+		t.Fatalf("Expected the device to be revoked, got %v", err)
+	}
+	if len(devices.devices) != 1 || keycloakCalls[len(keycloakCalls)-1] != "DELETE /admin/realms/base/sessions/sess-3" {
+		t.Errorf("Expected the device to be forgotten and its session ended, got %v", keycloakCalls)
+	}
+}
+
+func TestPasskeys(t *testing.T) {
+	credentials := `[
+		{"id": "cred-1", "type": "webauthn-passwordless", "userLabel": "MacBook", "createdDate": 1704067200000},
+		{"id": "cred-2", "type": "otp"}
+	]`
+	var deleted []string
+	keycloak := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/token"):
+			w.Write([]byte(`{"access_token": "admin-token"}`))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/users/kc-1/credentials"):
+			w.Write([]byte(credentials))
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/users/kc-1/federated-identity"):
+			w.Write([]byte(`[]`))
+		case r.Method == "DELETE":
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer keycloak.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{URL: keycloak.URL, Realm: "base", PasskeyRedirectURL: "https://app.example.com/security"}, logger)
+	ctx := context.Background()
+
+	passkeys, err := service.Passkeys(ctx, "kc-1")
+	if err != nil || len(passkeys) != 1 || passkeys[0].Label != "MacBook" || passkeys[0].CreatedAt.Year() != 2024 {
+		t.Errorf("Expected only the WebAuthn credential, got %+v %v", passkeys, err)
+	}
+
+	registration, err := service.StartPasskeyRegistration(ctx, "kc-1", rbac.Session{ID: "session-1", ClientID: "frontend"}, "")
+	if err != nil || !strings.Contains(registration.URL, "/realms/base/protocol/openid-connect/auth?") ||
+		!strings.Contains(registration.URL, "kc_action=webauthn-register-passwordless") {
+		t.Errorf("Expected an application-initiated action URL, got %+v %v", registration, err)
+	}
+	if _, err := service.StartPasskeyRegistration(ctx, "kc-1", rbac.Session{ClientID: "frontend"}, "fingerprint"); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected unknown kinds to be rejected, got %v", err)
+	}
+
+	if err := service.DeletePasskey(ctx, "kc-1", "cred-2"); apperrors.KindOf(err) != apperrors.KindNotFound {
+		t.Errorf("Expected other credential types not to be deletable, got %v", err)
+	}
+	if err := service.DeletePasskey(ctx, "kc-1", "cred-1"); apperrors.KindOf(err) != apperrors.KindConflict {
+		t.Errorf("Expected the only way to sign in to be kept, got %v", err)
+	}
+	credentials = `[{"id": "cred-1", "type": "webauthn-passwordless"}, {"id": "cred-3", "type": "password"}]`
+	if err := service.DeletePasskey(ctx, "kc-1", "cred-1"); err != nil {
+		t.Errorf("Expected the passkey to be deleted, got %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/admin/realms/base/users/kc-1/credentials/cred-1" {
+		t.Errorf("Expected one credential deletion, got %v", deleted)
+	}
+}
+
+func TestUserNotesAreHiddenFromTheirSubject(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	userID := uuid.New().String()
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	userRow := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow(userID, "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, "")
+	}
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(userID).WillReturnRows(userRow())
+	mock.ExpectExec(`INSERT INTO user_notes`).WithArgs(sqlmock.AnyArg(), userID, "kc-admin", "support", "Called about billing", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(userID).WillReturnRows(userRow())
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	service.SetNoteRepository(NewNoteRepository(db, db))
+
+	serve := func(method, caller, body string) *httptest.ResponseRecorder {
+		r := mux.NewRouter()
+		r.HandleFunc("/api/users/{id}/notes", CreateUserNoteHandler(service)).Methods("POST")
+		r.HandleFunc("/api/users/{id}/notes", GetUserNotesHandler(service)).Methods("GET")
+		req := httptest.NewRequest(method, "/api/users/"+userID+"/notes", strings.NewReader(body))
+		ctx := context.WithValue(req.Context(), rbac.UserIDKey, caller)
+		ctx = context.WithValue(ctx, rbac.UsernameKey, "support")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req.WithContext(ctx))
+		return rr
+	}
+
+	rr := serve("POST", "kc-admin", `{"body": "Called about billing"}`)
+	if rr.Code != http.StatusCreated || !strings.Contains(rr.Body.String(), `"author_name":"support"`) {
+		t.Errorf("Expected the note to be created, got %d %s", rr.Code, rr.Body.String())
+	}
+	rr = serve("GET", "kc-1", "")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "OWN_ACCOUNT_NOTES") {
+		t.Errorf("Expected users not to read notes about themselves, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestWelcomeStepsRunInOrderAndIsolateFailures(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{}, logger)
+
+	if _, err := service.WelcomeSteps([]string{"default_groups", "fax"}, WelcomeOptions{}); err == nil {
+		t.Error("Expected unknown welcome steps to be rejected")
+	}
+	alerts := &recordingNotifier{}
+	builtin, err := service.WelcomeSteps([]string{WelcomeWebhook}, WelcomeOptions{Notifier: alerts})
+	if err != nil {
+		t.Fatalf("Expected the webhook step to be built, got %v", err)
+	}
+
+	var ran []string
+	step := func(name string, run func() error) WelcomeStep {
+		return WelcomeStep{Name: name, Run: func(context.Context, *User) error {
+			ran = append(ran, name)
+			return run()
+		}}
+	}
+	service.SetWelcomeSteps(
+		step("first", func() error { return nil }),
+		step("failing", func() error { return sql.ErrConnDone }),
+		step("panicking", func() error { panic("boom") }),
+		builtin[0],
+		step("last", func() error { return nil }),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	service.runWelcome(ctx, &User{ID: "user-1", KeycloakID: "kc-1", Username: "alice"})
+	if strings.Join(ran, ",") != "first,failing,panicking,last" {
+		t.Errorf("Expected every step to run in order, got %v", ran)
+	}
+	if len(*alerts) != 1 || (*alerts)[0].Type != UserRegisteredEvent || (*alerts)[0].Data["keycloak_id"] != "kc-1" {
+		t.Errorf("Expected the registration to be announced, got %+v", *alerts)
+	}
+}
+
+type staticProfileRequirements struct {
+	fields  []string
+	enforce bool
+}
+
+func (p *staticProfileRequirements) ProfileRequirements() ([]string, bool) {
+	return p.fields, p.enforce
+}
+
+func TestIncompleteProfilesAreSentToTheirProfile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	userRow := func(phone interface{}) *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), phone, `{"department":"Sales"}`, "")
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	requirements := &staticProfileRequirements{fields: []string{"phone", "attributes.department"}}
+	service.SetProfileRequirements(requirements)
+
+	serve := func(path, caller string) *httptest.ResponseRecorder {
+		handler := ProfileCompletionMiddleware(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		req := httptest.NewRequest("GET", path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), rbac.UserIDKey, caller))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs("kc-1").WillReturnRows(userRow(nil))
+	result, err := service.ProfileCompleteness(context.Background(), "kc-1")
+	if err != nil || result.Complete || strings.Join(result.Missing, ",") != "phone" {
+		t.Errorf("Expected the phone to be missing, got %+v %v", result, err)
+	}
+	if rr := serve("/api/rbac/roles", "kc-1"); rr.Code != http.StatusOK {
+		t.Errorf("Expected requests to pass while the policy is not enforced, got %d", rr.Code)
+	}
+
+	requirements.enforce = true
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs("kc-1").WillReturnRows(userRow(nil))
+	if rr := serve("/api/rbac/roles", "kc-1"); rr.Code != http.StatusPreconditionRequired || !strings.Contains(rr.Body.String(), "PROFILE_INCOMPLETE") {
+		t.Errorf("Expected incomplete profiles to get 428, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := serve("/api/users/me/profile/completeness", "kc-1"); rr.Code != http.StatusOK {
+		t.Errorf("Expected the profile routes to stay reachable, got %d", rr.Code)
+	}
+	if rr := serve("/api/rbac/roles", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected anonymous requests to pass, got %d", rr.Code)
+	}
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs("kc-1").WillReturnRows(userRow("+14155552671"))
+	if rr := serve("/api/rbac/roles", "kc-1"); rr.Code != http.StatusOK {
+		t.Errorf("Expected complete profiles to pass, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestRegisterLoginAndUpdateAgainstFakeKeycloak(t *testing.T) {
+	kc := testsupport.NewKeycloak(t, "base")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{
+		URL: kc.URL, Realm: kc.Realm, ClientID: kc.ClientID, ClientSecret: kc.ClientSecret,
+		AdminUsername: kc.AdminUsername, AdminPassword: kc.AdminPassword,
+	}, logger)
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	ctx := context.Background()
+
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).WillReturnResult(sqlmock.NewResult(1, 1))
+	user, err := service.RegisterUser(ctx, RegisterRequest{Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "A", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Expected registration to succeed, got %v", err)
+	}
+	registered := kc.UserByUsername("alice")
+	if registered == nil || registered.ID != user.KeycloakID || registered.Password != "password123" {
+		t.Fatalf("Expected the user to be created in Keycloak with their password, got %+v", registered)
+	}
+
+	row := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow(user.ID, user.KeycloakID, "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, "")
+	}
+	if _, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "wrong"}); err != errInvalidCredentials {
+		t.Errorf("Expected a wrong password to be rejected, got %v", err)
+	}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").WillReturnRows(row())
+	login, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil || login.AccessToken == "" || login.RefreshToken == "" || login.User.ID != user.ID {
+		t.Fatalf("Expected login to succeed, got %+v %v", login, err)
+	}
+	if kc.Sessions(user.KeycloakID) != 1 {
+		t.Errorf("Expected the login to start a Keycloak session")
+	}
+
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(row())
+	mock.ExpectExec(`UPDATE users SET`).WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err := service.UpdateProfile(ctx, user.ID, ProfileUpdateRequest{FirstName: "Alicia", LastName: "A", Email: "alice@example.com"}); err != nil {
+		t.Fatalf("Expected the profile update to succeed, got %v", err)
+	}
+	if updated := kc.User(user.KeycloakID); updated.FirstName != "Alicia" {
+		t.Errorf("Expected the update to reach the Keycloak user, got %+v", updated)
+	}
+
+	if err := service.RevokeSessions(ctx, user.KeycloakID); err != nil || kc.Sessions(user.KeycloakID) != 0 {
+		t.Errorf("Expected the sessions to be revoked, got %d %v", kc.Sessions(user.KeycloakID), err)
+	}
+	if calls := kc.CallsTo("PUT", "/reset-password"); len(calls) != 1 || calls[0].Status != http.StatusNoContent {
+		t.Errorf("Expected one password set during registration, got %+v", calls)
+	}
+
+	kc.Fail("POST", "/token", http.StatusServiceUnavailable, `{"error": "temporarily_unavailable"}`)
+	if _, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "password123"}); apperrors.KindOf(err) != apperrors.KindUnavailable {
+		t.Errorf("Expected a Keycloak outage to surface as unavailable, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestRegisteredUsersReadAndUpdateTheirOwnProfile(t *testing.T) {
+	kc := testsupport.NewKeycloak(t, "base")
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{
+		URL: kc.URL, Realm: kc.Realm, ClientID: kc.ClientID, ClientSecret: kc.ClientSecret,
+		AdminUsername: kc.AdminUsername, AdminPassword: kc.AdminPassword,
+	}, logger)
+	groups := &recordingGroups{joined: map[string][]string{}}
+	service.SetGroupProvisioner(groups)
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).WillReturnResult(sqlmock.NewResult(1, 1))
+	user, err := service.RegisterUser(context.Background(), RegisterRequest{Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "A", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Expected registration to succeed, got %v", err)
+	}
+
+	// The new user holds what the groups they joined grant
+	spec := rbac.RegisteredUsersSpec()
+	var permissions []string
+	for _, joined := range groups.joined[user.KeycloakID] {
+		for _, group := range spec.Groups {
+			if group.Name != joined {
+				continue
+			}
+			for _, role := range spec.Roles {
+				for _, key := range group.Roles {
+					if role.Key == key {
+						permissions = append(permissions, role.Permissions...)
+					}
+				}
+			}
+		}
+	}
+	if len(permissions) == 0 {
+		t.Fatalf("Expected the new user to join %q, got %v", rbac.RegisteredUsersGroup, groups.joined)
+	}
+
+	rbacService := rbac.NewRBACService(&rbac.RBACRepository{}, logger)
+	serve := func(method string, handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users/profile", strings.NewReader(body))
+		ctx := context.WithValue(req.Context(), rbac.UserIDKey, user.KeycloakID)
+		ctx = context.WithValue(ctx, rbac.UserPermissionsKey, permissions)
+		rr := httptest.NewRecorder()
+		handler(rr, req.WithContext(ctx))
+		return rr
+	}
+	row := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow(user.ID, user.KeycloakID, "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, "")
+	}
+
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs(user.KeycloakID).WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(user.ID).WillReturnRows(row())
+	if rr := serve("GET", rbacService.RequireOwnershipOr(perm.ReadUser, service.ownsProfile, GetProfileHandler(service)), ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the new user to read their profile, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	mock.ExpectQuery(`FROM users WHERE keycloak_id = \$1`).WithArgs(user.KeycloakID).WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE id = \$1`).WithArgs(user.ID).WillReturnRows(row())
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(row())
+	mock.ExpectExec(`UPDATE users SET`).WillReturnResult(sqlmock.NewResult(0, 1))
+	update := `{"first_name": "Alicia", "last_name": "A", "email": "alice@example.com"}`
+	if rr := serve("PUT", rbacService.RequireOwnershipOr(perm.UpdateUser, service.ownsProfile, UpdateProfileHandler(service)), update); rr.Code != http.StatusOK {
+		t.Errorf("Expected the new user to update their profile, got %d %s", rr.Code, rr.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestOIDCLoginProvisionsUserAtFirstLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	var issuer string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer": %q, "token_endpoint": "%s/token", "userinfo_endpoint": "%s/userinfo"}`, issuer, issuer, issuer)
+		case "/token":
+			if r.FormValue("grant_type") != "password" || r.FormValue("password") != "correct-horse" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(`{"access_token": "at-1", "refresh_token": "rt-1"}`))
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer at-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"sub": "sub-1", "preferred_username": "alice", "email": "Alice@Example.com", "given_name": "Alice", "family_name": "A"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer idp.Close()
+	issuer = idp.URL
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	service.SetIdentityProvider(NewOIDCProvider(OIDCConfig{IssuerURL: idp.URL, ClientID: "app"}, logger))
+
+	if _, err := service.LoginUser(context.Background(), LoginRequest{Username: "alice", Password: "guess"}); !errors.Is(err, errInvalidCredentials) {
+		t.Errorf("Expected invalid credentials for a wrong password, got %v", err)
+	}
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), "sub-1", "alice", "alice@example.com", "Alice", "A", true, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, "", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	response, err := service.LoginUser(context.Background(), LoginRequest{Username: "alice", Password: "correct-horse"})
+	if err != nil {
+		t.Fatalf("Expected login to succeed, got %v", err)
+	}
+	if response.AccessToken != "at-1" || response.User == nil || response.User.KeycloakID != "sub-1" {
+		t.Errorf("Expected the provider's token and a provisioned user, got %+v", response)
+	}
+
+	if _, err := service.Passkeys(context.Background(), "sub-1"); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected Keycloak-only features to be unavailable, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestRegisterAndLoginWithLocalProvider(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	rbacService := rbac.NewRBACService(&rbac.RBACRepository{}, logger)
+	rbacService.SetJWTSecret("local-secret")
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	service.SetIdentityProvider(NewLocalProvider(db, rbacService.IssueToken, time.Hour, logger))
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	ctx := context.Background()
+
+	var storedHash string
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "alice", "alice@example.com", "Alice", "A", true, sqlmock.AnyArg(), sqlmock.AnyArg(), nil, nil, "", captureArg{&storedHash}).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	user, err := service.RegisterUser(ctx, RegisterRequest{Username: "alice", Email: "alice@example.com", FirstName: "Alice", LastName: "A", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Expected registration to succeed, got %v", err)
+	}
+	if !strings.HasPrefix(storedHash, "$argon2id$") {
+		t.Fatalf("Expected an argon2id hash to be stored, got %q", storedHash)
+	}
+
+	credentials := func(active bool) *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"keycloak_id", "username", "email", "password_hash", "is_active"}).
+			AddRow(user.KeycloakID, "alice", "alice@example.com", storedHash, active)
+	}
+	mock.ExpectQuery(`SELECT keycloak_id, username, email, password_hash, is_active FROM users`).WithArgs("alice").WillReturnRows(credentials(true))
+	if _, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "wrong-password"}); err != errInvalidCredentials {
+		t.Errorf("Expected a wrong password to be rejected, got %v", err)
+	}
+	mock.ExpectQuery(`SELECT keycloak_id, username, email, password_hash, is_active FROM users`).WithArgs("nobody").
+		WillReturnRows(sqlmock.NewRows([]string{"keycloak_id", "username", "email", "password_hash", "is_active"}))
+	if _, err := service.LoginUser(ctx, LoginRequest{Username: "nobody", Password: "password123"}); err != errInvalidCredentials {
+		t.Errorf("Expected an unknown user to be rejected, got %v", err)
+	}
+
+	mock.ExpectQuery(`SELECT keycloak_id, username, email, password_hash, is_active FROM users`).WithArgs("alice").WillReturnRows(credentials(true))
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(user.ID, user.KeycloakID, "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, ""))
+	login, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil || login.User == nil || login.User.ID != user.ID {
+		t.Fatalf("Expected login to succeed, got %+v %v", login, err)
+	}
+	var claims rbac.JWTClaims
+	if _, err := jwt.ParseWithClaims(login.AccessToken, &claims, func(*jwt.Token) (interface{}, error) { return []byte("local-secret"), nil }); err != nil {
+		t.Fatalf("Expected a token signed with the JWT secret, got %v", err)
+	}
+	if claims.UserID != user.KeycloakID || claims.Username != "alice" || claims.Session == "" {
+		t.Errorf("Expected the token to identify alice and her session, got %+v", claims)
+	}
+
+	mock.ExpectQuery(`SELECT keycloak_id, username, email, password_hash, is_active FROM users`).WithArgs("alice").WillReturnRows(credentials(false))
+	if _, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "password123"}); err != errInvalidCredentials {
+		t.Errorf("Expected a deactivated user to be rejected, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+type closedRegistration struct{}
+
+func (closedRegistration) CheckRegistration(email, inviteCode string) error {
+	return apperrors.Forbidden("REGISTRATION_CLOSED", "Registration is closed")
+}
+
+type singleInvitation struct {
+	email, code string
+	redeemedBy  string
+}
+
+func (i *singleInvitation) CheckInvitation(email, code string) (bool, error) {
+	return i.redeemedBy == "" && email == i.email && code == i.code, nil
+}
+
+func (i *singleInvitation) RedeemInvitation(_ context.Context, email, code, userID string) ([]string, error) {
+	i.redeemedBy = userID
+	return []string{"staff"}, nil
+}
+
+func TestInvitationBypassesRegistrationGate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	rbacService := rbac.NewRBACService(&rbac.RBACRepository{}, logger)
+	rbacService.SetJWTSecret("local-secret")
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	service.SetIdentityProvider(NewLocalProvider(db, rbacService.IssueToken, time.Hour, logger))
+	service.SetRegistrationGate(closedRegistration{})
+	invitation := &singleInvitation{email: "admin@acme.test", code: "invite-code"}
+	service.SetInvitations(invitation)
+	groups := &recordingGroups{joined: map[string][]string{}}
+	service.SetGroupProvisioner(groups)
+	ctx := context.Background()
+
+	req := RegisterRequest{Username: "acme-admin", Email: "admin@acme.test", FirstName: "Acme", LastName: "Admin", Password: "password123", InviteCode: "wrong"}
+	if _, err := service.RegisterUser(ctx, req); apperrors.KindOf(err) != apperrors.KindForbidden {
+		t.Fatalf("Expected a wrong code to be rejected by the gate, got %v", err)
+	}
+
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec(`INSERT INTO users`).WillReturnResult(sqlmock.NewResult(0, 1))
+	req.InviteCode = "invite-code"
+	user, err := service.RegisterUser(ctx, req)
+	if err != nil {
+		t.Fatalf("Expected an invitee to register while registration is closed, got %v", err)
+	}
+	if invitation.redeemedBy != user.ID {
+		t.Errorf("Expected the invitation to be redeemed by %s, got %q", user.ID, invitation.redeemedBy)
+	}
+	// The welcome pipeline adds every new user to the registered users group afterwards
+	if got := groups.joined[user.KeycloakID]; strings.Join(got, ",") != "staff,"+rbac.RegisteredUsersGroup {
+		t.Errorf("Expected the invitee to join the groups of the invitation, got %v", got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+type memoryRefreshTokens map[string]*RefreshToken
+
+func (m memoryRefreshTokens) Create(token *RefreshToken) error {
+	m[token.Hash] = token
+	return nil
+}
+
+func (m memoryRefreshTokens) GetByHash(hash string) (*RefreshToken, error) {
+	if token, ok := m[hash]; ok {
+		copied := *token
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m memoryRefreshTokens) Rotate(hash string, at time.Time) (bool, error) {
+	token, ok := m[hash]
+	if !ok || token.RotatedAt != nil || token.RevokedAt != nil {
+		return false, nil
+	}
+	token.RotatedAt = &at
+	return true, nil
+}
+
+func (m memoryRefreshTokens) RevokeFamily(familyID string, at time.Time) ([]string, error) {
+	var sessions []string
+	for _, token := range m {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			token.RevokedAt = &at
+			sessions = append(sessions, token.SessionID)
+		}
+	}
+	return sessions, nil
+}
+
+func (m memoryRefreshTokens) DeleteIssuedBefore(before time.Time) (int64, error) {
+	var n int64
+	for hash, token := range m {
+		if token.IssuedAt.Before(before) {
+			delete(m, hash)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	kc := testsupport.NewKeycloak(t, "base")
+	userID := kc.AddUser(testsupport.KeycloakUser{Username: "alice", Email: "alice@example.com", Password: "password123"})
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{
+		URL: kc.URL, Realm: kc.Realm, ClientID: kc.ClientID, ClientSecret: kc.ClientSecret,
+		AdminUsername: kc.AdminUsername, AdminPassword: kc.AdminPassword,
+	}, logger)
+	tokens := memoryRefreshTokens{}
+	service.SetRefreshTokenTracking(tokens)
+	var events []authevents.Failure
+	service.OnAuthFailure(func(_ context.Context, failure authevents.Failure) { events = append(events, failure) })
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	ctx := context.Background()
+
+	mock.ExpectQuery(`FROM users WHERE lower\(username\)`).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("u1", userID, "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, ""))
+	login, err := service.LoginUser(ctx, LoginRequest{Username: "alice", Password: "password123"})
+	if err != nil {
+		t.Fatalf("Expected login to succeed, got %v", err)
+	}
+
+	refreshed, err := service.RefreshSession(ctx, RefreshRequest{RefreshToken: login.RefreshToken}, "10.0.0.1")
+	if err != nil || refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Fatalf("Expected the refresh to rotate the token, got %+v %v", refreshed, err)
+	}
+	if len(tokens) != 2 || tokens[hashRefreshToken(refreshed.RefreshToken)].FamilyID != tokens[hashRefreshToken(login.RefreshToken)].FamilyID {
+		t.Fatalf("Expected the new token to join the login's family, got %+v", tokens)
+	}
+
+	// The stolen first token is presented again
+	if _, err := service.RefreshSession(ctx, RefreshRequest{RefreshToken: login.RefreshToken}, "203.0.113.9"); err != errRefreshTokenReused {
+		t.Fatalf("Expected reuse to be detected, got %v", err)
+	}
+	if len(events) != 1 || events[0].Kind != authevents.KindRefreshTokenReuse || events[0].UserID != userID || events[0].IP != "203.0.113.9" {
+		t.Errorf("Expected a refresh token reuse event for alice, got %+v", events)
+	}
+	if kc.Sessions(userID) != 0 {
+		t.Errorf("Expected the family's Keycloak session to be ended, got %d", kc.Sessions(userID))
+	}
+	if _, err := service.RefreshSession(ctx, RefreshRequest{RefreshToken: refreshed.RefreshToken}, "10.0.0.1"); err != errInvalidRefreshToken {
+		t.Errorf("Expected the rest of the family to be revoked, got %v", err)
+	}
+	if _, err := service.RefreshSession(ctx, RefreshRequest{RefreshToken: "never-issued"}, "10.0.0.1"); err != errInvalidRefreshToken {
+		t.Errorf("Expected an unknown token to be rejected by Keycloak, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+type memoryViews map[string]*SavedView
+
+func (m memoryViews) Create(view *SavedView) error {
+	m[view.ID] = view
+	return nil
+}
+
+func (m memoryViews) Update(view *SavedView) error {
+	m[view.ID] = view
+	return nil
+}
+
+func (m memoryViews) ListForUser(userID, list string) ([]*SavedView, error) {
+	var views []*SavedView
+	for _, view := range m {
+		if view.UserID == userID && (list == "" || view.List == list) {
+			copied := *view
+			views = append(views, &copied)
+		}
+	}
+	return views, nil
+}
+
+func (m memoryViews) GetByID(userID, id string) (*SavedView, error) {
+	if view, ok := m[id]; ok && view.UserID == userID {
+		copied := *view
+		return &copied, nil
+	}
+	return nil, nil
+}
+
+func (m memoryViews) Delete(userID, id string) error {
+	delete(m, id)
+	return nil
+}
+
+func TestSavedViews(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(nil, KeycloakConfig{}, logger)
+	views := memoryViews{}
+	service.SetViewRepository(views)
+	ctx := context.Background()
+
+	view, err := service.SaveView(ctx, "kc-1", "", SaveViewRequest{List: "roles", Name: "Payments", Query: "?sort=-name&label=team:payments"})
+	if err != nil {
+		t.Fatalf("Expected the view to be saved, got %v", err)
+	}
+	if view.Query != "label=team%3Apayments&sort=-name" || view.Href != "/api/rbac/roles?label=team%3Apayments&sort=-name" {
+		t.Errorf("Expected a canonical query and a link to the role list, got %q %q", view.Query, view.Href)
+	}
+
+	if _, err := service.SaveView(ctx, "kc-1", "", SaveViewRequest{List: "roles", Name: "payments"}); apperrors.KindOf(err) != apperrors.KindConflict {
+		t.Errorf("Expected names to be unique per list, got %v", err)
+	}
+	if _, err := service.SaveView(ctx, "kc-1", "", SaveViewRequest{List: "users", Name: "Payments", Query: "sort=name"}); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected parameters the list does not understand to be rejected, got %v", err)
+	}
+	if _, err := service.SaveView(ctx, "kc-1", "", SaveViewRequest{List: "roles", Name: "Bad", Query: "sort=size"}); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected invalid sort fields to be rejected, got %v", err)
+	}
+	if _, err := service.SaveView(ctx, "kc-1", "", SaveViewRequest{List: "users", Name: "Payments", Query: "label=team:payments"}); err != nil {
+		t.Errorf("Expected the same name to be allowed on another list, got %v", err)
+	}
+
+	if _, err := service.GetView(ctx, "kc-2", view.ID); apperrors.KindOf(err) != apperrors.KindNotFound {
+		t.Errorf("Expected views of other users not to be found, got %v", err)
+	}
+	updated, err := service.SaveView(ctx, "kc-1", view.ID, SaveViewRequest{List: "roles", Name: "Payments", Query: "label=team:payments"})
+	if err != nil || updated.Query != "label=team%3Apayments" || !updated.CreatedAt.Equal(view.CreatedAt) {
+		t.Errorf("Expected the view to be updated in place, got %+v %v", updated, err)
+	}
+
+	listed, err := service.ListViews(ctx, "kc-1", "roles")
+	if err != nil || len(listed) != 1 || listed[0].Href != "/api/rbac/roles?label=team%3Apayments" {
+		t.Errorf("Expected one role view, got %+v %v", listed, err)
+	}
+	if err := service.DeleteView(ctx, "kc-1", view.ID); err != nil || len(views) != 1 {
+		t.Errorf("Expected the view to be deleted, got %v with %d views left", err, len(views))
+	}
+}
+
+type memoryMagicLinks map[string]*MagicLink
+
+func (m memoryMagicLinks) Create(link *MagicLink) error {
+	for hash, existing := range m {
+		if existing.UserID == link.UserID && existing.UsedAt == nil {
+			delete(m, hash)
+		}
+	}
+	m[link.CodeHash] = link
+	return nil
+}
+
+func (m memoryMagicLinks) Consume(codeHash string, at time.Time) (*MagicLink, error) {
+	link := m[codeHash]
+	if link == nil || link.UsedAt != nil || !link.ExpiresAt.After(at) {
+		return nil, nil
+	}
+	link.UsedAt = &at
+	return link, nil
+}
+
+func TestMagicLinkLoginIsSingleUse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	rbacService := rbac.NewRBACService(&rbac.RBACRepository{}, logger)
+	rbacService.SetJWTSecret("magic-secret")
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{}, logger)
+	ctx := context.Background()
+
+	if err := service.RequestMagicLink(ctx, MagicLinkRequest{Email: "alice@example.com"}); apperrors.KindOf(err) != apperrors.KindNotFound {
+		t.Errorf("Expected magic links to be disabled by default, got %v", err)
+	}
+
+	links := memoryMagicLinks{}
+	var sent recordingNotifier
+	service.SetMagicLinks(links, MagicLinkOptions{
+		Issuer:   NewLocalMagicLinkIssuer(rbacService.IssueToken, time.Hour),
+		Notifier: &sent,
+		URL:      "https://app.example.com/login/magic",
+	})
+	columns := []string{"id", "keycloak_id", "username", "email", "first_name", "last_name", "is_active", "created_at", "updated_at", "phone", "attributes", "realm"}
+	alice := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).AddRow("user-1", "kc-1", "alice", "alice@example.com", "Alice", "A", true, time.Now(), time.Now(), nil, nil, "")
+	}
+
+	// Unknown addresses get the same answer, and no email
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WithArgs("nobody@example.com").WillReturnRows(sqlmock.NewRows(columns))
+	if err := service.RequestMagicLink(ctx, MagicLinkRequest{Email: "nobody@example.com"}); err != nil || len(sent) != 0 {
+		t.Fatalf("Expected unknown addresses to be ignored silently, got %v and %d emails", err, len(sent))
+	}
+
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WithArgs("alice@example.com").WillReturnRows(alice())
+	if err := service.RequestMagicLink(ctx, MagicLinkRequest{Email: "Alice@Example.com"}); err != nil {
+		t.Fatalf("Expected the magic link to be sent, got %v", err)
+	}
+	if len(sent) != 1 || sent[0].Type != MagicLinkEvent {
+		t.Fatalf("Expected one magic link email, got %+v", sent)
+	}
+	_, code, _ := strings.Cut(sent[0].Message, "?code=")
+	code = strings.Fields(code)[0]
+	if _, stored := links[code]; stored || links[hashMagicLinkCode(code)] == nil {
+		t.Fatalf("Expected only the hash of the code to be stored")
+	}
+
+	mock.ExpectQuery(`FROM users WHERE id`).WithArgs("user-1").WillReturnRows(alice())
+	login, err := service.VerifyMagicLink(ctx, MagicLinkVerifyRequest{Code: code})
+	if err != nil || login.User.ID != "user-1" {
+		t.Fatalf("Expected the code to log alice in, got %+v %v", login, err)
+	}
+	var claims rbac.JWTClaims
+	if _, err := jwt.ParseWithClaims(login.AccessToken, &claims, func(*jwt.Token) (interface{}, error) { return []byte("magic-secret"), nil }); err != nil {
+		t.Fatalf("Expected a locally signed token, got %v", err)
+	}
+	if claims.UserID != "kc-1" || claims.Session == "" {
+		t.Errorf("Expected the token to identify alice and a new session, got %+v", claims)
+	}
+
+	if _, err := service.VerifyMagicLink(ctx, MagicLinkVerifyRequest{Code: code}); err != errInvalidMagicLink {
+		t.Errorf("Expected a used code to be rejected, got %v", err)
+	}
+
+	// Without a login page the email carries only the code
+	service.SetMagicLinks(links, MagicLinkOptions{Issuer: NewLocalMagicLinkIssuer(rbacService.IssueToken, time.Hour), Notifier: &sent})
+	mock.ExpectQuery(`FROM users WHERE lower\(email\)`).WithArgs("alice@example.com").WillReturnRows(alice())
+	if err := service.RequestMagicLink(ctx, MagicLinkRequest{Email: "alice@example.com"}); err != nil || len(sent) != 2 {
+		t.Fatalf("Expected a second magic link email, got %v and %d emails", err, len(sent))
+	}
+	if msg := sent[1].Message; !strings.HasPrefix(msg, "Log in with the code ") || strings.Contains(msg, "Log in at") {
+		t.Errorf("Expected a code-only email without a URL, got %q", msg)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("Unmet expectations: %v", err)
+	}
+}
+
+func TestExchangeTokenFollowsAudiencePolicy(t *testing.T) {
+	kc := testsupport.NewKeycloak(t, "base")
+	kc.AddUser(testsupport.KeycloakUser{Username: "alice", Email: "alice@example.com", Password: "password123"})
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Failed to create sqlmock: %v", err)
+	}
+	defer db.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	service := NewUserService(NewUserRepository(db), KeycloakConfig{
+		URL: kc.URL, Realm: kc.Realm, ClientID: kc.ClientID, ClientSecret: kc.ClientSecret,
+		AdminUsername: kc.AdminUsername, AdminPassword: kc.AdminPassword,
+	}, logger)
+	service.SetTokenExchangePolicies([]ExchangePolicy{
+		{Audience: "billing-api", Scopes: []string{"invoices:read", "invoices:write"}},
+		{Audience: "reports-api", Permission: "view_reports"},
+	})
+	login, err := service.keycloak.Login(context.Background(), kc.ClientID, kc.ClientSecret, kc.Realm, "alice", "password123")
+	if err != nil {
+		t.Fatalf("Expected login to succeed, got %v", err)
+	}
+	ctx := context.WithValue(context.Background(), rbac.UserPermissionsKey, []string{"read_user"})
+
+	exchanged, err := service.ExchangeToken(ctx, login.AccessToken, TokenExchangeRequest{Audience: "billing-api", Scope: "invoices:read"})
+	if err != nil {
+		t.Fatalf("Expected the exchange to succeed, got %v", err)
+	}
+	if exchanged.AccessToken == "" || exchanged.AccessToken == login.AccessToken || exchanged.Audience != "billing-api" || exchanged.Scope != "invoices:read" {
+		t.Errorf("Expected a narrower token for billing-api, got %+v", exchanged)
+	}
+
+	if _, err := service.ExchangeToken(ctx, login.AccessToken, TokenExchangeRequest{Audience: "billing-api", Scope: "invoices:read admin"}); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected scopes beyond the policy to be rejected, got %v", err)
+	}
+	if _, err := service.ExchangeToken(ctx, login.AccessToken, TokenExchangeRequest{Audience: "payroll-api"}); apperrors.KindOf(err) != apperrors.KindForbidden {
+		t.Errorf("Expected an unlisted audience to be refused, got %v", err)
+	}
+	if _, err := service.ExchangeToken(ctx, login.AccessToken, TokenExchangeRequest{Audience: "reports-api"}); apperrors.KindOf(err) != apperrors.KindForbidden {
+		t.Errorf("Expected the policy permission to be required, got %v", err)
+	}
+	if _, err := service.ExchangeToken(ctx, rbac.PersonalTokenPrefix+"abc", TokenExchangeRequest{Audience: "billing-api"}); apperrors.KindOf(err) != apperrors.KindInvalid {
+		t.Errorf("Expected personal access tokens to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package user_management
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"base-app/modules/auth"
+	"base-app/modules/rbac"
+	"base-app/pkg/apperrors"
+	"base-app/pkg/database"
+	"base-app/pkg/dberrors"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/labels"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxSavedViews bounds the views one user may save
+const MaxSavedViews = 100
+
+// viewList is an admin list views can be saved for: the path it is served at and the query
+// parameters it understands besides paging
+type viewList struct {
+	Path   string
+	Params []string
+	// Check validates the values of Params
+	Check func(query url.Values) error
+}
+
+// viewLists are the lists views can be saved for, by name
+var viewLists = map[string]viewList{
+	"users": {Path: "/api/users/export", Params: []string{labels.QueryParam}, Check: func(query url.Values) error {
+		_, err := labels.SelectorsFromQuery(query)
+		return err
+	}},
+	"roles": {Path: "/api/rbac/roles", Params: []string{labels.QueryParam, "sort", "limit"}, Check: func(query url.Values) error {
+		_, err := rbac.ParseListQuery(query)
+		return err
+	}},
+}
+
+// SavedView is a named filter and sort configuration of an admin list, kept per user so complex
+// queries are repeatable. Query is the list's query string; Href applies it to the list.
+type SavedView struct {
+	ID string `json:"id"`
+	// UserID is the Keycloak ID of the user the view belongs to
+	UserID    string    `json:"-"`
+	List      string    `json:"list"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	Href      string    `json:"href"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SaveViewRequest represents the request to save or update a view
+type SaveViewRequest struct {
+	List  string `json:"list" validate:"required,oneof=users roles"`
+	Name  string `json:"name" validate:"required,max=100"`
+	Query string `json:"query" validate:"max=2000"`
+}
+
+// ViewRepository stores users' saved views
+type ViewRepository interface {
+	Create(view *SavedView) error
+	Update(view *SavedView) error
+	// ListForUser returns the views of userID by list and name, of one list unless list is empty
+	ListForUser(userID, list string) ([]*SavedView, error)
+	// GetByID returns the view of userID with id, or nil
+	GetByID(userID, id string) (*SavedView, error)
+	Delete(userID, id string) error
+}
+
+type viewRepository struct {
+	db     database.DBTX
+	reader database.Querier
+}
+
+// NewViewRepository creates a view repository that writes to db and reads from reader
+func NewViewRepository(db *sql.DB, reader database.Querier) ViewRepository {
+	return &viewRepository{db: db, reader: reader}
+}
+
+const viewSelect = `SELECT id, user_id, list, name, query, created_at, updated_at FROM saved_views`
+
+func scanView(row database.Scanner) (*SavedView, error) {
+	view := &SavedView{}
+	err := row.Scan(&view.ID, &view.UserID, &view.List, &view.Name, &view.Query, &view.CreatedAt, &view.UpdatedAt)
+	return view, err
+}
+
+func (r *viewRepository) Create(view *SavedView) error {
+	query := `INSERT INTO saved_views (id, user_id, list, name, query, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := r.db.Exec(query, view.ID, view.UserID, view.List, view.Name, view.Query, view.CreatedAt, view.UpdatedAt)
+	return err
+}
+
+func (r *viewRepository) Update(view *SavedView) error {
+	query := `UPDATE saved_views SET list = $3, name = $4, query = $5, updated_at = $6 WHERE id = $1 AND user_id = $2`
+	_, err := r.db.Exec(query, view.ID, view.UserID, view.List, view.Name, view.Query, view.UpdatedAt)
+	return err
+}
+
+func (r *viewRepository) ListForUser(userID, list string) ([]*SavedView, error) {
+	if list == "" {
+		return database.QueryAll(r.reader, "list saved views", scanView, viewSelect+` WHERE user_id = $1 ORDER BY list, name`, userID)
+	}
+	return database.QueryAll(r.reader, "list saved views", scanView, viewSelect+` WHERE user_id = $1 AND list = $2 ORDER BY name`, userID, list)
+}
+
+func (r *viewRepository) GetByID(userID, id string) (*SavedView, error) {
+	view, err := scanView(r.db.QueryRow(viewSelect+` WHERE user_id = $1 AND id = $2`, userID, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return view, err
+}
+
+func (r *viewRepository) Delete(userID, id string) error {
+	_, err := r.db.Exec(`DELETE FROM saved_views WHERE user_id = $1 AND id = $2`, userID, id)
+	return err
+}
+
+// SetViewRepository lets users save views of the admin lists. Set it before serving requests.
+func (s *UserService) SetViewRepository(views ViewRepository) {
+	s.views = views
+}
+
+var (
+	errViewNotFound  = apperrors.NotFound("VIEW_NOT_FOUND", "Saved view not found")
+	errViewNameTaken = apperrors.Conflict("VIEW_NAME_TAKEN", "A view with this name already exists for the list")
+)
+
+// normalizeViewQuery checks the query of a view of list and returns it in canonical form
+func normalizeViewQuery(list, raw string) (string, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return "", apperrors.Invalid("INVALID_VIEW_QUERY", "Query must be a URL query string")
+	}
+	target := viewLists[list]
+	for param := range query {
+		known := false
+		for _, p := range target.Params {
+			known = known || p == param
+		}
+		if !known {
+			return "", apperrors.Invalid("INVALID_VIEW_QUERY", fmt.Sprintf("The %s list does not understand %q; use %s", list, param, strings.Join(target.Params, ", ")))
+		}
+	}
+	if err := target.Check(query); err != nil {
+		return "", err
+	}
+	return query.Encode(), nil
+}
+
+// withHref sets the link that applies view to its list
+func withHref(view *SavedView) *SavedView {
+	view.Href = viewLists[view.List].Path
+	if view.Query != "" {
+		view.Href += "?" + view.Query
+	}
+	return view
+}
+
+// ListViews lists the views the user with the given Keycloak ID saved, of one list unless list
+// is empty
+func (s *UserService) ListViews(ctx context.Context, userID, list string) ([]*SavedView, error) {
+	if list != "" {
+		if _, ok := viewLists[list]; !ok {
+			return nil, apperrors.Invalid("INVALID_VIEW_LIST", "List must be one of "+strings.Join(savedViewListNames(), ", "))
+		}
+	}
+	if s.views == nil {
+		return []*SavedView{}, nil
+	}
+	views, err := s.views.ListForUser(userID, list)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to list saved views")
+		return nil, err
+	}
+	for _, view := range views {
+		withHref(view)
+	}
+	return views, nil
+}
+
+// GetView returns a view of the user with the given Keycloak ID
+func (s *UserService) GetView(ctx context.Context, userID, id string) (*SavedView, error) {
+	if s.views == nil {
+		return nil, errViewNotFound
+	}
+	view, err := s.views.GetByID(userID, id)
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to get saved view")
+		return nil, err
+	}
+	if view == nil {
+		return nil, errViewNotFound
+	}
+	return withHref(view), nil
+}
+
+// SaveView creates a view for the user with the given Keycloak ID, or replaces the view with id
+// when it is not empty. Names are unique per list.
+func (s *UserService) SaveView(ctx context.Context, userID, id string, req SaveViewRequest) (*SavedView, error) {
+	if err := validate.Struct(req); err != nil {
+		return nil, err
+	}
+	if s.views == nil {
+		return nil, apperrors.Unavailable("VIEWS_UNAVAILABLE", "Saved views are not available", nil)
+	}
+	query, err := normalizeViewQuery(req.List, req.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.views.ListForUser(userID, "")
+	if err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to list saved views")
+		return nil, err
+	}
+	var view *SavedView
+	for _, v := range existing {
+		if v.ID == id {
+			view = v
+		} else if v.List == req.List && strings.EqualFold(v.Name, req.Name) {
+			return nil, errViewNameTaken
+		}
+	}
+
+	now := time.Now()
+	switch {
+	case id == "":
+		if len(existing) >= MaxSavedViews {
+			return nil, apperrors.QuotaExceeded("TOO_MANY_VIEWS", fmt.Sprintf("At most %d views can be saved", MaxSavedViews))
+		}
+		view = &SavedView{ID: uuid.New().String(), UserID: userID, CreatedAt: now}
+	case view == nil:
+		return nil, errViewNotFound
+	}
+	view.List, view.Name, view.Query, view.UpdatedAt = req.List, req.Name, query, now
+
+	if id == "" {
+		err = s.views.Create(view)
+	} else {
+		err = s.views.Update(view)
+	}
+	if err != nil {
+		if dberrors.IsUniqueViolation(err) {
+			return nil, errViewNameTaken
+		}
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to save view")
+		return nil, err
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"user_id": userID, "view_id": view.ID}).Info("View saved")
+	return withHref(view), nil
+}
+
+// DeleteView deletes a view of the user with the given Keycloak ID
+func (s *UserService) DeleteView(ctx context.Context, userID, id string) error {
+	if _, err := s.GetView(ctx, userID, id); err != nil {
+		return err
+	}
+	if err := s.views.Delete(userID, id); err != nil {
+		s.logger.WithContext(ctx).WithError(err).Error("Failed to delete saved view")
+		return err
+	}
+	return nil
+}
+
+// savedViewListNames returns the names of the lists views can be saved for
+func savedViewListNames() []string {
+	names := make([]string, 0, len(viewLists))
+	for name := range viewLists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HTTP Handlers
+
+// GetViewsHandler handles GET /api/users/me/views, of one list with ?list=roles
+func GetViewsHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		views, err := service.ListViews(r.Context(), auth.UserID(r.Context()), r.URL.Query().Get("list"))
+		if err != nil {
+			writeServiceError(w, err, "Failed to list saved views")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(views, page), len(views), page)
+	}
+}
+
+// GetViewHandler handles GET /api/users/me/views/{id}
+func GetViewHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view, err := service.GetView(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["id"])
+		if err != nil {
+			writeServiceError(w, err, "Failed to get saved view")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+	}
+}
+
+// SaveViewHandler handles POST /api/users/me/views and PUT /api/users/me/views/{id}
+func SaveViewHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SaveViewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+
+		id := mux.Vars(r)["id"]
+		view, err := service.SaveView(r.Context(), auth.UserID(r.Context()), id, req)
+		if err != nil {
+			writeServiceError(w, err, "Failed to save view")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if id == "" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(view)
+	}
+}
+
+// DeleteViewHandler handles DELETE /api/users/me/views/{id}
+func DeleteViewHandler(service *UserService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := service.DeleteView(r.Context(), auth.UserID(r.Context()), mux.Vars(r)["id"]); err != nil {
+			writeServiceError(w, err, "Failed to delete saved view")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,180 @@
+package user_management
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"base-app/modules/notification"
+	"base-app/modules/rbac"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Newly registered users go through the welcome pipeline: ordered steps such as joining default
+// groups or sending a welcome email. A failing step is logged and the next one still runs; the
+// registration itself has already succeeded and is never undone by a step.
+
+// Built-in welcome steps, by the names used in configuration
+const (
+	// WelcomeDefaultGroups adds the user to the default groups and the groups mapped to their
+	// email domain
+	WelcomeDefaultGroups = "default_groups"
+	// WelcomeDefaultPreferences stores the configured default preferences as user attributes
+	WelcomeDefaultPreferences = "default_preferences"
+	// WelcomeEmail asks the notification channel to email the user a welcome message
+	WelcomeEmail = "welcome_email"
+	// WelcomeWebhook announces the registration to the notification webhook
+	WelcomeWebhook = "webhook"
+)
+
+// Notification types sent by the welcome steps
+const (
+	WelcomeEmailEvent   = "user.welcome_email"
+	UserRegisteredEvent = "user.registered"
+)
+
+// DefaultWelcomeSteps is the pipeline of a new UserService
+var DefaultWelcomeSteps = []string{WelcomeDefaultGroups}
+
+// welcomeStepTimeout bounds each step, so a hanging step cannot hold up registration
+const welcomeStepTimeout = 10 * time.Second
+
+// WelcomeStep is one step of the welcome pipeline
+type WelcomeStep struct {
+	Name string
+	Run  func(ctx context.Context, user *User) error
+}
+
+// WelcomeOptions configures the built-in welcome steps
+type WelcomeOptions struct {
+	// DefaultGroups are joined by every new user in the default_groups step, by name;
+	// rbac.RegisteredUsersGroup when nil
+	DefaultGroups []string
+	// Preferences are stored as attributes by the default_preferences step, keeping values the
+	// user already has
+	Preferences map[string]string
+	// Notifier delivers the welcome_email and webhook notifications
+	Notifier notification.Notifier
+}
+
+// WelcomeSteps builds the pipeline of the named built-in steps, in order
+func (s *UserService) WelcomeSteps(names []string, opts WelcomeOptions) ([]WelcomeStep, error) {
+	if opts.Notifier == nil {
+		opts.Notifier = notification.Nop{}
+	}
+	if opts.DefaultGroups == nil {
+		opts.DefaultGroups = []string{rbac.RegisteredUsersGroup}
+	}
+	steps := make([]WelcomeStep, 0, len(names))
+	for _, name := range names {
+		var run func(ctx context.Context, user *User) error
+		switch name {
+		case WelcomeDefaultGroups:
+			run = s.joinDefaultGroups(opts.DefaultGroups)
+		case WelcomeDefaultPreferences:
+			run = s.defaultPreferences(opts.Preferences)
+		case WelcomeEmail:
+			run = notifyRegistration(opts.Notifier, WelcomeEmailEvent, "Welcome")
+		case WelcomeWebhook:
+			run = notifyRegistration(opts.Notifier, UserRegisteredEvent, "New user registered")
+		default:
+			return nil, fmt.Errorf("unknown welcome step %q", name)
+		}
+		steps = append(steps, WelcomeStep{Name: name, Run: run})
+	}
+	return steps, nil
+}
+
+// SetWelcomeSteps replaces the welcome pipeline run after each registration. Set it before
+// serving requests.
+func (s *UserService) SetWelcomeSteps(steps ...WelcomeStep) {
+	s.welcome = steps
+}
+
+// runWelcome runs the welcome pipeline for a newly registered user. Steps outlive a cancelled
+// request, since the account exists either way, and neither an error nor a panic in one step
+// stops the others.
+func (s *UserService) runWelcome(ctx context.Context, user *User) {
+	ctx = context.WithoutCancel(ctx)
+	for _, step := range s.welcome {
+		if err := runWelcomeStep(ctx, step, user); err != nil {
+			s.logger.WithContext(ctx).WithError(err).WithFields(logrus.Fields{
+				"user_id": user.ID,
+				"step":    step.Name,
+			}).Warn("Welcome step failed")
+		}
+	}
+}
+
+func runWelcomeStep(ctx context.Context, step WelcomeStep, user *User) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, welcomeStepTimeout)
+	defer cancel()
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return step.Run(ctx, user)
+}
+
+// joinDefaultGroups returns the default_groups step joining groups and the groups mapped to the
+// user's email domain
+func (s *UserService) joinDefaultGroups(groups []string) func(ctx context.Context, user *User) error {
+	return func(ctx context.Context, user *User) error {
+		if s.groups == nil {
+			return nil
+		}
+		if len(groups) > 0 {
+			_, unknown, err := s.groups.JoinGroupsByName(ctx, user.KeycloakID, groups)
+			if err != nil {
+				return err
+			}
+			if len(unknown) > 0 {
+				s.logger.WithContext(ctx).WithField("groups", unknown).Warn("Default groups not found")
+			}
+		}
+		_, err := s.groups.ApplyDomainRules(ctx, user.KeycloakID, user.Email)
+		return err
+	}
+}
+
+// defaultPreferences returns the default_preferences step storing preferences
+func (s *UserService) defaultPreferences(preferences map[string]string) func(ctx context.Context, user *User) error {
+	return func(ctx context.Context, user *User) error {
+		if len(preferences) == 0 {
+			return nil
+		}
+		if user.Attributes == nil {
+			user.Attributes = make(map[string]string, len(preferences))
+		}
+		for key, value := range preferences {
+			if _, ok := user.Attributes[key]; !ok {
+				user.Attributes[key] = value
+			}
+		}
+		user.UpdatedAt = time.Now()
+		return s.repo.Update(user)
+	}
+}
+
+// notifyRegistration returns a step sending a notification of type about the new user
+func notifyRegistration(notifier notification.Notifier, notificationType, subject string) func(ctx context.Context, user *User) error {
+	return func(ctx context.Context, user *User) error {
+		return notifier.Notify(ctx, notification.Notification{
+			Type:     notificationType,
+			Severity: notification.SeverityInfo,
+			Subject:  subject,
+			Message:  fmt.Sprintf("%s registered.", user.Username),
+			Data: map[string]interface{}{
+				"user_id":     user.ID,
+				"keycloak_id": user.KeycloakID,
+				"username":    user.Username,
+				"email":       user.Email,
+				"first_name":  user.FirstName,
+				"last_name":   user.LastName,
+			},
+			OccurredAt: user.CreatedAt,
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Package apispec describes the API of the running binary: an OpenAPI document built from the
+// registered routes, their permissions and the request body schemas, and TypeScript types
+// generated from it. Both are served under the build version, so a frontend can pin the exact
+// API surface it was built against:
+//
+//	GET /api/client/{version}/openapi.json
+//	GET /api/client/{version}/index.d.ts
+//
+// The artifacts are generated once at startup, after every module registered its routes.
+package apispec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jsonschema"
+
+	"github.com/gorilla/mux"
+)
+
+// PathPrefix is where the artifacts are served
+const PathPrefix = "/api/client"
+
+// OpenAPIVersion is the OpenAPI release generated documents follow; 3.1 uses the JSON Schema
+// dialect of pkg/jsonschema
+const OpenAPIVersion = "3.1.0"
+
+// Info identifies the API described
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Document is the subset of an OpenAPI document generated here
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components Components                      `json:"components"`
+}
+
+// Components holds the request schemas, by struct name, and the bearer security scheme
+type Components struct {
+	Schemas         map[string]*jsonschema.Schema `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme     `json:"securitySchemes"`
+}
+
+// SecurityScheme describes how callers authenticate
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// Operation is one method of a path
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	// Permission is the permission the route requires, "" when a valid token is enough; absent
+	// on public routes and on routes that check permissions in their handler
+	Permission *string `json:"x-permission,omitempty"`
+}
+
+// Parameter is a path parameter
+type Parameter struct {
+	Name     string             `json:"name"`
+	In       string             `json:"in"`
+	Required bool               `json:"required"`
+	Schema   *jsonschema.Schema `json:"schema"`
+}
+
+// RequestBody references the schema of a JSON request body
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// MediaType references a component schema
+type MediaType struct {
+	Schema map[string]string `json:"schema"`
+}
+
+// PermissionFunc returns the permission a route was protected with, and false for public routes
+type PermissionFunc func(route *mux.Route) (string, bool)
+
+// bearerScheme is the name of the bearer token security scheme
+const bearerScheme = "bearerAuth"
+
+// pathParam matches the variables of a mux path template, with an optional pattern
+var pathParam = regexp.MustCompile(`\{([^}:]+)(?::[^}]*)?\}`)
+
+// Build describes the routes of r. Request bodies come from schemas and permissions from
+// permissionOf; routes registered without methods (such as path prefixes) are left out.
+func Build(r *mux.Router, schemas *jsonschema.Registry, permissionOf PermissionFunc, info Info) (*Document, error) {
+	doc := &Document{
+		OpenAPI: OpenAPIVersion,
+		Info:    info,
+		Paths:   map[string]map[string]Operation{},
+		Components: Components{
+			Schemas:         map[string]*jsonschema.Schema{},
+			SecuritySchemes: map[string]SecurityScheme{bearerScheme: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"}},
+		},
+	}
+	err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := pathParam.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			if method == http.MethodOptions || method == http.MethodHead {
+				continue
+			}
+			op := Operation{OperationID: operationID(method, path)}
+			for _, match := range pathParam.FindAllStringSubmatch(template, -1) {
+				op.Parameters = append(op.Parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: &jsonschema.Schema{Type: "string"}})
+			}
+			if permission, ok := permissionOf(route); ok {
+				op.Permission = &permission
+				op.Security = []map[string][]string{{bearerScheme: {}}}
+			}
+			if s, ok := schemas.Lookup(method, template); ok {
+				name := s.Title
+				if existing, taken := doc.Components.Schemas[name]; taken && !sameSchema(existing, s) {
+					return fmt.Errorf("apispec: two request schemas are named %s", name)
+				}
+				doc.Components.Schemas[name] = s
+				op.RequestBody = &RequestBody{Required: true, Content: map[string]MediaType{
+					"application/json": {Schema: map[string]string{"$ref": "#/components/schemas/" + name}},
+				}}
+			}
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = map[string]Operation{}
+			}
+			doc.Paths[path][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// sameSchema reports whether a and b describe the same body, e.g. one struct registered for two routes
+func sameSchema(a, b *jsonschema.Schema) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// operationID derives a stable camelCase name, e.g. "POST /api/rbac/roles/{id}" becomes
+// "postApiRbacRolesById"
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if strings.HasPrefix(segment, "{") {
+			b.WriteString("By")
+			segment = strings.Trim(segment, "{}")
+		}
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// Artifacts are the generated files of one build
+type Artifacts struct {
+	Version    string
+	OpenAPI    []byte
+	TypeScript []byte
+}
+
+// Generate renders doc as OpenAPI JSON and TypeScript
+func Generate(doc *Document) (*Artifacts, error) {
+	openapi, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return &Artifacts{Version: doc.Info.Version, OpenAPI: openapi, TypeScript: TypeScript(doc)}, nil
+}
+
+// Handler serves the artifacts at PathPrefix/{version}/; other versions are not known to this
+// build and answer 404
+func Handler(artifacts *Artifacts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if vars["version"] != artifacts.Version {
+			httpapi.WriteErrorResponse(w, http.StatusNotFound, "API version "+vars["version"]+" is not served by this build", "API_VERSION_NOT_FOUND",
+				map[string]string{"current": artifacts.Version})
+			return
+		}
+		var body []byte
+		switch vars["file"] {
+		case "openapi.json":
+			w.Header().Set("Content-Type", "application/json")
+			body = artifacts.OpenAPI
+		case "index.d.ts":
+			w.Header().Set("Content-Type", "application/typescript; charset=utf-8")
+			body = artifacts.TypeScript
+		default:
+			httpapi.WriteErrorResponse(w, http.StatusNotFound, "Unknown client artifact", "NOT_FOUND", nil)
+			return
+		}
+		// A version's artifacts never change, except for development builds
+		if artifacts.Version != "dev" {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		w.Write(body)
+	}
+}
+
+// Mount serves the artifacts; they are public, like the routes' existence itself
+func Mount(r *mux.Router, artifacts *Artifacts) {
+	r.HandleFunc(PathPrefix+"/{version}/{file}", Handler(artifacts)).Methods("GET")
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,97 @@
+package apispec
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"base-app/pkg/jsonschema"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type createRoleRequest struct {
+	Name        string   `json:"name" validate:"required,min=3,max=50"`
+	Description string   `json:"description" validate:"max=255"`
+	Kind        string   `json:"kind" validate:"omitempty,oneof=system custom"`
+	Permissions []string `json:"permission_ids" validate:"dive,uuid"`
+}
+
+func testRouter() (*mux.Router, *jsonschema.Registry, PermissionFunc) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	create := r.HandleFunc("/api/rbac/roles", noop).Methods("POST")
+	remove := r.HandleFunc("/api/rbac/roles/{id:[0-9a-f-]+}", noop).Methods("DELETE")
+	r.HandleFunc("/health", noop).Methods("GET")
+	r.PathPrefix("/static/")
+
+	schemas := jsonschema.NewRegistry()
+	schemas.Register("POST", "/api/rbac/roles", createRoleRequest{})
+	permissions := map[*mux.Route]string{create: "create_role", remove: "delete_role"}
+	return r, schemas, func(route *mux.Route) (string, bool) {
+		permission, ok := permissions[route]
+		return permission, ok
+	}
+}
+
+func TestBuildDescribesRoutes(t *testing.T) {
+	r, schemas, permissionOf := testRouter()
+	doc, err := Build(r, schemas, permissionOf, Info{Title: "Test", Version: "1.2.0"})
+	require.NoError(t, err)
+
+	assert.Len(t, doc.Paths, 3, "routes without methods are left out")
+	create := doc.Paths["/api/rbac/roles"]["post"]
+	assert.Equal(t, "postApiRbacRoles", create.OperationID)
+	require.NotNil(t, create.Permission)
+	assert.Equal(t, "create_role", *create.Permission)
+	assert.Equal(t, "#/components/schemas/createRoleRequest", create.RequestBody.Content["application/json"].Schema["$ref"])
+
+	remove, ok := doc.Paths["/api/rbac/roles/{id}"]["delete"]
+	require.True(t, ok, "path patterns are dropped")
+	assert.Equal(t, "deleteApiRbacRolesById", remove.OperationID)
+	assert.Equal(t, "id", remove.Parameters[0].Name)
+
+	assert.Nil(t, doc.Paths["/health"]["get"].Permission, "public routes carry no permission")
+}
+
+func TestTypeScript(t *testing.T) {
+	r, schemas, permissionOf := testRouter()
+	doc, err := Build(r, schemas, permissionOf, Info{Title: "Test", Version: "1.2.0"})
+	require.NoError(t, err)
+
+	ts := string(TypeScript(doc))
+	assert.Contains(t, ts, `export declare const API_VERSION = "1.2.0";`)
+	assert.Contains(t, ts, "export interface createRoleRequest {\n  description?: string;\n  kind?: \"\" | \"system\" | \"custom\";\n  name: string;\n  permission_ids?: string[];\n}")
+	assert.Contains(t, ts, `"POST /api/rbac/roles": { operationId: "postApiRbacRoles"; body: createRoleRequest; permission: "create_role" };`)
+	assert.Contains(t, ts, `"GET /health": { operationId: "getHealth"; body: never; permission: null };`)
+}
+
+func TestHandlerServesTheCurrentVersion(t *testing.T) {
+	r, schemas, permissionOf := testRouter()
+	doc, err := Build(r, schemas, permissionOf, Info{Title: "Test", Version: "1.2.0"})
+	require.NoError(t, err)
+	artifacts, err := Generate(doc)
+	require.NoError(t, err)
+	Mount(r, artifacts)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/client/1.2.0/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+	var served Document
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Equal(t, OpenAPIVersion, served.OpenAPI)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/client/1.2.0/index.d.ts", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "export interface ApiRoutes")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/client/1.1.0/index.d.ts", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "API_VERSION_NOT_FOUND")
+}
@@ -0,0 +1,123 @@
+package apispec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"base-app/pkg/jsonschema"
+)
+
+// identifier matches property names usable unquoted in TypeScript
+var identifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// TypeScript renders doc as a declaration file: an interface per request schema and an
+// ApiRoutes map from "METHOD /path" to the route's body type and permission
+func TypeScript(doc *Document) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Generated from the %s API, version %s. Do not edit.\n\n", doc.Info.Title, doc.Info.Version)
+	fmt.Fprintf(&b, "export declare const API_VERSION = %s;\n", quote(doc.Info.Version))
+
+	for _, name := range sortedKeys(doc.Components.Schemas) {
+		fmt.Fprintf(&b, "\nexport interface %s ", name)
+		writeObject(&b, doc.Components.Schemas[name], "")
+		b.WriteString("\n")
+	}
+
+	b.WriteString("\nexport interface ApiRoutes {\n")
+	for _, path := range sortedKeys(doc.Paths) {
+		operations := doc.Paths[path]
+		for _, method := range sortedKeys(operations) {
+			op := operations[method]
+			body := "never"
+			if op.RequestBody != nil {
+				ref := op.RequestBody.Content["application/json"].Schema["$ref"]
+				body = ref[strings.LastIndex(ref, "/")+1:]
+			}
+			permission := "null"
+			if op.Permission != nil {
+				permission = quote(*op.Permission)
+			}
+			fmt.Fprintf(&b, "  %s: { operationId: %s; body: %s; permission: %s };\n",
+				quote(strings.ToUpper(method)+" "+path), quote(op.OperationID), body, permission)
+		}
+	}
+	b.WriteString("}\n\nexport type ApiRoute = keyof ApiRoutes;\n")
+	return b.Bytes()
+}
+
+// tsType renders the TypeScript type of s
+func tsType(s *jsonschema.Schema, indent string) string {
+	if s == nil {
+		return "unknown"
+	}
+	if len(s.Enum) > 0 {
+		values := make([]string, len(s.Enum))
+		for i, value := range s.Enum {
+			encoded, _ := json.Marshal(value)
+			values[i] = string(encoded)
+		}
+		return strings.Join(values, " | ")
+	}
+	if len(s.AnyOf) > 0 {
+		types := make([]string, len(s.AnyOf))
+		for i, alternative := range s.AnyOf {
+			types[i] = tsType(alternative, indent)
+		}
+		return strings.Join(types, " | ")
+	}
+	switch s.Type {
+	case "string":
+		// omitempty fields accept the empty string besides their constrained values
+		if s.MaxLength != nil && *s.MaxLength == 0 {
+			return `""`
+		}
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		item := tsType(s.Items, indent)
+		if strings.Contains(item, " | ") {
+			item = "(" + item + ")"
+		}
+		return item + "[]"
+	case "object":
+		if len(s.Properties) == 0 {
+			return "Record<string, " + tsType(s.AdditionalProperties, indent) + ">"
+		}
+		var b bytes.Buffer
+		writeObject(&b, s, indent)
+		return b.String()
+	}
+	return "unknown"
+}
+
+// writeObject renders the properties of an object schema as a type literal
+func writeObject(b *bytes.Buffer, s *jsonschema.Schema, indent string) {
+	required := make(map[string]bool, len(s.Required))
+	for _, name := range s.Required {
+		required[name] = true
+	}
+	b.WriteString("{\n")
+	for _, name := range sortedKeys(s.Properties) {
+		key := name
+		if !identifier.MatchString(name) {
+			key = quote(name)
+		}
+		optional := "?"
+		if required[name] {
+			optional = ""
+		}
+		fmt.Fprintf(b, "%s  %s%s: %s;\n", indent, key, optional, tsType(s.Properties[name], indent+"  "))
+	}
+	b.WriteString(indent + "}")
+}
+
+func quote(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
@@ -0,0 +1,123 @@
+// Package apperrors defines the domain error types services return so handlers can map
+// them to HTTP status codes in one place instead of guessing from error strings
+package apperrors
+
+import "errors"
+
+// Kind classifies a domain error
+type Kind int
+
+const (
+	// KindUnknown is any error that is not an *Error
+	KindUnknown Kind = iota
+	// KindNotFound means the addressed resource does not exist
+	KindNotFound
+	// KindConflict means the request conflicts with the current state of the resource
+	KindConflict
+	// KindForbidden means the caller is not allowed to perform the operation
+	KindForbidden
+	// KindUnavailable means a dependency (database, identity provider) could not serve the request
+	KindUnavailable
+	// KindQuotaExceeded means the operation would exceed a licensed quota
+	KindQuotaExceeded
+	// KindUnauthorized means the caller could not be authenticated, e.g. wrong credentials
+	KindUnauthorized
+	// KindInvalid means the request was well-formed but a dependency rejected its content
+	KindInvalid
+	// KindInternal is a permanent failure the caller cannot fix, e.g. a misconfigured dependency
+	KindInternal
+	// KindTooLarge means the request carries more items than the server accepts at once
+	KindTooLarge
+)
+
+// Error is a domain error with a stable machine-readable code
+type Error struct {
+	Kind    Kind
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+// Unwrap exposes the underlying cause, if any
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NotFound returns a KindNotFound error
+func NotFound(code, message string) *Error {
+	return &Error{Kind: KindNotFound, Code: code, Message: message}
+}
+
+// Conflict returns a KindConflict error
+func Conflict(code, message string) *Error {
+	return &Error{Kind: KindConflict, Code: code, Message: message}
+}
+
+// Forbidden returns a KindForbidden error
+func Forbidden(code, message string) *Error {
+	return &Error{Kind: KindForbidden, Code: code, Message: message}
+}
+
+// Unavailable returns a KindUnavailable error wrapping the dependency failure
+func Unavailable(code, message string, err error) *Error {
+	return &Error{Kind: KindUnavailable, Code: code, Message: message, Err: err}
+}
+
+// QuotaExceeded returns a KindQuotaExceeded error
+func QuotaExceeded(code, message string) *Error {
+	return &Error{Kind: KindQuotaExceeded, Code: code, Message: message}
+}
+
+// Unauthorized returns a KindUnauthorized error
+func Unauthorized(code, message string) *Error {
+	return &Error{Kind: KindUnauthorized, Code: code, Message: message}
+}
+
+// Invalid returns a KindInvalid error
+func Invalid(code, message string) *Error {
+	return &Error{Kind: KindInvalid, Code: code, Message: message}
+}
+
+// Internal returns a KindInternal error wrapping the failure
+func Internal(code, message string, err error) *Error {
+	return &Error{Kind: KindInternal, Code: code, Message: message, Err: err}
+}
+
+// TooLarge returns a KindTooLarge error
+func TooLarge(code, message string) *Error {
+	return &Error{Kind: KindTooLarge, Code: code, Message: message}
+}
+
+// As returns the first *Error in err's chain
+func As(err error) (*Error, bool) {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr, true
+	}
+	return nil, false
+}
+
+// KindOf returns the Kind of the first *Error in err's chain, or KindUnknown
+func KindOf(err error) Kind {
+	if appErr, ok := As(err); ok {
+		return appErr.Kind
+	}
+	return KindUnknown
+}
+
+// IsNotFound reports whether err is a KindNotFound error
+func IsNotFound(err error) bool {
+	return KindOf(err) == KindNotFound
+}
+
+// IsConflict reports whether err is a KindConflict error
+func IsConflict(err error) bool {
+	return KindOf(err) == KindConflict
+}
@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"base-app/pkg/logging"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps entries in memory, oldest first
+type memoryStore struct {
+	entries []*Entry
+}
+
+func (s *memoryStore) Create(entry *Entry) error {
+	entry.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memoryStore) List(filter Filter, limit, offset int) ([]*Entry, int, error) {
+	var matching []*Entry
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		entry := s.entries[i]
+		if (filter.ActorID == "" || entry.ActorID == filter.ActorID) &&
+			(filter.ResourceType == "" || entry.ResourceType == filter.ResourceType) &&
+			(filter.Since.IsZero() || !entry.OccurredAt.Before(filter.Since)) {
+			matching = append(matching, entry)
+		}
+	}
+	total := len(matching)
+	if offset > total {
+		offset = total
+	}
+	if offset+limit < total {
+		matching = matching[offset : offset+limit]
+	} else {
+		matching = matching[offset:]
+	}
+	return matching, total, nil
+}
+
+func testLog() (*Log, *memoryStore) {
+	store := &memoryStore{}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	log := NewLog(store, logger)
+	log.now = func() time.Time { return time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC) }
+	return log, store
+}
+
+func TestRecordAttributesChangeToRequest(t *testing.T) {
+	log, store := testLog()
+	type role struct {
+		Name string `json:"name"`
+	}
+	handler := logging.RequestMiddleware(log.logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.SetUserID(r.Context(), "admin-1")
+		log.Record(r.Context(), ActionUpdate, "role", "role-1", &role{Name: "viewer"}, &role{Name: "reader"})
+		var absent *role
+		log.Record(r.Context(), ActionCreate, "role", "role-2", absent, &role{Name: "writer"})
+	}))
+	req := httptest.NewRequest("POST", "/api/rbac/roles/role-1", nil)
+	req.RemoteAddr = "192.0.2.7:51234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.Len(t, store.entries, 2)
+	updated := store.entries[0]
+	assert.Equal(t, "admin-1", updated.ActorID)
+	assert.Equal(t, "192.0.2.7", updated.ClientIP)
+	assert.JSONEq(t, `{"name":"viewer"}`, string(updated.Before))
+	assert.JSONEq(t, `{"name":"reader"}`, string(updated.After))
+	assert.Nil(t, store.entries[1].Before, "a nil pointer records no before")
+
+	// Outside a request the change is the system's
+	log.Record(httptest.NewRequest("GET", "/", nil).Context(), ActionDelete, "role", "role-1", &role{Name: "reader"}, nil)
+	assert.Equal(t, SystemActor, store.entries[2].ActorID)
+	assert.Empty(t, store.entries[2].ClientIP)
+}
+
+func TestListHandlerFiltersAndPages(t *testing.T) {
+	log, store := testLog()
+	store.entries = []*Entry{
+		{ActorID: "admin-1", Action: ActionCreate, ResourceType: "role", ResourceID: "r1", OccurredAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ActorID: "admin-1", Action: ActionCreate, ResourceType: "user", ResourceID: "u1", OccurredAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{ActorID: "admin-2", Action: ActionUpdate, ResourceType: "role", ResourceID: "r1", OccurredAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{ActorID: "admin-1", Action: ActionDelete, ResourceType: "role", ResourceID: "r2", OccurredAt: time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC)},
+	}
+
+	rec := httptest.NewRecorder()
+	ListHandler(log)(rec, httptest.NewRequest("GET", Path+"?actor_id=admin-1&resource_type=role&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var body struct {
+		Data []*Entry `json:"data"`
+		Meta struct {
+			Total int `json:"total"`
+		} `json:"meta"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, 2, body.Meta.Total)
+	require.Len(t, body.Data, 1)
+	assert.Equal(t, "r2", body.Data[0].ResourceID, "newest first")
+
+	rec = httptest.NewRecorder()
+	ListHandler(log)(rec, httptest.NewRequest("GET", Path+"?since=yesterday", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "since")
+}
@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"net/http"
+	"time"
+
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where the audit log is served
+const Path = "/api/audit"
+
+// ListHandler handles GET /api/audit?actor_id=...&action=update&resource_type=role&resource_id=...
+// &since=<RFC 3339>&until=<RFC 3339>, newest first
+func ListHandler(log *Log) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := Filter{
+			ActorID:      query.Get("actor_id"),
+			Action:       query.Get("action"),
+			ResourceType: query.Get("resource_type"),
+			ResourceID:   query.Get("resource_id"),
+		}
+		details := make(map[string]string)
+		for name, at := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+			if raw := query.Get(name); raw != "" {
+				parsed, err := time.Parse(time.RFC3339, raw)
+				if err != nil {
+					details[name] = "must be an RFC 3339 time such as 2024-01-02T15:04:05Z"
+					continue
+				}
+				*at = parsed
+			}
+		}
+		if len(details) > 0 {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid filter parameters", "VALIDATION_ERROR", details)
+			return
+		}
+
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		entries, total, err := log.List(r.Context(), filter, page)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list audit log")
+			return
+		}
+		if entries == nil {
+			entries = []*Entry{}
+		}
+		httpapi.WriteList(w, r, entries, total, page)
+	}
+}
+
+// Mount registers the audit log endpoint at Path, wrapped by protect
+func Mount(r *mux.Router, log *Log, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(ListHandler(log))).Methods("GET")
+}
@@ -0,0 +1,105 @@
+package audit
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"base-app/pkg/database"
+)
+
+// Store keeps audit log entries. The Postgres store expects this table:
+//
+//	CREATE TABLE audit_logs (
+//		id BIGSERIAL PRIMARY KEY,
+//		actor_id VARCHAR NOT NULL,
+//		action VARCHAR(20) NOT NULL,
+//		resource_type VARCHAR(50) NOT NULL,
+//		resource_id VARCHAR NOT NULL,
+//		before JSONB,
+//		after JSONB,
+//		client_ip VARCHAR NOT NULL DEFAULT '',
+//		occurred_at TIMESTAMP NOT NULL
+//	)
+type Store interface {
+	// Create stores entry and sets its ID
+	Create(entry *Entry) error
+	// List returns one page of the entries matching filter, newest first, and their number
+	List(filter Filter, limit, offset int) ([]*Entry, int, error)
+}
+
+// store implements Store on Postgres
+type store struct {
+	db database.DBTX
+}
+
+// NewStore creates a Postgres audit store
+func NewStore(db *sql.DB) Store {
+	return &store{db: db}
+}
+
+func scanEntry(row database.Scanner) (*Entry, error) {
+	entry := &Entry{}
+	var before, after []byte
+	err := row.Scan(&entry.ID, &entry.ActorID, &entry.Action, &entry.ResourceType, &entry.ResourceID, &before, &after, &entry.ClientIP, &entry.OccurredAt)
+	entry.Before, entry.After = before, after
+	return entry, err
+}
+
+// nullJSON stores an absent payload as NULL
+func nullJSON(data []byte) interface{} {
+	if data == nil {
+		return nil
+	}
+	return string(data)
+}
+
+func (s *store) Create(entry *Entry) error {
+	query := `INSERT INTO audit_logs (actor_id, action, resource_type, resource_id, before, after, client_ip, occurred_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	return s.db.QueryRow(query, entry.ActorID, entry.Action, entry.ResourceType, entry.ResourceID,
+		nullJSON(entry.Before), nullJSON(entry.After), entry.ClientIP, entry.OccurredAt).Scan(&entry.ID)
+}
+
+func (s *store) List(filter Filter, limit, offset int) ([]*Entry, int, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.ActorID != "" {
+		where("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.ResourceType != "" {
+		where("resource_type = $%d", filter.ResourceType)
+	}
+	if filter.ResourceID != "" {
+		where("resource_id = $%d", filter.ResourceID)
+	}
+	if !filter.Since.IsZero() {
+		where("occurred_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("occurred_at < $%d", filter.Until)
+	}
+	clause := ""
+	if len(conditions) > 0 {
+		clause = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM audit_logs`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	query := fmt.Sprintf(`SELECT id, actor_id, action, resource_type, resource_id, before, after, client_ip, occurred_at
+	          FROM audit_logs%s ORDER BY occurred_at DESC, id DESC LIMIT $%d OFFSET $%d`, clause, len(args)+1, len(args)+2)
+	entries, err := database.QueryAll(s.db, "list audit log", scanEntry, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,55 @@
+// Package authevents defines the failed-authentication events that modules report so that
+// cross-cutting consumers (anomaly detection, auditing) can observe them without import cycles
+package authevents
+
+import (
+	"context"
+	"time"
+)
+
+// Failure kinds
+const (
+	// KindInvalidToken covers missing, malformed, expired or otherwise rejected bearer tokens (401)
+	KindInvalidToken = "invalid_token"
+	// KindForbidden is a valid token lacking the required permission (403)
+	KindForbidden = "forbidden"
+	// KindLoginFailed is a rejected username/password login
+	KindLoginFailed = "login_failed"
+	// KindLockout is a login refused because the account or client is locked out
+	KindLockout = "lockout"
+	// KindRefreshTokenReuse is a rotated refresh token presented again, a sign it was stolen
+	KindRefreshTokenReuse = "refresh_token_reuse"
+)
+
+// Failure describes one failed authentication or authorization attempt
+type Failure struct {
+	Kind string
+	// Code is the API error code returned to the client, e.g. TOKEN_EXPIRED
+	Code string
+	// UserID is set when the caller could be identified (e.g. a 403 with a valid token)
+	UserID string
+	// Username is the login name attempted, for login failures
+	Username string
+	IP       string
+	Path     string
+	At       time.Time
+}
+
+// Observer receives failures. Implementations must be fast and must not block the request.
+type Observer func(ctx context.Context, failure Failure)
+
+// Observers fans a failure out to several observers
+type Observers []Observer
+
+// Notify calls every observer with failure, stamping the time if unset
+func (o Observers) Notify(ctx context.Context, failure Failure) {
+	if len(o) == 0 {
+		return
+	}
+	if failure.At.IsZero() {
+		failure.At = time.Now()
+	}
+	for _, observe := range o {
+		observe(ctx, failure)
+	}
+}
@@ -0,0 +1,246 @@
+// Package avatar gives every user one stable avatar URL. Users without an uploaded picture get
+// their Gravatar, fetched server-side so browsers never reveal the email hash to Gravatar, or an
+// identicon generated from their ID. Images are cached in memory per instance, so Gravatar is
+// asked at most once per TTL for each user and size.
+package avatar
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"base-app/pkg/outbound"
+)
+
+// DefaultGravatarURL is the Gravatar image endpoint
+const DefaultGravatarURL = "https://www.gravatar.com/avatar/"
+
+// Size bounds in pixels
+const (
+	DefaultSize = 80
+	MinSize     = 16
+	MaxSize     = 512
+)
+
+// maxImageBytes bounds the Gravatar responses accepted
+const maxImageBytes = 1 << 20
+
+// failureTTL is how long the identicon served because Gravatar failed is kept, so an outage
+// is retried soon without asking on every request
+const failureTTL = time.Minute
+
+// maxCached bounds memory use; beyond it expired entries are swept and, if that is not enough,
+// the cache starts over
+const maxCached = 5000
+
+// Image is an avatar ready to serve
+type Image struct {
+	ContentType string
+	Body        []byte
+	ETag        string
+}
+
+func newImage(contentType string, body []byte) *Image {
+	sum := sha256.Sum256(body)
+	return &Image{ContentType: contentType, Body: body, ETag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+}
+
+// Options configures a Service
+type Options struct {
+	// Gravatar enables the Gravatar lookup; when false, only identicons are served and no email
+	// hash leaves the server
+	Gravatar bool
+	// GravatarURL is the image endpoint, DefaultGravatarURL when empty
+	GravatarURL string
+	// TTL is how long images are cached here and by browsers
+	TTL time.Duration
+}
+
+type cached struct {
+	image   *Image
+	expires time.Time
+}
+
+// Service resolves and caches avatars
+type Service struct {
+	opts   Options
+	client *http.Client
+	now    func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cached
+}
+
+// New creates a Service
+func New(opts Options) *Service {
+	if opts.GravatarURL == "" {
+		opts.GravatarURL = DefaultGravatarURL
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = 24 * time.Hour
+	}
+	return &Service{
+		opts:   opts,
+		client: outbound.Client(outbound.Gravatar),
+		now:    time.Now,
+		cache:  make(map[string]cached),
+	}
+}
+
+// TTL is how long served images may be cached
+func (s *Service) TTL() time.Duration {
+	return s.opts.TTL
+}
+
+// ClampSize returns size within the supported bounds, DefaultSize when unset
+func ClampSize(size int) int {
+	switch {
+	case size <= 0:
+		return DefaultSize
+	case size < MinSize:
+		return MinSize
+	case size > MaxSize:
+		return MaxSize
+	}
+	return size
+}
+
+// gravatarHash is the Gravatar key of an email address
+func gravatarHash(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the avatar of the user identified by seed (a stable ID) with the given email
+func (s *Service) Get(ctx context.Context, seed, email string, size int) *Image {
+	size = ClampSize(size)
+	hash := ""
+	if s.opts.Gravatar && email != "" {
+		hash = gravatarHash(email)
+	}
+	key := seed + "|" + hash + "|" + strconv.Itoa(size)
+	now := s.now()
+
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.image
+	}
+
+	image, ttl := s.resolve(ctx, seed, hash, size)
+	s.mu.Lock()
+	if len(s.cache) >= maxCached {
+		s.sweep(now)
+	}
+	s.cache[key] = cached{image: image, expires: now.Add(ttl)}
+	s.mu.Unlock()
+	return image
+}
+
+// resolve fetches the Gravatar of hash, falling back to an identicon, and says how long to keep it
+func (s *Service) resolve(ctx context.Context, seed, hash string, size int) (*Image, time.Duration) {
+	if hash == "" {
+		return Identicon(seed, size), s.opts.TTL
+	}
+	image, err := s.gravatar(ctx, hash, size)
+	if err != nil {
+		return Identicon(seed, size), failureTTL
+	}
+	if image == nil {
+		return Identicon(seed, size), s.opts.TTL
+	}
+	return image, s.opts.TTL
+}
+
+// gravatar fetches the Gravatar of hash; it returns nil when the address has none
+func (s *Service) gravatar(ctx context.Context, hash string, size int) (*Image, error) {
+	url := fmt.Sprintf("%s%s?s=%d&d=404", s.opts.GravatarURL, hash, size)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gravatar returned status %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("gravatar returned %q", contentType)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes))
+	if err != nil {
+		return nil, err
+	}
+	return newImage(contentType, body), nil
+}
+
+// sweep drops expired entries, or everything when none have expired. The caller holds mu.
+func (s *Service) sweep(now time.Time) {
+	for key, entry := range s.cache {
+		if !now.Before(entry.expires) {
+			delete(s.cache, key)
+		}
+	}
+	if len(s.cache) >= maxCached {
+		s.cache = make(map[string]cached)
+	}
+}
+
+// Identicon draws a symmetric 5x5 pattern in a colour derived from seed, as an SVG image
+func Identicon(seed string, size int) *Image {
+	size = ClampSize(size)
+	sum := sha256.Sum256([]byte(seed))
+	hue := int(sum[0]) * 360 / 256
+	color := fmt.Sprintf("hsl(%d,55%%,50%%)", hue)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 5 5" shape-rendering="crispEdges">`, size, size)
+	b.WriteString(`<rect width="5" height="5" fill="#f0f0f0"/>`)
+	// The left three columns come from the hash and are mirrored onto the right two
+	for row := 0; row < 5; row++ {
+		for col := 0; col < 3; col++ {
+			if sum[1+row*3+col]&1 == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, col, row, color)
+			if col < 2 {
+				fmt.Fprintf(&b, `<rect x="%d" y="%d" width="1" height="1" fill="%s"/>`, 4-col, row, color)
+			}
+		}
+	}
+	b.WriteString(`</svg>`)
+	return newImage("image/svg+xml", b.Bytes())
+}
+
+// Write serves image with caching headers, answering conditional requests with 304
+func Write(w http.ResponseWriter, r *http.Request, image *Image, maxAge time.Duration) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("ETag", image.ETag)
+	if r.Header.Get("If-None-Match") == image.ETag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", image.ContentType)
+	// SVG identicons are static, but keep any script in a fetched image from running
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(image.Body)
+}
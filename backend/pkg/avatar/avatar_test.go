@@ -0,0 +1,73 @@
+package avatar
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPrefersGravatarAndCaches(t *testing.T) {
+	var requests []string
+	gravatar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+		if r.URL.Path != "/"+gravatarHash("alice@example.com") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer gravatar.Close()
+
+	avatars := New(Options{Gravatar: true, GravatarURL: gravatar.URL + "/", TTL: time.Hour})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	avatars.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	image := avatars.Get(ctx, "user-1", " Alice@Example.com", 0)
+	assert.Equal(t, "image/png", image.ContentType)
+	assert.Equal(t, "png", string(image.Body))
+	avatars.Get(ctx, "user-1", "alice@example.com", 0)
+	assert.Equal(t, []string{"/" + gravatarHash("alice@example.com") + "?s=80&d=404"}, requests, "the second request is served from the cache")
+
+	image = avatars.Get(ctx, "user-2", "bob@example.com", 1000)
+	assert.Equal(t, "image/svg+xml", image.ContentType, "users without a Gravatar get an identicon")
+	assert.Contains(t, requests[1], "s=512", "sizes are clamped")
+
+	now = now.Add(2 * time.Hour)
+	avatars.Get(ctx, "user-1", "alice@example.com", 0)
+	assert.Len(t, requests, 3, "expired entries are fetched again")
+
+	private := New(Options{Gravatar: false, GravatarURL: gravatar.URL + "/"})
+	assert.Equal(t, "image/svg+xml", private.Get(ctx, "user-1", "alice@example.com", 0).ContentType)
+	assert.Len(t, requests, 3, "Gravatar is not contacted when disabled")
+}
+
+func TestIdenticonIsStable(t *testing.T) {
+	a, b := Identicon("user-1", 64), Identicon("user-1", 64)
+	assert.Equal(t, a.Body, b.Body)
+	assert.NotEqual(t, a.ETag, Identicon("user-2", 64).ETag)
+	assert.True(t, strings.HasPrefix(string(a.Body), `<svg xmlns="http://www.w3.org/2000/svg" width="64" height="64"`))
+}
+
+func TestWriteAnswersConditionalRequests(t *testing.T) {
+	image := Identicon("user-1", 0)
+
+	w := httptest.NewRecorder()
+	Write(w, httptest.NewRequest(http.MethodGet, "/avatar", nil), image, time.Hour)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	assert.Equal(t, image.ETag, w.Header().Get("ETag"))
+
+	r := httptest.NewRequest(http.MethodGet, "/avatar", nil)
+	r.Header.Set("If-None-Match", image.ETag)
+	w = httptest.NewRecorder()
+	Write(w, r, image, time.Hour)
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.Bytes())
+}
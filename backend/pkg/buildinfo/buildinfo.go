@@ -0,0 +1,89 @@
+// Package buildinfo exposes the version, git SHA and build time stamped into the binary.
+//
+// Values are set at link time, e.g.
+//
+//	go build -ldflags "-X base-app/pkg/buildinfo.Version=1.4.0 \
+//	  -X base-app/pkg/buildinfo.GitSHA=$(git rev-parse HEAD) \
+//	  -X base-app/pkg/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// When they are not, the VCS information recorded by the Go toolchain is used as a fallback.
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set via -ldflags "-X ..."
+var (
+	Version   = "dev"
+	GitSHA    = ""
+	BuildTime = ""
+)
+
+// Path is where the build information is served
+const Path = "/api/version"
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// Get returns the build information for the running binary
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		GitSHA:    GitSHA,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.GitSHA == "" {
+					info.GitSHA = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildTime == "" {
+					info.BuildTime = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	if info.GitSHA == "" {
+		info.GitSHA = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+// Fields returns the build information as log fields
+func (i Info) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"version":    i.Version,
+		"git_sha":    i.GitSHA,
+		"build_time": i.BuildTime,
+		"go_version": i.GoVersion,
+	}
+}
+
+// Handler handles GET /api/version with the build information of the running binary
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	}
+}
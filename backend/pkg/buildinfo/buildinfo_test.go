@@ -0,0 +1,47 @@
+package buildinfo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetUsesLinkerValues(t *testing.T) {
+	defer func(v, sha, bt string) { Version, GitSHA, BuildTime = v, sha, bt }(Version, GitSHA, BuildTime)
+	Version, GitSHA, BuildTime = "1.2.3", "abc123", "2024-01-02T03:04:05Z"
+
+	info := Get()
+
+	assert.Equal(t, "1.2.3", info.Version)
+	assert.Equal(t, "abc123", info.GitSHA)
+	assert.Equal(t, "2024-01-02T03:04:05Z", info.BuildTime)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.Equal(t, "abc123", info.Fields()["git_sha"])
+}
+
+func TestGetFillsUnknowns(t *testing.T) {
+	info := Get()
+
+	assert.NotEmpty(t, info.Version)
+	assert.NotEmpty(t, info.GitSHA)
+	assert.NotEmpty(t, info.BuildTime)
+}
+
+func TestHandlerServesBuildInfo(t *testing.T) {
+	defer func(v, sha, bt string) { Version, GitSHA, BuildTime = v, sha, bt }(Version, GitSHA, BuildTime)
+	Version, GitSHA, BuildTime = "1.2.3", "abc123", "2024-01-02T03:04:05Z"
+
+	w := httptest.NewRecorder()
+	Handler()(w, httptest.NewRequest(http.MethodGet, Path, nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var info Info
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	assert.Equal(t, Info{Version: "1.2.3", GitSHA: "abc123", BuildTime: "2024-01-02T03:04:05Z", GoVersion: runtime.Version(), Modified: info.Modified}, info)
+}
@@ -0,0 +1,229 @@
+// Package captcha slows credential stuffing: once logins keep failing from one IP or against
+// one account, further attempts must carry a solved challenge (reCAPTCHA or hCaptcha), verified
+// server-side. Failures are counted in memory per instance, which is enough to make automated
+// guessing expensive without locking legitimate users out.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"base-app/pkg/outbound"
+)
+
+// Providers and their server-side verification endpoints
+const (
+	Recaptcha = "recaptcha"
+	HCaptcha  = "hcaptcha"
+
+	RecaptchaVerifyURL = "https://www.google.com/recaptcha/api/siteverify"
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+)
+
+var (
+	// ErrRequired means the attempt needs a challenge response but carried none
+	ErrRequired = errors.New("captcha required")
+	// ErrInvalid means the provider rejected the challenge response
+	ErrInvalid = errors.New("captcha invalid")
+)
+
+// maxTracked bounds memory use; beyond it subjects without recent failures are swept
+const maxTracked = 10000
+
+// Verifier checks a challenge response a client obtained from the provider
+type Verifier interface {
+	// Verify returns ErrInvalid (possibly wrapped) when response is not a valid solution
+	Verify(ctx context.Context, response, remoteIP string) error
+}
+
+// SiteVerifier verifies responses with a siteverify endpoint, the protocol both reCAPTCHA and
+// hCaptcha implement
+type SiteVerifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewSiteVerifier creates a verifier posting to verifyURL with the provider secret
+func NewSiteVerifier(verifyURL, secret string) *SiteVerifier {
+	return &SiteVerifier{
+		url:    verifyURL,
+		secret: secret,
+		client: outbound.Client(outbound.Captcha),
+	}
+}
+
+// New creates the verifier of provider (Recaptcha or HCaptcha)
+func New(provider, secret string) (*SiteVerifier, error) {
+	switch provider {
+	case Recaptcha:
+		return NewSiteVerifier(RecaptchaVerifyURL, secret), nil
+	case HCaptcha:
+		return NewSiteVerifier(HCaptchaVerifyURL, secret), nil
+	default:
+		return nil, fmt.Errorf("unknown captcha provider %q", provider)
+	}
+}
+
+// Verify implements Verifier
+func (v *SiteVerifier) Verify(ctx context.Context, response, remoteIP string) error {
+	form := url.Values{"secret": {v.secret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verification returned %s", resp.Status)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decode captcha verification: %w", err)
+	}
+	if !result.Success {
+		if len(result.ErrorCodes) > 0 {
+			return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(result.ErrorCodes, ", "))
+		}
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Thresholds configure when a challenge is required
+type Thresholds struct {
+	// Window is the sliding window failures are counted in
+	Window time.Duration
+	// PerIP and PerAccount are the failures within Window after which attempts from the IP or
+	// against the account need a challenge (0 disables)
+	PerIP      int
+	PerAccount int
+}
+
+// Guard decides when login attempts need a challenge and verifies it
+type Guard struct {
+	verifier   Verifier
+	thresholds Thresholds
+	now        func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// NewGuard creates a guard verifying challenges with verifier
+func NewGuard(verifier Verifier, thresholds Thresholds) *Guard {
+	return &Guard{
+		verifier:   verifier,
+		thresholds: thresholds,
+		now:        time.Now,
+		failures:   make(map[string][]time.Time),
+	}
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func accountKey(account string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(account))
+}
+
+// Required reports whether an attempt from ip against account needs a challenge
+func (g *Guard) Required(ip, account string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	return g.exceeded(ipKey(ip), g.thresholds.PerIP, now) || g.exceeded(accountKey(account), g.thresholds.PerAccount, now)
+}
+
+// Check lets an attempt through when no challenge is required or response solves one
+func (g *Guard) Check(ctx context.Context, ip, account, response string) error {
+	if !g.Required(ip, account) {
+		return nil
+	}
+	if response == "" {
+		return ErrRequired
+	}
+	return g.verifier.Verify(ctx, response, ip)
+}
+
+// Failed records a failed attempt from ip against account
+func (g *Guard) Failed(ip, account string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if ip != "" && g.thresholds.PerIP > 0 {
+		g.record(ipKey(ip), now)
+	}
+	if account != "" && g.thresholds.PerAccount > 0 {
+		g.record(accountKey(account), now)
+	}
+	if len(g.failures) > maxTracked {
+		g.sweep(now)
+	}
+}
+
+// Succeeded forgets the failures against account once its owner has logged in. Failures from
+// the IP are kept, since one success does not vouch for the other accounts it tried.
+func (g *Guard) Succeeded(account string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, accountKey(account))
+}
+
+// exceeded reports whether key has threshold failures in the window; callers hold g.mu
+func (g *Guard) exceeded(key string, threshold int, now time.Time) bool {
+	if threshold <= 0 {
+		return false
+	}
+	return len(g.recent(key, now)) >= threshold
+}
+
+// recent drops failures of key outside the window and returns the rest; callers hold g.mu
+func (g *Guard) recent(key string, now time.Time) []time.Time {
+	failures := g.failures[key]
+	windowStart := now.Add(-g.thresholds.Window)
+	kept := failures[:0]
+	for _, at := range failures {
+		if at.After(windowStart) {
+			kept = append(kept, at)
+		}
+	}
+	if len(kept) == 0 {
+		delete(g.failures, key)
+		return nil
+	}
+	g.failures[key] = kept
+	return kept
+}
+
+// record adds a failure of key; callers hold g.mu
+func (g *Guard) record(key string, now time.Time) {
+	g.failures[key] = append(g.recent(key, now), now)
+}
+
+// sweep drops subjects with no failures in the window; callers hold g.mu
+func (g *Guard) sweep(now time.Time) {
+	for key := range g.failures {
+		g.recent(key, now)
+	}
+}
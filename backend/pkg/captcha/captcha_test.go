@@ -0,0 +1,78 @@
+package captcha
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type verifierFunc func(ctx context.Context, response, remoteIP string) error
+
+func (f verifierFunc) Verify(ctx context.Context, response, remoteIP string) error {
+	return f(ctx, response, remoteIP)
+}
+
+func TestGuardRequiresChallengeAfterFailures(t *testing.T) {
+	var verified []string
+	guard := NewGuard(verifierFunc(func(_ context.Context, response, _ string) error {
+		verified = append(verified, response)
+		if response != "solved" {
+			return ErrInvalid
+		}
+		return nil
+	}), Thresholds{Window: time.Minute, PerIP: 3, PerAccount: 2})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	guard.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	guard.Failed("10.0.0.1", "alice")
+	assert.NoError(t, guard.Check(ctx, "10.0.0.1", "alice", ""))
+
+	guard.Failed("10.0.0.1", "Alice")
+	assert.ErrorIs(t, guard.Check(ctx, "10.0.0.2", "alice", ""), ErrRequired, "accounts are counted case-insensitively from any IP")
+	assert.ErrorIs(t, guard.Check(ctx, "10.0.0.2", "alice", "wrong"), ErrInvalid)
+	assert.NoError(t, guard.Check(ctx, "10.0.0.2", "alice", "solved"))
+	assert.Equal(t, []string{"wrong", "solved"}, verified)
+
+	guard.Failed("10.0.0.1", "bob")
+	assert.True(t, guard.Required("10.0.0.1", "carol"), "the IP reached its threshold")
+
+	guard.Succeeded("alice")
+	assert.False(t, guard.Required("10.0.0.2", "alice"), "a successful login clears the account")
+	assert.True(t, guard.Required("10.0.0.1", "alice"), "but not the IP")
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, guard.Required("10.0.0.1", "bob"), "failures outside the window do not count")
+}
+
+func TestSiteVerifier(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "secret", r.PostForm.Get("secret"))
+		assert.Equal(t, "10.0.0.1", r.PostForm.Get("remoteip"))
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostForm.Get("response") == "solved" {
+			w.Write([]byte(`{"success": true}`))
+			return
+		}
+		w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+	}))
+	defer server.Close()
+
+	verifier := NewSiteVerifier(server.URL, "secret")
+	ctx := context.Background()
+	assert.NoError(t, verifier.Verify(ctx, "solved", "10.0.0.1"))
+
+	err := verifier.Verify(ctx, "guessed", "10.0.0.1")
+	assert.True(t, errors.Is(err, ErrInvalid))
+	assert.Contains(t, err.Error(), "invalid-input-response")
+
+	_, err = New("turnstile", "secret")
+	assert.Error(t, err)
+}
@@ -0,0 +1,943 @@
+// Package config loads the application configuration from environment variables
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"base-app/pkg/redact"
+)
+
+// DatabaseConfig holds the primary connection settings and optional read replicas
+type DatabaseConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+
+	// ReplicaDSNs lists connection strings for read replicas; reads fall back to the primary when empty
+	ReplicaDSNs []string
+	// ReplicaHealthCheckInterval controls how often the primary and replicas are pinged; a lost
+	// primary is re-checked sooner until it recovers
+	ReplicaHealthCheckInterval time.Duration
+	// ConnectTimeout is how long startup waits for the primary to accept connections
+	ConnectTimeout time.Duration
+
+	// SlowQueryThreshold logs statements running at least this long (0 disables)
+	SlowQueryThreshold time.Duration
+	// StatementTimeout is each request's statement budget: transactions begun for a request set
+	// it as their LOCAL statement_timeout, cut down to what is left of the request's deadline
+	// (0 leaves just the deadline)
+	StatementTimeout time.Duration
+	// ConnStatementTimeout is set as statement_timeout on every pooled connection, aborting any
+	// single statement running longer than this on the server, including those run outside a
+	// request; it defaults to StatementTimeout (0 disables)
+	ConnStatementTimeout time.Duration
+
+	// Ephemeral starts a throwaway Postgres for demo runs instead of connecting to Host and Port:
+	// "embedded" runs the local Postgres binaries, "docker" a container. Data is lost on exit.
+	Ephemeral string
+
+	// SchemaDrift is what startup does when tables differ from the schema the application
+	// creates: "warn" logs the differences, "fail" refuses to start, "off" skips the check
+	SchemaDrift string
+	// Migrate is what startup does with pending schema migrations: "up" applies them, "check"
+	// refuses to start until they are applied, "off" skips them
+	Migrate string
+}
+
+// PrimaryDSN builds the connection string for the primary database
+func (c DatabaseConfig) PrimaryDSN() string {
+	return "host=" + c.Host + " port=" + c.Port + " user=" + c.User + " password=" + c.Password + " dbname=" + c.Name + " sslmode=" + c.SSLMode
+}
+
+// LoggingConfig controls log output
+type LoggingConfig struct {
+	// Level is the default level (debug, info, warn, error)
+	Level string
+	// Format is "json" or "text"
+	Format string
+	// ModuleLevels overrides Level per module, e.g. {"rbac": "debug"}
+	ModuleLevels map[string]string
+	// ThrottleWindow and ThrottleBurst limit identical warnings/errors to ThrottleBurst per window (0 disables)
+	ThrottleWindow time.Duration
+	ThrottleBurst  int
+}
+
+// ErrorReportingConfig configures the external error tracker
+type ErrorReportingConfig struct {
+	// SentryDSN enables Sentry reporting when set
+	SentryDSN string
+	// Environment tags reported events, e.g. "production"
+	Environment string
+}
+
+// SecretsConfig selects an external secret manager for credentials. When Provider is empty,
+// credentials come from environment variables and keycloak.json as before.
+type SecretsConfig struct {
+	// Provider is "", "vault" or "aws"
+	Provider string
+	// RefreshInterval controls how often secrets are re-fetched to pick up rotations
+	RefreshInterval time.Duration
+	// DatabaseSecret holds "username" and "password" for the primary database
+	DatabaseSecret string
+	// KeycloakSecret holds "client_secret", "admin_username" and "admin_password", and optionally "url", "realm" and "client_id"
+	KeycloakSecret string
+	// JWTSecret holds "secret", the HMAC key used to verify access tokens
+	JWTSecret string
+	// EncryptionSecret holds "primary", the ID of the active column encryption key, and
+	// base64-encoded keys by ID
+	EncryptionSecret string
+
+	VaultMount  string
+	AWSRegion   string
+	AWSEndpoint string
+}
+
+// EncryptionConfig configures encryption at rest of sensitive user columns. Keys come from
+// Keys or, when set, the secret named by SecretsConfig.EncryptionSecret; with neither the
+// columns are stored in plaintext.
+type EncryptionConfig struct {
+	// Keys maps key IDs to base64-encoded 256-bit keys, e.g. {"2024-01": "..."}
+	Keys map[string]string
+	// PrimaryKey is the ID of the key new values are encrypted with; older keys only decrypt
+	PrimaryKey string
+	// ReencryptBatchSize is the number of rows re-encrypted per batch after a key rotation
+	ReencryptBatchSize int
+}
+
+// CompressionConfig controls gzip/deflate compression of JSON responses
+type CompressionConfig struct {
+	Enabled bool
+	// MinSize is the smallest response body, in bytes, that is compressed
+	MinSize int
+	// Level is the compression level from 1 (fastest) to 9 (smallest); 0 uses the default
+	Level int
+	// RouteMinSize overrides MinSize per route path template, e.g. {"/api/rbac/permissions": 256};
+	// a negative size turns compression off for the route
+	RouteMinSize map[string]int
+}
+
+// UsageConfig controls API usage recording
+type UsageConfig struct {
+	// FlushInterval is how often recorded counts are written to the usage rollup table
+	FlushInterval time.Duration
+}
+
+// DenylistConfig controls the token denylist used to revoke access tokens before they expire
+type DenylistConfig struct {
+	// TokenLifetime is how long a denylist entry is kept; it must cover the longest access token lifetime
+	TokenLifetime time.Duration
+	// RefreshInterval controls how often entries added by other instances are loaded
+	RefreshInterval time.Duration
+}
+
+// PermissionCacheConfig controls caching of resolved user permissions between requests
+type PermissionCacheConfig struct {
+	// TTL bounds how long changes made on other instances, and expired memberships, take to apply;
+	// 0 disables the cache
+	TTL time.Duration
+	// MaxEntries is the most users whose permissions are cached
+	MaxEntries int
+}
+
+// QuotaConfig holds the licensed limits enforced when resources are created; 0 means unlimited
+type QuotaConfig struct {
+	MaxUsers   int
+	MaxRoles   int
+	MaxGroups  int
+	MaxAPIKeys int
+}
+
+// RequestLimitsConfig bounds the size of request bodies the API accepts
+type RequestLimitsConfig struct {
+	// MaxListItems is the most IDs one assignment request may carry, e.g. permission_ids when
+	// assigning permissions to a role; larger requests are rejected with 413
+	MaxListItems int
+	// DefaultPageSize is the page size of list requests that do not ask for one, and
+	// MaxPageSize the largest a list request may ask for
+	DefaultPageSize int
+	MaxPageSize     int
+}
+
+// MembershipExpiryConfig controls reminders for time-limited group memberships
+type MembershipExpiryConfig struct {
+	// NoticeDays is how many days before expiry the member and group managers are reminded
+	NoticeDays int
+	// CheckInterval is how often memberships are checked for due reminders
+	CheckInterval time.Duration
+}
+
+// AnomalyConfig tunes detection of authentication failure spikes
+type AnomalyConfig struct {
+	Window        time.Duration
+	IPThreshold   int
+	UserThreshold int
+	Cooldown      time.Duration
+}
+
+// IdentityConfig selects the identity provider users log in with
+type IdentityConfig struct {
+	// Provider is keycloak (configured in keycloak.json), oidc or local. Empty picks keycloak
+	// when it is configured and local otherwise.
+	Provider string
+	// OIDCIssuerURL, OIDCClientID and OIDCClientSecret configure the oidc provider, whose
+	// issuer must allow the password grant for the client
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	// MagicLink enables passwordless login (MAGIC_LINK_LOGIN): keycloak issues the tokens by
+	// token exchange, local signs them in the API; empty disables it
+	MagicLink string
+	// MagicLinkURL is the frontend page the emailed link opens (MAGIC_LINK_URL)
+	MagicLinkURL string
+	// MagicLinkLifetime is how long an emailed code is valid (MAGIC_LINK_LIFETIME)
+	MagicLinkLifetime time.Duration
+	// JWKS verifies the RS256 tokens of Keycloak with the public keys of its realms (JWT_JWKS,
+	// on by default); it applies when Keycloak is the identity provider
+	JWKS bool
+	// AllowHMAC also accepts HMAC-signed tokens when JWKS is on (JWT_ALLOW_HMAC), for tests and
+	// development only
+	AllowHMAC bool
+	// TokenExchange lists the downstream audiences callers may exchange their Keycloak token
+	// for (TOKEN_EXCHANGE_POLICIES, a JSON array); empty allows none
+	TokenExchange []TokenExchangePolicy
+}
+
+// TokenExchangePolicy allows exchanging tokens for one downstream audience
+type TokenExchangePolicy struct {
+	// Audience is the Keycloak client ID of the downstream API
+	Audience string `json:"audience"`
+	// Permission, when set, must be held by the caller
+	Permission string `json:"permission,omitempty"`
+	// Scopes are the most an exchanged token may carry
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// CaptchaConfig configures the challenge required at login after repeated failures
+type CaptchaConfig struct {
+	// Provider is recaptcha or hcaptcha; empty disables the challenge
+	Provider string
+	// Secret is the provider's server-side verification secret
+	Secret string
+	// Window is the sliding window failed logins are counted in
+	Window time.Duration
+	// IPThreshold and AccountThreshold are the failed logins within Window from one IP or
+	// against one account after which a challenge is required (0 disables)
+	IPThreshold      int
+	AccountThreshold int
+}
+
+// BruteForceConfig limits login and registration attempts per username, on top of the per-IP
+// "login" and "register" rate limit budgets
+type BruteForceConfig struct {
+	// AccountAttempts are allowed per username per AccountWindow; 0 disables the limit
+	AccountAttempts int
+	AccountWindow   time.Duration
+}
+
+// AvatarConfig controls the avatars served for users without an uploaded picture
+type AvatarConfig struct {
+	// Gravatar looks avatars up on Gravatar; when false only generated identicons are served and
+	// no email hash is sent to Gravatar
+	Gravatar bool
+	// GravatarURL is the Gravatar image endpoint
+	GravatarURL string
+	// CacheTTL is how long avatars are cached by the server and browsers
+	CacheTTL time.Duration
+}
+
+// WelcomeConfig configures the steps run after a user registers
+type WelcomeConfig struct {
+	// Steps names the welcome steps in the order they run (default_groups, default_preferences,
+	// welcome_email, webhook)
+	Steps []string
+	// DefaultPreferences are stored as attributes of new users by the default_preferences step
+	DefaultPreferences map[string]string
+}
+
+// AlertsConfig configures where operational alerts are sent
+type AlertsConfig struct {
+	// WebhookURL receives alerts as JSON POSTs; empty disables delivery
+	WebhookURL string
+	// WebhookSecret signs webhook bodies (X-Signature-256)
+	WebhookSecret string
+}
+
+// OutboundConfig controls HTTP calls to other services (Keycloak, identity providers, webhooks,
+// captcha, Gravatar, Sentry). Unset, the proxy comes from HTTP_PROXY/HTTPS_PROXY/NO_PROXY and
+// only the system CAs are trusted. Every call also has a timeout budget.
+type OutboundConfig struct {
+	// ProxyURL routes every outbound call through this proxy
+	ProxyURL string
+	// NoProxy lists hosts, domains and CIDRs reached directly, comma separated
+	NoProxy string
+	// CAFile is a PEM bundle of CAs trusted in addition to the system ones
+	CAFile string
+	// ClientCertFile and ClientKeyFile are the PEM client certificate and key for mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// Timeout is the budget of one call to a service without a budget of its own; Timeouts sets
+	// budgets per service (keycloak, oidc, webhook, captcha, gravatar, sentry)
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+}
+
+// Config is the root application configuration
+type Config struct {
+	Port     string
+	Database DatabaseConfig
+	Logging  LoggingConfig
+
+	ErrorReporting ErrorReportingConfig
+	Secrets        SecretsConfig
+	Encryption     EncryptionConfig
+	Compression    CompressionConfig
+	Usage          UsageConfig
+	Denylist       DenylistConfig
+	Permissions    PermissionCacheConfig
+	Quota          QuotaConfig
+	Limits         RequestLimitsConfig
+	Membership     MembershipExpiryConfig
+	Anomaly        AnomalyConfig
+	Identity       IdentityConfig
+	Captcha        CaptchaConfig
+	BruteForce     BruteForceConfig
+	Alerts         AlertsConfig
+	Avatar         AvatarConfig
+	Welcome        WelcomeConfig
+	Outbound       OutboundConfig
+
+	// RequestTimeout is the deadline of each API request, which the outbound calls it makes
+	// inherit; 0 disables it
+	RequestTimeout time.Duration
+
+	// SettingsRefreshInterval controls how often persisted settings (e.g. maintenance mode) are reloaded
+	SettingsRefreshInterval time.Duration
+
+	// RateLimit and RateLimitWindow bound requests per client IP on rate-limited routes
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitRules are per-route and per-tier budgets (RATE_LIMIT_RULES, a JSON array)
+	RateLimitRules []RateLimitRule
+	// CORSAllowedOrigins lists browser origins allowed to call the API
+	CORSAllowedOrigins []string
+	// FeatureFlags switches optional behaviour on or off by name
+	FeatureFlags map[string]bool
+	// UICapabilities maps permissions to frontend menus and features (UI_CAPABILITIES, a JSON array)
+	UICapabilities []UICapability
+	// RuntimeConfigFile, when set, is a JSON file overriding the settings above (and log levels);
+	// it is re-read on SIGHUP
+	RuntimeConfigFile string
+	// PermissionCheck is what startup does when routes or configuration check permissions that
+	// do not exist, or registered permissions are checked nowhere: "warn" logs them, "fail"
+	// refuses to start, "off" skips the check
+	PermissionCheck string
+	// RBACBootstrapFile, when set, is a JSON file of roles and groups ensured at startup
+	// (see rbac.BootstrapSpec)
+	RBACBootstrapFile string
+	// RBACConfirmRoleDeletion refuses to delete roles that groups still hold unless the request
+	// confirms with force=true
+	RBACConfirmRoleDeletion bool
+	// TenantBootstrapFile, when set, is a JSON file of the roles and groups each new tenant gets
+	// (see tenant.Template); the built-in tenant template is used otherwise
+	TenantBootstrapFile string
+	// TenantRegisterURL is where the first administrator of a new tenant is invited to register
+	TenantRegisterURL string
+
+	// PprofEnabled mounts /debug/pprof (restricted to the manage_system permission)
+	PprofEnabled bool
+}
+
+// Load reads the configuration from the environment, applying defaults for unset values
+func Load() (*Config, error) {
+	healthInterval, err := getEnvDuration("DB_REPLICA_HEALTH_INTERVAL", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	connectTimeout, err := getEnvDuration("DB_CONNECT_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	slowQueryThreshold, err := getEnvDuration("DB_SLOW_QUERY_THRESHOLD", 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	statementTimeout, err := getEnvDuration("DB_STATEMENT_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// Deployments that set DB_STATEMENT_TIMEOUT before connections had their own setting keep it
+	connStatementTimeout, err := getEnvDuration("DB_CONN_STATEMENT_TIMEOUT", statementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	settingsRefresh, err := getEnvDuration("SETTINGS_REFRESH_INTERVAL", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	throttleWindow, err := getEnvDuration("LOG_THROTTLE_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	throttleBurst, err := getEnvInt("LOG_THROTTLE_BURST", 10)
+	if err != nil {
+		return nil, err
+	}
+	moduleLevels, err := getEnvMap("LOG_MODULE_LEVELS")
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := getEnvInt("RATE_LIMIT_REQUESTS", 100)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitWindow, err := getEnvDuration("RATE_LIMIT_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitRules := DefaultRateLimitRules()
+	if raw := os.Getenv("RATE_LIMIT_RULES"); raw != "" {
+		var items []rateLimitRuleJSON
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&items); err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %w", err)
+		}
+		if rateLimitRules, err = parseRateLimitRules(items); err != nil {
+			return nil, err
+		}
+	}
+	featureFlags, err := getEnvBoolMap("FEATURE_FLAGS")
+	if err != nil {
+		return nil, err
+	}
+	uiCapabilities := DefaultUICapabilities()
+	if raw := os.Getenv("UI_CAPABILITIES"); raw != "" {
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&uiCapabilities); err != nil {
+			return nil, fmt.Errorf("invalid UI_CAPABILITIES: %w", err)
+		}
+	}
+	anomalyWindow, err := getEnvDuration("ANOMALY_WINDOW", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	anomalyCooldown, err := getEnvDuration("ANOMALY_COOLDOWN", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	anomalyIPThreshold, err := getEnvInt("ANOMALY_IP_THRESHOLD", 20)
+	if err != nil {
+		return nil, err
+	}
+	anomalyUserThreshold, err := getEnvInt("ANOMALY_USER_THRESHOLD", 10)
+	if err != nil {
+		return nil, err
+	}
+	magicLinkLifetime, err := getEnvDuration("MAGIC_LINK_LIFETIME", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	identity := IdentityConfig{
+		Provider:          strings.ToLower(getEnv("IDENTITY_PROVIDER", "")),
+		OIDCIssuerURL:     getEnv("OIDC_ISSUER_URL", ""),
+		OIDCClientID:      getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+		MagicLink:         strings.ToLower(getEnv("MAGIC_LINK_LOGIN", "")),
+		MagicLinkURL:      getEnv("MAGIC_LINK_URL", ""),
+		MagicLinkLifetime: magicLinkLifetime,
+		JWKS:              getEnv("JWT_JWKS", "true") == "true",
+		AllowHMAC:         getEnv("JWT_ALLOW_HMAC", "false") == "true",
+	}
+	switch identity.Provider {
+	case "", "keycloak", "local":
+	case "oidc":
+		if identity.OIDCIssuerURL == "" || identity.OIDCClientID == "" {
+			return nil, fmt.Errorf("IDENTITY_PROVIDER oidc requires OIDC_ISSUER_URL and OIDC_CLIENT_ID")
+		}
+	default:
+		return nil, fmt.Errorf("invalid IDENTITY_PROVIDER %q: expected keycloak, oidc or local", identity.Provider)
+	}
+	switch identity.MagicLink {
+	case "", "keycloak", "local":
+	default:
+		return nil, fmt.Errorf("invalid MAGIC_LINK_LOGIN %q: expected keycloak or local", identity.MagicLink)
+	}
+	if raw := os.Getenv("TOKEN_EXCHANGE_POLICIES"); raw != "" {
+		decoder := json.NewDecoder(strings.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&identity.TokenExchange); err != nil {
+			return nil, fmt.Errorf("invalid TOKEN_EXCHANGE_POLICIES: %w", err)
+		}
+		audiences := make(map[string]bool, len(identity.TokenExchange))
+		for _, policy := range identity.TokenExchange {
+			if policy.Audience == "" || audiences[policy.Audience] {
+				return nil, fmt.Errorf("invalid TOKEN_EXCHANGE_POLICIES: audience %q is empty or repeated", policy.Audience)
+			}
+			audiences[policy.Audience] = true
+		}
+	}
+	captchaProvider := strings.ToLower(getEnv("CAPTCHA_PROVIDER", ""))
+	switch captchaProvider {
+	case "", "recaptcha", "hcaptcha":
+	default:
+		return nil, fmt.Errorf("invalid CAPTCHA_PROVIDER %q: expected recaptcha or hcaptcha", captchaProvider)
+	}
+	captchaWindow, err := getEnvDuration("CAPTCHA_WINDOW", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	captchaIPThreshold, err := getEnvInt("CAPTCHA_IP_THRESHOLD", 10)
+	if err != nil {
+		return nil, err
+	}
+	captchaAccountThreshold, err := getEnvInt("CAPTCHA_ACCOUNT_THRESHOLD", 3)
+	if err != nil {
+		return nil, err
+	}
+	accountAttempts, err := getEnvInt("BRUTE_FORCE_ACCOUNT_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	accountWindow, err := getEnvDuration("BRUTE_FORCE_ACCOUNT_WINDOW", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	encryptionKeys, err := getEnvMap("ENCRYPTION_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	reencryptBatch, err := getEnvInt("ENCRYPTION_REENCRYPT_BATCH_SIZE", 500)
+	if err != nil {
+		return nil, err
+	}
+	usageFlush, err := getEnvDuration("USAGE_FLUSH_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	avatarTTL, err := getEnvDuration("AVATAR_CACHE_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	welcomeSteps := getEnvList("WELCOME_STEPS", ",")
+	if len(welcomeSteps) == 0 {
+		welcomeSteps = []string{"default_groups"}
+	}
+	welcomePreferences, err := getEnvMap("WELCOME_DEFAULT_PREFERENCES")
+	if err != nil {
+		return nil, err
+	}
+	denylistTTL, err := getEnvDuration("TOKEN_DENYLIST_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	denylistRefresh, err := getEnvDuration("TOKEN_DENYLIST_REFRESH_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	permCacheTTL, err := getEnvDuration("PERMISSION_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	permCacheSize, err := getEnvInt("PERMISSION_CACHE_SIZE", 10000)
+	if err != nil {
+		return nil, err
+	}
+	if permCacheSize < 1 {
+		return nil, fmt.Errorf("invalid PERMISSION_CACHE_SIZE %d: expected at least 1", permCacheSize)
+	}
+	quotas := make(map[string]int)
+	for _, key := range []string{"QUOTA_MAX_USERS", "QUOTA_MAX_ROLES", "QUOTA_MAX_GROUPS", "QUOTA_MAX_API_KEYS"} {
+		limit, err := getEnvInt(key, 0)
+		if err != nil {
+			return nil, err
+		}
+		if limit < 0 {
+			return nil, fmt.Errorf("invalid %s %d: expected 0 (unlimited) or more", key, limit)
+		}
+		quotas[key] = limit
+	}
+	maxListItems, err := getEnvInt("MAX_REQUEST_LIST_ITEMS", 500)
+	if err != nil {
+		return nil, err
+	}
+	if maxListItems < 1 {
+		return nil, fmt.Errorf("invalid MAX_REQUEST_LIST_ITEMS %d: expected at least 1", maxListItems)
+	}
+	defaultPageSize, err := getEnvInt("PAGE_SIZE_DEFAULT", 50)
+	if err != nil {
+		return nil, err
+	}
+	maxPageSize, err := getEnvInt("PAGE_SIZE_MAX", 500)
+	if err != nil {
+		return nil, err
+	}
+	if defaultPageSize < 1 || maxPageSize < defaultPageSize {
+		return nil, fmt.Errorf("invalid PAGE_SIZE_DEFAULT %d and PAGE_SIZE_MAX %d: expected 1 <= default <= max", defaultPageSize, maxPageSize)
+	}
+	expiryNoticeDays, err := getEnvInt("MEMBERSHIP_EXPIRY_NOTICE_DAYS", 7)
+	if err != nil {
+		return nil, err
+	}
+	if expiryNoticeDays < 1 {
+		return nil, fmt.Errorf("invalid MEMBERSHIP_EXPIRY_NOTICE_DAYS %d: expected at least 1", expiryNoticeDays)
+	}
+	expiryCheckInterval, err := getEnvDuration("MEMBERSHIP_EXPIRY_CHECK_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	compressionMinSize, err := getEnvInt("COMPRESSION_MIN_SIZE", 1024)
+	if err != nil {
+		return nil, err
+	}
+	compressionLevel, err := getEnvInt("COMPRESSION_LEVEL", 0)
+	if err != nil {
+		return nil, err
+	}
+	if compressionLevel < 0 || compressionLevel > 9 {
+		return nil, fmt.Errorf("invalid COMPRESSION_LEVEL %d: expected 0-9", compressionLevel)
+	}
+	compressionRoutes, err := getEnvIntMap("COMPRESSION_ROUTE_MIN_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	secretsRefresh, err := getEnvDuration("SECRETS_REFRESH_INTERVAL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	secretsProvider := strings.ToLower(getEnv("SECRETS_PROVIDER", ""))
+	switch secretsProvider {
+	case "", "vault", "aws":
+	default:
+		return nil, fmt.Errorf("invalid SECRETS_PROVIDER %q: expected vault or aws", secretsProvider)
+	}
+	outboundTimeout, err := getEnvDuration("OUTBOUND_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	outboundTimeouts, err := getEnvDurationMap("OUTBOUND_TIMEOUTS")
+	if err != nil {
+		return nil, err
+	}
+	if outboundTimeout <= 0 {
+		return nil, fmt.Errorf("invalid OUTBOUND_TIMEOUT %s: expected a positive duration", outboundTimeout)
+	}
+	for service, timeout := range outboundTimeouts {
+		if timeout <= 0 {
+			return nil, fmt.Errorf("invalid OUTBOUND_TIMEOUTS entry %s=%s: expected a positive duration", service, timeout)
+		}
+	}
+	requestTimeout, err := getEnvDuration("REQUEST_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	outbound := OutboundConfig{
+		ProxyURL:       getEnv("OUTBOUND_PROXY_URL", ""),
+		NoProxy:        getEnv("OUTBOUND_NO_PROXY", ""),
+		CAFile:         getEnv("OUTBOUND_CA_FILE", ""),
+		ClientCertFile: getEnv("OUTBOUND_CLIENT_CERT_FILE", ""),
+		ClientKeyFile:  getEnv("OUTBOUND_CLIENT_KEY_FILE", ""),
+		Timeout:        outboundTimeout,
+		Timeouts:       outboundTimeouts,
+	}
+	if outbound.ProxyURL != "" {
+		if u, err := url.Parse(outbound.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid OUTBOUND_PROXY_URL: expected a URL such as http://proxy:3128")
+		}
+	}
+	if (outbound.ClientCertFile == "") != (outbound.ClientKeyFile == "") {
+		return nil, fmt.Errorf("OUTBOUND_CLIENT_CERT_FILE and OUTBOUND_CLIENT_KEY_FILE must be set together")
+	}
+	ephemeralDB := strings.ToLower(getEnv("DB_EPHEMERAL", ""))
+	switch ephemeralDB {
+	case "", "embedded", "docker":
+	default:
+		return nil, fmt.Errorf("invalid DB_EPHEMERAL %q: expected embedded or docker", ephemeralDB)
+	}
+	schemaDrift := strings.ToLower(getEnv("DB_SCHEMA_DRIFT", "warn"))
+	switch schemaDrift {
+	case "warn", "fail", "off":
+	default:
+		return nil, fmt.Errorf("invalid DB_SCHEMA_DRIFT %q: expected warn, fail or off", schemaDrift)
+	}
+	migrate := strings.ToLower(getEnv("DB_MIGRATE", "up"))
+	switch migrate {
+	case "up", "check", "off":
+	default:
+		return nil, fmt.Errorf("invalid DB_MIGRATE %q: expected up, check or off", migrate)
+	}
+	permissionCheck := strings.ToLower(getEnv("PERMISSION_CHECK", "warn"))
+	switch permissionCheck {
+	case "warn", "fail", "off":
+	default:
+		return nil, fmt.Errorf("invalid PERMISSION_CHECK %q: expected warn, fail or off", permissionCheck)
+	}
+
+	return &Config{
+		Port: getEnv("PORT", "8090"),
+		Database: DatabaseConfig{
+			Host:                       getEnv("DB_HOST", "localhost"),
+			Port:                       getEnv("DB_PORT", "5432"),
+			User:                       getEnv("DB_USER", "postgres"),
+			Password:                   getEnv("DB_PASSWORD", "postgres"),
+			Name:                       getEnv("DB_NAME", "baseapp"),
+			SSLMode:                    getEnv("DB_SSLMODE", "disable"),
+			ReplicaDSNs:                getEnvList("DB_REPLICA_DSNS", ";"),
+			ReplicaHealthCheckInterval: healthInterval,
+			ConnectTimeout:             connectTimeout,
+			SlowQueryThreshold:         slowQueryThreshold,
+			StatementTimeout:           statementTimeout,
+			ConnStatementTimeout:       connStatementTimeout,
+			Ephemeral:                  ephemeralDB,
+			SchemaDrift:                schemaDrift,
+			Migrate:                    migrate,
+		},
+		Logging: LoggingConfig{
+			Level:          getEnv("LOG_LEVEL", "info"),
+			Format:         getEnv("LOG_FORMAT", "json"),
+			ModuleLevels:   moduleLevels,
+			ThrottleWindow: throttleWindow,
+			ThrottleBurst:  throttleBurst,
+		},
+		ErrorReporting: ErrorReportingConfig{
+			SentryDSN:   getEnv("SENTRY_DSN", ""),
+			Environment: getEnv("SENTRY_ENVIRONMENT", "development"),
+		},
+		Secrets: SecretsConfig{
+			Provider:         secretsProvider,
+			RefreshInterval:  secretsRefresh,
+			DatabaseSecret:   getEnv("SECRETS_DATABASE", ""),
+			KeycloakSecret:   getEnv("SECRETS_KEYCLOAK", ""),
+			JWTSecret:        getEnv("SECRETS_JWT", ""),
+			EncryptionSecret: getEnv("SECRETS_ENCRYPTION", ""),
+			VaultMount:       getEnv("VAULT_KV_MOUNT", "secret"),
+			AWSRegion:        getEnv("AWS_REGION", ""),
+			AWSEndpoint:      getEnv("SECRETS_AWS_ENDPOINT", ""),
+		},
+		Encryption: EncryptionConfig{
+			Keys:               encryptionKeys,
+			PrimaryKey:         getEnv("ENCRYPTION_PRIMARY_KEY", ""),
+			ReencryptBatchSize: reencryptBatch,
+		},
+		Compression: CompressionConfig{
+			Enabled:      getEnv("COMPRESSION_ENABLED", "true") == "true",
+			MinSize:      compressionMinSize,
+			Level:        compressionLevel,
+			RouteMinSize: compressionRoutes,
+		},
+		Usage: UsageConfig{
+			FlushInterval: usageFlush,
+		},
+		Denylist: DenylistConfig{
+			TokenLifetime:   denylistTTL,
+			RefreshInterval: denylistRefresh,
+		},
+		Permissions: PermissionCacheConfig{
+			TTL:        permCacheTTL,
+			MaxEntries: permCacheSize,
+		},
+		Quota: QuotaConfig{
+			MaxUsers:   quotas["QUOTA_MAX_USERS"],
+			MaxRoles:   quotas["QUOTA_MAX_ROLES"],
+			MaxGroups:  quotas["QUOTA_MAX_GROUPS"],
+			MaxAPIKeys: quotas["QUOTA_MAX_API_KEYS"],
+		},
+		Limits: RequestLimitsConfig{
+			MaxListItems:    maxListItems,
+			DefaultPageSize: defaultPageSize,
+			MaxPageSize:     maxPageSize,
+		},
+		Membership: MembershipExpiryConfig{
+			NoticeDays:    expiryNoticeDays,
+			CheckInterval: expiryCheckInterval,
+		},
+		Anomaly: AnomalyConfig{
+			Window:        anomalyWindow,
+			IPThreshold:   anomalyIPThreshold,
+			UserThreshold: anomalyUserThreshold,
+			Cooldown:      anomalyCooldown,
+		},
+		Identity: identity,
+		Captcha: CaptchaConfig{
+			Provider:         captchaProvider,
+			Secret:           getEnv("CAPTCHA_SECRET", ""),
+			Window:           captchaWindow,
+			IPThreshold:      captchaIPThreshold,
+			AccountThreshold: captchaAccountThreshold,
+		},
+		BruteForce: BruteForceConfig{
+			AccountAttempts: accountAttempts,
+			AccountWindow:   accountWindow,
+		},
+		Alerts: AlertsConfig{
+			WebhookURL:    getEnv("ALERT_WEBHOOK_URL", ""),
+			WebhookSecret: getEnv("ALERT_WEBHOOK_SECRET", ""),
+		},
+		Avatar: AvatarConfig{
+			Gravatar:    getEnv("AVATAR_GRAVATAR_ENABLED", "true") == "true",
+			GravatarURL: getEnv("GRAVATAR_URL", "https://www.gravatar.com/avatar/"),
+			CacheTTL:    avatarTTL,
+		},
+		Welcome: WelcomeConfig{
+			Steps:              welcomeSteps,
+			DefaultPreferences: welcomePreferences,
+		},
+		Outbound:                outbound,
+		RequestTimeout:          requestTimeout,
+		SettingsRefreshInterval: settingsRefresh,
+		RateLimit:               rateLimit,
+		RateLimitWindow:         rateLimitWindow,
+		RateLimitRules:          rateLimitRules,
+		CORSAllowedOrigins:      getEnvList("CORS_ALLOWED_ORIGINS", ","),
+		FeatureFlags:            featureFlags,
+		UICapabilities:          uiCapabilities,
+		RuntimeConfigFile:       getEnv("RUNTIME_CONFIG_FILE", ""),
+		PermissionCheck:         permissionCheck,
+		RBACBootstrapFile:       getEnv("RBAC_BOOTSTRAP_FILE", ""),
+		RBACConfirmRoleDeletion: getEnv("RBAC_CONFIRM_ROLE_DELETION", "true") == "true",
+		TenantBootstrapFile:     getEnv("TENANT_BOOTSTRAP_FILE", ""),
+		TenantRegisterURL:       getEnv("TENANT_REGISTER_URL", ""),
+		PprofEnabled:            getEnv("PPROF_ENABLED", "false") == "true",
+	}, nil
+}
+
+// String renders the configuration for logs with passwords, DSNs and other secrets masked
+func (c Config) String() string {
+	type plain Config
+	masked := plain(c)
+	masked.Database.Password = redact.Secret(c.Database.Password)
+	masked.Database.ReplicaDSNs = make([]string, len(c.Database.ReplicaDSNs))
+	for i, dsn := range c.Database.ReplicaDSNs {
+		masked.Database.ReplicaDSNs[i] = redact.String(dsn)
+	}
+	masked.Encryption.Keys = make(map[string]string, len(c.Encryption.Keys))
+	for id, key := range c.Encryption.Keys {
+		masked.Encryption.Keys[id] = redact.Secret(key)
+	}
+	masked.ErrorReporting.SentryDSN = redact.Secret(c.ErrorReporting.SentryDSN)
+	masked.Captcha.Secret = redact.Secret(c.Captcha.Secret)
+	masked.Identity.OIDCClientSecret = redact.Secret(c.Identity.OIDCClientSecret)
+	masked.Alerts.WebhookSecret = redact.Secret(c.Alerts.WebhookSecret)
+	masked.Alerts.WebhookURL = redact.String(c.Alerts.WebhookURL)
+	masked.Outbound.ProxyURL = redact.String(c.Outbound.ProxyURL)
+	return fmt.Sprintf("%+v", masked)
+}
+
+// getEnv gets an environment variable with a default fallback value
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvDuration parses a duration such as "500ms" or "10s" from the environment
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// getEnvInt parses an integer from the environment
+func getEnvInt(key string, defaultValue int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer for %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// getEnvMap parses "key=value,key2=value2" from the environment
+func getEnvMap(key string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range getEnvList(key, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid entry %q for %s: expected key=value", pair, key)
+		}
+		values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return values, nil
+}
+
+// getEnvIntMap parses "key=1,key2=-1" from the environment
+func getEnvIntMap(key string) (map[string]int, error) {
+	values, err := getEnvMap(key)
+	if err != nil {
+		return nil, err
+	}
+	ints := make(map[string]int, len(values))
+	for name, value := range values {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %q for %s in %s", value, name, key)
+		}
+		ints[name] = n
+	}
+	return ints, nil
+}
+
+// getEnvDurationMap parses "key=5s,key2=1m" from the environment
+func getEnvDurationMap(key string) (map[string]time.Duration, error) {
+	values, err := getEnvMap(key)
+	if err != nil {
+		return nil, err
+	}
+	durations := make(map[string]time.Duration, len(values))
+	for name, value := range values {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q for %s in %s", value, name, key)
+		}
+		durations[name] = d
+	}
+	return durations, nil
+}
+
+// getEnvBoolMap parses "flag=true,other=false" from the environment
+func getEnvBoolMap(key string) (map[string]bool, error) {
+	values, err := getEnvMap(key)
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]bool, len(values))
+	for name, value := range values {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boolean %q for %s in %s", value, name, key)
+		}
+		flags[name] = on
+	}
+	return flags, nil
+}
+
+// getEnvList splits an environment variable on sep, dropping empty entries
+func getEnvList(key, sep string) []string {
+	var values []string
+	for _, part := range strings.Split(os.Getenv(key), sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
@@ -0,0 +1,384 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"base-app/pkg/perm"
+)
+
+// Runtime holds the settings that can be changed without restarting the server
+type Runtime struct {
+	LogLevel        string
+	LogModuleLevels map[string]string
+	// RateLimit requests per RateLimitWindow are allowed per client IP on rate-limited routes
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitRules are budgets for specific routes and client tiers, tried in order before
+	// falling back to RateLimit
+	RateLimitRules []RateLimitRule
+	// CORSAllowedOrigins lists origins allowed to call the API from a browser; "*" allows any
+	CORSAllowedOrigins []string
+	Features           map[string]bool
+	// UICapabilities drive the frontend manifest; see UICapability
+	UICapabilities []UICapability
+}
+
+// UICapability is a menu entry or feature of the frontend, granted to callers holding its
+// permissions. The frontend checks capability keys instead of permission names.
+type UICapability struct {
+	// Key names the capability, e.g. "menu.users" or "feature.roles.edit"
+	Key string `json:"key"`
+	// Kind is "menu" or "feature"
+	Kind string `json:"kind"`
+	// Label and Path describe menu entries
+	Label string `json:"label,omitempty"`
+	Path  string `json:"path,omitempty"`
+	// AllOf permissions are all required and at least one of AnyOf; with neither, every
+	// signed-in user gets the capability
+	AllOf []string `json:"all_of,omitempty"`
+	AnyOf []string `json:"any_of,omitempty"`
+	// Feature, when set, is a feature flag that must also be on
+	Feature string `json:"feature,omitempty"`
+}
+
+// RateLimitRule is a request budget for the routes and clients it matches
+type RateLimitRule struct {
+	// Name identifies the budget, e.g. "login"
+	Name string
+	// Methods and Path select requests; Path is a route template or a prefix ending in "*"
+	Methods []string
+	Path    string
+	// Tier restricts the rule to one client tier: "anonymous", "user", "service" or "api_key"
+	Tier string
+	// Limit requests per Window plus Burst at once; a negative Limit means unlimited
+	Limit  int
+	Window time.Duration
+	Burst  int
+	// Key counts the budget per "ip" (default), "user" or "tenant"
+	Key string
+}
+
+// rateLimitRuleJSON is the JSON layout of a rule in RATE_LIMIT_RULES and the runtime file
+type rateLimitRuleJSON struct {
+	Name    string   `json:"name"`
+	Methods []string `json:"methods"`
+	Path    string   `json:"path"`
+	Tier    string   `json:"tier"`
+	Limit   int      `json:"limit"`
+	Window  string   `json:"window"`
+	Burst   int      `json:"burst"`
+	Key     string   `json:"key"`
+}
+
+func (j rateLimitRuleJSON) rule() (RateLimitRule, error) {
+	rule := RateLimitRule{Name: j.Name, Methods: j.Methods, Path: j.Path, Tier: j.Tier, Limit: j.Limit, Burst: j.Burst, Key: j.Key}
+	if j.Window != "" {
+		window, err := time.ParseDuration(j.Window)
+		if err != nil {
+			return RateLimitRule{}, fmt.Errorf("invalid window for rate limit rule %q: %w", j.Name, err)
+		}
+		rule.Window = window
+	}
+	return rule, nil
+}
+
+func parseRateLimitRules(items []rateLimitRuleJSON) ([]RateLimitRule, error) {
+	rules := make([]RateLimitRule, 0, len(items))
+	for _, item := range items {
+		rule, err := item.rule()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// DefaultRateLimitRules exempts health checks and holds logins to 10 per minute per IP
+func DefaultRateLimitRules() []RateLimitRule {
+	return []RateLimitRule{
+		{Name: "health", Path: "/health", Limit: -1},
+		{Name: "login", Methods: []string{"POST"}, Path: "/api/users/login", Limit: 10, Window: time.Minute, Burst: 5},
+		{Name: "refresh", Methods: []string{"POST"}, Path: "/api/users/refresh", Limit: 30, Window: time.Minute, Burst: 10},
+		{Name: "register", Methods: []string{"POST"}, Path: "/api/users/register", Limit: 5, Window: time.Hour, Burst: 5},
+	}
+}
+
+// DefaultUICapabilities describes the menus of the bundled frontend
+func DefaultUICapabilities() []UICapability {
+	return []UICapability{
+		{Key: "menu.dashboard", Kind: "menu", Label: "Dashboard", Path: "/dashboard"},
+		{Key: "menu.profile", Kind: "menu", Label: "Profile", Path: "/profile"},
+		{Key: "menu.users", Kind: "menu", Label: "User Management", Path: "/prime-users", AllOf: []string{"read_user"}},
+		{Key: "feature.users.edit", Kind: "feature", AnyOf: []string{"create_user", "update_user", "delete_user"}},
+		{Key: "feature.roles.edit", Kind: "feature", AnyOf: []string{"create_role", "update_role", "delete_role"}},
+		{Key: "feature.groups.members", Kind: "feature", AllOf: []string{"manage_group_membership"}},
+	}
+}
+
+var uiCapabilityKinds = map[string]bool{"menu": true, "feature": true}
+
+var (
+	rateLimitKeys  = map[string]bool{"": true, "ip": true, "user": true, "tenant": true}
+	rateLimitTiers = map[string]bool{"": true, "anonymous": true, "user": true, "service": true, "api_key": true}
+)
+
+// Runtime returns the runtime settings taken from the environment, before any file overrides
+func (c Config) Runtime() Runtime {
+	return Runtime{
+		LogLevel:           c.Logging.Level,
+		LogModuleLevels:    c.Logging.ModuleLevels,
+		RateLimit:          c.RateLimit,
+		RateLimitWindow:    c.RateLimitWindow,
+		RateLimitRules:     c.RateLimitRules,
+		CORSAllowedOrigins: c.CORSAllowedOrigins,
+		Features:           c.FeatureFlags,
+		UICapabilities:     c.UICapabilities,
+	}
+}
+
+var logLevels = map[string]bool{
+	"panic": true, "fatal": true, "error": true, "warn": true, "warning": true, "info": true, "debug": true, "trace": true,
+}
+
+// Validate checks every field, so an invalid reload can be rejected as a whole
+func (r Runtime) Validate() error {
+	var errs []error
+	if !logLevels[strings.ToLower(r.LogLevel)] {
+		errs = append(errs, fmt.Errorf("invalid log level %q", r.LogLevel))
+	}
+	for module, level := range r.LogModuleLevels {
+		if !logLevels[strings.ToLower(level)] {
+			errs = append(errs, fmt.Errorf("invalid log level %q for module %s", level, module))
+		}
+	}
+	if r.RateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("rate limit must be positive, got %d", r.RateLimit))
+	}
+	if r.RateLimitWindow <= 0 {
+		errs = append(errs, fmt.Errorf("rate limit window must be positive, got %s", r.RateLimitWindow))
+	}
+	names := make(map[string]bool, len(r.RateLimitRules))
+	for _, rule := range r.RateLimitRules {
+		switch {
+		case rule.Name == "" || rule.Name == "default":
+			errs = append(errs, fmt.Errorf("rate limit rules need a name other than %q", "default"))
+		case names[rule.Name]:
+			errs = append(errs, fmt.Errorf("duplicate rate limit rule %q", rule.Name))
+		case rule.Limit == 0:
+			errs = append(errs, fmt.Errorf("rate limit rule %q: limit must be positive, or negative for unlimited", rule.Name))
+		case rule.Limit > 0 && rule.Window <= 0:
+			errs = append(errs, fmt.Errorf("rate limit rule %q: window must be positive", rule.Name))
+		case rule.Burst < 0:
+			errs = append(errs, fmt.Errorf("rate limit rule %q: burst must not be negative", rule.Name))
+		case !rateLimitKeys[rule.Key]:
+			errs = append(errs, fmt.Errorf("rate limit rule %q: invalid key %q, expected ip, user or tenant", rule.Name, rule.Key))
+		case !rateLimitTiers[rule.Tier]:
+			errs = append(errs, fmt.Errorf("rate limit rule %q: invalid tier %q, expected anonymous, user or service", rule.Name, rule.Tier))
+		}
+		names[rule.Name] = true
+	}
+	for _, origin := range r.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			errs = append(errs, fmt.Errorf("invalid CORS origin %q: expected scheme://host[:port]", origin))
+		}
+	}
+	keys := make(map[string]bool, len(r.UICapabilities))
+	for _, capability := range r.UICapabilities {
+		switch {
+		case capability.Key == "":
+			errs = append(errs, errors.New("UI capabilities need a key"))
+		case keys[capability.Key]:
+			errs = append(errs, fmt.Errorf("duplicate UI capability %q", capability.Key))
+		case !uiCapabilityKinds[capability.Kind]:
+			errs = append(errs, fmt.Errorf("UI capability %q: invalid kind %q, expected menu or feature", capability.Key, capability.Kind))
+		}
+		keys[capability.Key] = true
+		for _, name := range append(append([]string{}, capability.AllOf...), capability.AnyOf...) {
+			if !knownPermissions[perm.Name(name)] {
+				errs = append(errs, fmt.Errorf("UI capability %q: unknown permission %q", capability.Key, name))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// knownPermissions guards UI capabilities against misspelt permission names
+var knownPermissions = func() map[perm.Name]bool {
+	known := make(map[perm.Name]bool, len(perm.All))
+	for _, name := range perm.All {
+		known[name] = true
+	}
+	return known
+}()
+
+// FeatureEnabled reports whether the named feature flag is on
+func (r Runtime) FeatureEnabled(name string) bool {
+	return r.Features[name]
+}
+
+// runtimeFile is the JSON layout of RUNTIME_CONFIG_FILE. Absent fields keep the environment value.
+type runtimeFile struct {
+	LogLevel           *string             `json:"log_level"`
+	LogModuleLevels    map[string]string   `json:"log_module_levels"`
+	RateLimit          *int                `json:"rate_limit"`
+	RateLimitWindow    *string             `json:"rate_limit_window"`
+	RateLimitRules     []rateLimitRuleJSON `json:"rate_limit_rules"`
+	CORSAllowedOrigins []string            `json:"cors_allowed_origins"`
+	Features           map[string]bool     `json:"features"`
+	UICapabilities     []UICapability      `json:"ui_capabilities"`
+}
+
+// applyFile overlays the settings in file on base
+func applyFile(base Runtime, data []byte) (Runtime, error) {
+	var file runtimeFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return Runtime{}, fmt.Errorf("parse runtime config: %w", err)
+	}
+
+	r := base
+	if file.LogLevel != nil {
+		r.LogLevel = *file.LogLevel
+	}
+	if file.LogModuleLevels != nil {
+		r.LogModuleLevels = file.LogModuleLevels
+	}
+	if file.RateLimit != nil {
+		r.RateLimit = *file.RateLimit
+	}
+	if file.RateLimitWindow != nil {
+		window, err := time.ParseDuration(*file.RateLimitWindow)
+		if err != nil {
+			return Runtime{}, fmt.Errorf("invalid rate_limit_window: %w", err)
+		}
+		r.RateLimitWindow = window
+	}
+	if file.RateLimitRules != nil {
+		rules, err := parseRateLimitRules(file.RateLimitRules)
+		if err != nil {
+			return Runtime{}, err
+		}
+		r.RateLimitRules = rules
+	}
+	if file.CORSAllowedOrigins != nil {
+		r.CORSAllowedOrigins = file.CORSAllowedOrigins
+	}
+	if file.UICapabilities != nil {
+		r.UICapabilities = file.UICapabilities
+	}
+	if file.Features != nil {
+		features := make(map[string]bool, len(base.Features)+len(file.Features))
+		for name, on := range base.Features {
+			features[name] = on
+		}
+		for name, on := range file.Features {
+			features[name] = on
+		}
+		r.Features = features
+	}
+	return r, nil
+}
+
+// RuntimeStore holds the current runtime settings. Reload re-reads the config file, validates
+// the result and swaps it in atomically; readers always see a complete snapshot.
+type RuntimeStore struct {
+	base Runtime
+	path string
+
+	current atomic.Pointer[Runtime]
+
+	mu          sync.Mutex
+	subscribers []func(Runtime)
+}
+
+// NewRuntimeStore loads path (if set) over base and validates the result
+func NewRuntimeStore(base Runtime, path string) (*RuntimeStore, error) {
+	s := &RuntimeStore{base: base, path: path}
+	r, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(&r)
+	return s, nil
+}
+
+// Current returns the active snapshot
+func (s *RuntimeStore) Current() Runtime {
+	return *s.current.Load()
+}
+
+// Subscribe registers fn to be called with every successfully reloaded snapshot
+func (s *RuntimeStore) Subscribe(fn func(Runtime)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Reload re-reads the config file. On any error the current snapshot stays in place.
+func (s *RuntimeStore) Reload() (Runtime, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.load()
+	if err != nil {
+		return s.Current(), err
+	}
+	s.current.Store(&r)
+	for _, fn := range s.subscribers {
+		fn(r)
+	}
+	return r, nil
+}
+
+// ReloadOnSignal reloads whenever the process receives SIGHUP until ctx is cancelled, passing
+// each outcome to report
+func (s *RuntimeStore) ReloadOnSignal(ctx context.Context, report func(Runtime, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-signals:
+				report(s.Reload())
+			}
+		}
+	}()
+}
+
+func (s *RuntimeStore) load() (Runtime, error) {
+	r := s.base
+	if s.path != "" {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return Runtime{}, fmt.Errorf("read runtime config: %w", err)
+		}
+		if r, err = applyFile(s.base, data); err != nil {
+			return Runtime{}, err
+		}
+	}
+	if err := r.Validate(); err != nil {
+		return Runtime{}, err
+	}
+	return r, nil
+}
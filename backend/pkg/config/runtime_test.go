@@ -0,0 +1,162 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRuntime() Runtime {
+	return Runtime{
+		LogLevel:        "info",
+		RateLimit:       100,
+		RateLimitWindow: time.Minute,
+		Features:        map[string]bool{"exports": true},
+	}
+}
+
+func TestRuntimeStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"log_level": "debug"}`), 0o600))
+
+	store, err := NewRuntimeStore(testRuntime(), path)
+	require.NoError(t, err)
+	assert.Equal(t, "debug", store.Current().LogLevel)
+	assert.Equal(t, 100, store.Current().RateLimit)
+
+	var applied []Runtime
+	store.Subscribe(func(r Runtime) { applied = append(applied, r) })
+
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"log_level": "warn",
+		"rate_limit": 20,
+		"rate_limit_window": "30s",
+		"cors_allowed_origins": ["https://app.example.com"],
+		"features": {"beta_ui": true}
+	}`), 0o600))
+	r, err := store.Reload()
+	require.NoError(t, err)
+
+	assert.Equal(t, "warn", r.LogLevel)
+	assert.Equal(t, 20, r.RateLimit)
+	assert.Equal(t, 30*time.Second, r.RateLimitWindow)
+	assert.Equal(t, []string{"https://app.example.com"}, r.CORSAllowedOrigins)
+	assert.True(t, r.FeatureEnabled("beta_ui"))
+	assert.True(t, r.FeatureEnabled("exports"), "flags from the environment are kept")
+	require.Len(t, applied, 1)
+	assert.Equal(t, r, store.Current())
+}
+
+func TestRuntimeStoreRejectsInvalidReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rate_limit": 50}`), 0o600))
+
+	store, err := NewRuntimeStore(testRuntime(), path)
+	require.NoError(t, err)
+
+	called := false
+	store.Subscribe(func(Runtime) { called = true })
+
+	for _, content := range []string{
+		`{"rate_limit": 10, "log_level": "loud"}`,
+		`{"rate_limit": 0}`,
+		`{"cors_allowed_origins": ["app.example.com"]}`,
+		`{"rate_limit_windw": "1m"}`,
+		`not json`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := store.Reload()
+		assert.Error(t, err, content)
+	}
+
+	assert.False(t, called)
+	assert.Equal(t, 50, store.Current().RateLimit)
+}
+
+func TestRuntimeRateLimitRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rate_limit_rules": [
+		{"name": "reads", "methods": ["GET"], "path": "/api/*", "limit": 300, "window": "1m"},
+		{"name": "services", "tier": "service", "limit": 1000, "window": "1m", "burst": 100, "key": "tenant"}
+	]}`), 0o600))
+
+	store, err := NewRuntimeStore(testRuntime(), path)
+	require.NoError(t, err)
+	assert.Equal(t, []RateLimitRule{
+		{Name: "reads", Methods: []string{"GET"}, Path: "/api/*", Limit: 300, Window: time.Minute},
+		{Name: "services", Tier: "service", Limit: 1000, Window: time.Minute, Burst: 100, Key: "tenant"},
+	}, store.Current().RateLimitRules)
+
+	for _, content := range []string{
+		`{"rate_limit_rules": [{"limit": 10, "window": "1m"}]}`,
+		`{"rate_limit_rules": [{"name": "a", "limit": 10}]}`,
+		`{"rate_limit_rules": [{"name": "a", "limit": 10, "window": "soon"}]}`,
+		`{"rate_limit_rules": [{"name": "a", "limit": 10, "window": "1m", "key": "session"}]}`,
+		`{"rate_limit_rules": [{"name": "a", "limit": 10, "window": "1m", "tier": "gold"}]}`,
+		`{"rate_limit_rules": [{"name": "a", "limit": -1}, {"name": "a", "limit": -1}]}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := store.Reload()
+		assert.Error(t, err, content)
+	}
+}
+
+func TestRuntimeUICapabilities(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runtime.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"ui_capabilities": [
+		{"key": "menu.roles", "kind": "menu", "label": "Roles", "path": "/roles", "all_of": ["read_role"]}
+	]}`), 0o600))
+
+	store, err := NewRuntimeStore(testRuntime(), path)
+	require.NoError(t, err)
+	assert.Equal(t, []UICapability{
+		{Key: "menu.roles", Kind: "menu", Label: "Roles", Path: "/roles", AllOf: []string{"read_role"}},
+	}, store.Current().UICapabilities)
+
+	for _, content := range []string{
+		`{"ui_capabilities": [{"kind": "menu"}]}`,
+		`{"ui_capabilities": [{"key": "menu.roles", "kind": "button"}]}`,
+		`{"ui_capabilities": [{"key": "menu.roles", "kind": "menu", "any_of": ["read_roles"]}]}`,
+		`{"ui_capabilities": [{"key": "a", "kind": "menu"}, {"key": "a", "kind": "feature"}]}`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := store.Reload()
+		assert.Error(t, err, content)
+	}
+}
+
+func TestLoadRuntimeSettings(t *testing.T) {
+	t.Setenv("RATE_LIMIT_REQUESTS", "10")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com")
+	t.Setenv("FEATURE_FLAGS", "beta_ui=true,exports=false")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+
+	r := cfg.Runtime()
+	assert.Equal(t, 10, r.RateLimit)
+	assert.Equal(t, time.Minute, r.RateLimitWindow)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, r.CORSAllowedOrigins)
+	assert.Equal(t, map[string]bool{"beta_ui": true, "exports": false}, r.Features)
+	assert.Equal(t, DefaultRateLimitRules(), r.RateLimitRules)
+	assert.Equal(t, DefaultUICapabilities(), r.UICapabilities)
+	assert.NoError(t, r.Validate())
+
+	t.Setenv("RATE_LIMIT_RULES", `[{"name": "login", "path": "/api/users/login", "limit": 5, "window": "1m"}]`)
+	cfg, err = Load()
+	require.NoError(t, err)
+	assert.Equal(t, []RateLimitRule{{Name: "login", Path: "/api/users/login", Limit: 5, Window: time.Minute}}, cfg.RateLimitRules)
+
+	t.Setenv("RATE_LIMIT_RULES", `{"name": "login"}`)
+	_, err = Load()
+	assert.Error(t, err)
+	t.Setenv("RATE_LIMIT_RULES", "")
+
+	t.Setenv("FEATURE_FLAGS", "beta_ui=maybe")
+	_, err = Load()
+	assert.Error(t, err)
+}
@@ -0,0 +1,331 @@
+// Package database provides shared database plumbing for the repository layer
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"base-app/pkg/dberrors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readAttempts is how often a read query is tried when the database is unreachable
+const readAttempts = 3
+
+// retryBackoff is the wait before the first retry of a read and the first re-check of a lost
+// primary; it doubles with each attempt
+const retryBackoff = 100 * time.Millisecond
+
+// defaultMaxIdleConns is database/sql's default idle pool size, restored after the idle
+// connections of a lost database are dropped
+const defaultMaxIdleConns = 2
+
+// Querier is the read-only subset of *sql.DB used by repository read paths.
+// Both *sql.DB and *Cluster satisfy it.
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// replica tracks a read replica connection and its last known health
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// Cluster routes writes to a primary database and reads to healthy replicas,
+// falling back to the primary when no replica is available.
+//
+// Reads served by replicas may lag behind the primary; anything that must observe
+// its own writes (transactions, read-modify-write sequences) should use Primary().
+//
+// The cluster survives a failover without a restart: reads that hit a lost connection are
+// retried, and a lost primary has its stale connections dropped and is re-checked with backoff
+// until it answers again.
+type Cluster struct {
+	primary        *sql.DB
+	primaryHealthy atomic.Bool
+	replicas       []*replica
+	next           atomic.Uint32
+	logger         *logrus.Logger
+	stopOnce       sync.Once
+	stop           chan struct{}
+	// dropIdle closes the idle connections of a lost database
+	dropIdle func(db *sql.DB)
+}
+
+// Open connects to the Postgres primary and every replica DSN with instrumented connections.
+// Replicas that cannot be opened are skipped with a warning so a broken replica never prevents startup.
+func Open(primaryDSN string, replicaDSNs []string, opts Options, logger *logrus.Logger) (*Cluster, error) {
+	primary, err := OpenPostgres(primaryDSN, opts, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Replica DSNs carry their own credentials
+	replicaOpts := opts
+	replicaOpts.Credentials = nil
+
+	var replicas []*sql.DB
+	for i, dsn := range replicaDSNs {
+		db, err := OpenPostgres(dsn, replicaOpts, logger)
+		if err != nil {
+			logger.WithError(err).WithField("replica", i).Warn("Failed to open read replica, skipping")
+			continue
+		}
+		replicas = append(replicas, db)
+	}
+
+	return NewCluster(primary, replicas, logger), nil
+}
+
+// NewCluster wraps existing connections. Replicas start out healthy until a health check says otherwise.
+func NewCluster(primary *sql.DB, replicas []*sql.DB, logger *logrus.Logger) *Cluster {
+	c := &Cluster{
+		primary:  primary,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		dropIdle: dropIdleConns,
+	}
+	c.primaryHealthy.Store(true)
+	for i, db := range replicas {
+		r := &replica{name: "replica-" + strconv.Itoa(i), db: db}
+		r.healthy.Store(true)
+		c.replicas = append(c.replicas, r)
+	}
+	return c
+}
+
+// Primary returns the writable primary connection
+func (c *Cluster) Primary() *sql.DB {
+	return c.primary
+}
+
+// Reader returns a healthy replica in round-robin order, or the primary if none is healthy
+func (c *Cluster) Reader() *sql.DB {
+	n := len(c.replicas)
+	if n == 0 {
+		return c.primary
+	}
+	start := int(c.next.Add(1))
+	for i := 0; i < n; i++ {
+		r := c.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.db
+		}
+	}
+	return c.primary
+}
+
+// Query runs a read query on the current reader, retrying on another connection when the
+// database could not be reached
+func (c *Cluster) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	var rows *sql.Rows
+	err := c.retryRead(func(db *sql.DB) error {
+		var err error
+		rows, err = db.Query(query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// QueryRow runs a single-row read query on the current reader, retrying like Query
+func (c *Cluster) QueryRow(query string, args ...interface{}) *sql.Row {
+	var row *sql.Row
+	c.retryRead(func(db *sql.DB) error {
+		row = db.QueryRow(query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// retryRead runs read on the current reader until it succeeds, fails for a reason other than
+// an unreachable database, or readAttempts are used up. A reader that could not be reached is
+// marked unhealthy, so the next attempt goes elsewhere when it can.
+func (c *Cluster) retryRead(read func(db *sql.DB) error) error {
+	backoff := retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		db := c.Reader()
+		if err = read(db); err == nil || !dberrors.IsUnavailable(err) || attempt == readAttempts {
+			return err
+		}
+		c.markUnavailable(db, err)
+		select {
+		case <-c.stop:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// markUnavailable flags db as unhealthy after err showed it could not be reached
+func (c *Cluster) markUnavailable(db *sql.DB, err error) {
+	if db == c.primary {
+		c.setPrimaryHealthy(false, err)
+		return
+	}
+	for _, r := range c.replicas {
+		if r.db == db && r.healthy.Swap(false) {
+			c.logger.WithError(err).WithField("replica", r.name).Warn("Read replica unreachable, routing reads elsewhere")
+		}
+	}
+}
+
+// setPrimaryHealthy records the primary's health, dropping its idle connections when it is lost
+// so that new ones are opened to wherever it comes back, e.g. a promoted standby
+func (c *Cluster) setPrimaryHealthy(healthy bool, err error) {
+	if previous := c.primaryHealthy.Swap(healthy); previous == healthy {
+		return
+	}
+	if healthy {
+		c.logger.Info("Primary database recovered")
+		return
+	}
+	c.logger.WithError(err).Error("Primary database unreachable; reconnecting")
+	c.dropIdle(c.primary)
+}
+
+// dropIdleConns closes the idle connections of db; new ones are opened on demand
+func dropIdleConns(db *sql.DB) {
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(defaultMaxIdleConns)
+}
+
+// CheckPrimary pings the primary and records whether it answered
+func (c *Cluster) CheckPrimary(ctx context.Context) error {
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err := c.primary.PingContext(pingCtx)
+	c.setPrimaryHealthy(err == nil, err)
+	return err
+}
+
+// WaitForPrimary pings the primary with backoff until it answers or timeout passes, so the
+// application can start while the database is still coming up
+func (c *Cluster) WaitForPrimary(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	backoff := retryBackoff
+	for {
+		err := c.CheckPrimary(ctx)
+		if err == nil {
+			return nil
+		}
+		c.logger.WithError(err).Warn("Database not reachable yet, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// Health is the state of the cluster as last checked
+type Health struct {
+	// Status is "ok", "degraded" when the primary or a replica is down but reads are still
+	// served, or "unavailable" when nothing can be read
+	Status          string `json:"status"`
+	Primary         bool   `json:"primary"`
+	Replicas        int    `json:"replicas"`
+	HealthyReplicas int    `json:"healthy_replicas"`
+}
+
+// Health statuses
+const (
+	HealthOK          = "ok"
+	HealthDegraded    = "degraded"
+	HealthUnavailable = "unavailable"
+)
+
+// Health reports the state of the primary and replicas as of their last check
+func (c *Cluster) Health() Health {
+	h := Health{Primary: c.primaryHealthy.Load(), Replicas: len(c.replicas)}
+	for _, r := range c.replicas {
+		if r.healthy.Load() {
+			h.HealthyReplicas++
+		}
+	}
+	switch {
+	case h.Primary && h.HealthyReplicas == h.Replicas:
+		h.Status = HealthOK
+	case h.Primary || h.HealthyReplicas > 0:
+		h.Status = HealthDegraded
+	default:
+		h.Status = HealthUnavailable
+	}
+	return h
+}
+
+// CheckReplicas pings every replica and updates its health flag, logging state changes
+func (c *Cluster) CheckReplicas(ctx context.Context) {
+	for _, r := range c.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := r.db.PingContext(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if previous := r.healthy.Swap(healthy); previous != healthy {
+			entry := c.logger.WithField("replica", r.name)
+			if healthy {
+				entry.Info("Read replica recovered")
+			} else {
+				entry.WithError(err).Warn("Read replica unhealthy, routing reads elsewhere")
+			}
+		}
+	}
+}
+
+// StartHealthChecks pings the primary and replicas every interval until ctx is cancelled or
+// Close is called. While the primary is down it is re-checked sooner, with backoff from
+// retryBackoff up to interval, so recovery is noticed quickly.
+func (c *Cluster) StartHealthChecks(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		wait, backoff := interval, time.Duration(0)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.stop:
+				return
+			case <-time.After(wait):
+			}
+			c.CheckReplicas(ctx)
+			if c.CheckPrimary(ctx) == nil {
+				wait, backoff = interval, 0
+				continue
+			}
+			switch {
+			case backoff == 0:
+				backoff = retryBackoff
+			case backoff*2 < interval:
+				backoff *= 2
+			default:
+				backoff = interval
+			}
+			wait = backoff
+		}
+	}()
+}
+
+// Close stops health checks and closes all connections
+func (c *Cluster) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+	for _, r := range c.replicas {
+		r.db.Close()
+	}
+	return c.primary.Close()
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	return logger
+}
+
+func TestClusterReaderFallsBackToPrimary(t *testing.T) {
+	primary, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer primary.Close()
+
+	cluster := NewCluster(primary, nil, newTestLogger())
+	assert.Same(t, primary, cluster.Reader())
+}
+
+func TestClusterSkipsUnhealthyReplicas(t *testing.T) {
+	primary, _, err := sqlmock.New()
+	require.NoError(t, err)
+	healthy, healthyMock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	broken, brokenMock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+
+	cluster := NewCluster(primary, []*sql.DB{healthy, broken}, newTestLogger())
+	defer cluster.Close()
+
+	healthyMock.ExpectPing()
+	brokenMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	cluster.CheckReplicas(context.Background())
+
+	for i := 0; i < 4; i++ {
+		assert.Same(t, healthy, cluster.Reader())
+	}
+
+	// Once every replica is down, reads go back to the primary
+	healthyMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	brokenMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	cluster.CheckReplicas(context.Background())
+	assert.Same(t, primary, cluster.Reader())
+}
+
+// newTestCluster creates a cluster on sqlmock connections, which cannot be reopened once their
+// idle connection is dropped
+func newTestCluster(primary *sql.DB, replicas ...*sql.DB) *Cluster {
+	cluster := NewCluster(primary, replicas, newTestLogger())
+	cluster.dropIdle = func(*sql.DB) {}
+	return cluster
+}
+
+func TestClusterRetriesReadsOnAnotherConnection(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New()
+	require.NoError(t, err)
+	replica, replicaMock, err := sqlmock.New()
+	require.NoError(t, err)
+	cluster := newTestCluster(primary, replica)
+	defer cluster.Close()
+
+	replicaMock.ExpectQuery("SELECT name").WillReturnError(&pq.Error{Code: "57P01", Message: "terminating connection due to administrator command"})
+	primaryMock.ExpectQuery("SELECT name").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("admin"))
+
+	var name string
+	require.NoError(t, cluster.QueryRow("SELECT name FROM roles").Scan(&name))
+	assert.Equal(t, "admin", name)
+	assert.Equal(t, Health{Status: HealthDegraded, Primary: true, Replicas: 1}, cluster.Health(), "the lost replica is skipped until it answers a ping")
+	assert.NoError(t, replicaMock.ExpectationsWereMet())
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestClusterGivesUpOnUnreachableDatabase(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	cluster := newTestCluster(primary)
+	defer cluster.Close()
+
+	lost := &pq.Error{Code: "08006", Message: "connection failure"}
+	for i := 0; i < readAttempts; i++ {
+		primaryMock.ExpectQuery("SELECT name").WillReturnError(lost)
+	}
+	_, err = cluster.Query("SELECT name FROM roles")
+	assert.ErrorIs(t, err, lost)
+	assert.Equal(t, HealthUnavailable, cluster.Health().Status)
+
+	// Query errors are not retried
+	primaryMock.ExpectQuery("SELECT nme").WillReturnError(&pq.Error{Code: "42703", Message: "column does not exist"})
+	_, err = cluster.Query("SELECT nme FROM roles")
+	assert.Error(t, err)
+
+	primaryMock.ExpectPing()
+	require.NoError(t, cluster.CheckPrimary(context.Background()))
+	assert.Equal(t, HealthOK, cluster.Health().Status)
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
+
+func TestWaitForPrimary(t *testing.T) {
+	primary, primaryMock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(t, err)
+	cluster := newTestCluster(primary)
+	defer cluster.Close()
+
+	primaryMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	primaryMock.ExpectPing()
+	require.NoError(t, cluster.WaitForPrimary(context.Background(), time.Second))
+
+	primaryMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	primaryMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	primaryMock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	assert.Error(t, cluster.WaitForPrimary(context.Background(), 150*time.Millisecond))
+}
@@ -0,0 +1,225 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ephemeral Postgres modes
+const (
+	// EphemeralEmbedded runs initdb and pg_ctl from the local Postgres installation in a temporary
+	// directory. Postgres refuses to run as root, so this needs an unprivileged user.
+	EphemeralEmbedded = "embedded"
+	// EphemeralDocker runs a throwaway container with the docker CLI
+	EphemeralDocker = "docker"
+)
+
+// EphemeralOptions configures StartEphemeral
+type EphemeralOptions struct {
+	// BinDir holds initdb and pg_ctl for embedded servers; they are looked up in PATH when empty
+	BinDir string
+	// Image is the container image of docker servers, postgres:15 when empty
+	Image string
+	// Password of the postgres superuser, postgres when empty
+	Password string
+	// StartTimeout bounds how long to wait for the server to accept connections, 60s when 0
+	StartTimeout time.Duration
+}
+
+// Ephemeral is a throwaway Postgres server for tests and demo runs; everything it stored is gone
+// once it is stopped
+type Ephemeral struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+
+	stop func() error
+}
+
+// StartEphemeral starts a Postgres server in mode and waits until it accepts connections
+func StartEphemeral(mode string, opts EphemeralOptions) (*Ephemeral, error) {
+	if opts.Image == "" {
+		opts.Image = "postgres:15"
+	}
+	if opts.Password == "" {
+		opts.Password = "postgres"
+	}
+	if opts.StartTimeout == 0 {
+		opts.StartTimeout = time.Minute
+	}
+
+	var e *Ephemeral
+	var err error
+	switch mode {
+	case EphemeralEmbedded:
+		e, err = startEmbedded(opts)
+	case EphemeralDocker:
+		e, err = startContainer(opts)
+	default:
+		return nil, fmt.Errorf("database: unknown ephemeral Postgres mode %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := e.waitReady(opts.StartTimeout); err != nil {
+		e.Stop()
+		return nil, err
+	}
+	return e, nil
+}
+
+// DSN is the connection string of database name on the server
+func (e *Ephemeral) DSN(name string) string {
+	return "host=" + e.Host + " port=" + e.Port + " user=" + e.User + " password=" + e.Password + " dbname=" + name + " sslmode=disable"
+}
+
+// CreateDatabase creates database name, unless it exists
+func (e *Ephemeral) CreateDatabase(name string) error {
+	db, err := sql.Open("postgres", e.DSN("postgres"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).Scan(&exists); err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(`CREATE DATABASE "` + strings.ReplaceAll(name, `"`, `""`) + `"`)
+	return err
+}
+
+// Stop shuts the server down and deletes its data
+func (e *Ephemeral) Stop() error {
+	return e.stop()
+}
+
+// waitReady pings the server until it answers or timeout passes
+func (e *Ephemeral) waitReady(timeout time.Duration) error {
+	db, err := sql.Open("postgres", e.DSN("postgres"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("database: ephemeral Postgres not ready after %s: %w", timeout, err)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func startEmbedded(opts EphemeralOptions) (*Ephemeral, error) {
+	bin := func(name string) string {
+		if opts.BinDir != "" {
+			return filepath.Join(opts.BinDir, name)
+		}
+		return name
+	}
+	dir, err := os.MkdirTemp("", "base-app-postgres-")
+	if err != nil {
+		return nil, err
+	}
+	port, err := freePort()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	data := filepath.Join(dir, "data")
+
+	// The superuser authenticates by password like against a real server
+	pwfile := filepath.Join(dir, "pwfile")
+	if err := os.WriteFile(pwfile, []byte(opts.Password+"\n"), 0o600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := run(bin("initdb"), "-D", data, "-U", "postgres", "--pwfile", pwfile, "--auth", "md5", "-E", "UTF8", "--no-sync"); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	// Durability is pointless for a throwaway server; turning it off makes tests faster
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off -c synchronous_commit=off -c full_page_writes=off", port, dir)
+	if err := run(bin("pg_ctl"), "-D", data, "-o", options, "-l", filepath.Join(dir, "postgres.log"), "-w", "start"); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Ephemeral{
+		Host:     "127.0.0.1",
+		Port:     strconv.Itoa(port),
+		User:     "postgres",
+		Password: opts.Password,
+		stop: func() error {
+			err := run(bin("pg_ctl"), "-D", data, "-m", "immediate", "-w", "stop")
+			if removeErr := os.RemoveAll(dir); err == nil {
+				err = removeErr
+			}
+			return err
+		},
+	}, nil
+}
+
+func startContainer(opts EphemeralOptions) (*Ephemeral, error) {
+	out, err := output("docker", "run", "--detach", "--rm", "--publish", "127.0.0.1::5432",
+		"--env", "POSTGRES_PASSWORD="+opts.Password, opts.Image,
+		"-c", "fsync=off", "-c", "synchronous_commit=off", "-c", "full_page_writes=off")
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSpace(out)
+	remove := func() error { return run("docker", "rm", "--force", id) }
+
+	// docker port prints one line per address family, e.g. "127.0.0.1:49153"
+	out, err = output("docker", "port", id, "5432/tcp")
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(strings.TrimSpace(strings.SplitN(out, "\n", 2)[0]))
+	if err != nil {
+		remove()
+		return nil, fmt.Errorf("database: unexpected docker port output %q: %w", out, err)
+	}
+	return &Ephemeral{Host: host, Port: port, User: "postgres", Password: opts.Password, stop: remove}, nil
+}
+
+// freePort asks the kernel for a port nothing listens on
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func run(name string, args ...string) error {
+	_, err := output(name, args...)
+	return err
+}
+
+// output runs a command and returns its stdout, folding stderr into the error
+func output(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("database: %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartEphemeral_RejectsUnknownMode(t *testing.T) {
+	_, err := StartEphemeral("sqlite", EphemeralOptions{})
+	assert.ErrorContains(t, err, `unknown ephemeral Postgres mode "sqlite"`)
+}
+
+func TestStartEphemeral_Embedded(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Starts a Postgres server")
+	}
+	if _, err := exec.LookPath("initdb"); err != nil {
+		t.Skip("Postgres binaries not in PATH")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("Postgres refuses to run as root")
+	}
+
+	server, err := StartEphemeral(EphemeralEmbedded, EphemeralOptions{})
+	require.NoError(t, err)
+	defer server.Stop()
+
+	require.NoError(t, server.CreateDatabase("demo"))
+	require.NoError(t, server.CreateDatabase("demo"), "existing databases are kept")
+	db, err := sql.Open("postgres", server.DSN("demo"))
+	require.NoError(t, err)
+	defer db.Close()
+	var name string
+	require.NoError(t, db.QueryRow(`SELECT current_database()`).Scan(&name))
+	assert.Equal(t, "demo", name)
+}
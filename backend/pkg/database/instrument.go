@@ -0,0 +1,233 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// Options tunes how connections are opened and instrumented
+type Options struct {
+	// SlowQueryThreshold logs any statement taking at least this long; zero disables slow query logging
+	SlowQueryThreshold time.Duration
+	// ConnStatementTimeout is set once on every new pooled connection as Postgres'
+	// statement_timeout, so it bounds each statement on any connection; RunInTxContext narrows it
+	// per request. Zero leaves the server default.
+	ConnStatementTimeout time.Duration
+	// Credentials, when set, supplies the user and password for every new connection, overriding
+	// the DSN's. It lets rotated credentials take effect without reopening the pool; connections
+	// that are already open keep working since Postgres only checks credentials on connect.
+	Credentials func() (user, password string)
+}
+
+// OpenPostgres opens a Postgres connection pool whose statements are timed and subject to opts
+func OpenPostgres(dsn string, opts Options, logger *logrus.Logger) (*sql.DB, error) {
+	var connector driver.Connector
+	if opts.Credentials != nil {
+		// Validate the base DSN up front; the real connector is built per connection
+		if _, err := pq.NewConnector(dsn); err != nil {
+			return nil, err
+		}
+		connector = &credentialsConnector{dsn: dsn, credentials: opts.Credentials}
+	} else {
+		base, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		connector = base
+	}
+	return sql.OpenDB(NewInstrumentedConnector(connector, opts, logger)), nil
+}
+
+// credentialsConnector builds a pq connector per connection from the base DSN and the current credentials
+type credentialsConnector struct {
+	dsn         string
+	credentials func() (user, password string)
+}
+
+func (c *credentialsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	user, password := c.credentials()
+	connector, err := pq.NewConnector(c.dsn + " user=" + quoteDSNValue(user) + " password=" + quoteDSNValue(password))
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *credentialsConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// quoteDSNValue quotes a value for a key=value connection string
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// NewInstrumentedConnector wraps a driver connector so that every statement executed through
+// it - including those inside transactions - is timed and logged when slow
+func NewInstrumentedConnector(base driver.Connector, opts Options, logger *logrus.Logger) driver.Connector {
+	return &instrumentedConnector{base: base, opts: opts, logger: logger}
+}
+
+type instrumentedConnector struct {
+	base   driver.Connector
+	opts   Options
+	logger *logrus.Logger
+}
+
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.ConnStatementTimeout > 0 {
+		execer, ok := conn.(driver.ExecerContext)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("database: driver does not support setting statement_timeout")
+		}
+		stmt := "SET statement_timeout = " + strconv.FormatInt(c.opts.ConnStatementTimeout.Milliseconds(), 10)
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("set statement_timeout: %w", err)
+		}
+	}
+
+	return &instrumentedConn{Conn: conn, connector: c}, nil
+}
+
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return c.base.Driver()
+}
+
+// observe logs statements that exceeded the slow query threshold or were cancelled by the statement timeout
+func (c *instrumentedConnector) observe(query string, args []driver.NamedValue, duration time.Duration, err error) {
+	slow := c.opts.SlowQueryThreshold > 0 && duration >= c.opts.SlowQueryThreshold
+	cancelled := isStatementTimeout(err)
+	if !slow && !cancelled {
+		return
+	}
+
+	entry := c.logger.WithFields(logrus.Fields{
+		"duration_ms": duration.Milliseconds(),
+		"query":       compactQuery(query),
+		"params":      redactParams(args),
+	})
+	if cancelled {
+		entry.WithError(err).Warn("Query cancelled by statement timeout")
+		return
+	}
+	entry.Warn("Slow query")
+}
+
+// instrumentedConn forwards to the driver connection, timing statement execution
+type instrumentedConn struct {
+	driver.Conn
+	connector *instrumentedConnector
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	c.connector.observe(query, args, time.Since(start), err)
+	return rows, err
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	c.connector.observe(query, args, time.Since(start), err)
+	return result, err
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+// isStatementTimeout reports whether err is Postgres' query_canceled error raised by statement_timeout
+func isStatementTimeout(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// compactQuery collapses whitespace so multi-line SQL logs on a single line
+func compactQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// redactParams describes statement parameters by type and size only, never by value
+func redactParams(args []driver.NamedValue) []string {
+	params := make([]string, len(args))
+	for i, arg := range args {
+		var desc string
+		switch v := arg.Value.(type) {
+		case nil:
+			desc = "NULL"
+		case string:
+			desc = "string(" + strconv.Itoa(len(v)) + ")"
+		case []byte:
+			desc = "bytes(" + strconv.Itoa(len(v)) + ")"
+		default:
+			desc = fmt.Sprintf("%T", v)
+		}
+		params[i] = "$" + strconv.Itoa(arg.Ordinal) + "=" + desc
+	}
+	return params
+}
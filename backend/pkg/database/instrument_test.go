@@ -0,0 +1,108 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConnector hands out fakeConns that record every executed statement
+type fakeConnector struct {
+	executed []string
+	delay    time.Duration
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{connector: c}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return nil }
+
+type fakeConn struct {
+	connector *fakeConnector
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.connector.executed = append(c.connector.executed, query)
+	time.Sleep(c.connector.delay)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.connector.executed = append(c.connector.executed, query)
+	time.Sleep(c.connector.delay)
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (r *fakeRows) Columns() []string              { return []string{"id"} }
+func (r *fakeRows) Close() error                   { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestInstrumentedConnectorSetsConnStatementTimeout(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	base := &fakeConnector{}
+	db := sql.OpenDB(NewInstrumentedConnector(base, Options{ConnStatementTimeout: 5 * time.Second}, logger))
+	defer db.Close()
+
+	_, err := db.Exec("UPDATE roles SET name = $1 WHERE id = $2", "admin", 1)
+	require.NoError(t, err)
+
+	require.Len(t, base.executed, 2)
+	assert.Equal(t, "SET statement_timeout = 5000", base.executed[0])
+}
+
+func TestInstrumentedConnectorLogsSlowQueriesWithRedactedParams(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	base := &fakeConnector{delay: 5 * time.Millisecond}
+	db := sql.OpenDB(NewInstrumentedConnector(base, Options{SlowQueryThreshold: time.Millisecond}, logger))
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id\n\t\tFROM users WHERE email = $1", "secret@example.com")
+	require.NoError(t, err)
+	rows.Close()
+
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, "Slow query", entry.Message)
+	assert.Equal(t, "SELECT id FROM users WHERE email = $1", entry.Data["query"])
+	assert.Equal(t, []string{"$1=string(18)"}, entry.Data["params"])
+}
+
+func TestInstrumentedConnectorIgnoresFastQueries(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	db := sql.OpenDB(NewInstrumentedConnector(&fakeConnector{}, Options{SlowQueryThreshold: time.Second}, logger))
+	defer db.Close()
+
+	_, err := db.Exec("DELETE FROM roles WHERE id = $1", "x")
+	require.NoError(t, err)
+	assert.Empty(t, hook.AllEntries())
+}
+
+func TestQuoteDSNValue(t *testing.T) {
+	quoted := quoteDSNValue(`p'a\ss word`)
+	assert.Equal(t, `'p\'a\\ss word'`, quoted)
+
+	_, err := pq.NewConnector("host=localhost dbname=baseapp user=" + quoteDSNValue("app") + " password=" + quoted)
+	assert.NoError(t, err)
+}
+
+func TestOpenPostgresWithCredentialsRejectsInvalidDSN(t *testing.T) {
+	_, err := OpenPostgres("host='unterminated", Options{Credentials: func() (string, string) { return "u", "p" }}, logrus.New())
+	assert.Error(t, err)
+}
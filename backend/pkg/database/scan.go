@@ -0,0 +1,49 @@
+package database
+
+import "fmt"
+
+// Scanner is implemented by *sql.Row and *sql.Rows
+type Scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// QueryEach runs query on q and calls fn for every row as it is read. Query, scan and
+// iteration errors (rows.Err) are all returned wrapped with op, so a result set that broke
+// off part way is never mistaken for a complete one.
+func QueryEach(q Querier, op string, fn func(row Scanner) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return fmt.Errorf("%s: row %d: %w", op, n, err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: reading rows after row %d: %w", op, n, err)
+	}
+	return nil
+}
+
+// QueryAll runs query on q and collects every row converted by scan. On any error it
+// returns nil rather than the rows read so far.
+func QueryAll[T any](q Querier, op string, scan func(row Scanner) (T, error), query string, args ...interface{}) ([]T, error) {
+	var items []T
+	err := QueryEach(q, op, func(row Scanner) error {
+		item, err := scan(row)
+		if err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
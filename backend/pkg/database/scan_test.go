@@ -0,0 +1,83 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func scanName(row Scanner) (string, error) {
+	var name string
+	err := row.Scan(&name)
+	return name, err
+}
+
+func TestQueryAll(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT name FROM roles").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("admin").AddRow("editor"))
+
+	names, err := QueryAll(db, "list roles", scanName, "SELECT name FROM roles")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin", "editor"}, names)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestQueryAll_IterationErrorDiscardsPartialResult(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	broken := errors.New("connection reset by peer")
+	mock.ExpectQuery("SELECT name FROM roles").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).
+			AddRow("admin").
+			AddRow("editor").
+			RowError(1, broken))
+
+	names, err := QueryAll(db, "list roles", scanName, "SELECT name FROM roles")
+
+	assert.Nil(t, names)
+	assert.ErrorIs(t, err, broken)
+	assert.Contains(t, err.Error(), "list roles")
+	assert.Contains(t, err.Error(), "after row 1")
+}
+
+func TestQueryAll_ScanError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT name FROM roles").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("admin").AddRow(nil))
+
+	names, err := QueryAll(db, "list roles", scanName, "SELECT name FROM roles")
+
+	assert.Nil(t, names)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "list roles: row 1")
+}
+
+func TestQueryEach_QueryErrorAndCallbackError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	failed := errors.New("relation does not exist")
+	mock.ExpectQuery("SELECT name FROM roles").WillReturnError(failed)
+	err = QueryEach(db, "list roles", func(Scanner) error { return nil }, "SELECT name FROM roles")
+	assert.ErrorIs(t, err, failed)
+
+	stop := errors.New("client went away")
+	mock.ExpectQuery("SELECT name FROM roles").
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("admin"))
+	err = QueryEach(db, "list roles", func(Scanner) error { return stop }, "SELECT name FROM roles")
+	assert.ErrorIs(t, err, stop)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
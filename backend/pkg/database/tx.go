@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DBTX is the statement-executing subset shared by *sql.DB and *sql.Tx, letting repositories
+// run unchanged inside or outside a transaction
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// contextDBTX is a DBTX that can also run statements under a context, as *sql.DB and *sql.Tx can
+type contextDBTX interface {
+	DBTX
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// WithContext returns db with every statement run under ctx through ExecContext, QueryContext
+// and QueryRowContext, so repositories built on it give up - and Postgres cancels the statement -
+// once ctx is done. db is returned unchanged if it cannot take a context.
+func WithContext(ctx context.Context, db DBTX) DBTX {
+	if bound, ok := db.(boundDB); ok {
+		db = bound.db
+	}
+	cdb, ok := db.(contextDBTX)
+	if !ok {
+		return db
+	}
+	return boundDB{ctx: ctx, db: cdb}
+}
+
+// boundDB is a DBTX whose statements all run under ctx
+type boundDB struct {
+	ctx context.Context
+	db  contextDBTX
+}
+
+func (b boundDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return b.db.ExecContext(b.ctx, query, args...)
+}
+
+func (b boundDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return b.db.QueryContext(b.ctx, query, args...)
+}
+
+func (b boundDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return b.db.QueryRowContext(b.ctx, query, args...)
+}
+
+type statementTimeoutKey struct{}
+
+// WithStatementTimeout returns ctx carrying timeout as the longest any statement of a transaction
+// begun under it may run; see StatementBudget
+func WithStatementTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, statementTimeoutKey{}, timeout)
+}
+
+// StatementBudget is how long a statement run under ctx may take: the timeout set with
+// WithStatementTimeout, cut down to what is left before ctx's deadline. Zero means no limit.
+func StatementBudget(ctx context.Context) time.Duration {
+	budget, _ := ctx.Value(statementTimeoutKey{}).(time.Duration)
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); budget <= 0 || left < budget {
+			budget = left
+		}
+		// A statement_timeout of 0 means no limit, so a spent deadline gets the smallest one instead
+		if budget < time.Millisecond {
+			budget = time.Millisecond
+		}
+	}
+	return budget
+}
+
+// txBeginner is implemented by *sql.DB but not *sql.Tx
+type txBeginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// RunInTx runs fn in a transaction, committing when fn succeeds and rolling back when it
+// returns an error or panics. If db is already a transaction, fn simply joins it so that
+// repository methods needing atomicity compose into a larger unit of work. A db bound with
+// WithContext keeps its context, as with RunInTxContext.
+func RunInTx(db DBTX, fn func(tx DBTX) error) error {
+	bound, ok := db.(boundDB)
+	if !ok {
+		if _, ok := db.(txBeginner); !ok {
+			return fn(db)
+		}
+		return RunInTxContext(context.Background(), db, fn)
+	}
+	return RunInTxContext(bound.ctx, bound.db, fn)
+}
+
+// RunInTxContext is RunInTx under ctx: fn's statements run under ctx, and a transaction it begins
+// first sets statement_timeout LOCAL to ctx's StatementBudget, so none of its statements can
+// outlast the request it serves
+func RunInTxContext(ctx context.Context, db DBTX, fn func(tx DBTX) error) (err error) {
+	if bound, ok := db.(boundDB); ok {
+		db = bound.db
+	}
+	beginner, ok := db.(txBeginner)
+	if !ok {
+		return fn(WithContext(ctx, db))
+	}
+
+	tx, err := beginner.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if budget := StatementBudget(ctx); budget > 0 {
+		stmt := "SET LOCAL statement_timeout = " + strconv.FormatInt(budget.Milliseconds(), 10)
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("set statement_timeout: %w", err)
+		}
+	}
+
+	if err := fn(WithContext(ctx, tx)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
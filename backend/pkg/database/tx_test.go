@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunInTx_CommitsOnSuccess(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roles").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = RunInTx(db, func(tx DBTX) error {
+		_, err := tx.Exec("DELETE FROM roles WHERE id = $1", "r1")
+		return err
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunInTx_RollsBackOnError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	boom := errors.New("boom")
+	err = RunInTx(db, func(tx DBTX) error { return boom })
+
+	assert.ErrorIs(t, err, boom)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunInTx_JoinsExistingTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Only the outer call begins and commits
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO role_permissions").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = RunInTx(db, func(outer DBTX) error {
+		return RunInTx(outer, func(inner DBTX) error {
+			_, err := inner.Exec("INSERT INTO role_permissions (role_id, permission_id) VALUES ($1, $2)", "r1", "p1")
+			return err
+		})
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunInTxContext_SetsLocalStatementTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 2000").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM roles").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx := WithStatementTimeout(context.Background(), 2*time.Second)
+	err = RunInTxContext(ctx, db, func(tx DBTX) error {
+		_, err := tx.Exec("DELETE FROM roles WHERE id = $1", "r1")
+		return err
+	})
+
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestStatementBudget_ShrinksToDeadline(t *testing.T) {
+	assert.Zero(t, StatementBudget(context.Background()))
+	assert.Equal(t, 5*time.Second, StatementBudget(WithStatementTimeout(context.Background(), 5*time.Second)))
+
+	ctx, cancel := context.WithTimeout(WithStatementTimeout(context.Background(), time.Minute), time.Second)
+	defer cancel()
+	budget := StatementBudget(ctx)
+	assert.True(t, budget > 0 && budget <= time.Second, "budget %s", budget)
+
+	// A spent deadline still limits statements rather than lifting the limit
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	assert.Equal(t, time.Millisecond, StatementBudget(expired))
+}
+
+func TestRunInTx_JoinedStatementsKeepTheRequestContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = RunInTxContext(ctx, db, func(outer DBTX) error {
+		cancel()
+		// A repository joining the transaction without a context still runs under the request's
+		return RunInTx(outer, func(inner DBTX) error {
+			_, err := inner.Exec("DELETE FROM roles WHERE id = $1", "r1")
+			return err
+		})
+	})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
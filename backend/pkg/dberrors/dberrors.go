@@ -0,0 +1,77 @@
+// Package dberrors translates Postgres driver errors into conditions the service layer can act on
+package dberrors
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// Postgres SQLSTATE codes handled by this package
+const (
+	CodeUniqueViolation     = "23505"
+	CodeForeignKeyViolation = "23503"
+)
+
+// code returns the SQLSTATE of a Postgres error, or "" if err is not one
+func code(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	return ""
+}
+
+// IsUniqueViolation reports whether err is a Postgres unique constraint violation
+func IsUniqueViolation(err error) bool {
+	return code(err) == CodeUniqueViolation
+}
+
+// IsForeignKeyViolation reports whether err is a Postgres foreign key violation
+func IsForeignKeyViolation(err error) bool {
+	return code(err) == CodeForeignKeyViolation
+}
+
+// Constraint returns the name of the constraint or index that err violated, or "" if unknown
+func Constraint(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Constraint
+	}
+	return ""
+}
+
+// IsUnavailable reports whether err means the database could not be reached or is refusing
+// work (connection failures, shutdown, too many connections) as opposed to a query error
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P01", "57P02", "57P03", "53300":
+			return true
+		}
+		return pqErr.Code.Class() == "08"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// UniqueViolationField maps a unique violation to the request field it concerns using
+// constraints (constraint or index name -> field). It returns false if err is not a unique
+// violation or the constraint is not listed.
+func UniqueViolationField(err error, constraints map[string]string) (string, bool) {
+	if !IsUniqueViolation(err) {
+		return "", false
+	}
+	field, ok := constraints[Constraint(err)]
+	return field, ok
+}
@@ -0,0 +1,43 @@
+package dberrors
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueViolationField(t *testing.T) {
+	constraints := map[string]string{"roles_name_key": "name"}
+	err := fmt.Errorf("insert role: %w", &pq.Error{Code: CodeUniqueViolation, Constraint: "roles_name_key"})
+
+	field, ok := UniqueViolationField(err, constraints)
+	assert.True(t, ok)
+	assert.Equal(t, "name", field)
+
+	_, ok = UniqueViolationField(&pq.Error{Code: CodeUniqueViolation, Constraint: "other_key"}, constraints)
+	assert.False(t, ok)
+
+	_, ok = UniqueViolationField(&pq.Error{Code: CodeForeignKeyViolation, Constraint: "roles_name_key"}, constraints)
+	assert.False(t, ok)
+}
+
+func TestClassification(t *testing.T) {
+	assert.True(t, IsUniqueViolation(&pq.Error{Code: CodeUniqueViolation}))
+	assert.True(t, IsForeignKeyViolation(&pq.Error{Code: CodeForeignKeyViolation}))
+	assert.False(t, IsUniqueViolation(errors.New("boom")))
+	assert.Equal(t, "", Constraint(nil))
+}
+
+func TestIsUnavailable(t *testing.T) {
+	assert.True(t, IsUnavailable(fmt.Errorf("query: %w", driver.ErrBadConn)))
+	assert.True(t, IsUnavailable(&pq.Error{Code: "08006"}))
+	assert.True(t, IsUnavailable(&pq.Error{Code: "57P01"}))
+	assert.True(t, IsUnavailable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.False(t, IsUnavailable(&pq.Error{Code: CodeUniqueViolation}))
+	assert.False(t, IsUnavailable(nil))
+}
@@ -0,0 +1,144 @@
+package emailtemplates
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where email templates are served
+const Path = "/api/email-templates"
+
+// Summary is a template with the current version of each of its locales
+type Summary struct {
+	Definition
+	Locales []*Template `json:"locales"`
+}
+
+// writeJSON answers with v
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeInvalidBody rejects a request whose body is not valid JSON
+func writeInvalidBody(w http.ResponseWriter) {
+	httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+}
+
+// ListHandler handles GET /api/email-templates
+func ListHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Definitions())
+	}
+}
+
+// SummaryHandler handles GET /api/email-templates/{name}
+func SummaryHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		def, err := definition(name)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get email template")
+			return
+		}
+		locales, err := service.Locales(name)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get email template")
+			return
+		}
+		writeJSON(w, http.StatusOK, Summary{Definition: def, Locales: locales})
+	}
+}
+
+// GetHandler handles GET /api/email-templates/{name}/{locale}, of an older version with
+// ?version=
+func GetHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				httpapi.WriteError(w, apperrors.Invalid("INVALID_VERSION", "version must be a positive number"), "Failed to get email template")
+				return
+			}
+			version = n
+		}
+		vars := mux.Vars(r)
+		t, err := service.Get(vars["name"], vars["locale"], version)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get email template")
+			return
+		}
+		writeJSON(w, http.StatusOK, t)
+	}
+}
+
+// VersionsHandler handles GET /api/email-templates/{name}/{locale}/versions
+func VersionsHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+		vars := mux.Vars(r)
+		versions, err := service.Versions(vars["name"], vars["locale"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list email template versions")
+			return
+		}
+		httpapi.WriteList(w, r, httpapi.Paginate(versions, page), len(versions), page)
+	}
+}
+
+// SaveHandler handles PUT /api/email-templates/{name}/{locale}, which saves a new version
+func SaveHandler(service *Service, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req SaveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+		vars := mux.Vars(r)
+		t, err := service.Save(r.Context(), vars["name"], vars["locale"], req, viewer(r).UserID)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to save email template")
+			return
+		}
+		writeJSON(w, http.StatusCreated, t)
+	}
+}
+
+// PreviewHandler handles POST /api/email-templates/{name}/preview
+func PreviewHandler(service *Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req PreviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeInvalidBody(w)
+			return
+		}
+		msg, err := service.Preview(mux.Vars(r)["name"], req)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to render email template")
+			return
+		}
+		writeJSON(w, http.StatusOK, msg)
+	}
+}
+
+// Mount registers the template endpoints under Path, wrapped by protect
+func Mount(r *mux.Router, service *Service, viewer func(r *http.Request) fieldfilter.Viewer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(ListHandler())).Methods("GET")
+	r.HandleFunc(Path+"/{name}", protect(SummaryHandler(service))).Methods("GET")
+	r.HandleFunc(Path+"/{name}/preview", protect(PreviewHandler(service))).Methods("POST")
+	r.HandleFunc(Path+"/{name}/{locale}", protect(GetHandler(service))).Methods("GET")
+	r.HandleFunc(Path+"/{name}/{locale}", protect(SaveHandler(service, viewer))).Methods("PUT")
+	r.HandleFunc(Path+"/{name}/{locale}/versions", protect(VersionsHandler(service))).Methods("GET")
+}
@@ -0,0 +1,92 @@
+package emailtemplates
+
+import (
+	"database/sql"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/database"
+	"base-app/pkg/dberrors"
+)
+
+// Store keeps template versions. The Postgres store expects this table:
+//
+//	CREATE TABLE email_templates (
+//		name VARCHAR(50) NOT NULL,
+//		locale VARCHAR(10) NOT NULL,
+//		version INT NOT NULL,
+//		subject TEXT NOT NULL,
+//		text_body TEXT NOT NULL,
+//		html_body TEXT NOT NULL DEFAULT '',
+//		created_by VARCHAR NOT NULL DEFAULT '',
+//		created_at TIMESTAMP NOT NULL,
+//		PRIMARY KEY (name, locale, version)
+//	)
+type Store interface {
+	// Create stores a new version, failing with a conflict when the version exists
+	Create(t *Template) error
+	// Get returns one version, or nil
+	Get(name, locale string, version int) (*Template, error)
+	// Latest returns the newest version in locale, or nil
+	Latest(name, locale string) (*Template, error)
+	// Versions returns every version in locale, newest first
+	Versions(name, locale string) ([]*Template, error)
+	// Current returns the newest version in each locale, by locale
+	Current(name string) ([]*Template, error)
+}
+
+// store implements Store on Postgres
+type store struct {
+	db database.DBTX
+}
+
+// NewStore creates a Postgres template store
+func NewStore(db *sql.DB) Store {
+	return &store{db: db}
+}
+
+const templateColumns = `name, locale, version, subject, text_body, html_body, created_by, created_at`
+
+func scanTemplate(row database.Scanner) (*Template, error) {
+	var t Template
+	if err := row.Scan(&t.Name, &t.Locale, &t.Version, &t.Subject, &t.Text, &t.HTML, &t.CreatedBy, &t.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *store) Create(t *Template) error {
+	_, err := s.db.Exec(`INSERT INTO email_templates (`+templateColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		t.Name, t.Locale, t.Version, t.Subject, t.Text, t.HTML, t.CreatedBy, t.CreatedAt)
+	if dberrors.IsUniqueViolation(err) {
+		return apperrors.Conflict("TEMPLATE_VERSION_CONFLICT", "The template was changed at the same time; reload it and save again")
+	}
+	return err
+}
+
+// one returns the first template query returns, or nil
+func (s *store) one(op, query string, args ...interface{}) (*Template, error) {
+	templates, err := database.QueryAll(s.db, op, scanTemplate, query, args...)
+	if err != nil || len(templates) == 0 {
+		return nil, err
+	}
+	return templates[0], nil
+}
+
+func (s *store) Get(name, locale string, version int) (*Template, error) {
+	return s.one("get email template", `SELECT `+templateColumns+` FROM email_templates WHERE name = $1 AND locale = $2 AND version = $3`, name, locale, version)
+}
+
+func (s *store) Latest(name, locale string) (*Template, error) {
+	return s.one("get latest email template", `SELECT `+templateColumns+` FROM email_templates WHERE name = $1 AND locale = $2
+	    ORDER BY version DESC LIMIT 1`, name, locale)
+}
+
+func (s *store) Versions(name, locale string) ([]*Template, error) {
+	return database.QueryAll(s.db, "list email template versions", scanTemplate, `SELECT `+templateColumns+` FROM email_templates
+	    WHERE name = $1 AND locale = $2 ORDER BY version DESC`, name, locale)
+}
+
+func (s *store) Current(name string) ([]*Template, error) {
+	return database.QueryAll(s.db, "list email template locales", scanTemplate, `SELECT DISTINCT ON (locale) `+templateColumns+`
+	    FROM email_templates WHERE name = $1 ORDER BY locale, version DESC`, name)
+}
@@ -0,0 +1,395 @@
+// Package emailtemplates keeps the templates of transactional emails in the database, versioned
+// and per locale, so administrators can change them without a release. Every template has a
+// built-in default, which is used until an administrator saves a version of their own.
+package emailtemplates
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"regexp"
+	"sort"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Templates of the transactional emails
+const (
+	PasswordReset = "password_reset"
+	Invite        = "invite"
+	VerifyEmail   = "verify_email"
+	Digest        = "digest"
+	MagicLink     = "magic_link"
+)
+
+// DefaultLocale is used when a template has no variant for the requested locale
+const DefaultLocale = "en"
+
+// MaxBodySize bounds each part of a template
+const MaxBodySize = 64 * 1024
+
+// localePattern accepts a language with an optional region, e.g. "de" or "pt-BR"
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Z]{2})?$`)
+
+// Template is one version of a template in one locale. Subject and Text are text/template
+// sources and HTML, which may be empty, is an html/template source.
+type Template struct {
+	Name    string `json:"name"`
+	Locale  string `json:"locale"`
+	Version int    `json:"version"`
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+	// Builtin marks the default shipped with the application, which has version 0
+	Builtin   bool      `json:"builtin,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Message is a rendered email
+type Message struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// Definition describes a template the application sends
+type Definition struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Sample is the data previews are rendered with unless the request brings its own
+	Sample map[string]interface{} `json:"sample"`
+	// Default is the built-in English template
+	Default Template `json:"-"`
+}
+
+// definitions are the templates of the application's emails
+var definitions = []Definition{
+	{
+		Name:        PasswordReset,
+		Description: "Sent when a user asks to reset their password",
+		Sample:      map[string]interface{}{"Name": "Ada", "ResetURL": "https://example.com/reset?token=abc", "ExpiresIn": "1 hour"},
+		Default: Template{
+			Subject: "Reset your password",
+			Text:    "Hello {{.Name}},\n\nFollow this link to choose a new password: {{.ResetURL}}\nThe link expires in {{.ExpiresIn}}. If you did not ask for a reset, ignore this email.",
+		},
+	},
+	{
+		Name:        Invite,
+		Description: "Sent to people invited to register",
+		Sample:      map[string]interface{}{"InviterName": "Ada", "RegisterURL": "https://example.com/register", "InviteCode": "WELCOME"},
+		Default: Template{
+			Subject: "{{.InviterName}} invited you",
+			Text:    "{{.InviterName}} invited you to create an account.\n\nRegister at {{.RegisterURL}} with the invite code {{.InviteCode}}.",
+		},
+	},
+	{
+		Name:        VerifyEmail,
+		Description: "Sent to confirm a user's email address",
+		Sample:      map[string]interface{}{"Name": "Ada", "VerifyURL": "https://example.com/verify?token=abc"},
+		Default: Template{
+			Subject: "Confirm your email address",
+			Text:    "Hello {{.Name}},\n\nConfirm your email address by following this link: {{.VerifyURL}}",
+		},
+	},
+	{
+		Name:        Digest,
+		Description: "The daily or weekly digest of access control changes",
+		Sample:      map[string]interface{}{"Frequency": "daily", "Summary": "Changes between 2024-01-01T00:00:00Z and 2024-01-02T00:00:00Z: 1 new roles, 0 membership changes, 0 permission grants.\nNew role: auditor"},
+		Default: Template{
+			Subject: "Access control changes ({{.Frequency}} digest)",
+			Text:    "{{.Summary}}",
+		},
+	},
+	{
+		Name:        MagicLink,
+		Description: "Sent when a user asks to log in without a password",
+		Sample:      map[string]interface{}{"Name": "Ada", "LoginURL": "https://example.com/login/magic?code=abc", "Code": "abc", "ExpiresIn": "15 minutes"},
+		Default: Template{
+			Subject: "Your login link",
+			Text:    "Hello {{.Name}},\n\n{{if .LoginURL}}Follow this link to log in: {{.LoginURL}}\nOr enter{{else}}Enter{{end}} the code {{.Code}}. It can be used once and expires in {{.ExpiresIn}}. If you did not ask to log in, ignore this email.",
+		},
+	},
+}
+
+// Definitions lists the templates of the application's emails, by name
+func Definitions() []Definition {
+	defs := append([]Definition(nil), definitions...)
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// definition returns the template called name
+func definition(name string) (Definition, error) {
+	for _, def := range definitions {
+		if def.Name == name {
+			return def, nil
+		}
+	}
+	return Definition{}, apperrors.NotFound("TEMPLATE_NOT_FOUND", fmt.Sprintf("There is no %q email template", name))
+}
+
+// builtin returns the built-in default of def
+func builtin(def Definition) *Template {
+	t := def.Default
+	t.Name, t.Locale, t.Builtin = def.Name, DefaultLocale, true
+	return &t
+}
+
+// SaveRequest is a new version of a template; subject and text are required
+type SaveRequest struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// Service manages and renders email templates
+type Service struct {
+	store  Store
+	logger *logrus.Logger
+}
+
+// NewService creates a template service on store
+func NewService(store Store, logger *logrus.Logger) *Service {
+	return &Service{store: store, logger: logger}
+}
+
+// checkLocale rejects malformed locales
+func checkLocale(locale string) error {
+	if !localePattern.MatchString(locale) {
+		return apperrors.Invalid("INVALID_LOCALE", "locale must be a language code with an optional region, e.g. de or pt-BR")
+	}
+	return nil
+}
+
+// Locales lists the variants of a template, with their current versions; the built-in default
+// is listed as version 0 of DefaultLocale until one is saved
+func (s *Service) Locales(name string) ([]*Template, error) {
+	def, err := definition(name)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := s.store.Current(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		if t.Locale == DefaultLocale {
+			return templates, nil
+		}
+	}
+	return append([]*Template{builtin(def)}, templates...), nil
+}
+
+// Get returns a version of a template in locale, the current one when version is 0. The
+// built-in default is returned for DefaultLocale while nothing has been saved.
+func (s *Service) Get(name, locale string, version int) (*Template, error) {
+	def, err := definition(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLocale(locale); err != nil {
+		return nil, err
+	}
+	var t *Template
+	if version == 0 {
+		t, err = s.store.Latest(name, locale)
+	} else {
+		t, err = s.store.Get(name, locale, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		if locale == DefaultLocale && version == 0 {
+			return builtin(def), nil
+		}
+		return nil, apperrors.NotFound("TEMPLATE_NOT_FOUND", fmt.Sprintf("The %q template has no such %s version", name, locale))
+	}
+	return t, nil
+}
+
+// Versions lists every saved version of a template in locale, newest first
+func (s *Service) Versions(name, locale string) ([]*Template, error) {
+	if _, err := definition(name); err != nil {
+		return nil, err
+	}
+	if err := checkLocale(locale); err != nil {
+		return nil, err
+	}
+	return s.store.Versions(name, locale)
+}
+
+// Save stores req as the next version of a template in locale, after checking that it parses
+func (s *Service) Save(ctx context.Context, name, locale string, req SaveRequest, createdBy string) (*Template, error) {
+	if _, err := definition(name); err != nil {
+		return nil, err
+	}
+	if err := checkLocale(locale); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(req.Subject) == "" || strings.TrimSpace(req.Text) == "" {
+		return nil, apperrors.Invalid("INVALID_TEMPLATE", "subject and text are required")
+	}
+	t := &Template{Name: name, Locale: locale, Subject: req.Subject, Text: req.Text, HTML: req.HTML, CreatedBy: createdBy, CreatedAt: time.Now().UTC()}
+	if _, err := parse(t); err != nil {
+		return nil, err
+	}
+
+	latest, err := s.store.Latest(name, locale)
+	if err != nil {
+		return nil, err
+	}
+	t.Version = 1
+	if latest != nil {
+		t.Version = latest.Version + 1
+	}
+	if err := s.store.Create(t); err != nil {
+		s.logger.WithContext(ctx).WithError(err).WithField("template", name).Error("Failed to save email template")
+		return nil, err
+	}
+
+	s.logger.WithContext(ctx).WithFields(logrus.Fields{"template": name, "locale": locale, "version": t.Version}).Info("Email template saved")
+	return t, nil
+}
+
+// Render renders the current template for locale with data. A locale without a variant falls
+// back to its language and then to DefaultLocale, e.g. pt-BR to pt to en.
+func (s *Service) Render(name, locale string, data interface{}) (*Message, error) {
+	def, err := definition(name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.resolve(def, locale)
+	if err != nil {
+		return nil, err
+	}
+	return render(t, data)
+}
+
+// resolve returns the template to send in locale
+func (s *Service) resolve(def Definition, locale string) (*Template, error) {
+	candidates := []string{locale}
+	if language, _, ok := strings.Cut(locale, "-"); ok {
+		candidates = append(candidates, language)
+	}
+	candidates = append(candidates, DefaultLocale)
+	for _, candidate := range candidates {
+		if checkLocale(candidate) != nil {
+			continue
+		}
+		t, err := s.store.Latest(def.Name, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			return t, nil
+		}
+	}
+	return builtin(def), nil
+}
+
+// PreviewRequest renders a draft, or the current template when the draft is empty, with
+// data, or with the template's sample data when data is empty
+type PreviewRequest struct {
+	Locale  string                 `json:"locale,omitempty"`
+	Subject string                 `json:"subject,omitempty"`
+	Text    string                 `json:"text,omitempty"`
+	HTML    string                 `json:"html,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Preview renders a draft or the current template of name without sending anything
+func (s *Service) Preview(name string, req PreviewRequest) (*Message, error) {
+	def, err := definition(name)
+	if err != nil {
+		return nil, err
+	}
+	data := req.Data
+	if len(data) == 0 {
+		data = def.Sample
+	}
+	if req.Subject == "" && req.Text == "" && req.HTML == "" {
+		locale := req.Locale
+		if locale == "" {
+			locale = DefaultLocale
+		}
+		if err := checkLocale(locale); err != nil {
+			return nil, err
+		}
+		t, err := s.resolve(def, locale)
+		if err != nil {
+			return nil, err
+		}
+		return render(t, data)
+	}
+	return render(&Template{Name: name, Subject: req.Subject, Text: req.Text, HTML: req.HTML}, data)
+}
+
+// parsed holds the compiled parts of a template
+type parsed struct {
+	subject, text *texttemplate.Template
+	html          *htmltemplate.Template
+}
+
+// parse compiles t, rejecting oversized parts and syntax errors
+func parse(t *Template) (*parsed, error) {
+	for part, source := range map[string]string{"subject": t.Subject, "text": t.Text, "html": t.HTML} {
+		if len(source) > MaxBodySize {
+			return nil, apperrors.TooLarge("TEMPLATE_TOO_LARGE", fmt.Sprintf("%s is larger than %d bytes", part, MaxBodySize))
+		}
+	}
+	var p parsed
+	var err error
+	if p.subject, err = texttemplate.New("subject").Option("missingkey=error").Parse(t.Subject); err != nil {
+		return nil, invalidTemplate("subject", err)
+	}
+	if p.text, err = texttemplate.New("text").Option("missingkey=error").Parse(t.Text); err != nil {
+		return nil, invalidTemplate("text", err)
+	}
+	if t.HTML != "" {
+		if p.html, err = htmltemplate.New("html").Option("missingkey=error").Parse(t.HTML); err != nil {
+			return nil, invalidTemplate("html", err)
+		}
+	}
+	return &p, nil
+}
+
+// invalidTemplate reports a template part that does not parse or render
+func invalidTemplate(part string, err error) error {
+	return apperrors.Invalid("INVALID_TEMPLATE", fmt.Sprintf("%s: %v", part, err))
+}
+
+// render executes t with data
+func render(t *Template, data interface{}) (*Message, error) {
+	p, err := parse(t)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	var b bytes.Buffer
+	if err := p.subject.Execute(&b, data); err != nil {
+		return nil, invalidTemplate("subject", err)
+	}
+	// Subjects are a single header line
+	msg.Subject = strings.Join(strings.Fields(b.String()), " ")
+	b.Reset()
+	if err := p.text.Execute(&b, data); err != nil {
+		return nil, invalidTemplate("text", err)
+	}
+	msg.Text = b.String()
+	if p.html != nil {
+		b.Reset()
+		if err := p.html.Execute(&b, data); err != nil {
+			return nil, invalidTemplate("html", err)
+		}
+		msg.HTML = b.String()
+	}
+	return &msg, nil
+}
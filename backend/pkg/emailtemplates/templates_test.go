@@ -0,0 +1,198 @@
+package emailtemplates
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps template versions in memory
+type memoryStore struct {
+	templates []*Template
+}
+
+func (s *memoryStore) Create(t *Template) error {
+	if existing, _ := s.Get(t.Name, t.Locale, t.Version); existing != nil {
+		return apperrors.Conflict("TEMPLATE_VERSION_CONFLICT", "conflict")
+	}
+	s.templates = append(s.templates, t)
+	return nil
+}
+
+func (s *memoryStore) Get(name, locale string, version int) (*Template, error) {
+	for _, t := range s.templates {
+		if t.Name == name && t.Locale == locale && t.Version == version {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) Latest(name, locale string) (*Template, error) {
+	versions, _ := s.Versions(name, locale)
+	if len(versions) == 0 {
+		return nil, nil
+	}
+	return versions[0], nil
+}
+
+func (s *memoryStore) Versions(name, locale string) ([]*Template, error) {
+	var versions []*Template
+	for _, t := range s.templates {
+		if t.Name == name && t.Locale == locale {
+			versions = append(versions, t)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+func (s *memoryStore) Current(name string) ([]*Template, error) {
+	latest := make(map[string]*Template)
+	for _, t := range s.templates {
+		if t.Name == name && (latest[t.Locale] == nil || latest[t.Locale].Version < t.Version) {
+			latest[t.Locale] = t
+		}
+	}
+	var current []*Template
+	for _, t := range latest {
+		current = append(current, t)
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].Locale < current[j].Locale })
+	return current, nil
+}
+
+func newTestService() *Service {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewService(&memoryStore{}, logger)
+}
+
+func TestBuiltinDefaultsRender(t *testing.T) {
+	service := newTestService()
+	for _, def := range Definitions() {
+		msg, err := service.Preview(def.Name, PreviewRequest{})
+		require.NoError(t, err, def.Name)
+		assert.NotEmpty(t, msg.Subject, def.Name)
+		assert.NotEmpty(t, msg.Text, def.Name)
+	}
+
+	msg, err := service.Render(Digest, "de-AT", map[string]interface{}{"Frequency": "weekly", "Summary": "Nothing"})
+	require.NoError(t, err)
+	assert.Equal(t, &Message{Subject: "Access control changes (weekly digest)", Text: "Nothing"}, msg)
+
+	_, err = service.Render("newsletter", DefaultLocale, nil)
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "TEMPLATE_NOT_FOUND", appErr.Code)
+}
+
+func TestSaveVersionsAndLocaleFallback(t *testing.T) {
+	service := newTestService()
+	ctx := context.Background()
+
+	first, err := service.Save(ctx, Invite, "de", SaveRequest{Subject: "Einladung von {{.InviterName}}", Text: "Code: {{.InviteCode}}"}, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, 1, first.Version)
+	second, err := service.Save(ctx, Invite, "de", SaveRequest{Subject: "{{.InviterName}} lädt dich ein", Text: "Code: {{.InviteCode}}", HTML: "<p>{{.InviteCode}}</p>"}, "admin")
+	require.NoError(t, err)
+	assert.Equal(t, 2, second.Version)
+
+	data := map[string]string{"InviterName": "Ada", "InviteCode": "<b>X</b>", "RegisterURL": "https://example.com"}
+	msg, err := service.Render(Invite, "de-CH", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada lädt dich ein", msg.Subject)
+	assert.Equal(t, "<p>&lt;b&gt;X&lt;/b&gt;</p>", msg.HTML, "HTML bodies escape their data")
+
+	msg, err = service.Render(Invite, "fr", data)
+	require.NoError(t, err)
+	assert.Equal(t, "Ada invited you", msg.Subject, "unknown locales get the built-in default")
+
+	old, err := service.Get(Invite, "de", 1)
+	require.NoError(t, err)
+	assert.Equal(t, first, old)
+	versions, err := service.Versions(Invite, "de")
+	require.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	locales, err := service.Locales(Invite)
+	require.NoError(t, err)
+	require.Len(t, locales, 2)
+	assert.True(t, locales[0].Builtin)
+	assert.Equal(t, 2, locales[1].Version)
+
+	for _, req := range []SaveRequest{
+		{Subject: "Hi {{.Name", Text: "x"},
+		{Subject: "Hi", Text: ""},
+		{Subject: "Hi", Text: "x", HTML: "{{end}}"},
+	} {
+		_, err := service.Save(ctx, Invite, "de", req, "admin")
+		appErr, ok := apperrors.As(err)
+		require.True(t, ok)
+		assert.Equal(t, "INVALID_TEMPLATE", appErr.Code)
+	}
+	_, err = service.Save(ctx, Invite, "german", SaveRequest{Subject: "Hi", Text: "x"}, "admin")
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "INVALID_LOCALE", appErr.Code)
+}
+
+func TestPreviewReportsMissingData(t *testing.T) {
+	service := newTestService()
+	_, err := service.Preview(PasswordReset, PreviewRequest{Subject: "Hi {{.Nickname}}", Text: "x"})
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "INVALID_TEMPLATE", appErr.Code)
+
+	msg, err := service.Preview(PasswordReset, PreviewRequest{Subject: "Hi {{.Name}}", Text: "x", Data: map[string]interface{}{"Name": "Bob"}})
+	require.NoError(t, err)
+	assert.Equal(t, "Hi Bob", msg.Subject)
+}
+
+func TestTemplateEndpoints(t *testing.T) {
+	service := newTestService()
+	r := mux.NewRouter()
+	protected := 0
+	Mount(r, service, func(*http.Request) fieldfilter.Viewer { return fieldfilter.Viewer{UserID: "admin"} },
+		func(handler http.HandlerFunc) http.HandlerFunc {
+			protected++
+			return handler
+		})
+	assert.Equal(t, 6, protected)
+
+	body, _ := json.Marshal(SaveRequest{Subject: "Bestätigen", Text: "{{.VerifyURL}}"})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, Path+"/verify_email/de", bytes.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var saved Template
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&saved))
+	assert.Equal(t, "admin", saved.CreatedBy)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, Path+"/verify_email/preview", strings.NewReader(`{"locale":"de"}`)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"text":"https://example.com/verify?token=abc"`)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path+"/verify_email/de?version=0", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path+"/verify_email/de/versions", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"total":1`)
+}
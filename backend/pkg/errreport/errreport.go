@@ -0,0 +1,110 @@
+// Package errreport forwards unexpected errors and panics to an external error tracker.
+// Reporters are pluggable; every event is scrubbed of personal data before it leaves the process.
+package errreport
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"base-app/pkg/logging"
+	"base-app/pkg/redact"
+)
+
+// Event is a single unexpected error with the request context it happened in
+type Event struct {
+	Err       error
+	Message   string
+	RequestID string
+	UserID    string
+	// Panic marks events raised by recovered panics; Stack then holds the goroutine stack
+	Panic bool
+	Stack string
+	// Tags are indexed, low-cardinality values (module, method, route)
+	Tags map[string]string
+	// Extra holds free-form diagnostic data
+	Extra map[string]interface{}
+}
+
+// Reporter delivers events to an error tracker
+type Reporter interface {
+	Report(ctx context.Context, event Event)
+	// Flush waits up to timeout for buffered events to be sent, reporting whether all were
+	Flush(timeout time.Duration) bool
+}
+
+// Nop discards every event; it is used when no tracker is configured
+type Nop struct{}
+
+func (Nop) Report(context.Context, Event) {}
+
+func (Nop) Flush(time.Duration) bool { return true }
+
+// NewEvent builds an event for err, filling in the request and user ID from ctx
+func NewEvent(ctx context.Context, err error, message string) Event {
+	event := Event{Err: err, Message: message}
+	if ctx != nil {
+		event.RequestID = logging.RequestID(ctx)
+		event.UserID = logging.UserID(ctx)
+	}
+	return event
+}
+
+const redacted = redact.Mask
+
+// sensitiveKey matches tag/extra keys whose values must never be reported
+var sensitiveKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|authorization|cookie|api[_-]?key|email|first_?name|last_?name|phone|address)`)
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// ScrubString masks credentials (see redact.String) and email addresses embedded in free text
+func ScrubString(s string) string {
+	return emailPattern.ReplaceAllString(redact.String(s), "[email]")
+}
+
+// Scrub returns a copy of event with personal data removed: values under sensitive keys are
+// replaced and free text is passed through ScrubString. The user ID is kept since it is an
+// opaque identifier, not contact data.
+func Scrub(event Event) Event {
+	event.Message = ScrubString(event.Message)
+	event.Stack = ScrubString(event.Stack)
+
+	if event.Tags != nil {
+		tags := make(map[string]string, len(event.Tags))
+		for k, v := range event.Tags {
+			if sensitiveKey.MatchString(k) {
+				tags[k] = redacted
+				continue
+			}
+			tags[k] = ScrubString(v)
+		}
+		event.Tags = tags
+	}
+
+	if event.Extra != nil {
+		extra := make(map[string]interface{}, len(event.Extra))
+		for k, v := range event.Extra {
+			switch {
+			case sensitiveKey.MatchString(k):
+				extra[k] = redacted
+			default:
+				if s, ok := v.(string); ok {
+					extra[k] = ScrubString(s)
+				} else {
+					extra[k] = v
+				}
+			}
+		}
+		event.Extra = extra
+	}
+	return event
+}
+
+// ErrorText returns the scrubbed error text of event, or its message when there is no error
+func ErrorText(event Event) string {
+	if event.Err == nil {
+		return ScrubString(event.Message)
+	}
+	return ScrubString(strings.TrimSpace(event.Err.Error()))
+}
@@ -0,0 +1,144 @@
+package errreport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"base-app/pkg/logging"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeReporter struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (f *fakeReporter) Report(_ context.Context, event Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, Scrub(event))
+}
+
+func (f *fakeReporter) Flush(time.Duration) bool { return true }
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestScrub(t *testing.T) {
+	event := Scrub(Event{
+		Message: "lookup failed for jane.doe@example.com with Bearer abc.def-ghi",
+		UserID:  "user-1",
+		Tags:    map[string]string{"module": "rbac", "email": "jane.doe@example.com"},
+		Extra: map[string]interface{}{
+			"password": "hunter2",
+			"token":    "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig",
+			"query":    "notify eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig",
+			"attempts": 3,
+		},
+	})
+
+	assert.Equal(t, "lookup failed for [email] with Bearer [REDACTED]", event.Message)
+	assert.Equal(t, "user-1", event.UserID)
+	assert.Equal(t, "rbac", event.Tags["module"])
+	assert.Equal(t, "[REDACTED]", event.Tags["email"])
+	assert.Equal(t, "[REDACTED]", event.Extra["password"])
+	assert.Equal(t, "[REDACTED]", event.Extra["token"])
+	assert.Equal(t, "notify [REDACTED]", event.Extra["query"])
+	assert.Equal(t, 3, event.Extra["attempts"])
+}
+
+func TestHookReportsErrorEntriesWithContext(t *testing.T) {
+	reporter := &fakeReporter{}
+	logger := quietLogger()
+	logger.AddHook(NewHook(reporter))
+
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	logging.SetUserID(ctx, "user-1")
+
+	logger.WithContext(ctx).Warn("not reported")
+	logger.WithContext(ctx).WithError(errors.New("insert failed for bob@example.com")).
+		WithFields(logrus.Fields{"module": "rbac", "role_id": "r1"}).Error("Failed to create role")
+	logger.WithField(ReportedField, true).Error("already reported")
+
+	require.Len(t, reporter.events, 1)
+	event := reporter.events[0]
+	assert.Equal(t, "req-1", event.RequestID)
+	assert.Equal(t, "user-1", event.UserID)
+	assert.Equal(t, "Failed to create role", event.Message)
+	assert.Equal(t, "insert failed for [email]", ErrorText(event))
+	assert.Equal(t, "rbac", event.Tags["module"])
+	assert.Equal(t, "r1", event.Extra["role_id"])
+}
+
+func TestRecoverReportsPanic(t *testing.T) {
+	reporter := &fakeReporter{}
+	logger := quietLogger()
+	logger.AddHook(NewHook(reporter))
+
+	r := mux.NewRouter()
+	r.Use(logging.RequestMiddleware(quietLogger()))
+	r.Use(Recover(reporter, logger))
+	r.HandleFunc("/api/roles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/roles/42", nil)
+	req.Header.Set(logging.RequestIDHeader, "req-9")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "INTERNAL_ERROR", body["code"])
+
+	// Reported once by the middleware; the hook skips the accompanying log entry
+	require.Len(t, reporter.events, 1)
+	event := reporter.events[0]
+	assert.True(t, event.Panic)
+	assert.Equal(t, "req-9", event.RequestID)
+	assert.Equal(t, "/api/roles/{id}", event.Tags["route"])
+	assert.EqualError(t, event.Err, "panic: boom")
+	assert.Contains(t, event.Stack, "goroutine")
+}
+
+func TestScrubSentryEvent(t *testing.T) {
+	event := &sentry.Event{
+		Message:   "mail to a@b.io",
+		Exception: []sentry.Exception{{Value: "duplicate key for a@b.io"}},
+		Request: &sentry.Request{
+			URL:     "/api/users",
+			Cookies: "session=1",
+			Headers: map[string]string{"Authorization": "Bearer x"},
+		},
+		User: sentry.User{ID: "u1", Email: "a@b.io", IPAddress: "10.0.0.1"},
+	}
+
+	event = scrubSentryEvent(event)
+
+	assert.Equal(t, "mail to [email]", event.Message)
+	assert.Equal(t, "duplicate key for [email]", event.Exception[0].Value)
+	assert.Empty(t, event.Request.Cookies)
+	assert.Nil(t, event.Request.Headers)
+	assert.Equal(t, sentry.User{ID: "u1"}, event.User)
+}
+
+func TestNewSentryRequiresDSN(t *testing.T) {
+	_, err := NewSentry(SentryOptions{})
+	assert.Error(t, err)
+}
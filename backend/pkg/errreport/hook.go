@@ -0,0 +1,69 @@
+package errreport
+
+import (
+	"context"
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ReportedField marks log entries whose error was already reported, so the hook skips them
+const ReportedField = "error_reported"
+
+// Hook reports every Error-level (and above) log entry. Services already log unexpected
+// failures at Error level, so installing the hook on the root logger reports them without
+// threading a reporter through every constructor.
+type Hook struct {
+	reporter Reporter
+}
+
+// NewHook returns a logrus hook forwarding error entries to reporter
+func NewHook(reporter Reporter) *Hook {
+	return &Hook{reporter: reporter}
+}
+
+func (h *Hook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	if reported, _ := entry.Data[ReportedField].(bool); reported {
+		return nil
+	}
+
+	ctx := entry.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	err, _ := entry.Data[logrus.ErrorKey].(error)
+	if err == nil {
+		err = errors.New(entry.Message)
+	}
+
+	event := NewEvent(ctx, err, entry.Message)
+	event.Tags = map[string]string{}
+	event.Extra = map[string]interface{}{}
+	for k, v := range entry.Data {
+		switch k {
+		case logrus.ErrorKey:
+		case "module":
+			if s, ok := v.(string); ok {
+				event.Tags["module"] = s
+			}
+		case "request_id":
+			if event.RequestID == "" {
+				event.RequestID, _ = v.(string)
+			}
+		case "user_id":
+			if event.UserID == "" {
+				event.UserID, _ = v.(string)
+			}
+		default:
+			event.Extra[k] = v
+		}
+	}
+
+	h.reporter.Report(ctx, event)
+	return nil
+}
@@ -0,0 +1,70 @@
+package errreport
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Recover turns panics in downstream handlers into a 500 response, reports them with the
+// request context and logs them. http.ErrAbortHandler is re-panicked as net/http expects.
+func Recover(reporter Reporter, logger *logrus.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				ctx := r.Context()
+				err, ok := recovered.(error)
+				if !ok {
+					err = fmt.Errorf("panic: %v", recovered)
+				}
+				stack := string(debug.Stack())
+
+				event := NewEvent(ctx, err, "Panic recovered")
+				event.Panic = true
+				event.Stack = stack
+				event.Tags = map[string]string{"method": r.Method}
+				if route := routeTemplate(r); route != "" {
+					event.Tags["route"] = route
+				}
+				reporter.Report(ctx, event)
+
+				logger.WithContext(ctx).WithError(err).WithFields(logrus.Fields{
+					"method":      r.Method,
+					"path":        r.URL.Path,
+					"stack":       stack,
+					ReportedField: true,
+				}).Error("Panic recovered")
+
+				httpapi.WriteErrorResponse(w, http.StatusInternalServerError, "Internal server error", "INTERNAL_ERROR", nil)
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// routeTemplate returns the matched mux route template (e.g. /api/users/{id}), which unlike the
+// raw path carries no identifiers
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return template
+}
@@ -0,0 +1,102 @@
+package errreport
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"base-app/pkg/outbound"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// SentryOptions configures the Sentry reporter
+type SentryOptions struct {
+	DSN         string
+	Environment string
+	Release     string
+}
+
+// Sentry reports events to Sentry through a dedicated hub, so it never touches sentry's global state
+type Sentry struct {
+	hub *sentry.Hub
+}
+
+// NewSentry creates a Sentry reporter. Request bodies, cookies, IPs and user details other than the
+// ID are never sent, and every outgoing event passes through scrubSentryEvent.
+func NewSentry(opts SentryOptions) (*Sentry, error) {
+	if opts.DSN == "" {
+		return nil, errors.New("errreport: sentry DSN is required")
+	}
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:            opts.DSN,
+		Environment:    opts.Environment,
+		Release:        opts.Release,
+		SendDefaultPII: false,
+		HTTPTransport:  outbound.Transport(outbound.Sentry),
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			return scrubSentryEvent(event)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Sentry{hub: sentry.NewHub(client, sentry.NewScope())}, nil
+}
+
+// Report sends the scrubbed event with its request and user context attached
+func (s *Sentry) Report(_ context.Context, event Event) {
+	event = Scrub(event)
+	s.hub.WithScope(func(scope *sentry.Scope) {
+		if event.UserID != "" {
+			scope.SetUser(sentry.User{ID: event.UserID})
+		}
+		if event.RequestID != "" {
+			scope.SetTag("request_id", event.RequestID)
+		}
+		scope.SetTags(event.Tags)
+		scope.SetExtras(event.Extra)
+		if event.Message != "" {
+			scope.SetExtra("message", event.Message)
+		}
+
+		if event.Panic {
+			scope.SetLevel(sentry.LevelFatal)
+			scope.SetExtra("stack", event.Stack)
+		}
+
+		if event.Err != nil {
+			s.hub.CaptureException(event.Err)
+			return
+		}
+		s.hub.CaptureMessage(event.Message)
+	})
+}
+
+// Flush waits for queued events to be delivered
+func (s *Sentry) Flush(timeout time.Duration) bool {
+	return s.hub.Flush(timeout)
+}
+
+// scrubSentryEvent is the last line of defence against PII: it rewrites the exception chain
+// (which includes the raw text of wrapped errors), drops request data the SDK may have
+// collected and keeps only the user ID.
+func scrubSentryEvent(event *sentry.Event) *sentry.Event {
+	event.Message = ScrubString(event.Message)
+	for i := range event.Exception {
+		event.Exception[i].Value = ScrubString(event.Exception[i].Value)
+	}
+	for i := range event.Breadcrumbs {
+		event.Breadcrumbs[i].Message = ScrubString(event.Breadcrumbs[i].Message)
+		event.Breadcrumbs[i].Data = nil
+	}
+	if event.Request != nil {
+		event.Request.Cookies = ""
+		event.Request.Data = ""
+		event.Request.QueryString = ""
+		event.Request.Headers = nil
+		event.Request.Env = nil
+	}
+	event.User = sentry.User{ID: event.User.ID}
+	return event
+}
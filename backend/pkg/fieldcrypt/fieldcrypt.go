@@ -0,0 +1,159 @@
+// Package fieldcrypt encrypts individual column values with AES-256-GCM so sensitive data is
+// unreadable at rest. Values carry the ID of the key that sealed them, which lets keys rotate:
+// new values use the primary key while older keys keep decrypting existing rows until they are
+// re-encrypted.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// prefix marks encrypted values; the full format is "enc:v1:<key id>:<base64 nonce+ciphertext>"
+const prefix = "enc:v1:"
+
+// validKeyID restricts key IDs to characters that need no escaping in values or SQL LIKE patterns
+var validKeyID = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// KeySize is the required key length in bytes (AES-256)
+const KeySize = 32
+
+// ErrUnknownKey is returned when a value was sealed with a key that is not in the keyring
+var ErrUnknownKey = errors.New("fieldcrypt: unknown key")
+
+// keyset is an immutable snapshot of the keys in a Keyring
+type keyset struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// Keyring holds the encryption keys by ID. Keys can be replaced at runtime with SetKeys.
+type Keyring struct {
+	current atomic.Pointer[keyset]
+}
+
+// NewKeyring creates a keyring sealing new values with keys[primary]
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	k := &Keyring{}
+	if err := k.SetKeys(primary, keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// SetKeys replaces the keys, e.g. after a rotation in the secret manager. On error the
+// current keys stay in place.
+func (k *Keyring) SetKeys(primary string, keys map[string][]byte) error {
+	if _, ok := keys[primary]; !ok {
+		return fmt.Errorf("fieldcrypt: primary key %q not among the configured keys", primary)
+	}
+	set := &keyset{primary: primary, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if !validKeyID.MatchString(id) {
+			return fmt.Errorf("fieldcrypt: invalid key id %q: use letters, digits and dashes", id)
+		}
+		if len(key) != KeySize {
+			return fmt.Errorf("fieldcrypt: key %q must be %d bytes, got %d", id, KeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("fieldcrypt: key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("fieldcrypt: key %q: %w", id, err)
+		}
+		set.aeads[id] = aead
+	}
+	k.current.Store(set)
+	return nil
+}
+
+// PrimaryKeyID returns the ID of the key new values are sealed with
+func (k *Keyring) PrimaryKeyID() string {
+	return k.current.Load().primary
+}
+
+// Encrypt seals plaintext with the primary key. aad binds the value to its context (e.g. the
+// table, column and row ID) so a ciphertext copied to another row fails to decrypt.
+func (k *Keyring) Encrypt(plaintext, aad []byte) (string, error) {
+	set := k.current.Load()
+	aead := set.aeads[set.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("fieldcrypt: generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, aad)
+	return KeyPrefix(set.primary) + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with the same aad
+func (k *Keyring) Decrypt(value string, aad []byte) ([]byte, error) {
+	id, payload, ok := parse(value)
+	if !ok {
+		return nil, errors.New("fieldcrypt: value is not encrypted")
+	}
+	aead, ok := k.current.Load().aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("fieldcrypt: malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("fieldcrypt: decrypt with key %q: %w", id, err)
+	}
+	return plaintext, nil
+}
+
+// NeedsRotation reports whether value is plaintext or sealed with a key other than the primary
+func (k *Keyring) NeedsRotation(value string) bool {
+	id, _, ok := parse(value)
+	return !ok || id != k.PrimaryKeyID()
+}
+
+// IsEncrypted reports whether value was produced by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// KeyPrefix returns the prefix shared by all values sealed with key id
+func KeyPrefix(id string) string {
+	return prefix + id + ":"
+}
+
+// KeyID returns the ID of the key value was sealed with, or "" for plaintext
+func KeyID(value string) string {
+	id, _, _ := parse(value)
+	return id
+}
+
+func parse(value string) (id, payload string, ok bool) {
+	if !IsEncrypted(value) {
+		return "", "", false
+	}
+	return strings.Cut(strings.TrimPrefix(value, prefix), ":")
+}
+
+// DecodeKeys decodes base64 keys by ID, as they appear in configuration and secrets
+func DecodeKeys(encoded map[string]string) (map[string][]byte, error) {
+	keys := make(map[string][]byte, len(encoded))
+	for id, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("fieldcrypt: key %q is not valid base64", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
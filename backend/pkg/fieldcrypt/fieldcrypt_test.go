@@ -0,0 +1,78 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+
+	sealed, err := keyring.Encrypt([]byte("+14155552671"), []byte("users.phone:1"))
+	require.NoError(t, err)
+	assert.True(t, IsEncrypted(sealed))
+	assert.Equal(t, "k1", KeyID(sealed))
+	assert.NotContains(t, sealed, "4155552671")
+
+	again, err := keyring.Encrypt([]byte("+14155552671"), []byte("users.phone:1"))
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again, "nonces must differ")
+
+	plaintext, err := keyring.Decrypt(sealed, []byte("users.phone:1"))
+	require.NoError(t, err)
+	assert.Equal(t, "+14155552671", string(plaintext))
+
+	_, err = keyring.Decrypt(sealed, []byte("users.phone:2"))
+	assert.Error(t, err, "ciphertext must be bound to its aad")
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyring, err := NewKeyring("old", map[string][]byte{"old": testKey(1)})
+	require.NoError(t, err)
+	sealed, err := keyring.Encrypt([]byte("secret"), nil)
+	require.NoError(t, err)
+	assert.False(t, keyring.NeedsRotation(sealed))
+	assert.True(t, keyring.NeedsRotation("plaintext"))
+
+	require.NoError(t, keyring.SetKeys("new", map[string][]byte{"old": testKey(1), "new": testKey(2)}))
+	assert.True(t, keyring.NeedsRotation(sealed))
+	plaintext, err := keyring.Decrypt(sealed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(plaintext))
+
+	resealed, err := keyring.Encrypt(plaintext, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "new", KeyID(resealed))
+
+	require.NoError(t, keyring.SetKeys("new", map[string][]byte{"new": testKey(2)}))
+	_, err = keyring.Decrypt(sealed, nil)
+	assert.True(t, errors.Is(err, ErrUnknownKey))
+}
+
+func TestSetKeysRejectsInvalidKeys(t *testing.T) {
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+
+	assert.Error(t, keyring.SetKeys("missing", map[string][]byte{"k1": testKey(1)}))
+	assert.Error(t, keyring.SetKeys("short", map[string][]byte{"short": []byte("too short")}))
+	assert.Error(t, keyring.SetKeys("a_b", map[string][]byte{"a_b": testKey(1)}))
+	assert.Equal(t, "k1", keyring.PrimaryKeyID(), "failed updates keep the current keys")
+}
+
+func TestDecodeKeys(t *testing.T) {
+	keys, err := DecodeKeys(map[string]string{"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="})
+	require.NoError(t, err)
+	assert.Equal(t, testKey(1), keys["k1"])
+
+	_, err = DecodeKeys(map[string]string{"k1": "not base64!"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+// Package fieldfilter removes fields from API responses that the caller may not see. Struct
+// fields name the permission required to see them in a perm tag:
+//
+//	Email string `json:"email" perm:"read_user,self"`
+//
+// Alternatives are separated by "|" ("read_user|manage_users"), and the "self" option also
+// shows the field when the object belongs to the caller (see Owned). Fields without a perm
+// tag are always visible.
+package fieldfilter
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Viewer is the caller a response is filtered for. The zero value is an anonymous caller.
+type Viewer struct {
+	UserID      string
+	Permissions []string
+}
+
+// Can reports whether the viewer holds permission
+func (v Viewer) Can(permission string) bool {
+	for _, p := range v.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Owned is implemented by objects that belong to a user, for fields tagged with "self"
+type Owned interface {
+	OwnerID() string
+}
+
+// Filter returns v with the fields viewer may not see removed, ready to be JSON encoded.
+// Values whose types carry no perm tags are returned unchanged; tagged structs become
+// objects that encode like the struct would, minus the hidden fields.
+func Filter(v interface{}, viewer Viewer) interface{} {
+	return filterValue(reflect.ValueOf(v), viewer)
+}
+
+// fieldRule is the visibility rule parsed from a perm tag
+type fieldRule struct {
+	anyOf []string
+	self  bool
+}
+
+func (rule *fieldRule) allows(viewer Viewer, ownerID string) bool {
+	if rule == nil {
+		return true
+	}
+	if rule.self && viewer.UserID != "" && viewer.UserID == ownerID {
+		return true
+	}
+	for _, permission := range rule.anyOf {
+		if viewer.Can(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// field describes one JSON-visible struct field
+type field struct {
+	index     []int
+	name      string
+	omitEmpty bool
+	rule      *fieldRule
+}
+
+var (
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+	// filtered caches whether a type contains perm tags anywhere within it
+	filtered sync.Map // reflect.Type -> bool
+	// fields caches the JSON fields of struct types
+	fields sync.Map // reflect.Type -> []field
+)
+
+// needsFilter reports whether values of t can contain perm-tagged fields
+func needsFilter(t reflect.Type) bool {
+	return needsFilterSeen(t, map[reflect.Type]bool{})
+}
+
+func needsFilterSeen(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if cached, ok := filtered.Load(t); ok {
+		return cached.(bool)
+	}
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+
+	result := false
+	if !t.Implements(marshalerType) && !reflect.PointerTo(t).Implements(marshalerType) {
+		switch t.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+			result = needsFilterSeen(t.Elem(), seen)
+		case reflect.Interface:
+			// The dynamic type is only known per value
+			result = true
+		case reflect.Struct:
+			for _, f := range structFields(t) {
+				if f.rule != nil || needsFilterSeen(t.FieldByIndex(f.index).Type, seen) {
+					result = true
+					break
+				}
+			}
+		}
+	}
+	filtered.Store(t, result)
+	return result
+}
+
+// structFields lists the JSON fields of t in encoding order, flattening embedded structs
+func structFields(t reflect.Type) []field {
+	if cached, ok := fields.Load(t); ok {
+		return cached.([]field)
+	}
+	var result []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for _, f := range structFields(embedded) {
+					f.index = append([]int{i}, f.index...)
+					result = append(result, f)
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		f := field{index: []int{i}, name: name, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")}
+		if perm := sf.Tag.Get("perm"); perm != "" {
+			f.rule = parseRule(perm)
+		}
+		result = append(result, f)
+	}
+	fields.Store(t, result)
+	return result
+}
+
+func parseRule(tag string) *fieldRule {
+	permissions, opts, _ := strings.Cut(tag, ",")
+	rule := &fieldRule{self: opts == "self"}
+	for _, permission := range strings.Split(permissions, "|") {
+		if permission = strings.TrimSpace(permission); permission != "" {
+			rule.anyOf = append(rule.anyOf, permission)
+		}
+	}
+	return rule
+}
+
+func filterValue(v reflect.Value, viewer Viewer) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if !needsFilter(v.Type()) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return filterValue(v.Elem(), viewer)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			items[i] = filterValue(v.Index(i), viewer)
+		}
+		return items
+	case reflect.Map:
+		if v.IsNil() || v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		entries := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			entries[iter.Key().String()] = filterValue(iter.Value(), viewer)
+		}
+		return entries
+	case reflect.Struct:
+		return filterStruct(v, viewer)
+	default:
+		return v.Interface()
+	}
+}
+
+func filterStruct(v reflect.Value, viewer Viewer) object {
+	var ownerID string
+	if v.CanInterface() {
+		if owned, ok := v.Interface().(Owned); ok {
+			ownerID = owned.OwnerID()
+		}
+	}
+
+	var obj object
+	for _, f := range structFields(v.Type()) {
+		if !f.rule.allows(viewer, ownerID) {
+			continue
+		}
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || (f.omitEmpty && fv.IsZero()) {
+			continue
+		}
+		obj = append(obj, member{name: f.name, value: filterValue(fv, viewer)})
+	}
+	return obj
+}
+
+// fieldByIndex is like Value.FieldByIndex but reports false instead of panicking on a nil
+// embedded pointer, whose fields encoding/json omits
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// object is a filtered struct; it encodes its members in field order
+type object []member
+
+type member struct {
+	name  string
+	value interface{}
+}
+
+// MarshalJSON encodes the members as a JSON object in struct field order
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(m.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,67 @@
+package fieldfilter
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type account struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Email     string            `json:"email" perm:"read_user,self"`
+	Secret    string            `json:"secret,omitempty" perm:"manage_system|read_secrets"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	internal  string
+}
+
+func (a account) OwnerID() string { return a.ID }
+
+type team struct {
+	Name    string     `json:"name"`
+	Members []*account `json:"members"`
+}
+
+func encode(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestFilterHidesFieldsWithoutPermission(t *testing.T) {
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	a := &account{ID: "u1", Name: "Ada", Email: "ada@example.com", Secret: "s", CreatedAt: created, internal: "x"}
+
+	assert.Equal(t, `{"id":"u1","name":"Ada","created_at":"2024-01-02T03:04:05Z"}`, encode(t, Filter(a, Viewer{})))
+	assert.Equal(t, `{"id":"u1","name":"Ada","email":"ada@example.com","created_at":"2024-01-02T03:04:05Z"}`,
+		encode(t, Filter(a, Viewer{UserID: "u2", Permissions: []string{"read_user"}})))
+	assert.Equal(t, `{"id":"u1","name":"Ada","email":"ada@example.com","created_at":"2024-01-02T03:04:05Z"}`,
+		encode(t, Filter(a, Viewer{UserID: "u1"})), "self shows the owner their own email")
+	assert.Equal(t, `{"id":"u1","name":"Ada","secret":"s","created_at":"2024-01-02T03:04:05Z"}`,
+		encode(t, Filter(a, Viewer{UserID: "u2", Permissions: []string{"read_secrets"}})))
+
+	// With every permission the output matches plain encoding
+	assert.Equal(t, encode(t, a), encode(t, Filter(a, Viewer{Permissions: []string{"read_user", "manage_system"}})))
+}
+
+func TestFilterNestedValues(t *testing.T) {
+	tm := team{Name: "core", Members: []*account{{ID: "u1", Email: "a@example.com"}, nil}}
+	assert.Equal(t, `{"name":"core","members":[{"id":"u1","name":"","email":"a@example.com","created_at":"0001-01-01T00:00:00Z"},null]}`,
+		encode(t, Filter(tm, Viewer{UserID: "u1"})))
+	assert.Equal(t, `{"name":"core","members":null}`, encode(t, Filter(team{Name: "core"}, Viewer{})))
+	assert.Equal(t, `{"x":{"name":"core","members":null}}`, encode(t, Filter(map[string]team{"x": {Name: "core"}}, Viewer{})))
+}
+
+func TestFilterLeavesUntaggedTypesAlone(t *testing.T) {
+	type plain struct {
+		Name string `json:"name"`
+	}
+	p := plain{Name: "x"}
+	assert.Equal(t, p, Filter(p, Viewer{}))
+	assert.Nil(t, Filter(nil, Viewer{}))
+}
@@ -0,0 +1,59 @@
+package fixtures
+
+import (
+	"testing"
+
+	"base-app/pkg/perm"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserBuilderCreatesMissingGroups(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	fx := New(db)
+
+	mock.ExpectQuery(`SELECT id, keycloak_id, email FROM users`).WithArgs("user1").WillReturnRows(sqlmock.NewRows([]string{"id", "keycloak_id", "email"}))
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(sqlmock.AnyArg(), "kc-user1", "user1", "user1@example.com", "Test", "User1", true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id FROM role_groups`).WithArgs("admins").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO role_groups`).WithArgs(sqlmock.AnyArg(), "admins", "").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO user_group_memberships`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user, err := fx.NewUser().InGroup("admins").Build()
+	require.NoError(t, err)
+	assert.Equal(t, "user1", user.Username)
+	assert.Equal(t, "kc-user1", user.KeycloakID)
+	assert.NotEmpty(t, user.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBuildersReuseExistingRows(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	fx := New(db)
+
+	mock.ExpectQuery(`SELECT id FROM roles`).WithArgs("admin").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("role-1"))
+	mock.ExpectQuery(`SELECT id FROM permissions`).WithArgs("manage_group_roles").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO permissions`).WithArgs(sqlmock.AnyArg(), "manage_group_roles", "group_roles", "manage").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO role_permissions .* ON CONFLICT DO NOTHING`).WithArgs("role-1", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	role := fx.NewRole("admin").WithPermissions(perm.ManageGroupRoles).MustBuild()
+	assert.Equal(t, "role-1", role.ID, "the existing role is kept")
+
+	mock.ExpectQuery(`SELECT id, keycloak_id, email FROM users`).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "keycloak_id", "email"}).AddRow("user-1", "kc-real", "alice@corp.example"))
+	user := fx.NewUser().Username("alice").MustBuild()
+	assert.Equal(t, &User{ID: "user-1", KeycloakID: "kc-real", Username: "alice", Email: "alice@corp.example"}, user)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPermissionNamesNeedAnAction(t *testing.T) {
+	_, err := New(nil).Permission("admin")
+	assert.ErrorContains(t, err, "not named action_resource")
+}
@@ -0,0 +1,223 @@
+package httpapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CompressionOptions configures response compression
+type CompressionOptions struct {
+	// MinSize is the body size in bytes from which responses are compressed
+	MinSize int
+	// Level is the gzip/zlib compression level; 0 means the library default
+	Level int
+	// RouteMinSize overrides MinSize by mux path template, e.g. {"/api/rbac/permissions": 256};
+	// a negative size disables compression for the route
+	RouteMinSize map[string]int
+}
+
+// Compress gzip- or deflate-encodes JSON responses of at least MinSize bytes for clients that
+// accept it. Smaller responses are buffered and sent as is, so short error bodies don't pay
+// the compression overhead; responses the handler already encoded are left alone.
+//
+// It is added with Use so the route, and with it RouteMinSize, is known.
+func Compress(opts CompressionOptions) mux.MiddlewareFunc {
+	level := opts.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			minSize := opts.MinSize
+			if route := mux.CurrentRoute(r); route != nil {
+				if template, err := route.GetPathTemplate(); err == nil {
+					if size, ok := opts.RouteMinSize[template]; ok {
+						minSize = size
+					}
+				}
+			}
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if minSize < 0 || encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, level: level, minSize: minSize}
+			next.ServeHTTP(cw, r)
+			// Not deferred: after a panic the buffered body is dropped so the recovery
+			// middleware can still send its own response
+			cw.Close()
+		})
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip on
+// equal quality, or returns "" when neither is acceptable
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	wildcard := -1.0
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			qualities[name] = q
+		}
+	}
+	for _, encoding := range []string{"gzip", "deflate"} {
+		q, ok := qualities[encoding]
+		if !ok && wildcard >= 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether a response with the given Content-Type is worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// compressWriter buffers the start of a response until it knows whether to compress it:
+// once minSize bytes are written, or the handler flushes or returns
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf.Write(p)
+		if cw.buf.Len() < cw.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide sends the headers, compressing if the buffered body is large enough and of a
+// compressible type, and writes out the buffer
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	eligible := compressible(h.Get("Content-Type")) && h.Get("Content-Encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && cw.buf.Len() > 0 && cw.buf.Len() >= cw.minSize {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		var err error
+		if cw.encoding == "gzip" {
+			cw.encoder, err = gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+		} else {
+			cw.encoder, err = zlib.NewWriterLevel(cw.ResponseWriter, cw.level)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// Flush sends what has been written so far, deciding on compression by its size
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 && cw.buf.Len() == 0 {
+			return
+		}
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if gz, ok := cw.encoder.(*gzip.Writer); ok {
+		gz.Flush()
+	} else if z, ok := cw.encoder.(*zlib.Writer); ok {
+		z.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close completes the response once the handler has returned
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			// The handler wrote nothing; let net/http send its implicit 200
+			return nil
+		}
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package httpapi
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"deflate, gzip":           "gzip",
+		"gzip;q=0.5, deflate":     "deflate",
+		"gzip;q=0, deflate;q=0":   "",
+		"br, *;q=0.1":             "gzip",
+		"identity":                "",
+		"GZIP;q=1.0, deflate;q=1": "gzip",
+	}
+	for header, want := range cases {
+		assert.Equal(t, want, negotiateEncoding(header), header)
+	}
+}
+
+func newCompressRouter(body string, contentType string) *mux.Router {
+	r := mux.NewRouter()
+	r.Use(Compress(CompressionOptions{
+		MinSize:      64,
+		RouteMinSize: map[string]int{"/small": 1, "/off": -1},
+	}))
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, body)
+	}
+	for _, path := range []string{"/items", "/small", "/off"} {
+		r.HandleFunc(path, handler)
+	}
+	return r
+}
+
+func TestCompress(t *testing.T) {
+	large := `{"items":[` + strings.Repeat(`"permission",`, 20) + `"last"]}`
+	send := func(r *mux.Router, path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	router := newCompressRouter(large, "application/json")
+
+	w := send(router, "/items", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	w = send(router, "/items", "deflate")
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	z, err := zlib.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(z)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	// Without Accept-Encoding, or with compression off for the route, the body is untouched
+	for _, w := range []*httptest.ResponseRecorder{send(router, "/items", ""), send(router, "/off", "gzip")} {
+		assert.Empty(t, w.Header().Get("Content-Encoding"))
+		assert.Equal(t, large, w.Body.String())
+	}
+
+	// Bodies under the threshold and non-JSON bodies are sent as is
+	small := newCompressRouter(`{"ok":true}`, "application/json")
+	w = send(small, "/items", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, `{"ok":true}`, w.Body.String())
+	assert.Equal(t, "gzip", send(small, "/small", "gzip").Header().Get("Content-Encoding"), "route override")
+
+	text := newCompressRouter(large, "text/plain")
+	w = send(text, "/items", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+}
+
+func TestCompressKeepsStatusAndStreams(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(Compress(CompressionOptions{MinSize: 16}))
+	r.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		stream := NewArrayStream(w, "ids")
+		for i := 0; i < 250; i++ {
+			stream.Write("550e8400-e29b-41d4-a716-446655440000")
+		}
+		stream.Close()
+	})
+	r.HandleFunc("/created", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/stream", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, w.Flushed)
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), `{"ids":[`))
+	assert.True(t, strings.HasSuffix(string(body), "]}\n"))
+
+	req = httptest.NewRequest(http.MethodGet, "/created", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+}
@@ -0,0 +1,55 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, X-Request-ID"
+	corsExposeHeaders = "X-Request-ID, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining"
+)
+
+// CORS sets Access-Control headers for requests from allowed origins and answers their
+// preflight requests. allowedOrigins is consulted per request so the list can change at
+// runtime; "*" allows any origin. Requests from other origins pass through unchanged, which
+// makes browsers block them.
+//
+// It must wrap the router rather than be added with Use, since preflight OPTIONS requests
+// match no route.
+func CORS(allowedOrigins func() []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !originAllowed(origin, allowedOrigins()) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Credentials", "true")
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func originAllowed(origin string, allowed []string) bool {
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(strings.TrimSuffix(candidate, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
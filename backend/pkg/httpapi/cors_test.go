@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	origins := []string{"https://app.example.com"}
+	handler := CORS(func() []string { return origins })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/rbac/roles", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "https://app.example.com", false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = serve(http.MethodOptions, "https://app.example.com", true)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+
+	w = serve(http.MethodGet, "https://evil.example.com", false)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// The origin list is read per request
+	origins = []string{"*"}
+	w = serve(http.MethodGet, "https://evil.example.com", false)
+	assert.Equal(t, "https://evil.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"base-app/pkg/database"
+
+	"github.com/gorilla/mux"
+)
+
+// Deadline gives every request a context deadline of timeout, so calls a handler makes with the
+// request's context, such as to Keycloak, give up when the request's time is up instead of
+// stalling it. A timeout of 0 disables the deadline.
+func Deadline(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// StatementTimeout gives every request a database statement budget of timeout, which each
+// transaction begun with the request's context sets as its LOCAL statement_timeout, cut down to
+// what is left of the request's deadline. A timeout of 0 leaves just the deadline.
+func StatementTimeout(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(database.WithStatementTimeout(r.Context(), timeout)))
+		})
+	}
+}
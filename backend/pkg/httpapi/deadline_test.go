@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"base-app/pkg/database"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadline(t *testing.T) {
+	var deadline time.Time
+	var hasDeadline bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	})
+
+	Deadline(time.Minute)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, hasDeadline)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	Deadline(0)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, hasDeadline)
+}
+
+func TestStatementTimeout(t *testing.T) {
+	var budget time.Duration
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		budget = database.StatementBudget(r.Context())
+	})
+
+	StatementTimeout(5*time.Second)(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, 5*time.Second, budget)
+
+	// Behind a shorter request deadline, the deadline wins
+	Deadline(time.Second)(StatementTimeout(5*time.Second)(handler)).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.True(t, budget > 0 && budget <= time.Second, "budget %s", budget)
+}
@@ -0,0 +1,217 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// DefaultPageLimit is the page size used when a request does not specify one, unless
+	// ConfigurePaging sets another
+	DefaultPageLimit = 50
+	// MaxPageLimit bounds the page size a client may request, unless ConfigurePaging sets another
+	MaxPageLimit = 500
+)
+
+// PageLimits are the page size of requests that do not specify one and the largest a client
+// may request
+type PageLimits struct {
+	Default int
+	Max     int
+}
+
+// pageLimits holds what ConfigurePaging set
+var pageLimits atomic.Pointer[PageLimits]
+
+// ConfigurePaging sets the page limits of every list endpoint. Configure it at startup, before
+// serving requests.
+func ConfigurePaging(limits PageLimits) error {
+	if limits.Default < 1 || limits.Max < limits.Default {
+		return fmt.Errorf("invalid page limits: default %d and max %d must satisfy 1 <= default <= max", limits.Default, limits.Max)
+	}
+	pageLimits.Store(&limits)
+	return nil
+}
+
+// CurrentPageLimits returns the page limits set by ConfigurePaging, or the built-in ones
+func CurrentPageLimits() PageLimits {
+	if limits := pageLimits.Load(); limits != nil {
+		return *limits
+	}
+	return PageLimits{Default: DefaultPageLimit, Max: MaxPageLimit}
+}
+
+// Page is the window of a collection requested with the limit and offset query parameters
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// ParsePage reads limit and offset from the query string. On invalid values it writes a 400
+// VALIDATION_ERROR response and returns false.
+func ParsePage(w http.ResponseWriter, r *http.Request) (Page, bool) {
+	details := make(map[string]string)
+	page := Page{Limit: parseLimit(r, details)}
+
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		offset, err := strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			details["offset"] = "must be a non-negative integer"
+		} else {
+			page.Offset = offset
+		}
+	}
+
+	if len(details) > 0 {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid pagination parameters", "VALIDATION_ERROR", details)
+		return Page{}, false
+	}
+	return page, true
+}
+
+// ParseLimit reads limit from the query string, for lists of the most recent items that take no
+// offset. On an invalid value it writes a 400 VALIDATION_ERROR response and returns false.
+func ParseLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	details := make(map[string]string)
+	limit := parseLimit(r, details)
+	if len(details) > 0 {
+		WriteErrorResponse(w, http.StatusBadRequest, "Invalid pagination parameters", "VALIDATION_ERROR", details)
+		return 0, false
+	}
+	return limit, true
+}
+
+// parseLimit reads limit from the query string within the current page limits, adding a detail
+// when it is invalid
+func parseLimit(r *http.Request, details map[string]string) int {
+	limits := CurrentPageLimits()
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return limits.Default
+	}
+	limit, err := strconv.Atoi(raw)
+	switch {
+	case err != nil || limit < 1:
+		details["limit"] = "must be a positive integer"
+	case limit > limits.Max:
+		details["limit"] = fmt.Sprintf("must be at most %d", limits.Max)
+	}
+	return limit
+}
+
+// Paginate returns the part of items inside the page, for collections that are loaded whole
+func Paginate[T any](items []T, page Page) []T {
+	if page.Offset >= len(items) {
+		return items[:0]
+	}
+	end := page.Offset + page.Limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[page.Offset:end]
+}
+
+// ListMeta describes where a page sits in the collection
+type ListMeta struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// ListLinks are the URLs of the current and neighbouring pages; next and prev are omitted at
+// the ends of the collection
+type ListLinks struct {
+	Self string `json:"self"`
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// ListResponse is the JSON body of every paginated list
+type ListResponse struct {
+	Data  interface{} `json:"data"`
+	Meta  ListMeta    `json:"meta"`
+	Links ListLinks   `json:"links"`
+}
+
+// NewListResponse wraps one page of a collection of total items. The links reuse the request
+// path and query string, so filters carry over to the neighbouring pages.
+func NewListResponse(r *http.Request, data interface{}, total int, page Page) ListResponse {
+	links := ListLinks{Self: pageURL(r.URL, page)}
+	if page.Offset+page.Limit < total {
+		links.Next = pageURL(r.URL, Page{Limit: page.Limit, Offset: page.Offset + page.Limit})
+	}
+	if page.Offset > 0 {
+		prev := page.Offset - page.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		links.Prev = pageURL(r.URL, Page{Limit: page.Limit, Offset: prev})
+	}
+	return ListResponse{
+		Data:  data,
+		Meta:  ListMeta{Total: total, Limit: page.Limit, Offset: page.Offset},
+		Links: links,
+	}
+}
+
+// WriteList writes one page of a collection in the list envelope
+func WriteList(w http.ResponseWriter, r *http.Request, data interface{}, total int, page Page) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewListResponse(r, data, total, page))
+}
+
+func pageURL(u *url.URL, page Page) string {
+	query := u.Query()
+	query.Set("limit", strconv.Itoa(page.Limit))
+	query.Set("offset", strconv.Itoa(page.Offset))
+	return (&url.URL{Path: u.Path, RawQuery: query.Encode()}).String()
+}
+
+// Links maps relation names (e.g. "self", "permissions") to resource URLs
+type Links map[string]string
+
+// Linked is a resource encoded together with its links: the fields of Resource followed by
+// a "links" member. Resource must encode as a JSON object.
+type Linked struct {
+	Resource interface{}
+	Links    Links
+}
+
+// WithLinks attaches links to a resource for encoding
+func WithLinks(resource interface{}, links Links) Linked {
+	return Linked{Resource: resource, Links: links}
+}
+
+// MarshalJSON encodes the resource with a trailing "links" member
+func (l Linked) MarshalJSON() ([]byte, error) {
+	resource, err := json.Marshal(l.Resource)
+	if err != nil {
+		return nil, err
+	}
+	resource = bytes.TrimSpace(resource)
+	if len(resource) < 2 || resource[0] != '{' {
+		return nil, fmt.Errorf("httpapi: cannot attach links to %s", resource)
+	}
+	if len(l.Links) == 0 {
+		return resource, nil
+	}
+	links, err := json.Marshal(l.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(resource[:len(resource)-1])
+	if len(resource) > 2 {
+		buf.WriteByte(',')
+	}
+	buf.WriteString(`"links":`)
+	buf.Write(links)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePage(t *testing.T) {
+	cases := []struct {
+		name  string
+		query string
+		page  Page
+		field string
+	}{
+		{"defaults", "", Page{Limit: DefaultPageLimit}, ""},
+		{"explicit", "?limit=10&offset=20", Page{Limit: 10, Offset: 20}, ""},
+		{"zero limit", "?limit=0", Page{}, "limit"},
+		{"limit too large", "?limit=501", Page{}, "limit"},
+		{"negative offset", "?offset=-1", Page{}, "offset"},
+		{"not a number", "?offset=abc", Page{}, "offset"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			page, ok := ParsePage(w, httptest.NewRequest(http.MethodGet, "/items"+tc.query, nil))
+
+			if tc.field == "" {
+				assert.True(t, ok)
+				assert.Equal(t, tc.page, page)
+				return
+			}
+			assert.False(t, ok)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			var resp ErrorResponse
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "VALIDATION_ERROR", resp.Code)
+			assert.Contains(t, resp.Details, tc.field)
+		})
+	}
+}
+
+func TestConfigurePaging(t *testing.T) {
+	t.Cleanup(func() { pageLimits.Store(nil) })
+	assert.Error(t, ConfigurePaging(PageLimits{Default: 0, Max: 10}))
+	assert.Error(t, ConfigurePaging(PageLimits{Default: 20, Max: 10}))
+	require.NoError(t, ConfigurePaging(PageLimits{Default: 20, Max: 100}))
+
+	page, ok := ParsePage(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items", nil))
+	assert.True(t, ok)
+	assert.Equal(t, Page{Limit: 20}, page)
+
+	w := httptest.NewRecorder()
+	_, ok = ParseLimit(w, httptest.NewRequest(http.MethodGet, "/items?limit=101", nil))
+	assert.False(t, ok)
+	assert.Contains(t, w.Body.String(), "must be at most 100")
+	limit, ok := ParseLimit(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items?limit=100", nil))
+	assert.True(t, ok)
+	assert.Equal(t, 100, limit)
+}
+
+func TestPaginate(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5}
+	assert.Equal(t, []int{3, 4}, Paginate(items, Page{Limit: 2, Offset: 2}))
+	assert.Equal(t, []int{5}, Paginate(items, Page{Limit: 2, Offset: 4}))
+	assert.Empty(t, Paginate(items, Page{Limit: 2, Offset: 5}))
+}
+
+func TestWriteList(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/items?q=ad&limit=2&offset=3", nil)
+	w := httptest.NewRecorder()
+	WriteList(w, r, []string{"d", "e"}, 7, Page{Limit: 2, Offset: 3})
+
+	var resp struct {
+		Data  []string  `json:"data"`
+		Meta  ListMeta  `json:"meta"`
+		Links ListLinks `json:"links"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"d", "e"}, resp.Data)
+	assert.Equal(t, ListMeta{Total: 7, Limit: 2, Offset: 3}, resp.Meta)
+	assert.Equal(t, "/items?limit=2&offset=3&q=ad", resp.Links.Self)
+	assert.Equal(t, "/items?limit=2&offset=5&q=ad", resp.Links.Next)
+	assert.Equal(t, "/items?limit=2&offset=1&q=ad", resp.Links.Prev)
+
+	// No neighbours at the ends of the collection
+	list := NewListResponse(r, nil, 2, Page{Limit: 2})
+	assert.Empty(t, list.Links.Next)
+	assert.Empty(t, list.Links.Prev)
+}
+
+func TestWithLinks(t *testing.T) {
+	resource := struct {
+		ID string `json:"id"`
+	}{ID: "r1"}
+
+	data, err := json.Marshal(WithLinks(resource, Links{"self": "/things/r1"}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"r1","links":{"self":"/things/r1"}}`, string(data))
+
+	data, err = json.Marshal(WithLinks(struct{}{}, Links{"self": "/things"}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"links":{"self":"/things"}}`, string(data))
+
+	_, err = json.Marshal(WithLinks([]string{"a"}, Links{"self": "/things"}))
+	assert.Error(t, err, "only objects can carry links")
+}
@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/dberrors"
+)
+
+// ErrorResponse is the JSON body of every API error
+type ErrorResponse struct {
+	Error   string            `json:"error"`
+	Code    string            `json:"code"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// WriteErrorResponse writes a standardized error response
+func WriteErrorResponse(w http.ResponseWriter, statusCode int, message, code string, details map[string]string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error:   message,
+		Code:    code,
+		Details: details,
+	})
+}
+
+// StatusFor maps a domain error kind to its HTTP status code
+func StatusFor(kind apperrors.Kind) int {
+	switch kind {
+	case apperrors.KindNotFound:
+		return http.StatusNotFound
+	case apperrors.KindConflict:
+		return http.StatusConflict
+	case apperrors.KindForbidden:
+		return http.StatusForbidden
+	case apperrors.KindUnavailable:
+		return http.StatusServiceUnavailable
+	case apperrors.KindQuotaExceeded:
+		return http.StatusPaymentRequired
+	case apperrors.KindUnauthorized:
+		return http.StatusUnauthorized
+	case apperrors.KindInvalid:
+		return http.StatusBadRequest
+	case apperrors.KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteError maps a service error to a response. Domain errors use their kind and code;
+// database connectivity failures become 503 so clients know to retry; anything else is a
+// 500 carrying fallbackMessage, never the raw error text.
+func WriteError(w http.ResponseWriter, err error, fallbackMessage string) {
+	if appErr, ok := apperrors.As(err); ok {
+		if appErr.Kind == apperrors.KindUnavailable {
+			w.Header().Set("Retry-After", "5")
+		}
+		WriteErrorResponse(w, StatusFor(appErr.Kind), appErr.Message, appErr.Code, nil)
+		return
+	}
+	if dberrors.IsUnavailable(err) {
+		w.Header().Set("Retry-After", "5")
+		WriteErrorResponse(w, http.StatusServiceUnavailable, "Service temporarily unavailable", "SERVICE_UNAVAILABLE", nil)
+		return
+	}
+	WriteErrorResponse(w, http.StatusInternalServerError, fallbackMessage, "INTERNAL_ERROR", nil)
+}
@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"not found", apperrors.NotFound("ROLE_NOT_FOUND", "role not found"), http.StatusNotFound, "ROLE_NOT_FOUND"},
+		{"wrapped conflict", fmt.Errorf("assign: %w", apperrors.Conflict("ALREADY_GROUP_MEMBER", "user already in group")), http.StatusConflict, "ALREADY_GROUP_MEMBER"},
+		{"forbidden", apperrors.Forbidden("NOT_OWNER", "not allowed"), http.StatusForbidden, "NOT_OWNER"},
+		{"unauthorized", apperrors.Unauthorized("INVALID_CREDENTIALS", "invalid username or password"), http.StatusUnauthorized, "INVALID_CREDENTIALS"},
+		{"invalid", apperrors.Invalid("PASSWORD_REJECTED", "password rejected"), http.StatusBadRequest, "PASSWORD_REJECTED"},
+		{"internal", apperrors.Internal("KEYCLOAK_REQUEST_FAILED", "identity provider rejected the request", errors.New("403 Forbidden: syntax error")), http.StatusInternalServerError, "KEYCLOAK_REQUEST_FAILED"},
+		{"quota exceeded", apperrors.QuotaExceeded("QUOTA_EXCEEDED", "user quota reached"), http.StatusPaymentRequired, "QUOTA_EXCEEDED"},
+		{"too large", apperrors.TooLarge("LIST_TOO_LARGE", "too many role IDs"), http.StatusRequestEntityTooLarge, "LIST_TOO_LARGE"},
+		{"database down", fmt.Errorf("list roles: %w", driver.ErrBadConn), http.StatusServiceUnavailable, "SERVICE_UNAVAILABLE"},
+		{"unexpected", errors.New("pq: syntax error at or near"), http.StatusInternalServerError, "INTERNAL_ERROR"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			WriteError(w, tc.err, "Failed to do thing")
+
+			assert.Equal(t, tc.status, w.Code)
+			assert.Contains(t, w.Body.String(), `"code":"`+tc.code+`"`)
+			assert.NotContains(t, w.Body.String(), "syntax error")
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Package httpapi holds HTTP helpers shared by the backend modules
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// streamFlushEvery controls how many elements are buffered before flushing to the client
+const streamFlushEvery = 100
+
+// ArrayStream writes a JSON array element by element so large result sets never have to be
+// held in memory. Nothing is written until the first element (or Close), which lets handlers
+// still send a regular error response when the underlying query fails up front.
+type ArrayStream struct {
+	w       http.ResponseWriter
+	key     string
+	fields  []streamField
+	started bool
+	count   int
+}
+
+// streamField is a member written ahead of the array in its wrapping object
+type streamField struct {
+	name  string
+	value interface{}
+}
+
+// NewArrayStream creates a stream writing to w. When key is non-empty the array is wrapped
+// in an object, e.g. {"user_ids": [...]}, to keep existing response shapes intact.
+func NewArrayStream(w http.ResponseWriter, key string) *ArrayStream {
+	return &ArrayStream{w: w, key: key}
+}
+
+// WithField writes name: value ahead of the array in its wrapping object, e.g.
+// {"realm": "base", "users": [...]}. It needs a key and must be called before the first Write.
+func (s *ArrayStream) WithField(name string, value interface{}) *ArrayStream {
+	s.fields = append(s.fields, streamField{name: name, value: value})
+	return s
+}
+
+// Started reports whether the response status and opening bracket have been written
+func (s *ArrayStream) Started() bool {
+	return s.started
+}
+
+// Count returns the number of elements written so far
+func (s *ArrayStream) Count() int {
+	return s.count
+}
+
+func (s *ArrayStream) start() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(http.StatusOK)
+
+	opening := "["
+	if s.key != "" {
+		opening = "{"
+		for _, field := range s.fields {
+			name, err := json.Marshal(field.name)
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(field.value)
+			if err != nil {
+				return err
+			}
+			opening += string(name) + ":" + string(value) + ","
+		}
+		key, err := json.Marshal(s.key)
+		if err != nil {
+			return err
+		}
+		opening += string(key) + ":["
+	}
+	_, err := io.WriteString(s.w, opening)
+	return err
+}
+
+// Write encodes v as the next array element
+func (s *ArrayStream) Write(v interface{}) error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if s.count > 0 {
+		if _, err := io.WriteString(s.w, ","); err != nil {
+			return err
+		}
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	s.count++
+	if s.count%streamFlushEvery == 0 {
+		s.flush()
+	}
+	return nil
+}
+
+// Close terminates the array (and wrapping object), writing an empty array if nothing was streamed.
+// Handlers that hit an error after Started() should skip Close so the client sees a truncated,
+// unparseable body instead of a silently incomplete list.
+func (s *ArrayStream) Close() error {
+	if err := s.start(); err != nil {
+		return err
+	}
+	closing := "]"
+	if s.key != "" {
+		closing = "]}"
+	}
+	_, err := io.WriteString(s.w, closing+"\n")
+	s.flush()
+	return err
+}
+
+func (s *ArrayStream) flush() {
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
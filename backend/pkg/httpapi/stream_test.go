@@ -0,0 +1,57 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrayStreamWritesValidJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := NewArrayStream(w, "")
+
+	for i := 0; i < 250; i++ {
+		require.NoError(t, stream.Write(map[string]int{"n": i}))
+	}
+	require.NoError(t, stream.Close())
+
+	var items []map[string]int
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &items))
+	assert.Len(t, items, 250)
+	assert.Equal(t, 249, items[249]["n"])
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
+
+func TestArrayStreamWrapsInObject(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := NewArrayStream(w, "user_ids")
+
+	require.NoError(t, stream.Write("a"))
+	require.NoError(t, stream.Write("b"))
+	require.NoError(t, stream.Close())
+
+	assert.JSONEq(t, `{"user_ids":["a","b"]}`, w.Body.String())
+}
+
+func TestArrayStreamWritesFieldsAheadOfArray(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := NewArrayStream(w, "users").WithField("realm", "base")
+
+	require.NoError(t, stream.Write(map[string]string{"username": "alice"}))
+	require.NoError(t, stream.Close())
+
+	assert.Equal(t, `{"realm":"base","users":[{"username":"alice"}]}`+"\n", w.Body.String())
+}
+
+func TestArrayStreamEmptyAndLazyStart(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := NewArrayStream(w, "user_ids")
+	assert.False(t, stream.Started())
+	assert.Empty(t, w.Body.String())
+
+	require.NoError(t, stream.Close())
+	assert.JSONEq(t, `{"user_ids":[]}`, w.Body.String())
+}
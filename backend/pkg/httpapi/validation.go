@@ -0,0 +1,61 @@
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ValidationDetails converts validator errors into per-field, human readable messages.
+// message describes a failed rule; nil uses ValidationMessage.
+func ValidationDetails(errs validator.ValidationErrors, message func(validator.FieldError) string) map[string]string {
+	if message == nil {
+		message = ValidationMessage
+	}
+	details := make(map[string]string, len(errs))
+	for _, fe := range errs {
+		details[fe.Field()] = message(fe)
+	}
+	return details
+}
+
+// ValidationMessage returns a friendly message for a failed built-in validation rule
+func ValidationMessage(fe validator.FieldError) string {
+	isCollection := fe.Kind() == reflect.Slice || fe.Kind() == reflect.Map
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		if isCollection {
+			return fmt.Sprintf("must contain at least %s item(s)", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s characters long", fe.Param())
+	case "max":
+		if isCollection {
+			return fmt.Sprintf("must contain at most %s item(s)", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s characters long", fe.Param())
+	case "email":
+		return "must be a valid email address"
+	case "uuid":
+		return "must be a valid UUID"
+	case "e164":
+		return "must be a phone number in E.164 format, e.g. +14155552671"
+	default:
+		return "is invalid"
+	}
+}
+
+// WriteValidationError writes a 400 VALIDATION_ERROR for validator errors and reports whether
+// err was one
+func WriteValidationError(w http.ResponseWriter, err error) bool {
+	var fieldErrs validator.ValidationErrors
+	if !errors.As(err, &fieldErrs) {
+		return false
+	}
+	WriteErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", ValidationDetails(fieldErrs, nil))
+	return true
+}
@@ -0,0 +1,91 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where operations are served
+const Path = "/api/operations"
+
+// WantsAsync reports whether r asks to be answered with an operation instead of waiting for the
+// work, with the "Prefer: respond-async" header of RFC 7240
+func WantsAsync(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for _, token := range strings.Split(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteAccepted answers 202 with op, its location and the applied preference
+func WriteAccepted(w http.ResponseWriter, op *Operation) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", Path+"/"+op.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(op)
+}
+
+// visible returns the operation with id if the caller started it or may manage the system;
+// other callers get not found, so they cannot probe for operation IDs
+func visible(r *http.Request, runner *Runner, viewer func(r *http.Request) fieldfilter.Viewer, id string) (*Operation, error) {
+	op, err := runner.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	v := viewer(r)
+	if op.CreatedBy != v.UserID && !v.Can(string(perm.ManageSystem)) {
+		return nil, apperrors.NotFound("OPERATION_NOT_FOUND", "operation not found")
+	}
+	return op, nil
+}
+
+// StatusHandler handles GET /api/operations/{id}
+func StatusHandler(runner *Runner, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := visible(r, runner, viewer, mux.Vars(r)["id"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get operation")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(op)
+	}
+}
+
+// ResultHandler handles GET /api/operations/{id}/result
+func ResultHandler(runner *Runner, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := visible(r, runner, viewer, mux.Vars(r)["id"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get operation result")
+			return
+		}
+		result, err := runner.Result(op.ID)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get operation result")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(result)
+	}
+}
+
+// Mount registers the operation endpoints under Path, wrapped by protect. Callers see the
+// operations they started; holders of manage_system see all.
+func Mount(r *mux.Router, runner *Runner, viewer func(r *http.Request) fieldfilter.Viewer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path+"/{id}", protect(StatusHandler(runner, viewer))).Methods("GET")
+	r.HandleFunc(Path+"/{id}/result", protect(ResultHandler(runner, viewer))).Methods("GET")
+}
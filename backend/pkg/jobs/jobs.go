@@ -0,0 +1,291 @@
+// Package jobs runs long operations such as bulk imports and exports in the background. The
+// endpoint that starts one answers 202 with an operation; clients poll GET /api/operations/{id}
+// for its progress and fetch the result from the operation's result_url once it succeeded.
+//
+// Operations are stored in the database, so any instance can report on them. An operation
+// whose instance stops while running stops sending heartbeats and is marked failed by the
+// periodic cleanup.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// Statuses of an operation
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Retention is how long finished operations and their results are kept
+const Retention = 7 * 24 * time.Hour
+
+// heartbeatInterval is how often a running operation records that it is still alive;
+// operations silent for staleAfter are considered abandoned
+const (
+	heartbeatInterval = time.Minute
+	staleAfter        = 5 * heartbeatInterval
+)
+
+// progressFlushInterval bounds how often progress reports are written to the store
+const progressFlushInterval = time.Second
+
+// Operation is a background job and its progress
+type Operation struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	Status    string `json:"status"`
+	CreatedBy string `json:"created_by,omitempty"`
+	// Processed and Total count the items handled so far and overall; Total is 0 until known
+	Processed int    `json:"processed"`
+	Total     int    `json:"total"`
+	Error     string `json:"error,omitempty"`
+	// ResultURL is where the result of a succeeded operation is served
+	ResultURL  string     `json:"result_url,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Job does the work of an operation and returns its result, which is stored as JSON. Report
+// progress with ReportProgress.
+type Job func(ctx context.Context) (interface{}, error)
+
+// Runner starts jobs and tracks them as operations
+type Runner struct {
+	store  Store
+	logger *logrus.Logger
+	now    func() time.Time
+
+	wg sync.WaitGroup
+}
+
+// NewRunner creates a runner keeping operations in store
+func NewRunner(store Store, logger *logrus.Logger) *Runner {
+	return &Runner{store: store, logger: logger, now: time.Now}
+}
+
+// Submit records an operation of kind started by createdBy and runs job in the background.
+// The job's context keeps the values of ctx, such as the request ID, but not its cancellation,
+// so it outlives the request that started it.
+func (r *Runner) Submit(ctx context.Context, kind, createdBy string, job Job) (*Operation, error) {
+	now := r.now()
+	op := &Operation{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Status:    StatusRunning,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := r.store.Create(op); err != nil {
+		r.logger.WithContext(ctx).WithError(err).WithField("kind", kind).Error("Failed to record operation")
+		return nil, err
+	}
+
+	tracker := &tracker{runner: r, id: op.ID}
+	jobCtx := context.WithValue(context.WithoutCancel(ctx), trackerKey{}, tracker)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		stop := tracker.heartbeat()
+		result, err := r.run(jobCtx, job)
+		stop()
+		r.finish(jobCtx, op, tracker, result, err)
+	}()
+
+	r.logger.WithContext(ctx).WithFields(logrus.Fields{"operation_id": op.ID, "kind": kind}).Info("Operation started")
+	return op, nil
+}
+
+// run calls job, turning a panic into an error so one bad job cannot take the server down
+func (r *Runner) run(ctx context.Context, job Job) (result interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return job(ctx)
+}
+
+// finish stores the outcome of op. Only domain errors are shown to clients; others are logged.
+func (r *Runner) finish(ctx context.Context, op *Operation, t *tracker, result interface{}, err error) {
+	logger := r.logger.WithContext(ctx).WithFields(logrus.Fields{"operation_id": op.ID, "kind": op.Kind})
+	status, message := StatusSucceeded, ""
+	var body []byte
+	if err == nil {
+		body, err = json.Marshal(result)
+	}
+	if err != nil {
+		status, message = StatusFailed, "Operation failed"
+		if appErr, ok := apperrors.As(err); ok {
+			message = appErr.Message
+		}
+		logger.WithError(err).Error("Operation failed")
+		body = nil
+	}
+
+	processed, total := t.counts()
+	if status == StatusSucceeded && total > 0 {
+		processed = total
+	}
+	if err := r.store.Finish(op.ID, status, processed, total, body, message, r.now()); err != nil {
+		logger.WithError(err).Error("Failed to record operation outcome")
+		return
+	}
+	if status == StatusSucceeded {
+		logger.Info("Operation succeeded")
+	}
+}
+
+// Get returns the operation with id, or a not found error
+func (r *Runner) Get(id string) (*Operation, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, apperrors.NotFound("OPERATION_NOT_FOUND", "operation not found")
+	}
+	op, err := r.store.Get(id)
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to get operation")
+		return nil, err
+	}
+	if op == nil {
+		return nil, apperrors.NotFound("OPERATION_NOT_FOUND", "operation not found")
+	}
+	if op.Status == StatusSucceeded {
+		op.ResultURL = Path + "/" + op.ID + "/result"
+	}
+	return op, nil
+}
+
+// Result returns the stored result of a succeeded operation
+func (r *Runner) Result(id string) (json.RawMessage, error) {
+	op, err := r.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if op.Status != StatusSucceeded {
+		return nil, apperrors.Conflict("OPERATION_NOT_SUCCEEDED", "the operation has no result; it is "+op.Status)
+	}
+	result, err := r.store.Result(id)
+	if err != nil {
+		r.logger.WithError(err).Error("Failed to get operation result")
+		return nil, err
+	}
+	return result, nil
+}
+
+// Wait blocks until the jobs started by this runner have finished
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+// Cleanup fails operations abandoned by a stopped instance and deletes finished operations
+// older than Retention
+func (r *Runner) Cleanup() error {
+	now := r.now()
+	abandoned, err := r.store.FailStale(now.Add(-staleAfter), "Operation abandoned: the server running it stopped", now)
+	if err != nil {
+		return fmt.Errorf("fail abandoned operations: %w", err)
+	}
+	if abandoned > 0 {
+		r.logger.WithField("operations", abandoned).Warn("Marked abandoned operations as failed")
+	}
+	if _, err := r.store.DeleteFinished(now.Add(-Retention)); err != nil {
+		return fmt.Errorf("delete old operations: %w", err)
+	}
+	return nil
+}
+
+// Start runs Cleanup every interval until ctx is cancelled
+func (r *Runner) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Cleanup(); err != nil {
+					r.logger.WithError(err).Error("Failed to clean up operations")
+				}
+			}
+		}
+	}()
+}
+
+type trackerKey struct{}
+
+// tracker holds the progress of one running operation and writes it to the store
+type tracker struct {
+	runner *Runner
+	id     string
+
+	mu               sync.Mutex
+	processed, total int
+	flushed          time.Time
+}
+
+func (t *tracker) counts() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.processed, t.total
+}
+
+// report records progress, writing it when the last write is older than progressFlushInterval
+// or the operation is complete
+func (t *tracker) report(processed, total int) {
+	t.mu.Lock()
+	t.processed, t.total = processed, total
+	now := t.runner.now()
+	if now.Sub(t.flushed) < progressFlushInterval && processed < total {
+		t.mu.Unlock()
+		return
+	}
+	t.flushed = now
+	t.mu.Unlock()
+	t.flush(processed, total, now)
+}
+
+func (t *tracker) flush(processed, total int, at time.Time) {
+	if err := t.runner.store.Progress(t.id, processed, total, at); err != nil {
+		t.runner.logger.WithError(err).WithField("operation_id", t.id).Warn("Failed to record operation progress")
+	}
+}
+
+// heartbeat writes the current progress every heartbeatInterval, so the operation is not taken
+// for abandoned while its job is busy; the returned function stops it
+func (t *tracker) heartbeat() func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				processed, total := t.counts()
+				t.flush(processed, total, t.runner.now())
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ReportProgress records that a job has processed items of total; outside a job it does nothing
+func ReportProgress(ctx context.Context, processed, total int) {
+	if t, ok := ctx.Value(trackerKey{}).(*tracker); ok {
+		t.report(processed, total)
+	}
+}
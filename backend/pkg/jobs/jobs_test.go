@@ -0,0 +1,224 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps operations in memory
+type memoryStore struct {
+	mu      sync.Mutex
+	ops     map[string]Operation
+	results map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{ops: make(map[string]Operation), results: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Create(op *Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[op.ID] = *op
+	return nil
+}
+
+func (s *memoryStore) Progress(id string, processed, total int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.ops[id]
+	op.Processed, op.Total, op.UpdatedAt = processed, total, at
+	s.ops[id] = op
+	return nil
+}
+
+func (s *memoryStore) Finish(id, status string, processed, total int, result []byte, message string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.ops[id]
+	op.Status, op.Processed, op.Total, op.Error, op.UpdatedAt, op.FinishedAt = status, processed, total, message, at, &at
+	s.ops[id] = op
+	s.results[id] = result
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (*Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op, ok := s.ops[id]
+	if !ok {
+		return nil, nil
+	}
+	return &op, nil
+}
+
+func (s *memoryStore) Result(id string) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results[id], nil
+}
+
+func (s *memoryStore) FailStale(before time.Time, message string, at time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, op := range s.ops {
+		if op.Status == StatusRunning && op.UpdatedAt.Before(before) {
+			op.Status, op.Error, op.FinishedAt = StatusFailed, message, &at
+			s.ops[id] = op
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) DeleteFinished(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, op := range s.ops {
+		if op.FinishedAt != nil && op.FinishedAt.Before(before) {
+			delete(s.ops, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func newTestRunner() *Runner {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewRunner(newMemoryStore(), logger)
+}
+
+func TestSubmitRecordsProgressAndResult(t *testing.T) {
+	runner := newTestRunner()
+
+	op, err := runner.Submit(context.Background(), "users.export", "u1", func(ctx context.Context) (interface{}, error) {
+		ReportProgress(ctx, 1, 2)
+		return map[string]int{"users": 2}, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, StatusRunning, op.Status)
+	runner.Wait()
+
+	done, err := runner.Get(op.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusSucceeded, done.Status)
+	assert.Equal(t, 2, done.Processed, "a succeeded operation is complete")
+	assert.Equal(t, 2, done.Total)
+	assert.Equal(t, Path+"/"+op.ID+"/result", done.ResultURL)
+	assert.NotNil(t, done.FinishedAt)
+
+	result, err := runner.Result(op.ID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"users":2}`, string(result))
+}
+
+func TestSubmitHidesInternalErrors(t *testing.T) {
+	runner := newTestRunner()
+
+	internal, _ := runner.Submit(context.Background(), "users.import", "u1", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("pq: connection reset")
+	})
+	domain, _ := runner.Submit(context.Background(), "users.import", "u1", func(ctx context.Context) (interface{}, error) {
+		return nil, apperrors.Invalid("EMPTY_IMPORT", "The file contains no users")
+	})
+	panicked, _ := runner.Submit(context.Background(), "users.import", "u1", func(ctx context.Context) (interface{}, error) {
+		panic("boom")
+	})
+	runner.Wait()
+
+	for id, message := range map[string]string{
+		internal.ID: "Operation failed",
+		domain.ID:   "The file contains no users",
+		panicked.ID: "Operation failed",
+	} {
+		op, err := runner.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, StatusFailed, op.Status)
+		assert.Equal(t, message, op.Error)
+		assert.Empty(t, op.ResultURL)
+	}
+	_, err := runner.Result(domain.ID)
+	assert.Equal(t, apperrors.KindConflict, apperrors.KindOf(err))
+}
+
+func TestCleanupFailsAbandonedOperations(t *testing.T) {
+	runner := newTestRunner()
+	store := runner.store.(*memoryStore)
+	old := time.Now().Add(-time.Hour)
+	store.Create(&Operation{ID: "a2d1b2c4-0000-4000-8000-000000000001", Status: StatusRunning, UpdatedAt: old})
+	store.Create(&Operation{ID: "a2d1b2c4-0000-4000-8000-000000000002", Status: StatusSucceeded, FinishedAt: &old})
+	expired := time.Now().Add(-Retention - time.Hour)
+	store.Create(&Operation{ID: "a2d1b2c4-0000-4000-8000-000000000003", Status: StatusSucceeded, FinishedAt: &expired})
+
+	require.NoError(t, runner.Cleanup())
+
+	abandoned, _ := runner.Get("a2d1b2c4-0000-4000-8000-000000000001")
+	assert.Equal(t, StatusFailed, abandoned.Status)
+	kept, _ := runner.Get("a2d1b2c4-0000-4000-8000-000000000002")
+	assert.Equal(t, StatusSucceeded, kept.Status)
+	_, err := runner.Get("a2d1b2c4-0000-4000-8000-000000000003")
+	assert.True(t, apperrors.IsNotFound(err))
+}
+
+func TestStatusHandlerShowsOperationsToTheirCreator(t *testing.T) {
+	runner := newTestRunner()
+	op, err := runner.Submit(context.Background(), "users.export", "u1", func(ctx context.Context) (interface{}, error) {
+		return []string{}, nil
+	})
+	require.NoError(t, err)
+	runner.Wait()
+
+	router := mux.NewRouter()
+	var viewer fieldfilter.Viewer
+	Mount(router, runner, func(*http.Request) fieldfilter.Viewer { return viewer }, func(h http.HandlerFunc) http.HandlerFunc { return h })
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	viewer = fieldfilter.Viewer{UserID: "u2"}
+	assert.Equal(t, http.StatusNotFound, get(Path+"/"+op.ID).Code, "other users cannot see the operation")
+
+	viewer = fieldfilter.Viewer{UserID: "u2", Permissions: []string{string(perm.ManageSystem)}}
+	assert.Equal(t, http.StatusOK, get(Path+"/"+op.ID).Code)
+
+	viewer = fieldfilter.Viewer{UserID: "u1"}
+	w := get(Path + "/" + op.ID)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status Operation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, StatusSucceeded, status.Status)
+
+	w = get(status.ResultURL)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, get(Path+"/not-a-uuid").Code)
+}
+
+func TestWantsAsync(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/users/import", nil)
+	assert.False(t, WantsAsync(r))
+	r.Header.Set("Prefer", "return=minimal, Respond-Async")
+	assert.True(t, WantsAsync(r))
+}
@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"base-app/pkg/database"
+)
+
+// Store keeps operations. The Postgres store expects this table:
+//
+//	CREATE TABLE operations (
+//		id UUID PRIMARY KEY,
+//		kind VARCHAR(100) NOT NULL,
+//		status VARCHAR(20) NOT NULL,
+//		created_by VARCHAR(255) NOT NULL DEFAULT '',
+//		processed INTEGER NOT NULL DEFAULT 0,
+//		total INTEGER NOT NULL DEFAULT 0,
+//		result JSONB,
+//		error TEXT NOT NULL DEFAULT '',
+//		created_at TIMESTAMP NOT NULL,
+//		updated_at TIMESTAMP NOT NULL,
+//		finished_at TIMESTAMP
+//	)
+type Store interface {
+	// Create records a new operation
+	Create(op *Operation) error
+	// Progress updates the counts of a running operation and marks it alive at the given time
+	Progress(id string, processed, total int, at time.Time) error
+	// Finish records the outcome of a running operation
+	Finish(id, status string, processed, total int, result []byte, message string, at time.Time) error
+	// Get returns the operation with id, or nil when there is none
+	Get(id string) (*Operation, error)
+	// Result returns the stored result of an operation
+	Result(id string) (json.RawMessage, error)
+	// FailStale fails running operations not updated since before and returns how many there were
+	FailStale(before time.Time, message string, at time.Time) (int, error)
+	// DeleteFinished deletes operations finished before the given time
+	DeleteFinished(before time.Time) (int, error)
+}
+
+// store implements Store on Postgres
+type store struct {
+	db database.DBTX
+}
+
+// NewStore creates a Postgres operation store
+func NewStore(db *sql.DB) Store {
+	return &store{db: db}
+}
+
+func (s *store) Create(op *Operation) error {
+	query := `INSERT INTO operations (id, kind, status, created_by, processed, total, created_at, updated_at)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := s.db.Exec(query, op.ID, op.Kind, op.Status, op.CreatedBy, op.Processed, op.Total, op.CreatedAt, op.UpdatedAt)
+	return err
+}
+
+func (s *store) Progress(id string, processed, total int, at time.Time) error {
+	query := `UPDATE operations SET processed = $2, total = $3, updated_at = $4 WHERE id = $1 AND status = $5`
+	_, err := s.db.Exec(query, id, processed, total, at, StatusRunning)
+	return err
+}
+
+func (s *store) Finish(id, status string, processed, total int, result []byte, message string, at time.Time) error {
+	query := `UPDATE operations
+	          SET status = $2, processed = $3, total = $4, result = $5, error = $6, updated_at = $7, finished_at = $7
+	          WHERE id = $1 AND status = $8`
+	var resultArg interface{}
+	if result != nil {
+		resultArg = string(result)
+	}
+	_, err := s.db.Exec(query, id, status, processed, total, resultArg, message, at, StatusRunning)
+	return err
+}
+
+func (s *store) Get(id string) (*Operation, error) {
+	query := `SELECT id, kind, status, created_by, processed, total, error, created_at, updated_at, finished_at
+	          FROM operations WHERE id = $1`
+	var op Operation
+	var finishedAt sql.NullTime
+	err := s.db.QueryRow(query, id).Scan(&op.ID, &op.Kind, &op.Status, &op.CreatedBy, &op.Processed, &op.Total,
+		&op.Error, &op.CreatedAt, &op.UpdatedAt, &finishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if finishedAt.Valid {
+		op.FinishedAt = &finishedAt.Time
+	}
+	return &op, nil
+}
+
+func (s *store) Result(id string) (json.RawMessage, error) {
+	var result []byte
+	if err := s.db.QueryRow(`SELECT result FROM operations WHERE id = $1`, id).Scan(&result); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(result), nil
+}
+
+func (s *store) FailStale(before time.Time, message string, at time.Time) (int, error) {
+	query := `UPDATE operations SET status = $1, error = $2, updated_at = $3, finished_at = $3
+	          WHERE status = $4 AND updated_at < $5`
+	res, err := s.db.Exec(query, StatusFailed, message, at, StatusRunning, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *store) DeleteFinished(before time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM operations WHERE finished_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
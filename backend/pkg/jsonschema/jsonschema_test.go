@@ -0,0 +1,138 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testRequest struct {
+	Name       string            `json:"name" validate:"required,min=2,max=10,shouty"`
+	Email      string            `json:"email" validate:"required,email"`
+	Phone      string            `json:"phone" validate:"omitempty,e164"`
+	Kind       string            `json:"kind" validate:"omitempty,oneof=admin member"`
+	Age        int               `json:"age" validate:"min=0,max=150"`
+	IDs        []string          `json:"ids" validate:"required,min=1,dive,uuid"`
+	Attributes map[string]string `json:"attributes" validate:"omitempty,max=2,dive,keys,min=1,max=5,endkeys,max=8"`
+	Internal   string            `json:"-"`
+}
+
+func init() {
+	RegisterTag("shouty", func(s *Schema, _ string) {
+		s.SetPattern(`^[A-Z]+$`)
+	})
+}
+
+func TestForTranslatesValidateTags(t *testing.T) {
+	s, err := For(testRequest{})
+	require.NoError(t, err)
+
+	assert.Equal(t, Draft, s.Draft)
+	assert.Equal(t, "object", s.Type)
+	assert.ElementsMatch(t, []string{"name", "email", "ids"}, s.Required)
+	assert.NotContains(t, s.Properties, "Internal")
+
+	name := s.Properties["name"]
+	assert.Equal(t, 2, *name.MinLength)
+	assert.Equal(t, 10, *name.MaxLength)
+	assert.Equal(t, `^[A-Z]+$`, name.Pattern)
+
+	assert.Equal(t, "email", s.Properties["email"].Format)
+	assert.Equal(t, "integer", s.Properties["age"].Type)
+	assert.Equal(t, float64(150), *s.Properties["age"].Maximum)
+	assert.Equal(t, 1, *s.Properties["ids"].MinItems)
+	assert.Equal(t, "uuid", s.Properties["ids"].Items.Format)
+
+	attributes := s.Properties["attributes"]
+	assert.Equal(t, 5, *attributes.PropertyNames.MaxLength)
+	assert.Equal(t, 8, *attributes.AdditionalProperties.MaxLength)
+	require.Len(t, attributes.AnyOf, 2, "omitempty exempts the empty value")
+
+	// The schema is plain JSON Schema
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"$schema":"https://json-schema.org/draft/2020-12/schema"`)
+
+	_, err = For("not a struct")
+	assert.Error(t, err)
+}
+
+func TestValidateJSON(t *testing.T) {
+	s := MustFor(testRequest{})
+
+	valid := `{"name":"ADA","email":"ada@example.com","ids":["550e8400-e29b-41d4-a716-446655440000"],"phone":"","kind":"admin","attributes":{"team":"core"}}`
+	assert.Empty(t, s.ValidateJSON([]byte(valid)))
+
+	errs := Details(s.ValidateJSON([]byte(`{"name":"a","email":"nope","age":200,"ids":["x"],"phone":"555","kind":"guest","attributes":{"toolongkey":"v"}}`)))
+	assert.Equal(t, map[string]string{
+		"name":                  "must be at least 2 characters long",
+		"email":                 "must be a valid email address",
+		"age":                   "must be at most 150",
+		"ids[0]":                "must be a valid UUID",
+		"phone":                 "has an invalid format",
+		"kind":                  "must be one of: admin, member",
+		"attributes.toolongkey": "key must be at most 5 characters long",
+	}, errs)
+
+	errs = Details(s.ValidateJSON([]byte(`{"name":"ADA","email":"a@b.co","ids":["550e8400-e29b-41d4-a716-446655440000"],"attributes":{"a":"1","b":"2","c":"3"}}`)))
+	assert.Equal(t, map[string]string{"attributes": "must contain at most 2 item(s)"}, errs)
+
+	errs = Details(s.ValidateJSON([]byte(`{"name":null,"email":"","age":"old","ids":[]}`)))
+	assert.Equal(t, map[string]string{
+		"name":  "is required",
+		"email": "is required",
+		"age":   "must be an integer",
+		"ids":   "must contain at least 1 item(s)",
+	}, errs)
+
+	assert.Equal(t, []FieldError{{Field: "body", Message: "must be valid JSON"}}, s.ValidateJSON([]byte(`{"name":`)))
+	assert.Equal(t, []FieldError{{Field: "body", Message: "must be an object"}}, s.ValidateJSON([]byte(`[]`)))
+}
+
+func TestMiddleware(t *testing.T) {
+	reg := NewRegistry()
+	reg.Register("POST", "/items/{id}", testRequest{})
+	enabled := true
+
+	var received string
+	r := mux.NewRouter()
+	r.Use(reg.Middleware(func() bool { return enabled }))
+	r.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}).Methods("POST", "PUT")
+
+	send := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/items/1", strings.NewReader(body)))
+		return w
+	}
+
+	w := send("POST", `{"name":"x"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp struct {
+		Code    string            `json:"code"`
+		Details map[string]string `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "VALIDATION_ERROR", resp.Code)
+	assert.Equal(t, "is required", resp.Details["email"])
+	assert.Empty(t, received, "the handler must not run")
+
+	valid := `{"name":"ADA","email":"ada@example.com","ids":["550e8400-e29b-41d4-a716-446655440000"]}`
+	w = send("POST", valid)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, valid, received, "the handler sees the original body")
+
+	// Unregistered methods and a disabled middleware pass through
+	assert.Equal(t, http.StatusOK, send("PUT", `{}`).Code)
+	enabled = false
+	assert.Equal(t, http.StatusOK, send("POST", `{}`).Code)
+}
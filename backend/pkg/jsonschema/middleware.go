@@ -0,0 +1,103 @@
+package jsonschema
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// MaxBodyBytes bounds the request bodies the middleware reads
+const MaxBodyBytes = 1 << 20
+
+// Registry maps routes, by method and mux path template, to the schema of their request body
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]*Schema
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{schemas: make(map[string]*Schema)}
+}
+
+// Register derives the schema of v and associates it with the route. It panics if v cannot be
+// described, since request structs are fixed at compile time.
+func (reg *Registry) Register(method, pathTemplate string, v interface{}) {
+	s := MustFor(v)
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.schemas[method+" "+pathTemplate] = s
+}
+
+// Lookup returns the schema registered for the route
+func (reg *Registry) Lookup(method, pathTemplate string) (*Schema, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	s, ok := reg.schemas[method+" "+pathTemplate]
+	return s, ok
+}
+
+// Middleware validates request bodies of registered routes before their handlers run and
+// rejects invalid ones with a 400 VALIDATION_ERROR listing every failing field. enabled is
+// checked per request, so validation can be switched on and off at runtime.
+func (reg *Registry) Middleware(enabled func() bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			schema, ok := reg.Lookup(r.Method, template)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodyBytes))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					httpapi.WriteErrorResponse(w, http.StatusRequestEntityTooLarge, "Request body too large", "PAYLOAD_TOO_LARGE", nil)
+					return
+				}
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "VALIDATION_ERROR", nil)
+				return
+			}
+			if errs := schema.ValidateJSON(body); len(errs) > 0 {
+				httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Validation failed", "VALIDATION_ERROR", Details(errs))
+				return
+			}
+
+			// Handlers decode the body again
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Details converts violations to the field -> message map used in API error responses
+func Details(errs []FieldError) map[string]string {
+	details := make(map[string]string, len(errs))
+	for _, e := range errs {
+		if _, seen := details[e.Field]; !seen {
+			details[e.Field] = e.Message
+		}
+	}
+	return details
+}
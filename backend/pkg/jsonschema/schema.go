@@ -0,0 +1,398 @@
+// Package jsonschema derives JSON Schemas from request structs and validates payloads against
+// them. Schemas follow the struct's json tags and translate its validate tags (required, min,
+// max, email, uuid, oneof, dive, ...), so the schema and the go-playground validator used by
+// the services agree on what a valid request is.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Draft is the JSON Schema dialect generated schemas declare
+const Draft = "https://json-schema.org/draft/2020-12/schema"
+
+// Schema is the subset of JSON Schema needed to describe request payloads
+type Schema struct {
+	Draft                string             `json:"$schema,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinProperties        *int               `json:"minProperties,omitempty"`
+	MaxProperties        *int               `json:"maxProperties,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// TagFunc applies a custom validate tag to the schema of the field carrying it
+type TagFunc func(s *Schema, param string)
+
+var (
+	tagsMu     sync.RWMutex
+	customTags = map[string]TagFunc{}
+)
+
+// RegisterTag teaches the generator a custom validator tag, typically next to the matching
+// validator.RegisterValidation call. Unknown tags are ignored, leaving the check to the service.
+func RegisterTag(name string, fn TagFunc) {
+	tagsMu.Lock()
+	defer tagsMu.Unlock()
+	customTags[name] = fn
+}
+
+// SetPattern constrains a string schema to a regular expression
+func (s *Schema) SetPattern(expr string) {
+	s.Pattern = expr
+	s.pattern = regexp.MustCompile(expr)
+}
+
+// For generates the schema of v's type, which must be a struct or pointer to one
+func For(v interface{}) (*Schema, error) {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("jsonschema: %T is not a struct", v)
+	}
+	s, err := typeSchema(t)
+	if err != nil {
+		return nil, err
+	}
+	s.Draft = Draft
+	s.Title = t.Name()
+	return s, nil
+}
+
+// MustFor is like For but panics on error; use it for request structs known at compile time
+func MustFor(v interface{}) *Schema {
+	s, err := For(v)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func typeSchema(t reflect.Type) (*Schema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	case t == rawMessageType:
+		return &Schema{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as a base64 string
+			return &Schema{Type: "string"}, nil
+		}
+		items, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("jsonschema: map key type %s is not supported", t.Key())
+		}
+		values, err := typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		return structSchema(t)
+	case reflect.Interface:
+		return &Schema{}, nil
+	default:
+		return nil, fmt.Errorf("jsonschema: type %s is not supported", t)
+	}
+}
+
+func structSchema(t reflect.Type) (*Schema, error) {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+
+		// Embedded structs without a JSON name contribute their fields, as encoding/json does
+		if field.Anonymous && name == "" {
+			embedded, err := typeSchema(field.Type)
+			if err != nil {
+				return nil, err
+			}
+			for prop, ps := range embedded.Properties {
+				s.Properties[prop] = ps
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fs, err := typeSchema(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("jsonschema: field %s: %w", field.Name, err)
+		}
+		fs, required, err := applyTags(fs, field.Type, field.Tag.Get("validate"))
+		if err != nil {
+			return nil, fmt.Errorf("jsonschema: field %s: %w", field.Name, err)
+		}
+		s.Properties[name] = fs
+		if required {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s, nil
+}
+
+// applyTags translates a validate tag into constraints on s and reports whether the field is
+// required. Constraints after "dive" apply to the elements, those between "keys" and
+// "endkeys" to map keys. Or-ed alternatives ("a|b") are left to the service.
+func applyTags(s *Schema, t reflect.Type, tag string) (*Schema, bool, error) {
+	if tag == "" {
+		return s, false, nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	rules := strings.Split(tag, ",")
+	own, rest := rules, []string(nil)
+	for i, rule := range rules {
+		if rule == "dive" {
+			own, rest = rules[:i], rules[i+1:]
+			break
+		}
+	}
+
+	required, omitEmpty := false, false
+	target := s
+	if contains(own, "omitempty") {
+		omitEmpty = true
+		// Zero values skip every other rule, exactly like the validator's omitempty
+		target = &Schema{Type: s.Type}
+	}
+	for _, rule := range own {
+		name, param, _ := strings.Cut(rule, "=")
+		switch {
+		case name == "omitempty" || strings.Contains(rule, "|"):
+		case name == "required":
+			required = true
+			if t.Kind() == reflect.String && s.MinLength == nil && !hasRule(own, "min") && !hasRule(own, "len") {
+				target.MinLength = intPtr(1)
+			}
+		default:
+			if err := applyRule(target, t, name, param); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if omitEmpty && !isEmptySchema(target, s.Type) {
+		s.AnyOf = []*Schema{emptyValue(t), target}
+	}
+
+	if rest != nil {
+		if err := applyDive(s, t, rest); err != nil {
+			return nil, false, err
+		}
+	}
+	return s, required, nil
+}
+
+func applyDive(s *Schema, t reflect.Type, rules []string) error {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, _, err := applyTags(s.Items, t.Elem(), strings.Join(rules, ","))
+		s.Items = items
+		return err
+	case reflect.Map:
+		if len(rules) > 0 && rules[0] == "keys" {
+			end := indexOf(rules, "endkeys")
+			if end < 0 {
+				return fmt.Errorf("keys without endkeys")
+			}
+			keys, _, err := applyTags(&Schema{Type: "string"}, t.Key(), strings.Join(rules[1:end], ","))
+			if err != nil {
+				return err
+			}
+			s.PropertyNames = keys
+			rules = rules[end+1:]
+		}
+		values, _, err := applyTags(s.AdditionalProperties, t.Elem(), strings.Join(rules, ","))
+		s.AdditionalProperties = values
+		return err
+	default:
+		return fmt.Errorf("dive on non-collection type %s", t)
+	}
+}
+
+// applyRule translates a single validator rule; min, max and len depend on the field's kind
+func applyRule(s *Schema, t reflect.Type, name, param string) error {
+	switch name {
+	case "min", "max", "len", "gte", "lte", "gt", "lt":
+		return applyBound(s, t, name, param)
+	case "email":
+		s.Format = "email"
+	case "uuid", "uuid4":
+		s.Format = "uuid"
+	case "url", "uri":
+		s.Format = "uri"
+	case "e164":
+		s.SetPattern(`^\+[1-9][0-9]{1,14}$`)
+	case "alphanum":
+		s.SetPattern(`^[A-Za-z0-9]*$`)
+	case "oneof":
+		for _, value := range strings.Fields(param) {
+			s.Enum = append(s.Enum, value)
+		}
+	default:
+		tagsMu.RLock()
+		fn, ok := customTags[name]
+		tagsMu.RUnlock()
+		if ok {
+			fn(s, param)
+		}
+	}
+	return nil
+}
+
+func applyBound(s *Schema, t reflect.Type, name, param string) error {
+	n, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s parameter %q", name, param)
+	}
+	lower := name == "min" || name == "gte" || name == "gt" || name == "len"
+	upper := name == "max" || name == "lte" || name == "lt" || name == "len"
+	size := int(n)
+	if name == "gt" {
+		size++
+	}
+	if name == "lt" {
+		size--
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if lower {
+			s.MinLength = intPtr(size)
+		}
+		if upper {
+			s.MaxLength = intPtr(size)
+		}
+	case reflect.Slice, reflect.Array:
+		if lower {
+			s.MinItems = intPtr(size)
+		}
+		if upper {
+			s.MaxItems = intPtr(size)
+		}
+	case reflect.Map:
+		if lower {
+			s.MinProperties = intPtr(size)
+		}
+		if upper {
+			s.MaxProperties = intPtr(size)
+		}
+	default:
+		// Exclusive numeric bounds are rare in request structs; treat them as inclusive
+		if lower {
+			s.Minimum = &n
+		}
+		if upper {
+			s.Maximum = &n
+		}
+	}
+	return nil
+}
+
+// emptyValue matches the zero value of t, which omitempty exempts from other rules
+func emptyValue(t reflect.Type) *Schema {
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string", MaxLength: intPtr(0)}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", MaxItems: intPtr(0)}
+	case reflect.Map:
+		return &Schema{Type: "object", MaxProperties: intPtr(0)}
+	case reflect.Bool:
+		return &Schema{Enum: []interface{}{false}}
+	default:
+		return &Schema{Enum: []interface{}{0}}
+	}
+}
+
+// isEmptySchema reports whether s constrains nothing beyond the type
+func isEmptySchema(s *Schema, typ string) bool {
+	b, _ := json.Marshal(s)
+	want, _ := json.Marshal(&Schema{Type: typ})
+	return string(b) == string(want)
+}
+
+func hasRule(rules []string, name string) bool {
+	for _, rule := range rules {
+		if rule == name || strings.HasPrefix(rule, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	return indexOf(values, value) >= 0
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+func intPtr(n int) *int {
+	return &n
+}
@@ -0,0 +1,244 @@
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError is a single violation, located by the JSON path of the offending value
+// (e.g. "permission_ids[2]" or "attributes.department"); the root is "body"
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidateJSON parses data and validates it against s
+func (s *Schema) ValidateJSON(data []byte) []FieldError {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return []FieldError{{Field: "body", Message: "must be valid JSON"}}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return []FieldError{{Field: "body", Message: "must contain a single JSON value"}}
+	}
+	return s.Validate(value)
+}
+
+// Validate checks a value decoded with json.Decoder.UseNumber against s and returns every
+// violation found, at most one per field
+func (s *Schema) Validate(value interface{}) []FieldError {
+	var errs []FieldError
+	s.validate("", value, &errs)
+	return errs
+}
+
+func (s *Schema) validate(path string, value interface{}, errs *[]FieldError) {
+	fail := func(format string, args ...interface{}) {
+		field := path
+		if field == "" {
+			field = "body"
+		}
+		*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(s.AnyOf) > 0 {
+		var last []FieldError
+		for _, alternative := range s.AnyOf {
+			last = nil
+			alternative.validate(path, value, &last)
+			if len(last) == 0 {
+				break
+			}
+		}
+		if len(last) > 0 {
+			*errs = append(*errs, last...)
+			return
+		}
+	}
+
+	if len(s.Enum) > 0 && !inEnum(s.Enum, value) {
+		values := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			values[i] = fmt.Sprint(v)
+		}
+		fail("must be one of: %s", strings.Join(values, ", "))
+		return
+	}
+
+	switch s.Type {
+	case "":
+		return
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		s.validateString(str, fail)
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		f, err := n.Float64()
+		if !ok || err != nil || (s.Type == "integer" && !isInteger(n)) {
+			if s.Type == "integer" {
+				fail("must be an integer")
+			} else {
+				fail("must be a number")
+			}
+			return
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			fail("must be at least %v", *s.Minimum)
+		} else if s.Maximum != nil && f > *s.Maximum {
+			fail("must be at most %v", *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be a boolean")
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			fail("must contain at least %d item(s)", *s.MinItems)
+			return
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			fail("must contain at most %d item(s)", *s.MaxItems)
+			return
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		s.validateObject(path, object, fail, errs)
+	}
+}
+
+func (s *Schema) validateString(str string, fail func(string, ...interface{})) {
+	length := utf8.RuneCountInString(str)
+	switch {
+	case s.MinLength != nil && length < *s.MinLength:
+		if *s.MinLength == 1 {
+			fail("is required")
+		} else {
+			fail("must be at least %d characters long", *s.MinLength)
+		}
+	case s.MaxLength != nil && length > *s.MaxLength:
+		fail("must be at most %d characters long", *s.MaxLength)
+	case s.pattern != nil && !s.pattern.MatchString(str):
+		fail("has an invalid format")
+	case s.Format != "" && !validFormat(s.Format, str):
+		fail("must be a valid %s", formatNames[s.Format])
+	}
+}
+
+func (s *Schema) validateObject(path string, object map[string]interface{}, fail func(string, ...interface{}), errs *[]FieldError) {
+	if s.MinProperties != nil && len(object) < *s.MinProperties {
+		fail("must contain at least %d item(s)", *s.MinProperties)
+		return
+	}
+	if s.MaxProperties != nil && len(object) > *s.MaxProperties {
+		fail("must contain at most %d item(s)", *s.MaxProperties)
+		return
+	}
+
+	// null is treated as absent, as encoding/json leaves the field at its zero value
+	for _, name := range s.Required {
+		if v, ok := object[name]; !ok || v == nil {
+			*errs = append(*errs, FieldError{Field: join(path, name), Message: "is required"})
+		}
+	}
+	for name, value := range object {
+		if value == nil {
+			continue
+		}
+		if s.PropertyNames != nil {
+			var keyErrs []FieldError
+			s.PropertyNames.validate(join(path, name), name, &keyErrs)
+			for _, e := range keyErrs {
+				*errs = append(*errs, FieldError{Field: e.Field, Message: "key " + e.Message})
+			}
+		}
+		if prop, ok := s.Properties[name]; ok {
+			prop.validate(join(path, name), value, errs)
+		} else if s.AdditionalProperties != nil {
+			s.AdditionalProperties.validate(join(path, name), value, errs)
+		}
+	}
+}
+
+var formatNames = map[string]string{
+	"email":     "email address",
+	"uuid":      "UUID",
+	"uri":       "URL",
+	"date-time": "RFC 3339 timestamp",
+}
+
+func validFormat(format, value string) bool {
+	switch format {
+	case "email":
+		addr, err := mail.ParseAddress(value)
+		return err == nil && addr.Address == value
+	case "uuid":
+		return uuidPattern.MatchString(value)
+	case "uri":
+		u, err := url.ParseRequestURI(value)
+		return err == nil && u.Scheme != ""
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, value)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, candidate := range enum {
+		switch v := value.(type) {
+		case json.Number:
+			if f, err := v.Float64(); err == nil && fmt.Sprint(candidate) == strconv.FormatFloat(f, 'f', -1, 64) {
+				return true
+			}
+		default:
+			if candidate == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInteger(n json.Number) bool {
+	_, err := n.Int64()
+	return err == nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
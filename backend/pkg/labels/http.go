@@ -0,0 +1,56 @@
+package labels
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+)
+
+// Labels is the body of label requests and responses
+type Labels struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// GetHandler handles GET on the labels of an entity of kind
+func GetHandler(service *Service, kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		labels, err := service.Get(r.Context(), kind, mux.Vars(r)["id"])
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get labels")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Labels{Labels: labels})
+	}
+}
+
+// PutHandler handles PUT on the labels of an entity of kind, replacing them
+func PutHandler(service *Service, kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Labels
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+		labels, err := service.Set(r.Context(), kind, mux.Vars(r)["id"], req.Labels)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to set labels")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Labels{Labels: labels})
+	}
+}
+
+// Mount registers the label endpoints of every registered kind, each wrapped by protect with the
+// kind's permission
+func Mount(r *mux.Router, service *Service, protect func(perm.Name, http.HandlerFunc) http.HandlerFunc) {
+	for _, kind := range service.Kinds() {
+		r.HandleFunc(kind.Path, protect(kind.Read, GetHandler(service, kind.Name))).Methods("GET")
+		r.HandleFunc(kind.Path, protect(kind.Update, PutHandler(service, kind.Name))).Methods("PUT")
+	}
+}
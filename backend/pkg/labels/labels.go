@@ -0,0 +1,210 @@
+// Package labels attaches key/value labels to users, roles and groups, so large installations
+// can slice them by team, project or environment, and filters lists with ?label=key:value
+package labels
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/perm"
+)
+
+// Kinds of labelled entities
+const (
+	KindUser  = "user"
+	KindRole  = "role"
+	KindGroup = "group"
+)
+
+const (
+	// MaxLabels bounds the labels of one entity
+	MaxLabels = 50
+	// MaxValueLength bounds the length of a label value
+	MaxValueLength = 63
+	// QueryParam is the query parameter list endpoints filter by; it may be repeated
+	QueryParam = "label"
+)
+
+// keyPattern is what label keys look like: lowercase, starting with a letter or digit, at most
+// 63 characters. Colons are reserved as the separator of selectors.
+var keyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._/-]{0,62}$`)
+
+// Selector matches entities labelled Key=Value, or with any value of Key when Value is empty
+type Selector struct {
+	Key   string
+	Value string
+}
+
+func (s Selector) String() string {
+	if s.Value == "" {
+		return s.Key
+	}
+	return s.Key + ":" + s.Value
+}
+
+// Kind describes a labelled entity type and where its labels are served
+type Kind struct {
+	Name string
+	// Path is the route of an entity's labels, with the entity ID as {id}
+	Path string
+	// Read and Update are the permissions to see and change labels
+	Read, Update perm.Name
+	// Exists reports whether the entity with id exists, so labels are not set on unknown IDs
+	Exists func(ctx context.Context, id string) (bool, error)
+}
+
+// Service keeps the labels of the registered kinds
+type Service struct {
+	store Store
+	kinds map[string]Kind
+	order []string
+}
+
+// NewService creates a label service on store
+func NewService(store Store) *Service {
+	return &Service{store: store, kinds: make(map[string]Kind)}
+}
+
+// Register adds a kind of labelled entity. Register kinds before serving requests.
+func (s *Service) Register(kind Kind) {
+	if _, ok := s.kinds[kind.Name]; !ok {
+		s.order = append(s.order, kind.Name)
+	}
+	s.kinds[kind.Name] = kind
+}
+
+// Kinds returns the registered kinds in registration order
+func (s *Service) Kinds() []Kind {
+	kinds := make([]Kind, len(s.order))
+	for i, name := range s.order {
+		kinds[i] = s.kinds[name]
+	}
+	return kinds
+}
+
+// exists checks that id names an entity of kind
+func (s *Service) exists(ctx context.Context, kind, id string) error {
+	k, ok := s.kinds[kind]
+	if !ok {
+		return apperrors.Invalid("UNKNOWN_LABEL_KIND", fmt.Sprintf("%s entities cannot be labelled", kind))
+	}
+	if k.Exists == nil {
+		return nil
+	}
+	found, err := k.Exists(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return apperrors.NotFound(strings.ToUpper(kind)+"_NOT_FOUND", kind+" not found")
+	}
+	return nil
+}
+
+// Get returns the labels of the entity of kind with id
+func (s *Service) Get(ctx context.Context, kind, id string) (map[string]string, error) {
+	if err := s.exists(ctx, kind, id); err != nil {
+		return nil, err
+	}
+	return s.store.Get(kind, id)
+}
+
+// Set replaces the labels of the entity of kind with id
+func (s *Service) Set(ctx context.Context, kind, id string, labels map[string]string) (map[string]string, error) {
+	if err := Validate(labels); err != nil {
+		return nil, err
+	}
+	if err := s.exists(ctx, kind, id); err != nil {
+		return nil, err
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	if err := s.store.Replace(kind, id, labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// Forget deletes the labels of a deleted entity
+func (s *Service) Forget(kind, id string) error {
+	return s.store.Delete(kind, id)
+}
+
+// Matching returns the IDs of the entities of kind that match every selector
+func (s *Service) Matching(kind string, selectors []Selector) (map[string]bool, error) {
+	ids, err := s.store.Match(kind, selectors)
+	if err != nil {
+		return nil, err
+	}
+	matching := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		matching[id] = true
+	}
+	return matching, nil
+}
+
+// Validate checks the keys and values of a label set
+func Validate(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return apperrors.Invalid("TOO_MANY_LABELS", fmt.Sprintf("At most %d labels are allowed", MaxLabels))
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := validateLabel(key, labels[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLabel(key, value string) error {
+	if !keyPattern.MatchString(key) {
+		return apperrors.Invalid("INVALID_LABEL", fmt.Sprintf("Label key %q must be lowercase letters, digits, '.', '_', '-' or '/', up to 63 characters", key))
+	}
+	if value == "" || utf8.RuneCountInString(value) > MaxValueLength || strings.ContainsAny(value, "\x00\r\n") {
+		return apperrors.Invalid("INVALID_LABEL", fmt.Sprintf("Value of label %q must be 1 to %d characters on one line", key, MaxValueLength))
+	}
+	return nil
+}
+
+// ParseSelectors reads the label query parameters of r: "team:payments" matches that value and
+// "team" any value of the key. Repeated parameters must all match.
+func ParseSelectors(r *http.Request) ([]Selector, error) {
+	return SelectorsFromQuery(r.URL.Query())
+}
+
+// SelectorsFromQuery reads the label parameters of a query string like ParseSelectors
+func SelectorsFromQuery(query url.Values) ([]Selector, error) {
+	var selectors []Selector
+	for _, raw := range query[QueryParam] {
+		key, value, _ := strings.Cut(raw, ":")
+		if !keyPattern.MatchString(key) || utf8.RuneCountInString(value) > MaxValueLength {
+			return nil, apperrors.Invalid("INVALID_LABEL_SELECTOR", fmt.Sprintf("Invalid label selector %q, expected key or key:value", raw))
+		}
+		selectors = append(selectors, Selector{Key: key, Value: value})
+	}
+	return selectors, nil
+}
+
+// Filter keeps the items whose ID is in matching, in their order
+func Filter[T any](items []T, id func(T) string, matching map[string]bool) []T {
+	kept := items[:0:0]
+	for _, item := range items {
+		if matching[id(item)] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,163 @@
+package labels
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/perm"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps labels in memory
+type memoryStore struct {
+	labels map[string]map[string]string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{labels: make(map[string]map[string]string)}
+}
+
+func (s *memoryStore) Get(kind, id string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for key, value := range s.labels[kind+"/"+id] {
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+func (s *memoryStore) Replace(kind, id string, labels map[string]string) error {
+	s.labels[kind+"/"+id] = labels
+	return nil
+}
+
+func (s *memoryStore) Delete(kind, id string) error {
+	delete(s.labels, kind+"/"+id)
+	return nil
+}
+
+func (s *memoryStore) Match(kind string, selectors []Selector) ([]string, error) {
+	var ids []string
+	for entity, labels := range s.labels {
+		id, ok := strings.CutPrefix(entity, kind+"/")
+		if !ok {
+			continue
+		}
+		matches := true
+		for _, selector := range selectors {
+			value, has := labels[selector.Key]
+			if !has || (selector.Value != "" && value != selector.Value) {
+				matches = false
+			}
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func newTestService() *Service {
+	service := NewService(newMemoryStore())
+	service.Register(Kind{Name: KindRole, Path: "/api/rbac/roles/{id}/labels", Read: perm.ReadRole, Update: perm.UpdateRole,
+		Exists: func(_ context.Context, id string) (bool, error) { return id != "missing", nil }})
+	return service
+}
+
+func TestLabelEndpoints(t *testing.T) {
+	service := newTestService()
+	var checked []perm.Name
+	r := mux.NewRouter()
+	Mount(r, service, func(permission perm.Name, handler http.HandlerFunc) http.HandlerFunc {
+		checked = append(checked, permission)
+		return handler
+	})
+	assert.Equal(t, []perm.Name{perm.ReadRole, perm.UpdateRole}, checked)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	w := send(http.MethodPut, "/api/rbac/roles/r1/labels", `{"labels":{"team":"payments","env":"prod"}}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	w = send(http.MethodGet, "/api/rbac/roles/r1/labels", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var got Labels
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, map[string]string{"team": "payments", "env": "prod"}, got.Labels)
+
+	w = send(http.MethodPut, "/api/rbac/roles/r1/labels", `{"labels":{"Team":"payments"}}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "INVALID_LABEL")
+
+	w = send(http.MethodPut, "/api/rbac/roles/missing/labels", `{"labels":{"team":"payments"}}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "ROLE_NOT_FOUND")
+}
+
+func TestMatchingAndFilter(t *testing.T) {
+	service := newTestService()
+	ctx := context.Background()
+	_, err := service.Set(ctx, KindRole, "r1", map[string]string{"team": "payments", "env": "prod"})
+	require.NoError(t, err)
+	_, err = service.Set(ctx, KindRole, "r2", map[string]string{"team": "payments", "env": "staging"})
+	require.NoError(t, err)
+	_, err = service.Set(ctx, KindRole, "r3", map[string]string{"team": "search"})
+	require.NoError(t, err)
+
+	ids := []string{"r1", "r2", "r3", "r4"}
+	match := func(selectors ...Selector) []string {
+		matching, err := service.Matching(KindRole, selectors)
+		require.NoError(t, err)
+		return Filter(ids, func(id string) string { return id }, matching)
+	}
+	assert.Equal(t, []string{"r1", "r2"}, match(Selector{Key: "team", Value: "payments"}))
+	assert.Equal(t, []string{"r1"}, match(Selector{Key: "team", Value: "payments"}, Selector{Key: "env", Value: "prod"}))
+	assert.Equal(t, []string{"r1", "r2"}, match(Selector{Key: "env"}))
+
+	require.NoError(t, service.Forget(KindRole, "r1"))
+	assert.Equal(t, []string{"r2"}, match(Selector{Key: "env"}))
+}
+
+func TestParseSelectors(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/rbac/roles?label=team:payments&label=env", nil)
+	selectors, err := ParseSelectors(r)
+	require.NoError(t, err)
+	assert.Equal(t, []Selector{{Key: "team", Value: "payments"}, {Key: "env"}}, selectors)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/rbac/roles?label=:payments", nil)
+	_, err = ParseSelectors(r)
+	require.Error(t, err)
+	assert.Equal(t, apperrors.KindInvalid, apperrors.KindOf(err))
+}
+
+func TestStoreMatchQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT entity_id FROM entity_labels WHERE kind = $1 AND ((key = $2) OR (key = $3 AND value = $4))`)).
+		WithArgs(KindGroup, "env", "team", "payments", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"entity_id"}).AddRow("g1"))
+
+	ids, err := NewStore(db).Match(KindGroup, []Selector{{Key: "team", Value: "payments"}, {Key: "env"}, {Key: "team"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"g1"}, ids)
+
+	ids, err = NewStore(db).Match(KindGroup, []Selector{{Key: "team", Value: "payments"}, {Key: "team", Value: "search"}})
+	require.NoError(t, err)
+	assert.Empty(t, ids, "two values of one key match nothing")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
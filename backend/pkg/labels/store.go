@@ -0,0 +1,118 @@
+package labels
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"base-app/pkg/database"
+)
+
+// Store keeps labels. The Postgres store expects this table:
+//
+//	CREATE TABLE entity_labels (
+//		kind VARCHAR(20) NOT NULL,
+//		entity_id VARCHAR(255) NOT NULL,
+//		key VARCHAR(63) NOT NULL,
+//		value VARCHAR(63) NOT NULL,
+//		PRIMARY KEY (kind, entity_id, key)
+//	)
+type Store interface {
+	// Get returns the labels of an entity
+	Get(kind, id string) (map[string]string, error)
+	// Replace replaces the labels of an entity
+	Replace(kind, id string, labels map[string]string) error
+	// Delete deletes the labels of an entity
+	Delete(kind, id string) error
+	// Match returns the IDs of the entities of kind matching every selector
+	Match(kind string, selectors []Selector) ([]string, error)
+}
+
+// store implements Store on Postgres
+type store struct {
+	db database.DBTX
+}
+
+// NewStore creates a Postgres label store
+func NewStore(db *sql.DB) Store {
+	return &store{db: db}
+}
+
+func (s *store) Get(kind, id string) (map[string]string, error) {
+	labels := make(map[string]string)
+	err := database.QueryEach(s.db, "get labels", func(row database.Scanner) error {
+		var key, value string
+		if err := row.Scan(&key, &value); err != nil {
+			return err
+		}
+		labels[key] = value
+		return nil
+	}, `SELECT key, value FROM entity_labels WHERE kind = $1 AND entity_id = $2`, kind, id)
+	if err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (s *store) Replace(kind, id string, labels map[string]string) error {
+	return database.RunInTx(s.db, func(tx database.DBTX) error {
+		if _, err := tx.Exec(`DELETE FROM entity_labels WHERE kind = $1 AND entity_id = $2`, kind, id); err != nil {
+			return err
+		}
+		for key, value := range labels {
+			if _, err := tx.Exec(`INSERT INTO entity_labels (kind, entity_id, key, value) VALUES ($1, $2, $3, $4)`, kind, id, key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *store) Delete(kind, id string) error {
+	_, err := s.db.Exec(`DELETE FROM entity_labels WHERE kind = $1 AND entity_id = $2`, kind, id)
+	return err
+}
+
+// Match counts, per entity, the selectors its labels satisfy. Keys are unique per entity, so
+// selectors are reduced to one per key first; two values for one key match nothing.
+func (s *store) Match(kind string, selectors []Selector) ([]string, error) {
+	values := make(map[string]string)
+	for _, selector := range selectors {
+		prev, seen := values[selector.Key]
+		if seen && prev != "" && selector.Value != "" && prev != selector.Value {
+			return nil, nil
+		}
+		if !seen || selector.Value != "" {
+			values[selector.Key] = selector.Value
+		}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []interface{}{kind}
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		args = append(args, key)
+		condition := fmt.Sprintf("key = $%d", len(args))
+		if values[key] != "" {
+			args = append(args, values[key])
+			condition += fmt.Sprintf(" AND value = $%d", len(args))
+		}
+		conditions[i] = "(" + condition + ")"
+	}
+	args = append(args, len(keys))
+	query := fmt.Sprintf(`SELECT entity_id FROM entity_labels WHERE kind = $1 AND (%s)
+	          GROUP BY entity_id HAVING COUNT(*) = $%d`, strings.Join(conditions, " OR "), len(args))
+	return database.QueryAll(s.db, "match labels", func(row database.Scanner) (string, error) {
+		var id string
+		err := row.Scan(&id)
+		return id, err
+	}, query, args...)
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"base-app/pkg/httpapi"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader carries the request ID in requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDPattern limits accepted incoming request IDs to a safe charset and length
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+type requestFieldsKey struct{}
+
+// requestFields holds per-request log fields. It is stored by pointer so that handlers deeper
+// in the chain (e.g. authentication) can fill in the user ID after the middleware ran.
+type requestFields struct {
+	mu        sync.RWMutex
+	requestID string
+	userID    string
+	clientIP  string
+}
+
+// RequestID returns the request ID for ctx, or "" outside a request
+func RequestID(ctx context.Context) string {
+	if fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields); ok {
+		fields.mu.RLock()
+		defer fields.mu.RUnlock()
+		return fields.requestID
+	}
+	return ""
+}
+
+// UserID returns the authenticated user recorded for ctx, or "" if none
+func UserID(ctx context.Context) string {
+	if fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields); ok {
+		fields.mu.RLock()
+		defer fields.mu.RUnlock()
+		return fields.userID
+	}
+	return ""
+}
+
+// ClientIP returns the IP address of the client whose request ctx belongs to, or "" outside a
+// request
+func ClientIP(ctx context.Context) string {
+	if fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields); ok {
+		fields.mu.RLock()
+		defer fields.mu.RUnlock()
+		return fields.clientIP
+	}
+	return ""
+}
+
+// SetUserID records the authenticated user for the request's log entries
+func SetUserID(ctx context.Context, userID string) {
+	if fields, ok := ctx.Value(requestFieldsKey{}).(*requestFields); ok {
+		fields.mu.Lock()
+		fields.userID = userID
+		fields.mu.Unlock()
+	}
+}
+
+// WithRequestID returns a context carrying requestID, for work started outside HTTP handlers
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestFieldsKey{}, &requestFields{requestID: requestID})
+}
+
+// contextHook adds request_id and user_id to entries logged with WithContext
+type contextHook struct{}
+
+func (contextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (contextHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	fields, ok := entry.Context.Value(requestFieldsKey{}).(*requestFields)
+	if !ok {
+		return nil
+	}
+	fields.mu.RLock()
+	defer fields.mu.RUnlock()
+	if fields.requestID != "" {
+		entry.Data["request_id"] = fields.requestID
+	}
+	if fields.userID != "" {
+		entry.Data["user_id"] = fields.userID
+	}
+	return nil
+}
+
+// statusRecorder captures the response status for the access log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// RequestMiddleware assigns every request an ID (reusing a well-formed incoming X-Request-ID),
+// echoes it in the response and writes one access log entry per request
+func RequestMiddleware(logger *logrus.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get(RequestIDHeader)
+			if !requestIDPattern.MatchString(requestID) {
+				requestID = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, requestID)
+
+			ctx := context.WithValue(r.Context(), requestFieldsKey{}, &requestFields{requestID: requestID, clientIP: httpapi.ClientIP(r)})
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			start := time.Now()
+
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			entry := logger.WithContext(ctx).WithFields(logrus.Fields{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"status":      recorder.status,
+				"duration_ms": time.Since(start).Milliseconds(),
+			})
+			switch {
+			case recorder.status >= 500:
+				entry.Warn("HTTP request failed: " + strconv.Itoa(recorder.status))
+			default:
+				entry.Info("HTTP request")
+			}
+		})
+	}
+}
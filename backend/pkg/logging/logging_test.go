@@ -0,0 +1,178 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"base-app/pkg/config"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLoggers(t *testing.T, cfg config.LoggingConfig) (*Loggers, *bytes.Buffer) {
+	loggers, err := New(cfg)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	loggers.Root().SetOutput(&buf)
+	return loggers, &buf
+}
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestModuleLoggerLevelAndField(t *testing.T) {
+	loggers, buf := newTestLoggers(t, config.LoggingConfig{
+		Level:        "info",
+		Format:       "json",
+		ModuleLevels: map[string]string{"rbac": "debug"},
+	})
+
+	loggers.For("rbac").Debug("rbac detail")
+	loggers.For("settings").Debug("settings detail")
+
+	entries := decodeLines(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "rbac detail", entries[0]["msg"])
+	assert.Equal(t, "rbac", entries[0]["module"])
+}
+
+func TestSetLevelsUpdatesExistingLoggers(t *testing.T) {
+	loggers, buf := newTestLoggers(t, config.LoggingConfig{Level: "info", Format: "json"})
+	rbacLogger := loggers.For("rbac")
+	settingsLogger := loggers.For("settings")
+
+	require.NoError(t, loggers.SetLevels("warn", map[string]string{"rbac": "debug"}))
+	rbacLogger.Debug("rbac detail")
+	settingsLogger.Info("settings info")
+	loggers.Root().Info("root info")
+
+	entries := decodeLines(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "rbac detail", entries[0]["msg"])
+
+	assert.Error(t, loggers.SetLevels("info", map[string]string{"rbac": "loud"}))
+	assert.Equal(t, logrus.WarnLevel, loggers.Root().GetLevel(), "invalid levels change nothing")
+}
+
+func TestNewRejectsInvalidLevel(t *testing.T) {
+	_, err := New(config.LoggingConfig{Level: "loud", Format: "json"})
+	assert.Error(t, err)
+
+	_, err = New(config.LoggingConfig{Level: "info", Format: "xml"})
+	assert.Error(t, err)
+}
+
+func TestThrottlingFormatter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	formatter := NewThrottlingFormatter(&logrus.JSONFormatter{}, time.Minute, 2)
+	formatter.now = func() time.Time { return now }
+
+	logger := logrus.New()
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	logger.SetFormatter(formatter)
+
+	for i := 0; i < 5; i++ {
+		logger.Warn("Replica unhealthy")
+	}
+	logger.Info("not throttled")
+	logger.Info("not throttled")
+	assert.Len(t, decodeLines(t, &buf), 4)
+
+	buf.Reset()
+	now = now.Add(time.Minute)
+	logger.Warn("Replica unhealthy")
+	entries := decodeLines(t, &buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, float64(3), entries[0]["suppressed"])
+}
+
+func TestThrottlingFormatterForgetsPassedWindows(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	formatter := NewThrottlingFormatter(&logrus.JSONFormatter{}, time.Minute, 1)
+	formatter.now = func() time.Time { return now }
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	logger.SetFormatter(formatter)
+
+	// Messages that never repeat do not accumulate beyond the two windows between sweeps
+	for i := 0; i < 600; i++ {
+		logger.Warnf("Failed to load user %d", i)
+		now = now.Add(time.Second)
+	}
+	assert.LessOrEqual(t, len(formatter.buckets), 120)
+
+	// A suppressed message that never comes back is dropped after one more window
+	logger.Warn("Replica unhealthy")
+	logger.Warn("Replica unhealthy")
+	now = now.Add(2 * time.Minute)
+	logger.Warn("something else")
+	assert.Len(t, formatter.buckets, 1)
+}
+
+func TestRequestMiddlewareAddsRequestAndUserID(t *testing.T) {
+	loggers, buf := newTestLoggers(t, config.LoggingConfig{Level: "info", Format: "json"})
+	logger := loggers.For("http")
+
+	handler := RequestMiddleware(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUserID(r.Context(), "user-42")
+		logger.WithContext(r.Context()).Info("handled")
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/rbac/roles", nil)
+	req.Header.Set(RequestIDHeader, "req-abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	assert.Equal(t, "req-abc", w.Header().Get(RequestIDHeader))
+	entries := decodeLines(t, buf)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "req-abc", entry["request_id"])
+		assert.Equal(t, "user-42", entry["user_id"])
+	}
+	assert.Equal(t, float64(http.StatusCreated), entries[1]["status"])
+
+	// Malformed incoming IDs are replaced
+	req = httptest.NewRequest(http.MethodGet, "/health", nil)
+	req.Header.Set(RequestIDHeader, "bad id\nwith newline")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad id\nwith newline", w.Header().Get(RequestIDHeader))
+	assert.NotEmpty(t, w.Header().Get(RequestIDHeader))
+}
+
+func TestEntriesAreRedacted(t *testing.T) {
+	loggers, buf := newTestLoggers(t, config.LoggingConfig{Level: "info", Format: "json"})
+
+	loggers.For("user_management").
+		WithError(errors.New(`login failed: client_secret=abc123 rejected`)).
+		WithField("dsn", "host=db password=hunter2").
+		Error("Failed to login to Keycloak with Bearer eyJ.x")
+
+	entries := decodeLines(t, buf)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "login failed: client_secret=[REDACTED] rejected", entries[0]["error"])
+	assert.Equal(t, "host=db password=[REDACTED]", entries[0]["dsn"])
+	assert.Equal(t, "Failed to login to Keycloak with Bearer [REDACTED]", entries[0]["msg"])
+}
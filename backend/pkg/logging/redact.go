@@ -0,0 +1,28 @@
+package logging
+
+import (
+	"base-app/pkg/redact"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactHook masks credentials in every entry's message, error and string fields. Errors from
+// Keycloak and the database driver can echo tokens, DSNs or form bodies, so nothing is logged raw.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact.String(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case error:
+			entry.Data[key] = redact.Error(v)
+		case string:
+			entry.Data[key] = redact.String(v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package logging
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// throttleBucket counts occurrences of one message within the current window
+type throttleBucket struct {
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+// ThrottlingFormatter drops repeats of the same warning or error message beyond burst per
+// window. The first entry let through in a new window carries a "suppressed" field counting
+// what was dropped in the previous one, so nothing disappears without a trace.
+type ThrottlingFormatter struct {
+	next   logrus.Formatter
+	window time.Duration
+	burst  int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*throttleBucket
+	// pruned is when idle buckets were last dropped
+	pruned time.Time
+}
+
+// NewThrottlingFormatter wraps next, allowing at most burst identical warnings per window
+func NewThrottlingFormatter(next logrus.Formatter, window time.Duration, burst int) *ThrottlingFormatter {
+	return &ThrottlingFormatter{
+		next:    next,
+		window:  window,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*throttleBucket),
+	}
+}
+
+// Format implements logrus.Formatter. A nil result means the entry was suppressed.
+func (f *ThrottlingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level != logrus.WarnLevel && entry.Level != logrus.ErrorLevel {
+		return f.next.Format(entry)
+	}
+
+	suppressed, allow := f.admit(entry.Level.String() + "|" + entry.Message)
+	if !allow {
+		return nil, nil
+	}
+	if suppressed > 0 {
+		clone := *entry
+		clone.Data = make(logrus.Fields, len(entry.Data)+1)
+		for k, v := range entry.Data {
+			clone.Data[k] = v
+		}
+		clone.Data["suppressed"] = suppressed
+		entry = &clone
+	}
+	return f.next.Format(entry)
+}
+
+// admit records an occurrence of key and reports whether it may be logged, plus how many
+// occurrences were dropped in the previous window
+func (f *ThrottlingFormatter) admit(key string) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	if now.Sub(f.pruned) >= f.window {
+		f.prune(now)
+	}
+	bucket, ok := f.buckets[key]
+	if !ok {
+		bucket = &throttleBucket{windowStart: now}
+		f.buckets[key] = bucket
+	}
+
+	reported := 0
+	if now.Sub(bucket.windowStart) >= f.window {
+		reported = bucket.suppressed
+		bucket.windowStart = now
+		bucket.count = 0
+		bucket.suppressed = 0
+	}
+
+	bucket.count++
+	if bucket.count > f.burst {
+		bucket.suppressed++
+		return 0, false
+	}
+	return reported, true
+}
+
+// prune forgets messages whose window has passed, at most once per window, so the map cannot
+// grow without bound even when no message repeats. A message that stops recurring after being
+// suppressed keeps its count for one more window in case it comes back to report it.
+func (f *ThrottlingFormatter) prune(now time.Time) {
+	f.pruned = now
+	for key, bucket := range f.buckets {
+		idle := now.Sub(bucket.windowStart)
+		if idle >= 2*f.window || (idle >= f.window && bucket.suppressed == 0) {
+			delete(f.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package migrations
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"base-app/pkg/schemacheck"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPairsAndOrdersMigrations(t *testing.T) {
+	migrations, err := load(fstest.MapFS{
+		"sql/0002_notes.up.sql":      {Data: []byte("CREATE TABLE notes ();")},
+		"sql/0002_notes.down.sql":    {Data: []byte("DROP TABLE notes;")},
+		"sql/0001_baseline.up.sql":   {Data: []byte("CREATE TABLE users ();")},
+		"sql/0001_baseline.down.sql": {Data: []byte("DROP TABLE users;")},
+	}, "sql")
+	require.NoError(t, err)
+	require.Len(t, migrations, 2)
+	assert.Equal(t, Migration{Version: 1, Name: "baseline", Up: "CREATE TABLE users ();", Down: "DROP TABLE users;"}, migrations[0])
+	assert.Equal(t, 2, migrations[1].Version)
+
+	_, err = load(fstest.MapFS{"sql/0001_baseline.up.sql": {Data: []byte("SELECT 1;")}}, "sql")
+	assert.ErrorContains(t, err, "needs both an up and a down file")
+	_, err = load(fstest.MapFS{"sql/baseline.up.sql": {Data: []byte("SELECT 1;")}}, "sql")
+	assert.ErrorContains(t, err, "positive version")
+}
+
+func TestMigrationsCreateTheExpectedSchema(t *testing.T) {
+	migrations, err := All()
+	require.NoError(t, err)
+	var up string
+	for _, m := range migrations {
+		up += m.Up
+	}
+	for _, table := range schemacheck.Expected {
+		if table.Name == "schema_migrations" {
+			continue
+		}
+		assert.Regexp(t, `CREATE TABLE IF NOT EXISTS `+table.Name+` \(`, up, "no migration creates %s", table.Name)
+	}
+}
+
+func TestUpAppliesPendingMigrationsOnly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	runner := &Runner{db: db, logger: logger, migrations: []Migration{
+		{Version: 1, Name: "baseline", Up: "CREATE TABLE users ();", Down: "DROP TABLE users;"},
+		{Version: 2, Name: "notes", Up: "CREATE TABLE notes ();", Down: "DROP TABLE notes;"},
+	}}
+
+	mock.ExpectExec(`SELECT pg_advisory_lock`).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE notes ();")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(2, "notes", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock`).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := runner.Up(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []int{2}, applied)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
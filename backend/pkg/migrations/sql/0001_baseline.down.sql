@@ -0,0 +1,35 @@
+-- Drops everything the baseline creates, and so all application data
+DROP TABLE IF EXISTS tenant_usage;
+DROP TABLE IF EXISTS tenant_invitations;
+DROP TABLE IF EXISTS tenants;
+DROP TABLE IF EXISTS operations;
+DROP TABLE IF EXISTS dead_letters;
+DROP TABLE IF EXISTS api_usage;
+DROP TABLE IF EXISTS security_anomalies;
+DROP TABLE IF EXISTS settings;
+DROP TABLE IF EXISTS user_notes;
+DROP TABLE IF EXISTS saved_views;
+DROP TABLE IF EXISTS magic_link_codes;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS email_templates;
+DROP TABLE IF EXISTS trash_items;
+DROP TABLE IF EXISTS entity_labels;
+DROP TABLE IF EXISTS rbac_digest_subscriptions;
+DROP TABLE IF EXISTS user_devices;
+DROP TABLE IF EXISTS role_usage;
+DROP TABLE IF EXISTS permission_usage;
+DROP TABLE IF EXISTS token_denylist;
+DROP TABLE IF EXISTS personal_access_tokens;
+DROP TABLE IF EXISTS domain_group_rules;
+DROP TABLE IF EXISTS group_template_roles;
+DROP TABLE IF EXISTS group_templates;
+DROP TABLE IF EXISTS group_membership_history;
+DROP TABLE IF EXISTS user_group_memberships;
+DROP TABLE IF EXISTS group_roles;
+DROP TABLE IF EXISTS role_groups;
+DROP TABLE IF EXISTS permission_deprecations;
+DROP TABLE IF EXISTS role_scopes;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS users;
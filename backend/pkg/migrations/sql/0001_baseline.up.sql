@@ -0,0 +1,370 @@
+-- The schema the application created before migrations were introduced. Every statement is
+-- idempotent, so databases created back then take this migration as already applied.
+
+CREATE TABLE IF NOT EXISTS users (
+	id UUID PRIMARY KEY,
+	keycloak_id VARCHAR UNIQUE,
+	username VARCHAR UNIQUE,
+	email VARCHAR UNIQUE,
+	first_name VARCHAR,
+	last_name VARCHAR,
+	is_active BOOLEAN,
+	created_at TIMESTAMP,
+	updated_at TIMESTAMP
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT, ADD COLUMN IF NOT EXISTS attributes TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS realm VARCHAR(255) NOT NULL DEFAULT '';
+-- Argon2id hashes of users who log in locally, without Keycloak
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_hash TEXT;
+
+-- Create RBAC tables
+CREATE TABLE IF NOT EXISTS roles (
+	id UUID PRIMARY KEY,
+	name VARCHAR UNIQUE NOT NULL,
+	description TEXT,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permissions (
+	id UUID PRIMARY KEY,
+	name VARCHAR UNIQUE NOT NULL,
+	resource VARCHAR NOT NULL,
+	action VARCHAR NOT NULL
+);
+-- Catalog metadata shown when browsing permissions
+ALTER TABLE permissions ADD COLUMN IF NOT EXISTS category VARCHAR NOT NULL DEFAULT 'General',
+	ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS risk_level VARCHAR NOT NULL DEFAULT 'low';
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+	permission_id UUID REFERENCES permissions(id) ON DELETE CASCADE,
+	PRIMARY KEY (role_id, permission_id)
+);
+
+-- Grants made before granted_at existed have none and are left out of change digests
+ALTER TABLE role_permissions ADD COLUMN IF NOT EXISTS granted_at TIMESTAMP;
+ALTER TABLE role_permissions ALTER COLUMN granted_at SET DEFAULT (NOW() AT TIME ZONE 'UTC');
+
+-- Roles scoped to a resource only grant their permissions on it
+CREATE TABLE IF NOT EXISTS role_scopes (
+	role_id UUID PRIMARY KEY REFERENCES roles(id) ON DELETE CASCADE,
+	resource VARCHAR NOT NULL,
+	updated_by VARCHAR NOT NULL DEFAULT '',
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS permission_deprecations (
+	permission_id UUID PRIMARY KEY REFERENCES permissions(id) ON DELETE CASCADE,
+	replaced_by UUID REFERENCES permissions(id) ON DELETE SET NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	deprecated_by VARCHAR NOT NULL DEFAULT '',
+	deprecated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS role_groups (
+	id UUID PRIMARY KEY,
+	name VARCHAR UNIQUE NOT NULL,
+	description TEXT,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS group_roles (
+	group_id UUID REFERENCES role_groups(id) ON DELETE CASCADE,
+	role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (group_id, role_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_group_memberships (
+	user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+	group_id UUID REFERENCES role_groups(id) ON DELETE CASCADE,
+	assigned_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, group_id)
+);
+-- Time-limited memberships and their expiry reminders
+ALTER TABLE user_group_memberships ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP,
+	ADD COLUMN IF NOT EXISTS expiry_reminded_at TIMESTAMP,
+	ADD COLUMN IF NOT EXISTS expiry_snoozed_until TIMESTAMP;
+
+-- Who added and removed group members, and when; kept after the group or user is deleted
+CREATE TABLE IF NOT EXISTS group_membership_history (
+	id BIGSERIAL PRIMARY KEY,
+	group_id UUID NOT NULL,
+	user_id UUID NOT NULL,
+	action VARCHAR NOT NULL,
+	actor_id VARCHAR NOT NULL DEFAULT '',
+	expires_at TIMESTAMP,
+	occurred_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_group_membership_history_group ON group_membership_history(group_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_group_membership_history_user ON group_membership_history(user_id, occurred_at);
+
+-- Reusable access bundles: a group name pattern, description and role set
+CREATE TABLE IF NOT EXISTS group_templates (
+	id UUID PRIMARY KEY,
+	name VARCHAR UNIQUE NOT NULL,
+	name_pattern VARCHAR NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS group_template_roles (
+	template_id UUID REFERENCES group_templates(id) ON DELETE CASCADE,
+	role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+	PRIMARY KEY (template_id, role_id)
+);
+
+-- Email domains whose new users join a role group automatically
+CREATE TABLE IF NOT EXISTS domain_group_rules (
+	id UUID PRIMARY KEY,
+	domain VARCHAR NOT NULL,
+	group_id UUID NOT NULL REFERENCES role_groups(id) ON DELETE CASCADE,
+	created_by VARCHAR NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	UNIQUE (domain, group_id)
+);
+
+-- Personal access tokens, stored by the hash of their secret
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+	id UUID PRIMARY KEY,
+	user_id VARCHAR NOT NULL,
+	username VARCHAR NOT NULL DEFAULT '',
+	name VARCHAR NOT NULL,
+	prefix VARCHAR NOT NULL,
+	token_hash VARCHAR UNIQUE NOT NULL,
+	permissions TEXT[] NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+
+-- Revoked tokens (by jti) and users (by subject), kept until the tokens they cover expire
+CREATE TABLE IF NOT EXISTS token_denylist (
+	kind VARCHAR NOT NULL,
+	value VARCHAR NOT NULL,
+	reason TEXT NOT NULL DEFAULT '',
+	revoked_by VARCHAR NOT NULL DEFAULT '',
+	revoked_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (kind, value)
+);
+CREATE INDEX IF NOT EXISTS idx_token_denylist_expires_at ON token_denylist(expires_at);
+
+-- When each permission was last checked and each role last relied on, for the dormancy report
+CREATE TABLE IF NOT EXISTS permission_usage (
+	name VARCHAR PRIMARY KEY,
+	last_checked_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS role_usage (
+	role_id UUID PRIMARY KEY,
+	last_used_at TIMESTAMP NOT NULL
+);
+
+-- Devices users logged in from, for their device list and new-device alerts
+CREATE TABLE IF NOT EXISTS user_devices (
+	id UUID PRIMARY KEY,
+	user_id VARCHAR NOT NULL,
+	device_key VARCHAR NOT NULL,
+	name VARCHAR NOT NULL,
+	user_agent TEXT NOT NULL DEFAULT '',
+	last_ip VARCHAR NOT NULL DEFAULT '',
+	session_id VARCHAR NOT NULL DEFAULT '',
+	first_seen_at TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	UNIQUE (user_id, device_key)
+);
+
+-- Administrators subscribed to RBAC change digests
+CREATE TABLE IF NOT EXISTS rbac_digest_subscriptions (
+	user_id VARCHAR PRIMARY KEY,
+	frequency VARCHAR NOT NULL,
+	last_sent_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL
+);
+
+-- Key/value labels on users, roles and groups
+CREATE TABLE IF NOT EXISTS entity_labels (
+	kind VARCHAR(20) NOT NULL,
+	entity_id VARCHAR NOT NULL,
+	key VARCHAR(63) NOT NULL,
+	value VARCHAR(63) NOT NULL,
+	PRIMARY KEY (kind, entity_id, key)
+);
+CREATE INDEX IF NOT EXISTS idx_entity_labels_key_value ON entity_labels(kind, key, value);
+
+-- Deleted users, roles and groups, restorable until purge_at
+CREATE TABLE IF NOT EXISTS trash_items (
+	id UUID PRIMARY KEY,
+	kind VARCHAR(20) NOT NULL,
+	entity_id VARCHAR NOT NULL,
+	name VARCHAR NOT NULL DEFAULT '',
+	deleted_by VARCHAR NOT NULL DEFAULT '',
+	deleted_at TIMESTAMP NOT NULL,
+	purge_at TIMESTAMP NOT NULL,
+	data JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_trash_items_kind ON trash_items(kind, deleted_at);
+CREATE INDEX IF NOT EXISTS idx_trash_items_purge_at ON trash_items(purge_at);
+
+-- Versions of the transactional email templates administrators saved, per locale
+CREATE TABLE IF NOT EXISTS email_templates (
+	name VARCHAR(50) NOT NULL,
+	locale VARCHAR(10) NOT NULL,
+	version INT NOT NULL,
+	subject TEXT NOT NULL,
+	text_body TEXT NOT NULL,
+	html_body TEXT NOT NULL DEFAULT '',
+	created_by VARCHAR NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (name, locale, version)
+);
+
+-- Refresh tokens issued at login and refresh, by hash, so reuse of a rotated one is caught
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	token_hash VARCHAR PRIMARY KEY,
+	family_id UUID NOT NULL,
+	user_id VARCHAR NOT NULL DEFAULT '',
+	realm VARCHAR NOT NULL DEFAULT '',
+	session_id VARCHAR NOT NULL DEFAULT '',
+	issued_at TIMESTAMP NOT NULL,
+	rotated_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_issued_at ON refresh_tokens(issued_at);
+
+-- Single-use codes of passwordless logins; only their hashes are kept
+CREATE TABLE IF NOT EXISTS magic_link_codes (
+	id UUID PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash VARCHAR(64) NOT NULL UNIQUE,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_magic_link_codes_user_id ON magic_link_codes(user_id);
+
+-- Filter and sort configurations users saved for the admin lists
+CREATE TABLE IF NOT EXISTS saved_views (
+	id UUID PRIMARY KEY,
+	user_id VARCHAR NOT NULL,
+	list VARCHAR(20) NOT NULL,
+	name VARCHAR(100) NOT NULL,
+	query TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	UNIQUE (user_id, list, name)
+);
+
+-- Administrators' support notes on user accounts
+CREATE TABLE IF NOT EXISTS user_notes (
+	id UUID PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	author_id VARCHAR NOT NULL,
+	author_name VARCHAR NOT NULL DEFAULT '',
+	body TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_user_notes_user_id ON user_notes(user_id, created_at);
+
+-- Persisted application settings (maintenance mode, ...)
+CREATE TABLE IF NOT EXISTS settings (
+	key VARCHAR PRIMARY KEY,
+	value TEXT NOT NULL,
+	updated_by VARCHAR,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Detected authentication failure anomalies
+CREATE TABLE IF NOT EXISTS security_anomalies (
+	id UUID PRIMARY KEY,
+	subject_type VARCHAR NOT NULL,
+	subject VARCHAR NOT NULL,
+	failures INTEGER NOT NULL,
+	kinds JSONB,
+	window_start TIMESTAMP NOT NULL,
+	detected_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_security_anomalies_detected_at ON security_anomalies(detected_at);
+
+-- Hourly API request counts per client and endpoint
+CREATE TABLE IF NOT EXISTS api_usage (
+	period_start TIMESTAMP NOT NULL,
+	client_id VARCHAR NOT NULL,
+	method VARCHAR NOT NULL,
+	route VARCHAR NOT NULL,
+	requests BIGINT NOT NULL DEFAULT 0,
+	client_errors BIGINT NOT NULL DEFAULT 0,
+	server_errors BIGINT NOT NULL DEFAULT 0,
+	duration_ms BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (period_start, client_id, method, route)
+);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id UUID PRIMARY KEY,
+	channel VARCHAR(100) NOT NULL,
+	type VARCHAR(100) NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	payload JSONB NOT NULL,
+	attempts JSONB NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	replayed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_dead_letters_status ON dead_letters(status, created_at);
+
+CREATE TABLE IF NOT EXISTS operations (
+	id UUID PRIMARY KEY,
+	kind VARCHAR(100) NOT NULL,
+	status VARCHAR(20) NOT NULL,
+	created_by VARCHAR(255) NOT NULL DEFAULT '',
+	processed INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	result JSONB,
+	error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP
+);
+
+-- Tenants and the invitations of their first administrators
+CREATE TABLE IF NOT EXISTS tenants (
+	id UUID PRIMARY KEY,
+	slug VARCHAR(40) UNIQUE NOT NULL,
+	name VARCHAR(100) NOT NULL,
+	schema_name VARCHAR(63) NOT NULL DEFAULT '',
+	admin_email VARCHAR(255) NOT NULL,
+	role_names TEXT[] NOT NULL,
+	group_names TEXT[] NOT NULL,
+	created_by VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tenant_invitations (
+	id UUID PRIMARY KEY,
+	tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+	email VARCHAR(255) NOT NULL,
+	code_hash VARCHAR(64) UNIQUE NOT NULL,
+	group_names TEXT[] NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	accepted_by VARCHAR(255),
+	accepted_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL
+);
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP,
+	ADD COLUMN IF NOT EXISTS suspend_reason VARCHAR(500) NOT NULL DEFAULT '';
+
+-- Hourly API usage per tenant, next to the per-client rollup
+CREATE TABLE IF NOT EXISTS tenant_usage (
+	period_start TIMESTAMP NOT NULL,
+	tenant VARCHAR(40) NOT NULL,
+	requests BIGINT NOT NULL DEFAULT 0,
+	client_errors BIGINT NOT NULL DEFAULT 0,
+	server_errors BIGINT NOT NULL DEFAULT 0,
+	duration_ms BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (period_start, tenant)
+);
+
+-- Create indexes for better performance
+CREATE INDEX IF NOT EXISTS idx_user_group_memberships_user_id ON user_group_memberships(user_id);
+CREATE INDEX IF NOT EXISTS idx_group_roles_group_id ON group_roles(group_id);
+CREATE INDEX IF NOT EXISTS idx_role_permissions_role_id ON role_permissions(role_id);
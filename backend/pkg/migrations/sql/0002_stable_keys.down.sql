@@ -0,0 +1,4 @@
+-- Checks compare names again once the keys are gone, so rename renamed permissions back to
+-- their keys before rolling this back
+ALTER TABLE roles DROP COLUMN key;
+ALTER TABLE permissions DROP COLUMN key;
@@ -0,0 +1,12 @@
+-- Stable machine keys for permissions and roles, so display names can be renamed freely.
+-- Existing rows keep their name as key, which is what authorization checked until now.
+
+ALTER TABLE permissions ADD COLUMN key VARCHAR;
+UPDATE permissions SET key = name;
+ALTER TABLE permissions ALTER COLUMN key SET NOT NULL;
+ALTER TABLE permissions ADD CONSTRAINT permissions_key_key UNIQUE (key);
+
+ALTER TABLE roles ADD COLUMN key VARCHAR;
+UPDATE roles SET key = name;
+ALTER TABLE roles ALTER COLUMN key SET NOT NULL;
+ALTER TABLE roles ADD CONSTRAINT roles_key_key UNIQUE (key);
@@ -0,0 +1,2 @@
+-- Drops the audit log and every recorded change
+DROP TABLE IF EXISTS audit_logs;
@@ -0,0 +1,15 @@
+-- Who created, updated or deleted which user, role or group, with the resource before and after
+CREATE TABLE IF NOT EXISTS audit_logs (
+	id BIGSERIAL PRIMARY KEY,
+	actor_id VARCHAR NOT NULL,
+	action VARCHAR(20) NOT NULL,
+	resource_type VARCHAR(50) NOT NULL,
+	resource_id VARCHAR NOT NULL,
+	before JSONB,
+	after JSONB,
+	client_ip VARCHAR NOT NULL DEFAULT '',
+	occurred_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_occurred_at ON audit_logs(occurred_at);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_actor ON audit_logs(actor_id, occurred_at);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_resource ON audit_logs(resource_type, resource_id, occurred_at);
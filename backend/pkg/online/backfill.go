@@ -0,0 +1,217 @@
+package online
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/jobs"
+
+	"github.com/sirupsen/logrus"
+)
+
+// OperationBackfill is the kind of the operations backfills run as
+const OperationBackfill = "schema_backfill"
+
+// DefaultBatchSize is how many rows a backfill updates per statement unless it sets its own
+const DefaultBatchSize = 1000
+
+// Backfill updates the rows of Table matching Where in batches, each its own short statement,
+// so no lock is held on the whole table. Set and Where may use $1..$n of Args, e.g. Set
+// "phone_number = $1" and Where "phone_number IS NULL". Rows are visited once in Key order, so
+// Set need not make them stop matching Where.
+type Backfill struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	Table string        `json:"-"`
+	Set   string        `json:"-"`
+	Where string        `json:"-"`
+	Args  []interface{} `json:"-"`
+	// Key orders the batches: a unique column, "id" when empty
+	Key string `json:"-"`
+	// BatchSize is the rows per batch, DefaultBatchSize when 0; Pause is waited between batches
+	// to leave room for other writes
+	BatchSize int           `json:"-"`
+	Pause     time.Duration `json:"-"`
+}
+
+// BackfillResult is the result of a backfill operation
+type BackfillResult struct {
+	Name    string `json:"name"`
+	Updated int    `json:"updated"`
+}
+
+func (b Backfill) key() string {
+	if b.Key == "" {
+		return "id"
+	}
+	return b.Key
+}
+
+func (b Backfill) batchSize() int {
+	if b.BatchSize <= 0 {
+		return DefaultBatchSize
+	}
+	return b.BatchSize
+}
+
+// Pending counts the rows left to update
+func (b Backfill) Pending(ctx context.Context, db *sql.DB) (int, error) {
+	var n int
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", b.Table, b.Where)
+	if err := db.QueryRowContext(ctx, query, b.Args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("count rows to backfill for %s: %w", b.Name, err)
+	}
+	return n, nil
+}
+
+// Run updates the pending rows batch by batch until none are left or ctx is cancelled,
+// reporting progress to the operation it runs in, and returns how many rows it updated
+func (b Backfill) Run(ctx context.Context, db *sql.DB) (int, error) {
+	total, err := b.Pending(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	key, n := b.key(), len(b.Args)
+
+	updated, after := 0, ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return updated, err
+		}
+		args := append(append([]interface{}{}, b.Args...), b.batchSize())
+		bound := ""
+		if after != "" {
+			args = append(args, after)
+			bound = fmt.Sprintf(" AND %s > $%d", key, n+2)
+		}
+		query := fmt.Sprintf(`WITH batch AS (
+		            SELECT %[1]s FROM %[2]s WHERE (%[3]s)%[4]s ORDER BY %[1]s LIMIT $%[5]d
+		          ), updated AS (
+		            UPDATE %[2]s SET %[6]s WHERE %[1]s IN (SELECT %[1]s FROM batch) AND (%[3]s) RETURNING 1
+		          )
+		          SELECT (SELECT COUNT(*) FROM updated), (SELECT %[1]s::text FROM batch ORDER BY %[1]s DESC LIMIT 1)`,
+			key, b.Table, b.Where, bound, n+1, b.Set)
+
+		var batchUpdated int
+		var last sql.NullString
+		if err := db.QueryRowContext(ctx, query, args...).Scan(&batchUpdated, &last); err != nil {
+			return updated, fmt.Errorf("backfill %s after %q: %w", b.Name, after, err)
+		}
+		updated += batchUpdated
+		if !last.Valid {
+			return updated, nil
+		}
+		after = last.String
+		if updated > total {
+			total = updated
+		}
+		jobs.ReportProgress(ctx, updated, total)
+
+		if b.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return updated, ctx.Err()
+			case <-time.After(b.Pause):
+			}
+		}
+	}
+}
+
+// Backfills runs registered backfills as operations, one run of each at a time
+type Backfills struct {
+	db     *sql.DB
+	runner *jobs.Runner
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	backfills map[string]Backfill
+	running   map[string]bool
+}
+
+// NewBackfills creates a registry running backfills on db as operations of runner
+func NewBackfills(db *sql.DB, runner *jobs.Runner, logger *logrus.Logger) *Backfills {
+	return &Backfills{db: db, runner: runner, logger: logger, backfills: make(map[string]Backfill), running: make(map[string]bool)}
+}
+
+// Register makes b available to List and Start. Register backfills before serving requests.
+func (s *Backfills) Register(b Backfill) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backfills[b.Name] = b
+}
+
+// List returns the registered backfills by name
+func (s *Backfills) List() []Backfill {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Backfill, 0, len(s.backfills))
+	for _, b := range s.backfills {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Start runs the backfill name as an operation started by createdBy
+func (s *Backfills) Start(ctx context.Context, name, createdBy string) (*jobs.Operation, error) {
+	s.mu.Lock()
+	b, ok := s.backfills[name]
+	if !ok {
+		s.mu.Unlock()
+		return nil, apperrors.NotFound("BACKFILL_NOT_FOUND", "backfill not found")
+	}
+	if s.running[name] {
+		s.mu.Unlock()
+		return nil, apperrors.Conflict("BACKFILL_RUNNING", "the backfill is already running")
+	}
+	s.running[name] = true
+	s.mu.Unlock()
+
+	op, err := s.runner.Submit(ctx, OperationBackfill, createdBy, func(ctx context.Context) (interface{}, error) {
+		defer s.done(name)
+		updated, err := b.Run(ctx, s.db)
+		if err != nil {
+			return nil, err
+		}
+		s.logger.WithContext(ctx).WithFields(logrus.Fields{"backfill": name, "updated": updated}).Info("Backfill finished")
+		return BackfillResult{Name: name, Updated: updated}, nil
+	})
+	if err != nil {
+		s.done(name)
+		return nil, err
+	}
+	return op, nil
+}
+
+func (s *Backfills) done(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, name)
+}
+
+// StartPending starts every registered backfill that has rows left to update, e.g. at startup
+// after the expand step of a schema change was deployed
+func (s *Backfills) StartPending(ctx context.Context) {
+	for _, b := range s.List() {
+		logger := s.logger.WithField("backfill", b.Name)
+		pending, err := b.Pending(ctx, s.db)
+		if err != nil {
+			logger.WithError(err).Error("Failed to check backfill")
+			continue
+		}
+		if pending == 0 {
+			continue
+		}
+		if _, err := s.Start(ctx, b.Name, ""); err != nil {
+			logger.WithError(err).Error("Failed to start backfill")
+			continue
+		}
+		logger.WithField("rows", pending).Info("Backfill started")
+	}
+}
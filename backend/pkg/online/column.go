@@ -0,0 +1,52 @@
+package online
+
+import "fmt"
+
+// Phase is how far the replacement of a column has got
+type Phase int
+
+const (
+	// Expanding: the new column was added and is being backfilled. Reads fall back to the old
+	// column where the new one is still NULL; writes go to both.
+	Expanding Phase = iota
+	// Migrated: the backfill finished. Reads use the new column; writes still go to both, for
+	// instances of the previous release that read the old one.
+	Migrated
+	// Contracted: the old column is dropped. Only the new one is read and written.
+	Contracted
+)
+
+// Column is a column being replaced by another, e.g. renamed, in expand/contract steps. Queries
+// build their reads and writes from it, so moving to the next phase is a one-line change.
+type Column struct {
+	Old   string
+	New   string
+	Phase Phase
+}
+
+// Read is the expression to select the column by, aliased to the new name
+func (c Column) Read() string {
+	if c.Phase == Expanding {
+		return fmt.Sprintf("COALESCE(%s, %s) AS %s", c.New, c.Old, c.New)
+	}
+	return c.New
+}
+
+// Write is the SET assignment of value, e.g. a placeholder such as "$2"
+func (c Column) Write(value string) string {
+	if c.Phase == Contracted {
+		return fmt.Sprintf("%s = %s", c.New, value)
+	}
+	return fmt.Sprintf("%s = %s, %s = %s", c.New, value, c.Old, value)
+}
+
+// Backfill copies the old column into the new one on table where it is not set yet
+func (c Column) Backfill(name, table string) Backfill {
+	return Backfill{
+		Name:        name,
+		Description: fmt.Sprintf("Copy %s.%s into %s", table, c.Old, c.New),
+		Table:       table,
+		Set:         fmt.Sprintf("%s = %s", c.New, c.Old),
+		Where:       fmt.Sprintf("%s IS NULL AND %s IS NOT NULL", c.New, c.Old),
+	}
+}
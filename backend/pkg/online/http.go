@@ -0,0 +1,41 @@
+package online
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+	"base-app/pkg/jobs"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where backfills are listed and started
+const Path = "/api/backfills"
+
+// ListHandler handles GET /api/backfills
+func ListHandler(backfills *Backfills) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backfills.List())
+	}
+}
+
+// StartHandler handles POST /api/backfills/{name}, answering 202 with the operation running it
+func StartHandler(backfills *Backfills, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		op, err := backfills.Start(r.Context(), mux.Vars(r)["name"], viewer(r).UserID)
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to start backfill")
+			return
+		}
+		jobs.WriteAccepted(w, op)
+	}
+}
+
+// Mount registers the backfill endpoints under Path, wrapped by protect
+func Mount(r *mux.Router, backfills *Backfills, viewer func(r *http.Request) fieldfilter.Viewer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(ListHandler(backfills))).Methods("GET")
+	r.HandleFunc(Path+"/{name}", protect(StartHandler(backfills, viewer))).Methods("POST")
+}
@@ -0,0 +1,64 @@
+// Package online helps change the schema of large tables, such as users, without locking them:
+// indexes are built concurrently, new columns are filled by batched backfills running as
+// operations, and Column reads and writes a renamed column during the change. Such changes go in
+// expand/contract steps: add the new structure, backfill it while both are read and written,
+// then drop the old one once no running instance uses it.
+package online
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Index is an index to build without blocking writes to its table
+type Index struct {
+	Name  string
+	Table string
+	// Columns are the indexed columns or expressions, e.g. "lower(email)"
+	Columns string
+	Unique  bool
+	// Where makes it a partial index, e.g. "deleted_at IS NULL"
+	Where string
+}
+
+// CreateIndex builds idx with CREATE INDEX CONCURRENTLY, which lets writes go on while it runs.
+// An index left invalid by an earlier failed build is dropped and built again; a valid one is
+// kept. Concurrent builds cannot run in a transaction, so db must not be one.
+func CreateIndex(ctx context.Context, db *sql.DB, idx Index) error {
+	var valid bool
+	err := db.QueryRowContext(ctx, `SELECT x.indisvalid FROM pg_index x JOIN pg_class i ON i.oid = x.indexrelid
+	          WHERE i.relname = $1 AND i.relnamespace = current_schema()::regnamespace`, idx.Name).Scan(&valid)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return fmt.Errorf("check index %s: %w", idx.Name, err)
+	case valid:
+		return nil
+	default:
+		if err := DropIndex(ctx, db, idx.Name); err != nil {
+			return err
+		}
+	}
+
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+	statement := fmt.Sprintf("CREATE %sINDEX CONCURRENTLY %s ON %s (%s)", unique, idx.Name, idx.Table, idx.Columns)
+	if idx.Where != "" {
+		statement += " WHERE " + idx.Where
+	}
+	if _, err := db.ExecContext(ctx, statement); err != nil {
+		return fmt.Errorf("create index %s: %w", idx.Name, err)
+	}
+	return nil
+}
+
+// DropIndex drops the index name with DROP INDEX CONCURRENTLY, if it exists
+func DropIndex(ctx context.Context, db *sql.DB, name string) error {
+	if _, err := db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+name); err != nil {
+		return fmt.Errorf("drop index %s: %w", name, err)
+	}
+	return nil
+}
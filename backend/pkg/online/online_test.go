@@ -0,0 +1,173 @@
+package online
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/jobs"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jobStore keeps operations in memory
+type jobStore struct {
+	mu      sync.Mutex
+	ops     map[string]jobs.Operation
+	results map[string][]byte
+}
+
+func (s *jobStore) Create(op *jobs.Operation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops[op.ID] = *op
+	return nil
+}
+
+func (s *jobStore) Progress(id string, processed, total int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.ops[id]
+	op.Processed, op.Total = processed, total
+	s.ops[id] = op
+	return nil
+}
+
+func (s *jobStore) Finish(id, status string, processed, total int, result []byte, message string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := s.ops[id]
+	op.Status, op.Processed, op.Total, op.Error = status, processed, total, message
+	s.ops[id] = op
+	s.results[id] = result
+	return nil
+}
+
+func (s *jobStore) Get(id string) (*jobs.Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op, ok := s.ops[id]
+	if !ok {
+		return nil, nil
+	}
+	return &op, nil
+}
+
+func (s *jobStore) Result(id string) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results[id], nil
+}
+
+func (s *jobStore) FailStale(before time.Time, message string, at time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *jobStore) DeleteFinished(before time.Time) (int, error) {
+	return 0, nil
+}
+
+func newTestLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestCreateIndexRebuildsInvalidIndex(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	idx := Index{Name: "idx_users_active_email", Table: "users", Columns: "lower(email)", Unique: true, Where: "is_active"}
+
+	mock.ExpectQuery("SELECT x.indisvalid").WithArgs(idx.Name).
+		WillReturnRows(sqlmock.NewRows([]string{"indisvalid"}).AddRow(true))
+	require.NoError(t, CreateIndex(context.Background(), db, idx), "a valid index is kept")
+
+	mock.ExpectQuery("SELECT x.indisvalid").WithArgs(idx.Name).
+		WillReturnRows(sqlmock.NewRows([]string{"indisvalid"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta("DROP INDEX CONCURRENTLY IF EXISTS idx_users_active_email")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE UNIQUE INDEX CONCURRENTLY idx_users_active_email ON users (lower(email)) WHERE is_active")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	require.NoError(t, CreateIndex(context.Background(), db, idx))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBackfillRunsInBatches(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	backfill := Backfill{Name: "users_realm", Table: "users", Set: "realm = $1", Where: "realm = ''", Args: []interface{}{"main"}, BatchSize: 2}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE realm = ''")).WithArgs("main").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM users WHERE (realm = '') ORDER BY id LIMIT $2")).WithArgs("main", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"updated", "last"}).AddRow(2, "b"))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE (realm = '') AND id > $3 ORDER BY id LIMIT $2")).WithArgs("main", 2, "b").
+		WillReturnRows(sqlmock.NewRows([]string{"updated", "last"}).AddRow(1, "c"))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET realm = $1")).WithArgs("main", 2, "c").
+		WillReturnRows(sqlmock.NewRows([]string{"updated", "last"}).AddRow(0, nil))
+
+	updated, err := backfill.Run(context.Background(), db)
+	require.NoError(t, err)
+	assert.Equal(t, 3, updated)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestBackfillsRunAsOperations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	runner := jobs.NewRunner(&jobStore{ops: make(map[string]jobs.Operation), results: make(map[string][]byte)}, newTestLogger())
+	backfills := NewBackfills(db, runner, newTestLogger())
+	backfills.Register(Column{Old: "phone", New: "phone_number"}.Backfill("users_phone_number", "users"))
+
+	_, err = backfills.Start(context.Background(), "users_email", "admin")
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperrors.KindNotFound, appErr.Kind)
+
+	backfills.running["users_phone_number"] = true
+	_, err = backfills.Start(context.Background(), "users_phone_number", "admin")
+	appErr, ok = apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "BACKFILL_RUNNING", appErr.Code)
+	backfills.done("users_phone_number")
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM users WHERE phone_number IS NULL AND phone IS NOT NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET phone_number = phone")).
+		WillReturnRows(sqlmock.NewRows([]string{"updated", "last"}).AddRow(1, "a"))
+	mock.ExpectQuery(regexp.QuoteMeta("UPDATE users SET phone_number = phone")).
+		WillReturnRows(sqlmock.NewRows([]string{"updated", "last"}).AddRow(0, nil))
+	op, err := backfills.Start(context.Background(), "users_phone_number", "admin")
+	require.NoError(t, err)
+	runner.Wait()
+
+	result, err := runner.Result(op.ID)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name":"users_phone_number","updated":1}`, string(result))
+	assert.Empty(t, backfills.running)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestColumnPhases(t *testing.T) {
+	column := Column{Old: "phone", New: "phone_number"}
+	assert.Equal(t, "COALESCE(phone_number, phone) AS phone_number", column.Read())
+	assert.Equal(t, "phone_number = $2, phone = $2", column.Write("$2"))
+
+	column.Phase = Migrated
+	assert.Equal(t, "phone_number", column.Read())
+	assert.Equal(t, "phone_number = $2, phone = $2", column.Write("$2"))
+
+	column.Phase = Contracted
+	assert.Equal(t, "phone_number = $2", column.Write("$2"))
+}
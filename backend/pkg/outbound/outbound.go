@@ -0,0 +1,217 @@
+// Package outbound provides the HTTP transport of calls to other services: Keycloak, identity
+// providers, webhooks, captcha verification, Gravatar and error reporting. Locked-down networks
+// can route them through a proxy, trust a private CA and present a client certificate. Every
+// call has a timeout budget per service and also ends when the context of the request that
+// made it does.
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Services with their own timeout budget
+const (
+	Keycloak = "keycloak"
+	OIDC     = "oidc"
+	Webhook  = "webhook"
+	Captcha  = "captcha"
+	Gravatar = "gravatar"
+	Sentry   = "sentry"
+)
+
+// DefaultTimeout is the budget of one call to a service without a budget of its own
+const DefaultTimeout = 10 * time.Second
+
+// defaultTimeouts are the budgets of services that differ from DefaultTimeout
+var defaultTimeouts = map[string]time.Duration{
+	// Avatars fall back to identicons, so a slow Gravatar is not worth waiting for
+	Gravatar: 5 * time.Second,
+}
+
+// Options configures outbound HTTP. The zero value keeps Go's defaults: the proxy comes from
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY and only the system CAs are trusted.
+type Options struct {
+	// ProxyURL routes every outbound call through this proxy, e.g. http://proxy.corp:3128
+	ProxyURL string
+	// NoProxy lists hosts, domains (.corp.example) and CIDRs reached directly, comma separated
+	NoProxy string
+	// CAFile is a PEM bundle of CAs trusted in addition to the system ones
+	CAFile string
+	// ClientCertFile and ClientKeyFile are a PEM certificate and key presented to servers that
+	// ask for one
+	ClientCertFile string
+	ClientKeyFile  string
+	// Timeout is the budget of one call to a service without a budget of its own,
+	// DefaultTimeout when 0; Timeouts sets budgets per service, e.g. {"keycloak": 5 * time.Second}
+	Timeout  time.Duration
+	Timeouts map[string]time.Duration
+}
+
+// Validate checks that opts can be used, without reading the files it names
+func (opts Options) Validate() error {
+	if opts.ProxyURL != "" {
+		u, err := url.Parse(opts.ProxyURL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return errors.New("outbound: proxy URL must be an http, https or socks5 URL with a host")
+		}
+	}
+	if (opts.ClientCertFile == "") != (opts.ClientKeyFile == "") {
+		return errors.New("outbound: a client certificate needs both a certificate and a key file")
+	}
+	if opts.Timeout < 0 {
+		return errors.New("outbound: the timeout must not be negative")
+	}
+	for service, timeout := range opts.Timeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("outbound: the %s timeout must be positive", service)
+		}
+	}
+	return nil
+}
+
+// NewTransport builds a transport applying opts
+func NewTransport(opts Options) (*http.Transport, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.ProxyURL != "" {
+		proxy := (&httpproxy.Config{HTTPProxy: opts.ProxyURL, HTTPSProxy: opts.ProxyURL, NoProxy: opts.NoProxy}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxy(req.URL)
+		}
+	}
+	if opts.CAFile == "" && opts.ClientCertFile == "" {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("outbound: read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("outbound: %s holds no PEM certificates", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("outbound: load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// config is what Configure set
+type config struct {
+	transport *http.Transport
+	timeout   time.Duration
+	timeouts  map[string]time.Duration
+}
+
+// configured is the config set by Configure
+var configured atomic.Pointer[config]
+
+// Configure applies opts to every client using Transport, including those created earlier.
+// Configure it at startup, before outbound calls are made.
+func Configure(opts Options) error {
+	transport, err := NewTransport(opts)
+	if err != nil {
+		return err
+	}
+	c := &config{transport: transport, timeout: opts.Timeout, timeouts: make(map[string]time.Duration)}
+	for service, timeout := range opts.Timeouts {
+		c.timeouts[service] = timeout
+	}
+	if previous := configured.Swap(c); previous != nil {
+		previous.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// Budget returns how long one call to service may take
+func Budget(service string) time.Duration {
+	if c := configured.Load(); c != nil {
+		if timeout, ok := c.timeouts[service]; ok {
+			return timeout
+		}
+		if _, ok := defaultTimeouts[service]; !ok && c.timeout > 0 {
+			return c.timeout
+		}
+	}
+	if timeout, ok := defaultTimeouts[service]; ok {
+		return timeout
+	}
+	return DefaultTimeout
+}
+
+// WithBudget returns ctx limited to the budget of a call to service; a deadline ctx already has
+// is kept when it is sooner
+func WithBudget(ctx context.Context, service string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, Budget(service))
+}
+
+// budgeted sends requests through the configured transport, or Go's default one before
+// Configure, within the budget of service
+type budgeted struct {
+	service string
+}
+
+func (b budgeted) RoundTrip(req *http.Request) (*http.Response, error) {
+	var transport http.RoundTripper = http.DefaultTransport
+	if c := configured.Load(); c != nil {
+		transport = c.transport
+	}
+	ctx, cancel := WithBudget(req.Context(), b.service)
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The budget covers reading the body too; it is released once the body is closed
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a call's budget when its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Transport returns the round tripper of calls to service
+func Transport(service string) http.RoundTripper {
+	return budgeted{service: service}
+}
+
+// Client returns a client for calls to service
+func Client(service string) *http.Client {
+	return &http.Client{Transport: Transport(service)}
+}
@@ -0,0 +1,132 @@
+package outbound
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyAndNoProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+
+	transport, err := NewTransport(Options{ProxyURL: proxy.URL, NoProxy: "direct.example"})
+	require.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get("http://keycloak.example/realms/app")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "via proxy", string(body))
+	assert.Equal(t, []string{"http://keycloak.example/realms/app"}, proxied)
+
+	proxyURL, err := transport.Proxy(httptest.NewRequest(http.MethodGet, "http://direct.example/", nil))
+	require.NoError(t, err)
+	assert.Nil(t, proxyURL, "NoProxy hosts are reached directly")
+}
+
+func TestCAFileIsTrusted(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	transport, err := NewTransport(Options{})
+	require.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.Error(t, err, "the test server's CA is not a system CA")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, cert, 0o600))
+	transport, err = NewTransport(Options{CAFile: caFile})
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for name, opts := range map[string]Options{
+		"proxy without host":  {ProxyURL: "http://"},
+		"unsupported scheme":  {ProxyURL: "ftp://proxy:21"},
+		"certificate, no key": {ClientCertFile: "client.pem"},
+		"missing CA bundle":   {CAFile: filepath.Join(t.TempDir(), "missing.pem")},
+		"missing certificate": {ClientCertFile: "missing.pem", ClientKeyFile: "missing.key"},
+	} {
+		_, err := NewTransport(opts)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestConfigureAppliesToExistingClients(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "via proxy")
+	}))
+	defer proxy.Close()
+	client := Client(Webhook)
+
+	require.NoError(t, Configure(Options{ProxyURL: proxy.URL}))
+	defer configured.Store(nil)
+
+	resp, err := client.Get("http://webhook.example/hook")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "via proxy", string(body))
+}
+
+func TestBudgets(t *testing.T) {
+	defer configured.Store(nil)
+	assert.Equal(t, DefaultTimeout, Budget(Keycloak))
+	assert.Equal(t, 5*time.Second, Budget(Gravatar))
+
+	require.NoError(t, Configure(Options{Timeout: 3 * time.Second, Timeouts: map[string]time.Duration{Keycloak: time.Second}}))
+	assert.Equal(t, time.Second, Budget(Keycloak))
+	assert.Equal(t, 3*time.Second, Budget(Webhook))
+	assert.Equal(t, 5*time.Second, Budget(Gravatar))
+	assert.Error(t, Configure(Options{Timeouts: map[string]time.Duration{Webhook: 0}}))
+}
+
+func TestCallsGiveUpAfterTheirBudget(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	defer configured.Store(nil)
+
+	require.NoError(t, Configure(Options{Timeouts: map[string]time.Duration{Keycloak: 50 * time.Millisecond}}))
+	start := time.Now()
+	_, err := Client(Keycloak).Get(server.URL)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// A sooner deadline of the calling request wins
+	require.NoError(t, Configure(Options{}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	_, err = Client(Keycloak).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
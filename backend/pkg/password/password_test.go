@@ -0,0 +1,33 @@
+package password
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	hash, err := Hash("correct horse")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	ok, err := Verify("correct horse", hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = Verify("battery staple", hash)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	again, err := Hash("correct horse")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, again, "each hash has its own salt")
+}
+
+func TestVerifyRejectsMalformedHashes(t *testing.T) {
+	for _, hash := range []string{"", "plain", "$2a$10$abcdefghijklmnopqrstuv", "$argon2id$v=19$m=x$salt$key", "$argon2id$v=19$m=8,t=1,p=1$!!$key"} {
+		_, err := Verify("pw", hash)
+		assert.ErrorIs(t, err, ErrMalformedHash, hash)
+	}
+}
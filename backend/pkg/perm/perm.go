@@ -0,0 +1,89 @@
+// Package perm names every permission the application checks. Protect routes with these
+// constants instead of string literals, so a misspelt permission fails to compile instead of
+// answering 403 to everyone. The module owning a permission declares it to the RBAC registry;
+// startup warns about constants that no module declared.
+package perm
+
+import "strings"
+
+// Name is the key of a permission, as stored in the key column of the permissions table. The
+// display name next to it may be renamed; the key may not.
+type Name string
+
+// User management
+const (
+	CreateUser Name = "create_user"
+	ReadUser   Name = "read_user"
+	UpdateUser Name = "update_user"
+	DeleteUser Name = "delete_user"
+	// ManageUserNotes reads and writes support notes on user accounts
+	ManageUserNotes Name = "manage_user_notes"
+	// ReadUserOwn and UpdateUserOwn are the own-resource variants of ReadUser and UpdateUser:
+	// they only reach the caller's own profile
+	ReadUserOwn   Name = ReadUser + OwnSuffix
+	UpdateUserOwn Name = UpdateUser + OwnSuffix
+)
+
+// OwnSuffix ends the name of the own-resource variant of a permission, which grants it only
+// on resources the caller owns
+const OwnSuffix = "_own"
+
+// Own returns the own-resource variant of name
+func Own(name Name) Name {
+	return name + OwnSuffix
+}
+
+// Access control
+const (
+	ManageRoles           Name = "manage_roles"
+	CreateRole            Name = "create_role"
+	ReadRole              Name = "read_role"
+	UpdateRole            Name = "update_role"
+	DeleteRole            Name = "delete_role"
+	CreateGroup           Name = "create_group"
+	ReadGroup             Name = "read_group"
+	UpdateGroup           Name = "update_group"
+	DeleteGroup           Name = "delete_group"
+	ManageGroupMembership Name = "manage_group_membership"
+	ManageGroupRoles      Name = "manage_group_roles"
+	ReadPermission        Name = "read_permission"
+	RevokeTokens          Name = "revoke_tokens"
+)
+
+// System, monitoring and reporting
+const (
+	ManageConfig       Name = "manage_config"
+	ManageSystem       Name = "manage_system"
+	ManageTenants      Name = "manage_tenants"
+	ReadSecurityEvents Name = "read_security_events"
+	ReadUsage          Name = "read_usage"
+	ReadAuditLog       Name = "read_audit_log"
+	ViewReports        Name = "view_reports"
+)
+
+// Platform administration: the hosting operator's console across tenants. These permissions
+// share PlatformPrefix and are never effective in a tenant's context, so no tenant role can
+// grant them.
+const (
+	PlatformImpersonate Name = PlatformPrefix + "impersonate"
+	PlatformReadUsage   Name = PlatformPrefix + "read_usage"
+	PlatformSuspend     Name = PlatformPrefix + "suspend_tenants"
+)
+
+// PlatformPrefix starts the name of every platform administration permission
+const PlatformPrefix = "platform_admin_"
+
+// Platform reports whether name is a platform administration permission
+func Platform(name string) bool {
+	return strings.HasPrefix(name, PlatformPrefix)
+}
+
+// All lists every permission above
+var All = []Name{
+	CreateUser, ReadUser, UpdateUser, DeleteUser, ManageUserNotes, ReadUserOwn, UpdateUserOwn,
+	ManageRoles, CreateRole, ReadRole, UpdateRole, DeleteRole,
+	CreateGroup, ReadGroup, UpdateGroup, DeleteGroup,
+	ManageGroupMembership, ManageGroupRoles, ReadPermission, RevokeTokens,
+	ManageConfig, ManageSystem, ManageTenants, ReadSecurityEvents, ReadUsage, ReadAuditLog, ViewReports,
+	PlatformImpersonate, PlatformReadUsage, PlatformSuspend,
+}
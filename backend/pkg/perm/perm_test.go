@@ -0,0 +1,18 @@
+package perm
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllIsUniqueSnakeCase(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z]+(_[a-z]+)*$`)
+	seen := make(map[Name]bool)
+	for _, name := range All {
+		assert.Regexp(t, pattern, string(name))
+		assert.False(t, seen[name], "%s is listed twice", name)
+		seen[name] = true
+	}
+}
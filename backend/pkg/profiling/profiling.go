@@ -0,0 +1,26 @@
+// Package profiling mounts the net/http/pprof endpoints on a router behind an authorization wrapper
+package profiling
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+// PathPrefix is where the profiling endpoints are mounted
+const PathPrefix = "/debug/pprof"
+
+// Mount registers the pprof handlers under PathPrefix, each wrapped by protect so that only
+// authorized callers can capture profiles
+func Mount(r *mux.Router, protect func(http.HandlerFunc) http.HandlerFunc) {
+	router := r.PathPrefix(PathPrefix).Subrouter()
+
+	router.HandleFunc("/cmdline", protect(pprof.Cmdline)).Methods("GET")
+	router.HandleFunc("/profile", protect(pprof.Profile)).Methods("GET")
+	router.HandleFunc("/symbol", protect(pprof.Symbol)).Methods("GET", "POST")
+	router.HandleFunc("/trace", protect(pprof.Trace)).Methods("GET")
+
+	// Index also serves the named profiles (heap, goroutine, allocs, block, mutex, threadcreate)
+	router.PathPrefix("/").HandlerFunc(protect(pprof.Index)).Methods("GET")
+}
@@ -0,0 +1,159 @@
+// Package quota enforces licensed limits on how many of each resource (users, roles, ...) may
+// exist. Limits apply to the whole installation, which is licensed as one tenant. Checks run
+// before a resource is created and count what exists at that moment, so concurrent creations
+// can overshoot a limit by a few; that is acceptable for seat licensing.
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// Resources with quotas
+const (
+	Users   = "users"
+	Roles   = "roles"
+	Groups  = "groups"
+	APIKeys = "api_keys"
+)
+
+// Path is where Mount serves quota usage
+const Path = "/api/quotas"
+
+// Checker is consulted before creating a resource that counts against a quota
+type Checker interface {
+	Check(ctx context.Context, resource string) error
+	// CheckN is Check for creating n resources at once
+	CheckN(ctx context.Context, resource string, n int) error
+}
+
+// Counter returns how many of a resource exist
+type Counter func(ctx context.Context) (int, error)
+
+// Usage is the consumption of one quota. Limit and Remaining are null when unlimited.
+type Usage struct {
+	Resource  string `json:"resource"`
+	Used      int    `json:"used"`
+	Limit     *int   `json:"limit"`
+	Remaining *int   `json:"remaining"`
+}
+
+// CountRows returns a Counter running query, which must select a single count
+func CountRows(db *sql.DB, query string) Counter {
+	return func(ctx context.Context) (int, error) {
+		var n int
+		err := db.QueryRowContext(ctx, query).Scan(&n)
+		return n, err
+	}
+}
+
+type tracked struct {
+	limit int
+	count Counter
+}
+
+// Enforcer holds the limit and counter of each registered resource
+type Enforcer struct {
+	mu        sync.RWMutex
+	resources map[string]tracked
+	order     []string
+}
+
+// NewEnforcer creates an enforcer with no resources; unregistered resources are unlimited
+func NewEnforcer() *Enforcer {
+	return &Enforcer{resources: make(map[string]tracked)}
+}
+
+// Register tracks resource with the given limit (0 means unlimited)
+func (e *Enforcer) Register(resource string, limit int, count Counter) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.resources[resource]; !ok {
+		e.order = append(e.order, resource)
+	}
+	e.resources[resource] = tracked{limit: limit, count: count}
+}
+
+// Check returns a KindQuotaExceeded error when creating one more resource would exceed its limit
+func (e *Enforcer) Check(ctx context.Context, resource string) error {
+	return e.CheckN(ctx, resource, 1)
+}
+
+// CheckN returns a KindQuotaExceeded error when creating n more resources would exceed its limit
+func (e *Enforcer) CheckN(ctx context.Context, resource string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	e.mu.RLock()
+	t, ok := e.resources[resource]
+	e.mu.RUnlock()
+	if !ok || t.limit <= 0 {
+		return nil
+	}
+
+	used, err := t.count(ctx)
+	if err != nil {
+		return fmt.Errorf("count %s: %w", resource, err)
+	}
+	if used+n > t.limit {
+		return apperrors.QuotaExceeded("QUOTA_EXCEEDED", fmt.Sprintf("The license allows at most %d %s", t.limit, resource))
+	}
+	return nil
+}
+
+// Usage reports the consumption of every registered resource, in registration order
+func (e *Enforcer) Usage(ctx context.Context) ([]Usage, error) {
+	e.mu.RLock()
+	order := append([]string(nil), e.order...)
+	resources := make(map[string]tracked, len(e.resources))
+	for name, t := range e.resources {
+		resources[name] = t
+	}
+	e.mu.RUnlock()
+
+	usage := make([]Usage, 0, len(order))
+	for _, name := range order {
+		t := resources[name]
+		used, err := t.count(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("count %s: %w", name, err)
+		}
+		u := Usage{Resource: name, Used: used}
+		if t.limit > 0 {
+			limit, remaining := t.limit, t.limit-used
+			if remaining < 0 {
+				remaining = 0
+			}
+			u.Limit, u.Remaining = &limit, &remaining
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// UsageHandler handles GET /api/quotas
+func UsageHandler(e *Enforcer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usage, err := e.Usage(r.Context())
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to get quota usage")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"quotas": usage})
+	}
+}
+
+// Mount registers the usage endpoint at Path, wrapped by protect
+func Mount(r *mux.Router, e *Enforcer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(UsageHandler(e))).Methods("GET")
+}
@@ -0,0 +1,64 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"base-app/pkg/apperrors"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fixedCount(n int) Counter {
+	return func(context.Context) (int, error) { return n, nil }
+}
+
+func TestCheck(t *testing.T) {
+	e := NewEnforcer()
+	e.Register(Users, 3, fixedCount(2))
+	e.Register(Roles, 3, fixedCount(3))
+	e.Register(Groups, 0, fixedCount(1000))
+	e.Register(APIKeys, 1, func(context.Context) (int, error) { return 0, errors.New("connection refused") })
+	ctx := context.Background()
+
+	assert.NoError(t, e.Check(ctx, Users))
+	assert.NoError(t, e.Check(ctx, Groups), "a zero limit is unlimited")
+	assert.NoError(t, e.Check(ctx, "widgets"), "unregistered resources are unlimited")
+
+	err := e.Check(ctx, Roles)
+	require.Error(t, err)
+	assert.Equal(t, apperrors.KindQuotaExceeded, apperrors.KindOf(err))
+
+	err = e.Check(ctx, APIKeys)
+	require.Error(t, err)
+	assert.Equal(t, apperrors.KindUnknown, apperrors.KindOf(err), "count failures are not quota errors")
+
+	assert.NoError(t, e.CheckN(ctx, Users, 1))
+	assert.Equal(t, apperrors.KindQuotaExceeded, apperrors.KindOf(e.CheckN(ctx, Users, 2)))
+	assert.NoError(t, e.CheckN(ctx, Roles, 0), "creating nothing never exceeds a quota")
+}
+
+func TestUsageHandler(t *testing.T) {
+	e := NewEnforcer()
+	e.Register(Users, 10, fixedCount(4))
+	e.Register(Roles, 2, fixedCount(3))
+	e.Register(Groups, 0, fixedCount(7))
+
+	w := httptest.NewRecorder()
+	UsageHandler(e)(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp struct {
+		Quotas []map[string]interface{} `json:"quotas"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Quotas, 3)
+	assert.Equal(t, map[string]interface{}{"resource": "users", "used": 4.0, "limit": 10.0, "remaining": 6.0}, resp.Quotas[0])
+	assert.Equal(t, map[string]interface{}{"resource": "roles", "used": 3.0, "limit": 2.0, "remaining": 0.0}, resp.Quotas[1])
+	assert.Equal(t, map[string]interface{}{"resource": "groups", "used": 7.0, "limit": nil, "remaining": nil}, resp.Quotas[2])
+}
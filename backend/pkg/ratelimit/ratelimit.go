@@ -0,0 +1,327 @@
+// Package ratelimit enforces request budgets per route and client tier. Each budget is a
+// token bucket holding Limit+Burst requests that refills at Limit per Window, so a client
+// can briefly exceed its steady rate by Burst requests.
+package ratelimit
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// Keys a budget can be counted by. Requests lacking the identity fall back to the next
+// narrower key: tenant to user, user to IP.
+const (
+	KeyIP     = "ip"
+	KeyUser   = "user"
+	KeyTenant = "tenant"
+)
+
+// Rule is a request budget for the requests it matches
+type Rule struct {
+	// Name identifies the budget in responses, e.g. "login"
+	Name string
+	// Methods restricts the rule to these HTTP methods; empty matches any
+	Methods []string
+	// Path is a mux path template, or a prefix followed by "*"; empty matches any route
+	Path string
+	// Tier restricts the rule to clients of this tier (e.g. "service"); empty matches any
+	Tier string
+	// Limit requests are allowed per Window; a negative Limit means unlimited
+	Limit  int
+	Window time.Duration
+	// Burst extra requests may be made at once on top of Limit
+	Burst int
+	// Key is what the budget is counted per: KeyIP (the default), KeyUser or KeyTenant.
+	// Tenant budgets are shared by every client of the tenant.
+	Key string
+}
+
+// Policy is an ordered list of rules; the first matching rule applies and requests matching
+// none use Default
+type Policy struct {
+	Default Rule
+	Rules   []Rule
+}
+
+// Client identifies the caller of a request
+type Client struct {
+	IP     string
+	UserID string
+	Tenant string
+	Tier   string
+}
+
+// Decision is the outcome of a request against its budget
+type Decision struct {
+	Rule       Rule
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// bucket holds the tokens of one budget for one key
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// sweepEvery controls how often idle, full buckets are dropped
+const sweepEvery = time.Minute
+
+// BudgetStats counts the decisions taken under one budget since the limiter started
+type BudgetStats struct {
+	Budget   string `json:"budget"`
+	Allowed  int64  `json:"allowed"`
+	Rejected int64  `json:"rejected"`
+}
+
+// StatsPath is where Mount serves the budget statistics
+const StatsPath = "/api/rate-limits"
+
+// Limiter tracks budgets in memory. Its policy can be replaced while serving requests.
+type Limiter struct {
+	policy atomic.Pointer[Policy]
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	stats     map[string]*BudgetStats
+	lastSweep time.Time
+
+	// onReject, when set, is told about requests the middleware turns away
+	onReject func(r *http.Request, decision Decision)
+
+	now func() time.Time
+}
+
+// New creates a limiter enforcing policy
+func New(policy Policy) *Limiter {
+	l := &Limiter{buckets: make(map[string]*bucket), stats: make(map[string]*BudgetStats), now: time.Now}
+	l.SetPolicy(policy)
+	return l
+}
+
+// OnReject registers a callback for requests the middleware rejects, e.g. to report lockouts.
+// Set it before serving requests.
+func (l *Limiter) OnReject(callback func(r *http.Request, decision Decision)) {
+	l.onReject = callback
+}
+
+// SetPolicy replaces the rules for subsequent requests. Budgets keep their remaining tokens
+// when a rule with the same name is kept.
+func (l *Limiter) SetPolicy(policy Policy) {
+	if policy.Default.Name == "" {
+		policy.Default.Name = "default"
+	}
+	l.policy.Store(&policy)
+}
+
+// Match returns the rule that applies to a request for the route template by a client of tier
+func (l *Limiter) Match(method, pathTemplate, tier string) Rule {
+	policy := l.policy.Load()
+	for _, rule := range policy.Rules {
+		if rule.matches(method, pathTemplate, tier) {
+			return rule
+		}
+	}
+	return policy.Default
+}
+
+func (rule Rule) matches(method, pathTemplate, tier string) bool {
+	if rule.Tier != "" && rule.Tier != tier {
+		return false
+	}
+	if len(rule.Methods) > 0 {
+		found := false
+		for _, m := range rule.Methods {
+			if strings.EqualFold(m, method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	switch {
+	case rule.Path == "":
+		return true
+	case strings.HasSuffix(rule.Path, "*"):
+		return strings.HasPrefix(pathTemplate, strings.TrimSuffix(rule.Path, "*"))
+	default:
+		return pathTemplate == rule.Path
+	}
+}
+
+// keyFor picks the identity a rule counts client by
+func keyFor(rule Rule, client Client) string {
+	switch {
+	case rule.Key == KeyTenant && client.Tenant != "":
+		return "tenant:" + client.Tenant
+	case (rule.Key == KeyTenant || rule.Key == KeyUser) && client.UserID != "":
+		return "user:" + client.UserID
+	default:
+		return "ip:" + client.IP
+	}
+}
+
+// Allow takes a token from client's budget under rule
+func (l *Limiter) Allow(rule Rule, client Client) Decision {
+	return l.AllowKey(rule, keyFor(rule, client))
+}
+
+// AllowKey takes a token from the budget of key under rule, for identities the middleware
+// cannot see, such as the username in a login body
+func (l *Limiter) AllowKey(rule Rule, key string) Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	decision := l.take(rule, rule.Name+"|"+key)
+	stats, ok := l.stats[rule.Name]
+	if !ok {
+		stats = &BudgetStats{Budget: rule.Name}
+		l.stats[rule.Name] = stats
+	}
+	if decision.Allowed {
+		stats.Allowed++
+	} else {
+		stats.Rejected++
+	}
+	return decision
+}
+
+// take removes a token from the bucket of key; the caller holds l.mu
+func (l *Limiter) take(rule Rule, key string) Decision {
+	if rule.Limit < 0 {
+		return Decision{Rule: rule, Allowed: true, Remaining: -1}
+	}
+	if rule.Limit == 0 || rule.Window <= 0 {
+		return Decision{Rule: rule, RetryAfter: rule.Window}
+	}
+
+	capacity := float64(rule.Limit + rule.Burst)
+	rate := float64(rule.Limit) / rule.Window.Seconds()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return Decision{Rule: rule, RetryAfter: wait}
+	}
+	b.tokens--
+	return Decision{Rule: rule, Allowed: true, Remaining: int(b.tokens)}
+}
+
+// Stats returns the decisions taken per budget, by budget name
+func (l *Limiter) Stats() []BudgetStats {
+	l.mu.Lock()
+	stats := make([]BudgetStats, 0, len(l.stats))
+	for _, s := range l.stats {
+		stats = append(stats, *s)
+	}
+	l.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Budget < stats[j].Budget })
+	return stats
+}
+
+// sweep drops buckets that have been idle long enough to be full again, so memory stays
+// bounded by the number of active clients. The caller holds l.mu.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepEvery {
+		return
+	}
+	l.lastSweep = now
+
+	longest := l.policy.Load().Default.Window
+	for _, rule := range l.policy.Load().Rules {
+		if rule.Window > longest {
+			longest = rule.Window
+		}
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) > longest {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// WriteHeaders sets the X-RateLimit headers of decision
+func WriteHeaders(w http.ResponseWriter, decision Decision) {
+	if decision.Rule.Limit >= 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Rule.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	}
+}
+
+// WriteRejection writes the 429 RATE_LIMIT_EXCEEDED response of a rejected decision
+func WriteRejection(w http.ResponseWriter, decision Decision) {
+	retryAfter := strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds())))
+	w.Header().Set("Retry-After", retryAfter)
+	httpapi.WriteErrorResponse(w, http.StatusTooManyRequests, "Rate limit exceeded", "RATE_LIMIT_EXCEEDED", map[string]string{
+		"retry_after": retryAfter,
+		"budget":      decision.Rule.Name,
+	})
+}
+
+// Middleware rejects requests over their budget with 429 RATE_LIMIT_EXCEEDED and a
+// Retry-After header. client identifies the caller of each request. It is added with Use so
+// rules can match on the route template.
+func (l *Limiter) Middleware(client func(*http.Request) Client) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var template string
+			if route := mux.CurrentRoute(r); route != nil {
+				template, _ = route.GetPathTemplate()
+			}
+			c := client(r)
+			decision := l.Allow(l.Match(r.Method, template, c.Tier), c)
+
+			WriteHeaders(w, decision)
+			if !decision.Allowed {
+				if l.onReject != nil {
+					l.onReject(r, decision)
+				}
+				WriteRejection(w, decision)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// StatsHandler handles GET /api/rate-limits, listing the budgets of all limiters together
+func StatsHandler(limiters ...*Limiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := []BudgetStats{}
+		for _, l := range limiters {
+			stats = append(stats, l.Stats()...)
+		}
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Budget < stats[j].Budget })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"budgets": stats})
+	}
+}
+
+// Mount registers the statistics endpoint at StatsPath, wrapped by protect
+func Mount(r *mux.Router, protect func(http.HandlerFunc) http.HandlerFunc, limiters ...*Limiter) {
+	r.HandleFunc(StatsPath, protect(StatsHandler(limiters...))).Methods("GET")
+}
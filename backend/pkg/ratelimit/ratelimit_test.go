@@ -0,0 +1,136 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPolicy() Policy {
+	return Policy{
+		Default: Rule{Limit: 5, Window: time.Minute},
+		Rules: []Rule{
+			{Name: "health", Path: "/health", Limit: -1},
+			{Name: "login", Methods: []string{"POST"}, Path: "/api/users/login", Limit: 2, Window: time.Minute, Burst: 1},
+			{Name: "service", Tier: "service", Path: "/api/*", Limit: 100, Window: time.Minute, Key: KeyTenant},
+		},
+	}
+}
+
+func TestMatch(t *testing.T) {
+	l := New(testPolicy())
+
+	assert.Equal(t, "health", l.Match("GET", "/health", "anonymous").Name)
+	assert.Equal(t, "login", l.Match("POST", "/api/users/login", "anonymous").Name)
+	assert.Equal(t, "default", l.Match("GET", "/api/users/login", "anonymous").Name, "method mismatch")
+	assert.Equal(t, "service", l.Match("GET", "/api/rbac/roles", "service").Name)
+	assert.Equal(t, "default", l.Match("GET", "/api/rbac/roles", "user").Name, "tier mismatch")
+}
+
+func TestAllowRefillsWithBurst(t *testing.T) {
+	l := New(testPolicy())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+
+	login := l.Match("POST", "/api/users/login", "anonymous")
+	client := Client{IP: "10.0.0.1"}
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(login, client).Allowed, "limit plus burst requests at once")
+	}
+	denied := l.Allow(login, client)
+	assert.False(t, denied.Allowed)
+	assert.Equal(t, 30*time.Second, denied.RetryAfter)
+
+	// Other clients have their own budget
+	assert.True(t, l.Allow(login, Client{IP: "10.0.0.2"}).Allowed)
+
+	now = now.Add(30 * time.Second)
+	assert.True(t, l.Allow(login, client).Allowed, "one token refilled")
+	assert.False(t, l.Allow(login, client).Allowed)
+
+	assert.True(t, l.Allow(l.Match("GET", "/health", ""), client).Allowed)
+}
+
+func TestAllowSharesTenantBudget(t *testing.T) {
+	l := New(Policy{Default: Rule{Limit: 2, Window: time.Minute, Key: KeyTenant}})
+	rule := l.Match("GET", "/api/rbac/roles", "service")
+
+	assert.True(t, l.Allow(rule, Client{IP: "10.0.0.1", UserID: "a", Tenant: "acme"}).Allowed)
+	assert.True(t, l.Allow(rule, Client{IP: "10.0.0.2", UserID: "b", Tenant: "acme"}).Allowed)
+	assert.False(t, l.Allow(rule, Client{IP: "10.0.0.3", UserID: "c", Tenant: "acme"}).Allowed)
+
+	// Without a tenant the budget falls back to the user
+	assert.True(t, l.Allow(rule, Client{IP: "10.0.0.1", UserID: "a"}).Allowed)
+}
+
+func TestMiddleware(t *testing.T) {
+	l := New(testPolicy())
+	r := mux.NewRouter()
+	r.Use(l.Middleware(func(r *http.Request) Client {
+		return Client{IP: r.RemoteAddr, Tier: "anonymous"}
+	}))
+	r.HandleFunc("/api/users/login", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/users/login", nil))
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		w := send()
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "2", w.Header().Get("X-RateLimit-Limit"))
+	}
+
+	var rejected []string
+	l.OnReject(func(r *http.Request, decision Decision) {
+		rejected = append(rejected, decision.Rule.Name)
+	})
+	w := send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Equal(t, []string{"login"}, rejected)
+	var resp struct {
+		Code    string            `json:"code"`
+		Details map[string]string `json:"details"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "RATE_LIMIT_EXCEEDED", resp.Code)
+	assert.Equal(t, "login", resp.Details["budget"])
+
+	// A reloaded policy applies to the next request
+	policy := testPolicy()
+	policy.Rules[1].Name = "login-v2"
+	l.SetPolicy(policy)
+	assert.Equal(t, http.StatusOK, send().Code)
+}
+
+func TestAllowKeyAndStats(t *testing.T) {
+	l := New(Policy{Default: Rule{Name: "account", Limit: 2, Window: time.Minute}})
+	rule := l.Match("POST", "", "")
+	rule.Name = "login_account"
+
+	assert.True(t, l.AllowKey(rule, "alice").Allowed)
+	assert.True(t, l.AllowKey(rule, "alice").Allowed)
+	assert.False(t, l.AllowKey(rule, "alice").Allowed)
+	assert.True(t, l.AllowKey(rule, "bob").Allowed, "each key has its own budget")
+	assert.True(t, l.Allow(l.Match("POST", "", ""), Client{IP: "alice"}).Allowed, "budgets are separate per rule")
+
+	assert.Equal(t, []BudgetStats{
+		{Budget: "account", Allowed: 1},
+		{Budget: "login_account", Allowed: 3, Rejected: 1},
+	}, l.Stats())
+
+	w := httptest.NewRecorder()
+	StatsHandler(l, New(Policy{}))(w, httptest.NewRequest(http.MethodGet, StatsPath, nil))
+	assert.JSONEq(t, `{"budgets": [
+		{"budget": "account", "allowed": 1, "rejected": 0},
+		{"budget": "login_account", "allowed": 3, "rejected": 1}
+	]}`, w.Body.String())
+}
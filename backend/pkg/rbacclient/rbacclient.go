@@ -0,0 +1,237 @@
+// Package rbacclient lets other Go services authorize their callers against this application.
+// A service forwards the bearer token it received and asks whether its owner holds a
+// permission; the answer comes from GET /api/users/me/access, so personal access token scopes
+// and revocations apply as they do here. Permission sets are cached per token for a short TTL,
+// so a busy handler costs one call per caller per TTL.
+//
+//	client := rbacclient.New("https://base-app.internal", rbacclient.Options{})
+//	mux.Handle("/reports", client.Require(perm.ViewReports, reportsHandler))
+package rbacclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"base-app/pkg/httpapi"
+	"base-app/pkg/perm"
+)
+
+// AccessPath is the endpoint returning the caller's own access
+const AccessPath = "/api/users/me/access"
+
+// DefaultTTL is how long a token's permissions are cached when Options.TTL is unset
+const DefaultTTL = 30 * time.Second
+
+// maxCached bounds memory use; beyond it expired entries are swept and, if that is not enough,
+// the cache starts over
+const maxCached = 10000
+
+var (
+	// ErrNoToken means the context carries no bearer token
+	ErrNoToken = errors.New("rbacclient: no bearer token")
+	// ErrUnauthenticated means the application rejected the token as invalid, expired or revoked
+	ErrUnauthenticated = errors.New("rbacclient: token rejected")
+)
+
+// Options configures a Client
+type Options struct {
+	// TTL is how long permissions are cached per token; negative disables the cache
+	TTL time.Duration
+	// HTTPClient makes the calls; a client with a 10 second timeout when nil
+	HTTPClient *http.Client
+}
+
+// Access is the caller's identity and permissions
+type Access struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	// Permissions holds the names of the permissions the caller has, sorted
+	Permissions []string `json:"permissions"`
+}
+
+// Has reports whether the access includes permission
+func (a *Access) Has(permission perm.Name) bool {
+	i := sort.SearchStrings(a.Permissions, string(permission))
+	return i < len(a.Permissions) && a.Permissions[i] == string(permission)
+}
+
+type cached struct {
+	access  *Access
+	expires time.Time
+}
+
+// Client asks the application about the permissions of bearer tokens
+type Client struct {
+	baseURL string
+	ttl     time.Duration
+	http    *http.Client
+	now     func() time.Time
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]cached
+}
+
+// New creates a client of the application at baseURL
+func New(baseURL string, opts Options) *Client {
+	if opts.TTL == 0 {
+		opts.TTL = DefaultTTL
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		ttl:     opts.TTL,
+		http:    opts.HTTPClient,
+		now:     time.Now,
+		cache:   make(map[[sha256.Size]byte]cached),
+	}
+}
+
+type tokenKey struct{}
+
+// WithToken returns ctx carrying the bearer token checks are made for
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// TokenFromContext returns the bearer token of ctx
+func TokenFromContext(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// TokenFromRequest returns the bearer token of r's Authorization header
+func TokenFromRequest(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Access returns the identity and permissions of the token in ctx
+func (c *Client) Access(ctx context.Context) (*Access, error) {
+	token := TokenFromContext(ctx)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	key := sha256.Sum256([]byte(token))
+	now := c.now()
+
+	c.mu.Lock()
+	entry, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.access, nil
+	}
+
+	access, err := c.fetch(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if c.ttl > 0 {
+		c.mu.Lock()
+		if len(c.cache) >= maxCached {
+			c.sweep(now)
+		}
+		c.cache[key] = cached{access: access, expires: now.Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return access, nil
+}
+
+// Permissions returns the permission names of the token in ctx, sorted
+func (c *Client) Permissions(ctx context.Context) ([]string, error) {
+	access, err := c.Access(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return access.Permissions, nil
+}
+
+// Check reports whether the owner of the token in ctx holds permission
+func (c *Client) Check(ctx context.Context, permission perm.Name) (bool, error) {
+	access, err := c.Access(ctx)
+	if err != nil {
+		return false, err
+	}
+	return access.Has(permission), nil
+}
+
+// Forget drops the cached permissions of token, e.g. after the service saw it revoked
+func (c *Client) Forget(token string) {
+	key := sha256.Sum256([]byte(token))
+	c.mu.Lock()
+	delete(c.cache, key)
+	c.mu.Unlock()
+}
+
+// Require wraps next so it only serves requests whose bearer token holds permission, answering
+// 401 or 403 in the application's error format otherwise. The token is put in the request
+// context for further checks.
+func (c *Client) Require(permission perm.Name, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithToken(r.Context(), TokenFromRequest(r))
+		allowed, err := c.Check(ctx, permission)
+		switch {
+		case errors.Is(err, ErrNoToken), errors.Is(err, ErrUnauthenticated):
+			httpapi.WriteErrorResponse(w, http.StatusUnauthorized, "Authentication required", "UNAUTHORIZED", nil)
+		case err != nil:
+			httpapi.WriteErrorResponse(w, http.StatusServiceUnavailable, "Authorization service unavailable", "AUTHORIZATION_UNAVAILABLE", nil)
+		case !allowed:
+			httpapi.WriteErrorResponse(w, http.StatusForbidden, "Insufficient permissions", "INSUFFICIENT_PERMISSIONS", map[string]string{"required": string(permission)})
+		default:
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+	})
+}
+
+func (c *Client) fetch(ctx context.Context, token string) (*Access, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+AccessPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("rbacclient: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, ErrUnauthenticated
+	case resp.StatusCode != http.StatusOK:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		return nil, fmt.Errorf("rbacclient: %s returned status %d", AccessPath, resp.StatusCode)
+	}
+	access := &Access{}
+	if err := json.NewDecoder(resp.Body).Decode(access); err != nil {
+		return nil, fmt.Errorf("rbacclient: decode access: %w", err)
+	}
+	sort.Strings(access.Permissions)
+	return access, nil
+}
+
+// sweep drops expired entries, or everything when none have expired. The caller holds mu.
+func (c *Client) sweep(now time.Time) {
+	for key, entry := range c.cache {
+		if !now.Before(entry.expires) {
+			delete(c.cache, key)
+		}
+	}
+	if len(c.cache) >= maxCached {
+		c.cache = make(map[[sha256.Size]byte]cached)
+	}
+}
@@ -0,0 +1,105 @@
+package rbacclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"base-app/pkg/perm"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAccessServer(t *testing.T, calls *int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		assert.Equal(t, AccessPath, r.URL.Path)
+		switch r.Header.Get("Authorization") {
+		case "Bearer alice-token":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"user_id": "kc-1", "username": "alice", "permissions": ["view_reports", "read_role"]}`))
+		case "Bearer broken-token":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckCachesPermissionsPerToken(t *testing.T) {
+	calls := 0
+	server := newAccessServer(t, &calls)
+	client := New(server.URL+"/", Options{TTL: time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	client.now = func() time.Time { return now }
+
+	ctx := WithToken(context.Background(), "alice-token")
+	allowed, err := client.Check(ctx, perm.ViewReports)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = client.Check(ctx, perm.DeleteRole)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	permissions, err := client.Permissions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"read_role", "view_reports"}, permissions)
+	assert.Equal(t, 1, calls, "permissions are cached for the TTL")
+
+	now = now.Add(2 * time.Minute)
+	_, err = client.Check(ctx, perm.ViewReports)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls, "expired entries are fetched again")
+
+	client.Forget("alice-token")
+	_, err = client.Check(ctx, perm.ViewReports)
+	require.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	_, err = client.Check(context.Background(), perm.ViewReports)
+	assert.ErrorIs(t, err, ErrNoToken)
+	_, err = client.Check(WithToken(context.Background(), "revoked-token"), perm.ViewReports)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestRequire(t *testing.T) {
+	calls := 0
+	server := newAccessServer(t, &calls)
+	client := New(server.URL, Options{})
+	handler := client.Require(perm.ViewReports, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "alice-token", TokenFromContext(r.Context()))
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	cases := []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer alice-token", http.StatusOK},
+		{"", http.StatusUnauthorized},
+		{"Bearer revoked-token", http.StatusUnauthorized},
+		{"Bearer broken-token", http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/reports", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, tc.status, w.Code, tc.authorization)
+	}
+
+	denied := client.Require(perm.DeleteRole, http.NotFoundHandler())
+	req := httptest.NewRequest(http.MethodGet, "/roles", nil)
+	req.Header.Set("Authorization", "Bearer alice-token")
+	w := httptest.NewRecorder()
+	denied.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "INSUFFICIENT_PERMISSIONS")
+}
@@ -0,0 +1,37 @@
+package redact
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestString(t *testing.T) {
+	cases := map[string]string{
+		"host=db user=app password=s3cret dbname=x":          "host=db user=app password=[REDACTED] dbname=x",
+		`{"client_secret":"abc","realm":"r"}`:                `{"client_secret":"[REDACTED]","realm":"r"}`,
+		"POST https://kc/token?refresh_token=xyz&a=1":        "POST https://kc/token?refresh_token=[REDACTED]&a=1",
+		"Authorization: Bearer abc.def":                      "Authorization: Bearer [REDACTED]",
+		"postgres://app:s3cret@db:5432/x":                    "postgres://app:[REDACTED]@db:5432/x",
+		"got eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln here": "got [REDACTED] here",
+		"401 Unauthorized: invalid_grant":                    "401 Unauthorized: invalid_grant",
+	}
+	for input, want := range cases {
+		assert.Equal(t, want, String(input), input)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	assert.Equal(t, "", Secret(""))
+	assert.Equal(t, Mask, Secret("x"))
+}
+
+func TestError(t *testing.T) {
+	assert.Nil(t, Error(nil))
+
+	base := errors.New("dial postgres://app:pw@db failed")
+	err := Error(base)
+	assert.Equal(t, "dial postgres://app:[REDACTED]@db failed", err.Error())
+	assert.True(t, errors.Is(err, base))
+}
@@ -0,0 +1,516 @@
+package schemacheck
+
+// Expected is the schema the migrations of pkg/migrations create. Keep it in step when adding
+// or changing tables.
+var Expected = []Table{
+	{
+		Name: "users",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"keycloak_id varchar",
+			"username varchar",
+			"email varchar",
+			"first_name varchar",
+			"last_name varchar",
+			"is_active bool",
+			"created_at timestamp",
+			"updated_at timestamp",
+			"phone text",
+			"attributes text",
+			"realm varchar(255) NOT NULL",
+			"password_hash text",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (id)",
+			"UNIQUE (keycloak_id)",
+			"UNIQUE (username)",
+			"UNIQUE (email)",
+		},
+		Indexes: []string{
+			"idx_users_username_lower UNIQUE btree (lower((username)::text))",
+			"idx_users_email_lower UNIQUE btree (lower((email)::text))",
+		},
+	},
+	{
+		Name: "roles",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"name varchar NOT NULL",
+			"description text",
+			"created_at timestamp NOT NULL",
+			"key varchar NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (name)", "UNIQUE (key)"},
+	},
+	{
+		Name: "permissions",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"name varchar NOT NULL",
+			"resource varchar NOT NULL",
+			"action varchar NOT NULL",
+			"category varchar NOT NULL",
+			"description text NOT NULL",
+			"risk_level varchar NOT NULL",
+			"key varchar NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (name)", "UNIQUE (key)"},
+	},
+	{
+		Name: "role_permissions",
+		Columns: []string{
+			"role_id uuid NOT NULL",
+			"permission_id uuid NOT NULL",
+			"granted_at timestamp",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (role_id, permission_id)",
+			"FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE",
+			"FOREIGN KEY (permission_id) REFERENCES permissions(id) ON DELETE CASCADE",
+		},
+		Indexes: []string{"idx_role_permissions_role_id btree (role_id)"},
+	},
+	{
+		Name: "role_scopes",
+		Columns: []string{
+			"role_id uuid NOT NULL",
+			"resource varchar NOT NULL",
+			"updated_by varchar NOT NULL",
+			"updated_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (role_id)",
+			"FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE",
+		},
+	},
+	{
+		Name: "permission_deprecations",
+		Columns: []string{
+			"permission_id uuid NOT NULL",
+			"replaced_by uuid",
+			"reason text NOT NULL",
+			"deprecated_by varchar NOT NULL",
+			"deprecated_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (permission_id)",
+			"FOREIGN KEY (permission_id) REFERENCES permissions(id) ON DELETE CASCADE",
+			"FOREIGN KEY (replaced_by) REFERENCES permissions(id) ON DELETE SET NULL",
+		},
+	},
+	{
+		Name: "role_groups",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"name varchar NOT NULL",
+			"description text",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (name)"},
+	},
+	{
+		Name: "group_roles",
+		Columns: []string{
+			"group_id uuid NOT NULL",
+			"role_id uuid NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (group_id, role_id)",
+			"FOREIGN KEY (group_id) REFERENCES role_groups(id) ON DELETE CASCADE",
+			"FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE",
+		},
+		Indexes: []string{"idx_group_roles_group_id btree (group_id)"},
+	},
+	{
+		Name: "user_group_memberships",
+		Columns: []string{
+			"user_id uuid NOT NULL",
+			"group_id uuid NOT NULL",
+			"assigned_at timestamp NOT NULL",
+			"expires_at timestamp",
+			"expiry_reminded_at timestamp",
+			"expiry_snoozed_until timestamp",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (user_id, group_id)",
+			"FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE",
+			"FOREIGN KEY (group_id) REFERENCES role_groups(id) ON DELETE CASCADE",
+		},
+		Indexes: []string{"idx_user_group_memberships_user_id btree (user_id)"},
+	},
+	{
+		Name: "group_membership_history",
+		Columns: []string{
+			"id int8 NOT NULL",
+			"group_id uuid NOT NULL",
+			"user_id uuid NOT NULL",
+			"action varchar NOT NULL",
+			"actor_id varchar NOT NULL",
+			"expires_at timestamp",
+			"occurred_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+		Indexes: []string{
+			"idx_group_membership_history_group btree (group_id, occurred_at)",
+			"idx_group_membership_history_user btree (user_id, occurred_at)",
+		},
+	},
+	{
+		Name: "group_templates",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"name varchar NOT NULL",
+			"name_pattern varchar NOT NULL",
+			"description text NOT NULL",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (name)"},
+	},
+	{
+		Name: "group_template_roles",
+		Columns: []string{
+			"template_id uuid NOT NULL",
+			"role_id uuid NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (template_id, role_id)",
+			"FOREIGN KEY (template_id) REFERENCES group_templates(id) ON DELETE CASCADE",
+			"FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE",
+		},
+	},
+	{
+		Name: "domain_group_rules",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"domain varchar NOT NULL",
+			"group_id uuid NOT NULL",
+			"created_by varchar NOT NULL",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (id)",
+			"UNIQUE (domain, group_id)",
+			"FOREIGN KEY (group_id) REFERENCES role_groups(id) ON DELETE CASCADE",
+		},
+	},
+	{
+		Name: "personal_access_tokens",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"user_id varchar NOT NULL",
+			"username varchar NOT NULL",
+			"name varchar NOT NULL",
+			"prefix varchar NOT NULL",
+			"token_hash varchar NOT NULL",
+			"permissions _text NOT NULL",
+			"expires_at timestamp NOT NULL",
+			"last_used_at timestamp",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (token_hash)"},
+		Indexes:     []string{"idx_personal_access_tokens_user_id btree (user_id)"},
+	},
+	{
+		Name: "token_denylist",
+		Columns: []string{
+			"kind varchar NOT NULL",
+			"value varchar NOT NULL",
+			"reason text NOT NULL",
+			"revoked_by varchar NOT NULL",
+			"revoked_at timestamp NOT NULL",
+			"expires_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (kind, value)"},
+		Indexes:     []string{"idx_token_denylist_expires_at btree (expires_at)"},
+	},
+	{
+		Name:        "permission_usage",
+		Columns:     []string{"name varchar NOT NULL", "last_checked_at timestamp NOT NULL"},
+		Constraints: []string{"PRIMARY KEY (name)"},
+	},
+	{
+		Name:        "role_usage",
+		Columns:     []string{"role_id uuid NOT NULL", "last_used_at timestamp NOT NULL"},
+		Constraints: []string{"PRIMARY KEY (role_id)"},
+	},
+	{
+		Name: "user_devices",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"user_id varchar NOT NULL",
+			"device_key varchar NOT NULL",
+			"name varchar NOT NULL",
+			"user_agent text NOT NULL",
+			"last_ip varchar NOT NULL",
+			"session_id varchar NOT NULL",
+			"first_seen_at timestamp NOT NULL",
+			"last_seen_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (user_id, device_key)"},
+	},
+	{
+		Name: "rbac_digest_subscriptions",
+		Columns: []string{
+			"user_id varchar NOT NULL",
+			"frequency varchar NOT NULL",
+			"last_sent_at timestamp",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (user_id)"},
+	},
+	{
+		Name: "entity_labels",
+		Columns: []string{
+			"kind varchar(20) NOT NULL",
+			"entity_id varchar NOT NULL",
+			"key varchar(63) NOT NULL",
+			"value varchar(63) NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (kind, entity_id, key)"},
+		Indexes:     []string{"idx_entity_labels_key_value btree (kind, key, value)"},
+	},
+	{
+		Name: "trash_items",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"kind varchar(20) NOT NULL",
+			"entity_id varchar NOT NULL",
+			"name varchar NOT NULL",
+			"deleted_by varchar NOT NULL",
+			"deleted_at timestamp NOT NULL",
+			"purge_at timestamp NOT NULL",
+			"data jsonb NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+		Indexes: []string{
+			"idx_trash_items_kind btree (kind, deleted_at)",
+			"idx_trash_items_purge_at btree (purge_at)",
+		},
+	},
+	{
+		Name: "email_templates",
+		Columns: []string{
+			"name varchar(50) NOT NULL",
+			"locale varchar(10) NOT NULL",
+			"version int4 NOT NULL",
+			"subject text NOT NULL",
+			"text_body text NOT NULL",
+			"html_body text NOT NULL",
+			"created_by varchar NOT NULL",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (name, locale, version)"},
+	},
+	{
+		Name: "refresh_tokens",
+		Columns: []string{
+			"token_hash varchar NOT NULL",
+			"family_id uuid NOT NULL",
+			"user_id varchar NOT NULL",
+			"realm varchar NOT NULL",
+			"session_id varchar NOT NULL",
+			"issued_at timestamp NOT NULL",
+			"rotated_at timestamp",
+			"revoked_at timestamp",
+		},
+		Constraints: []string{"PRIMARY KEY (token_hash)"},
+		Indexes: []string{
+			"idx_refresh_tokens_family_id btree (family_id)",
+			"idx_refresh_tokens_issued_at btree (issued_at)",
+		},
+	},
+	{
+		Name: "magic_link_codes",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"user_id uuid NOT NULL",
+			"code_hash varchar(64) NOT NULL",
+			"expires_at timestamp NOT NULL",
+			"used_at timestamp",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (id)",
+			"UNIQUE (code_hash)",
+			"FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE",
+		},
+		Indexes: []string{"idx_magic_link_codes_user_id btree (user_id)"},
+	},
+	{
+		Name: "saved_views",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"user_id varchar NOT NULL",
+			"list varchar(20) NOT NULL",
+			"name varchar(100) NOT NULL",
+			"query text NOT NULL",
+			"created_at timestamp NOT NULL",
+			"updated_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (user_id, list, name)"},
+	},
+	{
+		Name: "user_notes",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"user_id uuid NOT NULL",
+			"author_id varchar NOT NULL",
+			"author_name varchar NOT NULL",
+			"body text NOT NULL",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (id)",
+			"FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE",
+		},
+		Indexes: []string{"idx_user_notes_user_id btree (user_id, created_at)"},
+	},
+	{
+		Name: "settings",
+		Columns: []string{
+			"key varchar NOT NULL",
+			"value text NOT NULL",
+			"updated_by varchar",
+			"updated_at timestamp",
+		},
+		Constraints: []string{"PRIMARY KEY (key)"},
+	},
+	{
+		Name: "security_anomalies",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"subject_type varchar NOT NULL",
+			"subject varchar NOT NULL",
+			"failures int4 NOT NULL",
+			"kinds jsonb",
+			"window_start timestamp NOT NULL",
+			"detected_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+		Indexes:     []string{"idx_security_anomalies_detected_at btree (detected_at)"},
+	},
+	{
+		Name: "api_usage",
+		Columns: []string{
+			"period_start timestamp NOT NULL",
+			"client_id varchar NOT NULL",
+			"method varchar NOT NULL",
+			"route varchar NOT NULL",
+			"requests int8 NOT NULL",
+			"client_errors int8 NOT NULL",
+			"server_errors int8 NOT NULL",
+			"duration_ms int8 NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (period_start, client_id, method, route)"},
+	},
+	{
+		Name: "dead_letters",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"channel varchar(100) NOT NULL",
+			"type varchar(100) NOT NULL",
+			"status varchar(20) NOT NULL",
+			"payload jsonb NOT NULL",
+			"attempts jsonb NOT NULL",
+			"created_at timestamp NOT NULL",
+			"updated_at timestamp NOT NULL",
+			"replayed_at timestamp",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+		Indexes:     []string{"idx_dead_letters_status btree (status, created_at)"},
+	},
+	{
+		Name: "operations",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"kind varchar(100) NOT NULL",
+			"status varchar(20) NOT NULL",
+			"created_by varchar(255) NOT NULL",
+			"processed int4 NOT NULL",
+			"total int4 NOT NULL",
+			"result jsonb",
+			"error text NOT NULL",
+			"created_at timestamp NOT NULL",
+			"updated_at timestamp NOT NULL",
+			"finished_at timestamp",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+	},
+	{
+		Name: "tenants",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"slug varchar(40) NOT NULL",
+			"name varchar(100) NOT NULL",
+			"schema_name varchar(63) NOT NULL",
+			"admin_email varchar(255) NOT NULL",
+			"role_names _text NOT NULL",
+			"group_names _text NOT NULL",
+			"created_by varchar(255) NOT NULL",
+			"created_at timestamp NOT NULL",
+			"suspended_at timestamp",
+			"suspend_reason varchar(500) NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)", "UNIQUE (slug)"},
+	},
+	{
+		Name: "tenant_invitations",
+		Columns: []string{
+			"id uuid NOT NULL",
+			"tenant_id uuid NOT NULL",
+			"email varchar(255) NOT NULL",
+			"code_hash varchar(64) NOT NULL",
+			"group_names _text NOT NULL",
+			"expires_at timestamp NOT NULL",
+			"accepted_by varchar(255)",
+			"accepted_at timestamp",
+			"created_at timestamp NOT NULL",
+		},
+		Constraints: []string{
+			"PRIMARY KEY (id)",
+			"UNIQUE (code_hash)",
+			"FOREIGN KEY (tenant_id) REFERENCES tenants(id) ON DELETE CASCADE",
+		},
+	},
+	{
+		Name: "tenant_usage",
+		Columns: []string{
+			"period_start timestamp NOT NULL",
+			"tenant varchar(40) NOT NULL",
+			"requests int8 NOT NULL",
+			"client_errors int8 NOT NULL",
+			"server_errors int8 NOT NULL",
+			"duration_ms int8 NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (period_start, tenant)"},
+	},
+	{
+		Name: "audit_logs",
+		Columns: []string{
+			"id int8 NOT NULL",
+			"actor_id varchar NOT NULL",
+			"action varchar(20) NOT NULL",
+			"resource_type varchar(50) NOT NULL",
+			"resource_id varchar NOT NULL",
+			"before jsonb",
+			"after jsonb",
+			"client_ip varchar NOT NULL",
+			"occurred_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (id)"},
+		Indexes: []string{
+			"idx_audit_logs_actor btree (actor_id, occurred_at)",
+			"idx_audit_logs_occurred_at btree (occurred_at)",
+			"idx_audit_logs_resource btree (resource_type, resource_id, occurred_at)",
+		},
+	},
+	{
+		Name: "schema_migrations",
+		Columns: []string{
+			"version int8 NOT NULL",
+			"name varchar NOT NULL",
+			"applied_at timestamp NOT NULL",
+		},
+		Constraints: []string{"PRIMARY KEY (version)"},
+	},
+}
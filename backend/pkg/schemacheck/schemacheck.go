@@ -0,0 +1,243 @@
+// Package schemacheck compares the live database schema with the one the application's
+// migrations create, catching tables someone edited by hand: changed or extra columns, dropped
+// indexes, loosened constraints.
+package schemacheck
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"base-app/pkg/database"
+
+	"github.com/lib/pq"
+)
+
+// Table is the schema of one table. Columns read "name type" with a trailing NOT NULL, types as
+// Postgres names them (varchar(255), int4, timestamp, _text for text[]). Constraints are their
+// definitions, e.g. "UNIQUE (username)", whatever they are named. Indexes other than those of
+// constraints read "name [UNIQUE ]method (columns)".
+type Table struct {
+	Name        string
+	Columns     []string
+	Constraints []string
+	Indexes     []string
+}
+
+// Drift is one difference between the expected and the live schema; Expected is empty for
+// objects that should not be there and Actual for those that are missing
+type Drift struct {
+	Table    string `json:"table"`
+	Object   string `json:"object"`
+	Name     string `json:"name"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+func (d Drift) String() string {
+	switch {
+	case d.Actual == "":
+		return fmt.Sprintf("- %s: missing %s %s", d.Table, d.Object, d.Expected)
+	case d.Expected == "":
+		return fmt.Sprintf("+ %s: unexpected %s %s", d.Table, d.Object, d.Actual)
+	default:
+		return fmt.Sprintf("~ %s: %s %s is %s, expected %s", d.Table, d.Object, d.Name, d.Actual, d.Expected)
+	}
+}
+
+// Report lists the drifts found, ordered by table
+type Report []Drift
+
+// String renders the report as a diff, one drift per line
+func (r Report) String() string {
+	lines := make([]string, len(r))
+	for i, d := range r {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Check inspects the tables of expected in the current schema of db and reports how they differ.
+// Tables outside expected are not looked at.
+func Check(db database.Querier, expected []Table) (Report, error) {
+	names := make([]string, len(expected))
+	for i, t := range expected {
+		names[i] = t.Name
+	}
+	actual, err := Inspect(db, names)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(expected, actual), nil
+}
+
+// Inspect reads the schema of the named tables; tables that do not exist are left out
+func Inspect(db database.Querier, names []string) ([]Table, error) {
+	tables := make(map[string]*Table)
+	table := func(name string) *Table {
+		if tables[name] == nil {
+			tables[name] = &Table{Name: name}
+		}
+		return tables[name]
+	}
+
+	err := database.QueryEach(db, "inspect columns", func(row database.Scanner) error {
+		var tableName, column, udt, nullable string
+		var length *int
+		if err := row.Scan(&tableName, &column, &udt, &length, &nullable); err != nil {
+			return err
+		}
+		table(tableName).Columns = append(table(tableName).Columns, columnDef(column, udt, length, nullable == "NO"))
+		return nil
+	}, `SELECT table_name, column_name, udt_name, character_maximum_length, is_nullable
+	    FROM information_schema.columns
+	    WHERE table_schema = current_schema() AND table_name = ANY($1)
+	    ORDER BY table_name, ordinal_position`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.QueryEach(db, "inspect constraints", func(row database.Scanner) error {
+		var tableName, def string
+		if err := row.Scan(&tableName, &def); err != nil {
+			return err
+		}
+		if tables[tableName] != nil {
+			table(tableName).Constraints = append(table(tableName).Constraints, def)
+		}
+		return nil
+	}, `SELECT t.relname, pg_get_constraintdef(c.oid)
+	    FROM pg_constraint c JOIN pg_class t ON t.oid = c.conrelid
+	    WHERE t.relnamespace = current_schema()::regnamespace AND t.relname = ANY($1)
+	      AND c.contype IN ('p', 'u', 'f', 'c')`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.QueryEach(db, "inspect indexes", func(row database.Scanner) error {
+		var tableName, name, def string
+		if err := row.Scan(&tableName, &name, &def); err != nil {
+			return err
+		}
+		if tables[tableName] != nil {
+			table(tableName).Indexes = append(table(tableName).Indexes, indexDef(name, def))
+		}
+		return nil
+	}, `SELECT t.relname, i.relname, pg_get_indexdef(i.oid)
+	    FROM pg_index x
+	    JOIN pg_class i ON i.oid = x.indexrelid
+	    JOIN pg_class t ON t.oid = x.indrelid
+	    WHERE t.relnamespace = current_schema()::regnamespace AND t.relname = ANY($1)
+	      AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.oid)`, pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Table, 0, len(tables))
+	for _, t := range tables {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// columnDef formats a column the way Table lists them
+func columnDef(name, udt string, length *int, notNull bool) string {
+	def := name + " " + udt
+	if length != nil {
+		def += fmt.Sprintf("(%d)", *length)
+	}
+	if notNull {
+		def += " NOT NULL"
+	}
+	return def
+}
+
+// indexDef formats an index from its name and pg_get_indexdef, which reads
+// "CREATE [UNIQUE] INDEX name ON schema.table USING method (columns)"
+func indexDef(name, def string) string {
+	formatted := name
+	if strings.HasPrefix(def, "CREATE UNIQUE INDEX") {
+		formatted += " UNIQUE"
+	}
+	if i := strings.Index(def, " USING "); i >= 0 {
+		formatted += " " + def[i+len(" USING "):]
+	}
+	return formatted
+}
+
+// Diff reports how actual differs from expected; tables only in actual are ignored
+func Diff(expected, actual []Table) Report {
+	live := make(map[string]Table, len(actual))
+	for _, t := range actual {
+		live[t.Name] = t
+	}
+
+	var report Report
+	for _, want := range expected {
+		got, ok := live[want.Name]
+		if !ok {
+			report = append(report, Drift{Table: want.Name, Object: "table", Name: want.Name, Expected: want.Name})
+			continue
+		}
+		report = append(report, diffNamed(want.Name, "column", want.Columns, got.Columns)...)
+		report = append(report, diffNamed(want.Name, "index", want.Indexes, got.Indexes)...)
+		report = append(report, diffSet(want.Name, "constraint", want.Constraints, got.Constraints)...)
+	}
+	return report
+}
+
+// diffNamed compares definitions that start with their name, reporting a changed definition
+// once rather than as a missing and an unexpected one
+func diffNamed(table, object string, expected, actual []string) []Drift {
+	byName := func(defs []string) map[string]string {
+		m := make(map[string]string, len(defs))
+		for _, def := range defs {
+			m[strings.Fields(def)[0]] = def
+		}
+		return m
+	}
+	want, got := byName(expected), byName(actual)
+
+	var drifts []Drift
+	for _, name := range sortedKeys(want, got) {
+		if want[name] != got[name] {
+			drifts = append(drifts, Drift{Table: table, Object: object, Name: name, Expected: want[name], Actual: got[name]})
+		}
+	}
+	return drifts
+}
+
+// diffSet compares definitions that have no stable name
+func diffSet(table, object string, expected, actual []string) []Drift {
+	toSet := func(defs []string) map[string]string {
+		m := make(map[string]string, len(defs))
+		for _, def := range defs {
+			m[def] = def
+		}
+		return m
+	}
+	want, got := toSet(expected), toSet(actual)
+
+	var drifts []Drift
+	for _, def := range sortedKeys(want, got) {
+		if want[def] != got[def] {
+			drifts = append(drifts, Drift{Table: table, Object: object, Name: def, Expected: want[def], Actual: got[def]})
+		}
+	}
+	return drifts
+}
+
+func sortedKeys(a, b map[string]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
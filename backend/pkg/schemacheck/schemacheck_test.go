@@ -0,0 +1,80 @@
+package schemacheck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var expectedNotes = []Table{{
+	Name:        "user_notes",
+	Columns:     []string{"id uuid NOT NULL", "user_id uuid NOT NULL", "body text NOT NULL"},
+	Constraints: []string{"PRIMARY KEY (id)", "FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE"},
+	Indexes:     []string{"idx_user_notes_user_id btree (user_id, created_at)"},
+}, {
+	Name:    "saved_views",
+	Columns: []string{"id uuid NOT NULL"},
+}}
+
+func TestCheckReportsHandEditedTables(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery("FROM information_schema.columns").WillReturnRows(
+		sqlmock.NewRows([]string{"table_name", "column_name", "udt_name", "character_maximum_length", "is_nullable"}).
+			AddRow("user_notes", "id", "uuid", nil, "NO").
+			AddRow("user_notes", "user_id", "uuid", nil, "NO").
+			AddRow("user_notes", "body", "varchar", 500, "YES").
+			AddRow("user_notes", "pinned", "bool", nil, "YES"))
+	mock.ExpectQuery("FROM pg_constraint").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "def"}).
+			AddRow("user_notes", "PRIMARY KEY (id)").
+			AddRow("user_notes", "FOREIGN KEY (user_id) REFERENCES users(id)"))
+	mock.ExpectQuery("FROM pg_index").WillReturnRows(
+		sqlmock.NewRows([]string{"relname", "relname", "def"}).
+			AddRow("user_notes", "idx_user_notes_user_id", "CREATE INDEX idx_user_notes_user_id ON public.user_notes USING btree (user_id)").
+			AddRow("user_notes", "idx_user_notes_body", "CREATE UNIQUE INDEX idx_user_notes_body ON public.user_notes USING btree (body)"))
+
+	report, err := Check(db, expectedNotes)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, Report{
+		{Table: "user_notes", Object: "column", Name: "body", Expected: "body text NOT NULL", Actual: "body varchar(500)"},
+		{Table: "user_notes", Object: "column", Name: "pinned", Actual: "pinned bool"},
+		{Table: "user_notes", Object: "index", Name: "idx_user_notes_body", Actual: "idx_user_notes_body UNIQUE btree (body)"},
+		{Table: "user_notes", Object: "index", Name: "idx_user_notes_user_id", Expected: "idx_user_notes_user_id btree (user_id, created_at)", Actual: "idx_user_notes_user_id btree (user_id)"},
+		{Table: "user_notes", Object: "constraint", Name: "FOREIGN KEY (user_id) REFERENCES users(id)", Actual: "FOREIGN KEY (user_id) REFERENCES users(id)"},
+		{Table: "user_notes", Object: "constraint", Name: "FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE", Expected: "FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE"},
+		{Table: "saved_views", Object: "table", Name: "saved_views", Expected: "saved_views"},
+	}, report)
+
+	lines := strings.Split(report.String(), "\n")
+	assert.Equal(t, "~ user_notes: column body is body varchar(500), expected body text NOT NULL", lines[0])
+	assert.Equal(t, "+ user_notes: unexpected column pinned bool", lines[1])
+	assert.Equal(t, "- saved_views: missing table saved_views", lines[6])
+}
+
+func TestDiffOfMatchingSchemaIsEmpty(t *testing.T) {
+	assert.Empty(t, Diff(Expected, Expected))
+}
+
+func TestExpectedNamesAreUnique(t *testing.T) {
+	tables := make(map[string]bool)
+	for _, table := range Expected {
+		assert.False(t, tables[table.Name], "table %s listed twice", table.Name)
+		tables[table.Name] = true
+		for _, defs := range [][]string{table.Columns, table.Indexes} {
+			names := make(map[string]bool)
+			for _, def := range defs {
+				name := strings.Fields(def)[0]
+				assert.False(t, names[name], "%s.%s listed twice", table.Name, name)
+				names[name] = true
+			}
+		}
+	}
+}
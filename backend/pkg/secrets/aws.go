@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// AWSOptions configures the AWS Secrets Manager provider. Credentials and region come from
+// the SDK's default chain (environment, shared config, IAM role); Region overrides the latter.
+type AWSOptions struct {
+	Region string
+	// Endpoint overrides the service endpoint, e.g. for LocalStack
+	Endpoint string
+}
+
+// AWS reads JSON secrets from AWS Secrets Manager
+type AWS struct {
+	client *secretsmanager.Client
+}
+
+// NewAWS creates an AWS Secrets Manager provider
+func NewAWS(ctx context.Context, opts AWSOptions) (*AWS, error) {
+	var loadOpts []func(*awsconfig.LoadOptions) error
+	if opts.Region != "" {
+		loadOpts = append(loadOpts, awsconfig.WithRegion(opts.Region))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, err
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+	})
+	return &AWS{client: client}, nil
+}
+
+// Fetch reads the current version of the secret name (an ID or ARN); its value must be a JSON object
+func (a *AWS) Fetch(ctx context.Context, name string) (Secret, error) {
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	if out.SecretString == nil {
+		return nil, errors.New("binary secrets are not supported")
+	}
+	return parseJSON([]byte(*out.SecretString))
+}
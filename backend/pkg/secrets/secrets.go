@@ -0,0 +1,181 @@
+// Package secrets loads credentials from an external secret manager (Vault or AWS Secrets
+// Manager) and re-fetches them periodically so rotated values take effect without a restart.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"base-app/pkg/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Secret is the set of key/value pairs stored under one secret name
+type Secret map[string]string
+
+// Get returns the value for key, or fallback when the key is missing or empty
+func (s Secret) Get(key, fallback string) string {
+	if v := s[key]; v != "" {
+		return v
+	}
+	return fallback
+}
+
+// equal reports whether two secrets hold the same pairs
+func (s Secret) equal(other Secret) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for k, v := range s {
+		if other[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Provider fetches a secret by name from a backing secret manager
+type Provider interface {
+	Fetch(ctx context.Context, name string) (Secret, error)
+}
+
+// Store caches secrets fetched from a provider, refreshes them periodically and notifies
+// watchers when a value changes
+type Store struct {
+	provider Provider
+	logger   *logrus.Logger
+
+	mu       sync.RWMutex
+	values   map[string]Secret
+	watchers map[string][]func(Secret)
+}
+
+// NewStore creates a store backed by provider
+func NewStore(provider Provider, logger *logrus.Logger) *Store {
+	return &Store{
+		provider: provider,
+		logger:   logger,
+		values:   make(map[string]Secret),
+		watchers: make(map[string][]func(Secret)),
+	}
+}
+
+// Load fetches name and keeps it in the store so later refreshes re-fetch it
+func (s *Store) Load(ctx context.Context, name string) (Secret, error) {
+	secret, err := s.provider.Fetch(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("fetch secret %s: %w", name, err)
+	}
+	s.mu.Lock()
+	s.values[name] = secret
+	s.mu.Unlock()
+	return secret, nil
+}
+
+// Get returns the cached value of name, or nil if it was never loaded
+func (s *Store) Get(name string) Secret {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[name]
+}
+
+// Watch registers fn to be called with the new value whenever a refresh changes name
+func (s *Store) Watch(name string, fn func(Secret)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers[name] = append(s.watchers[name], fn)
+}
+
+// Refresh re-fetches every loaded secret. A failed fetch keeps the previous value so a
+// secret manager outage never drops working credentials.
+func (s *Store) Refresh(ctx context.Context) {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+
+	for _, name := range names {
+		secret, err := s.provider.Fetch(ctx, name)
+		if err != nil {
+			s.logger.WithError(err).WithField("secret", name).Warn("Failed to refresh secret, keeping previous value")
+			continue
+		}
+
+		s.mu.Lock()
+		changed := !s.values[name].equal(secret)
+		s.values[name] = secret
+		watchers := append([]func(Secret){}, s.watchers[name]...)
+		s.mu.Unlock()
+
+		if changed {
+			s.logger.WithField("secret", name).Info("Secret rotated")
+			for _, fn := range watchers {
+				fn(secret)
+			}
+		}
+	}
+}
+
+// StartRefresh re-fetches secrets every interval until ctx is cancelled
+func (s *Store) StartRefresh(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Refresh(ctx)
+			}
+		}
+	}()
+}
+
+// parseJSON decodes a secret stored as a JSON object; non-string values keep their JSON form
+func parseJSON(raw []byte) (Secret, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	return fromMap(fields), nil
+}
+
+// fromMap converts decoded secret data into a Secret
+func fromMap(fields map[string]interface{}) Secret {
+	secret := make(Secret, len(fields))
+	for k, v := range fields {
+		switch value := v.(type) {
+		case string:
+			secret[k] = value
+		case nil:
+		default:
+			encoded, _ := json.Marshal(value)
+			secret[k] = string(encoded)
+		}
+	}
+	return secret
+}
+
+// New creates the provider selected by cfg, or returns nil when no secret manager is configured
+func New(ctx context.Context, cfg config.SecretsConfig) (Provider, error) {
+	switch cfg.Provider {
+	case "":
+		return nil, nil
+	case "vault":
+		return NewVault(VaultOptions{Mount: cfg.VaultMount})
+	case "aws":
+		return NewAWS(ctx, AWSOptions{Region: cfg.AWSRegion, Endpoint: cfg.AWSEndpoint})
+	default:
+		return nil, fmt.Errorf("unknown secrets provider %q", cfg.Provider)
+	}
+}
@@ -0,0 +1,142 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider serves secrets from a map and can be told to fail
+type fakeProvider struct {
+	mu      sync.Mutex
+	secrets map[string]Secret
+	err     error
+}
+
+func (p *fakeProvider) Fetch(_ context.Context, name string) (Secret, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	secret, ok := p.secrets[name]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return secret, nil
+}
+
+func (p *fakeProvider) set(name string, secret Secret, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.secrets[name] = secret
+	p.err = err
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestStoreRefreshNotifiesOnRotation(t *testing.T) {
+	provider := &fakeProvider{secrets: map[string]Secret{"db": {"username": "app", "password": "v1"}}}
+	store := NewStore(provider, quietLogger())
+
+	secret, err := store.Load(context.Background(), "db")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", secret["password"])
+
+	var notified []string
+	store.Watch("db", func(s Secret) { notified = append(notified, s["password"]) })
+
+	// Unchanged value: no notification
+	store.Refresh(context.Background())
+	assert.Empty(t, notified)
+
+	provider.set("db", Secret{"username": "app", "password": "v2"}, nil)
+	store.Refresh(context.Background())
+	assert.Equal(t, []string{"v2"}, notified)
+	assert.Equal(t, "v2", store.Get("db")["password"])
+
+	// A failing provider keeps the last good value
+	provider.set("db", Secret{"password": "v3"}, errors.New("vault sealed"))
+	store.Refresh(context.Background())
+	assert.Equal(t, "v2", store.Get("db")["password"])
+	assert.Len(t, notified, 1)
+}
+
+func TestStoreLoadFails(t *testing.T) {
+	store := NewStore(&fakeProvider{secrets: map[string]Secret{}}, quietLogger())
+
+	_, err := store.Load(context.Background(), "missing")
+	assert.Error(t, err)
+	assert.Nil(t, store.Get("missing"))
+}
+
+func TestSecretGet(t *testing.T) {
+	secret := Secret{"password": "p", "empty": ""}
+	assert.Equal(t, "p", secret.Get("password", "fallback"))
+	assert.Equal(t, "fallback", secret.Get("empty", "fallback"))
+
+	var none Secret
+	assert.Equal(t, "fallback", none.Get("password", "fallback"))
+}
+
+func TestVaultFetchesKVv2(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/kv/data/base-app/db", r.URL.Path)
+		assert.Equal(t, "test-token", r.Header.Get("X-Vault-Token"))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"username": "app", "password": "s3cret", "port": 5432},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		})
+	}))
+	defer server.Close()
+
+	provider, err := NewVault(VaultOptions{Address: server.URL, Token: "test-token", Mount: "kv"})
+	require.NoError(t, err)
+
+	secret, err := provider.Fetch(context.Background(), "base-app/db")
+	require.NoError(t, err)
+	assert.Equal(t, Secret{"username": "app", "password": "s3cret", "port": "5432"}, secret)
+}
+
+func TestAWSFetchesSecretString(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		var input map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		assert.Equal(t, "base-app/keycloak", input["SecretId"])
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]string{
+			"Name":         "base-app/keycloak",
+			"SecretString": `{"client_secret":"abc","admin_password":"xyz"}`,
+		})
+	}))
+	defer server.Close()
+
+	provider, err := NewAWS(context.Background(), AWSOptions{Region: "eu-central-1", Endpoint: server.URL})
+	require.NoError(t, err)
+
+	secret, err := provider.Fetch(context.Background(), "base-app/keycloak")
+	require.NoError(t, err)
+	assert.Equal(t, Secret{"client_secret": "abc", "admin_password": "xyz"}, secret)
+}
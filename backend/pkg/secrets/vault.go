@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"context"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+// VaultOptions configures the Vault provider. Address and Token fall back to the standard
+// VAULT_ADDR and VAULT_TOKEN environment variables read by the Vault client.
+type VaultOptions struct {
+	Address string
+	Token   string
+	// Mount is the KV v2 secrets engine mount, "secret" by default
+	Mount string
+}
+
+// Vault reads secrets from a KV v2 secrets engine
+type Vault struct {
+	kv *vault.KVv2
+}
+
+// NewVault creates a Vault provider
+func NewVault(opts VaultOptions) (*Vault, error) {
+	cfg := vault.DefaultConfig()
+	if cfg.Error != nil {
+		return nil, cfg.Error
+	}
+	if opts.Address != "" {
+		cfg.Address = opts.Address
+	}
+	client, err := vault.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token != "" {
+		client.SetToken(opts.Token)
+	}
+	mount := opts.Mount
+	if mount == "" {
+		mount = "secret"
+	}
+	return &Vault{kv: client.KVv2(mount)}, nil
+}
+
+// Fetch reads the latest version of the secret at path name
+func (v *Vault) Fetch(ctx context.Context, name string) (Secret, error) {
+	secret, err := v.kv.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return fromMap(secret.Data), nil
+}
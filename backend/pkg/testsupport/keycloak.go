@@ -0,0 +1,669 @@
+// Package testsupport holds fakes of the application's external services, so tests of the
+// code talking to them run hermetically.
+//
+// Keycloak is an httptest server speaking the parts of the Keycloak API the application uses:
+// the token endpoint with token exchange, the JWKS of the realm and the admin user APIs. Every request is recorded,
+// so tests can assert on the interactions, and failures can be injected per endpoint.
+//
+//	kc := testsupport.NewKeycloak(t, "base")
+//	kc.AddUser(testsupport.KeycloakUser{Username: "alice", Password: "secret"})
+//	service := user_management.NewUserService(repo, user_management.KeycloakConfig{
+//		URL: kc.URL, Realm: kc.Realm, ClientID: kc.ClientID, ClientSecret: kc.ClientSecret,
+//		AdminUsername: kc.AdminUsername, AdminPassword: kc.AdminPassword,
+//	}, logger)
+package testsupport
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Default credentials of a fake Keycloak
+const (
+	DefaultClientID      = "base-app"
+	DefaultClientSecret  = "client-secret"
+	DefaultAdminUsername = "admin"
+	DefaultAdminPassword = "admin"
+)
+
+// adminClientID is the client gocloak's LoginAdmin authenticates with
+const adminClientID = "admin-cli"
+
+// KeycloakUser is a user of the fake realm
+type KeycloakUser struct {
+	ID         string
+	Username   string
+	Email      string
+	FirstName  string
+	LastName   string
+	Disabled   bool
+	Password   string
+	Attributes map[string][]string
+	// Identities are the linked identity provider accounts
+	Identities []gocloak.FederatedIdentityRepresentation
+}
+
+// Interaction is one recorded request to the fake
+type Interaction struct {
+	Method string
+	Path   string
+	// Form holds the form fields of token requests, passwords and secrets left out
+	Form map[string]string
+	// Body is the JSON body of admin API requests
+	Body   json.RawMessage
+	Status int
+}
+
+type failure struct {
+	method string
+	suffix string
+	status int
+	body   string
+}
+
+// Keycloak is a fake Keycloak serving one realm
+type Keycloak struct {
+	URL           string
+	Realm         string
+	ClientID      string
+	ClientSecret  string
+	AdminUsername string
+	AdminPassword string
+	// TokenTTL is the lifetime of issued access tokens
+	TokenTTL time.Duration
+	// HMACSecret, when set, signs access tokens with HS256 instead of the realm's RSA key, as
+	// the rbac module verifies them with JWT_SECRET
+	HMACSecret string
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	keyID  string
+
+	mu       sync.Mutex
+	users    map[string]*KeycloakUser
+	sessions map[string]string // session ID to user ID
+	refresh  map[string]string // refresh token to session ID
+	admin    map[string]bool   // access tokens of admin logins
+	failures []failure
+	calls    []Interaction
+}
+
+// NewKeycloak starts a fake Keycloak for realm, closed when the test ends
+func NewKeycloak(t testing.TB, realm string) *Keycloak {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("testsupport: generate realm key: %v", err)
+	}
+	k := &Keycloak{
+		Realm:         realm,
+		ClientID:      DefaultClientID,
+		ClientSecret:  DefaultClientSecret,
+		AdminUsername: DefaultAdminUsername,
+		AdminPassword: DefaultAdminPassword,
+		TokenTTL:      5 * time.Minute,
+		key:           key,
+		keyID:         uuid.NewString(),
+		users:         make(map[string]*KeycloakUser),
+		sessions:      make(map[string]string),
+		refresh:       make(map[string]string),
+		admin:         make(map[string]bool),
+	}
+	k.server = httptest.NewServer(http.HandlerFunc(k.serve))
+	k.URL = k.server.URL
+	t.Cleanup(k.server.Close)
+	return k
+}
+
+// Issuer is the iss claim of the realm's tokens
+func (k *Keycloak) Issuer() string {
+	return k.URL + "/realms/" + k.Realm
+}
+
+// PublicKey is the key access tokens are signed with, unless HMACSecret is set
+func (k *Keycloak) PublicKey() *rsa.PublicKey {
+	return &k.key.PublicKey
+}
+
+// AddUser adds user to the realm and returns its ID, generated when user has none
+func (k *Keycloak) AddUser(user KeycloakUser) string {
+	if user.ID == "" {
+		user.ID = uuid.NewString()
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.users[user.ID] = &user
+	return user.ID
+}
+
+// User returns a copy of the user with id, or nil
+func (k *Keycloak) User(id string) *KeycloakUser {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if user, ok := k.users[id]; ok {
+		copied := *user
+		return &copied
+	}
+	return nil
+}
+
+// UserByUsername returns a copy of the user named username, or nil
+func (k *Keycloak) UserByUsername(username string) *KeycloakUser {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if user := k.findUser(username); user != nil {
+		copied := *user
+		return &copied
+	}
+	return nil
+}
+
+// Sessions returns the number of active sessions of the user with id
+func (k *Keycloak) Sessions(id string) int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	n := 0
+	for _, userID := range k.sessions {
+		if userID == id {
+			n++
+		}
+	}
+	return n
+}
+
+// Fail makes the next request with method and a path ending in suffix answer status and body,
+// e.g. Fail("PUT", "/reset-password", 400, `{"error": "invalidPasswordMinLengthMessage"}`)
+func (k *Keycloak) Fail(method, suffix string, status int, body string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failures = append(k.failures, failure{method: method, suffix: suffix, status: status, body: body})
+}
+
+// Calls returns the requests served so far
+func (k *Keycloak) Calls() []Interaction {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]Interaction(nil), k.calls...)
+}
+
+// CallsTo returns the requests with method and a path ending in suffix
+func (k *Keycloak) CallsTo(method, suffix string) []Interaction {
+	var matching []Interaction
+	for _, call := range k.Calls() {
+		if call.Method == method && strings.HasSuffix(call.Path, suffix) {
+			matching = append(matching, call)
+		}
+	}
+	return matching
+}
+
+// recorder captures the status written by a handler
+type recorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (k *Keycloak) serve(w http.ResponseWriter, r *http.Request) {
+	call := Interaction{Method: r.Method, Path: r.URL.Path}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.ParseForm()
+		call.Form = make(map[string]string)
+		for name := range r.PostForm {
+			if name != "password" && name != "client_secret" {
+				call.Form[name] = r.PostForm.Get(name)
+			}
+		}
+	} else if r.Body != nil {
+		var body json.RawMessage
+		if json.NewDecoder(r.Body).Decode(&body) == nil {
+			call.Body = body
+		}
+	}
+	rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+	w.Header().Set("Content-Type", "application/json")
+
+	k.mu.Lock()
+	defer func() {
+		call.Status = rec.status
+		k.calls = append(k.calls, call)
+		k.mu.Unlock()
+	}()
+
+	for i, f := range k.failures {
+		if f.method == r.Method && strings.HasSuffix(r.URL.Path, f.suffix) {
+			k.failures = append(k.failures[:i], k.failures[i+1:]...)
+			rec.WriteHeader(f.status)
+			w.Write([]byte(f.body))
+			return
+		}
+	}
+
+	realmPath := "/realms/" + k.Realm + "/protocol/openid-connect/"
+	adminPath := "/admin/realms/" + k.Realm + "/users"
+	sessionsPath := "/admin/realms/" + k.Realm + "/sessions/"
+	switch {
+	case r.URL.Path == realmPath+"token" && r.Method == http.MethodPost:
+		k.token(rec, r)
+	case r.URL.Path == realmPath+"certs" && r.Method == http.MethodGet:
+		k.certs(rec)
+	case strings.HasPrefix(r.URL.Path, adminPath):
+		if !k.admin[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			writeError(rec, http.StatusUnauthorized, "HTTP 401 Unauthorized")
+			return
+		}
+		k.adminUsers(rec, r, call.Body, strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminPath), "/"), "/"))
+	case strings.HasPrefix(r.URL.Path, sessionsPath) && r.Method == http.MethodDelete:
+		if !k.admin[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+			writeError(rec, http.StatusUnauthorized, "HTTP 401 Unauthorized")
+			return
+		}
+		sessionID := strings.TrimPrefix(r.URL.Path, sessionsPath)
+		if _, ok := k.sessions[sessionID]; !ok {
+			writeError(rec, http.StatusNotFound, "Session not found")
+			return
+		}
+		delete(k.sessions, sessionID)
+		k.dropRefreshTokens()
+		rec.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(rec, http.StatusNotFound, "Unable to find matching target resource method")
+	}
+}
+
+func (k *Keycloak) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != adminClientID && (clientID != k.ClientID || clientSecret != k.ClientSecret) {
+		writeTokenError(w, http.StatusUnauthorized, "unauthorized_client", "Invalid client or Invalid client credentials")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "password":
+		username, password := r.PostForm.Get("username"), r.PostForm.Get("password")
+		if clientID == adminClientID {
+			if username != k.AdminUsername || password != k.AdminPassword {
+				writeTokenError(w, http.StatusUnauthorized, "invalid_grant", "Invalid user credentials")
+				return
+			}
+			k.issue(w, clientID, &KeycloakUser{ID: "admin", Username: username}, true, "", "")
+			return
+		}
+		user := k.findUser(username)
+		if user == nil || user.Password == "" || user.Password != password {
+			writeTokenError(w, http.StatusUnauthorized, "invalid_grant", "Invalid user credentials")
+			return
+		}
+		if user.Disabled {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Account disabled")
+			return
+		}
+		k.issue(w, clientID, user, false, "", "")
+	case "client_credentials":
+		if clientID == adminClientID {
+			writeTokenError(w, http.StatusUnauthorized, "unauthorized_client", "Public client not allowed to retrieve service account")
+			return
+		}
+		k.issue(w, clientID, &KeycloakUser{ID: "service-account-" + clientID, Username: "service-account-" + clientID}, true, "", "")
+	case "refresh_token":
+		sessionID, ok := k.refresh[r.PostForm.Get("refresh_token")]
+		user := k.users[k.sessions[sessionID]]
+		if !ok || user == nil {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+			return
+		}
+		delete(k.refresh, r.PostForm.Get("refresh_token"))
+		delete(k.sessions, sessionID)
+		k.issue(w, clientID, user, false, "", "")
+	case TokenExchangeGrant:
+		k.exchange(w, r, clientID)
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+	}
+}
+
+// TokenExchangeGrant is the grant_type of token exchange requests
+const TokenExchangeGrant = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// exchange serves token exchange. With requested_subject the client's service account
+// impersonates that user, starting a session; otherwise the subject token's user gets a token
+// for the requested audience, without a session. The caller holds mu.
+func (k *Keycloak) exchange(w http.ResponseWriter, r *http.Request, clientID string) {
+	var claims jwt.MapClaims
+	_, err := jwt.ParseWithClaims(r.PostForm.Get("subject_token"), &claims, func(token *jwt.Token) (interface{}, error) {
+		if k.HMACSecret != "" {
+			return []byte(k.HMACSecret), nil
+		}
+		return &k.key.PublicKey, nil
+	})
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_token", "Invalid token")
+		return
+	}
+	subject, _ := claims["sub"].(string)
+
+	if requested := r.PostForm.Get("requested_subject"); requested != "" {
+		user := k.users[requested]
+		if subject != "service-account-"+clientID {
+			writeTokenError(w, http.StatusForbidden, "access_denied", "Client not allowed to exchange")
+			return
+		}
+		if user == nil || user.Disabled {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", "Requested subject not found")
+			return
+		}
+		k.issue(w, clientID, user, false, "", "")
+		return
+	}
+	user := k.users[subject]
+	if user == nil || user.Disabled {
+		writeTokenError(w, http.StatusBadRequest, "invalid_token", "Invalid token")
+		return
+	}
+	audience := r.PostForm.Get("audience")
+	if audience == "" {
+		audience = clientID
+	}
+	k.issue(w, clientID, user, false, audience, r.PostForm.Get("scope"))
+}
+
+// issue answers a token response for user, starting a session unless the token is an admin or
+// service account token or an exchanged token for audience, which carries the requested scope.
+// The caller holds mu.
+func (k *Keycloak) issue(w http.ResponseWriter, clientID string, user *KeycloakUser, admin bool, audience, requestedScope string) {
+	now := time.Now()
+	sessionID := uuid.NewString()
+	claims := jwt.MapClaims{
+		"iss":                k.Issuer(),
+		"sub":                user.ID,
+		"aud":                "account",
+		"typ":                "Bearer",
+		"azp":                clientID,
+		"sid":                sessionID,
+		"session_state":      sessionID,
+		"preferred_username": user.Username,
+		"iat":                now.Unix(),
+		"exp":                now.Add(k.TokenTTL).Unix(),
+		"jti":                uuid.NewString(),
+	}
+	if user.Email != "" {
+		claims["email"] = user.Email
+	}
+	scope := "openid profile email"
+	if audience != "" {
+		claims["aud"] = audience
+		delete(claims, "sid")
+		delete(claims, "session_state")
+		sessionID = ""
+		scope = requestedScope
+	}
+
+	var token *jwt.Token
+	var signingKey interface{}
+	if k.HMACSecret != "" {
+		token, signingKey = jwt.NewWithClaims(jwt.SigningMethodHS256, claims), []byte(k.HMACSecret)
+	} else {
+		token, signingKey = jwt.NewWithClaims(jwt.SigningMethodRS256, claims), k.key
+		token.Header["kid"] = k.keyID
+	}
+	accessToken, err := token.SignedString(signingKey)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := gocloak.JWT{
+		AccessToken:      accessToken,
+		ExpiresIn:        int(k.TokenTTL.Seconds()),
+		RefreshExpiresIn: int(30 * time.Minute / time.Second),
+		TokenType:        "Bearer",
+		SessionState:     sessionID,
+		Scope:            scope,
+	}
+	switch {
+	case admin:
+		k.admin[accessToken] = true
+	case audience != "":
+		// Exchanged tokens belong to no session and cannot be refreshed
+	default:
+		response.RefreshToken = uuid.NewString()
+		k.sessions[sessionID] = user.ID
+		k.refresh[response.RefreshToken] = sessionID
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (k *Keycloak) certs(w http.ResponseWriter) {
+	public := k.key.PublicKey
+	encode := func(b []byte) *string {
+		s := base64.RawURLEncoding.EncodeToString(b)
+		return &s
+	}
+	json.NewEncoder(w).Encode(gocloak.CertResponse{Keys: &[]gocloak.CertResponseKey{{
+		Kid: gocloak.StringP(k.keyID),
+		Kty: gocloak.StringP("RSA"),
+		Alg: gocloak.StringP("RS256"),
+		Use: gocloak.StringP("sig"),
+		N:   encode(public.N.Bytes()),
+		E:   encode(big.NewInt(int64(public.E)).Bytes()),
+	}}})
+}
+
+// adminUsers serves the admin user APIs; segments is the path below /users. The caller holds mu.
+func (k *Keycloak) adminUsers(w http.ResponseWriter, r *http.Request, body json.RawMessage, segments []string) {
+	if segments[0] == "" {
+		switch r.Method {
+		case http.MethodPost:
+			k.createUser(w, body)
+		case http.MethodGet:
+			k.searchUsers(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "HTTP 405 Method Not Allowed")
+		}
+		return
+	}
+
+	user := k.users[segments[0]]
+	if user == nil {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	action := strings.Join(segments[1:], "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(representation(user))
+	case action == "" && r.Method == http.MethodPut:
+		var update gocloak.User
+		if err := json.Unmarshal(body, &update); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid user representation")
+			return
+		}
+		if update.Email != nil && *update.Email != user.Email && k.findUser(*update.Email) != nil {
+			writeError(w, http.StatusConflict, "User exists with same email")
+			return
+		}
+		apply(user, update)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" && r.Method == http.MethodDelete:
+		delete(k.users, user.ID)
+		k.logout(user.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "reset-password" && r.Method == http.MethodPut:
+		var credential gocloak.CredentialRepresentation
+		if err := json.Unmarshal(body, &credential); err != nil || credential.Value == nil {
+			writeError(w, http.StatusBadRequest, "Invalid credential representation")
+			return
+		}
+		user.Password = *credential.Value
+		w.WriteHeader(http.StatusNoContent)
+	case action == "credentials" && r.Method == http.MethodGet:
+		credentials := []gocloak.CredentialRepresentation{}
+		if user.Password != "" {
+			credentials = append(credentials, gocloak.CredentialRepresentation{ID: gocloak.StringP(user.ID + "-password"), Type: gocloak.StringP("password")})
+		}
+		json.NewEncoder(w).Encode(credentials)
+	case strings.HasPrefix(action, "credentials/") && r.Method == http.MethodDelete:
+		if action != "credentials/"+user.ID+"-password" || user.Password == "" {
+			writeError(w, http.StatusNotFound, "Credential not found")
+			return
+		}
+		user.Password = ""
+		w.WriteHeader(http.StatusNoContent)
+	case action == "logout" && r.Method == http.MethodPost:
+		k.logout(user.ID)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "federated-identity" && r.Method == http.MethodGet:
+		identities := append([]gocloak.FederatedIdentityRepresentation{}, user.Identities...)
+		json.NewEncoder(w).Encode(identities)
+	case strings.HasPrefix(action, "federated-identity/") && r.Method == http.MethodDelete:
+		provider := strings.TrimPrefix(action, "federated-identity/")
+		for i, identity := range user.Identities {
+			if gocloak.PString(identity.IdentityProvider) == provider {
+				user.Identities = append(user.Identities[:i], user.Identities[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "Federated identity not found")
+	default:
+		writeError(w, http.StatusNotFound, "Unable to find matching target resource method")
+	}
+}
+
+// createUser answers 201 with the new user's location, or 409 when the username or email is taken
+func (k *Keycloak) createUser(w http.ResponseWriter, body json.RawMessage) {
+	var created gocloak.User
+	if err := json.Unmarshal(body, &created); err != nil || gocloak.PString(created.Username) == "" {
+		writeError(w, http.StatusBadRequest, "Invalid user representation")
+		return
+	}
+	if k.findUser(*created.Username) != nil {
+		writeError(w, http.StatusConflict, "User exists with same username")
+		return
+	}
+	if email := gocloak.PString(created.Email); email != "" && k.findUser(email) != nil {
+		writeError(w, http.StatusConflict, "User exists with same email")
+		return
+	}
+	user := &KeycloakUser{ID: uuid.NewString(), Username: strings.ToLower(*created.Username)}
+	apply(user, created)
+	k.users[user.ID] = user
+	w.Header().Set("Location", k.URL+"/admin/realms/"+k.Realm+"/users/"+user.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// searchUsers filters by the username, email and exact query parameters like Keycloak does
+func (k *Keycloak) searchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	exact := query.Get("exact") == "true"
+	matches := func(value, filter string) bool {
+		if filter == "" {
+			return true
+		}
+		if exact {
+			return strings.EqualFold(value, filter)
+		}
+		return strings.Contains(strings.ToLower(value), strings.ToLower(filter))
+	}
+	users := []gocloak.User{}
+	for _, user := range k.users {
+		if matches(user.Username, query.Get("username")) && matches(user.Email, query.Get("email")) {
+			users = append(users, representation(user))
+		}
+	}
+	json.NewEncoder(w).Encode(users)
+}
+
+// findUser returns the user whose username or email is login, case-insensitively. The caller
+// holds mu.
+func (k *Keycloak) findUser(login string) *KeycloakUser {
+	for _, user := range k.users {
+		if strings.EqualFold(user.Username, login) || (user.Email != "" && strings.EqualFold(user.Email, login)) {
+			return user
+		}
+	}
+	return nil
+}
+
+// logout ends the sessions of the user with id. The caller holds mu.
+func (k *Keycloak) logout(id string) {
+	for sessionID, userID := range k.sessions {
+		if userID == id {
+			delete(k.sessions, sessionID)
+		}
+	}
+	k.dropRefreshTokens()
+}
+
+// dropRefreshTokens forgets the refresh tokens of ended sessions. The caller holds mu.
+func (k *Keycloak) dropRefreshTokens() {
+	for token, sessionID := range k.refresh {
+		if _, ok := k.sessions[sessionID]; !ok {
+			delete(k.refresh, token)
+		}
+	}
+}
+
+// apply copies the fields set in update onto user
+func apply(user *KeycloakUser, update gocloak.User) {
+	if update.Email != nil {
+		user.Email = strings.ToLower(*update.Email)
+	}
+	if update.FirstName != nil {
+		user.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		user.LastName = *update.LastName
+	}
+	if update.Enabled != nil {
+		user.Disabled = !*update.Enabled
+	}
+	if update.Attributes != nil {
+		user.Attributes = *update.Attributes
+	}
+}
+
+func representation(user *KeycloakUser) gocloak.User {
+	represented := gocloak.User{
+		ID:        gocloak.StringP(user.ID),
+		Username:  gocloak.StringP(user.Username),
+		Email:     gocloak.StringP(user.Email),
+		FirstName: gocloak.StringP(user.FirstName),
+		LastName:  gocloak.StringP(user.LastName),
+		Enabled:   gocloak.BoolP(!user.Disabled),
+	}
+	if user.Attributes != nil {
+		represented.Attributes = &user.Attributes
+	}
+	return represented
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"errorMessage": message})
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
@@ -0,0 +1,85 @@
+package testsupport
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeycloakIssuesVerifiableTokens(t *testing.T) {
+	kc := NewKeycloak(t, "base")
+	id := kc.AddUser(KeycloakUser{Username: "alice", Email: "alice@example.com", Password: "secret"})
+	client := gocloak.NewClient(kc.URL)
+	ctx := context.Background()
+
+	token, err := client.Login(ctx, kc.ClientID, kc.ClientSecret, kc.Realm, "alice", "secret")
+	require.NoError(t, err)
+	assert.NotEmpty(t, token.RefreshToken)
+	assert.Equal(t, 1, kc.Sessions(id))
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token.AccessToken, claims, func(*jwt.Token) (interface{}, error) { return kc.PublicKey(), nil },
+		jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(kc.Issuer()))
+	require.NoError(t, err)
+	assert.Equal(t, id, claims["sub"])
+	assert.Equal(t, token.SessionState, claims["sid"])
+
+	certs, err := client.GetCerts(ctx, kc.Realm)
+	require.NoError(t, err)
+	require.Len(t, *certs.Keys, 1)
+	assert.Equal(t, "RS256", *(*certs.Keys)[0].Alg)
+
+	refreshed, err := client.RefreshToken(ctx, token.RefreshToken, kc.ClientID, kc.ClientSecret, kc.Realm)
+	require.NoError(t, err)
+	assert.NotEqual(t, token.RefreshToken, refreshed.RefreshToken)
+	_, err = client.RefreshToken(ctx, token.RefreshToken, kc.ClientID, kc.ClientSecret, kc.Realm)
+	assert.Error(t, err, "refresh tokens are single use")
+
+	_, err = client.Login(ctx, kc.ClientID, kc.ClientSecret, kc.Realm, "alice", "wrong")
+	assert.Error(t, err)
+	calls := kc.CallsTo("POST", "/token")
+	last := calls[len(calls)-1]
+	assert.Equal(t, http.StatusUnauthorized, last.Status)
+	assert.Equal(t, "alice", last.Form["username"])
+	assert.NotContains(t, last.Form, "password", "credentials are not recorded")
+}
+
+func TestKeycloakAdminUserAPIs(t *testing.T) {
+	kc := NewKeycloak(t, "base")
+	client := gocloak.NewClient(kc.URL)
+	ctx := context.Background()
+
+	_, err := client.CreateUser(ctx, "not-an-admin-token", kc.Realm, gocloak.User{Username: gocloak.StringP("bob")})
+	assert.Error(t, err, "admin APIs need an admin token")
+
+	admin, err := client.LoginAdmin(ctx, kc.AdminUsername, kc.AdminPassword, kc.Realm)
+	require.NoError(t, err)
+	id, err := client.CreateUser(ctx, admin.AccessToken, kc.Realm, gocloak.User{Username: gocloak.StringP("Bob"), Email: gocloak.StringP("bob@example.com")})
+	require.NoError(t, err)
+	_, err = client.CreateUser(ctx, admin.AccessToken, kc.Realm, gocloak.User{Username: gocloak.StringP("bob")})
+	assert.Error(t, err, "usernames are unique case-insensitively")
+
+	require.NoError(t, client.SetPassword(ctx, admin.AccessToken, id, kc.Realm, "secret", false))
+	users, err := client.GetUsers(ctx, admin.AccessToken, kc.Realm, gocloak.GetUsersParams{Username: gocloak.StringP("bob"), Exact: gocloak.BoolP(true)})
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, id, *users[0].ID)
+
+	require.NoError(t, client.UpdateUser(ctx, admin.AccessToken, kc.Realm, gocloak.User{ID: &id, Enabled: gocloak.BoolP(false)}))
+	_, err = client.Login(ctx, kc.ClientID, kc.ClientSecret, kc.Realm, "bob", "secret")
+	assert.Error(t, err, "disabled users cannot log in")
+
+	kc.Fail("DELETE", "/users/"+id, http.StatusInternalServerError, `{"error": "unknown_error"}`)
+	assert.Error(t, client.DeleteUser(ctx, admin.AccessToken, kc.Realm, id))
+	require.NoError(t, client.DeleteUser(ctx, admin.AccessToken, kc.Realm, id))
+	assert.Nil(t, kc.User(id))
+
+	calls := kc.CallsTo("PUT", "/reset-password")
+	require.Len(t, calls, 1)
+	assert.Equal(t, http.StatusNoContent, calls[0].Status)
+}
@@ -0,0 +1,140 @@
+package testsupport
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"base-app/pkg/database"
+
+	_ "github.com/lib/pq"
+)
+
+// Postgres modes selected with TEST_DB_MODE
+const (
+	// PostgresExternal uses the server at TEST_DB_HOST and TEST_DB_PORT, by default the one of
+	// docker/docker-compose.test.yml on port 5433. Tests skip when it is unreachable.
+	PostgresExternal = "external"
+	// PostgresEmbedded starts a server from the local Postgres binaries, found in TEST_PG_BIN or PATH
+	PostgresEmbedded = database.EphemeralEmbedded
+	// PostgresDocker starts a throwaway postgres:15 container
+	PostgresDocker = database.EphemeralDocker
+)
+
+var shared struct {
+	once      sync.Once
+	server    *database.Ephemeral
+	external  bool
+	err       error
+	startedBy string
+}
+
+// postgresServer returns the server test databases are created on, starting it on first use
+func postgresServer() (*database.Ephemeral, bool, error) {
+	shared.once.Do(func() {
+		mode := getEnv("TEST_DB_MODE", PostgresExternal)
+		if mode == PostgresExternal {
+			shared.external = true
+			shared.server = &database.Ephemeral{
+				Host:     getEnv("TEST_DB_HOST", "localhost"),
+				Port:     getEnv("TEST_DB_PORT", "5433"),
+				User:     getEnv("TEST_DB_USER", "postgres"),
+				Password: getEnv("TEST_DB_PASSWORD", "postgres"),
+			}
+			return
+		}
+		shared.server, shared.err = database.StartEphemeral(mode, database.EphemeralOptions{BinDir: os.Getenv("TEST_PG_BIN")})
+		shared.startedBy = mode
+	})
+	return shared.server, shared.external, shared.err
+}
+
+// SkipWithoutPostgres skips t when TEST_DB_MODE is external and that server is unreachable, for
+// tests that are optional without a database
+func SkipWithoutPostgres(t testing.TB) {
+	t.Helper()
+	server, external, err := postgresServer()
+	if err != nil || !external {
+		return
+	}
+	if err := ping(server); err != nil {
+		t.Skipf("Test DB not available at %s:%s (set TEST_DB_MODE=embedded or docker to start one): %v", server.Host, server.Port, err)
+	}
+}
+
+// NewTestDatabase creates an empty database for t on the server TEST_DB_MODE selects, and
+// drops it when t ends. Embedded and docker servers are started once per test binary; call
+// Main from TestMain to stop them afterwards. Like SkipWithoutPostgres, it skips t when the
+// external server is unreachable.
+func NewTestDatabase(t testing.TB) *sql.DB {
+	t.Helper()
+	SkipWithoutPostgres(t)
+	server, _, err := postgresServer()
+	if err != nil {
+		t.Fatalf("testsupport: start Postgres: %v", err)
+	}
+
+	admin, err := sql.Open("postgres", server.DSN("postgres"))
+	if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+	defer admin.Close()
+
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	name := "test_" + hex.EncodeToString(suffix)
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("testsupport: create database: %v", err)
+	}
+
+	db, err := sql.Open("postgres", server.DSN(name))
+	if err != nil {
+		t.Fatalf("testsupport: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		admin, err := sql.Open("postgres", server.DSN("postgres"))
+		if err != nil {
+			return
+		}
+		defer admin.Close()
+		admin.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1`, name)
+		if _, err := admin.Exec("DROP DATABASE IF EXISTS " + name); err != nil {
+			t.Logf("testsupport: drop database %s: %v", name, err)
+		}
+	})
+	return db
+}
+
+// Main runs the tests of m and stops the Postgres server NewTestDatabase started, if any
+//
+//	func TestMain(m *testing.M) { testsupport.Main(m) }
+func Main(m *testing.M) {
+	code := m.Run()
+	if shared.startedBy != "" && shared.server != nil {
+		if err := shared.server.Stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "testsupport: stop %s Postgres: %v\n", shared.startedBy, err)
+		}
+	}
+	os.Exit(code)
+}
+
+func ping(server *database.Ephemeral) error {
+	db, err := sql.Open("postgres", server.DSN("postgres"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Ping()
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,84 @@
+package trash
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/httpapi"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where the trash is served
+const Path = "/api/trash"
+
+// BulkRequest names the items to restore or purge
+type BulkRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BulkResponse reports the outcome of each item
+type BulkResponse struct {
+	Results []Result `json:"results"`
+}
+
+// ListHandler handles GET /api/trash, of one kind with ?kind=role
+func ListHandler(bin *Bin, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		page, ok := httpapi.ParsePage(w, r)
+		if !ok {
+			return
+		}
+
+		items, err := bin.List(r.Context(), viewer(r), r.URL.Query().Get("kind"))
+		if err != nil {
+			httpapi.WriteError(w, err, "Failed to list trash")
+			return
+		}
+
+		httpapi.WriteList(w, r, httpapi.Paginate(items, page), len(items), page)
+	}
+}
+
+// bulkHandler decodes a BulkRequest and answers with the results of action
+func bulkHandler(viewer func(r *http.Request) fieldfilter.Viewer, action func(r *http.Request, v fieldfilter.Viewer, ids []string) ([]Result, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpapi.WriteErrorResponse(w, http.StatusBadRequest, "Invalid request body", "INVALID_REQUEST", nil)
+			return
+		}
+
+		results, err := action(r, viewer(r), req.IDs)
+		if err != nil {
+			httpapi.WriteError(w, err, "Trash action failed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BulkResponse{Results: results})
+	}
+}
+
+// RestoreHandler handles POST /api/trash/restore
+func RestoreHandler(bin *Bin, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return bulkHandler(viewer, func(r *http.Request, v fieldfilter.Viewer, ids []string) ([]Result, error) {
+		return bin.Restore(r.Context(), v, ids)
+	})
+}
+
+// PurgeHandler handles POST /api/trash/purge
+func PurgeHandler(bin *Bin, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return bulkHandler(viewer, func(r *http.Request, v fieldfilter.Viewer, ids []string) ([]Result, error) {
+		return bin.Purge(r.Context(), v, ids)
+	})
+}
+
+// Mount registers the trash endpoints at Path, wrapped by protect. Each item additionally
+// requires the permission of its kind.
+func Mount(r *mux.Router, bin *Bin, viewer func(r *http.Request) fieldfilter.Viewer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(ListHandler(bin, viewer))).Methods("GET")
+	r.HandleFunc(Path+"/restore", protect(RestoreHandler(bin, viewer))).Methods("POST")
+	r.HandleFunc(Path+"/purge", protect(PurgeHandler(bin, viewer))).Methods("POST")
+}
@@ -0,0 +1,81 @@
+package trash
+
+import (
+	"database/sql"
+	"time"
+
+	"base-app/pkg/database"
+
+	"github.com/lib/pq"
+)
+
+// Store keeps trash items. The Postgres store expects this table:
+//
+//	CREATE TABLE trash_items (
+//		id UUID PRIMARY KEY,
+//		kind VARCHAR(20) NOT NULL,
+//		entity_id VARCHAR NOT NULL,
+//		name VARCHAR NOT NULL DEFAULT '',
+//		deleted_by VARCHAR NOT NULL DEFAULT '',
+//		deleted_at TIMESTAMP NOT NULL,
+//		purge_at TIMESTAMP NOT NULL,
+//		data JSONB NOT NULL
+//	)
+type Store interface {
+	Create(item *Item) error
+	// Get returns the item with id, or nil
+	Get(id string) (*Item, error)
+	// List returns the items of kinds, most recently deleted first
+	List(kinds []string) ([]*Item, error)
+	// ListPurgeDue returns the items to purge at the given time
+	ListPurgeDue(at time.Time) ([]*Item, error)
+	Delete(id string) error
+}
+
+// store implements Store on Postgres
+type store struct {
+	db database.DBTX
+}
+
+// NewStore creates a Postgres trash store
+func NewStore(db *sql.DB) Store {
+	return &store{db: db}
+}
+
+const itemSelect = `SELECT id, kind, entity_id, name, deleted_by, deleted_at, purge_at, data FROM trash_items`
+
+func scanItem(row database.Scanner) (*Item, error) {
+	item := &Item{}
+	var data []byte
+	err := row.Scan(&item.ID, &item.Kind, &item.EntityID, &item.Name, &item.DeletedBy, &item.DeletedAt, &item.PurgeAt, &data)
+	item.Data = data
+	return item, err
+}
+
+func (s *store) Create(item *Item) error {
+	query := `INSERT INTO trash_items (id, kind, entity_id, name, deleted_by, deleted_at, purge_at, data)
+	          VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	_, err := s.db.Exec(query, item.ID, item.Kind, item.EntityID, item.Name, item.DeletedBy, item.DeletedAt, item.PurgeAt, string(item.Data))
+	return err
+}
+
+func (s *store) Get(id string) (*Item, error) {
+	item, err := scanItem(s.db.QueryRow(itemSelect+` WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+func (s *store) List(kinds []string) ([]*Item, error) {
+	return database.QueryAll(s.db, "list trash", scanItem, itemSelect+` WHERE kind = ANY($1) ORDER BY deleted_at DESC`, pq.Array(kinds))
+}
+
+func (s *store) ListPurgeDue(at time.Time) ([]*Item, error) {
+	return database.QueryAll(s.db, "list purge-due trash", scanItem, itemSelect+` WHERE purge_at <= $1 ORDER BY purge_at`, at)
+}
+
+func (s *store) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM trash_items WHERE id = $1`, id)
+	return err
+}
@@ -0,0 +1,280 @@
+// Package trash keeps deleted users, roles and groups restorable for a while. Modules put a
+// snapshot of an entity in the bin when it is deleted and register how to restore it and how
+// to finish deleting it; the bin purges items when asked to or once their retention ends.
+package trash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/perm"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetention is how long deleted entities stay restorable
+const DefaultRetention = 30 * 24 * time.Hour
+
+// MaxBulkItems bounds the items one restore or purge request may name
+const MaxBulkItems = 100
+
+// Item is a deleted entity in the bin
+type Item struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	EntityID string `json:"entity_id"`
+	Name     string `json:"name"`
+	// DeletedBy is the Keycloak ID of the user who deleted the entity, when known
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	// PurgeAt is when the item is purged unless it is restored first
+	PurgeAt time.Time `json:"purge_at"`
+	// Data is the snapshot the owning module restores the entity from
+	Data json.RawMessage `json:"-"`
+}
+
+// Kind describes a kind of entity the bin holds
+type Kind struct {
+	Name string
+	// Permission is needed to see, restore and purge items of the kind
+	Permission perm.Name
+	// Restore recreates the entity from item
+	Restore func(ctx context.Context, item *Item) error
+	// Purge finishes deleting the entity, e.g. at the identity provider; nil when the snapshot
+	// is all that is left
+	Purge func(ctx context.Context, item *Item) error
+}
+
+// Result is the outcome of restoring or purging one item, in request order
+type Result struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Result statuses
+const (
+	StatusRestored = "restored"
+	StatusPurged   = "purged"
+	StatusFailed   = "failed"
+)
+
+// Bin holds deleted entities of the registered kinds
+type Bin struct {
+	store     Store
+	kinds     map[string]Kind
+	retention time.Duration
+	logger    *logrus.Logger
+}
+
+// NewBin creates a bin on store keeping items for DefaultRetention
+func NewBin(store Store, logger *logrus.Logger) *Bin {
+	return &Bin{store: store, kinds: make(map[string]Kind), retention: DefaultRetention, logger: logger}
+}
+
+// SetRetention changes how long items stay restorable. Set it before serving requests.
+func (b *Bin) SetRetention(retention time.Duration) {
+	b.retention = retention
+}
+
+// Register adds a kind of entity. Register kinds before serving requests.
+func (b *Bin) Register(kind Kind) {
+	b.kinds[kind.Name] = kind
+}
+
+// Put stores a snapshot of a deleted entity and returns the item, so the caller can Discard it
+// when the deletion itself fails. deletedBy is the Keycloak ID of the deleting user.
+func (b *Bin) Put(ctx context.Context, kind, entityID, name, deletedBy string, snapshot interface{}) (*Item, error) {
+	if _, ok := b.kinds[kind]; !ok {
+		return nil, fmt.Errorf("trash: kind %q is not registered", kind)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	item := &Item{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		EntityID:  entityID,
+		Name:      name,
+		DeletedBy: deletedBy,
+		DeletedAt: now,
+		PurgeAt:   now.Add(b.retention),
+		Data:      data,
+	}
+	if err := b.store.Create(item); err != nil {
+		b.logger.WithContext(ctx).WithError(err).WithField("kind", kind).Error("Failed to put item in the trash")
+		return nil, err
+	}
+	return item, nil
+}
+
+// Discard forgets an item whose deletion did not happen
+func (b *Bin) Discard(ctx context.Context, item *Item) {
+	if err := b.store.Delete(item.ID); err != nil {
+		b.logger.WithContext(ctx).WithError(err).WithField("trash_id", item.ID).Error("Failed to discard trash item")
+	}
+}
+
+// visibleKinds returns the kinds viewer may see, or only kind when it is not empty
+func (b *Bin) visibleKinds(viewer fieldfilter.Viewer, kind string) ([]string, error) {
+	if kind != "" {
+		k, ok := b.kinds[kind]
+		if !ok {
+			return nil, apperrors.Invalid("UNKNOWN_TRASH_KIND", fmt.Sprintf("The trash holds no %q items", kind))
+		}
+		if !viewer.Can(string(k.Permission)) {
+			return nil, apperrors.Forbidden("FORBIDDEN", "Missing permission "+string(k.Permission))
+		}
+		return []string{kind}, nil
+	}
+	var kinds []string
+	for name, k := range b.kinds {
+		if viewer.Can(string(k.Permission)) {
+			kinds = append(kinds, name)
+		}
+	}
+	return kinds, nil
+}
+
+// List returns the items viewer may see, most recently deleted first, of one kind unless kind
+// is empty
+func (b *Bin) List(ctx context.Context, viewer fieldfilter.Viewer, kind string) ([]*Item, error) {
+	kinds, err := b.visibleKinds(viewer, kind)
+	if err != nil {
+		return nil, err
+	}
+	if len(kinds) == 0 {
+		return []*Item{}, nil
+	}
+	items, err := b.store.List(kinds)
+	if err != nil {
+		b.logger.WithContext(ctx).WithError(err).Error("Failed to list trash")
+		return nil, err
+	}
+	return items, nil
+}
+
+// get returns the item with id when viewer may act on it
+func (b *Bin) get(viewer fieldfilter.Viewer, id string) (*Item, Kind, error) {
+	item, err := b.store.Get(id)
+	if err != nil {
+		return nil, Kind{}, err
+	}
+	if item == nil {
+		return nil, Kind{}, apperrors.NotFound("TRASH_ITEM_NOT_FOUND", "Trash item not found")
+	}
+	kind, ok := b.kinds[item.Kind]
+	if !ok || !viewer.Can(string(kind.Permission)) {
+		// Items the viewer may not see are not found, so their IDs cannot be probed
+		return nil, Kind{}, apperrors.NotFound("TRASH_ITEM_NOT_FOUND", "Trash item not found")
+	}
+	return item, kind, nil
+}
+
+// Restore recreates the entities of the items with ids and removes the items from the bin. Each
+// item succeeds or fails on its own.
+func (b *Bin) Restore(ctx context.Context, viewer fieldfilter.Viewer, ids []string) ([]Result, error) {
+	return b.each(ctx, viewer, ids, StatusRestored, func(item *Item, kind Kind) error {
+		if err := kind.Restore(ctx, item); err != nil {
+			return err
+		}
+		return b.store.Delete(item.ID)
+	})
+}
+
+// Purge finishes deleting the entities of the items with ids and removes the items from the bin.
+// Each item succeeds or fails on its own.
+func (b *Bin) Purge(ctx context.Context, viewer fieldfilter.Viewer, ids []string) ([]Result, error) {
+	return b.each(ctx, viewer, ids, StatusPurged, func(item *Item, kind Kind) error {
+		return b.purge(ctx, item, kind)
+	})
+}
+
+func (b *Bin) purge(ctx context.Context, item *Item, kind Kind) error {
+	if kind.Purge != nil {
+		if err := kind.Purge(ctx, item); err != nil {
+			return err
+		}
+	}
+	return b.store.Delete(item.ID)
+}
+
+// each applies fn to the items with ids and reports the outcome of each
+func (b *Bin) each(ctx context.Context, viewer fieldfilter.Viewer, ids []string, status string, fn func(item *Item, kind Kind) error) ([]Result, error) {
+	if len(ids) == 0 {
+		return nil, apperrors.Invalid("NO_TRASH_ITEMS", "ids must name at least one item")
+	}
+	if len(ids) > MaxBulkItems {
+		return nil, apperrors.TooLarge("LIST_TOO_LARGE", fmt.Sprintf("ids has %d items; at most %d are accepted", len(ids), MaxBulkItems))
+	}
+	results := make([]Result, len(ids))
+	for i, id := range ids {
+		results[i] = Result{ID: id, Status: status}
+		item, kind, err := b.get(viewer, id)
+		if err == nil {
+			err = fn(item, kind)
+		}
+		if err != nil {
+			results[i].Status = StatusFailed
+			if appErr, ok := apperrors.As(err); ok {
+				results[i].Code, results[i].Error = appErr.Code, appErr.Message
+			} else {
+				b.logger.WithContext(ctx).WithError(err).WithField("trash_id", id).Error("Trash action failed")
+				results[i].Code, results[i].Error = "INTERNAL_ERROR", "Action failed"
+			}
+			continue
+		}
+		b.logger.WithContext(ctx).WithFields(logrus.Fields{"trash_id": id, "kind": item.Kind, "entity_id": item.EntityID}).Info("Trash item " + status)
+	}
+	return results, nil
+}
+
+// PurgeExpired purges the items whose retention has ended
+func (b *Bin) PurgeExpired(ctx context.Context) error {
+	items, err := b.store.ListPurgeDue(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	purged := 0
+	for _, item := range items {
+		kind, ok := b.kinds[item.Kind]
+		if !ok {
+			continue
+		}
+		if err := b.purge(ctx, item, kind); err != nil {
+			b.logger.WithContext(ctx).WithError(err).WithField("trash_id", item.ID).Error("Failed to purge expired trash item")
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		b.logger.WithContext(ctx).WithField("items", purged).Info("Purged expired trash")
+	}
+	return nil
+}
+
+// StartPurging runs PurgeExpired every interval until ctx is cancelled
+func (b *Bin) StartPurging(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := b.PurgeExpired(ctx); err != nil {
+					b.logger.WithError(err).Error("Failed to purge expired trash")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,209 @@
+package trash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"base-app/pkg/apperrors"
+	"base-app/pkg/fieldfilter"
+	"base-app/pkg/perm"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryStore keeps trash items in memory
+type memoryStore map[string]*Item
+
+func (s memoryStore) Create(item *Item) error {
+	s[item.ID] = item
+	return nil
+}
+
+func (s memoryStore) Get(id string) (*Item, error) {
+	return s[id], nil
+}
+
+func (s memoryStore) List(kinds []string) ([]*Item, error) {
+	var items []*Item
+	for _, item := range s {
+		for _, kind := range kinds {
+			if item.Kind == kind {
+				items = append(items, item)
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+	return items, nil
+}
+
+func (s memoryStore) ListPurgeDue(at time.Time) ([]*Item, error) {
+	var items []*Item
+	for _, item := range s {
+		if !item.PurgeAt.After(at) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s memoryStore) Delete(id string) error {
+	delete(s, id)
+	return nil
+}
+
+// testBin holds roles, which fail to restore while their name is taken, and users
+func testBin(t *testing.T) (*Bin, memoryStore, map[string]string) {
+	store := memoryStore{}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	bin := NewBin(store, logger)
+	events := make(map[string]string)
+	bin.Register(Kind{
+		Name:       "role",
+		Permission: perm.DeleteRole,
+		Restore: func(_ context.Context, item *Item) error {
+			if item.Name == "taken" {
+				return apperrors.Conflict("ROLE_NAME_TAKEN", "Another role is now named taken")
+			}
+			events[item.EntityID] = "restored"
+			return nil
+		},
+		Purge: func(_ context.Context, item *Item) error {
+			events[item.EntityID] = "purged"
+			return nil
+		},
+	})
+	bin.Register(Kind{
+		Name:       "user",
+		Permission: perm.DeleteUser,
+		Restore: func(_ context.Context, item *Item) error {
+			events[item.EntityID] = "restored"
+			return nil
+		},
+	})
+	return bin, store, events
+}
+
+func TestListShowsPermittedKinds(t *testing.T) {
+	bin, _, _ := testBin(t)
+	ctx := context.Background()
+	_, err := bin.Put(ctx, "role", "r1", "editor", "admin", map[string]string{"name": "editor"})
+	require.NoError(t, err)
+	_, err = bin.Put(ctx, "user", "u1", "alice", "admin", nil)
+	require.NoError(t, err)
+	_, err = bin.Put(ctx, "widget", "w1", "", "", nil)
+	assert.Error(t, err, "unregistered kinds are rejected")
+
+	roleAdmin := fieldfilter.Viewer{UserID: "a", Permissions: []string{string(perm.DeleteRole)}}
+	items, err := bin.List(ctx, roleAdmin, "")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, "r1", items[0].EntityID)
+	assert.Equal(t, "admin", items[0].DeletedBy)
+	assert.WithinDuration(t, items[0].DeletedAt.Add(DefaultRetention), items[0].PurgeAt, time.Second)
+
+	_, err = bin.List(ctx, roleAdmin, "user")
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, apperrors.KindForbidden, appErr.Kind)
+
+	_, err = bin.List(ctx, roleAdmin, "widget")
+	appErr, ok = apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "UNKNOWN_TRASH_KIND", appErr.Code)
+
+	items, err = bin.List(ctx, fieldfilter.Viewer{UserID: "b"}, "")
+	require.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+func TestRestoreAndPurgeReportEachItem(t *testing.T) {
+	bin, store, events := testBin(t)
+	ctx := context.Background()
+	editor, _ := bin.Put(ctx, "role", "r1", "editor", "", nil)
+	taken, _ := bin.Put(ctx, "role", "r2", "taken", "", nil)
+	alice, _ := bin.Put(ctx, "user", "u1", "alice", "", nil)
+	roleAdmin := fieldfilter.Viewer{UserID: "a", Permissions: []string{string(perm.DeleteRole)}}
+
+	results, err := bin.Restore(ctx, roleAdmin, []string{editor.ID, taken.ID, alice.ID, "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, []Result{
+		{ID: editor.ID, Status: StatusRestored},
+		{ID: taken.ID, Status: StatusFailed, Code: "ROLE_NAME_TAKEN", Error: "Another role is now named taken"},
+		{ID: alice.ID, Status: StatusFailed, Code: "TRASH_ITEM_NOT_FOUND", Error: "Trash item not found"},
+		{ID: "missing", Status: StatusFailed, Code: "TRASH_ITEM_NOT_FOUND", Error: "Trash item not found"},
+	}, results)
+	assert.Equal(t, "restored", events["r1"])
+	assert.NotContains(t, store, editor.ID)
+	assert.Contains(t, store, taken.ID, "failed restores stay in the trash")
+
+	results, err = bin.Purge(ctx, roleAdmin, []string{taken.ID})
+	require.NoError(t, err)
+	assert.Equal(t, StatusPurged, results[0].Status)
+	assert.Equal(t, "purged", events["r2"])
+	assert.NotContains(t, store, taken.ID)
+
+	_, err = bin.Restore(ctx, roleAdmin, nil)
+	assert.Error(t, err)
+	_, err = bin.Purge(ctx, roleAdmin, make([]string, MaxBulkItems+1))
+	appErr, ok := apperrors.As(err)
+	require.True(t, ok)
+	assert.Equal(t, "LIST_TOO_LARGE", appErr.Code)
+}
+
+func TestPurgeExpired(t *testing.T) {
+	bin, store, events := testBin(t)
+	ctx := context.Background()
+	bin.SetRetention(-time.Minute)
+	expired, _ := bin.Put(ctx, "role", "r1", "old", "", nil)
+	bin.SetRetention(time.Hour)
+	kept, _ := bin.Put(ctx, "role", "r2", "new", "", nil)
+
+	require.NoError(t, bin.PurgeExpired(ctx))
+	assert.NotContains(t, store, expired.ID)
+	assert.Contains(t, store, kept.ID)
+	assert.Equal(t, "purged", events["r1"])
+}
+
+func TestTrashEndpoints(t *testing.T) {
+	bin, _, _ := testBin(t)
+	item, _ := bin.Put(context.Background(), "role", "r1", "editor", "", map[string]string{"snapshot": "private"})
+	r := mux.NewRouter()
+	protected := 0
+	viewer := func(*http.Request) fieldfilter.Viewer {
+		return fieldfilter.Viewer{UserID: "a", Permissions: []string{string(perm.DeleteRole)}}
+	}
+	Mount(r, bin, viewer, func(handler http.HandlerFunc) http.HandlerFunc {
+		protected++
+		return handler
+	})
+	assert.Equal(t, 3, protected)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, Path+"?kind=role", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"entity_id":"r1"`)
+	assert.NotContains(t, rec.Body.String(), "private", "snapshots are not listed")
+
+	body, _ := json.Marshal(BulkRequest{IDs: []string{item.ID}})
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, Path+"/restore", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp BulkResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, []Result{{ID: item.ID, Status: StatusRestored}}, resp.Results)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, Path+"/purge", bytes.NewReader([]byte("{"))))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,116 @@
+// Package uimanifest tells the frontend which menus and features the caller may use. The
+// mapping from permissions to capabilities is configuration (see config.UICapability), so the
+// frontend checks stable capability keys instead of hardcoding permission names.
+package uimanifest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"base-app/pkg/fieldfilter"
+
+	"github.com/gorilla/mux"
+)
+
+// Path is where Mount serves the manifest
+const Path = "/api/ui/manifest"
+
+// Capability is a menu entry or feature granted to callers holding its permissions
+type Capability struct {
+	Key     string
+	Kind    string
+	Label   string
+	Path    string
+	AllOf   []string
+	AnyOf   []string
+	Feature string
+}
+
+// Kinds of capability
+const (
+	KindMenu    = "menu"
+	KindFeature = "feature"
+)
+
+// MenuEntry is a menu entry the caller may see
+type MenuEntry struct {
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+// Manifest lists the caller's menu entries in configured order, and every feature with whether
+// the caller may use it
+type Manifest struct {
+	Menu     []MenuEntry     `json:"menu"`
+	Features map[string]bool `json:"features"`
+}
+
+// Builder builds manifests from the current capabilities
+type Builder struct {
+	capabilities   atomic.Pointer[[]Capability]
+	featureEnabled func(name string) bool
+}
+
+// NewBuilder creates a builder; featureEnabled reports whether a feature flag is on
+func NewBuilder(capabilities []Capability, featureEnabled func(name string) bool) *Builder {
+	b := &Builder{featureEnabled: featureEnabled}
+	b.SetCapabilities(capabilities)
+	return b
+}
+
+// SetCapabilities replaces the capabilities for subsequent manifests
+func (b *Builder) SetCapabilities(capabilities []Capability) {
+	b.capabilities.Store(&capabilities)
+}
+
+// Build returns the manifest of viewer
+func (b *Builder) Build(viewer fieldfilter.Viewer) Manifest {
+	manifest := Manifest{Menu: []MenuEntry{}, Features: make(map[string]bool)}
+	for _, c := range *b.capabilities.Load() {
+		granted := b.grants(c, viewer)
+		switch c.Kind {
+		case KindMenu:
+			if granted {
+				manifest.Menu = append(manifest.Menu, MenuEntry{Key: c.Key, Label: c.Label, Path: c.Path})
+			}
+		case KindFeature:
+			manifest.Features[c.Key] = granted
+		}
+	}
+	return manifest
+}
+
+func (b *Builder) grants(c Capability, viewer fieldfilter.Viewer) bool {
+	if c.Feature != "" && !b.featureEnabled(c.Feature) {
+		return false
+	}
+	for _, name := range c.AllOf {
+		if !viewer.Can(name) {
+			return false
+		}
+	}
+	if len(c.AnyOf) == 0 {
+		return true
+	}
+	for _, name := range c.AnyOf {
+		if viewer.Can(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler handles GET /api/ui/manifest; viewer identifies the caller
+func Handler(b *Builder, viewer func(r *http.Request) fieldfilter.Viewer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b.Build(viewer(r)))
+	}
+}
+
+// Mount registers the manifest endpoint at Path, wrapped by protect
+func Mount(r *mux.Router, b *Builder, viewer func(r *http.Request) fieldfilter.Viewer, protect func(http.HandlerFunc) http.HandlerFunc) {
+	r.HandleFunc(Path, protect(Handler(b, viewer))).Methods("GET")
+}
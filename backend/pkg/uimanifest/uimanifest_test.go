@@ -0,0 +1,60 @@
+package uimanifest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"base-app/pkg/fieldfilter"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testCapabilities = []Capability{
+	{Key: "menu.dashboard", Kind: KindMenu, Label: "Dashboard", Path: "/dashboard"},
+	{Key: "menu.users", Kind: KindMenu, Label: "Users", Path: "/users", AllOf: []string{"read_user"}},
+	{Key: "menu.reports", Kind: KindMenu, Label: "Reports", Path: "/reports", AllOf: []string{"view_reports"}, Feature: "reports"},
+	{Key: "feature.users.edit", Kind: KindFeature, AllOf: []string{"read_user"}, AnyOf: []string{"update_user", "delete_user"}},
+	{Key: "feature.roles.edit", Kind: KindFeature, AnyOf: []string{"update_role"}},
+}
+
+func TestBuild(t *testing.T) {
+	flags := map[string]bool{}
+	b := NewBuilder(testCapabilities, func(name string) bool { return flags[name] })
+
+	manifest := b.Build(fieldfilter.Viewer{UserID: "u1", Permissions: []string{"read_user", "delete_user", "view_reports"}})
+	assert.Equal(t, []MenuEntry{
+		{Key: "menu.dashboard", Label: "Dashboard", Path: "/dashboard"},
+		{Key: "menu.users", Label: "Users", Path: "/users"},
+	}, manifest.Menu, "menus behind a disabled feature flag are hidden")
+	assert.Equal(t, map[string]bool{"feature.users.edit": true, "feature.roles.edit": false}, manifest.Features)
+
+	flags["reports"] = true
+	assert.Len(t, b.Build(fieldfilter.Viewer{UserID: "u1", Permissions: []string{"view_reports"}}).Menu, 2)
+
+	// AnyOf alone is not enough when AllOf is missing
+	assert.False(t, b.Build(fieldfilter.Viewer{UserID: "u1", Permissions: []string{"update_user"}}).Features["feature.users.edit"])
+
+	b.SetCapabilities(testCapabilities[:1])
+	assert.Empty(t, b.Build(fieldfilter.Viewer{UserID: "u1"}).Features)
+}
+
+func TestHandler(t *testing.T) {
+	b := NewBuilder(testCapabilities, func(string) bool { return false })
+	r := mux.NewRouter()
+	Mount(r, b, func(*http.Request) fieldfilter.Viewer {
+		return fieldfilter.Viewer{UserID: "u1", Permissions: []string{"update_role"}}
+	}, func(handler http.HandlerFunc) http.HandlerFunc { return handler })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Path, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var manifest Manifest
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &manifest))
+	assert.Equal(t, []MenuEntry{{Key: "menu.dashboard", Label: "Dashboard", Path: "/dashboard"}}, manifest.Menu)
+	assert.True(t, manifest.Features["feature.roles.edit"])
+}